@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Aggregates: a SELECT with GROUP BY or an aggregate function has a row for
+// each group of the rows of its WHERE with the same values of the GROUP BY,
+// in the order of their first row, one of all of them without GROUP BY.
+// The groups are in a hash map of the keys of AppendKey of the values. The
+// columns, the HAVING and the ORDER BY are of the aggregates and of the
+// expressions of the GROUP BY on the rows of a group.
+//
+// COUNT(*) is the rows of the group, COUNT the values not NULL, SUM, MIN,
+// MAX and AVG of those values, NULL if none; SUM of int64s is an int64,
+// AVG a float64. The MIN and MAX of columns of a table alone are read from
+// the first key of an index or the primary key of the column if all the
+// columns are of them and there's no GROUP BY.
+
+// whether a SELECT aggregates
+func isAggregate(s *SelectStmt) bool {
+	if s.GroupBy != nil || s.Having != nil {
+		return true
+	}
+	for _, c := range s.Columns {
+		if !c.Star && hasAggregate(c.Expr) {
+			return true
+		}
+	}
+	for _, o := range s.OrderBy {
+		if hasAggregate(o.Expr) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAggregate(e Expr) bool {
+	switch e := e.(type) {
+	case *FuncExpr:
+		return true
+	case *UnaryExpr:
+		return hasAggregate(e.X)
+	case *BinaryExpr:
+		return hasAggregate(e.X) || hasAggregate(e.Y)
+	case *IsNullExpr:
+		return hasAggregate(e.X)
+	}
+	return false
+}
+
+// an aggregate function of the rows of a group
+type aggregate struct {
+	call *FuncExpr
+	arg  sqlEval // nil for COUNT(*)
+}
+
+// the state of an aggregate in a group
+type aggState struct {
+	count int64
+	value any // sum, min or max
+}
+
+func (a *aggregate) add(st *aggState, row []any) error {
+	if a.arg == nil {
+		st.count++
+		return nil
+	}
+	v, err := a.arg(row)
+	if err != nil || v == nil {
+		return err
+	}
+	st.count++
+	switch a.call.Name {
+	case "SUM", "AVG":
+		if st.value == nil {
+			st.value = int64(0)
+		}
+		sum, err := addSum(st.value, v)
+		if err != nil {
+			return err
+		}
+		st.value = sum
+	case "MIN", "MAX":
+		if st.value == nil {
+			st.value = v
+			return nil
+		}
+		c, err := compareValues(v, st.value)
+		if err != nil {
+			return err
+		}
+		if c < 0 && a.call.Name == "MIN" || c > 0 && a.call.Name == "MAX" {
+			st.value = v
+		}
+	}
+	return nil
+}
+
+func (a *aggregate) result(st *aggState) any {
+	switch a.call.Name {
+	case "COUNT":
+		return st.count
+	case "AVG":
+		if st.count == 0 {
+			return nil
+		}
+		sum, _ := toFloat(st.value)
+		return sum / float64(st.count)
+	}
+	return st.value
+}
+
+// the sum of a SUM and a value, of int64s unless there's a float64
+func addSum(sum, v any) (any, error) {
+	i, iok := sum.(int64)
+	j, jok := v.(int64)
+	if iok && jok {
+		if j > 0 && i > math.MaxInt64-j || j < 0 && i < math.MinInt64-j {
+			return nil, fmt.Errorf("%w: SUM overflows int64", ErrSQL)
+		}
+		return i + j, nil
+	}
+	f, fok := toFloat(sum)
+	g, gok := toFloat(v)
+	if !fok || !gok {
+		return nil, fmt.Errorf("%w: SUM of %T", ErrSQL, v)
+	}
+	return f + g, nil
+}
+
+// the compiler of the expressions on the rows of the groups: the values of
+// the GROUP BY, then those of the aggregates
+type aggregates struct {
+	scope   *sqlScope // of the rows of the tables
+	groupBy []Expr
+	aggs    []*aggregate
+	args    []any
+}
+
+func (a *aggregates) compile(e Expr) (sqlEval, error) {
+	scope := &sqlScope{tables: a.scope.tables, grouped: a.grouped}
+	return compileExpr(e, scope, a.args)
+}
+
+func (a *aggregates) grouped(e Expr) (sqlEval, bool, error) {
+	for i, g := range a.groupBy {
+		if a.sameExpr(e, g) {
+			return func(row []any) (any, error) { return row[i], nil }, true, nil
+		}
+	}
+	switch e := e.(type) {
+	case *FuncExpr:
+		agg := &aggregate{call: e}
+		if !e.Star {
+			var err error
+			if agg.arg, err = compileExpr(e.X, a.scope, a.args); err != nil {
+				return nil, true, err
+			}
+		}
+		i := len(a.groupBy) + len(a.aggs)
+		a.aggs = append(a.aggs, agg)
+		return func(row []any) (any, error) { return row[i], nil }, true, nil
+	case *ColumnRef:
+		if _, err := a.scope.resolve(e); err != nil {
+			return nil, true, err
+		}
+		return nil, true, fmt.Errorf("%w: column %s neither in GROUP BY nor in an aggregate", ErrSQL, exprString(e))
+	}
+	return nil, false, nil
+}
+
+// whether two expressions are the same, the columns by their offset
+func (a *aggregates) sameExpr(x, y Expr) bool {
+	rx, xok := x.(*ColumnRef)
+	ry, yok := y.(*ColumnRef)
+	if xok && yok {
+		i, err := a.scope.resolve(rx)
+		j, err2 := a.scope.resolve(ry)
+		return err == nil && err2 == nil && i == j
+	}
+	return exprString(x) == exprString(y)
+}
+
+// a group of the rows
+type aggGroup struct {
+	values []any // of the GROUP BY
+	states []aggState
+}
+
+// an aggregate SELECT compiled
+type aggQuery struct {
+	*aggregates
+	plans   []*scanPlan // of the rows
+	where   sqlEval     // on the rows joined
+	groups  []sqlEval   // of the GROUP BY
+	columns []string
+	evals   []sqlEval // on the rows of the groups
+	having  sqlEval
+	orders  []sqlEval
+	seeks   []*scanPlan // of the MIN and MAX read from the first key, nil if not
+}
+
+func (tx *Tx) planAggregate(s *SelectStmt, args []any) (*aggQuery, error) {
+	// the groups are sorted, not the rows
+	scope, plans, where, err := tx.planSelect(s, nil, false, args)
+	if err != nil {
+		return nil, err
+	}
+	q := &aggQuery{aggregates: &aggregates{scope: scope, groupBy: s.GroupBy, args: args}, plans: plans, where: where}
+	for _, e := range s.GroupBy {
+		eval, err := compileExpr(e, scope, args)
+		if err != nil {
+			return nil, err
+		}
+		q.groups = append(q.groups, eval)
+	}
+	for _, c := range s.Columns {
+		if c.Star {
+			return nil, fmt.Errorf("%w: * with aggregates", ErrSQL)
+		}
+		eval, err := q.compile(c.Expr)
+		if err != nil {
+			return nil, err
+		}
+		name := c.Alias
+		if name == "" {
+			name = exprString(c.Expr)
+		}
+		q.columns = append(q.columns, name)
+		q.evals = append(q.evals, eval)
+	}
+	if s.Having != nil {
+		if q.having, err = q.compile(s.Having); err != nil {
+			return nil, err
+		}
+	}
+	for _, o := range s.OrderBy {
+		eval, err := q.compileOrder(o.Expr, q.columns, q.evals)
+		if err != nil {
+			return nil, err
+		}
+		q.orders = append(q.orders, eval)
+	}
+	if q.seeks, err = tx.minMaxPlans(s, q.aggregates); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (tx *Tx) execAggregate(s *SelectStmt, limit, offset int64, args []any) (*Result, error) {
+	q, err := tx.planAggregate(s, args)
+	if err != nil {
+		return nil, err
+	}
+	a := q.aggregates
+	var groups []*aggGroup
+	if q.seeks != nil {
+		g := &aggGroup{states: make([]aggState, len(a.aggs))}
+		for i, p := range q.seeks {
+			if err := a.aggs[i].seek(p, &g.states[i]); err != nil {
+				return nil, err
+			}
+		}
+		groups = append(groups, g)
+	} else {
+		byKey := map[string]*aggGroup{}
+		err = scanJoin(q.plans, nil, func(row []any) error {
+			if q.where != nil {
+				v, err := q.where(row)
+				if err != nil || v != true {
+					return err
+				}
+			}
+			values := make([]any, len(q.groups))
+			for i, eval := range q.groups {
+				v, err := eval(row)
+				if err != nil {
+					return err
+				}
+				values[i] = v
+			}
+			key, err := AppendKey(nil, values...)
+			if err != nil {
+				return err
+			}
+			g := byKey[string(key)]
+			if g == nil {
+				g = &aggGroup{values: values, states: make([]aggState, len(a.aggs))}
+				byKey[string(key)] = g
+				groups = append(groups, g)
+			}
+			for i, agg := range a.aggs {
+				if err := agg.add(&g.states[i], row); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if groups == nil && s.GroupBy == nil {
+			groups = append(groups, &aggGroup{states: make([]aggState, len(a.aggs))})
+		}
+	}
+
+	var out []sortedRow
+	for _, g := range groups {
+		row := append([]any(nil), g.values...)
+		for i, agg := range a.aggs {
+			row = append(row, agg.result(&g.states[i]))
+		}
+		if q.having != nil {
+			v, err := q.having(row)
+			if err != nil {
+				return nil, err
+			}
+			if v != true {
+				continue
+			}
+		}
+		r, err := evalRow(row, q.evals, q.orders)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	if q.orders != nil {
+		if err := sortRows(out, s.OrderBy); err != nil {
+			return nil, err
+		}
+	}
+	return &Result{Columns: q.columns, Rows: pageRows(out, limit, offset)}, nil
+}
+
+// an expression of ORDER BY: a name of a column of the result, else an
+// expression of the groups
+func (a *aggregates) compileOrder(e Expr, names []string, evals []sqlEval) (sqlEval, error) {
+	if ref, ok := e.(*ColumnRef); ok && ref.Table == "" {
+		if _, err := a.scope.resolve(ref); err != nil {
+			for i, name := range names {
+				if name == ref.Column {
+					return evals[i], nil
+				}
+			}
+		}
+	}
+	return a.compile(e)
+}
+
+// the plans of the MIN and MAX of the aggregates read from the first key
+// in the order of their column, nil if not all are
+func (tx *Tx) minMaxPlans(s *SelectStmt, a *aggregates) ([]*scanPlan, error) {
+	if s.Joins != nil || s.GroupBy != nil || len(a.aggs) == 0 {
+		return nil, nil
+	}
+	t, err := tx.Table(s.From)
+	if err != nil {
+		return nil, err
+	}
+	var plans []*scanPlan
+	for _, agg := range a.aggs {
+		ref, ok := agg.call.X.(*ColumnRef)
+		if !ok || agg.call.Name != "MIN" && agg.call.Name != "MAX" {
+			return nil, nil
+		}
+		// the rows of the WHERE with a value
+		var terms []Expr
+		if s.Where != nil {
+			terms = conjuncts(s.Where)
+		}
+		terms = append(terms[:len(terms):len(terms)], &IsNullExpr{X: ref, Not: true})
+		order := []OrderTerm{{Expr: ref, Desc: agg.call.Name == "MAX"}}
+		p, err := planScan(t, a.scope, 0, andExpr(terms), order, true, nil, a.args)
+		if err != nil {
+			return nil, err
+		}
+		if !p.ordered {
+			return nil, nil
+		}
+		plans = append(plans, p)
+	}
+	return plans, nil
+}
+
+// the MIN or MAX of the first row of a plan
+func (a *aggregate) seek(p *scanPlan, st *aggState) error {
+	err := p.scan(nil, func(key []byte, row []any) error {
+		if err := a.add(st, row); err != nil {
+			return err
+		}
+		return errStopSeek
+	})
+	if err == errStopSeek {
+		return nil
+	}
+	return err
+}
+
+var errStopSeek = errors.New("first row read")
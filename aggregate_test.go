@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	db := itemsTest(t)
+	// the values of itemsTest
+	var qtys, sum int64
+	for i := 0; i < 100; i++ {
+		if i%7 != 0 {
+			qtys, sum = qtys+1, sum+int64(i%3)
+		}
+	}
+	want := fmt.Sprint([][]any{{int64(100), qtys, sum, 0.0, 24.75, 49.5}})
+	if got := selectTest(t, db, "SELECT COUNT(*), COUNT(qty), SUM(qty), MIN(price), MAX(price), AVG(id) FROM items"); got != want {
+		t.Fatalf("aggregates %s, want %s", got, want)
+	}
+	for _, c := range []struct {
+		query, rows string
+	}{
+		{"SELECT name, COUNT(*), SUM(qty) FROM items WHERE id < 30 GROUP BY name", "[[n0 10 8] [n1 10 8] [n2 10 10]]"},
+		{"SELECT name, SUM(qty) AS s FROM items WHERE id < 30 GROUP BY name HAVING SUM(qty) > 8 ORDER BY name DESC", "[[n2 10]]"},
+		{"SELECT name, SUM(qty) AS s FROM items WHERE id < 30 GROUP BY name ORDER BY s, name DESC LIMIT 2", "[[n1 8] [n0 8]]"},
+		// the groups in the order of their first row, NULL a group
+		{"SELECT qty, COUNT(*), MIN(id) FROM items WHERE id < 20 GROUP BY qty", "[[<nil> 3 0] [1 6 1] [2 5 2] [0 6 3]]"},
+		{"SELECT qty % 2, COUNT(id) FROM items WHERE id < 20 AND qty IS NOT NULL GROUP BY qty % 2", "[[1 6] [0 11]]"},
+		{"SELECT COUNT(*) * 2, SUM(price) / COUNT(*), MAX(name) FROM items WHERE id < 4", "[[8 0.375 n0]]"},
+		{"SELECT AVG(qty), SUM(qty), MIN(qty), COUNT(qty) FROM items WHERE id = 0", "[[<nil> <nil> <nil> 0]]"},
+		{"SELECT COUNT(*) FROM items WHERE id > 1000", "[[0]]"},
+		{"SELECT name, COUNT(*) FROM items WHERE id > 1000 GROUP BY name", "[]"},
+		{"SELECT SUM(price), SUM(qty + 0.5) FROM items WHERE id < 3", "[[0.75 4]]"},
+	} {
+		if got := selectTest(t, db, c.query); got != c.rows {
+			t.Errorf("%s: %s, want %s", c.query, got, c.rows)
+		}
+	}
+	res := execTest(t, db, "SELECT name, COUNT(*) AS n FROM items GROUP BY name")
+	if fmt.Sprint(res.Columns) != "[name n]" || len(res.Rows) != 10 {
+		t.Fatalf("result %+v", res)
+	}
+
+	execTest(t, db, "CREATE TABLE big (id INT PRIMARY KEY, v INT)")
+	execTest(t, db, "INSERT INTO big VALUES (1, 9223372036854775807), (2, 1)")
+	for _, query := range []string{
+		"SELECT name, qty FROM items GROUP BY name",
+		"SELECT *, COUNT(*) FROM items",
+		"SELECT SUM(name) FROM items",
+		"SELECT id FROM items WHERE COUNT(*) > 1",
+		"SELECT SUM(v) FROM big",
+		"SELECT MIN(id) FROM items GROUP BY missing",
+	} {
+		if _, err := db.Exec(query); !errors.Is(err, ErrSQL) {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+}
+
+// the MIN and MAX of a column of a key or an index are read from its first
+// or last key
+func TestAggregateMinMax(t *testing.T) {
+	db := itemsTest(t)
+	for _, c := range []struct {
+		query, plan, rows string
+	}{
+		{"SELECT MIN(id), MAX(id) FROM items", "[[items full scan <nil> false 1 false] [items full scan <nil> true 1 false]]", "[[0 99]]"},
+		{"SELECT MAX(name) FROM items", "[[items index scan by_name true 1 false]]", "[[n9]]"},
+		{"SELECT MIN(id) FROM items WHERE id > 42 AND qty = 0", "[[items key range scan <nil> false 1 false]]", "[[45]]"},
+		{"SELECT MAX(id) FROM items WHERE name = 'n4'", "[[items index scan by_name true 1 false]]", "[[49]]"},
+		{"SELECT MIN(id) FROM items WHERE id > 1000", "[[items key range scan <nil> false 0 false]]", "[[<nil>]]"},
+		// not of a key, read from all the rows
+		{"SELECT MIN(price) FROM items", "[[items full scan <nil> false 100 false]]", "[[0]]"},
+		{"SELECT MIN(id), COUNT(*) FROM items", "[[items index only scan by_name false 100 false]]", "[[0 100]]"},
+	} {
+		if got := selectTest(t, db, "EXPLAIN "+c.query); got != c.plan {
+			t.Errorf("EXPLAIN %s: %s, want %s", c.query, got, c.plan)
+		}
+		if got := selectTest(t, db, c.query); got != c.rows {
+			t.Errorf("%s: %s, want %s", c.query, got, c.rows)
+		}
+	}
+}
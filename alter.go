@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Schema changes: AddColumn adds a column at the end of a table without
+// writing its rows. The version of the schema is bumped, the column is
+// of that version; a row written before it ends before the column, it's
+// read with the default of the column. The rows are rewritten with all
+// their columns when updated, or by UpgradeRows.
+
+const UPGRADE_BATCH = 256 // rows read per Tx by UpgradeRows
+
+// AddColumn adds a column after the others of the table: nullable, or
+// with a default, the value of the rows written before. It can't be of
+// the primary key, nor AUTO_INCREMENT.
+func (t *Table) AddColumn(c Column) error {
+	if !c.Nullable && c.Default == nil {
+		return fmt.Errorf("%w: column %q added not nullable without a default", ErrSchema, c.Name)
+	}
+	if c.AutoIncrement {
+		return fmt.Errorf("%w: AUTO_INCREMENT column %q added", ErrSchema, c.Name)
+	}
+	s := t.schema
+	s.Version++
+	c.Added = s.Version
+	s.Columns = append(s.Columns[:len(s.Columns):len(s.Columns)], c)
+	nt, err := newTable(s)
+	if err != nil {
+		return err
+	}
+	return t.saveSchema(nt.schema)
+}
+
+// UpgradeRows rewrites the rows of a table written before a column was
+// added with all their columns, UPGRADE_BATCH rows read per Tx, and
+// returns how many it rewrote. The rows read the same before and after,
+// it can run in the background, with a goroutine of its own.
+func (db *DB) UpgradeRows(ctx context.Context, table string) (int64, error) {
+	var total int64
+	var from []byte
+	for {
+		n, next, err := db.upgradeBatch(ctx, table, from)
+		total += n
+		if err != nil || next == nil {
+			return total, err
+		}
+		from = next
+	}
+}
+
+// rewrite the old rows of the batch from a key, returns the key of the
+// next batch, nil at the end
+func (db *DB) upgradeBatch(ctx context.Context, table string, from []byte) (int64, []byte, error) {
+	tx, err := db.BeginContext(ctx, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+	t, err := tx.Table(table)
+	if err != nil {
+		return 0, nil, err
+	}
+	var keys, values [][]byte
+	var next []byte
+	c := t.rows.Cursor()
+	key, value := c.First()
+	if from != nil {
+		key, value = c.Seek(from)
+	}
+	for read := 0; key != nil; key, value = c.Next() {
+		if read == UPGRADE_BATCH {
+			next = append([]byte(nil), key...)
+			break
+		}
+		read++
+		row, n, err := t.decodeColumns(value)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n == len(row) {
+			continue
+		}
+		_, value, err := t.encodeRow(row)
+		if err != nil {
+			return 0, nil, err
+		}
+		keys = append(keys, append([]byte(nil), key...))
+		values = append(values, value)
+	}
+	if err := c.Err(); err != nil {
+		return 0, nil, err
+	}
+	for i, key := range keys {
+		if err := t.rows.Set(key, values[i]); err != nil {
+			return 0, nil, err
+		}
+	}
+	if len(keys) == 0 {
+		return 0, next, nil
+	}
+	return int64(len(keys)), next, tx.Commit()
+}
+
+// the default of a column of the type of the column, as decoded from the
+// JSON of the schema too
+func columnDefault(c Column) (any, error) {
+	switch v := c.Default.(type) {
+	case nil:
+		return nil, nil
+	case json.Number:
+		if c.Type == ColumnInt64 {
+			i, err := v.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("%w: default %v of column %q", ErrSchema, v, c.Name)
+			}
+			return i, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("%w: default %v of column %q", ErrSchema, v, c.Name)
+		}
+		return f, nil
+	case float64:
+		if c.Type == ColumnInt64 && v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return int64(v), nil
+		}
+	case int64:
+		if c.Type == ColumnFloat64 {
+			return float64(v), nil
+		}
+	case string:
+		// []byte is base64 in JSON
+		if c.Type == ColumnBytes {
+			b, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("%w: default of column %q: %v", ErrSchema, c.Name, err)
+			}
+			return b, nil
+		}
+	}
+	if err := checkColumn(c, c.Default); err != nil {
+		return nil, fmt.Errorf("%w: default of column %q: %v", ErrSchema, c.Name, err)
+	}
+	return c.Default, nil
+}
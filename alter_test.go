@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// the number of rows of a table written before its last column was added
+func oldRowsTest(t *testing.T, db *DB, table string) int {
+	t.Helper()
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	tb, err := tx.Table(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := 0
+	c := tb.rows.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		row, n, err := tb.decodeColumns(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < len(row) {
+			old++
+		}
+	}
+	return old
+}
+
+func TestAddColumn(t *testing.T) {
+	db := openTest(t)
+	execTest(t, db, "CREATE TABLE t (id INT PRIMARY KEY, v TEXT)")
+	tx, _ := db.Begin(true)
+	for i := 0; i < 600; i++ {
+		execTestTx(t, tx, "INSERT INTO t VALUES (?, 'x')", i)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	execTest(t, db, "ALTER TABLE t ADD COLUMN n INT NOT NULL DEFAULT 7")
+	execTest(t, db, "ALTER TABLE t ADD f REAL DEFAULT 2")
+	execTest(t, db, "ALTER TABLE t ADD b BLOB NOT NULL DEFAULT x'00ff'")
+	execTest(t, db, "ALTER TABLE t ADD s TEXT")
+	for _, sql := range []string{
+		"ALTER TABLE t ADD z INT NOT NULL",
+		"ALTER TABLE t ADD v INT",
+		"ALTER TABLE t ADD d TEXT DEFAULT 3",
+		"ALTER TABLE missing ADD z INT",
+	} {
+		if _, err := db.Exec(sql); err == nil {
+			t.Errorf("%s accepted", sql)
+		}
+	}
+	tx, _ = db.Begin(true)
+	tb, _ := tx.Table("t")
+	if err := tb.AddColumn(Column{Name: "a", Type: ColumnInt64, Nullable: true, AutoIncrement: true}); !errors.Is(err, ErrSchema) {
+		tx.Rollback()
+		t.Fatalf("AUTO_INCREMENT column added: %v", err)
+	}
+	tx.Rollback()
+
+	execTest(t, db, "INSERT INTO t (id, v) VALUES (1000, 'y')")
+	execTest(t, db, "UPDATE t SET n = 8 WHERE id = 3")
+	check := func(db *DB, version int) {
+		t.Helper()
+		got := selectTest(t, db, "SELECT id, v, n, f, b, s FROM t WHERE id = 1 OR id = 3 OR id = 1000")
+		if want := "[[1 x 7 2 [0 255] <nil>] [3 x 8 2 [0 255] <nil>] [1000 y 7 2 [0 255] <nil>]]"; got != want {
+			t.Fatalf("rows %s, want %s", got, want)
+		}
+		tx, _ := db.Begin(false)
+		defer tx.Rollback()
+		tb, _ := tx.Table("t")
+		s := tb.Schema()
+		if s.Version != version {
+			t.Fatalf("schema version %d", s.Version)
+		}
+		for i, c := range s.Columns {
+			if c.Added != max(i-1, 0) {
+				t.Fatalf("column %s added in version %d", c.Name, c.Added)
+			}
+		}
+	}
+	check(db, 4)
+	// the defaults are read back from the JSON of the schema
+	db = reopenTest(t, db)
+	check(db, 4)
+	if old := oldRowsTest(t, db, "t"); old != 599 {
+		t.Fatalf("%d rows written before the columns", old)
+	}
+
+	// indexed with the defaults of the rows written before
+	execTest(t, db, "CREATE INDEX by_n ON t (n)")
+	if got := selectTest(t, db, "SELECT COUNT(*) FROM t WHERE n = 7"); got != "[[600]]" {
+		t.Fatalf("%s rows of n 7", got)
+	}
+
+	n, err := db.UpgradeRows(context.Background(), "t")
+	if err != nil || n != 599 {
+		t.Fatalf("%d rows upgraded: %v", n, err)
+	}
+	if old := oldRowsTest(t, db, "t"); old != 0 {
+		t.Fatalf("%d rows not upgraded", old)
+	}
+	if n, err := db.UpgradeRows(context.Background(), "t"); err != nil || n != 0 {
+		t.Fatalf("%d rows upgraded twice: %v", n, err)
+	}
+	if got := selectTest(t, db, "SELECT SUM(n), SUM(f), COUNT(b), COUNT(s) FROM t"); got != "[[4208 1202 601 0]]" {
+		t.Fatalf("sums %s after the upgrade", got)
+	}
+	// bumped by the index
+	check(db, 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.UpgradeRows(ctx, "t"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled upgrade: %v", err)
+	}
+	if _, err := db.UpgradeRows(context.Background(), "missing"); !errors.Is(err, ErrTableNotFound) {
+		t.Fatalf("upgrade of a missing table: %v", err)
+	}
+}
+
+func TestAddColumnSchemaBad(t *testing.T) {
+	s := usersSchemaTest()
+	s.Version = 1
+	s.Columns[len(s.Columns)-1].Added = 2
+	if _, err := newTable(s); !errors.Is(err, ErrSchema) {
+		t.Fatalf("column added after the version: %v", err)
+	}
+	s.Columns[len(s.Columns)-1].Added = 0
+	s.Columns[2].Added = 1
+	if _, err := newTable(s); !errors.Is(err, ErrSchema) {
+		t.Fatalf("column created after one added: %v", err)
+	}
+}
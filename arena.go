@@ -0,0 +1,35 @@
+package storage
+
+const (
+	ARENA_MIN_SLAB = 4  // pages
+	ARENA_MAX_SLAB = 64 // pages
+)
+
+// arena cuts page buffers from large slabs, for a writable Tx building
+// many pages: most of them are short-lived, replaced by the next updates
+// of the Tx, and a slab is one allocation instead of one per page. The
+// slabs start small and double up to ARENA_MAX_SLAB so that small Tx don't
+// waste memory.
+//
+// An arena is dropped as a whole when its Tx ends. The buffers are never
+// reused: a value returned by Get stays valid until the Tx ends, and the
+// committed pages live on in the cache. The memory of a slab is released
+// with the last of its pages.
+type arena struct {
+	slab []byte // the rest of the current slab
+	size int    // pages of the next slab
+}
+
+// a page buffer, a nil arena allocates it alone
+func (a *arena) page(pageSize int) []byte {
+	if a == nil {
+		return make([]byte, pageSize)
+	}
+	if len(a.slab) < pageSize {
+		a.size = min(max(2*a.size, ARENA_MIN_SLAB), ARENA_MAX_SLAB)
+		a.slab = make([]byte, a.size*pageSize)
+	}
+	page := a.slab[:pageSize:pageSize]
+	a.slab = a.slab[pageSize:]
+	return page
+}
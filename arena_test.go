@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestArena(t *testing.T) {
+	var a arena
+	const pageSize = 512
+	pages := make([][]byte, 0, 200)
+	for i := 0; i < 200; i++ {
+		page := a.page(pageSize)
+		if len(page) != pageSize || cap(page) != pageSize {
+			t.Fatalf("page of %d bytes, capacity %d", len(page), cap(page))
+		}
+		for j := range page {
+			page[j] = byte(i)
+		}
+		pages = append(pages, page)
+	}
+	for i, page := range pages {
+		for _, b := range page {
+			if b != byte(i) {
+				t.Fatalf("page %d overlaps another", i)
+			}
+		}
+	}
+	// appending to a page reallocates it instead of writing into the next
+	next := a.page(pageSize)
+	_ = append(pages[len(pages)-1], 0xff)
+	if next[0] != 0 {
+		t.Fatal("append wrote into the next page")
+	}
+	if a.size != ARENA_MAX_SLAB {
+		t.Fatalf("slabs of %d pages after 200 pages", a.size)
+	}
+	var none *arena
+	if page := none.page(pageSize); len(page) != pageSize {
+		t.Fatalf("page of %d bytes without an arena", len(page))
+	}
+}
+
+func BenchmarkInsertArena(b *testing.B) {
+	for _, name := range []string{"alone", "arena"} {
+		b.Run(name, func(b *testing.B) {
+			m := newMemTree(b)
+			if name == "arena" {
+				m.tree.arena = &arena{}
+			}
+			m.tree.new = func(node BNode) uint64 {
+				m.next++
+				m.pages[m.next] = BNode{node.data[:BTREE_PAGE_SIZE]}
+				return m.next
+			}
+			key := make([]byte, 8)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				binary.BigEndian.PutUint64(key, uint64(i)*2654435761)
+				if err := m.tree.Insert(key, key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
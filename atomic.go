@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// CompareAndSwap sets the key to value if its current value is old, in a
+// single Tx. A nil old expects the key to be absent, a nil value deletes
+// the key. On a mismatch nothing is written and actual is the current
+// value, nil if the key is absent.
+func (db *DB) CompareAndSwap(key []byte, old []byte, value []byte) (swapped bool, actual []byte, err error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return false, nil, err
+	}
+	defer tx.Rollback()
+	current, ok, err := tx.GetCopy(key)
+	if err != nil {
+		return false, nil, err
+	}
+	if ok != (old != nil) || !bytes.Equal(current, old) {
+		return false, current, nil
+	}
+	if value == nil {
+		if !ok {
+			return true, nil, nil // absent already
+		}
+		_, err = tx.Del(key)
+	} else {
+		err = tx.Set(key, value)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	return true, nil, nil
+}
+
+var ErrNotCounter = errors.New("value is not an 8-byte counter")
+
+// Increment adds delta to the counter of the key, a little-endian int64,
+// created at zero if the key is absent, and returns its new value.
+// The counter is read and updated in a single walk of the tree.
+func (tx *Tx) Increment(key []byte, delta int64) (int64, error) {
+	if err := tx.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := tx.tree.checkKeyValue(key, nil); err != nil {
+		return 0, err
+	}
+	tx.traceOp("increment", key)
+	var n int64
+	var bad bool
+	add := func(old []byte, ok bool) []byte {
+		if ok && len(old) != 8 {
+			bad = true
+			return old // left as it is
+		}
+		if ok {
+			n = int64(binary.LittleEndian.Uint64(old))
+		}
+		n += delta
+		return binary.LittleEndian.AppendUint64(nil, uint64(n))
+	}
+	if tx.optimistic {
+		old, ok, err := tx.optimisticGet(key)
+		if err != nil {
+			return 0, err
+		}
+		if value := add(old, ok); !bad {
+			tx.bufferWrite(walOp{kind: WAL_OP_SET, key: append([]byte(nil), key...), value: value})
+		}
+	} else {
+		if err := tx.dropExpired(key); err != nil {
+			return 0, err
+		}
+		if err := tx.tree.Update(key, add); err != nil {
+			tx.err = err
+			return 0, err
+		}
+		tx.gen++
+		if !bad {
+			tx.logOp(nil, walOp{kind: WAL_OP_SET, key: append([]byte(nil), key...), value: binary.LittleEndian.AppendUint64(nil, uint64(n))})
+		}
+	}
+	if bad {
+		return 0, fmt.Errorf("%w: key %q", ErrNotCounter, key)
+	}
+	return n, nil
+}
+
+// Increment runs Tx.Increment in its own Tx.
+func (db *DB) Increment(key []byte, delta int64) (int64, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	n, err := tx.Increment(key, delta)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
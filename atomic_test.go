@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	db := openTest(t)
+	if ok, actual, err := db.CompareAndSwap([]byte("k"), nil, []byte("0")); !ok || actual != nil || err != nil {
+		t.Fatalf("swap of an absent key %v %q %v", ok, actual, err)
+	}
+	if ok, actual, _ := db.CompareAndSwap([]byte("k"), nil, []byte("1")); ok || string(actual) != "0" {
+		t.Fatalf("swap of a present key as absent %v %q", ok, actual)
+	}
+	if ok, actual, _ := db.CompareAndSwap([]byte("k"), []byte("5"), []byte("1")); ok || string(actual) != "0" {
+		t.Fatalf("swap with another value %v %q", ok, actual)
+	}
+	wantValue(t, db, "k", []byte("0"))
+
+	const writers, swaps = 8, 50
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < swaps; {
+				v, _, _ := db.Get([]byte("k"))
+				n, _ := strconv.Atoi(string(v))
+				ok, _, err := db.CompareAndSwap([]byte("k"), v, []byte(strconv.Itoa(n+1)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					i++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	wantValue(t, db, "k", []byte(strconv.Itoa(writers*swaps)))
+
+	if ok, _, _ := db.CompareAndSwap([]byte("k"), []byte(strconv.Itoa(writers*swaps)), nil); !ok {
+		t.Fatal("swap to delete failed")
+	}
+	wantValue(t, db, "k", nil)
+	if ok, _, _ := db.CompareAndSwap([]byte("k"), nil, nil); !ok {
+		t.Fatal("swap to delete an absent key failed")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	db := openTest(t)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if _, err := db.Increment([]byte("c"), 2); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := db.Increment([]byte("c"), -1); n != 1599 || err != nil {
+		t.Fatalf("counter %d %v", n, err)
+	}
+
+	mustSet(t, db, "s", "abc")
+	if _, err := db.Increment([]byte("s"), 1); !errors.Is(err, ErrNotCounter) {
+		t.Fatalf("increment of a string: %v", err)
+	}
+	wantValue(t, db, "s", []byte("abc"))
+
+	// optimistic Txs see their own increments
+	tx, _ := db.BeginTx(TxOptions{Writable: true})
+	tx.Increment([]byte("c"), 1)
+	if n, _ := tx.Increment([]byte("c"), 1); n != 1601 {
+		t.Fatalf("counter %d in the Tx", n)
+	}
+	if _, err := tx.Increment([]byte("s"), 1); !errors.Is(err, ErrNotCounter) {
+		t.Fatalf("increment of a string: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = reopenTest(t, db)
+	if n, _ := db.Increment([]byte("c"), 0); n != 1601 {
+		t.Fatalf("counter %d after reopening", n)
+	}
+	if n, _ := db.Increment([]byte("new"), -3); n != -3 {
+		t.Fatalf("new counter %d", n)
+	}
+	wantValue(t, db, "s", []byte("abc"))
+}
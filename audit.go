@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Audit log, WithAuditLog: each commit adds an entry to an internal tree,
+// who committed, when, and the keys, buckets and tables it changed, without
+// the values. The entry is written by the Tx itself before its record is
+// logged, with a WAL_OP_AUDIT op that replay applies again: it's durable,
+// replicated and checkpointed with the commit, there is no commit without
+// its entry.
+//
+// The key of an entry is the version of the commit then a part number,
+// big-endian: the changes of a large commit are split into parts that fit
+// in a value. A Tx applying audited commits, those of Follow and
+// RecoverWAL, copies their entries and adds none of its own. Compact, the
+// backups and the resyncs of the followers copy the keys and buckets only,
+// not the audit log.
+//
+// entry layout, the lengths uvarints
+// | time | plen | principal | changes...               |
+// | 8B   |      |           | op | len | path | len | key |
+// |      |      |           | 1B |     |      |     |     |
+
+const (
+	AUDIT_PATH      = "\x00\x02audit" // internal tree of the entries
+	AUDIT_KEY_SIZE  = 8 + 4           // version then part
+	AUDIT_PRINCIPAL = 256             // bytes of a principal at most
+)
+
+// AuditEntry is what a commit changed, see WithAuditLog.
+type AuditEntry struct {
+	Version   uint64
+	Time      time.Time
+	Principal string // of WithPrincipal, empty for the Txs begun without one and those of BeginTx
+	Changes   []AuditChange
+}
+
+// AuditChange is a key or a bucket a commit changed. Bucket is the names of
+// the bucket of Key from the top, nil outside buckets, as for Change.
+type AuditChange struct {
+	Op     ChangeOp
+	Bucket [][]byte
+	Key    []byte
+	Table  string // of a row, an index entry or a schema, empty otherwise
+}
+
+// WithAuditLog adds an entry to the audit log with every commit, see
+// Tx.AuditLog and WithPrincipal. The log grows with the commits, it's
+// never trimmed.
+func WithAuditLog() Option {
+	return func(db *DB) {
+		db.opts.audit = true
+	}
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context whose Txs are audited as committed by
+// principal, a user or a connection: see WithAuditLog. It's cut to
+// AUDIT_PRINCIPAL bytes.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	if len(principal) > AUDIT_PRINCIPAL {
+		principal = principal[:AUDIT_PRINCIPAL]
+	}
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// AuditLog calls fn with the entries of the commits after the version
+// after, in order, until fn returns an error. The entries are those of the
+// snapshot of the Tx.
+func (tx *Tx) AuditLog(after uint64, fn func(e AuditEntry) error) (err error) {
+	if tx.done {
+		return ErrTxClosed
+	}
+	tree, err := tx.internalTree(AUDIT_PATH)
+	if err != nil || tree.root == 0 {
+		return err
+	}
+	var e AuditEntry
+	flush := func() error {
+		if e.Version == 0 {
+			return nil
+		}
+		return fn(e)
+	}
+	walk := func() (err error) {
+		defer catchTreeError(&err)
+		start := auditKey(after+1, 0)
+		for iter := tree.SeekLE(start); !iter.atEnd(); iter.Next() {
+			if !iter.Valid() {
+				continue // the sentinel
+			}
+			key, value := iter.Deref()
+			if bytes.Compare(key, start) < 0 {
+				continue
+			}
+			if len(key) != AUDIT_KEY_SIZE {
+				return fmt.Errorf("%w: audit key of %d bytes", ErrCorrupt, len(key))
+			}
+			if version := binary.BigEndian.Uint64(key); version != e.Version {
+				if err := flush(); err != nil {
+					return err
+				}
+				e = AuditEntry{Version: version}
+			}
+			if err := decodeAudit(value, &e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+func auditKey(version uint64, part uint32) []byte {
+	key := binary.BigEndian.AppendUint64(make([]byte, 0, AUDIT_KEY_SIZE), version)
+	return binary.BigEndian.AppendUint32(key, part)
+}
+
+// add the entry of the commit of the Tx, the caller logs its record next
+func (tx *Tx) audit() error {
+	if !tx.db.opts.audit || tx.ctx.Value(replicationKey{}) != nil {
+		return nil
+	}
+	for _, op := range tx.ops {
+		if op.kind == WAL_OP_AUDIT {
+			return nil // applying audited commits
+		}
+	}
+	changes, err := decodeChanges(tx.ops)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	principal, _ := tx.ctx.Value(principalKey{}).(string)
+	version := tx.version + 1
+	for i, part := range encodeAudit(time.Now(), principal, changes, maxValueSize(tx.db.nodeSize())) {
+		if err := tx.auditPart(auditKey(version, uint32(i)), part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write a part of an entry, by the commit or by replay
+func (tx *Tx) auditPart(key []byte, value []byte) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	op := walOp{kind: WAL_OP_AUDIT, key: append([]byte(nil), key...), value: append([]byte(nil), value...)}
+	tree, err := tx.internalTree(AUDIT_PATH)
+	if err != nil {
+		return err
+	}
+	err = tree.Insert(op.key, op.value)
+	if err == nil {
+		err = tx.setBucketRoot([]byte(AUDIT_PATH), tree.root)
+	}
+	if err != nil {
+		tx.err = err
+		return err
+	}
+	tx.logOp(nil, op)
+	return nil
+}
+
+// the parts of an entry, each at most size bytes
+func encodeAudit(at time.Time, principal string, changes []Change, size int) [][]byte {
+	header := binary.BigEndian.AppendUint64(nil, uint64(at.UnixNano()))
+	header = binary.AppendUvarint(header, uint64(len(principal)))
+	header = append(header, principal...)
+	var parts [][]byte
+	part := bytes.Clone(header)
+	for _, c := range changes {
+		var path []byte
+		for _, name := range c.Bucket {
+			path = bucketPath(path, name)
+		}
+		rec := []byte{byte(c.Op)}
+		rec = binary.AppendUvarint(rec, uint64(len(path)))
+		rec = append(rec, path...)
+		rec = binary.AppendUvarint(rec, uint64(len(c.Key)))
+		rec = append(rec, c.Key...)
+		if len(part) > len(header) && len(part)+len(rec) > size {
+			parts, part = append(parts, part), bytes.Clone(header)
+		}
+		part = append(part, rec...)
+	}
+	return append(parts, part)
+}
+
+// add the changes of a part to the entry
+func decodeAudit(data []byte, e *AuditEntry) error {
+	bad := fmt.Errorf("%w: bad audit entry %d", ErrCorrupt, e.Version)
+	if len(data) < 8 {
+		return bad
+	}
+	e.Time = time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	data = data[8:]
+	field := func() ([]byte, bool) {
+		n, size := binary.Uvarint(data)
+		if size <= 0 || uint64(len(data)-size) < n {
+			return nil, false
+		}
+		b := data[size : size+int(n)]
+		data = data[size+int(n):]
+		return b, true
+	}
+	principal, ok := field()
+	if !ok {
+		return bad
+	}
+	e.Principal = string(principal)
+	for len(data) > 0 {
+		c := AuditChange{Op: ChangeOp(data[0])}
+		data = data[1:]
+		path, ok := field()
+		if !ok {
+			return bad
+		}
+		if c.Key, ok = field(); !ok {
+			return bad
+		}
+		c.Key = bytes.Clone(c.Key)
+		if len(path) > 0 {
+			c.Bucket = splitPath(path)
+		}
+		switch {
+		case len(c.Bucket) > 1 && string(c.Bucket[0]) == TABLES_BUCKET:
+			c.Table = string(c.Bucket[1])
+		case len(c.Bucket) == 1 && string(c.Bucket[0]) == TABLES_BUCKET:
+			c.Table = string(c.Key)
+		}
+		e.Changes = append(e.Changes, c)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the entries of the audit log after the version after
+func auditTest(t *testing.T, db *DB, after uint64) []AuditEntry {
+	t.Helper()
+	var entries []AuditEntry
+	err := db.View(func(tx *Tx) error {
+		return tx.AuditLog(after, func(e AuditEntry) error {
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// the changes of an entry, "<op> <bucket/...> <key> <table>" each
+func auditChangesTest(e AuditEntry) []string {
+	var changes []string
+	for _, c := range e.Changes {
+		var bucket []string
+		for _, name := range c.Bucket {
+			bucket = append(bucket, string(name))
+		}
+		changes = append(changes, strings.Join(strings.Fields(fmt.Sprintf("%s %s %s %s", c.Op, strings.Join(bucket, "/"), c.Key, c.Table)), " "))
+	}
+	return changes
+}
+
+func TestAuditLog(t *testing.T) {
+	db := openTest(t, WithAuditLog())
+	start := time.Now()
+	tx, _ := db.BeginContext(WithPrincipal(context.Background(), "ann@127.0.0.1:1234"), true)
+	tx.Set([]byte("a"), []byte("secret value"))
+	b, _ := tx.CreateBucket([]byte("app"))
+	b.Set([]byte("k"), []byte("v"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	entries := auditTest(t, db, 0)
+	if len(entries) != 1 {
+		t.Fatalf("entries %+v", entries)
+	}
+	e := entries[0]
+	if e.Version != 1 || e.Principal != "ann@127.0.0.1:1234" || e.Time.Before(start) || e.Time.After(time.Now()) {
+		t.Fatalf("entry %+v", e)
+	}
+	if got := fmt.Sprint(auditChangesTest(e)); got != "[set a create_bucket app set app k]" {
+		t.Fatalf("changes %s", got)
+	}
+
+	// the rows of the tables, a commit without principal, one of 2PC
+	if _, err := db.Exec("CREATE TABLE t (id INT PRIMARY KEY, v TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO t VALUES (1, 'x')"); err != nil {
+		t.Fatal(err)
+	}
+	otx, _ := db.BeginTx(TxOptions{Writable: true})
+	otx.Del([]byte("a"))
+	if err := otx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	ptx, _ := db.BeginContext(WithPrincipal(context.Background(), strings.Repeat("p", AUDIT_PRINCIPAL+10)), true)
+	ptx.Set([]byte("p"), []byte("1"))
+	if err := ptx.Prepare("id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CommitPrepared("id"); err != nil {
+		t.Fatal(err)
+	}
+	entries = auditTest(t, db, 1)
+	if len(entries) != 4 {
+		t.Fatalf("%d entries after 1", len(entries))
+	}
+	for _, c := range entries[:2] {
+		if tables := fmt.Sprint(c.Changes[len(c.Changes)-1].Table); tables != "t" || c.Principal != "" {
+			t.Fatalf("entry of the table %+v", c)
+		}
+	}
+	if got := fmt.Sprint(auditChangesTest(entries[2])); got != "[delete a]" || entries[2].Principal != "" {
+		t.Fatalf("entry of BeginTx %+v", entries[2])
+	}
+	if got := fmt.Sprint(auditChangesTest(entries[3])); got != "[set p]" || entries[3].Principal != strings.Repeat("p", AUDIT_PRINCIPAL) {
+		t.Fatalf("entry of the prepared Tx %+v", entries[3])
+	}
+	// the changes of the commits don't list the entries
+	rec, err := db.Changes(0).Next(context.Background())
+	if err != nil || len(rec.Changes) != 3 {
+		t.Fatalf("changes of the first commit %+v: %v", rec, err)
+	}
+
+	// a large commit in parts, read back in one entry
+	tx, _ = db.BeginContext(WithPrincipal(context.Background(), "bob"), true)
+	for i := 0; i < 2000; i++ {
+		tx.Set([]byte(fmt.Sprintf("key%05d-%0100d", i, i)), []byte("v"))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	version := db.visible.Load().version
+	entries = auditTest(t, db, version-1)
+	if len(entries) != 1 || len(entries[0].Changes) != 2000 || entries[0].Principal != "bob" || string(entries[0].Changes[1999].Key) != fmt.Sprintf("key%05d-%0100d", 1999, 1999) {
+		t.Fatalf("large entry of %d changes", len(entries[0].Changes))
+	}
+	want := fmt.Sprint(auditTest(t, db, 0))
+	for _, v := range []string{"secret value", "'x'"} {
+		if strings.Contains(want, v) {
+			t.Fatalf("entries hold %s", v)
+		}
+	}
+
+	// the entries are those of the commits recovered, then checkpointed
+	crashTest(db)
+	db = openTestPath(t, db.Path, WithAuditLog())
+	if got := fmt.Sprint(auditTest(t, db, 0)); got != want {
+		t.Fatalf("entries recovered\n%s\nwant\n%s", got, want)
+	}
+	db = reopenTest(t, db, WithAuditLog())
+	if got := fmt.Sprint(auditTest(t, db, 0)); got != want {
+		t.Fatal("entries changed by the checkpoint")
+	}
+	if r, err := db.Check(context.Background()); err != nil || !r.OK() {
+		t.Fatalf("check: %v %v", r.Problems, err)
+	}
+	if entries := auditTest(t, db, version); len(entries) != 0 {
+		t.Fatalf("entries after the last %+v", entries)
+	}
+	tx, _ = db.Begin(false)
+	tx.Rollback()
+	if err := tx.AuditLog(0, func(AuditEntry) error { return nil }); err != ErrTxClosed {
+		t.Fatalf("audit log of a Tx closed: %v", err)
+	}
+
+	// without WithAuditLog the commits add none
+	db = reopenTest(t, db)
+	mustSet(t, db, "b", "1")
+	if got := fmt.Sprint(auditTest(t, db, 0)); got != want {
+		t.Fatal("entry without the audit log")
+	}
+	plain := openTest(t)
+	mustSet(t, plain, "a", "1")
+	if entries := auditTest(t, plain, 0); len(entries) != 0 {
+		t.Fatalf("entries without the audit log %+v", entries)
+	}
+}
+
+// the followers copy the entries of the commits streamed, adding none of
+// their own: those before a resync are left out
+func TestAuditReplication(t *testing.T) {
+	primary := openTest(t, WithAuditLog(), WithWALArchiveSize(1<<20))
+	addr := servePrimary(t, primary)
+	follower := openTest(t, WithAuditLog())
+	mustSet(t, primary, "before", "1")
+	startFollow(t, follower, addr)
+	waitFollower(t, primary, follower)
+	base := primary.visible.Load().version
+	for i := 0; i < 20; i++ {
+		tx, _ := primary.BeginContext(WithPrincipal(context.Background(), fmt.Sprint("user", i)), true)
+		tx.Set([]byte(fmt.Sprint("k", i)), []byte("v"))
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFollower(t, primary, follower)
+	want := fmt.Sprint(auditTest(t, primary, base))
+	if got := fmt.Sprint(auditTest(t, follower, 0)); got != want {
+		t.Fatalf("entries of the follower\n%s\nwant\n%s", got, want)
+	}
+	if entries := auditTest(t, primary, base); len(entries) != 20 || entries[19].Principal != "user19" {
+		t.Fatalf("%d entries", len(entries))
+	}
+}
+
+// the parts of an entry fit in a value, each with the principal and time
+func TestEncodeAudit(t *testing.T) {
+	at := time.Unix(1700000000, 42)
+	var changes []Change
+	for i := 0; i < 100; i++ {
+		changes = append(changes, Change{Op: ChangeSet, Bucket: [][]byte{[]byte("b"), []byte("inner")}, Key: []byte(fmt.Sprint("key", i))})
+	}
+	changes = append(changes, Change{Op: ChangeDelete, Key: []byte{0xff}})
+	parts := encodeAudit(at, "ann", changes, 200)
+	if len(parts) < 2 {
+		t.Fatalf("%d parts", len(parts))
+	}
+	e := AuditEntry{Version: 5}
+	for _, part := range parts {
+		if len(part) > 200 {
+			t.Fatalf("part of %d bytes", len(part))
+		}
+		if err := decodeAudit(part, &e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !e.Time.Equal(at) || e.Principal != "ann" || len(e.Changes) != 101 || string(e.Changes[99].Bucket[1]) != "inner" || e.Changes[100].Op != ChangeDelete || e.Changes[100].Bucket != nil {
+		t.Fatalf("entry %+v", e)
+	}
+	for _, bad := range [][]byte{nil, parts[0][:8], parts[0][:len(parts[0])-1]} {
+		if err := decodeAudit(bad, &AuditEntry{}); err == nil {
+			t.Errorf("entry %q decoded", bad)
+		}
+	}
+}
+
+func TestHTTPAudit(t *testing.T) {
+	db := openTest(t, WithAuditLog())
+	for _, key := range []string{"a", "b", "\xff"} {
+		tx, _ := db.BeginContext(WithPrincipal(context.Background(), "ann"), true)
+		tx.Set([]byte(key), []byte("v"))
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	do := httpTest(t, db)
+	var resp struct {
+		Entries []httpAuditEntry `json:"entries"`
+		More    bool             `json:"more"`
+	}
+	r := do("GET", "/audit?limit=2", "")
+	if err := json.Unmarshal([]byte(r.body), &resp); err != nil || r.code != 200 {
+		t.Fatalf("audit: %d %s: %v", r.code, r.body, err)
+	}
+	if len(resp.Entries) != 2 || !resp.More || resp.Entries[0].Principal != "ann" || resp.Entries[1].Changes[0].Key != "b" {
+		t.Fatalf("entries %+v", resp)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, resp.Entries[0].Time); err != nil {
+		t.Fatalf("time %q: %v", resp.Entries[0].Time, err)
+	}
+	resp.Entries = nil
+	r = do("GET", fmt.Sprintf("/audit?after=%d", 2), "")
+	json.Unmarshal([]byte(r.body), &resp)
+	if c := resp.Entries[0].Changes[0]; len(resp.Entries) != 1 || resp.More || !c.Base64 || c.Key != base64.StdEncoding.EncodeToString([]byte{0xff}) || c.Op != "set" {
+		t.Fatalf("entries after 2 %+v", resp)
+	}
+	for path, code := range map[string]int{"/audit?after=x": 400, "/audit?limit=0": 400, "/audit?limit=x": 400} {
+		if r := do("GET", path, ""); r.code != code {
+			t.Errorf("%s: %d %s", path, r.code, r.body)
+		}
+	}
+	if r := do("POST", "/audit", ""); r.code != 405 {
+		t.Errorf("post: %d", r.code)
+	}
+	if r := do("GET", "/audit?after=3", ""); strings.Join(strings.Fields(r.body), "") != `{"entries":[],"more":false}` {
+		t.Errorf("audit %s", r.body)
+	}
+}
@@ -0,0 +1,406 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+const (
+	BACKUP_SIG = "SEBAK-01"
+
+	// backup layout, see WriteBackup
+	// | sig | version | records... | end record |
+	// | 8B  | 8B      |            |            |
+	// record layout, the deadline in unix nanoseconds, 0 without one
+	// | type | klen | vlen | deadline | key | value |
+	// | 1B   | 4B   | 4B   | 8B       | ... | ...   |
+	// A BUCKET record starts a bucket, the key is its path and the KEY
+	// records after it are its keys, those before the first BUCKET are
+	// outside buckets. The END record has the CRC-32 of what's before it as
+	// its key.
+	BACKUP_HEADER        = 8 + 8
+	BACKUP_RECORD_HEADER = 1 + 4 + 4 + 8
+
+	BACKUP_KEY    = 1
+	BACKUP_BUCKET = 2
+	BACKUP_END    = 3
+
+	CLEAR_KEYS = 10000 // keys deleted per Tx when a snapshot replaces the keys
+
+	INCREMENTAL_SIG        = "SEINC-01"
+	INCREMENTAL_SIG_SEALED = "SEINC-E1" // of an encrypted database, the records sealed
+
+	// incremental backup layout, see WriteIncrementalBackup, the records
+	// those of the WAL, the CRC-32 of what's before it at the end
+	// | sig | since | version | records... | crc32 |
+	// | 8B  | 8B    | 8B      |            | 4B    |
+	INCREMENTAL_HEADER     = 8 + 8 + 8
+	INCREMENTAL_APPLY      = 1000    // records applied by a Tx of RestoreIncremental at most
+	INCREMENTAL_MAX_RECORD = 1 << 30 // bytes of a record at most
+)
+
+var ErrBackupChain = errors.New("incremental backup doesn't follow the version restored")
+
+// WriteBackup writes the keys and buckets of the Tx to w, with their
+// expiry, in a stream that Restore loads: a consistent copy of the
+// database at the version of the Tx, whatever is committed meanwhile. It's
+// smaller than the file, without its free pages nor its layout.
+func (tx *Tx) WriteBackup(w io.Writer) (err error) {
+	if tx.done {
+		return ErrTxClosed
+	}
+	defer catchTreeError(&err)
+	bw := bufio.NewWriter(w)
+	crc := crc32.NewIEEE()
+	out := io.MultiWriter(bw, crc)
+	header := append([]byte(BACKUP_SIG), make([]byte, 8)...)
+	binary.BigEndian.PutUint64(header[8:], tx.version)
+	out.Write(header)
+	record := func(kind byte, key, value []byte, deadline int64) error {
+		var h [BACKUP_RECORD_HEADER]byte
+		h[0] = kind
+		binary.BigEndian.PutUint32(h[1:], uint32(len(key)))
+		binary.BigEndian.PutUint32(h[5:], uint32(len(value)))
+		binary.BigEndian.PutUint64(h[9:], uint64(deadline))
+		out.Write(h[:])
+		out.Write(key)
+		_, err := out.Write(value)
+		return err
+	}
+	keys := func(c *Cursor, expiring bool) error {
+		for key, value := c.First(); key != nil; key, value = c.Next() {
+			var deadline int64
+			if expiring {
+				at, err := tx.Expiry(key)
+				if err != nil {
+					return err
+				}
+				if !at.IsZero() {
+					deadline = at.UnixNano()
+				}
+			}
+			if err := record(BACKUP_KEY, key, value, deadline); err != nil {
+				return err
+			}
+		}
+		return c.Err()
+	}
+	if err := keys(tx.Cursor(), true); err != nil {
+		return err
+	}
+	var bucket func(b *Bucket) error
+	bucket = func(b *Bucket) error {
+		if err := record(BACKUP_BUCKET, b.path, nil, 0); err != nil {
+			return err
+		}
+		if err := keys(b.Cursor(), false); err != nil {
+			return err
+		}
+		return b.ForEachBucket(func(name []byte) error {
+			inner, err := b.Bucket(name)
+			if err != nil {
+				return err
+			}
+			return bucket(inner)
+		})
+	}
+	err = tx.ForEachBucket(func(name []byte) error {
+		b, err := tx.Bucket(name)
+		if err != nil {
+			return err
+		}
+		return bucket(b)
+	})
+	if err != nil {
+		return err
+	}
+	if err := record(BACKUP_END, binary.BigEndian.AppendUint32(nil, crc.Sum32()), nil, 0); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Restore loads a backup of WriteBackup with a Loader begun with ctx,
+// over the keys and buckets of the DB: the keys of both are kept, those
+// of the backup win. Restored into an empty DB it's the database backed
+// up. Its version is returned.
+//
+// The backup is committed as it's read, in batches: a failed Restore
+// leaves the keys before the failure, a backup cut or damaged fails with
+// ErrCorrupt at the end.
+func (db *DB) Restore(ctx context.Context, r io.Reader) (version uint64, err error) {
+	br := bufio.NewReader(r)
+	crc := crc32.NewIEEE()
+	in := io.TeeReader(br, crc)
+	var header [BACKUP_HEADER]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return 0, backupError(err)
+	}
+	if string(header[:8]) != BACKUP_SIG {
+		return 0, fmt.Errorf("%w: not a backup", ErrCorrupt)
+	}
+	version = binary.BigEndian.Uint64(header[8:])
+	l := db.NewLoader(ctx)
+	defer func() {
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	var path [][]byte
+	for {
+		kind, key, value, deadline, err := readBackupRecord(in, crc)
+		if err != nil {
+			return 0, err
+		}
+		switch kind {
+		case BACKUP_KEY:
+			var at time.Time
+			if deadline != 0 {
+				at = time.Unix(0, deadline)
+			}
+			err = l.SetWithExpiry(path, key, value, at)
+		case BACKUP_BUCKET:
+			path = splitPath(key)
+			err = l.CreateBucket(path)
+		case BACKUP_END:
+			return version, nil
+		default:
+			err = fmt.Errorf("%w: record of type %d", ErrCorrupt, kind)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// remove every key and bucket before a restore, in Txs of CLEAR_KEYS
+// keys; the internal trees other than those of the keys stay
+func (db *DB) clear(ctx context.Context) error {
+	for {
+		tx, err := db.BeginContext(ctx, true)
+		if err != nil {
+			return err
+		}
+		var keys [][]byte
+		c := tx.Cursor()
+		for key, _ := c.First(); key != nil && len(keys) < CLEAR_KEYS; key, _ = c.Next() {
+			keys = append(keys, bytes.Clone(key))
+		}
+		err = c.Err()
+		for i := 0; err == nil && i < len(keys); i++ {
+			_, err = tx.Del(keys[i])
+		}
+		if err == nil && len(keys) < CLEAR_KEYS {
+			var names [][]byte
+			err = tx.ForEachBucket(func(name []byte) error {
+				names = append(names, bytes.Clone(name))
+				return nil
+			})
+			for i := 0; err == nil && i < len(names); i++ {
+				err = tx.DeleteBucket(names[i])
+			}
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil || len(keys) < CLEAR_KEYS {
+			return err
+		}
+	}
+}
+
+// a record of a backup, the END record checked against the CRC of what's
+// before it
+func readBackupRecord(r io.Reader, crc hash.Hash32) (kind byte, key, value []byte, deadline int64, err error) {
+	sum := crc.Sum32()
+	var h [BACKUP_RECORD_HEADER]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, nil, 0, backupError(err)
+	}
+	kind, deadline = h[0], int64(binary.BigEndian.Uint64(h[9:]))
+	klen, vlen := binary.BigEndian.Uint32(h[1:]), binary.BigEndian.Uint32(h[5:])
+	if klen > MAX_PAGE_SIZE || vlen > MAX_PAGE_SIZE {
+		return 0, nil, nil, 0, fmt.Errorf("%w: record of %d and %d bytes", ErrCorrupt, klen, vlen)
+	}
+	data := make([]byte, klen+vlen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, nil, 0, backupError(err)
+	}
+	key, value = data[:klen], data[klen:]
+	if kind == BACKUP_END && (klen != 4 || binary.BigEndian.Uint32(key) != sum) {
+		return 0, nil, nil, 0, fmt.Errorf("%w: bad backup checksum", ErrCorrupt)
+	}
+	return kind, key, value, deadline, nil
+}
+
+func backupError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: backup is cut", ErrCorrupt)
+	}
+	return err
+}
+
+// WriteIncrementalBackup writes to w the commits after the version since,
+// of a backup or of an incremental backup before, up to the last one, and
+// returns the version of the last: RestoreIncremental applies them to a
+// DB restored up to since. The commits are read from the WAL and the
+// segments it keeps after the checkpoints, see WithWALArchiveSize; ErrWALGone
+// if those after since aren't kept anymore, a full backup is needed then.
+// The commits of an encrypted database are sealed with its key.
+func (db *DB) WriteIncrementalBackup(w io.Writer, since uint64) (uint64, error) {
+	version := db.visible.Load().version
+	if err := db.writeIncrementalBackup(w, since, version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// write the commits after since up to version
+func (db *DB) writeIncrementalBackup(w io.Writer, since, version uint64) error {
+	if since > version {
+		return fmt.Errorf("%w: version %d is after the last commit %d", ErrBackupChain, since, version)
+	}
+	bw := bufio.NewWriter(w)
+	crc := crc32.NewIEEE()
+	out := io.MultiWriter(bw, crc)
+	sig := INCREMENTAL_SIG
+	if db.cipher != nil {
+		sig = INCREMENTAL_SIG_SEALED
+	}
+	header := append([]byte(sig), make([]byte, 16)...)
+	binary.BigEndian.PutUint64(header[8:], since)
+	binary.BigEndian.PutUint64(header[16:], version)
+	out.Write(header)
+	r := db.newWALReader(since)
+	for r.version < version {
+		recs, err := r.next()
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if rec.version > version {
+				break
+			}
+			data := encodeWALRecord(stripReplicated(rec))
+			if db.cipher != nil {
+				data = db.cipher.sealRecord(data)
+			}
+			if _, err := out.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+	bw.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	return bw.Flush()
+}
+
+// RestoreIncremental applies an incremental backup of
+// WriteIncrementalBackup to a DB restored up to version, by Restore or
+// RestoreIncremental: ErrBackupChain if the backup is after another
+// version. It returns the version of the backup, to restore the next one.
+//
+// The commits are applied as they're read, INCREMENTAL_APPLY of them in a
+// Tx begun with ctx: a failed RestoreIncremental leaves those before the
+// failure, a backup cut or damaged fails with ErrCorrupt. The commits of
+// an encrypted database are opened with the key of the DB, ErrEncryptionKey
+// if it's another.
+func (db *DB) RestoreIncremental(ctx context.Context, r io.Reader, version uint64) (uint64, error) {
+	br := bufio.NewReader(r)
+	crc := crc32.NewIEEE()
+	in := io.TeeReader(br, crc)
+	var header [INCREMENTAL_HEADER]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return 0, backupError(err)
+	}
+	var c *pageCipher
+	switch string(header[:8]) {
+	case INCREMENTAL_SIG:
+	case INCREMENTAL_SIG_SEALED:
+		if c = db.cipher; c == nil {
+			return 0, fmt.Errorf("%w: incremental backup sealed, the database isn't encrypted", ErrEncryptionKey)
+		}
+	default:
+		return 0, fmt.Errorf("%w: not an incremental backup", ErrCorrupt)
+	}
+	since, last := binary.BigEndian.Uint64(header[8:]), binary.BigEndian.Uint64(header[16:])
+	if since != version {
+		return 0, fmt.Errorf("%w: backup after version %d, restored up to %d", ErrBackupChain, since, version)
+	}
+	var recs []walRecord
+	apply := func() error {
+		err := db.replayRecords(ctx, recs)
+		recs = recs[:0]
+		return err
+	}
+	for version < last {
+		rec, err := readIncrementalRecord(in, c)
+		if err != nil {
+			return 0, err
+		}
+		if rec.version != version+1 {
+			return 0, fmt.Errorf("%w: version %d follows %d", ErrCorrupt, rec.version, version)
+		}
+		version = rec.version
+		if recs = append(recs, rec); len(recs) == INCREMENTAL_APPLY {
+			if err := apply(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	sum := crc.Sum32()
+	var trailer [4]byte
+	if _, err := io.ReadFull(br, trailer[:]); err != nil {
+		return 0, backupError(err)
+	}
+	if binary.BigEndian.Uint32(trailer[:]) != sum {
+		return 0, fmt.Errorf("%w: bad backup checksum", ErrCorrupt)
+	}
+	if len(recs) > 0 {
+		if err := apply(); err != nil {
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+// a WAL record of an incremental backup, checked against its CRC and
+// opened with the cipher if sealed
+func readIncrementalRecord(r io.Reader, c *pageCipher) (walRecord, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return walRecord{}, backupError(err)
+	}
+	size := binary.LittleEndian.Uint32(h[4:])
+	if size < WAL_RECORD_HEADER+4 || size > INCREMENTAL_MAX_RECORD {
+		return walRecord{}, fmt.Errorf("%w: record of %d bytes", ErrCorrupt, size)
+	}
+	data := make([]byte, size)
+	copy(data, h[:])
+	if _, err := io.ReadFull(r, data[8:]); err != nil {
+		return walRecord{}, backupError(err)
+	}
+	if crc32.ChecksumIEEE(data[4:]) != binary.LittleEndian.Uint32(data) {
+		return walRecord{}, fmt.Errorf("%w: bad record checksum", ErrCorrupt)
+	}
+	if c != nil {
+		var err error
+		if data, err = c.openRecord(data); err != nil {
+			return walRecord{}, err
+		}
+	}
+	rec, err := decodeWALRecord(data)
+	if err != nil {
+		return walRecord{}, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return rec, nil
+}
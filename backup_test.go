@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+	db := openTest(t)
+	fillBuckets(t, db)
+	db.SetWithTTL([]byte("t"), []byte("x"), time.Hour)
+	tx, _ := db.Begin(true)
+	users, _ := tx.Bucket([]byte("users"))
+	inner, _ := users.CreateBucket([]byte("inner"))
+	inner.Set([]byte("i"), []byte("j"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a snapshot, whatever is committed after
+	tx, _ = db.Begin(false)
+	mustSet(t, db, "later", "x")
+	var buf bytes.Buffer
+	if err := tx.WriteBackup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	version := tx.Version()
+	tx.Rollback()
+	if err := tx.WriteBackup(&buf); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("backup of a closed Tx: %v", err)
+	}
+	backup := buf.Bytes()
+
+	dst := openTest(t)
+	got, err := dst.Restore(context.Background(), bytes.NewReader(backup))
+	if err != nil || got != version {
+		t.Fatalf("restored version %d of %d: %v", got, version, err)
+	}
+	checkBuckets(t, dst)
+	wantValue(t, dst, "later", nil)
+	tx, _ = dst.Begin(false)
+	defer tx.Rollback()
+	if at, _ := tx.Expiry([]byte("t")); at.IsZero() {
+		t.Fatal("expiry not restored")
+	}
+	users, _ = tx.Bucket([]byte("users"))
+	if inner, err := users.Bucket([]byte("inner")); err != nil {
+		t.Fatal(err)
+	} else if v, _, _ := inner.Get([]byte("i")); string(v) != "j" {
+		t.Fatalf("i of inner is %q", v)
+	}
+}
+
+func TestRestoreCorrupt(t *testing.T) {
+	db := openTest(t)
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, fmt.Sprint("k", i), "v")
+	}
+	tx, _ := db.Begin(false)
+	var buf bytes.Buffer
+	tx.WriteBackup(&buf)
+	tx.Rollback()
+	backup := buf.Bytes()
+
+	flipped := bytes.Clone(backup)
+	flipped[BACKUP_HEADER+BACKUP_RECORD_HEADER] ^= 1
+	notBackup := bytes.Clone(backup)
+	notBackup[0] = 'X'
+	for name, data := range map[string][]byte{
+		"cut":        backup[:len(backup)-3],
+		"header":     backup[:BACKUP_HEADER-1],
+		"flipped":    flipped,
+		"not backup": notBackup,
+	} {
+		dst := openTest(t)
+		if _, err := dst.Restore(context.Background(), bytes.NewReader(data)); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("restore of a %s backup: %v", name, err)
+		}
+	}
+}
+
+// restoring over a DB keeps its keys, clear drops them first
+func TestRestoreOver(t *testing.T) {
+	src := openTest(t)
+	mustSet(t, src, "a", "backup")
+	tx, _ := src.Begin(false)
+	var buf bytes.Buffer
+	tx.WriteBackup(&buf)
+	tx.Rollback()
+
+	db := openTest(t)
+	fillBuckets(t, db)
+	mustSet(t, db, "a", "mine")
+	if _, err := db.Restore(context.Background(), bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	wantValue(t, db, "a", []byte("backup"))
+	wantValue(t, db, "k", []byte("default"))
+
+	if err := db.clear(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = db.Begin(false)
+	defer tx.Rollback()
+	if n := countKeys(t, tx); n != 0 || len(listBuckets(tx, nil)) != 0 {
+		t.Fatalf("%d keys and buckets %v after clear", n, listBuckets(tx, nil))
+	}
+}
+
+// a full backup and incremental ones after it, from the WAL and its archive
+func TestIncrementalBackup(t *testing.T) {
+	src := openTest(t, WithWALArchiveSize(1<<30), WithCheckpointSize(64<<10))
+	for i := 0; i < 100; i++ {
+		writeReplicated(t, src, i)
+	}
+	tx, _ := src.Begin(false)
+	var full bytes.Buffer
+	tx.WriteBackup(&full)
+	since := tx.Version()
+	tx.Rollback()
+	dst := openTest(t)
+	version, err := dst.Restore(context.Background(), &full)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the commits of the chain, across the checkpoints of the archive
+	var incrementals [][]byte
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 1000; i++ {
+			writeReplicated(t, src, 100+n*1000+i)
+		}
+		var buf bytes.Buffer
+		last, err := src.WriteIncrementalBackup(&buf, since)
+		if err != nil || last != src.visible.Load().version {
+			t.Fatalf("incremental backup up to %d: %v", last, err)
+		}
+		incrementals = append(incrementals, buf.Bytes())
+		since = last
+	}
+	if segments, _ := walSegments(src.Path); len(segments) == 0 {
+		t.Fatal("no segment archived")
+	}
+	if _, err := dst.RestoreIncremental(context.Background(), bytes.NewReader(incrementals[1]), version); !errors.Is(err, ErrBackupChain) {
+		t.Fatalf("restore of the second incremental first: %v", err)
+	}
+	for _, b := range incrementals {
+		if version, err = dst.RestoreIncremental(context.Background(), bytes.NewReader(b), version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if version != since {
+		t.Fatalf("restored up to %d, backed up to %d", version, since)
+	}
+	wantSameDB(t, src, dst)
+
+	// nothing after the last commit
+	var empty bytes.Buffer
+	if last, err := src.WriteIncrementalBackup(&empty, since); err != nil || last != since || empty.Len() != INCREMENTAL_HEADER+4 {
+		t.Fatalf("empty incremental of %d bytes up to %d: %v", empty.Len(), last, err)
+	}
+	if _, err := src.WriteIncrementalBackup(io.Discard, since+1); !errors.Is(err, ErrBackupChain) {
+		t.Fatalf("incremental after the last commit: %v", err)
+	}
+
+	backup := incrementals[0]
+	flipped := bytes.Clone(backup)
+	flipped[INCREMENTAL_HEADER+10] ^= 1
+	trailer := bytes.Clone(backup)
+	trailer[len(trailer)-1] ^= 1
+	notIncremental := bytes.Clone(backup)
+	notIncremental[0] = 'X'
+	for name, data := range map[string][]byte{
+		"cut":             backup[:len(backup)-100],
+		"header":          backup[:INCREMENTAL_HEADER-1],
+		"flipped":         flipped,
+		"trailer":         trailer,
+		"not incremental": notIncremental,
+		"full":            full.Bytes(),
+	} {
+		db := openTest(t)
+		if _, err := db.RestoreIncremental(context.Background(), bytes.NewReader(data), binary.BigEndian.Uint64(backup[8:])); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("restore of a %s incremental: %v", name, err)
+		}
+	}
+
+	// the commits after the full backup pruned from the archive
+	src = reopenTest(t, src, WithWALArchiveSize(1), WithCheckpointSize(64<<10))
+	for i := 0; i < 1000; i++ {
+		writeReplicated(t, src, 3000+i)
+	}
+	src.Checkpoint()
+	if _, err := src.WriteIncrementalBackup(io.Discard, binary.BigEndian.Uint64(backup[8:])); !errors.Is(err, ErrWALGone) {
+		t.Fatalf("incremental of pruned commits: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+//go:build badger
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// ImportBadger loads the keys of a Badger database in key order from a
+// snapshot: they're set outside buckets, over those of the DB, and keep
+// their TTL as their expiry, to the second as in Badger; the keys expired
+// or deleted are skipped. It's built with the badger tag after go get of
+// badger v4. The database is opened read-only, and fails if another
+// process has it open.
+//
+// progress, if not nil, is called every IMPORT_PROGRESS_KEYS keys and at
+// the end, whose counts are returned; the bytes read are those of the keys
+// and values, of the size of the LSM tree and the value log, which has
+// the values removed until its garbage collection. It goes at
+// WithImportRate at most. A failed import leaves the batches committed.
+func (db *DB) ImportBadger(ctx context.Context, dir string, progress func(ImportProgress)) (p ImportProgress, err error) {
+	bdb, err := badger.Open(badger.DefaultOptions(dir).WithReadOnly(true).WithLogger(nil))
+	if err != nil {
+		return p, err
+	}
+	defer bdb.Close()
+	lsm, vlog := bdb.Size()
+	ctx, span := db.startSpan(ctx, "storage_engine.import")
+	defer func() { endSpan(span, err) }()
+	span.set("import.source", "badger")
+	txn := bdb.NewTransaction(false)
+	defer txn.Discard()
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	var read int64
+	im := db.newImporter(ctx, lsm+vlog, func() int64 { return read }, progress)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		var value []byte
+		if value, err = item.ValueCopy(nil); err != nil {
+			break
+		}
+		var at time.Time
+		if exp := item.ExpiresAt(); exp > 0 {
+			at = time.Unix(int64(exp), 0)
+		}
+		read += int64(len(item.Key()) + len(value))
+		if err = im.setWithExpiry(nil, item.Key(), value, at); err != nil {
+			break
+		}
+	}
+	p, err = im.close(err)
+	span.set("import.keys", p.Keys)
+	return p, err
+}
@@ -0,0 +1,72 @@
+//go:build badger
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+func TestImportBadger(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "badger")
+	bdb, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb := bdb.NewWriteBatch()
+	for i := 0; i < 30000; i++ {
+		wb.Set([]byte(fmt.Sprintf("k%05d", i)), []byte(fmt.Sprint(i)))
+	}
+	if err := wb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	err = bdb.Update(func(txn *badger.Txn) error {
+		txn.SetEntry(badger.NewEntry([]byte("ttl"), []byte("x")).WithTTL(time.Hour))
+		txn.SetEntry(badger.NewEntry([]byte("expired"), []byte("x")).WithTTL(time.Second))
+		return txn.Delete([]byte("k00000"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bdb.Close()
+	time.Sleep(1100 * time.Millisecond)
+
+	db := openTest(t)
+	var reports []ImportProgress
+	p, err := db.ImportBadger(context.Background(), dir, func(p ImportProgress) { reports = append(reports, p) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Keys != 30000 || p.Size == 0 || len(reports) != 4 {
+		t.Fatalf("progress %+v, %d reports", p, len(reports))
+	}
+	wantValue(t, db, "k12345", []byte("12345"))
+	wantValue(t, db, "ttl", []byte("x"))
+	wantValue(t, db, "k00000", nil)
+	wantValue(t, db, "expired", nil)
+	db.View(func(tx *Tx) error {
+		at, err := tx.Expiry([]byte("ttl"))
+		if err != nil || time.Until(at) < 59*time.Minute || time.Until(at) > time.Hour+time.Second || at.Nanosecond() != 0 {
+			t.Fatalf("expiry of ttl %v: %v", at, err)
+		}
+		if at, err := tx.Expiry([]byte("k12345")); err != nil || !at.IsZero() {
+			t.Fatalf("expiry of a key without TTL %v: %v", at, err)
+		}
+		return nil
+	})
+
+	// the database of a process holding it
+	bdb, err = badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bdb.Close()
+	if _, err := db.ImportBadger(context.Background(), dir, nil); err == nil {
+		t.Fatal("import of a database held by another")
+	}
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	BATCH_SIG = "SEB1"
+
+	// batch layout, see MarshalBinary
+	// | sig | nops | ops... |
+	// | 4B  | 4B   |        |
+	// op layout, the deadline in unix nanoseconds, 0 without one
+	// | type | klen | vlen | deadline | key | value |
+	// | 1B   | 2B   | 4B   | 8B       | ... | ...   |
+	BATCH_HEADER    = 4 + 4
+	BATCH_OP_HEADER = 1 + 2 + 4 + 8
+
+	BATCH_OP_SET = 1
+	BATCH_OP_DEL = 2
+)
+
+var ErrBadBatch = errors.New("bad batch")
+
+// Batch is a list of updates of the keys outside buckets, written in one
+// Tx by DB.Write. It's encoded with MarshalBinary to be sent or logged, by
+// replication for one. Not safe for concurrent use.
+type Batch struct {
+	ops  []batchOp
+	size int // of the encoding
+}
+
+type batchOp struct {
+	kind     byte
+	key      []byte
+	value    []byte
+	deadline int64
+}
+
+// Set sets a key, the slices are copied.
+func (b *Batch) Set(key, value []byte) {
+	b.SetWithExpiry(key, value, time.Time{})
+}
+
+// SetWithExpiry sets a key until at, see Tx.SetWithExpiry.
+func (b *Batch) SetWithExpiry(key, value []byte, at time.Time) {
+	var deadline int64
+	if !at.IsZero() {
+		deadline = max(at.UnixNano(), 1)
+	}
+	b.add(batchOp{BATCH_OP_SET, append([]byte(nil), key...), append([]byte{}, value...), deadline})
+}
+
+func (b *Batch) Del(key []byte) {
+	b.add(batchOp{kind: BATCH_OP_DEL, key: append([]byte(nil), key...)})
+}
+
+func (b *Batch) add(op batchOp) {
+	b.ops = append(b.ops, op)
+	b.size += BATCH_OP_HEADER + len(op.key) + len(op.value)
+}
+
+// Len is the number of updates.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) Reset() {
+	b.ops, b.size = b.ops[:0], 0
+}
+
+func (b *Batch) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, BATCH_HEADER+b.size)
+	data = append(data, BATCH_SIG...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(b.ops)))
+	for _, op := range b.ops {
+		if len(op.key) > 0xffff {
+			return nil, fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, len(op.key))
+		}
+		data = append(data, op.kind)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(op.key)))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(op.value)))
+		data = binary.BigEndian.AppendUint64(data, uint64(op.deadline))
+		data = append(data, op.key...)
+		data = append(data, op.value...)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary replaces the updates of the Batch by those of data.
+func (b *Batch) UnmarshalBinary(data []byte) error {
+	if len(data) < BATCH_HEADER || string(data[:4]) != BATCH_SIG {
+		return fmt.Errorf("%w: no signature", ErrBadBatch)
+	}
+	n := binary.BigEndian.Uint32(data[4:])
+	data = data[BATCH_HEADER:]
+	b.Reset()
+	for i := uint32(0); i < n; i++ {
+		if len(data) < BATCH_OP_HEADER {
+			return fmt.Errorf("%w: op %d is cut", ErrBadBatch, i)
+		}
+		op := batchOp{kind: data[0], deadline: int64(binary.BigEndian.Uint64(data[7:]))}
+		klen, vlen := int(binary.BigEndian.Uint16(data[1:])), int(binary.BigEndian.Uint32(data[3:]))
+		data = data[BATCH_OP_HEADER:]
+		if len(data) < klen+vlen {
+			return fmt.Errorf("%w: op %d is cut", ErrBadBatch, i)
+		}
+		if op.kind != BATCH_OP_SET && op.kind != BATCH_OP_DEL {
+			return fmt.Errorf("%w: op %d of type %d", ErrBadBatch, i, op.kind)
+		}
+		op.key = append([]byte(nil), data[:klen]...)
+		if op.kind == BATCH_OP_SET {
+			op.value = append([]byte{}, data[klen:klen+vlen]...)
+		}
+		data = data[klen+vlen:]
+		b.add(op)
+	}
+	if len(data) > 0 {
+		return fmt.Errorf("%w: %d bytes after the ops", ErrBadBatch, len(data))
+	}
+	return nil
+}
+
+// Write applies the updates of the batch in order in one Tx begun with ctx,
+// all of them or none.
+func (db *DB) Write(ctx context.Context, b *Batch) error {
+	tx, err := db.BeginContext(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.WriteBatch(b); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// WriteBatch applies the updates of the batch to the Tx.
+func (tx *Tx) WriteBatch(b *Batch) error {
+	for _, op := range b.ops {
+		var err error
+		switch {
+		case op.kind == BATCH_OP_DEL:
+			_, err = tx.Del(op.key)
+		case op.deadline != 0:
+			err = tx.SetWithExpiry(op.key, op.value, time.Unix(0, op.deadline))
+		default:
+			err = tx.Set(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
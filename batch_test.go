@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	var b Batch
+	at := time.Now().Add(time.Hour)
+	b.Set([]byte("a"), []byte("1"))
+	b.Set([]byte("e"), nil)
+	b.SetWithExpiry([]byte("t"), []byte("x"), at)
+	b.Del([]byte("b"))
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != BATCH_HEADER+b.size {
+		t.Fatalf("%d bytes, %d planned", len(data), BATCH_HEADER+b.size)
+	}
+	var got Batch
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got.ops) != fmt.Sprint(b.ops) || got.size != b.size || got.Len() != 4 {
+		t.Fatalf("unmarshaled %v, want %v", got.ops, b.ops)
+	}
+	// a set of an empty value isn't a delete
+	if got.ops[1].value == nil {
+		t.Fatal("empty value unmarshaled as nil")
+	}
+
+	for _, bad := range [][]byte{
+		nil, []byte("SEB2\x00\x00\x00\x00"), data[:len(data)-1], data[:BATCH_HEADER+3], append(bytes.Clone(data), 0),
+	} {
+		if err := got.UnmarshalBinary(bad); !errors.Is(err, ErrBadBatch) {
+			t.Fatalf("unmarshal of %q: %v", bad, err)
+		}
+	}
+	bad := bytes.Clone(data)
+	bad[BATCH_HEADER] = 9
+	if err := got.UnmarshalBinary(bad); !errors.Is(err, ErrBadBatch) {
+		t.Fatalf("op of type 9: %v", err)
+	}
+
+	b.Reset()
+	if b.Len() != 0 || b.size != 0 {
+		t.Fatalf("%d ops after a reset", b.Len())
+	}
+	b.Set(make([]byte, 1<<16), nil)
+	if _, err := b.MarshalBinary(); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("marshal of a key of 64 KiB: %v", err)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "b", "old")
+	var b Batch
+	b.Set([]byte("a"), []byte("1"))
+	b.SetWithExpiry([]byte("t"), []byte("x"), time.Now().Add(time.Hour))
+	b.Del([]byte("b"))
+	b.Set([]byte("a"), []byte("2"))
+	version := db.version
+	if err := db.Write(context.Background(), &b); err != nil {
+		t.Fatal(err)
+	}
+	if db.version != version+1 {
+		t.Fatalf("batch written in %d commits", db.version-version)
+	}
+	wantValue(t, db, "a", []byte("2"))
+	wantValue(t, db, "b", nil)
+	tx, _ := db.Begin(false)
+	if at, _ := tx.Expiry([]byte("t")); at.IsZero() {
+		t.Fatal("expiry of the batch lost")
+	}
+	tx.Rollback()
+
+	// all of them or none
+	b.Reset()
+	b.Set([]byte("c"), []byte("1"))
+	b.Set(nil, []byte("1"))
+	if err := db.Write(context.Background(), &b); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("write of an empty key: %v", err)
+	}
+	wantValue(t, db, "c", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.Write(ctx, &b); !errors.Is(err, context.Canceled) {
+		t.Fatalf("write with ctx done: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+)
+
+// Importing bbolt files: ImportBolt reads the file itself, the layout of
+// bbolt 1.x, without the bbolt package.
+//
+// The first two pages are the meta pages, the one of the last transaction
+// that has a valid checksum is used. Its root bucket is a tree of branch
+// and leaf pages, the leaf elements flagged as buckets have the root of
+// their tree as value, or the tree itself when it fits in a page inline.
+// Integers are little-endian.
+//
+// page layout
+// | id | flags | count | overflow | elements... |
+// | 8B | 2B    | 2B    | 4B       |             |
+// meta layout, after the page header, the checksum is FNV-1a of the rest
+// | magic | version | page size | flags | root | sequence | freelist | pgid | txid | checksum |
+// | 4B    | 4B      | 4B        | 4B    | 8B   | 8B       | 8B       | 8B   | 8B   | 8B       |
+// branch element, pos is from the element to its key
+// | pos | ksize | pgid |
+// | 4B  | 4B    | 8B   |
+// leaf element, the value follows the key
+// | flags | pos | ksize | vsize |
+// | 4B    | 4B  | 4B    | 4B    |
+// bucket value, followed by the inline page if root is 0
+// | root | sequence |
+// | 8B   | 8B       |
+
+const (
+	BOLT_MAGIC        = 0xED0CDAED
+	BOLT_VERSION      = 2
+	BOLT_PAGE_HEADER  = 16
+	BOLT_ELEMENT      = 16
+	BOLT_META         = 64
+	BOLT_BUCKET       = 16
+	BOLT_BRANCH_PAGE  = 0x01
+	BOLT_LEAF_PAGE    = 0x02
+	BOLT_BUCKET_LEAF  = 0x01
+	BOLT_MAX_DEPTH    = 64 // of the trees, deeper is a cycle
+	BOLT_DEFAULT_PAGE = 4096
+)
+
+var ErrBadBolt = errors.New("bad bbolt file")
+
+// ImportBolt loads the buckets and keys of a bbolt file with a Loader,
+// nested buckets included, over those of the DB. bbolt has no keys outside
+// buckets, nor expiry; the sequences of the buckets are not kept. The file
+// must not be written meanwhile.
+//
+// progress, if not nil, is called every IMPORT_PROGRESS_KEYS keys and at
+// the end, whose counts are returned. It goes at WithImportRate at most. A
+// failed import leaves the batches committed.
+func (db *DB) ImportBolt(ctx context.Context, path string, progress func(ImportProgress)) (p ImportProgress, err error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return p, err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return p, err
+	}
+	b := &boltReader{fp: fp, size: fi.Size()}
+	root, err := b.meta()
+	if err != nil {
+		return p, err
+	}
+	ctx, span := db.startSpan(ctx, "storage_engine.import")
+	defer func() { endSpan(span, err) }()
+	span.set("import.source", "bolt")
+	im := db.newImporter(ctx, b.size, func() int64 { return b.read }, progress)
+	err = b.walk(root, nil, nil, 0, func(path [][]byte, key, value []byte, bucket bool) error {
+		if bucket {
+			return im.createBucket(append(path[:len(path):len(path)], key))
+		}
+		if err := im.set(path, key, value); err != nil {
+			return fmt.Errorf("key %q of bucket %s: %w", key, bytes.Join(path, []byte("/")), err)
+		}
+		return nil
+	})
+	p, err = im.close(err)
+	span.set("import.keys", p.Keys)
+	return p, err
+}
+
+type boltReader struct {
+	fp       *os.File
+	size     int64
+	pageSize int64
+	pages    uint64 // the high water mark of the meta
+	read     int64
+}
+
+// the root of the root bucket, from the meta page of the last transaction
+func (b *boltReader) meta() (uint64, error) {
+	var root, txid uint64
+	found := false
+	ok := func(m []byte) bool {
+		if len(m) < BOLT_PAGE_HEADER+BOLT_META {
+			return false
+		}
+		m = m[BOLT_PAGE_HEADER:]
+		h := fnv.New64a()
+		h.Write(m[:56])
+		return binary.LittleEndian.Uint32(m) == BOLT_MAGIC && binary.LittleEndian.Uint32(m[4:]) == BOLT_VERSION &&
+			h.Sum64() == binary.LittleEndian.Uint64(m[56:])
+	}
+	m0 := make([]byte, BOLT_PAGE_HEADER+BOLT_META)
+	if _, err := b.fp.ReadAt(m0, 0); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadBolt, err)
+	}
+	b.pageSize = BOLT_DEFAULT_PAGE
+	if ok(m0) {
+		b.pageSize = int64(binary.LittleEndian.Uint32(m0[BOLT_PAGE_HEADER+8:]))
+	}
+	if b.pageSize < BOLT_PAGE_HEADER+BOLT_META || b.pageSize > MAX_PAGE_SIZE {
+		return 0, fmt.Errorf("%w: pages of %d bytes", ErrBadBolt, b.pageSize)
+	}
+	m1 := make([]byte, len(m0))
+	if _, err := b.fp.ReadAt(m1, b.pageSize); err != nil {
+		m1 = nil
+	}
+	for _, m := range [][]byte{m0, m1} {
+		if !ok(m) || int64(binary.LittleEndian.Uint32(m[BOLT_PAGE_HEADER+8:])) != b.pageSize {
+			continue
+		}
+		m = m[BOLT_PAGE_HEADER:]
+		if t := binary.LittleEndian.Uint64(m[48:]); !found || t > txid {
+			found, txid = true, t
+			root, b.pages = binary.LittleEndian.Uint64(m[16:]), binary.LittleEndian.Uint64(m[40:])
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("%w: no valid meta page", ErrBadBolt)
+	}
+	return root, nil
+}
+
+// a page and its overflow
+func (b *boltReader) page(id uint64) ([]byte, error) {
+	if id < 2 || id >= b.pages {
+		return nil, fmt.Errorf("%w: page %d out of the file", ErrBadBolt, id)
+	}
+	header := make([]byte, BOLT_PAGE_HEADER)
+	if _, err := b.fp.ReadAt(header, int64(id)*b.pageSize); err != nil {
+		return nil, fmt.Errorf("%w: page %d: %v", ErrBadBolt, id, err)
+	}
+	overflow := uint64(binary.LittleEndian.Uint32(header[12:]))
+	if binary.LittleEndian.Uint64(header) != id || id+overflow >= b.pages {
+		return nil, fmt.Errorf("%w: page %d has a bad header", ErrBadBolt, id)
+	}
+	data := make([]byte, int64(overflow+1)*b.pageSize)
+	if _, err := b.fp.ReadAt(data, int64(id)*b.pageSize); err != nil {
+		return nil, fmt.Errorf("%w: page %d: %v", ErrBadBolt, id, err)
+	}
+	b.read += int64(len(data))
+	return data, nil
+}
+
+// call fn for the elements of the tree of a bucket in order, its root page
+// id or its inline page, then for those of the buckets inside as they come
+func (b *boltReader) walk(id uint64, inline []byte, path [][]byte, depth int, fn func(path [][]byte, key, value []byte, bucket bool) error) error {
+	if depth > BOLT_MAX_DEPTH {
+		return fmt.Errorf("%w: trees deeper than %d", ErrBadBolt, BOLT_MAX_DEPTH)
+	}
+	data := inline
+	if data == nil {
+		var err error
+		if data, err = b.page(id); err != nil {
+			return err
+		}
+	}
+	if len(data) < BOLT_PAGE_HEADER {
+		return fmt.Errorf("%w: inline page of %d bytes", ErrBadBolt, len(data))
+	}
+	flags, count := binary.LittleEndian.Uint16(data[8:]), int(binary.LittleEndian.Uint16(data[10:]))
+	if BOLT_PAGE_HEADER+count*BOLT_ELEMENT > len(data) {
+		return fmt.Errorf("%w: page %d has %d elements", ErrBadBolt, id, count)
+	}
+	// the slice of an element, key then value, checked against the page
+	field := func(elem, pos, size int) ([]byte, error) {
+		start := elem + pos
+		if pos < 0 || start+size > len(data) || size < 0 {
+			return nil, fmt.Errorf("%w: element out of page %d", ErrBadBolt, id)
+		}
+		return data[start : start+size], nil
+	}
+	for i := 0; i < count; i++ {
+		elem := BOLT_PAGE_HEADER + i*BOLT_ELEMENT
+		e := data[elem : elem+BOLT_ELEMENT]
+		switch {
+		case flags&BOLT_BRANCH_PAGE != 0:
+			if err := b.walk(binary.LittleEndian.Uint64(e[8:]), nil, path, depth+1, fn); err != nil {
+				return err
+			}
+		case flags&BOLT_LEAF_PAGE != 0:
+			pos, ksize, vsize := int(binary.LittleEndian.Uint32(e[4:])), int(binary.LittleEndian.Uint32(e[8:])), int(binary.LittleEndian.Uint32(e[12:]))
+			key, err := field(elem, pos, ksize)
+			if err != nil {
+				return err
+			}
+			value, err := field(elem, pos+ksize, vsize)
+			if err != nil {
+				return err
+			}
+			if binary.LittleEndian.Uint32(e)&BOLT_BUCKET_LEAF == 0 {
+				if err := fn(path, key, value, false); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(value) < BOLT_BUCKET {
+				return fmt.Errorf("%w: bucket %q of %d bytes", ErrBadBolt, key, len(value))
+			}
+			if err := fn(path, key, nil, true); err != nil {
+				return err
+			}
+			root, inline := binary.LittleEndian.Uint64(value), []byte(nil)
+			if root == 0 {
+				inline = value[BOLT_BUCKET:]
+			}
+			if err := b.walk(root, inline, append(path[:len(path):len(path)], key), depth+1, fn); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: page %d of type %#x in a tree", ErrBadBolt, id, flags)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// an element of a page of a bbolt file
+type boltElem struct {
+	bucket bool
+	key    []byte
+	value  []byte
+	child  uint64 // of a branch
+}
+
+// a page of the elements, size at least
+func boltPage(id uint64, flags uint16, overflow uint32, elems []boltElem, size int) []byte {
+	end := BOLT_PAGE_HEADER + BOLT_ELEMENT*len(elems)
+	for _, e := range elems {
+		end += len(e.key) + len(e.value)
+	}
+	p := make([]byte, max(end, size))
+	binary.LittleEndian.PutUint64(p, id)
+	binary.LittleEndian.PutUint16(p[8:], flags)
+	binary.LittleEndian.PutUint16(p[10:], uint16(len(elems)))
+	binary.LittleEndian.PutUint32(p[12:], overflow)
+	data := BOLT_PAGE_HEADER + BOLT_ELEMENT*len(elems)
+	for i, e := range elems {
+		elem := p[BOLT_PAGE_HEADER+BOLT_ELEMENT*i:]
+		pos := data - (BOLT_PAGE_HEADER + BOLT_ELEMENT*i)
+		if flags == BOLT_BRANCH_PAGE {
+			binary.LittleEndian.PutUint32(elem, uint32(pos))
+			binary.LittleEndian.PutUint32(elem[4:], uint32(len(e.key)))
+			binary.LittleEndian.PutUint64(elem[8:], e.child)
+		} else {
+			if e.bucket {
+				binary.LittleEndian.PutUint32(elem, BOLT_BUCKET_LEAF)
+			}
+			binary.LittleEndian.PutUint32(elem[4:], uint32(pos))
+			binary.LittleEndian.PutUint32(elem[8:], uint32(len(e.key)))
+			binary.LittleEndian.PutUint32(elem[12:], uint32(len(e.value)))
+		}
+		data += copy(p[data:], e.key)
+		data += copy(p[data:], e.value)
+	}
+	return p
+}
+
+// the value of a bucket whose root is the page, or inline if 0
+func boltBucket(root uint64, inline []boltElem) []byte {
+	value := binary.LittleEndian.AppendUint64(nil, root)
+	value = binary.LittleEndian.AppendUint64(value, 0)
+	if root == 0 {
+		value = append(value, boltPage(0, BOLT_LEAF_PAGE, 0, inline, 0)...)
+	}
+	return value
+}
+
+func boltMeta(id, root, pages, txid uint64) []byte {
+	p := make([]byte, BOLT_DEFAULT_PAGE)
+	binary.LittleEndian.PutUint64(p, id)
+	binary.LittleEndian.PutUint16(p[8:], 0x04)
+	m := p[BOLT_PAGE_HEADER:]
+	binary.LittleEndian.PutUint32(m, BOLT_MAGIC)
+	binary.LittleEndian.PutUint32(m[4:], BOLT_VERSION)
+	binary.LittleEndian.PutUint32(m[8:], BOLT_DEFAULT_PAGE)
+	binary.LittleEndian.PutUint64(m[16:], root)
+	binary.LittleEndian.PutUint64(m[32:], 2)
+	binary.LittleEndian.PutUint64(m[40:], pages)
+	binary.LittleEndian.PutUint64(m[48:], txid)
+	h := fnv.New64a()
+	h.Write(m[:56])
+	binary.LittleEndian.PutUint64(m[56:], h.Sum64())
+	return p
+}
+
+// a bbolt file of 8 pages: the bucket a of 200 keys in 2 leaves under a
+// branch, the second with an overflow page, the bucket b inline with the
+// bucket c inline in it, and e empty. The meta of txid 3 has a bad
+// checksum, that of txid 2 is used.
+func boltFile(t *testing.T) []byte {
+	var file []byte
+	bad := boltMeta(0, 99, 8, 3)
+	bad[BOLT_PAGE_HEADER+60]++
+	file = append(file, bad...)
+	file = append(file, boltMeta(1, 3, 8, 2)...)
+	file = append(file, boltPage(2, 0x10, 0, nil, BOLT_DEFAULT_PAGE)...) // freelist
+	c := boltBucket(0, []boltElem{{key: []byte("z"), value: []byte("zz")}})
+	b := boltBucket(0, []boltElem{{bucket: true, key: []byte("c"), value: c}, {key: []byte("x"), value: []byte("1")}})
+	file = append(file, boltPage(3, BOLT_LEAF_PAGE, 0, []boltElem{
+		{bucket: true, key: []byte("a"), value: boltBucket(4, nil)},
+		{bucket: true, key: []byte("b"), value: b},
+		{bucket: true, key: []byte("e"), value: boltBucket(0, nil)},
+	}, BOLT_DEFAULT_PAGE)...)
+	file = append(file, boltPage(4, BOLT_BRANCH_PAGE, 0, []boltElem{{key: []byte("k000"), child: 5}, {key: []byte("k100"), child: 6}}, BOLT_DEFAULT_PAGE)...)
+	var first, second []boltElem
+	for i := 0; i < 100; i++ {
+		first = append(first, boltElem{key: []byte(fmt.Sprintf("k%03d", i)), value: []byte(fmt.Sprint(i))})
+		second = append(second, boltElem{key: []byte(fmt.Sprintf("k%03d", 100+i)), value: make([]byte, 50)})
+	}
+	file = append(file, boltPage(5, BOLT_LEAF_PAGE, 0, first, BOLT_DEFAULT_PAGE)...)
+	file = append(file, boltPage(6, BOLT_LEAF_PAGE, 1, second, 2*BOLT_DEFAULT_PAGE)...)
+	if len(file) != 8*BOLT_DEFAULT_PAGE {
+		t.Fatalf("bbolt file of %d bytes", len(file))
+	}
+	return file
+}
+
+func TestImportBolt(t *testing.T) {
+	file := boltFile(t)
+	src := filepath.Join(t.TempDir(), "bolt.db")
+	os.WriteFile(src, file, 0o644)
+	db := openTest(t)
+	var reports int
+	p, err := db.ImportBolt(context.Background(), src, func(ImportProgress) { reports++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Keys != 202 || p.Buckets != 4 || p.Size != int64(len(file)) || reports == 0 {
+		t.Fatalf("progress %+v, %d reports", p, reports)
+	}
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	if names := fmt.Sprint(listBuckets(tx, nil)); names != "[a b e]" {
+		t.Fatalf("buckets %s", names)
+	}
+	a, _ := tx.Bucket([]byte("a"))
+	if v, _, _ := a.Get([]byte("k042")); string(v) != "42" {
+		t.Fatalf("k042 of a is %q", v)
+	}
+	if v, _, _ := a.Get([]byte("k199")); len(v) != 50 {
+		t.Fatalf("k199 of a is %q", v)
+	}
+	b, _ := tx.Bucket([]byte("b"))
+	inner, err := b.Bucket([]byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := inner.Get([]byte("z")); string(v) != "zz" {
+		t.Fatalf("z of b/c is %q", v)
+	}
+	if n := countKeys(t, tx); n != 0 {
+		t.Fatalf("%d keys outside buckets", n)
+	}
+}
+
+func TestImportBoltBad(t *testing.T) {
+	for name, edit := range map[string]func(file []byte) []byte{
+		"no meta":        func(file []byte) []byte { return file[:BOLT_DEFAULT_PAGE] },
+		"empty":          func(file []byte) []byte { return nil },
+		"bad page type":  func(file []byte) []byte { file[3*BOLT_DEFAULT_PAGE+8] = 0x20; return file },
+		"page id":        func(file []byte) []byte { file[4*BOLT_DEFAULT_PAGE] = 9; return file },
+		"child past end": func(file []byte) []byte { file[4*BOLT_DEFAULT_PAGE+BOLT_PAGE_HEADER+8] = 8; return file },
+		"elements":       func(file []byte) []byte { file[5*BOLT_DEFAULT_PAGE+10] = 0xff; return file },
+		"cycle":          func(file []byte) []byte { file[4*BOLT_DEFAULT_PAGE+BOLT_PAGE_HEADER+8] = 4; return file },
+		"cut": func(file []byte) []byte {
+			return file[:7*BOLT_DEFAULT_PAGE]
+		},
+		"element out of page": func(file []byte) []byte {
+			binary.LittleEndian.PutUint32(file[5*BOLT_DEFAULT_PAGE+BOLT_PAGE_HEADER+12:], 1<<20)
+			return file
+		},
+		"bucket value": func(file []byte) []byte {
+			// the value of a of 16 bytes, now 8
+			binary.LittleEndian.PutUint32(file[3*BOLT_DEFAULT_PAGE+BOLT_PAGE_HEADER+12:], 8)
+			return file
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), "bolt.db")
+			os.WriteFile(src, edit(boltFile(t)), 0o644)
+			db := openTest(t)
+			if _, err := db.ImportBolt(context.Background(), src, nil); !errors.Is(err, ErrBadBolt) {
+				t.Fatalf("import: %v", err)
+			}
+		})
+	}
+	db := openTest(t)
+	if _, err := db.ImportBolt(context.Background(), filepath.Join(t.TempDir(), "missing"), nil); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("import of a missing file: %v", err)
+	}
+}
@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A bucket is a key space of its own in the database file, with its own
+// tree. The catalog tree maps the bucket names to the roots of their trees,
+// its root is kept by the meta page next to the root of the keys of the Tx.
+// The keys of a bucket follow the comparator of the DB, the catalog is in
+// bytes.Compare order.
+//
+// Updates to a bucket are logged like the others, preceded by a
+// WAL_OP_BUCKET op with the path of the bucket. Deleting a bucket frees its
+// pages without logging its keys.
+
+var (
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrBucketExists   = errors.New("bucket already exists")
+	ErrBucketTx       = errors.New("buckets need a transaction from Begin")
+)
+
+// Buckets nest, a bucket can hold buckets as well as keys. The catalog
+// keys are the paths of the buckets: the names from the top, each escaped
+// and terminated so that the buckets inside another follow it in the
+// catalog, in name order.
+
+// Bucket is a handle on a bucket, valid until the Tx ends or the bucket is
+// deleted.
+type Bucket struct {
+	tx   *Tx
+	path []byte // catalog key of the bucket
+	name []byte
+	tree *BTree
+}
+
+// encode a name after the path of its parent:
+// 0x00 is escaped as 0x00 0xff and the name ends with 0x00 0x01
+func bucketPath(parent []byte, name []byte) []byte {
+	path := append([]byte(nil), parent...)
+	for _, c := range name {
+		path = append(path, c)
+		if c == 0 {
+			path = append(path, 0xff)
+		}
+	}
+	return append(path, 0, 1)
+}
+
+// the names of a path
+func splitPath(path []byte) [][]byte {
+	var names [][]byte
+	var name []byte
+	for i := 0; i+1 < len(path); i++ {
+		switch {
+		case path[i] != 0:
+			name = append(name, path[i])
+		case path[i+1] == 1:
+			names = append(names, name)
+			name = []byte{}
+			i++
+		default:
+			name = append(name, 0)
+			i++
+		}
+	}
+	return names
+}
+
+// the name of a path with a single name, nil otherwise
+func bucketName(path []byte) []byte {
+	if names := splitPath(path); len(names) == 1 {
+		return names[0]
+	}
+	return nil
+}
+
+// the path for errors, names separated by a slash
+func formatPath(path []byte) string {
+	return string(bytes.Join(splitPath(path), []byte("/")))
+}
+
+// Bucket opens an existing bucket.
+func (tx *Tx) Bucket(name []byte) (*Bucket, error) {
+	return tx.openBucket(nil, name)
+}
+
+// CreateBucket adds an empty bucket, ErrBucketExists if there is one
+// with that name.
+func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
+	return tx.createBucket(nil, name)
+}
+
+// DeleteBucket removes a bucket, all its keys and the buckets inside,
+// their pages are freed. Cursors on those buckets see no keys anymore.
+func (tx *Tx) DeleteBucket(name []byte) error {
+	return tx.deleteBucket(nil, name)
+}
+
+// ForEachBucket calls fn with the name of every bucket, in order, until fn
+// returns an error. The buckets inside others are not included.
+func (tx *Tx) ForEachBucket(fn func(name []byte) error) error {
+	return tx.forEachBucket(nil, fn)
+}
+
+// a cursor on the bucket at the path, the names from the top, on the keys
+// outside buckets if the path is empty
+func (tx *Tx) pathCursor(path [][]byte) (*Cursor, error) {
+	c := tx.Cursor()
+	var b *Bucket
+	var err error
+	for i, name := range path {
+		if i == 0 {
+			b, err = tx.Bucket(name)
+		} else {
+			b, err = b.Bucket(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c = b.Cursor()
+	}
+	return c, nil
+}
+
+func (tx *Tx) openBucket(parent []byte, name []byte) (*Bucket, error) {
+	if err := tx.checkBucket(name); err != nil {
+		return nil, err
+	}
+	path := bucketPath(parent, name)
+	tree, err := tx.bucketTree(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{tx: tx, path: path, name: append([]byte(nil), name...), tree: tree}, nil
+}
+
+func (tx *Tx) createBucket(parent []byte, name []byte) (*Bucket, error) {
+	if err := tx.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := tx.checkBucket(name); err != nil {
+		return nil, err
+	}
+	path := bucketPath(parent, name)
+	if err := tx.addBucket(path); err != nil {
+		return nil, err
+	}
+	return tx.openBucket(parent, name)
+}
+
+// add the catalog entry of an empty bucket
+func (tx *Tx) addBucket(path []byte) error {
+	if _, ok, err := tx.catalog.Get(path); err != nil || ok {
+		if ok {
+			err = fmt.Errorf("%w: %q", ErrBucketExists, formatPath(path))
+		}
+		return err
+	}
+	if err := tx.setBucketRoot(path, 0); err != nil {
+		return err
+	}
+	tx.logOp(nil, walOp{kind: WAL_OP_CREATE_BUCKET, key: path})
+	return nil
+}
+
+func (tx *Tx) deleteBucket(parent []byte, name []byte) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if err := tx.checkBucket(name); err != nil {
+		return err
+	}
+	return tx.removeBucket(bucketPath(parent, name))
+}
+
+// delete a bucket and those inside, which follow it in the catalog
+func (tx *Tx) removeBucket(path []byte) (err error) {
+	if _, err := tx.bucketTree(path); err != nil {
+		return err
+	}
+	paths, roots, err := tx.catalogScan(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.err = err
+		}
+	}()
+	defer catchTreeError(&err)
+	for i, path := range paths {
+		if _, err := tx.catalog.Delete(path); err != nil {
+			return err
+		}
+		if roots[i] != 0 {
+			tx.freeTree(roots[i])
+		}
+		if tree, ok := tx.buckets[string(path)]; ok {
+			tree.root = 0
+			delete(tx.buckets, string(path))
+		}
+		tx.dropUsage(path)
+	}
+	tx.logOp(nil, walOp{kind: WAL_OP_DELETE_BUCKET, key: path})
+	tx.gen++
+	return nil
+}
+
+func (tx *Tx) forEachBucket(parent []byte, fn func(name []byte) error) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if tx.optimistic {
+		return ErrBucketTx
+	}
+	// the names are collected first, fn may update the catalog
+	paths, _, err := tx.catalogScan(parent)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if name := bucketName(path[len(parent):]); name != nil {
+			if err := fn(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// the catalog entries starting with the prefix
+func (tx *Tx) catalogScan(prefix []byte) (paths [][]byte, roots []uint64, err error) {
+	defer catchTreeError(&err)
+	for iter := tx.catalog.SeekLE(prefix); !iter.atEnd(); iter.Next() {
+		if !iter.Valid() {
+			continue // the sentinel
+		}
+		key, value := iter.Deref()
+		if bytes.Compare(key, prefix) < 0 {
+			continue
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if len(value) != 8 {
+			return nil, nil, fmt.Errorf("%w: bad catalog entry %q", ErrCorrupt, formatPath(key))
+		}
+		paths = append(paths, append([]byte(nil), key...))
+		roots = append(roots, binary.LittleEndian.Uint64(value))
+	}
+	return paths, roots, nil
+}
+
+// free the pages of a tree, a tree error panics
+func (tx *Tx) freeTree(ptr uint64) {
+	node := tx.pageGet(ptr)
+	if node.getNodeType() == BNODE_NODE {
+		for i := uint16(0); i < node.getNumberOfKeys(); i++ {
+			tx.freeTree(node.getPointer(i))
+		}
+	}
+	tx.pageDel(ptr)
+}
+
+func (tx *Tx) checkBucket(name []byte) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if tx.optimistic {
+		return ErrBucketTx
+	}
+	if len(name) == 0 {
+		return fmt.Errorf("bucket name: %w", ErrEmptyKey)
+	}
+	return nil
+}
+
+// the tree of a bucket, shared by its handles and cursors
+func (tx *Tx) bucketTree(path []byte) (*BTree, error) {
+	if tree, ok := tx.buckets[string(path)]; ok {
+		return tree, nil
+	}
+	if err := tx.catalog.checkKeyValue(path, nil); err != nil {
+		return nil, fmt.Errorf("bucket path: %w", err)
+	}
+	value, ok, err := tx.catalog.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrBucketNotFound, formatPath(path))
+	}
+	if len(value) != 8 {
+		return nil, fmt.Errorf("%w: bad catalog entry %q", ErrCorrupt, formatPath(path))
+	}
+	tree := tx.tree // the same page callbacks and options
+	tree.root = binary.LittleEndian.Uint64(value)
+	if tree.usage != nil {
+		tx.track(&tree, string(path))
+	}
+	if tx.buckets == nil {
+		tx.buckets = map[string]*BTree{}
+	}
+	tx.buckets[string(path)] = &tree
+	return &tree, nil
+}
+
+func (tx *Tx) setBucketRoot(path []byte, root uint64) error {
+	var value [8]byte
+	binary.LittleEndian.PutUint64(value[:], root)
+	if err := tx.catalog.Insert(path, value[:]); err != nil {
+		tx.err = err
+		return err
+	}
+	return nil
+}
+
+// the catalog went back to a savepoint, so do the trees of the buckets
+func (tx *Tx) reloadBuckets() {
+	for path, tree := range tx.buckets {
+		value, ok, err := tx.catalog.Get([]byte(path))
+		if err != nil || !ok || len(value) != 8 {
+			// created after the savepoint, or opened again from the catalog
+			tree.root = 0
+			delete(tx.buckets, path)
+			continue
+		}
+		tree.root = binary.LittleEndian.Uint64(value)
+	}
+}
+
+func (b *Bucket) Name() []byte {
+	return b.name
+}
+
+// check that the handle is still on a bucket of the Tx
+func (b *Bucket) check() error {
+	if b.tx.done {
+		return ErrTxClosed
+	}
+	if b.tx.buckets[string(b.path)] != b.tree {
+		return fmt.Errorf("%w: %q", ErrBucketNotFound, formatPath(b.path))
+	}
+	return nil
+}
+
+// Get returns the value of the key, see Tx.Get.
+func (b *Bucket) Get(key []byte) ([]byte, bool, error) {
+	if err := b.check(); err != nil {
+		return nil, false, err
+	}
+	return b.tree.Get(key)
+}
+
+func (b *Bucket) Set(key []byte, value []byte) error {
+	if err := b.update(); err != nil {
+		return err
+	}
+	if err := b.tree.checkKeyValue(key, value); err != nil {
+		return err
+	}
+	if err := b.tree.Insert(key, value); err != nil {
+		b.tx.err = err
+		return err
+	}
+	op := walOp{
+		kind:  WAL_OP_SET,
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	}
+	return b.updated(op)
+}
+
+func (b *Bucket) Del(key []byte) (bool, error) {
+	if err := b.update(); err != nil {
+		return false, err
+	}
+	if err := b.tree.checkKeyValue(key, nil); err != nil {
+		return false, err
+	}
+	if deleted, err := b.tree.Delete(key); err != nil {
+		b.tx.err = err
+		return false, err
+	} else if !deleted {
+		return false, nil
+	}
+	return true, b.updated(walOp{kind: WAL_OP_DEL, key: append([]byte(nil), key...)})
+}
+
+func (b *Bucket) update() error {
+	if err := b.tx.checkWritable(); err != nil {
+		return err
+	}
+	return b.check()
+}
+
+// record the new root of the bucket and log the op
+func (b *Bucket) updated(op walOp) error {
+	if err := b.tx.setBucketRoot(b.path, b.tree.root); err != nil {
+		return err
+	}
+	b.tx.logOp(b.path, op)
+	b.tx.gen++
+	return nil
+}
+
+// Bucket opens a bucket inside this one.
+func (b *Bucket) Bucket(name []byte) (*Bucket, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	return b.tx.openBucket(b.path, name)
+}
+
+// CreateBucket adds an empty bucket inside this one.
+func (b *Bucket) CreateBucket(name []byte) (*Bucket, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	return b.tx.createBucket(b.path, name)
+}
+
+// DeleteBucket removes a bucket inside this one, see Tx.DeleteBucket.
+func (b *Bucket) DeleteBucket(name []byte) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.tx.deleteBucket(b.path, name)
+}
+
+// ForEachBucket calls fn with the names of the buckets right inside this
+// one, see Tx.ForEachBucket.
+func (b *Bucket) ForEachBucket(fn func(name []byte) error) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.tx.forEachBucket(b.path, fn)
+}
+
+// Cursor opens a cursor on the keys of the bucket, see Tx.Cursor.
+func (b *Bucket) Cursor() *Cursor {
+	return &Cursor{tx: b.tx, tree: b.tree, scan: -1}
+}
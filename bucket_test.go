@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// fill the bucket users, and "k" of each keyspace with its name
+func fillBuckets(t *testing.T, db *DB) {
+	t.Helper()
+	mustSet(t, db, "k", "default")
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	b, err := tx.CreateBucket([]byte("users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		b.Set([]byte(fmt.Sprintf("u%05d", i)), []byte(fmt.Sprint(i)))
+	}
+	b.Set([]byte("k"), []byte("users"))
+	o, _ := tx.CreateBucket([]byte("other"))
+	o.Set([]byte("k"), []byte("other"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkBuckets(t *testing.T, db *DB) {
+	t.Helper()
+	wantValue(t, db, "k", []byte("default"))
+	wantValue(t, db, "u00001", nil)
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	for _, name := range []string{"users", "other"} {
+		b, err := tx.Bucket([]byte(name))
+		if err != nil {
+			t.Fatalf("bucket %s: %v", name, err)
+		}
+		if v, _, _ := b.Get([]byte("k")); string(v) != name {
+			t.Fatalf("k of %s is %q", name, v)
+		}
+	}
+	b, _ := tx.Bucket([]byte("users"))
+	n := 0
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	if n != 3001 {
+		t.Fatalf("%d keys in users", n)
+	}
+	var names []string
+	tx.ForEachBucket(func(name []byte) error {
+		names = append(names, string(name))
+		return nil
+	})
+	if fmt.Sprint(names) != "[other users]" {
+		t.Fatalf("buckets %v", names)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	db := openTest(t)
+	fillBuckets(t, db)
+	checkBuckets(t, db)
+	tx, _ := db.Begin(true)
+	if _, err := tx.CreateBucket([]byte("users")); !errors.Is(err, ErrBucketExists) {
+		t.Fatalf("create twice: %v", err)
+	}
+	if _, err := tx.Bucket([]byte("missing")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("missing bucket: %v", err)
+	}
+	tx.Rollback()
+
+	// recovered from the WAL, then from the file
+	crashTest(db)
+	db = openTestPath(t, db.Path)
+	checkBuckets(t, db)
+	db = reopenTest(t, db)
+	checkBuckets(t, db)
+	db = reopenTest(t, db, WithNoFreelistSync())
+	checkBuckets(t, db)
+
+	tx, _ = db.BeginTx(TxOptions{Writable: true})
+	if _, err := tx.Bucket([]byte("users")); !errors.Is(err, ErrBucketTx) {
+		t.Fatalf("bucket of an optimistic Tx: %v", err)
+	}
+	tx.Rollback()
+}
+
+func TestBucketSavepoint(t *testing.T) {
+	db := openTest(t)
+	fillBuckets(t, db)
+	tx, _ := db.Begin(true)
+	b, _ := tx.Bucket([]byte("users"))
+	sp, _ := tx.Savepoint()
+	b.Set([]byte("zzz"), nil)
+	tx.DeleteBucket([]byte("other"))
+	tx.CreateBucket([]byte("new"))
+	if err := tx.RollbackTo(sp); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := b.Get([]byte("zzz")); ok {
+		t.Fatal("set kept by the rollback")
+	}
+	if _, err := tx.Bucket([]byte("new")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("created bucket kept by the rollback: %v", err)
+	}
+	if _, err := tx.Bucket([]byte("other")); err != nil {
+		t.Fatalf("deleted bucket kept by the rollback: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkBuckets(t, db)
+}
+
+// the pages of a deleted bucket are freed and reused
+func TestBucketDelete(t *testing.T) {
+	db := openTest(t)
+	fillBuckets(t, db)
+	db.Checkpoint()
+	before := db.page.flushed
+	tx, _ := db.Begin(true)
+	b, _ := tx.Bucket([]byte("users"))
+	if err := tx.DeleteBucket([]byte("users")); err != nil {
+		t.Fatal(err)
+	}
+	tx.DeleteBucket([]byte("other"))
+	if _, _, err := b.Get([]byte("k")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("get from a deleted bucket: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Checkpoint()
+	tx, _ = db.Begin(true)
+	if err := tx.DeleteBucket([]byte("users")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("delete twice: %v", err)
+	}
+	tx.Rollback()
+
+	fillBuckets(t, db)
+	checkBuckets(t, db)
+	db.Checkpoint()
+	if db.page.flushed > before+5 {
+		t.Fatalf("file of %d pages, %d before deleting", db.page.flushed, before)
+	}
+}
+
+func listBuckets(tx *Tx, b *Bucket) []string {
+	var names []string
+	fn := func(name []byte) error {
+		names = append(names, string(name))
+		return nil
+	}
+	if b == nil {
+		tx.ForEachBucket(fn)
+	} else {
+		b.ForEachBucket(fn)
+	}
+	return names
+}
+
+// names holding the separator of the paths don't mix up the levels
+func TestNestedBucket(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	a, _ := tx.CreateBucket([]byte("a"))
+	a.Set([]byte("k"), []byte("a"))
+	for _, name := range []string{"c", "b", "a\x00x", "b\x00"} {
+		b, err := a.CreateBucket([]byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 500; i++ {
+			b.Set([]byte(fmt.Sprint(i)), []byte(name))
+		}
+		g, _ := b.CreateBucket([]byte("g"))
+		g.Set([]byte("x"), []byte(name))
+	}
+	tx.CreateBucket([]byte("a\x00"))
+	tx.CreateBucket([]byte("ab"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *DB, inA string) {
+		t.Helper()
+		tx, _ := db.Begin(false)
+		defer tx.Rollback()
+		if got := fmt.Sprintf("%q", listBuckets(tx, nil)); got != `["a" "a\x00" "ab"]` {
+			t.Fatalf("top buckets %s", got)
+		}
+		a, err := tx.Bucket([]byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprintf("%q", listBuckets(tx, a)); got != inA {
+			t.Fatalf("buckets of a %s, want %s", got, inA)
+		}
+		if v, _, _ := a.Get([]byte("k")); string(v) != "a" {
+			t.Fatalf("k of a is %q", v)
+		}
+		b, _ := a.Bucket([]byte("b\x00"))
+		g, err := b.Bucket([]byte("g"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _, _ := g.Get([]byte("x")); string(v) != "b\x00" {
+			t.Fatalf("x of g is %q", v)
+		}
+		if _, err := a.Bucket([]byte("zz")); !errors.Is(err, ErrBucketNotFound) {
+			t.Fatalf("missing bucket: %v", err)
+		}
+	}
+	all := `["a\x00x" "b" "b\x00" "c"]`
+	check(db, all)
+	crashTest(db)
+	db = openTestPath(t, db.Path)
+	check(db, all)
+
+	// deleting b deletes its buckets, not those of b\x00
+	tx, _ = db.Begin(true)
+	a, _ = tx.Bucket([]byte("a"))
+	b, _ := a.Bucket([]byte("b"))
+	g, _ := b.Bucket([]byte("g"))
+	if err := a.DeleteBucket([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := g.Get([]byte("x")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("get from the bucket of a deleted bucket: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db = reopenTest(t, db, WithNoFreelistSync())
+	check(db, `["a\x00x" "b\x00" "c"]`)
+
+	tx, _ = db.Begin(true)
+	tx.DeleteBucket([]byte("a"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = db.Begin(false)
+	defer tx.Rollback()
+	if got := fmt.Sprintf("%q", listBuckets(tx, nil)); got != `["a\x00" "ab"]` {
+		t.Fatalf("top buckets %s", got)
+	}
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DEFAULT_CACHE_SIZE = 2048 // pages
+	CACHE_SHARDS       = 16
+)
+
+// pageCache keeps pages in memory between the trees and the file.
+//
+// Dirty pages are the committed pages not written in place yet, the
+// checkpoint writes them and marks them clean. They're pinned: the cache
+// is their only copy, they're never evicted. Clean pages are those read from
+// the file or checkpointed, the least recently used ones are evicted past
+// the size of WithCacheSize. Page buffers are never modified nor reused, a
+// Tx can keep a page it got even after its eviction.
+//
+// The cache is split in shards by page number so that readers rarely
+// contend on a lock.
+type pageCache struct {
+	size   int // pages, see WithCacheSize
+	shards [CACHE_SHARDS]cacheShard
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cacheShard struct {
+	mu     sync.Mutex
+	frames map[uint64]*frame
+	lru    list.List // clean frames, the most recently used first
+}
+
+type frame struct {
+	ptr   uint64
+	data  []byte
+	dirty bool
+	wipe  bool          // zeros of a free page, dropped once written
+	elem  *list.Element // in the LRU list if clean
+}
+
+func newPageCache(size int) *pageCache {
+	c := &pageCache{size: size}
+	for i := range c.shards {
+		c.shards[i].frames = map[uint64]*frame{}
+	}
+	return c
+}
+
+func (c *pageCache) shard(ptr uint64) *cacheShard {
+	return &c.shards[ptr%CACHE_SHARDS]
+}
+
+// look up a page, nil if it's not cached
+func (c *pageCache) get(ptr uint64) []byte {
+	s := c.shard(ptr)
+	s.mu.Lock()
+	f := s.frames[ptr]
+	if f != nil && f.elem != nil {
+		s.lru.MoveToFront(f.elem)
+	}
+	s.mu.Unlock()
+	if f == nil {
+		c.misses.Add(1)
+		return nil
+	}
+	c.hits.Add(1)
+	return f.data
+}
+
+// whether a page is cached, without using it
+func (c *pageCache) contains(ptr uint64) bool {
+	s := c.shard(ptr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.frames[ptr] != nil
+}
+
+// the cached copy of a page and whether it's dirty, without using it
+func (c *pageCache) peek(ptr uint64) ([]byte, bool) {
+	s := c.shard(ptr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f := s.frames[ptr]; f != nil {
+		return f.data, f.dirty
+	}
+	return nil, false
+}
+
+// cache a page read from the file, unless another copy was added meanwhile
+func (c *pageCache) addClean(ptr uint64, data []byte) []byte {
+	s := c.shard(ptr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f := s.frames[ptr]; f != nil {
+		return f.data
+	}
+	f := &frame{ptr: ptr, data: data}
+	f.elem = s.lru.PushFront(f)
+	s.frames[ptr] = f
+	c.evict(s)
+	return data
+}
+
+// pin the new content of a page until it's written in place
+func (c *pageCache) putDirty(ptr uint64, data []byte) {
+	s := c.shard(ptr)
+	s.mu.Lock()
+	if f := s.frames[ptr]; f != nil && f.elem != nil {
+		s.lru.Remove(f.elem)
+	}
+	s.frames[ptr] = &frame{ptr: ptr, data: data, dirty: true}
+	s.mu.Unlock()
+}
+
+func (c *pageCache) isDirty(ptr uint64) bool {
+	s := c.shard(ptr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.frames[ptr]
+	return f != nil && f.dirty
+}
+
+// unpin a dirty page written in place, it's evictable now. The page may
+// have a newer content, still dirty, if it was freed and reused meanwhile.
+func (c *pageCache) clean(ptr uint64, data []byte) {
+	s := c.shard(ptr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.frames[ptr]
+	if f == nil || !f.dirty || &f.data[0] != &data[0] {
+		return
+	}
+	if f.wipe {
+		delete(s.frames, ptr)
+		return
+	}
+	f.dirty = false
+	f.elem = s.lru.PushFront(f)
+	c.evict(s)
+}
+
+// replace a free page with zeros until they're written in place, see
+// WithSecureDelete
+func (c *pageCache) wipe(ptr uint64, zero []byte) {
+	s := c.shard(ptr)
+	s.mu.Lock()
+	if f := s.frames[ptr]; f != nil && f.elem != nil {
+		s.lru.Remove(f.elem)
+	}
+	s.frames[ptr] = &frame{ptr: ptr, data: zero, dirty: true, wipe: true}
+	s.mu.Unlock()
+}
+
+// forget a page, it's free and its content is garbage
+func (c *pageCache) drop(ptr uint64) {
+	s := c.shard(ptr)
+	s.mu.Lock()
+	if f := s.frames[ptr]; f != nil {
+		if f.elem != nil {
+			s.lru.Remove(f.elem)
+		}
+		delete(s.frames, ptr)
+	}
+	s.mu.Unlock()
+}
+
+// a copy of the dirty pages, at most limit of them if it's positive
+func (c *pageCache) dirtyPages(limit int) map[uint64][]byte {
+	pages := map[uint64][]byte{}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for ptr, f := range s.frames {
+			if limit > 0 && len(pages) >= limit {
+				break
+			}
+			if f.dirty {
+				pages[ptr] = f.data
+			}
+		}
+		s.mu.Unlock()
+	}
+	return pages
+}
+
+// evict the least recently used clean pages of the shard past its share
+// of the cache size, the caller holds s.mu
+func (c *pageCache) evict(s *cacheShard) {
+	limit := max(c.size/CACHE_SHARDS, 1)
+	for s.lru.Len() > limit {
+		f := s.lru.Remove(s.lru.Back()).(*frame)
+		delete(s.frames, f.ptr)
+	}
+}
+
+// number of pages in memory
+func (c *pageCache) len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += len(s.frames)
+		s.mu.Unlock()
+	}
+	return n
+}
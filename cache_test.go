@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func page(b byte) []byte {
+	return []byte{b}
+}
+
+func TestCacheEviction(t *testing.T) {
+	size := CACHE_SHARDS * 2 // two pages per shard
+	c := newPageCache(size)
+	// pages 0, 16, 32 go to the first shard
+	c.addClean(0, page(0))
+	c.addClean(16, page(16))
+	if c.get(0) == nil {
+		t.Fatal("page 0 evicted")
+	}
+	c.addClean(32, page(32)) // evicts 16, used the least recently
+	if c.get(16) != nil {
+		t.Fatal("page 16 not evicted")
+	}
+	if c.get(0) == nil || c.get(32) == nil {
+		t.Fatal("recently used page evicted")
+	}
+	if c.hits.Load() != 3 || c.misses.Load() != 1 {
+		t.Fatalf("%d hits, %d misses", c.hits.Load(), c.misses.Load())
+	}
+	if c.len() != 2 {
+		t.Fatalf("%d pages cached", c.len())
+	}
+}
+
+func TestCacheDirty(t *testing.T) {
+	size := CACHE_SHARDS
+	c := newPageCache(size)
+	dirty := page(1)
+	c.putDirty(0, dirty)
+	for i := 1; i < 10; i++ {
+		c.addClean(uint64(i*CACHE_SHARDS), page(byte(i)))
+	}
+	if data, isDirty := c.peek(0); !isDirty || &data[0] != &dirty[0] {
+		t.Fatal("dirty page evicted")
+	}
+	if pages := c.dirtyPages(0); len(pages) != 1 || pages[0] == nil {
+		t.Fatalf("dirty pages %v", pages)
+	}
+	// written in place, the page is clean and evictable
+	c.clean(0, dirty)
+	if c.isDirty(0) {
+		t.Fatal("still dirty")
+	}
+	c.addClean(CACHE_SHARDS*20, page(20))
+	if c.contains(0) {
+		t.Fatal("clean page not evicted")
+	}
+}
+
+// the page was reused meanwhile, its newer content stays dirty
+func TestCacheCleanReused(t *testing.T) {
+	size := DEFAULT_CACHE_SIZE
+	c := newPageCache(size)
+	old, reused := page(1), page(2)
+	c.putDirty(5, old)
+	c.putDirty(5, reused)
+	c.clean(5, old)
+	if data, dirty := c.peek(5); !dirty || data[0] != 2 {
+		t.Fatalf("page %v, dirty %v", data, dirty)
+	}
+	c.drop(5)
+	if c.contains(5) {
+		t.Fatal("dropped page cached")
+	}
+}
+
+// a small cache serves the interior nodes, the file the rest
+func TestCacheDB(t *testing.T) {
+	db := openTest(t, WithCacheSize(64))
+	value := func(i int) string { return fmt.Sprintf("%0200d", i) }
+	for i := 0; i < 3000; i++ {
+		mustSet(t, db, fmt.Sprintf("k%05d", i), value(i))
+	}
+	db.Checkpoint()
+	for i := 0; i < 3000; i += 7 {
+		wantValue(t, db, fmt.Sprintf("k%05d", i), []byte(value(i)))
+	}
+	s := db.Stats()
+	if s.CachedPages > 64 {
+		t.Fatalf("%d clean pages cached, the size is 64", s.CachedPages)
+	}
+	if s.CacheHits == 0 || s.CacheMisses == 0 {
+		t.Fatalf("%d hits, %d misses", s.CacheHits, s.CacheMisses)
+	}
+}
+
+// the zeros of a free page replace it until written, then leave the cache
+func TestCacheWipe(t *testing.T) {
+	c := newPageCache(DEFAULT_CACHE_SIZE)
+	zero := make([]byte, 8)
+	c.addClean(5, page(1))
+	c.putDirty(6, page(2))
+	c.wipe(5, zero)
+	c.wipe(6, zero)
+	for _, ptr := range []uint64{5, 6} {
+		if data, dirty := c.peek(ptr); !dirty || &data[0] != &zero[0] {
+			t.Fatalf("page %d %v, dirty %v", ptr, data, dirty)
+		}
+	}
+	if pages := c.dirtyPages(0); len(pages) != 2 {
+		t.Fatalf("dirty pages %v", pages)
+	}
+	c.clean(5, zero)
+	if c.contains(5) || !c.contains(6) {
+		t.Fatal("zeros cached once written")
+	}
+}
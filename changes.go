@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Change data capture: a ChangeStream reads the commits from the WAL, and
+// from the WAL archive once checkpointed, see WithWALArchiveSize. Nothing
+// is added to the write path, the commits don't wait for the consumers:
+// those behind the archive get ErrWALGone and start over from a snapshot.
+//
+// The sequence number of a commit is its version, consecutive, so that a
+// consumer storing the last one it has processed resumes after it.
+
+type ChangeOp int
+
+const (
+	ChangeSet ChangeOp = iota + 1
+	ChangeDelete
+	ChangeExpire       // Expiry is the deadline of Key, zero if it no longer expires
+	ChangeCreateBucket // Key is the name of the bucket
+	ChangeDeleteBucket
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeSet:
+		return "set"
+	case ChangeDelete:
+		return "delete"
+	case ChangeExpire:
+		return "expire"
+	case ChangeCreateBucket:
+		return "create_bucket"
+	case ChangeDeleteBucket:
+		return "delete_bucket"
+	default:
+		return "unknown"
+	}
+}
+
+// Change is an update of a commit. Bucket is the names of the bucket of
+// Key from the top, nil outside buckets. A merge is the set of the merged
+// value, and the sweeper deletes the expired keys.
+type Change struct {
+	Op     ChangeOp
+	Bucket [][]byte
+	Key    []byte
+	Value  []byte    // of ChangeSet
+	Expiry time.Time // of ChangeExpire
+}
+
+// ChangeRecord is the updates of a commit, in the order of its Tx.
+type ChangeRecord struct {
+	Seq     uint64
+	Changes []Change
+}
+
+// ChangeStream is the commits after a sequence number, see DB.Changes.
+type ChangeStream struct {
+	db   *DB
+	r    *walReader
+	recs []walRecord // read, not returned yet
+	seq  uint64
+}
+
+// Changes returns the stream of the commits after seq, those of Tx.Version
+// after a snapshot at seq.
+func (db *DB) Changes(seq uint64) *ChangeStream {
+	return &ChangeStream{db: db, r: db.newWALReader(seq), seq: seq}
+}
+
+// Next returns the next commit, waiting for it until ctx is done or the DB
+// is closed. ErrWALGone if it's no longer kept.
+func (s *ChangeStream) Next(ctx context.Context) (ChangeRecord, error) {
+	for len(s.recs) == 0 {
+		signal := s.db.commitSignal()
+		if s.db.closed.Load() {
+			return ChangeRecord{}, ErrDBClosed
+		}
+		recs, err := s.r.next()
+		if err != nil {
+			return ChangeRecord{}, err
+		}
+		if len(recs) > 0 {
+			s.recs = recs
+			break
+		}
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return ChangeRecord{}, ctx.Err()
+		}
+	}
+	rec := s.recs[0]
+	s.recs = s.recs[1:]
+	changes, err := decodeChanges(rec.ops)
+	if err != nil {
+		return ChangeRecord{}, err
+	}
+	s.seq = rec.version
+	return ChangeRecord{Seq: rec.version, Changes: changes}, nil
+}
+
+// Seq returns the sequence number of the last commit returned by Next.
+func (s *ChangeStream) Seq() uint64 {
+	return s.seq
+}
+
+// the changes of the ops of a commit
+func decodeChanges(ops []walOp) ([]Change, error) {
+	changes := []Change{}
+	var bucket [][]byte
+	for _, op := range ops {
+		c := Change{Key: op.key}
+		switch op.kind {
+		case WAL_OP_BUCKET:
+			bucket = splitPath(op.key)
+			if len(bucket) == 0 {
+				bucket = nil
+			}
+			continue
+		case WAL_OP_REPLICATED, WAL_OP_TIME, WAL_OP_AUDIT:
+			continue
+		case WAL_OP_SET:
+			c.Op, c.Bucket, c.Value = ChangeSet, bucket, op.value
+		case WAL_OP_DEL:
+			c.Op, c.Bucket = ChangeDelete, bucket
+		case WAL_OP_EXPIRE:
+			deadline, err := decodeDeadline(op.value)
+			if err != nil {
+				return nil, err
+			}
+			c.Op = ChangeExpire
+			if deadline != 0 {
+				c.Expiry = time.Unix(0, deadline)
+			}
+		case WAL_OP_CREATE_BUCKET, WAL_OP_DELETE_BUCKET:
+			c.Op = ChangeCreateBucket
+			if op.kind == WAL_OP_DELETE_BUCKET {
+				c.Op = ChangeDeleteBucket
+			}
+			names := splitPath(op.key)
+			if len(names) == 0 {
+				return nil, fmt.Errorf("%w: empty bucket path", ErrBadWAL)
+			}
+			c.Key = names[len(names)-1]
+			if len(names) > 1 {
+				c.Bucket = names[:len(names)-1]
+			}
+		default:
+			return nil, fmt.Errorf("%w: bad op type %d", ErrBadWAL, op.kind)
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// the changes of a record, a string each
+func changeStrings(rec ChangeRecord) []string {
+	var out []string
+	for _, c := range rec.Changes {
+		s := fmt.Sprintf("%v %q %q", c.Op, c.Bucket, c.Key)
+		if c.Op == ChangeSet {
+			s += fmt.Sprintf("=%q", c.Value)
+		}
+		if c.Op == ChangeExpire {
+			s += fmt.Sprint(" ", !c.Expiry.IsZero())
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func TestChanges(t *testing.T) {
+	db := openTest(t, WithWALArchiveSize(1<<30), WithCheckpointSize(16<<10))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := db.visible.Load().version
+	s := db.Changes(start)
+
+	tx, _ := db.Begin(true)
+	b, _ := tx.CreateBucket([]byte("b"))
+	b.Set([]byte("bk"), []byte("bv"))
+	b.CreateBucket([]byte("inner"))
+	tx.SetWithExpiry([]byte("e"), []byte("x"), time.Now().Add(time.Hour))
+	tx.Set([]byte("k"), []byte("v"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = db.Begin(true)
+	tx.Del([]byte("k"))
+	tx.Set([]byte("e"), []byte("y"))
+	tx.DeleteBucket([]byte("b"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`[create_bucket [] "b" set ["b"] "bk"="bv" create_bucket ["b"] "inner" set [] "e"="x" expire [] "e" true set [] "k"="v"]`,
+		`[delete [] "k" set [] "e"="y" expire [] "e" false delete_bucket [] "b"]`,
+	} {
+		rec, err := s.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(changeStrings(rec)); got != want {
+			t.Fatalf("changes of %d\n%s\nwant\n%s", rec.Seq, got, want)
+		}
+		if rec.Seq != s.Seq() {
+			t.Fatalf("seq %d of the stream, %d of the record", s.Seq(), rec.Seq)
+		}
+	}
+
+	// the commits as they come, across the checkpoints
+	go func() {
+		for i := 0; i < 300; i++ {
+			db.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 200))
+		}
+	}()
+	for i := 0; i < 300; i++ {
+		last := s.Seq()
+		rec, err := s.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Seq != last+1 || len(rec.Changes) != 1 || string(rec.Changes[0].Key) != fmt.Sprintf("k%04d", i) {
+			t.Fatalf("commit %d after %d: %v", rec.Seq, last, changeStrings(rec))
+		}
+	}
+	if segments, _ := walSegments(db.Path); len(segments) == 0 {
+		t.Fatal("no checkpoint")
+	}
+	// a consumer resumes after the last seq it processed, from the archive
+	rec, err := db.Changes(start + 1).Next(ctx)
+	if err != nil || rec.Seq != start+2 {
+		t.Fatalf("resumed at %d: %v", rec.Seq, err)
+	}
+
+	short, done := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer done()
+	if _, err := s.Next(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("next without commits: %v", err)
+	}
+	db = reopenTest(t, db, WithWALArchiveSize(1))
+	mustSet(t, db, "a", "1")
+	db.Checkpoint()
+	mustSet(t, db, "a", "2")
+	db.Checkpoint()
+	if _, err := db.Changes(start).Next(ctx); !errors.Is(err, ErrWALGone) {
+		t.Fatalf("changes no longer kept: %v", err)
+	}
+	s = db.Changes(db.visible.Load().version)
+	db.Close()
+	if _, err := s.Next(ctx); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("next once closed: %v", err)
+	}
+}
+
+func TestDecodeChanges(t *testing.T) {
+	if _, err := decodeChanges([]walOp{{kind: 200}}); !errors.Is(err, ErrBadWAL) {
+		t.Fatalf("op of type 200: %v", err)
+	}
+	if _, err := decodeChanges([]walOp{{kind: WAL_OP_CREATE_BUCKET}}); !errors.Is(err, ErrBadWAL) {
+		t.Fatalf("bucket of no name: %v", err)
+	}
+	if changes, err := decodeChanges([]walOp{{kind: WAL_OP_TIME}, {kind: WAL_OP_REPLICATED}}); err != nil || len(changes) != 0 {
+		t.Fatalf("changes %v of internal ops: %v", changes, err)
+	}
+	if s := ChangeOp(0).String(); s != "unknown" {
+		t.Fatalf("op 0 is %q", s)
+	}
+}
@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const CHECK_MAX_PROBLEMS = 1000 // the problems reported, the check goes on
+
+// the checks of CheckProblem
+const (
+	CHECK_META      = "meta"      // the signature and checksum of the meta page
+	CHECK_POINTER   = "pointer"   // a root or kid out of the file
+	CHECK_SHARED    = "shared"    // a page reached twice
+	CHECK_READ      = "read"      // the page can't be read
+	CHECK_CHECKSUM  = "checksum"  // the page doesn't match its checksum, or doesn't decrypt
+	CHECK_TYPE      = "type"      // neither a node nor a leaf
+	CHECK_SIZE      = "size"      // the keys overflow the page, or there are none
+	CHECK_OFFSETS   = "offsets"   // the offsets of the keys don't match their lengths
+	CHECK_ORDER     = "order"     // keys in the wrong order
+	CHECK_SEPARATOR = "separator" // a key out of the range of its parent key
+	CHECK_HEIGHT    = "height"    // leaves at different depths
+	CHECK_CATALOG   = "catalog"   // an entry not holding a root
+	CHECK_FREE      = "free"      // a free page out of the file, listed twice or in use
+	CHECK_LEAK      = "leak"      // a page neither in use nor free
+)
+
+// CheckProblem is an inconsistency found by Check.
+type CheckProblem struct {
+	Check  string // one of the CHECK_ constants
+	Page   uint64 // 0 if not about a page
+	Tree   string // keys, catalog, the path of a bucket or of an internal tree
+	Detail string
+}
+
+func (p CheckProblem) String() string {
+	s := p.Check
+	if p.Page != 0 {
+		s += " page " + strconv.FormatUint(p.Page, 10)
+	}
+	if p.Tree != "" {
+		s += " of " + p.Tree
+	}
+	return s + ": " + p.Detail
+}
+
+// CheckReport is the result of Check.
+type CheckReport struct {
+	Version   uint64 // the commit checked
+	FilePages uint64
+	UsedPages int  // reached from the trees, the meta page included
+	FreePages int  // free, to be freed or holding the free list
+	Trees     int  // the keys, the catalog, the buckets and the internal trees
+	Keys      int  // of all the trees but the catalog
+	Truncated bool // more than CHECK_MAX_PROBLEMS found
+	Problems  []CheckProblem
+}
+
+// OK is whether no problem was found.
+func (r CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Err joins the problems found, nil if none, wrapping ErrCorrupt.
+func (r CheckReport) Err() error {
+	if r.OK() {
+		return nil
+	}
+	errs := make([]error, len(r.Problems))
+	for i, p := range r.Problems {
+		errs[i] = fmt.Errorf("%w: %s", ErrCorrupt, p)
+	}
+	return errors.Join(errs...)
+}
+
+// the state of a check
+type checker struct {
+	db      *DB
+	ctx     context.Context
+	report  CheckReport
+	used    []bool // by page
+	tree    string // being walked
+	height  int    // of its leaves, 0 before the first
+	buckets []catalogEntry
+}
+
+// a tree found in the catalog
+type catalogEntry struct {
+	path []byte
+	root uint64
+}
+
+// Check walks every page of the last commit and reports the problems
+// found: the meta page, the layout of each node and leaf, the order of
+// their keys and the ranges given by their parents, the bucket roots,
+// the free list, and the pages neither in use nor free. The pages are read
+// from the cache or the file, without filling the cache; those of the file
+// must match their checksum, or decrypt, see pager.go.
+//
+// Like Checkpoint, it blocks writers meanwhile. The error is that of a
+// check not run to the end, ctx done, the DB closed or a failed read; the
+// problems found are in the report.
+func (db *DB) Check(ctx context.Context) (report CheckReport, err error) {
+	unlock, err := db.lockWriterContext(ctx)
+	if err != nil {
+		return CheckReport{}, err
+	}
+	defer unlock()
+	defer catchTreeError(&err)
+	if db.closed.Load() {
+		return CheckReport{}, ErrDBClosed
+	}
+	db.mu.Lock()
+	c := &checker{db: db, ctx: ctx}
+	c.report.Version, c.report.FilePages = db.version, db.page.flushed
+	root, catalog := db.root, db.catalog
+	free := db.free.free
+	for _, p := range db.free.pending {
+		free = append(append(free, p.pages...), p.young...)
+	}
+	free = append(free, db.free.pages...)
+	db.mu.Unlock()
+
+	c.used = make([]bool, c.report.FilePages)
+	c.used[0], c.report.UsedPages = true, 1
+	c.checkMeta()
+	c.walkTree(root, "keys", db.opts.cmp)
+	c.walkTree(catalog, "catalog", nil)
+	c.walkBuckets()
+	if err := ctx.Err(); err != nil {
+		return c.report, err
+	}
+	c.checkFree(free)
+	return c.report, nil
+}
+
+func (c *checker) fail(check string, page uint64, format string, args ...any) {
+	if len(c.report.Problems) == CHECK_MAX_PROBLEMS {
+		c.report.Truncated = true
+		return
+	}
+	c.report.Problems = append(c.report.Problems, CheckProblem{
+		Check: check, Page: page, Tree: c.tree, Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+// the meta page of the file, the checkpointed commit
+func (c *checker) checkMeta() {
+	data := make([]byte, c.db.opts.pageSize)
+	if err := c.db.pager.readPage(0, data); err != nil {
+		c.fail(CHECK_READ, 0, "%v", err)
+		return
+	}
+	if _, err := checkMeta(data); err != nil {
+		c.fail(CHECK_META, 0, "%v", err)
+	}
+}
+
+// the bucket trees and the internal trees of the catalog
+func (c *checker) walkBuckets() {
+	for _, b := range c.buckets {
+		cmp := c.db.opts.cmp
+		if bytes.HasPrefix(b.path, []byte{0, 2}) {
+			cmp = nil
+		}
+		c.walkTree(b.root, treeName(b.path), cmp)
+	}
+}
+
+// the name of a tree of the catalog in the report
+func treeName(path []byte) string {
+	if bytes.HasPrefix(path, []byte{0, 2}) {
+		return strconv.Quote(string(path))
+	}
+	return formatPath(path)
+}
+
+func (c *checker) walkTree(root uint64, name string, cmp func(a, b []byte) int) {
+	c.tree, c.height = name, 0
+	if root == 0 {
+		return
+	}
+	if root >= c.report.FilePages {
+		c.fail(CHECK_POINTER, 0, "root at page %d of %d", root, c.report.FilePages)
+		return
+	}
+	c.report.Trees++
+	tree := BTree{cmp: cmp}
+	c.walkPage(&tree, root, nil, nil, 1)
+}
+
+// check a page whose keys are in [lo, hi), a nil hi has no bound
+func (c *checker) walkPage(tree *BTree, ptr uint64, lo, hi []byte, depth int) {
+	if c.ctx.Err() != nil {
+		return
+	}
+	if c.used[ptr] {
+		c.fail(CHECK_SHARED, ptr, "reached twice")
+		return
+	}
+	c.used[ptr] = true
+	c.report.UsedPages++
+	node, ok := c.readNode(ptr)
+	if !ok {
+		return
+	}
+	nkeys := node.getNumberOfKeys()
+	for i := uint16(0); i < nkeys; i++ {
+		key := node.getKey(i)
+		switch {
+		case i == 0 && lo != nil && tree.compare(key, lo) != 0:
+			c.fail(CHECK_SEPARATOR, ptr, "first key %q isn't the key %q of the parent", key, lo)
+		case i > 0 && tree.compare(node.getKey(i-1), key) >= 0:
+			c.fail(CHECK_ORDER, ptr, "key %d %q after %q", i, key, node.getKey(i-1))
+		case hi != nil && tree.compare(key, hi) >= 0:
+			c.fail(CHECK_SEPARATOR, ptr, "key %d %q not before the next key %q of the parent", i, key, hi)
+		}
+	}
+	if node.getNodeType() == BNODE_LEAF {
+		if c.height == 0 {
+			c.height = depth
+		} else if depth != c.height {
+			c.fail(CHECK_HEIGHT, ptr, "leaf at depth %d, others at %d", depth, c.height)
+		}
+		if c.tree == "catalog" {
+			c.checkCatalog(node, ptr)
+			return
+		}
+		for i := uint16(0); i < nkeys; i++ {
+			if len(node.getKey(i)) > 0 {
+				c.report.Keys++
+			}
+		}
+		return
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		kid := node.getPointer(i)
+		if kid == 0 || kid >= c.report.FilePages {
+			c.fail(CHECK_POINTER, ptr, "kid %d at page %d of %d", i, kid, c.report.FilePages)
+			continue
+		}
+		next := hi
+		if i+1 < nkeys {
+			next = node.getKey(i + 1)
+		}
+		c.walkPage(tree, kid, node.getKey(i), next, depth+1)
+	}
+}
+
+// the catalog keys of a leaf hold the root of a tree, 0 if empty
+func (c *checker) checkCatalog(node BNode, ptr uint64) {
+	for i := uint16(0); i < node.getNumberOfKeys(); i++ {
+		key, value := node.getKey(i), node.getValue(i)
+		switch {
+		case len(key) == 0:
+		case len(value) != 8:
+			c.fail(CHECK_CATALOG, ptr, "entry %s of %d bytes", treeName(key), len(value))
+		default:
+			c.buckets = append(c.buckets, catalogEntry{key, binary.LittleEndian.Uint64(value)})
+		}
+	}
+}
+
+// read a page and check its layout, ok if its keys can be decoded
+func (c *checker) readNode(ptr uint64) (BNode, bool) {
+	data, ok := c.db.cache.peek(ptr)
+	if !ok {
+		node, err := c.db.readPage(ptr)
+		if errors.Is(err, ErrCorrupt) {
+			c.fail(CHECK_CHECKSUM, ptr, "%v", err)
+			return BNode{}, false
+		}
+		if err != nil {
+			c.fail(CHECK_READ, ptr, "%v", err)
+			return BNode{}, false
+		}
+		data = node.data
+	}
+	node := BNode{data}
+	if check, detail := checkLayout(node); check != "" {
+		c.fail(check, ptr, "%s", detail)
+		return node, false
+	}
+	return node, true
+}
+
+// the layout of a node or leaf, the check it fails with its detail or ""
+// if its keys can be decoded; Scrub and Health verify the pages with it too
+func checkLayout(node BNode) (check, detail string) {
+	data := node.data
+	nodeType, nkeys := node.getNodeType(), node.getNumberOfKeys()
+	if nodeType != BNODE_NODE && nodeType != BNODE_LEAF {
+		return CHECK_TYPE, fmt.Sprintf("type %d", nodeType)
+	}
+	if nkeys == 0 {
+		return CHECK_SIZE, "no keys"
+	}
+	if HEADER+10*int(nkeys) > len(data) {
+		return CHECK_SIZE, fmt.Sprintf("%d keys overflow the page", nkeys)
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		if node.getOffset(i+1) <= node.getOffset(i) {
+			return CHECK_OFFSETS, fmt.Sprintf("offset %d of key %d not after %d", node.getOffset(i+1), i, node.getOffset(i))
+		}
+		pos := int(node.getKeyValuePosition(i))
+		end := int(HEADER + 10*nkeys + node.getOffset(i+1))
+		if pos+4 > end || end > len(data) {
+			return CHECK_SIZE, fmt.Sprintf("key %d ends at %d of %d bytes", i, end, len(data))
+		}
+		klen := binary.LittleEndian.Uint16(data[pos:])
+		vlen := binary.LittleEndian.Uint16(data[pos+2:])
+		if pos+4+int(klen)+int(vlen) != end {
+			return CHECK_OFFSETS, fmt.Sprintf("key %d of %d+%d bytes in %d", i, klen, vlen, end-pos-4)
+		}
+	}
+	return "", ""
+}
+
+// the layout of a page read by Scrub or Health, wrapping ErrCorrupt
+func layoutErr(node BNode) error {
+	if check, detail := checkLayout(node); check != "" {
+		return fmt.Errorf("%w: %s: %s", ErrCorrupt, check, detail)
+	}
+	return nil
+}
+
+// the free pages are in the file, listed once and not in use, and every
+// page is either
+func (c *checker) checkFree(free []uint64) {
+	c.tree = "free list"
+	for _, ptr := range free {
+		switch {
+		case ptr == 0 || ptr >= c.report.FilePages:
+			c.fail(CHECK_FREE, 0, "page %d of %d", ptr, c.report.FilePages)
+		case c.used[ptr]:
+			c.fail(CHECK_FREE, ptr, "in use or listed twice")
+		default:
+			c.used[ptr] = true
+			c.report.FreePages++
+		}
+	}
+	c.tree = ""
+	for ptr, ok := range c.used {
+		switch {
+		case ok:
+		case c.db.quarantined(uint64(ptr)):
+			c.fail(CHECK_LEAK, uint64(ptr), "quarantined by Scrub")
+		default:
+			c.fail(CHECK_LEAK, uint64(ptr), "neither in use nor free")
+		}
+	}
+}
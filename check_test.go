@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func checkOK(t *testing.T, db *DB) CheckReport {
+	t.Helper()
+	report, err := db.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("%d problems, the first %v", len(report.Problems), report.Problems[0])
+	}
+	if report.Err() != nil {
+		t.Fatalf("error of an OK report: %v", report.Err())
+	}
+	if uint64(report.UsedPages+report.FreePages) != report.FilePages {
+		t.Fatalf("%d pages used, %d free of %d", report.UsedPages, report.FreePages, report.FilePages)
+	}
+	return report
+}
+
+// random commits to the keys and buckets, with checkpoints and an old
+// reader holding pages, keep the file consistent
+func TestCheck(t *testing.T) {
+	db := openTest(t)
+	r := rand.New(rand.NewSource(3))
+	var reader *Tx
+	for i := 0; i < 600; i++ {
+		switch i {
+		case 200:
+			reader, _ = db.Begin(false)
+		case 400:
+			reader.Rollback()
+		}
+		tx, _ := db.Begin(true)
+		name := []byte(fmt.Sprint("b", r.Intn(5)))
+		b, err := tx.Bucket(name)
+		if err != nil {
+			b, err = tx.CreateBucket(name)
+		}
+		if err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+		for j := 0; j < 20; j++ {
+			k := []byte(fmt.Sprint("k", r.Intn(3000)))
+			if r.Intn(3) == 0 {
+				tx.Del(k)
+				b.Del(k)
+				continue
+			}
+			v := make([]byte, r.Intn(300))
+			tx.Set(k, v)
+			b.Set(k, v)
+		}
+		if r.Intn(50) == 0 {
+			tx.DeleteBucket([]byte(fmt.Sprint("b", r.Intn(5))))
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if i%150 == 0 {
+			db.Checkpoint()
+		}
+		if i%97 == 0 {
+			checkOK(t, db)
+		}
+	}
+	checkOK(t, db)
+	db = reopenTest(t, db)
+	checkOK(t, db)
+	db.Checkpoint()
+	report := checkOK(t, db)
+	if report.Version != db.version || report.Trees < 3 || report.Keys == 0 || report.FreePages == 0 {
+		t.Fatalf("report %+v", report)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.Check(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("check with ctx done: %v", err)
+	}
+}
+
+func TestCheckFreeList(t *testing.T) {
+	db := openTest(t)
+	fillBuckets(t, db)
+	tx, _ := db.Begin(true)
+	tx.DeleteBucket([]byte("users"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// the pages freed are reused once checkpointed, by the next commit
+	db.Checkpoint()
+	mustSet(t, db, "k", "v")
+	db.Checkpoint()
+	checkOK(t, db)
+
+	// a free page dropped from the list leaks, the root listed as free is
+	// in use
+	db.mu.Lock()
+	if len(db.free.free) == 0 {
+		db.mu.Unlock()
+		t.Fatal("no free pages after deleting a bucket")
+	}
+	free := db.free.free
+	leaked := free[0]
+	db.free.free = append([]uint64{db.root}, free[1:]...)
+	db.mu.Unlock()
+	report, _ := db.Check(context.Background())
+	db.mu.Lock()
+	db.free.free = free
+	db.mu.Unlock()
+	var checks []string
+	for _, p := range report.Problems {
+		checks = append(checks, fmt.Sprint(p.Check, " ", p.Page))
+	}
+	want := fmt.Sprint([]string{
+		fmt.Sprint(CHECK_FREE, " ", db.root), fmt.Sprint(CHECK_LEAK, " ", leaked)})
+	if fmt.Sprint(checks) != want {
+		t.Fatalf("problems %v, want %s", checks, want)
+	}
+	if err := report.Err(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("report error %v", err)
+	}
+	checkOK(t, db)
+}
+
+func TestCheckCorrupt(t *testing.T) {
+	db := openTest(t)
+	for i := 0; i < 2000; i++ {
+		mustSet(t, db, fmt.Sprintf("k%05d", i), "v")
+	}
+	db.Checkpoint()
+	root := db.root
+	db.Close()
+	f, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{9, 9, 9, 9, 9, 9}, int64(root)*BTREE_PAGE_SIZE+20)
+	f.Close()
+
+	db = openTestPath(t, db.Path, WithReadOnly())
+	report, err := db.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || !errors.Is(report.Err(), ErrCorrupt) {
+		t.Fatalf("corrupt root checked OK: %v", report.Err())
+	}
+	if p := report.Problems[0]; p.Page != root || p.Tree != "keys" || p.String() == "" {
+		t.Fatalf("first problem %+v, root %d", p, root)
+	}
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Checkpoint writes the committed pages in place, switches the meta page
+// to the latest commit and empties the WAL. It blocks writers meanwhile.
+func (db *DB) Checkpoint() error {
+	return db.CheckpointContext(context.Background())
+}
+
+// CheckpointContext is Checkpoint giving up when ctx is done before it
+// starts writing.
+func (db *DB) CheckpointContext(ctx context.Context) error {
+	unlock, err := db.lockWriterContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if db.closed.Load() {
+		return ErrDBClosed
+	}
+	if db.opts.readOnly {
+		return ErrReadOnly
+	}
+	return db.checkpoint()
+}
+
+// the caller holds the writer lock
+func (db *DB) checkpoint() (err error) {
+	// the checkpoint replaces the WAL, all of it must be durable first
+	if err := db.waitDurable(db.version); err != nil {
+		return err
+	}
+	db.flusher.mu.Lock()
+	defer db.flusher.mu.Unlock()
+	pages := db.cache.dirtyPages(0)
+	if db.version == db.checkpointed && len(pages) == 0 {
+		return nil
+	}
+	start := time.Now()
+	_, span := db.startSpan(context.Background(), "storage_engine.checkpoint")
+	defer func() { endSpan(span, err) }()
+	span.set("checkpoint.version", db.version)
+	span.set("checkpoint.pages_written", len(pages))
+	span.set("checkpoint.bytes", len(pages)*db.opts.pageSize) // fsynced before the meta page
+
+	// the new free list goes to free pages, the old one is freed
+	// once the new meta page is durable
+	db.mu.Lock()
+	fl := db.free
+	flushed := db.page.flushed
+	db.mu.Unlock()
+	free := fl.free
+	// the pages taken by a prepared Tx are free on disk, the Tx is
+	// replayed from the WAL after a crash, but stay its own until it ends
+	var taken []uint64
+	var appended uint64
+	if p := db.prepared; p != nil {
+		free, taken = free[:len(free)-p.tx.page.reused], free[len(free)-p.tx.page.reused:]
+		appended = p.tx.page.nappend
+	}
+	var listPages []uint64
+	if !db.opts.noFreelistSync {
+		listPages = make([]uint64, freeListPages(fl.total()+len(fl.pages)+int(appended), db.nodeSize()))
+	}
+	prepared := flushed
+	flushed += appended
+	for i := range listPages {
+		if n := len(free); n > 0 {
+			listPages[i], free = free[n-1], free[:n-1]
+		} else {
+			listPages[i] = flushed
+			flushed++
+		}
+	}
+	var pointers []uint64
+	pointers = append(pointers, free...)
+	pointers = append(pointers, taken...)
+	for ptr := prepared; ptr < prepared+appended; ptr++ {
+		pointers = append(pointers, ptr)
+	}
+	for _, p := range fl.pending {
+		pointers = append(pointers, p.pages...)
+		pointers = append(pointers, p.young...)
+	}
+	pointers = append(pointers, fl.pages...)
+	for i, page := range encodeFreeList(pointers, listPages, db.nodeSize()) {
+		pages[listPages[i]] = page
+	}
+	if err := db.writePages(pages, flushed); err != nil {
+		db.log.Warn("checkpoint failed", "err", err)
+		return err
+	}
+
+	db.mu.Lock()
+	// the pages taken stay last, the commit of the prepared Tx drops them
+	db.free.free = append(append(free[:len(free):len(free)], fl.pages...), taken...)
+	db.free.pages = listPages
+	db.page.flushed = flushed
+	if p := db.prepared; p != nil {
+		// its commit sets the size of the file past the free list
+		p.tx.page.flushed = flushed - appended
+	}
+	checkpointed := db.checkpointed
+	db.checkpointed = db.version
+	err = db.writeMeta()
+	db.mu.Unlock()
+	if err == nil {
+		err = db.resetWAL()
+	}
+	if p := db.prepared; err == nil && p != nil {
+		// the prepared Tx is not part of the checkpoint
+		err = db.logPrepared(p.record)
+	}
+	if err != nil {
+		// the meta page or the WAL may be in any state now
+		db.mu.Lock()
+		db.checkpointed = checkpointed
+		db.mu.Unlock()
+		db.poison(fmt.Errorf("checkpoint: %w", err))
+		return err
+	}
+	for ptr, page := range pages {
+		db.cache.clean(ptr, page)
+	}
+	db.log.Info("checkpoint", "version", db.checkpointed, "pages", len(pages), "file_pages", flushed)
+	if elapsed := time.Since(start); db.slow(elapsed) {
+		db.log.Warn("slow checkpoint", "version", db.checkpointed, "duration", elapsed, "pages", len(pages), "bytes", len(pages)*db.opts.pageSize)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// the store of s3://bucket/key, the credentials from the environment as
+// for the AWS tools
+func parseS3(s3URL, endpoint, region string) (*storage.S3Store, string, error) {
+	u, err := url.Parse(s3URL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, "", fmt.Errorf("bad object %q, want s3://bucket/key", s3URL)
+	}
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	s := &storage.S3Store{
+		Endpoint:     endpoint,
+		Region:       region,
+		Bucket:       u.Host,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, "", fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are needed")
+	}
+	return s, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+func runBackup(args []string) error {
+	fs := newFlags("backup")
+	endpoint := fs.String("endpoint", "", "URL of the S3 service, AWS_ENDPOINT_URL or AWS by default")
+	region := fs.String("region", "", "region of the bucket, AWS_REGION or us-east-1 by default")
+	partSize := fs.Int64("part-size", storage.S3_PART_SIZE, "bytes of the parts uploaded")
+	from := fs.String("from", "", "address of the replication of a server to back up into <db>, instead of uploading <db>")
+	since := fs.Int64("since", -1, "upload an incremental backup of the commits after that version, of the backup before")
+	caFile := fs.String("tls-ca", "", "PEM file of the CAs of the server of -from, TLS to it if set")
+	certFile := fs.String("tls-cert", "", "PEM file of the client certificate for -from over TLS")
+	keyFile := fs.String("tls-key", "", "PEM file of the key of -tls-cert")
+	args, err := parseFlags(fs, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	if (*from != "") != (len(args) == 1) {
+		fs.Usage()
+		return fmt.Errorf("wrong number of arguments")
+	}
+	if *from != "" {
+		var opts []storage.Option
+		if *caFile != "" {
+			cfg, err := clientTLS(*caFile, *certFile, *keyFile)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, storage.WithReplicationTLS(cfg))
+		}
+		return backupFrom(*from, args[0], opts...)
+	}
+	s, key, err := parseS3(args[1], *endpoint, *region)
+	if err != nil {
+		return err
+	}
+	s.PartSize = *partSize
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	start := time.Now()
+	var version uint64
+	if *since >= 0 {
+		version, err = db.BackupS3Incremental(ctx, s, key, uint64(*since))
+	} else {
+		version, err = db.BackupS3(ctx, s, key)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("uploaded version %d to %s in %v\n", version, args[1], time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// the TLS of a server checked by the CAs of caFile, with a client
+// certificate if certFile is set
+func clientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	var cert *storage.TLSCertificate
+	if certFile != "" || keyFile != "" {
+		var err error
+		if cert, err = storage.LoadTLSCertificate(certFile, keyFile, ""); err != nil {
+			return nil, err
+		}
+	}
+	return storage.TLSClientConfig(caFile, cert)
+}
+
+// copy the database of a server into db: what it committed since the last
+// copy if db is one already
+func backupFrom(addr, path string, opts ...storage.Option) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	db, err := openDB(path, false, opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	start := time.Now()
+	version, err := db.BackupFrom(ctx, addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("backed up version %d of %s to %s in %v\n", version, addr, path, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs := newFlags("restore")
+	endpoint := fs.String("endpoint", "", "URL of the S3 service, AWS_ENDPOINT_URL or AWS by default")
+	region := fs.String("region", "", "region of the bucket, AWS_REGION or us-east-1 by default")
+	merge := fs.Bool("merge", false, "restore into an existing database, the keys of the backup win")
+	since := fs.Int64("since", -1, "the version the database is restored up to, to apply incremental backups only")
+	wal := fs.String("wal", "", "database whose WAL archive is replayed after the backups")
+	toVersion := fs.Uint64("to-version", 0, "the last commit of -wal replayed, all if 0")
+	toTime := fs.String("to-time", "", "replay the commits of -wal up to that RFC 3339 time")
+	args, err := parseFlags(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 && (*since < 0 || *wal == "") {
+		fs.Usage()
+		return fmt.Errorf("no backup to restore")
+	}
+	var target storage.RecoveryTarget
+	target.Version = *toVersion
+	if *toTime != "" {
+		if target.Time, err = time.Parse(time.RFC3339Nano, *toTime); err != nil {
+			return err
+		}
+	}
+	if fi, err := os.Stat(args[0]); err == nil && fi.Size() > 0 && !*merge && *since < 0 {
+		return fmt.Errorf("%s exists, use -merge to restore into it", args[0])
+	}
+	type object struct {
+		s   *storage.S3Store
+		key string
+	}
+	var objects []object
+	for _, arg := range args[1:] {
+		s, key, err := parseS3(arg, *endpoint, *region)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, object{s, key})
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	db, err := openDB(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// the full backup first, then the incremental ones in order
+	version := uint64(*since)
+	for i, o := range objects {
+		start := time.Now()
+		if i == 0 && *since < 0 {
+			version, err = db.RestoreS3(ctx, o.s, o.key)
+		} else {
+			version, err = db.RestoreS3Incremental(ctx, o.s, o.key, version)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[i+1], err)
+		}
+		fmt.Printf("restored version %d from %s in %v\n", version, args[i+1], time.Since(start).Round(time.Millisecond))
+	}
+	if *wal != "" {
+		start := time.Now()
+		if version, err = db.RecoverWAL(ctx, *wal, version, target); err != nil {
+			return err
+		}
+		fmt.Printf("recovered version %d from the WAL of %s in %v\n", version, *wal, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func TestParseS3(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "ak")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "sk")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_ENDPOINT_URL", "")
+	s, key, err := parseS3("s3://bk/dir/a.bak", "", "")
+	if err != nil || key != "dir/a.bak" || s.Bucket != "bk" || s.Region != "us-east-1" || s.Endpoint != "https://s3.us-east-1.amazonaws.com" {
+		t.Fatalf("store %+v, key %q: %v", s, key, err)
+	}
+	t.Setenv("AWS_REGION", "eu-west-3")
+	if s, _, _ := parseS3("s3://bk/a", "", ""); s.Region != "eu-west-3" || s.Endpoint != "https://s3.eu-west-3.amazonaws.com" {
+		t.Fatalf("store %+v of AWS_REGION", s)
+	}
+	t.Setenv("AWS_ENDPOINT_URL", "http://minio:9000")
+	if s, _, _ := parseS3("s3://bk/a", "", "r"); s.Region != "r" || s.Endpoint != "http://minio:9000" {
+		t.Fatalf("store %+v of AWS_ENDPOINT_URL", s)
+	}
+	if s, _, _ := parseS3("s3://bk/a", "http://other", ""); s.Endpoint != "http://other" {
+		t.Fatalf("store %+v of -endpoint", s)
+	}
+	for _, bad := range []string{"bk/a", "s3://bk", "s3://bk/", "s3:///a", "http://bk/a"} {
+		if _, _, err := parseS3(bad, "", ""); err == nil {
+			t.Fatalf("parsed %q", bad)
+		}
+	}
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	if _, _, err := parseS3("s3://bk/a", "", ""); err == nil {
+		t.Fatal("parsed without credentials")
+	}
+}
+
+// the multipart uploads and the gets of whole objects
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	parts   map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := r.URL.Query()
+	switch {
+	case r.Method == "POST" && q.Has("uploads"):
+		fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>1</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == "PUT":
+		data, _ := io.ReadAll(r.Body)
+		f.parts[r.URL.Path] = append(f.parts[r.URL.Path], data...)
+	case r.Method == "POST":
+		f.objects[r.URL.Path], f.parts[r.URL.Path] = f.parts[r.URL.Path], nil
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "GET" && f.objects[r.URL.Path] != nil:
+		w.Write(f.objects[r.URL.Path])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>no such key</Message></Error>")
+	}
+}
+
+func TestRunBackup(t *testing.T) {
+	f := &fakeS3{objects: map[string][]byte{}, parts: map[string][]byte{}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "ak")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "sk")
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+
+	db := openTestDB(t)
+	for i := 0; i < 1000; i++ {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i)))
+	}
+	db.Close()
+	if err := runBackup([]string{db.Path, "s3://bk/a.bak"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.objects["/bk/a.bak"]) == 0 {
+		t.Fatal("nothing uploaded")
+	}
+	if err := runBackup([]string{"-part-size", "10", db.Path, "s3://bk/b.bak"}); err == nil {
+		t.Fatal("uploaded in parts of 10 bytes")
+	}
+	if err := runBackup([]string{db.Path}); err == nil {
+		t.Fatal("uploaded to no object")
+	}
+
+	path := filepath.Join(t.TempDir(), "restored.db")
+	if err := runRestore([]string{path, "s3://bk/a.bak"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRestore([]string{path, "s3://bk/a.bak"}); err == nil || !strings.Contains(err.Error(), "-merge") {
+		t.Fatalf("restore over a database: %v", err)
+	}
+	if err := runRestore([]string{filepath.Join(t.TempDir(), "x.db"), "s3://bk/missing"}); err == nil || !strings.Contains(err.Error(), "NoSuchKey") {
+		t.Fatalf("restore of a missing object: %v", err)
+	}
+	restored, err := storage.Open(path, storage.WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	for i := 0; i < 1000; i += 99 {
+		if v, _, _ := restored.Get([]byte(fmt.Sprintf("k%04d", i))); string(v) != fmt.Sprint(i) {
+			t.Fatalf("k%04d is %q", i, v)
+		}
+	}
+}
+
+func TestRunBackupFrom(t *testing.T) {
+	primary := openTestDB(t)
+	for i := 0; i < 100; i++ {
+		primary.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i)))
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		primary.ServeReplication(l)
+	}()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := runBackup([]string{"-from", l.Addr().String(), path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runBackup([]string{"-from", l.Addr().String(), path, "s3://bk/a.bak"}); err == nil {
+		t.Fatal("backup -from to S3")
+	}
+	backup, err := storage.Open(path, storage.WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if v, _, _ := backup.Get([]byte("k0042")); string(v) != "42" {
+		t.Fatalf("k0042 is %q", v)
+	}
+}
+
+// a full backup and an incremental one, restored in a chain
+func TestRunBackupIncremental(t *testing.T) {
+	f := &fakeS3{objects: map[string][]byte{}, parts: map[string][]byte{}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "ak")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "sk")
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+
+	db := openTestDB(t, storage.WithWALArchiveSize(1<<30), storage.WithCheckpointSize(16<<10))
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("full"))
+	}
+	tx, _ := db.Begin(false)
+	since := tx.Version()
+	tx.Rollback()
+	for i := 50; i < 1000; i++ {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("incremental"))
+	}
+	db.Close()
+	if err := runBackup([]string{db.Path, "s3://bk/full.bak"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runBackup([]string{"-since", fmt.Sprint(since), db.Path, "s3://bk/inc.bak"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the full backup is of the last version, the incremental one follows
+	// another: restored up to since, it applies
+	path := filepath.Join(t.TempDir(), "restored.db")
+	if err := runRestore([]string{path, "s3://bk/full.bak", "s3://bk/inc.bak"}); err == nil || !strings.Contains(err.Error(), "inc.bak") {
+		t.Fatalf("restore of an incremental after the last version: %v", err)
+	}
+	path = filepath.Join(t.TempDir(), "restored.db")
+	partial := openTestDB(t)
+	for i := 0; i < 100; i++ {
+		partial.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("full"))
+	}
+	partial.Close()
+	if err := runRestore([]string{"-since", fmt.Sprint(since), partial.Path, "s3://bk/inc.bak"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRestore([]string{"-since", fmt.Sprint(since), path}); err == nil {
+		t.Fatal("restore of no backup")
+	}
+	restored, err := storage.Open(partial.Path, storage.WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	for i, want := range map[int]string{0: "full", 49: "full", 50: "incremental", 999: "incremental"} {
+		if v, _, _ := restored.Get([]byte(fmt.Sprintf("k%04d", i))); string(v) != want {
+			t.Fatalf("k%04d is %q", i, v)
+		}
+	}
+}
+
+// a backup restored, then the WAL archive of the database replayed
+func TestRunRestoreWAL(t *testing.T) {
+	f := &fakeS3{objects: map[string][]byte{}, parts: map[string][]byte{}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "ak")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "sk")
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+
+	db := openTestDB(t, storage.WithWALArchiveSize(1<<30), storage.WithCheckpointSize(16<<10))
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("backup"))
+	}
+	s, key, err := parseS3("s3://bk/a.bak", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.BackupS3(context.Background(), s, key); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("wal"))
+	}
+	tx, _ := db.Begin(false)
+	target := tx.Version()
+	tx.Rollback()
+	db.Set([]byte("k0000"), []byte("bad"))
+
+	restored := filepath.Join(t.TempDir(), "restored.db")
+	if err := runRestore([]string{"-wal", db.Path, "-to-version", fmt.Sprint(target), restored, "s3://bk/a.bak"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRestore([]string{"-wal", db.Path, "-to-time", "yesterday", filepath.Join(t.TempDir(), "x.db"), "s3://bk/a.bak"}); err == nil {
+		t.Fatal("restore up to a bad time")
+	}
+	r, err := storage.Open(restored, storage.WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, k := range []string{"k0000", "k0999"} {
+		if v, _, _ := r.Get([]byte(k)); string(v) != "wal" {
+			t.Fatalf("%s is %q", k, v)
+		}
+	}
+}
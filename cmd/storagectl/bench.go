@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// the key distributions of bench
+const (
+	DIST_UNIFORM    = "uniform"
+	DIST_ZIPFIAN    = "zipfian"    // a few keys take most of the operations
+	DIST_SEQUENTIAL = "sequential" // the keys in order, the workers sharing the sequence
+	ZIPF_S          = 1.1
+)
+
+type benchConfig struct {
+	keys      uint64
+	keySize   int
+	valueSize int
+	reads     float64 // share of the operations
+	dist      string
+	workers   int
+	duration  time.Duration
+	batch     int // keys set by a write Tx
+}
+
+// the latencies of the operations of a kind, in the buckets of the engine
+// histograms
+type latencies struct {
+	storage.Histogram
+}
+
+func newLatencies(bounds []time.Duration) *latencies {
+	return &latencies{storage.Histogram{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}}
+}
+
+func (l *latencies) observe(d time.Duration) {
+	l.Counts[sort.Search(len(l.Bounds), func(i int) bool { return d <= l.Bounds[i] })]++
+	l.Count++
+	l.Sum += d
+}
+
+func (l *latencies) add(o *latencies) {
+	for i, n := range o.Counts {
+		l.Counts[i] += n
+	}
+	l.Count += o.Count
+	l.Sum += o.Sum
+}
+
+func runBench(args []string) error {
+	fs := newFlags("bench")
+	var cfg benchConfig
+	fs.Uint64Var(&cfg.keys, "keys", 100000, "number of distinct keys, loaded before the run")
+	fs.IntVar(&cfg.keySize, "key-size", 16, "bytes of a key, at least 8")
+	fs.IntVar(&cfg.valueSize, "value-size", 100, "bytes of a value")
+	fs.Float64Var(&cfg.reads, "reads", 0.9, "share of reads in the operations, from 0 to 1")
+	fs.StringVar(&cfg.dist, "dist", DIST_UNIFORM, "key distribution: uniform, zipfian or sequential")
+	fs.IntVar(&cfg.workers, "c", 4, "concurrent workers")
+	fs.DurationVar(&cfg.duration, "d", 10*time.Second, "duration of the run")
+	fs.IntVar(&cfg.batch, "batch", 1, "keys set by each write transaction")
+	syncPolicy := fs.String("sync", "always", "sync policy: always, interval or never")
+	cache := fs.Int("cache", 0, "pages of the cache, the default if 0")
+	args, err := parseFlags(fs, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cfg.keys == 0:
+		return fmt.Errorf("-keys must be positive")
+	case cfg.keySize < 8:
+		return fmt.Errorf("-key-size must be at least 8")
+	case cfg.reads < 0 || cfg.reads > 1:
+		return fmt.Errorf("-reads must be between 0 and 1")
+	case cfg.workers < 1 || cfg.batch < 1:
+		return fmt.Errorf("-c and -batch must be positive")
+	case cfg.dist != DIST_UNIFORM && cfg.dist != DIST_ZIPFIAN && cfg.dist != DIST_SEQUENTIAL:
+		return fmt.Errorf("unknown distribution %q", cfg.dist)
+	}
+	opts := []storage.Option{}
+	switch *syncPolicy {
+	case "always":
+		opts = append(opts, storage.WithSyncPolicy(storage.SyncAlways))
+	case "interval":
+		opts = append(opts, storage.WithSyncPolicy(storage.SyncInterval))
+	case "never":
+		opts = append(opts, storage.WithSyncPolicy(storage.SyncNever))
+	default:
+		return fmt.Errorf("unknown sync policy %q", *syncPolicy)
+	}
+	if *cache > 0 {
+		opts = append(opts, storage.WithCacheSize(*cache))
+	}
+
+	// a file of its own unless one is given
+	var path string
+	if len(args) == 1 {
+		path = args[0]
+	} else {
+		dir, err := os.MkdirTemp("", "storagectl-bench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		path = filepath.Join(dir, "bench.db")
+	}
+	db, err := openDB(path, false, opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	start := time.Now()
+	if err := benchLoad(db, cfg); err != nil {
+		return err
+	}
+	fmt.Printf("loaded %d keys in %v\n", cfg.keys, time.Since(start).Round(time.Millisecond))
+	reads, writes, elapsed, err := bench(db, cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d workers, %s keys, %.0f%% reads, %v\n", cfg.workers, cfg.dist, cfg.reads*100, elapsed.Round(time.Millisecond))
+	printLatencies("reads", reads, elapsed)
+	printLatencies("writes", writes, elapsed)
+	s := db.Stats()
+	fmt.Printf("commits %d, wal syncs %d, cache hits %d, misses %d\n", s.Commits, s.WALSyncs, s.CacheHits, s.CacheMisses)
+	return nil
+}
+
+func printLatencies(name string, l *latencies, elapsed time.Duration) {
+	if l.Count == 0 {
+		return
+	}
+	fmt.Printf("%-7s %9d ops %10.0f ops/s  mean %-9v p50 %-9v p90 %-9v p99 %-9v p99.9 %v\n",
+		name, l.Count, float64(l.Count)/elapsed.Seconds(), l.Mean().Round(time.Microsecond),
+		l.Quantile(0.5), l.Quantile(0.9), l.Quantile(0.99), l.Quantile(0.999))
+}
+
+// the key of an index, the indexes of the random distributions are
+// scattered over the keys so that the hot ones aren't neighbours
+func benchKey(cfg benchConfig, i uint64) []byte {
+	key := make([]byte, cfg.keySize)
+	for j := range key[:cfg.keySize-8] {
+		key[j] = 'k'
+	}
+	if cfg.dist != DIST_SEQUENTIAL {
+		i = mix(i)
+	}
+	binary.BigEndian.PutUint64(key[cfg.keySize-8:], i)
+	return key
+}
+
+// splitmix64, a bijection
+func mix(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// set every key once
+func benchLoad(db *storage.DB, cfg benchConfig) error {
+	l := db.NewLoader(context.Background())
+	value := make([]byte, cfg.valueSize)
+	for i := uint64(0); i < cfg.keys; i++ {
+		if err := l.Set(nil, benchKey(cfg, i), value); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	if err := l.Close(); err != nil {
+		return err
+	}
+	return db.Checkpoint()
+}
+
+// run the workers for the duration, the latencies of their reads and writes
+func bench(db *storage.DB, cfg benchConfig) (reads, writes *latencies, elapsed time.Duration, err error) {
+	bounds := db.Stats().CommitLatency.Bounds
+	reads, writes = newLatencies(bounds), newLatencies(bounds)
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		stop     atomic.Bool
+		sequence atomic.Uint64
+		firstErr error
+	)
+	start := time.Now()
+	for w := 0; w < cfg.workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			next := func() uint64 { return r.Uint64() % cfg.keys }
+			switch cfg.dist {
+			case DIST_ZIPFIAN:
+				next = rand.NewZipf(r, ZIPF_S, 1, cfg.keys-1).Uint64
+			case DIST_SEQUENTIAL:
+				next = func() uint64 { return (sequence.Add(1) - 1) % cfg.keys }
+			}
+			rl, wl := newLatencies(bounds), newLatencies(bounds)
+			value := make([]byte, cfg.valueSize)
+			var err error
+			for !stop.Load() {
+				begin := time.Now()
+				if r.Float64() < cfg.reads {
+					_, _, err = db.Get(benchKey(cfg, next()))
+					rl.observe(time.Since(begin))
+				} else {
+					r.Read(value)
+					err = benchWrite(db, cfg, next, value)
+					wl.observe(time.Since(begin))
+				}
+				if err != nil {
+					stop.Store(true)
+					break
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			reads.add(rl)
+			writes.add(wl)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(int64(w) + 1)
+	}
+	timer := time.AfterFunc(cfg.duration, func() { stop.Store(true) })
+	defer timer.Stop()
+	wg.Wait()
+	return reads, writes, time.Since(start), firstErr
+}
+
+func benchWrite(db *storage.DB, cfg benchConfig, next func() uint64, value []byte) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < cfg.batch; i++ {
+		if err := tx.Set(benchKey(cfg, next()), value); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
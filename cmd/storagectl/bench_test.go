@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLatencies(t *testing.T) {
+	bounds := []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond}
+	a, b := newLatencies(bounds), newLatencies(bounds)
+	for i := 0; i < 90; i++ {
+		a.observe(500 * time.Microsecond)
+	}
+	for i := 0; i < 9; i++ {
+		b.observe(10 * time.Millisecond)
+	}
+	b.observe(time.Second)
+	a.add(b)
+	if fmt.Sprint(a.Counts) != "[90 9 0 1]" || a.Count != 100 {
+		t.Fatalf("counts %v of %d", a.Counts, a.Count)
+	}
+	if a.Sum != 45*time.Millisecond+90*time.Millisecond+time.Second {
+		t.Fatalf("sum %v", a.Sum)
+	}
+	for q, want := range map[float64]time.Duration{
+		0.5: time.Millisecond, 0.9: time.Millisecond, 0.99: 10 * time.Millisecond, 0.999: 100 * time.Millisecond} {
+		if got := a.Quantile(q); got != want {
+			t.Fatalf("quantile %v is %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestBenchKey(t *testing.T) {
+	cfg := benchConfig{keySize: 12, dist: DIST_SEQUENTIAL}
+	if k := benchKey(cfg, 1); string(k) != "kkkk\x00\x00\x00\x00\x00\x00\x00\x01" {
+		t.Fatalf("key %q", k)
+	}
+	if bytes.Compare(benchKey(cfg, 255), benchKey(cfg, 256)) >= 0 {
+		t.Fatal("sequential keys out of order")
+	}
+	cfg.dist = DIST_ZIPFIAN
+	seen := map[string]bool{}
+	for i := uint64(0); i < 10000; i++ {
+		seen[string(benchKey(cfg, i))] = true
+	}
+	if len(seen) != 10000 {
+		t.Fatalf("%d distinct keys of 10000", len(seen))
+	}
+	if bytes.Compare(benchKey(cfg, 0), benchKey(cfg, 1)) < 0 && bytes.Compare(benchKey(cfg, 1), benchKey(cfg, 2)) < 0 {
+		t.Fatal("random keys in order")
+	}
+}
+
+func TestBench(t *testing.T) {
+	for _, dist := range []string{DIST_UNIFORM, DIST_ZIPFIAN, DIST_SEQUENTIAL} {
+		t.Run(dist, func(t *testing.T) {
+			db := openTestDB(t)
+			cfg := benchConfig{keys: 500, keySize: 16, valueSize: 50, reads: 0.5, dist: dist,
+				workers: 2, duration: 50 * time.Millisecond, batch: 3}
+			if err := benchLoad(db, cfg); err != nil {
+				t.Fatal(err)
+			}
+			n := 0
+			tx, _ := db.Begin(false)
+			c := tx.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				n++
+			}
+			tx.Rollback()
+			if n != 500 {
+				t.Fatalf("%d keys loaded", n)
+			}
+			reads, writes, elapsed, err := bench(db, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reads.Count == 0 || writes.Count == 0 || elapsed < cfg.duration {
+				t.Fatalf("%d reads, %d writes in %v", reads.Count, writes.Count, elapsed)
+			}
+			if s := db.Stats(); s.Commits < writes.Count {
+				t.Fatalf("%d commits for %d writes", s.Commits, writes.Count)
+			}
+		})
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bench.db")
+	if err := runBench([]string{"-keys", "200", "-d", "20ms", "-sync", "never", "-reads", "0.8", path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runBench([]string{"-keys", "100", "-d", "10ms", "-dist", "zipfian", "-batch", "4"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-keys", "0"}, {"-key-size", "4"}, {"-reads", "2"}, {"-c", "0"},
+		{"-dist", "gauss"}, {"-sync", "sometimes"}} {
+		if err := runBench(args); err == nil {
+			t.Fatalf("bench %v ran", args)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func runCheck(args []string) error {
+	fs := newFlags("check")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	args, err := parseFlags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := db.Check(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if report.Problems == nil {
+			report.Problems = []storage.CheckProblem{} // [] rather than null
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(struct {
+			OK bool
+			storage.CheckReport
+		}{report.OK(), report})
+		if err != nil {
+			return err
+		}
+	} else {
+		printCheck(report)
+	}
+	if !report.OK() {
+		return fmt.Errorf("%d problems found", len(report.Problems))
+	}
+	return nil
+}
+
+func printCheck(r storage.CheckReport) {
+	for _, p := range r.Problems {
+		fmt.Println(p)
+	}
+	if r.Truncated {
+		fmt.Printf("more than %d problems, the first ones only\n", storage.CHECK_MAX_PROBLEMS)
+	}
+	fmt.Printf("version %d: %d pages, %d in use, %d free, %d trees, %d keys\n",
+		r.Version, r.FilePages, r.UsedPages, r.FreePages, r.Trees, r.Keys)
+}
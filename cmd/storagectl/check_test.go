@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func TestRunCheck(t *testing.T) {
+	db := openTestDB(t)
+	for i := 0; i < 1000; i++ {
+		db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v"))
+	}
+	db.Checkpoint()
+	db.Close()
+	for _, args := range [][]string{{db.Path}, {"-json", db.Path}} {
+		if err := runCheck(args); err != nil {
+			t.Fatalf("check %v: %v", args, err)
+		}
+	}
+	if err := runCheck(nil); err == nil {
+		t.Fatal("check without a file")
+	}
+
+	f, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every page of the trees, the free list is read by Open, which fails
+	// on a page of it not matching its checksum
+	st, _ := f.Stat()
+	for off := int64(storage.BTREE_PAGE_SIZE); off < st.Size(); off += storage.BTREE_PAGE_SIZE {
+		kind := make([]byte, 2)
+		if f.ReadAt(kind, off); kind[0] != storage.BNODE_FREE {
+			f.WriteAt([]byte{9, 9, 9, 9, 9, 9}, off+20)
+		}
+	}
+	f.Close()
+	for _, args := range [][]string{{db.Path}, {"-json", db.Path}} {
+		if err := runCheck(args); err == nil || !strings.Contains(err.Error(), "problems found") {
+			t.Fatalf("check %v of a corrupt file: %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func runCompact(args []string) error {
+	fs := newFlags("compact")
+	quiet := fs.Bool("q", false, "don't report the progress")
+	args, err := parseFlags(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	// read-only, the file isn't written even to recover the WAL
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var progress func(storage.CompactProgress)
+	if !*quiet {
+		last := time.Now()
+		progress = func(p storage.CompactProgress) {
+			if time.Since(last) < PROGRESS_INTERVAL {
+				return
+			}
+			last = time.Now()
+			fmt.Fprintf(os.Stderr, "%d of %d keys, %.1f%% of the bytes, %d pages written, %v left\n",
+				p.Keys, p.TotalKeys, percent(p.Bytes, p.TotalBytes), p.Pages, p.Remaining().Round(time.Second))
+		}
+	}
+	r, err := db.Compact(ctx, args[1], progress)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("copied %d keys of version %d in %v: %d bytes to %d, %d reclaimed (%.1f%%)\n",
+		r.Keys, r.Version, r.Duration.Round(time.Millisecond), r.OldBytes, r.NewBytes,
+		r.Reclaimed(), percent(r.Reclaimed(), r.OldBytes))
+	return nil
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 100
+	}
+	return 100 * float64(n) / float64(total)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func TestRunCompact(t *testing.T) {
+	db := openTestDB(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < 5000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 100))
+	}
+	tx.Commit()
+	tx, _ = db.Begin(true)
+	for i := 0; i < 5000; i += 2 {
+		tx.Del([]byte(fmt.Sprintf("k%05d", i)))
+	}
+	tx.Commit()
+	db.Close()
+
+	path := filepath.Join(t.TempDir(), "compact.db")
+	if err := runCompact([]string{db.Path, path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCompact([]string{"-q", db.Path, path}); err == nil {
+		t.Fatal("compacted over an existing file")
+	}
+	if err := runCompact([]string{db.Path}); err == nil {
+		t.Fatal("compacted without a destination")
+	}
+	dst, err := storage.Open(path, storage.WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	for i := 0; i < 5000; i++ {
+		_, ok, err := dst.Get([]byte(fmt.Sprintf("k%05d", i)))
+		if err != nil || ok != (i%2 == 1) {
+			t.Fatalf("k%05d found %v: %v", i, ok, err)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	if p := percent(1, 4); p != 25 {
+		t.Fatalf("%v%%", p)
+	}
+	if p := percent(0, 0); p != 100 {
+		t.Fatalf("%v%% of nothing", p)
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// CSV import: each row is a key, the columns of -key joined by -key-sep,
+// and a value, the column of -value or the other columns as a JSON object,
+// an array if the file has no header. The
+// rows are sorted in chunks of -chunk bytes written to temporary runs, the
+// runs are merged into the Loader so that it gets the keys in order. Of
+// the rows with the same key the last one wins.
+
+const CSV_CHUNK_SIZE = 64 << 20 // bytes of rows sorted in memory
+
+type csvOptions struct {
+	delimiter rune
+	header    bool     // the first row names the columns
+	keys      []string // columns of the key, names or numbers from 1
+	keySep    string
+	value     string // column of the value, the JSON of the others if empty
+	bucket    [][]byte
+	chunk     int
+	rate      int64 // bytes loaded per second at most, as WithImportRate
+}
+
+type csvRow struct {
+	key, value []byte
+}
+
+// the columns of the options as indexes of the rows
+type csvColumns struct {
+	names []string // of the columns, from the header or their numbers
+	keys  []int
+	value int // -1 for the JSON of the rest
+	rest  []int
+}
+
+func newCSVColumns(opts csvOptions, first []string) (*csvColumns, error) {
+	c := &csvColumns{value: -1}
+	if opts.header {
+		c.names = append([]string(nil), first...)
+	} else {
+		for i := range first {
+			c.names = append(c.names, strconv.Itoa(i+1))
+		}
+	}
+	index := func(col string) (int, error) {
+		for i, name := range c.names {
+			if name == col {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("no column %q", col)
+	}
+	if len(opts.keys) == 0 {
+		return nil, errors.New("no key column")
+	}
+	used := map[int]bool{}
+	for _, col := range opts.keys {
+		i, err := index(col)
+		if err != nil {
+			return nil, err
+		}
+		c.keys = append(c.keys, i)
+		used[i] = true
+	}
+	if opts.value != "" {
+		i, err := index(opts.value)
+		if err != nil {
+			return nil, err
+		}
+		c.value = i
+	}
+	for i := range c.names {
+		if !used[i] {
+			c.rest = append(c.rest, i)
+		}
+	}
+	return c, nil
+}
+
+// the key and value of a row
+func (c *csvColumns) row(opts csvOptions, fields []string) (csvRow, error) {
+	if len(fields) != len(c.names) {
+		return csvRow{}, fmt.Errorf("%d columns, want %d", len(fields), len(c.names))
+	}
+	var key []byte
+	for i, col := range c.keys {
+		if i > 0 {
+			key = append(key, opts.keySep...)
+		}
+		key = append(key, fields[col]...)
+	}
+	if c.value >= 0 {
+		return csvRow{key: key, value: []byte(fields[c.value])}, nil
+	}
+	// an object in the order of the columns, an array without names
+	open, end := byte('{'), byte('}')
+	if !opts.header {
+		open, end = '[', ']'
+	}
+	var value bytes.Buffer
+	value.WriteByte(open)
+	for i, col := range c.rest {
+		if i > 0 {
+			value.WriteByte(',')
+		}
+		if opts.header {
+			name, _ := json.Marshal(c.names[col])
+			value.Write(name)
+			value.WriteByte(':')
+		}
+		field, _ := json.Marshal(fields[col])
+		value.Write(field)
+	}
+	value.WriteByte(end)
+	return csvRow{key: key, value: value.Bytes()}, nil
+}
+
+// load the rows of a CSV file through sorted runs
+func importCSV(ctx context.Context, db *storage.DB, src string, opts csvOptions, progress func(storage.ImportProgress)) (p storage.ImportProgress, err error) {
+	start := time.Now()
+	fp, err := os.Open(src)
+	if err != nil {
+		return p, err
+	}
+	defer fp.Close()
+	if fi, err := fp.Stat(); err == nil {
+		p.Size = fi.Size()
+	}
+	counter := &countingReader{r: fp}
+	r := csv.NewReader(bufio.NewReader(counter))
+	r.Comma = opts.delimiter
+	r.ReuseRecord = true
+	if opts.delimiter == '\t' {
+		r.LazyQuotes = true
+	}
+	report := func() {
+		p.Read, p.Elapsed = counter.n.Load(), time.Since(start)
+		if progress != nil {
+			progress(p)
+		}
+	}
+
+	s := &csvSorter{chunk: opts.chunk}
+	defer s.remove()
+	var cols *csvColumns
+	for n := 1; ; n++ {
+		fields, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return p, err
+		}
+		if cols == nil {
+			if cols, err = newCSVColumns(opts, fields); err != nil {
+				return p, err
+			}
+			if opts.header {
+				continue
+			}
+		}
+		row, err := cols.row(opts, fields)
+		if err != nil {
+			return p, fmt.Errorf("row %d: %w", n, err)
+		}
+		if err := s.add(row); err != nil {
+			return p, err
+		}
+		if n%storage.IMPORT_PROGRESS_KEYS == 0 {
+			if err := ctx.Err(); err != nil {
+				return p, err
+			}
+			report()
+		}
+	}
+
+	l := db.NewLoader(ctx)
+	if len(opts.bucket) > 0 {
+		if err := l.CreateBucket(opts.bucket); err != nil {
+			return p, err
+		}
+		p.Buckets++
+	}
+	loading := time.Now()
+	err = s.merge(func(row csvRow) error {
+		if err := l.Set(opts.bucket, row.key, row.value); err != nil {
+			return fmt.Errorf("key %q: %w", row.key, err)
+		}
+		p.Keys++
+		p.Bytes += int64(len(row.key) + len(row.value))
+		if p.Keys%storage.IMPORT_PROGRESS_KEYS == 0 {
+			report()
+		}
+		if opts.rate > 0 {
+			due := time.Duration(float64(p.Bytes) / float64(opts.rate) * float64(time.Second))
+			if ahead := due - time.Since(loading); ahead >= storage.IMPORT_MIN_SLEEP {
+				select {
+				case <-time.After(ahead):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		return nil
+	})
+	if cerr := l.Close(); err == nil {
+		err = cerr
+	}
+	report()
+	return p, err
+}
+
+// an external sort of rows: the chunks are sorted in memory and written as
+// runs one after the other in a temp file, then merged
+type csvSorter struct {
+	chunk int
+	rows  []csvRow
+	size  int
+	file  *os.File
+	runs  []csvRun
+}
+
+// a sorted run in the temp file
+type csvRun struct {
+	offset, size int64
+}
+
+func (s *csvSorter) add(row csvRow) error {
+	s.rows = append(s.rows, row)
+	s.size += len(row.key) + len(row.value) + 64
+	if s.size >= s.chunk {
+		return s.spill()
+	}
+	return nil
+}
+
+// sort the rows of the chunk, the last of each key kept
+func (s *csvSorter) sort() []csvRow {
+	sort.SliceStable(s.rows, func(i, j int) bool { return bytes.Compare(s.rows[i].key, s.rows[j].key) < 0 })
+	rows := s.rows[:0]
+	for i, row := range s.rows {
+		if i+1 < len(s.rows) && bytes.Equal(row.key, s.rows[i+1].key) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// write the chunk to a run
+func (s *csvSorter) spill() error {
+	if s.file == nil {
+		f, err := os.CreateTemp("", "storagectl-csv-*")
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+	offset, err := s.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(s.file)
+	var n int64
+	for _, row := range s.sort() {
+		record := binary.AppendUvarint(nil, uint64(len(row.key)))
+		record = binary.AppendUvarint(record, uint64(len(row.value)))
+		for _, b := range [][]byte{record, row.key, row.value} {
+			w.Write(b)
+			n += int64(len(b))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	s.runs = append(s.runs, csvRun{offset: offset, size: n})
+	s.rows, s.size = nil, 0
+	return nil
+}
+
+func (s *csvSorter) remove() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
+
+// the rows in key order, the last one of a key
+func (s *csvSorter) merge(fn func(row csvRow) error) error {
+	if len(s.runs) == 0 {
+		for _, row := range s.sort() {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(s.rows) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	h := &csvHeap{}
+	for i, run := range s.runs {
+		c := &csvCursor{r: bufio.NewReader(io.NewSectionReader(s.file, run.offset, run.size)), run: i}
+		if err := c.next(); err != nil {
+			return err
+		}
+		if c.row.key != nil {
+			heap.Push(h, c)
+		}
+	}
+	for h.Len() > 0 {
+		c := (*h)[0]
+		row := c.row
+		if err := c.next(); err != nil {
+			return err
+		}
+		if c.row.key == nil {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+		// a later run has the same key, it wins
+		if h.Len() > 0 && bytes.Equal((*h)[0].row.key, row.key) {
+			continue
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the next row of a run, its key nil at the end
+type csvCursor struct {
+	r   *bufio.Reader
+	run int
+	row csvRow
+}
+
+func (c *csvCursor) next() error {
+	klen, err := binary.ReadUvarint(c.r)
+	if err == io.EOF {
+		c.row = csvRow{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	vlen, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, klen+vlen)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	c.row = csvRow{key: data[:klen:klen], value: data[klen:]}
+	return nil
+}
+
+// the cursors by key, then by run so that the earlier rows come first
+type csvHeap []*csvCursor
+
+func (h csvHeap) Len() int { return len(h) }
+func (h csvHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].row.key, h[j].row.key); c != 0 {
+		return c < 0
+	}
+	return h[i].run < h[j].run
+}
+func (h csvHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *csvHeap) Push(x any)   { *h = append(*h, x.(*csvCursor)) }
+func (h *csvHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// the delimiter of -delimiter, \t for a tab
+func parseDelimiter(s string) (rune, error) {
+	if s == `\t` {
+		return '\t', nil
+	}
+	if r := []rune(s); len(r) == 1 && r[0] != '"' && r[0] != '\r' && r[0] != '\n' {
+		return r[0], nil
+	}
+	return 0, fmt.Errorf("bad delimiter %q", s)
+}
+
+func splitColumns(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
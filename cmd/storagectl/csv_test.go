@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func writeCSVTest(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// the keys and values in a bucket, "k=v" in order
+func csvKeysTest(t *testing.T, db *storage.DB, bucket ...string) []string {
+	t.Helper()
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	c := tx.Cursor()
+	if len(bucket) > 0 {
+		b, err := tx.Bucket([]byte(bucket[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c = b.Cursor()
+	}
+	var kvs []string
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		kvs = append(kvs, string(k)+"="+string(v))
+	}
+	return kvs
+}
+
+func TestImportCSV(t *testing.T) {
+	src := writeCSVTest(t, "users.csv", "country,id,name,age\nfr,2,\"Doe, J\",30\nus,1,Ann,41\nfr,2,Jo,31\n")
+	db := openTestDB(t)
+	opts := csvOptions{delimiter: ',', header: true, keys: []string{"country", "id"}, keySep: ":", chunk: CSV_CHUNK_SIZE, bucket: [][]byte{[]byte("users")}}
+	p, err := importCSV(context.Background(), db, src, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Keys != 2 || p.Buckets != 1 || p.Read != p.Size {
+		t.Fatalf("progress %+v", p)
+	}
+	// the last row of a key wins, the other columns are an object
+	want := `[fr:2={"name":"Jo","age":"31"} us:1={"name":"Ann","age":"41"}]`
+	if got := fmt.Sprint(csvKeysTest(t, db, "users")); got != want {
+		t.Fatalf("imported %s, want %s", got, want)
+	}
+
+	// a TSV without header, the columns by numbers, a value column
+	src = writeCSVTest(t, "kv.tsv", "b\tx\t2\na\tq\"y\t1\n")
+	db = openTestDB(t)
+	opts = csvOptions{delimiter: '\t', keys: []string{"1"}, value: "2", chunk: CSV_CHUNK_SIZE}
+	if _, err := importCSV(context.Background(), db, src, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(csvKeysTest(t, db)); got != `[a=q"y b=x]` {
+		t.Fatalf("imported %s", got)
+	}
+	db = openTestDB(t)
+	opts.value = ""
+	if _, err := importCSV(context.Background(), db, src, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(csvKeysTest(t, db)); got != `[a=["q\"y","1"] b=["x","2"]]` {
+		t.Fatalf("imported %s", got)
+	}
+
+	for _, c := range []struct {
+		data, key, err string
+	}{
+		{"a,b\n1,2\n", "c", `no column "c"`},
+		{"a,b\n1,2\n3\n", "a", "wrong number of fields"},
+		{"a\n\"x\n", "a", "quote"},
+	} {
+		src := writeCSVTest(t, "bad.csv", c.data)
+		opts := csvOptions{delimiter: ',', header: true, keys: []string{c.key}, chunk: CSV_CHUNK_SIZE}
+		if _, err := importCSV(context.Background(), openTestDB(t), src, opts, nil); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("import of %q: %v, want %s", c.data, err, c.err)
+		}
+	}
+}
+
+// the runs written by small chunks merge in order, the last row of a key
+// winning across the runs
+func TestImportCSVRuns(t *testing.T) {
+	const rows = 20000
+	var data strings.Builder
+	data.WriteString("k,v\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&data, "%05d,%d\n", (i*7919)%(rows/2), i)
+	}
+	src := writeCSVTest(t, "runs.csv", data.String())
+	db := openTestDB(t)
+	opts := csvOptions{delimiter: ',', header: true, keys: []string{"k"}, value: "v", chunk: 16 << 10}
+	var reports int
+	p, err := importCSV(context.Background(), db, src, opts, func(storage.ImportProgress) { reports++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Keys != rows/2 || reports == 0 {
+		t.Fatalf("%d keys, %d reports", p.Keys, reports)
+	}
+	last := map[string]int{}
+	for i := 0; i < rows; i++ {
+		last[fmt.Sprintf("%05d", (i*7919)%(rows/2))] = i
+	}
+	kvs := csvKeysTest(t, db)
+	for i, kv := range kvs {
+		k := fmt.Sprintf("%05d", i)
+		if want := fmt.Sprintf("%s=%d", k, last[k]); kv != want {
+			t.Fatalf("imported %s, want %s", kv, want)
+		}
+	}
+	if len(kvs) != rows/2 {
+		t.Fatalf("%d keys", len(kvs))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := importCSV(ctx, openTestDB(t), src, opts, nil); err != context.Canceled {
+		t.Fatalf("canceled import: %v", err)
+	}
+}
+
+func TestParseDelimiter(t *testing.T) {
+	for s, want := range map[string]rune{`\t`: '\t', ";": ';', "|": '|', "é": 'é'} {
+		if r, err := parseDelimiter(s); r != want || err != nil {
+			t.Errorf("delimiter %q: %q %v", s, r, err)
+		}
+	}
+	for _, s := range []string{"", `"`, "\n", ",,"} {
+		if _, err := parseDelimiter(s); err == nil {
+			t.Errorf("delimiter %q accepted", s)
+		}
+	}
+}
+
+func TestRunImportCSV(t *testing.T) {
+	src := writeCSVTest(t, "kv.csv", "k;v\na;1\nb;2\n")
+	path := filepath.Join(t.TempDir(), "imported.db")
+	if err := runImport([]string{"-q", "-from", "csv", src, path}); err == nil || !strings.Contains(err.Error(), "-key") {
+		t.Fatalf("import without -key: %v", err)
+	}
+	if err := runImport([]string{"-q", "-from", "csv", "-delimiter", `""`, "-key", "k", src, path}); err == nil {
+		t.Fatal("import with a bad delimiter")
+	}
+	if err := runImport([]string{"-q", "-from", "csv", "-delimiter", ";", "-key", "k", "-value", "v", "-bucket", "b", src, path}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.Open(path, storage.WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := fmt.Sprint(csvKeysTest(t, db, "b")); got != "[a=1 b=2]" {
+		t.Fatalf("imported %s", got)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func runDOT(args []string) error {
+	fs := newFlags("dot")
+	output := fs.String("o", "", "write to a file instead of stdout")
+	args, err := parseFlags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	err = db.View(func(tx *storage.Tx) error {
+		return tx.WriteDOT(out)
+	})
+	if out != os.Stdout {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
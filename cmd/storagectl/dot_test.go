@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunDOT(t *testing.T) {
+	db := openTestDB(t)
+	db.Set([]byte("a"), []byte("b"))
+	db.Close()
+	out := filepath.Join(t.TempDir(), "tree.dot")
+	if err := runDOT([]string{"-o", out, db.Path}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "digraph storage {") || !strings.Contains(string(data), `\"a\"`) {
+		t.Fatalf("graph\n%s", data)
+	}
+	if err := runDOT([]string{"-o", filepath.Join(out, "x"), db.Path}); err == nil {
+		t.Fatal("graph written under a file")
+	}
+	if err := runDOT([]string{db.Path}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// the formats of dump and load
+const (
+	FORMAT_NDJSON = "ndjson" // a record per line
+	FORMAT_JSON   = "json"   // an array of records
+)
+
+func runDump(args []string) error {
+	fs := newFlags("dump")
+	format := fs.String("format", FORMAT_NDJSON, "ndjson or json")
+	output := fs.String("o", "", "write to a file instead of stdout")
+	args, err := parseFlags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *format != FORMAT_NDJSON && *format != FORMAT_JSON {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(out)
+	err = db.View(func(tx *storage.Tx) error {
+		return dump(w, tx, *format)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if out != os.Stdout {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// write the keys of the Tx then its buckets, in key order
+func dump(w io.Writer, tx *storage.Tx, format string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	n := 0
+	write := func(r record) error {
+		buf.Reset()
+		if format == FORMAT_JSON {
+			if n == 0 {
+				buf.WriteString("[\n")
+			} else {
+				buf.WriteString(",\n")
+			}
+		}
+		n++
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+		if format == FORMAT_JSON {
+			buf.Truncate(buf.Len() - 1) // the newline goes after the comma
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	keys := func(bucket [][]byte, c *storage.Cursor) error {
+		for key, value := c.First(); key != nil; key, value = c.Next() {
+			var expires time.Time
+			if bucket == nil {
+				var err error
+				if expires, err = tx.Expiry(key); err != nil {
+					return err
+				}
+			}
+			if err := write(newRecord(bucket, key, value, expires)); err != nil {
+				return err
+			}
+		}
+		return c.Err()
+	}
+	if err := keys(nil, tx.Cursor()); err != nil {
+		return err
+	}
+	var buckets func(path [][]byte, b *storage.Bucket) error
+	buckets = func(path [][]byte, b *storage.Bucket) error {
+		if err := write(newRecord(path, nil, nil, time.Time{})); err != nil {
+			return err
+		}
+		if err := keys(path, b.Cursor()); err != nil {
+			return err
+		}
+		return b.ForEachBucket(func(name []byte) error {
+			inner, err := b.Bucket(name)
+			if err != nil {
+				return err
+			}
+			return buckets(append(path[:len(path):len(path)], name), inner)
+		})
+	}
+	err := tx.ForEachBucket(func(name []byte) error {
+		b, err := tx.Bucket(name)
+		if err != nil {
+			return err
+		}
+		return buckets([][]byte{name}, b)
+	})
+	if err != nil || format != FORMAT_JSON {
+		return err
+	}
+	end := "\n]\n"
+	if n == 0 {
+		end = "[]\n"
+	}
+	_, err = io.WriteString(w, end)
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// fill a database with keys, an expiring one, nested buckets, binary names
+// and an empty bucket
+func fillDumpTest(t *testing.T, db *storage.DB, expires time.Time) {
+	t.Helper()
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	tx.Set([]byte("k"), []byte("v"))
+	tx.SetWithExpiry([]byte("t"), []byte("v"), expires)
+	b, _ := tx.CreateBucket([]byte("users"))
+	b.Set([]byte("u1"), []byte(`{"n":"<x>"}`))
+	inner, _ := b.CreateBucket([]byte{0, 0xff})
+	inner.Set([]byte("z"), nil)
+	tx.CreateBucket([]byte("empty"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	db := openTestDB(t)
+	expires := time.Date(2100, 1, 2, 3, 4, 5, 6, time.UTC)
+	fillDumpTest(t, db, expires)
+	want := `{"key":"k","value":"v"}
+{"key":"t","value":"v","expires":"2100-01-02T03:04:05.000000006Z"}
+{"bucket":["empty"]}
+{"bucket":["users"]}
+{"bucket":["users"],"key":"u1","value":"{\"n\":\"<x>\"}"}
+{"bucket":["dXNlcnM=","AP8="],"base64":true}
+{"bucket":["dXNlcnM=","AP8="],"key":"eg==","base64":true}
+`
+	var buf bytes.Buffer
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	if err := dump(&buf, tx, FORMAT_NDJSON); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Fatalf("dumped\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := dump(&buf, tx, FORMAT_JSON); err != nil {
+		t.Fatal(err)
+	}
+	var records []record
+	if err := json.Unmarshal(buf.Bytes(), &records); err != nil || len(records) != 7 {
+		t.Fatalf("json of %d records: %v\n%s", len(records), err, buf.String())
+	}
+	for _, r := range records {
+		bucket, key, value, at, err := r.decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again := newRecord(bucket, key, value, at); fmt.Sprint(again) != fmt.Sprint(r) {
+			t.Fatalf("record %+v decoded and encoded as %+v", r, again)
+		}
+	}
+}
+
+func TestRunDump(t *testing.T) {
+	db := openTestDB(t)
+	fillDumpTest(t, db, time.Now().Add(time.Hour))
+	db.Close()
+	out := filepath.Join(t.TempDir(), "dump.json")
+	if err := runDump([]string{"-format", "json", "-o", out, db.Path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runDump([]string{"-format", "xml", db.Path}); err == nil {
+		t.Fatal("dumped as xml")
+	}
+	if err := runDump([]string{filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Fatal("dumped a missing file")
+	}
+	var records []record
+	data, _ := os.ReadFile(out)
+	if err := json.Unmarshal(data, &records); err != nil || len(records) != 7 {
+		t.Fatalf("json of %d records: %v", len(records), err)
+	}
+}
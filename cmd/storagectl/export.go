@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"os"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func runExport(args []string) error {
+	fs := newFlags("export")
+	bucket := fs.String("bucket", "", "path of the bucket exported, names separated by a slash, the keys outside buckets if empty")
+	prefix := fs.String("prefix", "", "only the keys with the prefix")
+	start := fs.String("start", "", "the first key")
+	end := fs.String("end", "", "the key after the last")
+	output := fs.String("o", "", "write to a file instead of stdout")
+	args, err := parseFlags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	opts := storage.ExportOptions{Prefix: []byte(*prefix), Start: []byte(*start)}
+	if *bucket != "" {
+		opts.Bucket = bytes.Split([]byte(*bucket), []byte("/"))
+	}
+	if *end != "" {
+		opts.End = []byte(*end)
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	_, err = db.Export(out, opts)
+	if out != os.Stdout {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
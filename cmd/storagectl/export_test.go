@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunExport(t *testing.T) {
+	db := openTestDB(t)
+	fillDumpTest(t, db, time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC))
+	path := db.Path
+	db.Close()
+	out := filepath.Join(t.TempDir(), "out.ndjson")
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-start", "l"}, `{"key":"t","value":"v","expires":"2100-01-02T03:04:05Z"}` + "\n"},
+		{[]string{"-end", "l"}, `{"key":"k","value":"v"}` + "\n"},
+		{[]string{"-bucket", "users", "-prefix", "u"}, `{"key":"u1","value":"{\"n\":\"<x>\"}"}` + "\n"},
+		{[]string{"-bucket", "empty"}, ""},
+	} {
+		if err := runExport(append(c.args, "-o", out, path)); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(out); string(got) != c.want {
+			t.Errorf("export %v: %s, want %s", c.args, got, c.want)
+		}
+	}
+	if err := runExport([]string{"-bucket", "missing", "-o", out, path}); err == nil {
+		t.Fatal("export of a missing bucket")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func runHexdump(args []string) error {
+	fs := newFlags("hexdump")
+	args, err := parseFlags(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad page id %q", args[1])
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	page, err := db.ReadPage(id)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(w, "page %d, %d bytes\n", page.ID, len(page.Data))
+	for _, f := range page.Fields() {
+		hexdumpField(w, page.Data, f)
+	}
+	if page.Err != nil {
+		fmt.Fprintf(w, "error: %v\n", page.Err)
+	}
+	return w.Flush()
+}
+
+// the bytes of a field by rows of 16, annotated on the first one; a run of
+// zeros is a single line
+func hexdumpField(w io.Writer, data []byte, f storage.PageField) {
+	note := f.Name
+	if f.Value != "" {
+		note += " = " + f.Value
+	}
+	b := data[f.Start:f.End]
+	if len(b) > 16 && bytes.Count(b, []byte{0}) == len(b) {
+		fmt.Fprintf(w, "%04x  %-47s  %-18s  %s\n", f.Start, fmt.Sprintf("00 x %d", len(b)), "", note)
+		return
+	}
+	for off := 0; off < len(b); off += 16 {
+		row := b[off:min(off+16, len(b))]
+		var hex, ascii bytes.Buffer
+		for i, c := range row {
+			if i > 0 {
+				hex.WriteByte(' ')
+			}
+			fmt.Fprintf(&hex, "%02x", c)
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			ascii.WriteByte(c)
+		}
+		fmt.Fprintf(w, "%04x  %-47s  |%-16s|  %s\n", f.Start+off, hex.String(), ascii.String(), note)
+		note = ""
+	}
+}
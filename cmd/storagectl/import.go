@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// the imports of the source formats, more with build tags
+var importers = map[string]func(ctx context.Context, db *storage.DB, src string, progress func(storage.ImportProgress)) (storage.ImportProgress, error){
+	"bolt": func(ctx context.Context, db *storage.DB, src string, progress func(storage.ImportProgress)) (storage.ImportProgress, error) {
+		return db.ImportBolt(ctx, src, progress)
+	},
+}
+
+func runImport(args []string) error {
+	fs := newFlags("import")
+	from := fs.String("from", "", "format of the source: bolt, csv, tsv, or leveldb and badger when built with their tags")
+	rate := fs.Int64("rate", 0, "bytes of keys and values loaded per second at most, 0 for no limit")
+	merge := fs.Bool("merge", false, "import into an existing database, its keys are overwritten")
+	quiet := fs.Bool("q", false, "don't report the progress")
+	key := fs.String("key", "", "csv: columns of the keys, names or numbers from 1, separated by commas")
+	keySep := fs.String("key-sep", ":", "csv: separator of the columns of a key")
+	value := fs.String("value", "", "csv: column of the values, the other columns as JSON if empty")
+	delimiter := fs.String("delimiter", "", `csv: delimiter of the columns, "," or \t for tsv by default`)
+	header := fs.Bool("header", true, "csv: the first row names the columns")
+	bucket := fs.String("bucket", "", "csv: path of the bucket of the keys, names separated by a slash")
+	chunk := fs.Int("chunk", CSV_CHUNK_SIZE, "csv: bytes of rows sorted in memory")
+	args, err := parseFlags(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	run, ok := importers[*from]
+	if *from == "csv" || *from == "tsv" {
+		opts := csvOptions{delimiter: ',', header: *header, keys: splitColumns(*key), keySep: *keySep, value: *value, chunk: *chunk, rate: *rate}
+		if *from == "tsv" {
+			opts.delimiter = '\t'
+		}
+		if *delimiter != "" {
+			if opts.delimiter, err = parseDelimiter(*delimiter); err != nil {
+				return err
+			}
+		}
+		if len(opts.keys) == 0 {
+			return fmt.Errorf("-key is needed to import %s", *from)
+		}
+		if *bucket != "" {
+			opts.bucket = bytes.Split([]byte(*bucket), []byte("/"))
+		}
+		run, ok = func(ctx context.Context, db *storage.DB, src string, progress func(storage.ImportProgress)) (storage.ImportProgress, error) {
+			return importCSV(ctx, db, src, opts, progress)
+		}, true
+	}
+	if !ok {
+		return fmt.Errorf("unknown source format %q", *from)
+	}
+	if fi, err := os.Stat(args[1]); err == nil && fi.Size() > 0 && !*merge {
+		return fmt.Errorf("%s exists, use -merge to import into it", args[1])
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	db, err := openDB(args[1], false, storage.WithImportRate(*rate))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var progress func(storage.ImportProgress)
+	if !*quiet {
+		last := time.Now()
+		progress = func(p storage.ImportProgress) {
+			if time.Since(last) < PROGRESS_INTERVAL {
+				return
+			}
+			last = time.Now()
+			fmt.Fprintf(os.Stderr, "%d keys in %d buckets, %.1f%% of the source read\n", p.Keys, p.Buckets, percent(p.Read, p.Size))
+		}
+	}
+	p, err := run(ctx, db, args[0], progress)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d keys in %d buckets, %d bytes, in %v\n", p.Keys, p.Buckets, p.Bytes, p.Elapsed.Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build badger
+
+package main
+
+import (
+	"context"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func init() {
+	importers["badger"] = func(ctx context.Context, db *storage.DB, src string, progress func(storage.ImportProgress)) (storage.ImportProgress, error) {
+		return db.ImportBadger(ctx, src, progress)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build badger
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func TestRunImportBadger(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "badger")
+	bdb, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bdb.Update(func(txn *badger.Txn) error { return txn.Set([]byte("k"), []byte("v")) })
+	bdb.Close()
+	path := filepath.Join(t.TempDir(), "imported.db")
+	if err := runImport([]string{"-q", "-from", "badger", dir, path}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.Open(path, storage.WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, _, _ := db.Get([]byte("k")); string(v) != "v" {
+		t.Fatalf("k is %q", v)
+	}
+}
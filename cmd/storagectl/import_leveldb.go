@@ -0,0 +1,15 @@
+//go:build leveldb
+
+package main
+
+import (
+	"context"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func init() {
+	importers["leveldb"] = func(ctx context.Context, db *storage.DB, src string, progress func(storage.ImportProgress)) (storage.ImportProgress, error) {
+		return db.ImportLevelDB(ctx, src, progress)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build leveldb
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	storage "github.com/kevinjad/storage-engine"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestRunImportLevelDB(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "leveldb")
+	ldb, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldb.Put([]byte("k"), []byte("v"), nil)
+	ldb.Close()
+	path := filepath.Join(t.TempDir(), "imported.db")
+	if err := runImport([]string{"-q", "-from", "leveldb", dir, path}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.Open(path, storage.WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, _, _ := db.Get([]byte("k")); string(v) != "v" {
+		t.Fatalf("k is %q", v)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// a bbolt file of 3 pages, the bucket b holding k=v inline in the root
+func writeBoltTest(t *testing.T) string {
+	const page = storage.BOLT_DEFAULT_PAGE
+	file := make([]byte, 3*page)
+	for id := 0; id < 2; id++ {
+		p := file[id*page:]
+		binary.LittleEndian.PutUint64(p, uint64(id))
+		m := p[storage.BOLT_PAGE_HEADER:]
+		binary.LittleEndian.PutUint32(m, storage.BOLT_MAGIC)
+		binary.LittleEndian.PutUint32(m[4:], storage.BOLT_VERSION)
+		binary.LittleEndian.PutUint32(m[8:], page)
+		binary.LittleEndian.PutUint64(m[16:], 2) // root
+		binary.LittleEndian.PutUint64(m[40:], 3) // pages
+		binary.LittleEndian.PutUint64(m[48:], uint64(id))
+		h := fnv.New64a()
+		h.Write(m[:56])
+		binary.LittleEndian.PutUint64(m[56:], h.Sum64())
+	}
+	// the inline page of b: one leaf element k=v
+	inline := make([]byte, storage.BOLT_PAGE_HEADER+storage.BOLT_ELEMENT, 64)
+	binary.LittleEndian.PutUint16(inline[8:], storage.BOLT_LEAF_PAGE)
+	binary.LittleEndian.PutUint16(inline[10:], 1)
+	e := inline[storage.BOLT_PAGE_HEADER:]
+	binary.LittleEndian.PutUint32(e[4:], storage.BOLT_ELEMENT)
+	binary.LittleEndian.PutUint32(e[8:], 1)
+	binary.LittleEndian.PutUint32(e[12:], 1)
+	inline = append(inline, "kv"...)
+	value := append(make([]byte, storage.BOLT_BUCKET), inline...)
+
+	root := file[2*page:]
+	binary.LittleEndian.PutUint64(root, 2)
+	binary.LittleEndian.PutUint16(root[8:], storage.BOLT_LEAF_PAGE)
+	binary.LittleEndian.PutUint16(root[10:], 1)
+	e = root[storage.BOLT_PAGE_HEADER:]
+	binary.LittleEndian.PutUint32(e, storage.BOLT_BUCKET_LEAF)
+	binary.LittleEndian.PutUint32(e[4:], storage.BOLT_ELEMENT)
+	binary.LittleEndian.PutUint32(e[8:], 1)
+	binary.LittleEndian.PutUint32(e[12:], uint32(len(value)))
+	copy(e[storage.BOLT_ELEMENT:], append([]byte("b"), value...))
+
+	path := filepath.Join(t.TempDir(), "bolt.db")
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunImportBolt(t *testing.T) {
+	src := writeBoltTest(t)
+	path := filepath.Join(t.TempDir(), "imported.db")
+	if err := runImport([]string{"-q", "-from", "bolt", src, path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runImport([]string{"-q", "-from", "bolt", src, path}); err == nil || !strings.Contains(err.Error(), "-merge") {
+		t.Fatalf("import over a database: %v", err)
+	}
+	if err := runImport([]string{"-q", "-merge", "-from", "bolt", src, path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runImport([]string{"-from", "other", src, path}); err == nil || !strings.Contains(err.Error(), "unknown source format") {
+		t.Fatalf("import of another format: %v", err)
+	}
+	if err := runImport([]string{"-from", "bolt", path, filepath.Join(t.TempDir(), "x.db")}); err == nil {
+		t.Fatal("imported a database that isn't a bbolt file")
+	}
+	db, err := storage.Open(path, storage.WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	b, err := tx.Bucket([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := b.Get([]byte("k")); string(v) != "v" {
+		t.Fatalf("k of b is %q", v)
+	}
+}
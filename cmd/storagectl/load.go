@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+const PROGRESS_INTERVAL = time.Second
+
+func runLoad(args []string) error {
+	fs := newFlags("load")
+	format := fs.String("format", FORMAT_NDJSON, "ndjson or json")
+	input := fs.String("i", "", "read from a file instead of stdin")
+	merge := fs.Bool("merge", false, "load into an existing database, its keys are overwritten")
+	quiet := fs.Bool("q", false, "don't report the progress")
+	args, err := parseFlags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *format != FORMAT_NDJSON && *format != FORMAT_JSON {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if fi, err := os.Stat(args[0]); err == nil && fi.Size() > 0 && !*merge {
+		return fmt.Errorf("%s exists, use -merge to load into it", args[0])
+	}
+	in, size := os.Stdin, int64(0)
+	if *input != "" {
+		if in, err = os.Open(*input); err != nil {
+			return err
+		}
+		defer in.Close()
+		if fi, err := in.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	db, err := openDB(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	counter := &countingReader{r: in}
+	l := db.NewLoader(ctx)
+	var progress func()
+	if !*quiet {
+		start, last := time.Now(), time.Now()
+		progress = func() {
+			if time.Since(last) < PROGRESS_INTERVAL {
+				return
+			}
+			last = time.Now()
+			reportLoad(os.Stderr, l.Keys(), counter.n.Load(), size, time.Since(start))
+		}
+	}
+	err = load(bufio.NewReader(counter), *format, l, progress)
+	if cerr := l.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("after %d keys: %w", l.Keys(), err)
+	}
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "loaded %d keys\n", l.Keys())
+	}
+	return nil
+}
+
+func reportLoad(w io.Writer, keys, read, size int64, elapsed time.Duration) {
+	rate := float64(keys) / elapsed.Seconds()
+	if size > 0 {
+		fmt.Fprintf(w, "%d keys, %.1f%% of the input, %.0f keys/s\n", keys, 100*float64(read)/float64(size), rate)
+	} else {
+		fmt.Fprintf(w, "%d keys, %d bytes read, %.0f keys/s\n", keys, read, rate)
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// load the records of a dump, progress is called after each if not nil
+func load(r io.Reader, format string, l *storage.Loader, progress func()) error {
+	dec := json.NewDecoder(r)
+	if format == FORMAT_JSON {
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			if err == nil {
+				err = errors.New("not a JSON array")
+			}
+			return err
+		}
+	}
+	for n := 1; ; n++ {
+		if format == FORMAT_JSON && !dec.More() {
+			_, err := dec.Token() // the closing bracket
+			return err
+		}
+		var rec record
+		if err := dec.Decode(&rec); err == io.EOF && format == FORMAT_NDJSON {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		bucket, key, value, expires, err := rec.decode()
+		if err == nil && key == nil {
+			err = l.CreateBucket(bucket)
+		} else if err == nil {
+			err = l.SetWithExpiry(bucket, key, value, expires)
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		if progress != nil {
+			progress()
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a dump loaded then dumped again is the same
+func TestLoad(t *testing.T) {
+	db := openTestDB(t)
+	fillDumpTest(t, db, time.Now().Add(time.Hour))
+	db.Close()
+	dir := t.TempDir()
+	for _, format := range []string{FORMAT_NDJSON, FORMAT_JSON} {
+		dumped := filepath.Join(dir, "dump."+format)
+		if err := runDump([]string{"-format", format, "-o", dumped, db.Path}); err != nil {
+			t.Fatal(err)
+		}
+		loaded := filepath.Join(dir, "loaded-"+format+".db")
+		if err := runLoad([]string{"-q", "-format", format, "-i", dumped, loaded}); err != nil {
+			t.Fatal(err)
+		}
+		if err := runLoad([]string{"-q", "-format", format, "-i", dumped, loaded}); err == nil {
+			t.Fatal("loaded into an existing database without -merge")
+		}
+		if err := runLoad([]string{"-merge", "-q", "-format", format, "-i", dumped, loaded}); err != nil {
+			t.Fatal(err)
+		}
+		again := filepath.Join(dir, "again."+format)
+		if err := runDump([]string{"-format", format, "-o", again, loaded}); err != nil {
+			t.Fatal(err)
+		}
+		a, _ := os.ReadFile(dumped)
+		b, _ := os.ReadFile(again)
+		if string(a) != string(b) {
+			t.Fatalf("%s dumped\n%s\nthen\n%s", format, a, b)
+		}
+	}
+}
+
+func TestLoadBad(t *testing.T) {
+	for _, tt := range []struct {
+		format, input, err string
+	}{
+		{FORMAT_JSON, `{"key":"a"}`, "not a JSON array"},
+		{FORMAT_JSON, `[{"key":"a"}`, "unexpected end"},
+		{FORMAT_NDJSON, `{"key":"a"}` + "\n{", "record 2"},
+		{FORMAT_NDJSON, `{"value":"a"}`, "record 1: record without key nor bucket"},
+		{FORMAT_NDJSON, `{"key":"!","base64":true}`, "record 1: key"},
+		{FORMAT_NDJSON, `{"key":"a","expires":"soon"}`, "record 1: expires"},
+	} {
+		db := openTestDB(t)
+		l := db.NewLoader(context.Background())
+		err := load(strings.NewReader(tt.input), tt.format, l, nil)
+		l.Close()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("%s %q: %v, want %q", tt.format, tt.input, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Command storagectl works on the files of the storage engine.
+//
+//	storagectl <command> [flags] [args]
+//
+// Run storagectl help for the commands.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name  string
+	args  string
+	about string
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"shell", "[-readonly] <db>", "run commands on a database interactively", runShell},
+		{"dump", "[-format ndjson|json] [-o file] <db>", "write the buckets and keys of a database, in key order", runDump},
+		{"export", "[-bucket path] [-prefix p] [-start key] [-end key] [-o file] <db>", "write the keys of a bucket in a range as NDJSON, for jq and other tools", runExport},
+		{"load", "[-format ndjson|json] [-i file] [-merge] [-q] <db>", "build a database from a dump", runLoad},
+		{"page", "[-raw] <db> <id>...", "decode pages of the file: headers, keys and values", runPage},
+		{"hexdump", "<db> <id>", "print the bytes of a page, annotated with their fields", runHexdump},
+		{"dot", "[-o file] <db>", "draw the trees of a database for Graphviz: storagectl dot db | dot -Tsvg", runDOT},
+		{"check", "[-json] <db>", "check the pages of a database, exits with 1 on a problem", runCheck},
+		{"stats", "[-json] <db>", "print the space and activity of a database", runStats},
+		{"compact", "[-q] <db> <new db>", "copy the last commit of a database into a new file, without its free pages", runCompact},
+		{"sst", "[-bucket path] [-file-size n] [-bloom-bits n] <db> <dir>", "write the keys of a database as sorted SST files with an index and a Bloom filter", runSST},
+		{"parquet", "[-bucket path | -table name] [-strings] [-uncompressed] [-row-group-size n] <db> <file>", "write the keys of a database as a Parquet file of keys and values, or a table as its columns", runParquet},
+		{"sqlite", "[-strings] [-index] <db> <file>", "write the keys of a database into a SQLite file, a table for each bucket and each table of columns", runSQLite},
+		{"import", "-from bolt|leveldb|badger|csv|tsv [-rate n] [-merge] [-q] [-key cols] [-value col] [-bucket path] <source> <db>", "load the keys of a bbolt file, a LevelDB or Badger directory or a CSV file into a database", runImport},
+		{"backup", "[-endpoint url] [-region r] [-part-size n] [-since version] <db> s3://bucket/key | -from host:port <db>", "upload a backup of a database to an S3-compatible bucket, credentials from AWS_*, or copy the database of a server into one", runBackup},
+		{"restore", "[-endpoint url] [-region r] [-merge] [-since version] [-wal db [-to-version n] [-to-time t]] <db> s3://bucket/key...", "load a backup of storagectl backup, then the incremental ones after it and the commits of a WAL archive up to a point in time, into a database", runRestore},
+		{"bench", "[flags] [db]", "measure the throughput and latencies of reads and writes, on a temporary file by default", runBench},
+		{"help", "", "print this help", func([]string) error { usage(os.Stdout); return nil }},
+	}
+}
+
+func usage(w *os.File) {
+	fmt.Fprintln(w, "usage: storagectl <command> [flags] [args]\n\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n           %s\n", c.name, c.args, c.about)
+	}
+	fmt.Fprintln(w, "\nSTORAGE_KEY is the encryption key of the databases in hex, if encrypted,")
+	fmt.Fprintln(w, "or STORAGE_KEY_FILE the file holding it.")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		if err := c.run(os.Args[2:]); err != nil {
+			if err != flag.ErrHelp {
+				fmt.Fprintf(os.Stderr, "storagectl %s: %v\n", c.name, err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "storagectl: unknown command %q\n", os.Args[1])
+	usage(os.Stderr)
+	os.Exit(2)
+}
+
+// the flags of a command, parsing fails on a wrong number of args
+func parseFlags(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if n := fs.NArg(); n < min || max >= 0 && n > max {
+		fs.Usage()
+		return nil, fmt.Errorf("wrong number of arguments")
+	}
+	return fs.Args(), nil
+}
+
+// a flag set printing the usage of the command
+func newFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		for _, c := range commands {
+			if c.name == name {
+				fmt.Fprintf(fs.Output(), "usage: storagectl %s %s\n", c.name, c.args)
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func runPage(args []string) error {
+	fs := newFlags("page")
+	raw := fs.Bool("raw", false, "print the hexdump of the whole page too")
+	args, err := parseFlags(fs, args, 2, -1)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, arg := range args[1:] {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad page id %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for i, id := range ids {
+		page, err := db.ReadPage(id)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		printPage(w, page, db.Info())
+		if *raw || page.Err != nil {
+			fmt.Fprintf(w, "raw:\n%s", indent(hex.Dump(page.Data), "  "))
+		}
+	}
+	return nil
+}
+
+// print the headers and keys of a page, values as hexdumps
+func printPage(w io.Writer, page storage.Page, info storage.Info) {
+	switch {
+	case page.ID == 0:
+		fmt.Fprintf(w, "page 0: meta, format %d, page size %d, id %s\n", info.FormatVersion, info.PageSize, info.ID)
+	case page.Type == storage.BNODE_FREE:
+		fmt.Fprintf(w, "page %d: free list, %d pointers, next %s\n", page.ID, len(page.Free), freeNext(page.Next))
+		for i, ptr := range page.Free {
+			fmt.Fprintf(w, "  %4d  page %d\n", i, ptr)
+		}
+	case page.Type == storage.BNODE_NODE || page.Type == storage.BNODE_LEAF:
+		kind := "node"
+		if page.Type == storage.BNODE_LEAF {
+			kind = "leaf"
+		}
+		fmt.Fprintf(w, "page %d: %s, %d keys, %d of %d bytes used\n", page.ID, kind, len(page.Keys), page.Used, len(page.Data))
+		for i, k := range page.Keys {
+			fmt.Fprintf(w, "  %4d  offset %-5d", i, k.Offset)
+			if page.Type == storage.BNODE_NODE {
+				fmt.Fprintf(w, " page %-8d", k.Pointer)
+			}
+			fmt.Fprintf(w, " key %s", quote(k.Key))
+			if page.Type == storage.BNODE_LEAF {
+				fmt.Fprintf(w, ", value of %d bytes", len(k.Value))
+			}
+			fmt.Fprintln(w)
+			if len(k.Value) > 0 {
+				fmt.Fprint(w, indent(hex.Dump(k.Value), "        "))
+			}
+		}
+	default:
+		fmt.Fprintf(w, "page %d: unknown type %d\n", page.ID, page.Type)
+	}
+	if page.Err != nil {
+		fmt.Fprintf(w, "error: %v\n", page.Err)
+	}
+}
+
+func freeNext(next uint64) string {
+	if next == 0 {
+		return "none"
+	}
+	return strconv.FormatUint(next, 10)
+}
+
+// indent each line of s
+func indent(s string, prefix string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func TestPrintPage(t *testing.T) {
+	info := storage.Info{FormatVersion: 3, PageSize: 4096}
+	for _, tt := range []struct {
+		page storage.Page
+		want string
+	}{
+		{storage.Page{}, "page 0: meta, format 3, page size 4096, id 00000000-0000-0000-0000-000000000000\n"},
+		{storage.Page{ID: 7, Type: storage.BNODE_FREE, Free: []uint64{4, 5}},
+			"page 7: free list, 2 pointers, next none\n     0  page 4\n     1  page 5\n"},
+		{storage.Page{ID: 2, Type: storage.BNODE_NODE, Data: make([]byte, 4096), Used: 60, Keys: []storage.PageKey{
+			{Pointer: 9, Key: []byte{}}, {Pointer: 10, Offset: 4, Key: []byte("k 1")}}},
+			"page 2: node, 2 keys, 60 of 4096 bytes used\n" +
+				`     0  offset 0     page 9        key ""` + "\n" +
+				`     1  offset 4     page 10       key "k 1"` + "\n"},
+		{storage.Page{ID: 3, Type: storage.BNODE_LEAF, Data: make([]byte, 4096), Used: 40, Keys: []storage.PageKey{
+			{Key: []byte("a"), Value: []byte("xyz")}}},
+			"page 3: leaf, 1 keys, 40 of 4096 bytes used\n     0  offset 0     key a, value of 3 bytes\n" +
+				"        00000000  78 79 7a                                          |xyz|\n"},
+		{storage.Page{ID: 4, Type: 9, Err: errors.New("bad")}, "page 4: unknown type 9\nerror: bad\n"},
+	} {
+		var buf bytes.Buffer
+		printPage(&buf, tt.page, info)
+		if buf.String() != tt.want {
+			t.Fatalf("printed\n%q\nwant\n%q", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestRunPage(t *testing.T) {
+	db := openTestDB(t)
+	db.Set([]byte("a"), []byte("b"))
+	db.Checkpoint()
+	db.Close()
+	if err := runPage([]string{db.Path, "0", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runPage([]string{db.Path, "x"}); err == nil || !strings.Contains(err.Error(), "bad page id") {
+		t.Fatalf("page x: %v", err)
+	}
+	if err := runPage([]string{db.Path, "1000"}); err == nil {
+		t.Fatal("page past the end printed")
+	}
+	if err := runPage([]string{db.Path}); err == nil {
+		t.Fatal("no page id")
+	}
+}
+
+func TestHexdumpField(t *testing.T) {
+	data := append([]byte("\x01\x00abcdefghijklmnopqrstuvwxyz"), make([]byte, 40)...)
+	var buf bytes.Buffer
+	for _, f := range []storage.PageField{{Start: 0, End: 2, Name: "type", Value: "node"},
+		{Start: 2, End: 28, Name: "key 0"}, {Start: 28, End: 68, Name: "unused"}} {
+		hexdumpField(&buf, data, f)
+	}
+	want := "0000  01 00                                            |..              |  type = node\n" +
+		"0002  61 62 63 64 65 66 67 68 69 6a 6b 6c 6d 6e 6f 70  |abcdefghijklmnop|  key 0\n" +
+		"0012  71 72 73 74 75 76 77 78 79 7a                    |qrstuvwxyz      |  \n" +
+		"001c  00 x 40                                                              unused\n"
+	if buf.String() != want {
+		t.Fatalf("dumped\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestRunHexdump(t *testing.T) {
+	db := openTestDB(t)
+	db.Set([]byte("a"), []byte("b"))
+	db.Checkpoint()
+	db.Close()
+	if err := runHexdump([]string{db.Path, "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runHexdump([]string{db.Path, "x"}); err == nil {
+		t.Fatal("bad page id dumped")
+	}
+	if err := runHexdump([]string{db.Path, "1000"}); err == nil {
+		t.Fatal("page past the end dumped")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func runParquet(args []string) error {
+	fs := newFlags("parquet")
+	bucket := fs.String("bucket", "", "path of the bucket exported, names separated by a slash, the keys outside buckets if empty")
+	table := fs.String("table", "", "table exported as its typed columns, instead of a bucket")
+	strs := fs.Bool("strings", false, "write the keys and values as UTF-8 strings instead of bytes")
+	uncompressed := fs.Bool("uncompressed", false, "don't compress the pages with gzip")
+	rowGroup := fs.Int64("row-group-size", storage.PARQUET_ROW_GROUP_SIZE, "bytes of keys and values of a row group, held in memory")
+	args, err := parseFlags(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	opts := storage.ParquetOptions{Table: *table, Strings: *strs, Uncompressed: *uncompressed, RowGroupSize: *rowGroup}
+	if *bucket != "" {
+		opts.Bucket = bytes.Split([]byte(*bucket), []byte("/"))
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	out, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	var rows int64
+	err = db.View(func(tx *storage.Tx) error {
+		rows, err = tx.ExportParquet(w, opts)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(args[1])
+		return err
+	}
+	fmt.Printf("wrote %d rows to %s\n", rows, args[1])
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func TestRunParquet(t *testing.T) {
+	db := openTestDB(t)
+	fillDumpTest(t, db, time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC))
+	if _, err := db.Exec("CREATE TABLE t (id INT PRIMARY KEY, v TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO t VALUES (1, 'x')"); err != nil {
+		t.Fatal(err)
+	}
+	path := db.Path
+	db.Close()
+	out := filepath.Join(t.TempDir(), "users.parquet")
+	if err := runParquet([]string{"-bucket", "users", "-strings", path, out}); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(file); n < 12 || string(file[:4]) != storage.PARQUET_MAGIC || string(file[n-4:]) != storage.PARQUET_MAGIC {
+		t.Fatalf("file of %d bytes without the magic", n)
+	}
+	// a table as its columns
+	if err := runParquet([]string{"-table", "t", path, out}); err != nil {
+		t.Fatal(err)
+	}
+	if table, err := os.ReadFile(out); err != nil || !bytes.Contains(table, []byte("id")) || bytes.Equal(table, file) {
+		t.Fatalf("file of the table: %v", err)
+	}
+	// a failed export leaves no file
+	if err := runParquet([]string{"-bucket", "missing", path, out}); err == nil {
+		t.Fatal("export of a missing bucket")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("file of a failed export: %v", err)
+	}
+}
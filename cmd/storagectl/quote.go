@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Keys and values on the command line are taken as they are, or quoted
+// with the escapes of Go strings for binary ones: "a\x00b". Those printed
+// are quoted the same way unless they're plain words, so that they can be
+// pasted back.
+
+// split a line in words, a quoted word may have spaces
+func splitWords(line string) ([]string, error) {
+	var words []string
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" {
+			return words, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexFunc(line, unicode.IsSpace)
+			if end < 0 {
+				end = len(line)
+			}
+			words = append(words, line[:end])
+			line = line[end:]
+			continue
+		}
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return nil, fmt.Errorf("unterminated quote")
+		}
+		word, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("bad quoted string %s: %w", line[:end+1], err)
+		}
+		words = append(words, word)
+		line = line[end+1:]
+	}
+}
+
+// print bytes as a word, quoted unless it's printable without spaces
+func quote(b []byte) string {
+	if len(b) == 0 {
+		return `""`
+	}
+	for s := string(b); s != ""; {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError || r == '"' || r == '\\' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(string(b))
+		}
+		s = s[size:]
+	}
+	return string(b)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	for _, tt := range []struct {
+		line  string
+		words string
+	}{
+		{"", "[]"},
+		{"  get  a ", `["get" "a"]`},
+		{`set "a b" "\x00\"c"`, `["set" "a b" "\x00\"c"]`},
+		{`set a"b c`, `["set" "a\"b" "c"]`},
+		{`get ""`, `["get" ""]`},
+	} {
+		words, err := splitWords(tt.line)
+		if err != nil || fmt.Sprintf("%q", words) != tt.words {
+			t.Fatalf("split %q: %q %v, want %s", tt.line, words, err, tt.words)
+		}
+	}
+	for _, line := range []string{`get "a`, `get "a\"`, `get "\q"`} {
+		if words, err := splitWords(line); err == nil {
+			t.Fatalf("split %q: %q", line, words)
+		}
+	}
+}
+
+// the words printed are split back the same
+func TestQuote(t *testing.T) {
+	for _, b := range []string{"a", "", "a b", "\x00\xff", `a"b`, `a\b`, "é", "\u200b"} {
+		q := quote([]byte(b))
+		words, err := splitWords(q)
+		if err != nil || len(words) != 1 || words[0] != b {
+			t.Fatalf("%q quoted as %s split as %q %v", b, q, words, err)
+		}
+	}
+	if q := quote([]byte("plain")); q != "plain" {
+		t.Fatalf("plain word quoted %s", q)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// record is a line of a dump: a key and its value, or a bucket if Key is
+// empty. The names of the bucket, the key and the value are text, or all
+// base64 if one of them isn't UTF-8.
+type record struct {
+	Bucket  []string `json:"bucket,omitempty"` // the names from the top
+	Key     string   `json:"key,omitempty"`
+	Value   string   `json:"value,omitempty"`
+	Expires string   `json:"expires,omitempty"` // RFC 3339
+	Base64  bool     `json:"base64,omitempty"`
+}
+
+func newRecord(bucket [][]byte, key, value []byte, expires time.Time) record {
+	text := utf8.Valid(key) && utf8.Valid(value)
+	for _, name := range bucket {
+		text = text && utf8.Valid(name)
+	}
+	encode := func(b []byte) string {
+		if text {
+			return string(b)
+		}
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	r := record{Key: encode(key), Value: encode(value), Base64: !text}
+	for _, name := range bucket {
+		r.Bucket = append(r.Bucket, encode(name))
+	}
+	if !expires.IsZero() {
+		r.Expires = expires.Format(time.RFC3339Nano)
+	}
+	return r
+}
+
+// the bucket, key and value of a record, a nil key for a bucket
+func (r record) decode() (bucket [][]byte, key, value []byte, expires time.Time, err error) {
+	decode := func(s string) ([]byte, error) {
+		if !r.Base64 {
+			return []byte(s), nil
+		}
+		return base64.StdEncoding.DecodeString(s)
+	}
+	for _, name := range r.Bucket {
+		b, err := decode(name)
+		if err != nil {
+			return nil, nil, nil, expires, fmt.Errorf("bucket name: %w", err)
+		}
+		bucket = append(bucket, b)
+	}
+	if r.Key == "" {
+		if len(bucket) == 0 {
+			return nil, nil, nil, expires, fmt.Errorf("record without key nor bucket")
+		}
+		return bucket, nil, nil, expires, nil
+	}
+	if key, err = decode(r.Key); err != nil {
+		return nil, nil, nil, expires, fmt.Errorf("key: %w", err)
+	}
+	if value, err = decode(r.Value); err != nil {
+		return nil, nil, nil, expires, fmt.Errorf("value: %w", err)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	if r.Expires != "" {
+		if expires, err = time.Parse(time.RFC3339Nano, r.Expires); err != nil {
+			return nil, nil, nil, expires, fmt.Errorf("expires: %w", err)
+		}
+	}
+	return bucket, key, value, expires, nil
+}
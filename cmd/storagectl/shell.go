@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+const shellHelp = `commands:
+  get <key>                 print the value of a key
+  set <key> <value>         set a key
+  del <key>                 delete a key
+  scan [<start> [<end>]]    print the keys from start, up to end excluded
+  prefix <prefix>           print the keys starting with prefix
+  stats                     print the statistics of the database
+  begin                     start a writable transaction, the commands run in it
+  commit                    commit the transaction
+  rollback                  discard the transaction
+  help                      print this help
+  exit                      leave, rolling back the transaction
+Keys and values with spaces or binary bytes are quoted like Go strings: "a\x00b".
+`
+
+type shell struct {
+	db  *storage.DB
+	tx  *storage.Tx // the transaction begun, nil if none
+	out io.Writer
+}
+
+func runShell(args []string) error {
+	fs := newFlags("shell")
+	readOnly := fs.Bool("readonly", false, "open the database read-only")
+	args, err := parseFlags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(args[0], *readOnly)
+	if err != nil {
+		return err
+	}
+	sh := &shell{db: db, out: os.Stdout}
+	defer func() {
+		if sh.tx != nil {
+			sh.tx.Rollback()
+		}
+		db.Close()
+	}()
+	return sh.run(os.Stdin, isTerminal(os.Stdin))
+}
+
+// open a database with the encryption key of STORAGE_KEY if set, in hex,
+// or else of the file STORAGE_KEY_FILE
+func openDB(path string, readOnly bool, opts ...storage.Option) (*storage.DB, error) {
+	if readOnly {
+		opts = append(opts, storage.WithReadOnly())
+	}
+	if os.Getenv("STORAGE_KEY") != "" {
+		opts = append(opts, storage.WithKeyProvider(storage.EnvKey("STORAGE_KEY")))
+	} else if file := os.Getenv("STORAGE_KEY_FILE"); file != "" {
+		opts = append(opts, storage.WithKeyProvider(storage.FileKey(file)))
+	}
+	return storage.Open(path, opts...)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// run the commands of the input until its end, errors are printed unless
+// the input isn't interactive: the first one stops the run
+func (sh *shell) run(in io.Reader, interactive bool) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1<<20)
+	for {
+		if interactive {
+			prompt := "> "
+			if sh.tx != nil {
+				prompt = "tx> "
+			}
+			fmt.Fprint(sh.out, prompt)
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		words, err := splitWords(scanner.Text())
+		if err == nil && len(words) > 0 {
+			if words[0] == "exit" || words[0] == "quit" {
+				return nil
+			}
+			err = sh.exec(words[0], words[1:])
+		}
+		if err != nil {
+			if !interactive {
+				return err
+			}
+			fmt.Fprintln(sh.out, "error:", err)
+		}
+	}
+}
+
+func (sh *shell) exec(cmd string, args []string) error {
+	want := func(min, max int) error {
+		if len(args) < min || len(args) > max {
+			return fmt.Errorf("%s: wrong number of arguments, see help", cmd)
+		}
+		return nil
+	}
+	switch cmd {
+	case "get":
+		if err := want(1, 1); err != nil {
+			return err
+		}
+		return sh.view(func(tx *storage.Tx) error {
+			value, ok, err := tx.Get([]byte(args[0]))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("%s: not found", quote([]byte(args[0])))
+			}
+			fmt.Fprintln(sh.out, quote(value))
+			return nil
+		})
+	case "set":
+		if err := want(2, 2); err != nil {
+			return err
+		}
+		return sh.update(func(tx *storage.Tx) error {
+			return tx.Set([]byte(args[0]), []byte(args[1]))
+		})
+	case "del":
+		if err := want(1, 1); err != nil {
+			return err
+		}
+		return sh.update(func(tx *storage.Tx) error {
+			deleted, err := tx.Del([]byte(args[0]))
+			if err == nil && !deleted {
+				err = fmt.Errorf("%s: not found", quote([]byte(args[0])))
+			}
+			return err
+		})
+	case "scan":
+		if err := want(0, 2); err != nil {
+			return err
+		}
+		var start, end []byte
+		if len(args) > 0 {
+			start = []byte(args[0])
+		}
+		if len(args) > 1 {
+			end = []byte(args[1])
+		}
+		return sh.scan(start, func(key []byte) bool {
+			return end == nil || bytes.Compare(key, end) < 0
+		})
+	case "prefix":
+		if err := want(1, 1); err != nil {
+			return err
+		}
+		prefix := []byte(args[0])
+		return sh.scan(prefix, func(key []byte) bool {
+			return bytes.HasPrefix(key, prefix)
+		})
+	case "stats":
+		if err := want(0, 0); err != nil {
+			return err
+		}
+		printStats(sh.out, sh.db.Stats())
+		return nil
+	case "begin":
+		if err := want(0, 0); err != nil {
+			return err
+		}
+		if sh.tx != nil {
+			return errors.New("a transaction is running already")
+		}
+		tx, err := sh.db.Begin(true)
+		if err != nil {
+			return err
+		}
+		sh.tx = tx
+		return nil
+	case "commit", "rollback":
+		if err := want(0, 0); err != nil {
+			return err
+		}
+		if sh.tx == nil {
+			return errors.New("no transaction")
+		}
+		tx := sh.tx
+		sh.tx = nil
+		if cmd == "rollback" {
+			return tx.Rollback()
+		}
+		return tx.Commit()
+	case "help":
+		fmt.Fprint(sh.out, shellHelp)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, see help", cmd)
+	}
+}
+
+// run fn in the transaction begun, or in a read-only one
+func (sh *shell) view(fn func(tx *storage.Tx) error) error {
+	if sh.tx != nil {
+		return fn(sh.tx)
+	}
+	return sh.db.View(fn)
+}
+
+// run fn in the transaction begun, or in one committed right away
+func (sh *shell) update(fn func(tx *storage.Tx) error) error {
+	if sh.tx != nil {
+		return fn(sh.tx)
+	}
+	tx, err := sh.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// print the keys from start while in is true for them
+func (sh *shell) scan(start []byte, in func(key []byte) bool) error {
+	return sh.view(func(tx *storage.Tx) error {
+		c := tx.Cursor()
+		n := 0
+		for key, value := c.Seek(start); key != nil && in(key); key, value = c.Next() {
+			fmt.Fprintf(sh.out, "%s %s\n", quote(key), quote(value))
+			n++
+		}
+		if err := c.Err(); err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "(%d keys)\n", n)
+		return nil
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// open a database in a directory of the test, closed when it's over
+func openTestDB(t *testing.T, opts ...storage.Option) *storage.DB {
+	t.Helper()
+	db, err := storage.Open(filepath.Join(t.TempDir(), "test.db"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil && !errors.Is(err, storage.ErrDBClosed) {
+			t.Error(err)
+		}
+	})
+	return db
+}
+
+// run the commands in a shell, returning what it printed
+func runShellTest(t *testing.T, db *storage.DB, interactive bool, commands string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	sh := &shell{db: db, out: &out}
+	err := sh.run(strings.NewReader(commands), interactive)
+	if sh.tx != nil {
+		sh.tx.Rollback()
+	}
+	return out.String(), err
+}
+
+func TestShell(t *testing.T) {
+	db := openTestDB(t)
+	out, err := runShellTest(t, db, false, `
+set a 1
+set "b c" "x\x00y"
+set bb 2
+get "b c"
+scan
+scan b bc
+prefix b
+del a
+get bb
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `"x\x00y"
+a 1
+"b c" "x\x00y"
+bb 2
+(3 keys)
+"b c" "x\x00y"
+bb 2
+(2 keys)
+"b c" "x\x00y"
+bb 2
+(2 keys)
+2
+`
+	if out != want {
+		t.Fatalf("printed\n%s\nwant\n%s", out, want)
+	}
+	if _, ok, _ := db.Get([]byte("a")); ok {
+		t.Fatal("a not deleted")
+	}
+}
+
+func TestShellTx(t *testing.T) {
+	db := openTestDB(t)
+	out, err := runShellTest(t, db, true, "begin\nset a 1\nget a\nrollback\nget a\nbegin\nbegin\nset b 2\ncommit\ncommit\nexit\nset c 3\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "> tx> tx> 1\ntx> > error: a: not found\n> tx> error: a transaction is running already\ntx> tx> > error: no transaction\n> "
+	if out != want {
+		t.Fatalf("printed %q, want %q", out, want)
+	}
+	if v, _, _ := db.Get([]byte("b")); string(v) != "2" {
+		t.Fatalf("b is %q", v)
+	}
+	if _, ok, _ := db.Get([]byte("c")); ok {
+		t.Fatal("command run after exit")
+	}
+}
+
+// the first error stops a shell reading a file
+func TestShellError(t *testing.T) {
+	db := openTestDB(t)
+	for _, commands := range []string{"get\n", "nope\n", "set \"a\n", "del missing\n"} {
+		if _, err := runShellTest(t, db, false, commands+"set a 1\n"); err == nil {
+			t.Fatalf("%q ran", commands)
+		}
+	}
+	if _, ok, _ := db.Get([]byte("a")); ok {
+		t.Fatal("command run after an error")
+	}
+	out, _ := runShellTest(t, db, false, "help\n")
+	if out != shellHelp {
+		t.Fatalf("help %q", out)
+	}
+}
+
+// the key of STORAGE_KEY, or else of the file of STORAGE_KEY_FILE
+func TestOpenDBKey(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	path := filepath.Join(t.TempDir(), "test.db")
+	t.Setenv("STORAGE_KEY", key)
+	db, err := openDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.Info().Encrypted {
+		t.Fatal("not encrypted with STORAGE_KEY")
+	}
+	db.Close()
+
+	file := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(file, []byte(key), 0o600)
+	t.Setenv("STORAGE_KEY", "")
+	t.Setenv("STORAGE_KEY_FILE", file)
+	if db, err = openDB(path, true); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	t.Setenv("STORAGE_KEY_FILE", "")
+	if db, err := openDB(path, false); !errors.Is(err, storage.ErrEncryptionKey) {
+		if db != nil {
+			db.Close()
+		}
+		t.Fatalf("open without a key: %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func runSQLite(args []string) error {
+	fs := newFlags("sqlite")
+	strs := fs.Bool("strings", false, "make the key and value columns of the buckets TEXT instead of BLOB")
+	index := fs.Bool("index", false, "add a unique index of the keys of each bucket")
+	args, err := parseFlags(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	start := time.Now()
+	err = db.View(func(tx *storage.Tx) error {
+		return tx.ExportSQLite(args[1], storage.SQLiteOptions{Strings: *strs, Index: *index})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s in %v\n", args[1], time.Since(start).Round(time.Millisecond))
+	return nil
+}
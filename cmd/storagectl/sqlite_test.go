@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func TestRunSQLite(t *testing.T) {
+	db := openTestDB(t)
+	fillDumpTest(t, db, time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC))
+	path := db.Path
+	db.Close()
+	out := filepath.Join(t.TempDir(), "dump.sqlite")
+	if err := runSQLite([]string{"-strings", "-index", path, out}); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file) < storage.SQLITE_PAGE_SIZE || string(file[:16]) != storage.SQLITE_MAGIC {
+		t.Fatalf("file of %d bytes without the magic", len(file))
+	}
+	if err := runSQLite([]string{path, out}); !os.IsExist(err) {
+		t.Fatalf("export over a file: %v", err)
+	}
+}
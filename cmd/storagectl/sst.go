@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func runSST(args []string) error {
+	fs := newFlags("sst")
+	bucket := fs.String("bucket", "", "path of the bucket exported, names separated by a slash, the keys outside buckets if empty")
+	fileSize := fs.Int64("file-size", storage.SST_FILE_SIZE, "bytes of a file before the next one")
+	bloomBits := fs.Int("bloom-bits", storage.SST_BLOOM_BITS, "bits of the Bloom filter per key, none if negative")
+	args, err := parseFlags(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	opts := storage.SSTOptions{FileSize: *fileSize, BloomBits: *bloomBits}
+	if *bucket != "" {
+		opts.Bucket = bytes.Split([]byte(*bucket), []byte("/"))
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var files []string
+	err = db.View(func(tx *storage.Tx) error {
+		files, err = tx.ExportSST(args[1], opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%d bytes\n", f, fi.Size())
+	}
+	return nil
+}
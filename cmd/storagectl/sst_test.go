@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func TestRunSST(t *testing.T) {
+	db := openTestDB(t)
+	fillDumpTest(t, db, time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC))
+	path := db.Path
+	db.Close()
+	dir := t.TempDir()
+	for _, c := range []struct {
+		bucket, key, value string
+	}{
+		{"", "k", "v"},
+		{"users", "u1", `{"n":"<x>"}`},
+	} {
+		out := filepath.Join(dir, c.bucket+"out")
+		if err := runSST([]string{"-bucket", c.bucket, "-bloom-bits", "-1", path, out}); err != nil {
+			t.Fatal(err)
+		}
+		files, _ := filepath.Glob(filepath.Join(out, "*.sst"))
+		if len(files) != 1 {
+			t.Fatalf("files %v of %q", files, c.bucket)
+		}
+		r, err := storage.OpenSST(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, ok, err := r.Get([]byte(c.key)); string(v) != c.value || !ok || err != nil {
+			t.Fatalf("%s of %q = %q %v %v", c.key, c.bucket, v, ok, err)
+		}
+		r.Close()
+	}
+	if err := runSST([]string{"-bucket", "missing", path, dir}); err == nil {
+		t.Fatal("export of a missing bucket")
+	}
+	if err := runSST([]string{path}); err == nil {
+		t.Fatal("sst without a directory")
+	}
+}
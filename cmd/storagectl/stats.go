@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func runStats(args []string) error {
+	fs := newFlags("stats")
+	asJSON := fs.Bool("json", false, "print the statistics as JSON")
+	args, err := parseFlags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var r statsReport
+	r.Path, r.Info, r.Stats = args[0], db.Info(), db.Stats()
+	err = db.View(func(tx *storage.Tx) error {
+		r.Version = tx.Version()
+		if r.Usage, err = tx.Usage(); err != nil {
+			return err
+		}
+		r.Trees, err = tx.TreeStats()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r.json())
+	}
+	r.print(os.Stdout)
+	return nil
+}
+
+// what stats prints
+type statsReport struct {
+	Path    string
+	Version uint64
+	Info    storage.Info
+	Stats   storage.Stats
+	Usage   storage.Usage
+	Trees   storage.TreeStats
+}
+
+// the histograms summed up, the durations in nanoseconds
+type jsonLatency struct {
+	Count uint64
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+func latencySummary(h storage.Histogram) jsonLatency {
+	return jsonLatency{h.Count, h.Mean(), h.Quantile(0.5), h.Quantile(0.9), h.Quantile(0.99)}
+}
+
+type jsonBucket struct {
+	Path []string
+	storage.TreeUsage
+}
+
+// the report for JSON, the fields that don't print as they are replaced by
+// those at a lesser depth
+func (r statsReport) json() any {
+	type info struct {
+		storage.Info
+		ID string
+	}
+	type stats struct {
+		storage.Stats
+		SyncPolicy    string
+		CacheHitRate  float64
+		CommitLatency jsonLatency
+		GetLatency    jsonLatency
+		SetLatency    jsonLatency
+		SyncLatency   jsonLatency
+	}
+	type usage struct {
+		storage.Usage
+		Buckets []jsonBucket
+	}
+	s := r.Stats
+	u := usage{Usage: r.Usage, Buckets: []jsonBucket{}}
+	for _, b := range r.Usage.Buckets {
+		path := make([]string, len(b.Path))
+		for i, name := range b.Path {
+			path[i] = string(name)
+		}
+		u.Buckets = append(u.Buckets, jsonBucket{path, b.TreeUsage})
+	}
+	return struct {
+		Path    string
+		Version uint64
+		Info    info
+		Stats   stats
+		Usage   usage
+		Trees   storage.TreeStats
+	}{
+		r.Path, r.Version,
+		info{r.Info, r.Info.ID.String()},
+		stats{s, s.SyncPolicy.String(), s.CacheHitRate(), latencySummary(s.CommitLatency),
+			latencySummary(s.GetLatency), latencySummary(s.SetLatency), latencySummary(s.SyncLatency)},
+		u, r.Trees,
+	}
+}
+
+func (r statsReport) print(w io.Writer) {
+	info, s, u, t := r.Info, r.Stats, r.Usage, r.Trees
+	comparator := info.Comparator
+	if comparator == "" {
+		comparator = "bytes"
+	}
+	pages := func(n int64) string {
+		return fmt.Sprintf("%d (%s)", n, formatBytes(n*int64(s.PageSize)))
+	}
+	printSection(w, "database", [][2]string{
+		{"path", r.Path},
+		{"id", info.ID.String()},
+		{"format", fmt.Sprint(info.FormatVersion)},
+		{"version", fmt.Sprint(r.Version)},
+		{"comparator", comparator},
+		{"created", fmt.Sprintf("%s by %s", info.Created.Format(time.RFC3339), info.CreatedBy)},
+	})
+	printSection(w, "pages", [][2]string{
+		{"page size", formatBytes(int64(s.PageSize))},
+		{"file", pages(int64(u.FilePages))},
+		{"free", pages(int64(u.FreePages))},
+		{"free list", pages(int64(s.FreeListPages))},
+		{"other", pages(u.OtherPages)},
+		{"fragmented", formatBytes(u.Fragmented)},
+	})
+	printSection(w, "trees", [][2]string{
+		{"height", fmt.Sprint(t.Height)},
+		{"branch pages", fmt.Sprint(t.BranchPages)},
+		{"leaf pages", fmt.Sprint(t.LeafPages)},
+		{"fill factor", fmt.Sprintf("%.1f%%", 100*t.FillFactor)},
+		{"keys", fmt.Sprintf("%d, %s in %s", u.Keys.Keys, formatBytes(u.Keys.Bytes), pages(u.Keys.Pages))},
+		{"buckets", fmt.Sprintf("%d, %d keys in %s", t.Buckets, t.BucketKeys, pages(int64(t.BucketPages)))},
+	})
+	if len(u.Buckets) > 0 {
+		var rows [][2]string
+		for _, b := range u.Buckets {
+			names := make([]string, len(b.Path))
+			for i, name := range b.Path {
+				names[i] = quote(name)
+			}
+			rows = append(rows, [2]string{strings.Join(names, "/"),
+				fmt.Sprintf("%d keys, %s in %s", b.Keys, formatBytes(b.Bytes), pages(b.Pages))})
+		}
+		printSection(w, "buckets", rows)
+	}
+	printSection(w, "wal", [][2]string{
+		{"size", formatBytes(s.WALSize)},
+		{"sync policy", s.SyncPolicy.String()},
+		{"unsynced", fmt.Sprintf("%d commits", s.Unsynced)},
+	})
+	printStats(w, s)
+}
+
+// the counters since Open, for the shell too
+func printStats(w io.Writer, s storage.Stats) {
+	printSection(w, "activity", [][2]string{
+		{"commits", fmt.Sprint(s.Commits)},
+		{"wal syncs", fmt.Sprintf("%d, last of %d commits, largest of %d", s.WALSyncs, s.LastBatch, s.LargestBatch)},
+		{"cached pages", fmt.Sprint(s.CachedPages)},
+		{"cache hit rate", fmt.Sprintf("%.1f%% of %d reads", 100*s.CacheHitRate(), s.CacheHits+s.CacheMisses)},
+		{"page reads", fmt.Sprintf("%d, %d read ahead", s.PageReads, s.ReadAhead)},
+		{"page writes", fmt.Sprintf("%d, %d flushed", s.PageWrites, s.FlushedPages)},
+		{"scrubbed pages", fmt.Sprintf("%d, %d bad", s.ScrubbedPages, s.BadPages)},
+	})
+	var rows [][2]string
+	for _, h := range []struct {
+		name string
+		h    storage.Histogram
+	}{{"commit", s.CommitLatency}, {"get", s.GetLatency}, {"set", s.SetLatency}, {"fsync", s.SyncLatency}} {
+		if h.h.Count > 0 {
+			rows = append(rows, [2]string{h.name, fmt.Sprintf("%d, mean %v, p50 %v, p99 %v",
+				h.h.Count, h.h.Mean().Round(time.Microsecond), h.h.Quantile(0.5), h.h.Quantile(0.99))})
+		}
+	}
+	if len(rows) > 0 {
+		printSection(w, "latency", rows)
+	}
+}
+
+func printSection(w io.Writer, title string, rows [][2]string) {
+	fmt.Fprintln(w, title)
+	for _, row := range rows {
+		fmt.Fprintf(w, "  %-16s %s\n", row[0], row[1])
+	}
+}
+
+// bytes in binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit || value <= -unit {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[exp])
+}
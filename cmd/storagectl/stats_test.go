@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0: "0 B", 1023: "1023 B", 1024: "1.0 KiB", 1536: "1.5 KiB", 5 << 20: "5.0 MiB", 3 << 40: "3.0 TiB", -2048: "-2.0 KiB",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Fatalf("%d bytes formatted %q, want %q", n, got, want)
+		}
+	}
+}
+
+// fill a database, returning the report of stats
+func statsTest(t *testing.T) statsReport {
+	t.Helper()
+	db := openTestDB(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < 3000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("value"))
+	}
+	b, _ := tx.CreateBucket([]byte("b"))
+	inner, _ := b.CreateBucket([]byte("in ner"))
+	inner.Set([]byte("x"), []byte("y"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Get([]byte("k00000"))
+	r := statsReport{Path: db.Path, Info: db.Info(), Stats: db.Stats()}
+	tx, _ = db.Begin(false)
+	defer tx.Rollback()
+	r.Version = tx.Version()
+	var err error
+	if r.Usage, err = tx.Usage(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Trees, err = tx.TreeStats(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestStatsPrint(t *testing.T) {
+	r := statsTest(t)
+	var buf bytes.Buffer
+	r.print(&buf)
+	out := buf.String()
+	var titles []string
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" && !strings.HasPrefix(line, " ") {
+			titles = append(titles, line)
+		}
+	}
+	if strings.Join(titles, " ") != "database pages trees buckets wal activity latency" {
+		t.Fatalf("sections %v", titles)
+	}
+	for _, want := range []string{
+		"  path             " + r.Path + "\n",
+		"  comparator       bytes\n",
+		"  page size        4.0 KiB\n",
+		"  b/\"in ner\"       1 keys",
+		"  commits          1\n",
+		"  commit           1, mean",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("%q not in\n%s", want, out)
+		}
+	}
+}
+
+func TestStatsJSON(t *testing.T) {
+	r := statsTest(t)
+	data, err := json.Marshal(r.json())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Info  struct{ ID string }
+		Stats struct {
+			SyncPolicy    string
+			Commits       uint64
+			CommitLatency jsonLatency
+		}
+		Usage struct {
+			Buckets []jsonBucket
+		}
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Info.ID != r.Info.ID.String() || got.Stats.SyncPolicy != r.Stats.SyncPolicy.String() ||
+		got.Stats.Commits != 1 || got.Stats.CommitLatency.Count != 1 {
+		t.Fatalf("json %s", data)
+	}
+	if len(got.Usage.Buckets) != 2 || strings.Join(got.Usage.Buckets[1].Path, "/") != "b/in ner" {
+		t.Fatalf("buckets %+v", got.Usage.Buckets)
+	}
+
+	// [] rather than null without buckets
+	data, _ = json.Marshal(statsReport{}.json())
+	if !bytes.Contains(data, []byte(`"Buckets":[]`)) {
+		t.Fatalf("json without buckets %s", data)
+	}
+}
+
+func TestRunStats(t *testing.T) {
+	db := openTestDB(t)
+	db.Set([]byte("a"), []byte("b"))
+	db.Close()
+	for _, args := range [][]string{{db.Path}, {"-json", db.Path}} {
+		if err := runStats(args); err != nil {
+			t.Fatalf("stats %v: %v", args, err)
+		}
+	}
+	if err := runStats([]string{db.Path + ".missing"}); err == nil {
+		t.Fatal("stats of a missing file")
+	}
+}
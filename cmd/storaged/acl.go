@@ -0,0 +1,802 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The access control of -acl: a client logs in as a user of the file, and
+// the role of the user bounds the commands it runs. The file has a line per
+// user, # starts a comment:
+//
+//	<user> <role> <hash of the secret> [<bucket>=<role> ...]
+//
+// The secret is a password given with the user, its hash PBKDF2-HMAC-SHA256
+// of a random salt printed by storaged -hash-secret for a password on stdin,
+// ACL_ITERATIONS of them:
+//
+//	pbkdf2-sha256:<iterations>:<salt in hex>:<key in hex>
+//
+// or a token of ACL_TOKEN_LEN random bytes, given alone or with its user,
+// which storaged -new-token prints with its hash, HMAC-SHA256 of a random
+// key:
+//
+//	hmac-sha256:<key in hex>:<mac in hex>
+//
+// A login without user is looked up among the tokens only, a hash each
+// being cheap, and a password verified is remembered until the file
+// changes, so that the clients pay for the iterations at their first login
+// only. A host failing ACL_LOGIN_BURST logins is refused those after but
+// ACL_LOGIN_RATE a second, before any hash. The roles:
+//
+//	none        nothing but the buckets granted
+//	read-only   the reads
+//	read-write  the reads and the writes
+//	admin       everything, with /metrics, /audit and the ACL API /acl of -http
+//
+// The grants of buckets replace the role in those buckets, so that the
+// applications sharing a server each have a bucket of their own: the role
+// applies to the keys outside buckets and to the buckets not granted. A
+// grant is none, read-only or read-write, the names of the buckets granted
+// have no spaces. The role is looked up on every command, a user removed
+// or changed is so for the clients logged in as well.
+
+const (
+	ACL_ITERATIONS = 600000 // of PBKDF2 for the secrets hashed
+	ACL_SALT_LEN   = 16
+	ACL_KEY_LEN    = sha256.Size
+	ACL_TOKEN_LEN  = 32 // random bytes of the tokens, in hex
+
+	ACL_LOGIN_BURST = 10    // failed logins of a host before it's limited
+	ACL_LOGIN_RATE  = 1     // failed logins a second of a host limited
+	ACL_LOGIN_HOSTS = 10000 // hosts limited at most, those recovered forgotten first
+)
+
+// errBadUser is a user the ACL API can't set, replied with 400
+var errBadUser = errors.New("bad user")
+
+// the role of a user, each allows what those before do
+type role int
+
+const (
+	roleNone role = iota // no access, or not logged in
+	roleRead
+	roleWrite
+	roleAdmin
+)
+
+var roleNames = []string{"none", "read-only", "read-write", "admin"}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(s string) (role, error) {
+	for r, name := range roleNames {
+		if s == name {
+			return role(r), nil
+		}
+	}
+	return roleNone, fmt.Errorf("unknown role %q", s)
+}
+
+// a grant of a bucket, <bucket>=<role>
+func parseGrant(s string) (string, role, error) {
+	i := strings.LastIndexByte(s, '=')
+	if i <= 0 {
+		return "", roleNone, fmt.Errorf("bad grant %q, want <bucket>=<role>", s)
+	}
+	r, err := parseRole(s[i+1:])
+	if err == nil && r == roleAdmin {
+		err = fmt.Errorf("bucket %s can't be granted admin", s[:i])
+	}
+	return s[:i], r, err
+}
+
+// a password hashed by PBKDF2-HMAC-SHA256, or a token by HMAC-SHA256 of
+// the salt if token
+type secretHash struct {
+	token      bool
+	iterations int
+	salt       []byte
+	key        []byte
+}
+
+func hashSecret(secret string, iterations int) (secretHash, error) {
+	salt := make([]byte, ACL_SALT_LEN)
+	if _, err := rand.Read(salt); err != nil {
+		return secretHash{}, fmt.Errorf("salt: %w", err)
+	}
+	return secretHash{false, iterations, salt, pbkdf2SHA256([]byte(secret), salt, iterations, ACL_KEY_LEN)}, nil
+}
+
+// a new token and its hash
+func newToken() (string, secretHash, error) {
+	buf := make([]byte, ACL_TOKEN_LEN)
+	if _, err := rand.Read(buf); err != nil {
+		return "", secretHash{}, fmt.Errorf("token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+	h, err := hashToken(token)
+	return token, h, err
+}
+
+func hashToken(token string) (secretHash, error) {
+	key := make([]byte, ACL_KEY_LEN)
+	if _, err := rand.Read(key); err != nil {
+		return secretHash{}, fmt.Errorf("key: %w", err)
+	}
+	return secretHash{token: true, salt: key, key: tokenMAC(token, key)}, nil
+}
+
+func tokenMAC(token string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	return mac.Sum(nil)
+}
+
+func parseSecretHash(s string) (secretHash, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) == 3 && fields[0] == "hmac-sha256" {
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) < ACL_SALT_LEN {
+			return secretHash{}, fmt.Errorf("bad key %q, %d bytes in hex at least", fields[1], ACL_SALT_LEN)
+		}
+		mac, err := hex.DecodeString(fields[2])
+		if err != nil || len(mac) != sha256.Size {
+			return secretHash{}, fmt.Errorf("bad mac %q", fields[2])
+		}
+		return secretHash{token: true, salt: key, key: mac}, nil
+	}
+	if len(fields) != 4 || fields[0] != "pbkdf2-sha256" {
+		return secretHash{}, fmt.Errorf("bad hash %q, want pbkdf2-sha256:<iterations>:<salt>:<key> or hmac-sha256:<key>:<mac>", s)
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 1 {
+		return secretHash{}, fmt.Errorf("bad iterations %q", fields[1])
+	}
+	salt, err := hex.DecodeString(fields[2])
+	if err != nil || len(salt) < ACL_SALT_LEN {
+		return secretHash{}, fmt.Errorf("bad salt %q, %d bytes in hex at least", fields[2], ACL_SALT_LEN)
+	}
+	key, err := hex.DecodeString(fields[3])
+	if err != nil || len(key) != ACL_KEY_LEN {
+		return secretHash{}, fmt.Errorf("bad key %q", fields[3])
+	}
+	return secretHash{false, n, salt, key}, nil
+}
+
+func (h secretHash) String() string {
+	if h.token {
+		return fmt.Sprintf("hmac-sha256:%x:%x", h.salt, h.key)
+	}
+	return fmt.Sprintf("pbkdf2-sha256:%d:%x:%x", h.iterations, h.salt, h.key)
+}
+
+func (h secretHash) match(secret string) bool {
+	if h.token {
+		return hmac.Equal(tokenMAC(secret, h.salt), h.key)
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(secret), h.salt, h.iterations, len(h.key)), h.key) == 1
+}
+
+// PBKDF2 of RFC 8018 with HMAC-SHA256, a key of n bytes
+func pbkdf2SHA256(password, salt []byte, iterations, n int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < n; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:n]
+}
+
+// print the hash of the secret of the first line of r, for -hash-secret
+func printSecretHash(r io.Reader, w io.Writer) error {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	secret := strings.TrimRight(line, "\r\n")
+	if secret == "" {
+		return errors.New("no secret on stdin")
+	}
+	h, err := hashSecret(secret, ACL_ITERATIONS)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, h)
+	return err
+}
+
+// print a new token then its hash, for -new-token
+func printNewToken(w io.Writer) error {
+	token, h, err := newToken()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n%s\n", token, h)
+	return err
+}
+
+type aclUser struct {
+	role    role
+	hash    secretHash
+	buckets map[string]role // the grants, nil if none
+}
+
+// the users of an ACL file, nil when there is none: every client is an
+// admin then
+type acl struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]aclUser
+	// the users and secrets verified since the users were loaded, by the
+	// SHA-256 of the user, a 0 and the password
+	verified map[[sha256.Size]byte]bool
+	failures loginLimiter
+}
+
+// the failed logins of the hosts, a bucket each of ACL_LOGIN_BURST refilled
+// at ACL_LOGIN_RATE a second
+type loginLimiter struct {
+	mu    sync.Mutex
+	hosts map[string]*loginBucket
+}
+
+type loginBucket struct {
+	left float64 // the failures left
+	at   time.Time
+}
+
+// the bucket of a host refilled until now, nil if full
+func (l *loginLimiter) bucket(host string, now time.Time) *loginBucket {
+	b := l.hosts[host]
+	if b == nil {
+		return nil
+	}
+	b.left += now.Sub(b.at).Seconds() * ACL_LOGIN_RATE
+	b.at = now
+	if b.left >= ACL_LOGIN_BURST {
+		delete(l.hosts, host)
+		return nil
+	}
+	return b
+}
+
+// whether a host may try a login
+func (l *loginLimiter) allow(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(host, time.Now())
+	return b == nil || b.left >= 1
+}
+
+// count a failed login of a host
+func (l *loginLimiter) fail(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b := l.bucket(host, now)
+	if b == nil {
+		if len(l.hosts) >= ACL_LOGIN_HOSTS {
+			for h := range l.hosts {
+				l.bucket(h, now)
+			}
+		}
+		// any one of them if none recovered
+		for h := range l.hosts {
+			if len(l.hosts) < ACL_LOGIN_HOSTS {
+				break
+			}
+			delete(l.hosts, h)
+		}
+		if l.hosts == nil {
+			l.hosts = map[string]*loginBucket{}
+		}
+		b = &loginBucket{left: ACL_LOGIN_BURST, at: now}
+		l.hosts[host] = b
+	}
+	if b.left >= 1 {
+		b.left--
+	}
+}
+
+func loadACL(path string) (*acl, error) {
+	a := &acl{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// read the file again, the users stay those before if it's bad
+func (a *acl) reload() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseACL(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	a.mu.Lock()
+	a.users, a.verified = users, nil
+	a.mu.Unlock()
+	return nil
+}
+
+func parseACL(data []byte) (map[string]aclUser, error) {
+	users := map[string]aclUser{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: want <user> <role> <hash> [<bucket>=<role> ...]", n)
+		}
+		r, err := parseRole(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		h, err := parseSecretHash(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		u := aclUser{role: r, hash: h}
+		for _, grant := range fields[3:] {
+			bucket, r, err := parseGrant(grant)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			if u.buckets == nil {
+				u.buckets = map[string]role{}
+			}
+			u.buckets[bucket] = r
+		}
+		if _, ok := users[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: user %s again", n, fields[0])
+		}
+		users[fields[0]] = u
+	}
+	return users, sc.Err()
+}
+
+// the user of a secret of a client at addr, that of a token if user is
+// empty: "" and false if none matches or the host failed too many. The
+// hashes are checked without holding a.mu.
+func (a *acl) login(addr, user, secret string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if !a.failures.allow(host) {
+		return "", false
+	}
+	name, ok := a.match(user, secret)
+	if !ok {
+		a.failures.fail(host)
+	}
+	return name, ok
+}
+
+func (a *acl) match(user, secret string) (string, bool) {
+	a.mu.RLock()
+	users, verified := a.users, a.verified
+	a.mu.RUnlock()
+	names := []string{user}
+	if user == "" {
+		names = make([]string, 0, len(users))
+		for name := range users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		u, ok := users[name]
+		if !ok || user == "" && !u.hash.token {
+			continue
+		}
+		if u.hash.token {
+			if u.hash.match(secret) {
+				return name, true
+			}
+			continue
+		}
+		id := sha256.Sum256([]byte(name + "\x00" + secret))
+		if verified[id] {
+			return name, true
+		}
+		if !u.hash.match(secret) {
+			continue
+		}
+		a.mu.Lock()
+		// unless the users changed meanwhile
+		if cur, ok := a.users[name]; ok && bytes.Equal(cur.hash.key, u.hash.key) {
+			if a.verified == nil {
+				a.verified = map[[sha256.Size]byte]bool{}
+			}
+			a.verified[id] = true
+		}
+		a.mu.Unlock()
+		return name, true
+	}
+	return "", false
+}
+
+// whether a user is logged in, always without ACL
+func (a *acl) known(user string) bool {
+	return a == nil || a.knownUser(user) != ""
+}
+
+// the role of a user logged in on the keys of a bucket, outside buckets if
+// nil: admin without ACL
+func (a *acl) role(user string, bucket []byte) role {
+	if a == nil {
+		return roleAdmin
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u := a.users[user]
+	if r, ok := u.buckets[string(bucket)]; ok && bucket != nil {
+		return r
+	}
+	return u.role
+}
+
+// whether a user can read every bucket granted, the stream of the commits
+// of all the buckets is for those only
+func (a *acl) unrestricted(user string) bool {
+	if a == nil {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, r := range a.users[user].buckets {
+		if r < roleRead {
+			return false
+		}
+	}
+	return true
+}
+
+// the user of the client certificate of a TLS connection if the ACL has
+// it, after the handshake: "" otherwise
+func (a *acl) certUser(nc net.Conn) string {
+	tc, ok := nc.(*tls.Conn)
+	if a == nil || !ok || tc.Handshake() != nil {
+		return ""
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return a.knownUser(certs[0].Subject.CommonName)
+}
+
+func (a *acl) knownUser(name string) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if _, ok := a.users[name]; !ok {
+		return ""
+	}
+	return name
+}
+
+// add or change a user and write the file, the password kept if empty and
+// the grants if nil
+func (a *acl) set(name string, r role, secret string, buckets map[string]role) error {
+	if err := checkUser(name, buckets); err != nil {
+		return err
+	}
+	// hashed before locking, the logins go on meanwhile
+	var h *secretHash
+	if secret != "" {
+		hash, err := hashSecret(secret, ACL_ITERATIONS)
+		if err != nil {
+			return err
+		}
+		h = &hash
+	}
+	return a.setHash(name, r, h, buckets)
+}
+
+// add or change a user as set does, with a new token: its hash replaces the
+// secret
+func (a *acl) setToken(name string, r role, buckets map[string]role) (string, error) {
+	if err := checkUser(name, buckets); err != nil {
+		return "", err
+	}
+	token, h, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	return token, a.setHash(name, r, &h, buckets)
+}
+
+func checkUser(name string, buckets map[string]role) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n#") {
+		return fmt.Errorf("%w name %q", errBadUser, name)
+	}
+	for bucket, br := range buckets {
+		if bucket == "" || strings.ContainsAny(bucket, " \t\r\n#") {
+			return fmt.Errorf("%w %s: bad bucket %q", errBadUser, name, bucket)
+		}
+		if br == roleAdmin {
+			return fmt.Errorf("%w %s: bucket %s can't be granted admin", errBadUser, name, bucket)
+		}
+	}
+	return nil
+}
+
+// the secret kept if h is nil
+func (a *acl) setHash(name string, r role, h *secretHash, buckets map[string]role) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.users[name]
+	if !ok && h == nil {
+		return fmt.Errorf("%w %s: no secret for a new user", errBadUser, name)
+	}
+	u.role = r
+	if h != nil {
+		u.hash = *h
+	}
+	if buckets != nil {
+		u.buckets = buckets
+		if len(buckets) == 0 {
+			u.buckets = nil
+		}
+	}
+	users := make(map[string]aclUser, len(a.users)+1)
+	for n, u := range a.users {
+		users[n] = u
+	}
+	users[name] = u
+	return a.save(users)
+}
+
+// remove a user and write the file, false if there was none
+func (a *acl) remove(name string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.users[name]; !ok {
+		return false, nil
+	}
+	users := make(map[string]aclUser, len(a.users))
+	for n, u := range a.users {
+		if n != name {
+			users[n] = u
+		}
+	}
+	return true, a.save(users)
+}
+
+// a user of GET /acl
+type aclEntry struct {
+	User    string            `json:"user"`
+	Role    string            `json:"role"`
+	Buckets map[string]string `json:"buckets,omitempty"` // the grants
+}
+
+// the users in order
+func (a *acl) entries() []aclEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	entries := make([]aclEntry, 0, len(a.users))
+	for name, u := range a.users {
+		e := aclEntry{User: name, Role: u.role.String()}
+		for bucket, r := range u.buckets {
+			if e.Buckets == nil {
+				e.Buckets = map[string]string{}
+			}
+			e.Buckets[bucket] = r.String()
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].User < entries[j].User })
+	return entries
+}
+
+// replace the file by a new one with the users, then a.users: the caller
+// holds a.mu
+func (a *acl) save(users map[string]aclUser) error {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	buf.WriteString("# <user> <role> <hash of the secret> [<bucket>=<role> ...]\n")
+	for _, name := range names {
+		u := users[name]
+		fmt.Fprintf(&buf, "%s %s %s", name, u.role, u.hash)
+		buckets := make([]string, 0, len(u.buckets))
+		for bucket := range u.buckets {
+			buckets = append(buckets, bucket)
+		}
+		sort.Strings(buckets)
+		for _, bucket := range buckets {
+			fmt.Fprintf(&buf, " %s=%s", bucket, u.buckets[bucket])
+		}
+		buf.WriteByte('\n')
+	}
+	fp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	_, err = fp.Write(buf.Bytes())
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), a.path)
+	}
+	if err != nil {
+		return err
+	}
+	a.users, a.verified = users, nil
+	return nil
+}
+
+// the ACL API of the admins, under /acl:
+//
+//	GET    /acl          the users, their roles and grants as JSON
+//	PUT    /acl/{user}   add or change, {"role": ..., "secret": ..., "token": ..., "buckets": {...}}
+//	DELETE /acl/{user}   204, 404 if absent
+//
+// The secret is a password, with "token": true a new token replaces it
+// instead, replied as {"token": ...}. The secret and the grants of a user
+// changed are kept if not given, the buckets are a map of the names to
+// their roles.
+func (a *acl) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/acl"), "/")
+		switch {
+		case name == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(a.entries())
+		case name == "":
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		case r.Method == http.MethodPut:
+			var req struct {
+				Role    string            `json:"role"`
+				Secret  string            `json:"secret"`
+				Token   bool              `json:"token"`
+				Buckets map[string]string `json:"buckets"`
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ro, err := parseRole(req.Role)
+			var buckets map[string]role
+			if req.Buckets != nil {
+				buckets = map[string]role{}
+			}
+			for bucket, s := range req.Buckets {
+				if err == nil {
+					buckets[bucket], err = parseRole(s)
+				}
+			}
+			if err == nil && req.Token && req.Secret != "" {
+				err = errors.New("secret and token both given")
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var token string
+			if req.Token {
+				token, err = a.setToken(name, ro, buckets)
+			} else {
+				err = a.set(name, ro, req.Secret, buckets)
+			}
+			switch {
+			case errors.Is(err, errBadUser):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			case req.Token:
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]string{"token": token})
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		case r.Method == http.MethodDelete:
+			ok, err := a.remove(name)
+			switch {
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			case !ok:
+				http.NotFound(w, r)
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			w.Header().Set("Allow", "PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// check the credentials of the requests before h: Basic auth, a Bearer
+// token or a client certificate, then the role of the path and method
+func (a *acl) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := ""
+		if name, secret, ok := r.BasicAuth(); ok {
+			user, _ = a.login(r.RemoteAddr, name, secret)
+		} else if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			user, _ = a.login(r.RemoteAddr, "", token)
+		} else if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			user = a.knownUser(r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+		if !a.known(user) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="storaged"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if have, need := a.role(user, nil), httpRole(r); have < need {
+			http.Error(w, fmt.Sprintf("user %s is %s, %s is needed", user, have, need), http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/changes" && !a.unrestricted(user) {
+			http.Error(w, fmt.Sprintf("user %s can't read every bucket of /changes", user), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(principal(r.Context(), user, r.RemoteAddr)))
+	})
+}
+
+// the role a request needs outside buckets, those of HTTPHandler
+func httpRole(r *http.Request) role {
+	switch {
+	case r.URL.Path == "/metrics" || r.URL.Path == "/audit" || r.URL.Path == "/acl" || strings.HasPrefix(r.URL.Path, "/acl/") || strings.HasPrefix(r.URL.Path, "/raft/"):
+		return roleAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return roleRead
+	}
+	return roleWrite
+}
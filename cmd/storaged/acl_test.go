@@ -0,0 +1,664 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// few iterations for the hashes of the tests
+const ACL_TEST_ITERATIONS = 1000
+
+// an ACL file of lines "<user> <role> <secret> [<bucket>=<role> ...]",
+// the secrets hashed, as tokens those of "token:<token>"
+func writeACLTest(t *testing.T, lines ...string) *acl {
+	t.Helper()
+	var data strings.Builder
+	data.WriteString("# users of the test\n\n")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		h, err := hashSecret(fields[2], ACL_TEST_ITERATIONS)
+		if token, ok := strings.CutPrefix(fields[2], "token:"); ok {
+			h, err = hashToken(token)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields[2] = h.String()
+		fmt.Fprintln(&data, strings.Join(fields, " "), "# a comment")
+	}
+	path := filepath.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(path, []byte(data.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := loadACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// the test vectors of RFC 7914
+func TestPBKDF2(t *testing.T) {
+	for _, c := range []struct {
+		password, salt string
+		iterations, n  int
+		want           string
+	}{
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	} {
+		if got := hex.EncodeToString(pbkdf2SHA256([]byte(c.password), []byte(c.salt), c.iterations, c.n)); got != c.want {
+			t.Errorf("PBKDF2 of %q %q %d: %s, want %s", c.password, c.salt, c.iterations, got, c.want)
+		}
+	}
+}
+
+func TestSecretHash(t *testing.T) {
+	h, err := hashSecret("s3cret", ACL_TEST_ITERATIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseSecretHash(h.String())
+	if err != nil || parsed.String() != h.String() {
+		t.Fatalf("parsed %s of %s: %v", parsed, h, err)
+	}
+	if !parsed.match("s3cret") || parsed.match("s3cre") || parsed.match("") {
+		t.Fatal("match of the secrets")
+	}
+	// a salt of its own for each hash
+	if other, _ := hashSecret("s3cret", ACL_TEST_ITERATIONS); other.String() == h.String() {
+		t.Fatal("same hash of a secret twice")
+	}
+	if !strings.HasPrefix(h.String(), fmt.Sprintf("pbkdf2-sha256:%d:", ACL_TEST_ITERATIONS)) {
+		t.Fatalf("hash %s", h)
+	}
+	salt, key := strings.Repeat("00", ACL_SALT_LEN), strings.Repeat("00", ACL_KEY_LEN)
+	for _, s := range []string{
+		strings.Repeat("ab", 32), // an unsalted sha256
+		"pbkdf2-sha1:1000:" + salt + ":" + key,
+		"pbkdf2-sha256:0:" + salt + ":" + key,
+		"pbkdf2-sha256:x:" + salt + ":" + key,
+		"pbkdf2-sha256:1000:00:" + key,
+		"pbkdf2-sha256:1000:" + salt + ":00",
+		"pbkdf2-sha256:1000:" + salt,
+	} {
+		if _, err := parseSecretHash(s); err == nil {
+			t.Errorf("hash %q accepted", s)
+		}
+	}
+}
+
+func TestTokenHash(t *testing.T) {
+	token, h, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 2*ACL_TOKEN_LEN || !strings.HasPrefix(h.String(), "hmac-sha256:") {
+		t.Fatalf("token %s, hash %s", token, h)
+	}
+	parsed, err := parseSecretHash(h.String())
+	if err != nil || parsed.String() != h.String() || !parsed.token {
+		t.Fatalf("parsed %s of %s: %v", parsed, h, err)
+	}
+	if !parsed.match(token) || parsed.match(token[1:]) || parsed.match("") {
+		t.Fatal("match of the tokens")
+	}
+	if other, _, _ := newToken(); other == token {
+		t.Fatal("same token twice")
+	}
+	key, mac := strings.Repeat("00", ACL_KEY_LEN), strings.Repeat("00", sha256.Size)
+	for _, s := range []string{
+		"hmac-sha256:" + key,
+		"hmac-sha256:00:" + mac,
+		"hmac-sha256:" + key + ":00",
+		"hmac-sha256:x:" + mac,
+		"hmac-sha1:" + key + ":" + mac,
+	} {
+		if _, err := parseSecretHash(s); err == nil {
+			t.Errorf("hash %q accepted", s)
+		}
+	}
+
+	var out strings.Builder
+	if err := printNewToken(&out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("printed %q", out.String())
+	}
+	if h, err := parseSecretHash(lines[1]); err != nil || !h.match(lines[0]) {
+		t.Fatalf("printed %q: %v", out.String(), err)
+	}
+}
+
+// the failed logins of a host are limited, before any hash is checked
+func TestLoginLimit(t *testing.T) {
+	a := writeACLTest(t, "ann admin pw", "tok read-only token:token1")
+	for i := 0; i < ACL_LOGIN_BURST; i++ {
+		if _, ok := a.login("10.0.0.1:1000", "", "nope"); ok {
+			t.Fatal("login with a bad token")
+		}
+	}
+	// every port of the host, the others not
+	for _, addr := range []string{"10.0.0.1:1000", "10.0.0.1:2000"} {
+		if _, ok := a.login(addr, "ann", "pw"); ok {
+			t.Fatalf("login of %s limited", addr)
+		}
+	}
+	if user, ok := a.login("10.0.0.2:1000", "", "token1"); !ok || user != "tok" {
+		t.Fatalf("login of another host: %q %v", user, ok)
+	}
+	// a failure more a second
+	a.failures.hosts["10.0.0.1"].at = time.Now().Add(-1500 * time.Millisecond)
+	if user, ok := a.login("10.0.0.1:1000", "ann", "pw"); !ok || user != "ann" {
+		t.Fatalf("login after a second: %q %v", user, ok)
+	}
+	a.login("10.0.0.1:1000", "ann", "nope")
+	if _, ok := a.login("10.0.0.1:1000", "ann", "pw"); ok {
+		t.Fatal("login past the rate")
+	}
+	// recovered after the burst, and forgotten
+	a.failures.hosts["10.0.0.1"].at = time.Now().Add(-ACL_LOGIN_BURST * time.Second / ACL_LOGIN_RATE)
+	if _, ok := a.login("10.0.0.1:1000", "ann", "pw"); !ok || len(a.failures.hosts) != 0 {
+		t.Fatalf("login after the burst: %v, %d hosts", ok, len(a.failures.hosts))
+	}
+
+	// the hosts kept are bounded
+	for i := 0; i < ACL_LOGIN_HOSTS+10; i++ {
+		a.failures.fail(fmt.Sprint("host", i))
+	}
+	if n := len(a.failures.hosts); n != ACL_LOGIN_HOSTS {
+		t.Fatalf("%d hosts", n)
+	}
+}
+
+func TestPrintSecretHash(t *testing.T) {
+	var out strings.Builder
+	if err := printSecretHash(strings.NewReader("s3cret\nignored\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	h, err := parseSecretHash(strings.TrimSpace(out.String()))
+	if err != nil || h.iterations != ACL_ITERATIONS || !h.match("s3cret") {
+		t.Fatalf("hash %q: %v", out.String(), err)
+	}
+	if err := printSecretHash(strings.NewReader("\n"), io.Discard); err == nil {
+		t.Fatal("hash of no secret")
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	a := writeACLTest(t, "ann admin pw", "bob read-only bobpw", "tok read-write token:token1")
+	got := fmt.Sprint(a.entries())
+	if want := "[{ann admin map[]} {bob read-only map[]} {tok read-write map[]}]"; got != want {
+		t.Fatalf("entries %s, want %s", got, want)
+	}
+	h, _ := hashSecret("x", ACL_TEST_ITERATIONS)
+	for _, c := range []struct{ data, err string }{
+		{"ann admin", "line 1: want <user> <role> <hash>"},
+		{"ann root " + h.String(), `line 1: unknown role "root"`},
+		{"\nann admin " + strings.Repeat("ab", 32), "line 2: bad hash"},
+		{"ann admin " + h.String() + "\nann read-only " + h.String(), "line 2: user ann again"},
+	} {
+		if _, err := parseACL([]byte(c.data)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("ACL %q: %v, want %s", c.data, err, c.err)
+		}
+	}
+
+	// a bad file leaves the users before, a good one replaces them
+	os.WriteFile(a.path, []byte("ann admin"), 0o600)
+	if err := a.reload(); err == nil || !strings.Contains(err.Error(), a.path) {
+		t.Fatalf("reload of a bad file: %v", err)
+	}
+	if !a.known("bob") {
+		t.Fatal("users lost by a bad reload")
+	}
+	os.WriteFile(a.path, []byte("carl read-only "+h.String()+"\n"), 0o600)
+	if err := a.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a.known("bob") || !a.known("carl") {
+		t.Fatalf("users after the reload %v", a.entries())
+	}
+	os.Remove(a.path)
+	if err := a.reload(); err == nil {
+		t.Fatal("reload of a missing file")
+	}
+	if _, err := loadACL(a.path); err == nil {
+		t.Fatal("load of a missing file")
+	}
+}
+
+func TestACLLogin(t *testing.T) {
+	a := writeACLTest(t, "ann admin pw", "bob read-only bobpw", "tok read-write token:token1")
+	for _, c := range []struct {
+		user, secret, want string
+	}{
+		{"ann", "pw", "ann"},
+		{"bob", "bobpw", "bob"},
+		{"", "token1", "tok"},
+		{"tok", "token1", "tok"},
+		{"", "pw", ""}, // a password needs its user
+		{"ann", "token1", ""},
+		{"ann", "bobpw", ""},
+		{"nobody", "pw", ""},
+		{"", "nothing", ""},
+		{"", "", ""},
+	} {
+		for i := 0; i < 2; i++ { // verified, then remembered
+			if user, ok := a.login("127.0.0.1:1234", c.user, c.secret); user != c.want || ok != (c.want != "") {
+				t.Fatalf("login %q %q: %q %v, want %q", c.user, c.secret, user, ok, c.want)
+			}
+		}
+		a.failures.hosts = nil
+	}
+	// the passwords only, the tokens are cheap to check
+	if len(a.verified) != 2 {
+		t.Fatalf("%d secrets remembered", len(a.verified))
+	}
+	if a.role("tok", nil) != roleWrite || a.role("nobody", nil) != roleNone || !a.known("tok") || a.known("") {
+		t.Fatal("roles of the users")
+	}
+	var none *acl
+	if none.role("", nil) != roleAdmin || !none.known("") {
+		t.Fatal("roles without ACL")
+	}
+
+	// a secret changed or a user removed are so for the logins to come
+	if err := a.set("bob", roleWrite, "newpw", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.login("127.0.0.1:1234", "bob", "bobpw"); ok {
+		t.Fatal("login with the secret replaced")
+	}
+	if user, ok := a.login("127.0.0.1:1234", "bob", "newpw"); !ok || user != "bob" || a.role("bob", nil) != roleWrite {
+		t.Fatalf("login with the new secret: %q %v", user, ok)
+	}
+	// the secret kept if not given
+	if err := a.set("bob", roleRead, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.login("127.0.0.1:1234", "bob", "newpw"); !ok || a.role("bob", nil) != roleRead {
+		t.Fatal("secret lost by a change of the role")
+	}
+	if ok, err := a.remove("tok"); !ok || err != nil {
+		t.Fatalf("remove: %v %v", ok, err)
+	}
+	if _, ok := a.login("127.0.0.1:1234", "", "token1"); ok || a.known("tok") {
+		t.Fatal("login of a user removed")
+	}
+	if ok, err := a.remove("tok"); ok || err != nil {
+		t.Fatalf("remove twice: %v %v", ok, err)
+	}
+
+	// the file written is read again the same, the secrets salted
+	b, err := loadACL(a.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(b.entries()) != fmt.Sprint(a.entries()) {
+		t.Fatalf("file read again %v, written %v", b.entries(), a.entries())
+	}
+	data, _ := os.ReadFile(a.path)
+	if strings.Contains(string(data), "newpw") || !strings.Contains(string(data), fmt.Sprintf("bob read-only pbkdf2-sha256:%d:", ACL_ITERATIONS)) {
+		t.Fatalf("file written\n%s", data)
+	}
+	if _, ok := b.login("127.0.0.1:1234", "bob", "newpw"); !ok {
+		t.Fatal("login with the file written")
+	}
+
+	for _, name := range []string{"", "a b", "a#b", "a\nb"} {
+		if err := a.set(name, roleRead, "pw", nil); err == nil {
+			t.Errorf("user %q set", name)
+		}
+	}
+	if err := a.set("new", roleRead, "", nil); err == nil {
+		t.Error("new user set without a secret")
+	}
+}
+
+// the ACL API of -http, for the admins
+func TestACLAPI(t *testing.T) {
+	db := openTestDB(t)
+	a := writeACLTest(t, "ann admin pw", "bob read-write bobpw")
+	url := startHTTP(t, newHTTPServer(db, db.HTTPHandler(), a))
+	do := func(method, path, user, secret, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, url+path, strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, secret)
+		} else if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(data))
+	}
+	for _, c := range []struct {
+		method, path, user, secret, body string
+		status                           int
+	}{
+		{"PUT", "/kv/a", "", "", "1", 401},
+		{"PUT", "/kv/a", "bob", "nope", "1", 401},
+		{"PUT", "/kv/a", "bob", "bobpw", "1", 204},
+		{"GET", "/kv/a", "", "bobpw", "", 401}, // a password as a token
+		{"GET", "/acl", "bob", "bobpw", "", 403},
+		{"GET", "/metrics", "bob", "bobpw", "", 403},
+		{"PUT", "/acl/carl", "ann", "pw", `{"role": "read-only", "secret": "carlpw"}`, 204},
+		{"GET", "/kv/a", "carl", "carlpw", "", 200},
+		{"PUT", "/kv/a", "carl", "carlpw", "2", 403},
+		{"PUT", "/acl/dan", "ann", "pw", `{"role": "read-only"}`, 400},
+		{"PUT", "/acl/dan", "ann", "pw", `{"role": "root", "secret": "x"}`, 400},
+		{"PUT", "/acl/dan", "ann", "pw", `not json`, 400},
+		{"PUT", "/acl/a%20b", "ann", "pw", `{"role": "read-only", "secret": "x"}`, 400},
+		{"PUT", "/acl/dan", "ann", "pw", `{"role": "none", "secret": "x", "buckets": {"app": "admin"}}`, 400},
+		{"PUT", "/acl/dan", "ann", "pw", `{"role": "none", "secret": "x", "buckets": {"app": "root"}}`, 400},
+		{"PUT", "/acl/dan", "ann", "pw", `{"role": "none", "secret": "x", "buckets": {"app": "read-only"}}`, 204},
+		{"GET", "/kv/a", "dan", "x", "", 403},
+		{"DELETE", "/acl/dan", "ann", "pw", "", 204},
+		{"POST", "/acl", "ann", "pw", "", 405},
+		{"POST", "/acl/carl", "ann", "pw", "", 405},
+		{"DELETE", "/acl/carl", "ann", "pw", "", 204},
+		{"DELETE", "/acl/carl", "ann", "pw", "", 404},
+		{"GET", "/kv/a", "carl", "carlpw", "", 401},
+	} {
+		if status, body := do(c.method, c.path, c.user, c.secret, c.body); status != c.status {
+			t.Fatalf("%s %s as %s: %d %s, want %d", c.method, c.path, c.user, status, body, c.status)
+		}
+	}
+	status, body := do("GET", "/acl", "ann", "pw", "")
+	want := `[{"user":"ann","role":"admin"},{"user":"bob","role":"read-write"}]`
+	if strings.Join(strings.Fields(body), "") != want || status != 200 {
+		t.Fatalf("GET /acl: %d %s, want %s", status, body, want)
+	}
+
+	// a new token replied, then the Bearer of its user
+	if status, body := do("PUT", "/acl/eve", "ann", "pw", `{"role": "read-only", "secret": "x", "token": true}`); status != 400 {
+		t.Fatalf("secret and token: %d %s", status, body)
+	}
+	status, body = do("PUT", "/acl/eve", "ann", "pw", `{"role": "read-only", "token": true}`)
+	var resp struct{ Token string }
+	if err := json.Unmarshal([]byte(body), &resp); err != nil || status != 200 || len(resp.Token) != 2*ACL_TOKEN_LEN {
+		t.Fatalf("PUT of a token: %d %s: %v", status, body, err)
+	}
+	if status, body := do("GET", "/kv/a", "", resp.Token, ""); status != 200 || body != "1" {
+		t.Fatalf("GET with the token: %d %s", status, body)
+	}
+	if status, _ := do("PUT", "/kv/a", "", resp.Token, "2"); status != 403 {
+		t.Fatalf("PUT with the token of a reader: %d", status)
+	}
+}
+
+// AUTH of RESP and the roles of its commands
+func TestRESPAuth(t *testing.T) {
+	db := openTestDB(t)
+	_, addr := startRESP(t, db, writeACLTest(t, "ann read-write pw", "bob read-only bobpw", "tok none token:token1"))
+	nc, r := dialRESP(t, addr)
+	for _, tt := range []struct{ cmd, want string }{
+		{respCmd("GET", "a"), "(NOAUTH Authentication required.)"},
+		{"PING\r\n", "(NOAUTH Authentication required.)"},
+		{respCmd("AUTH", "ann", "nope"), "(WRONGPASS invalid username-password pair or user is disabled.)"},
+		{respCmd("AUTH", "a", "b", "c"), "(ERR syntax error)"},
+		{respCmd("AUTH", "ann", "pw"), "OK"},
+		{respCmd("SET", "a", "1"), "OK"},
+		{respCmd("AUTH", "bob", "bobpw"), "OK"},
+		{respCmd("GET", "a"), `"1"`},
+		{respCmd("SET", "a", "2"), "(NOPERM User bob has no permissions to run the 'set' command)"},
+		{respCmd("AUTH", "token1"), "OK"},
+		{"PING\r\n", "PONG"},
+		{respCmd("GET", "a"), "(NOPERM User tok has no permissions to run the 'get' command)"},
+	} {
+		if got := respPipeline(t, nc, r, tt.cmd)[0]; got != tt.want {
+			t.Fatalf("%q: %s, want %s", tt.cmd, got, tt.want)
+		}
+	}
+
+	_, open := startRESP(t, db, nil)
+	nc, r = dialRESP(t, open)
+	if got := respPipeline(t, nc, r, respCmd("AUTH", "pw"))[0]; got != "(ERR AUTH called without any ACL configured)" {
+		t.Fatalf("AUTH without ACL: %s", got)
+	}
+}
+
+func TestACLGrants(t *testing.T) {
+	for _, c := range []struct {
+		grant, bucket string
+		role          role
+		err           string
+	}{
+		{"app=read-write", "app", roleWrite, ""},
+		{"a=b=none", "a=b", roleNone, ""},
+		{"app", "", roleNone, "bad grant"},
+		{"=read-only", "", roleNone, "bad grant"},
+		{"app=root", "app", roleNone, "unknown role"},
+		{"app=admin", "app", roleAdmin, "can't be granted admin"},
+	} {
+		bucket, r, err := parseGrant(c.grant)
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) || c.err == "" && (err != nil || bucket != c.bucket || r != c.role) {
+			t.Errorf("grant %q: %q %s %v", c.grant, bucket, r, err)
+		}
+	}
+	if _, err := parseACL([]byte("ann none " + strings.Repeat("ab", 32) + " app=admin")); err == nil {
+		t.Error("file granting admin on a bucket")
+	}
+
+	a := writeACLTest(t, "app none pw app=read-write logs=read-only", "ops read-write opspw secrets=none", "all read-only allpw")
+	for _, c := range []struct {
+		user, bucket string
+		want         role
+	}{
+		{"app", "", roleNone},
+		{"app", "app", roleWrite},
+		{"app", "logs", roleRead},
+		{"app", "other", roleNone},
+		{"ops", "", roleWrite},
+		{"ops", "secrets", roleNone},
+		{"ops", "app", roleWrite},
+		{"all", "app", roleRead},
+	} {
+		var bucket []byte
+		if c.bucket != "" {
+			bucket = []byte(c.bucket)
+		}
+		if got := a.role(c.user, bucket); got != c.want {
+			t.Errorf("role of %s on %q: %s, want %s", c.user, c.bucket, got, c.want)
+		}
+	}
+	// the stream of /changes for those reading the keys outside buckets
+	// and every bucket granted
+	if !a.unrestricted("app") || a.unrestricted("ops") || !a.unrestricted("all") {
+		t.Fatal("users reading every bucket")
+	}
+	db := openTestDB(t)
+	url := startHTTP(t, newHTTPServer(db, db.HTTPHandler(), a))
+	for _, user := range []string{"app", "ops"} {
+		req, _ := http.NewRequest("GET", url+"/changes", nil)
+		req.SetBasicAuth(user, map[string]string{"app": "pw", "ops": "opspw"}[user])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("/changes for %s: %d", user, resp.StatusCode)
+		}
+	}
+	// the grants kept if nil, replaced otherwise, then written sorted
+	if err := a.set("app", roleRead, "", nil); err != nil || a.role("app", []byte("app")) != roleWrite {
+		t.Fatalf("grants lost by a change of the role: %v", err)
+	}
+	if err := a.set("ops", roleWrite, "", map[string]role{}); err != nil || !a.unrestricted("ops") {
+		t.Fatalf("grants not removed: %v", err)
+	}
+	for _, buckets := range []map[string]role{{"": roleRead}, {"a b": roleRead}, {"app": roleAdmin}} {
+		if err := a.set("app", roleRead, "", buckets); !errors.Is(err, errBadUser) {
+			t.Errorf("grants %v set: %v", buckets, err)
+		}
+	}
+	data, _ := os.ReadFile(a.path)
+	if !regexp.MustCompile(`\napp read-only pbkdf2-sha256:\S+ app=read-write logs=read-only\n`).Match(data) {
+		t.Fatalf("file written\n%s", data)
+	}
+	b, err := loadACL(a.path)
+	if err != nil || fmt.Sprint(b.entries()) != fmt.Sprint(a.entries()) {
+		t.Fatalf("file read again %v, written %v: %v", b.entries(), a.entries(), err)
+	}
+}
+
+// the buckets of SELECT, those of the grants only
+func TestRESPBuckets(t *testing.T) {
+	db := openTestDB(t)
+	_, addr := startRESP(t, db, writeACLTest(t, "app none pw app=read-write logs=read-only", "ops read-write opspw app=none"))
+	db.Set([]byte("a"), []byte("outside"))
+	nc, r := dialRESP(t, addr)
+	for _, tt := range []struct{ cmd, want string }{
+		{respCmd("SELECT", "app"), "(NOAUTH Authentication required.)"},
+		{respCmd("AUTH", "app", "pw"), "OK"},
+		{respCmd("GET", "a"), "(NOPERM User app has no permissions to run the 'get' command)"},
+		{respCmd("SELECT", "other"), "(NOPERM User app has no permissions to access bucket other)"},
+		{respCmd("SELECT", "logs"), `(ERR bucket not found: "logs")`},
+		{respCmd("SELECT", "app"), "OK"},
+		{respCmd("GET", "a"), "nil"},
+		{respCmd("SET", "a", "1"), "OK"},
+		{respCmd("SET", "b", "2", "EX", "100"), "(ERR the keys of buckets don't expire)"},
+		{respCmd("SET", "b", "2", "KEEPTTL"), "OK"},
+		{respCmd("TTL", "b"), "-1"},
+		{respCmd("TTL", "c"), "-2"},
+		{respCmd("MGET", "a", "b", "c"), `["1" "2" nil]`},
+		{respCmd("EXISTS", "a", "c"), "1"},
+		{respCmd("SCAN", "0"), `["0" ["a" "b"]]`},
+		{respCmd("DEL", "b", "c"), "1"},
+		{respCmd("SELECT", "0"), "OK"},
+		{respCmd("GET", "a"), "(NOPERM User app has no permissions to run the 'get' command)"},
+		{respCmd("AUTH", "ops", "opspw"), "OK"},
+		{respCmd("GET", "a"), `"outside"`},
+		{respCmd("SELECT", "app"), "(NOPERM User ops has no permissions to access bucket app)"},
+		{respCmd("SELECT", "new"), "OK"},
+		{respCmd("SET", "x", "y"), "OK"},
+	} {
+		if got := respPipeline(t, nc, r, tt.cmd)[0]; got != tt.want {
+			t.Fatalf("%q: %s, want %s", tt.cmd, got, tt.want)
+		}
+	}
+	if v, _, _ := db.Get([]byte("a")); string(v) != "outside" {
+		t.Fatalf("key outside buckets %q", v)
+	}
+	err := db.View(func(tx *storage.Tx) error {
+		for _, kv := range [][3]string{{"app", "a", "1"}, {"new", "x", "y"}} {
+			b, err := tx.Bucket([]byte(kv[0]))
+			if err != nil {
+				return err
+			}
+			if v, _, _ := b.Get([]byte(kv[1])); string(v) != kv[2] {
+				return fmt.Errorf("%s of bucket %s: %q", kv[1], kv[0], v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a grant read-only of a bucket, the role of the command on it
+	nc, r = dialRESP(t, addr)
+	tx, _ := db.Begin(true)
+	tx.CreateBucket([]byte("logs"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := respPipeline(t, nc, r, respCmd("AUTH", "app", "pw"), respCmd("SELECT", "logs"), respCmd("GET", "a"), respCmd("SET", "a", "1")); fmt.Sprint(got) !=
+		"[OK OK nil (NOPERM User app has no permissions to run the 'set' command on bucket logs)]" {
+		t.Fatalf("replies %v", got)
+	}
+}
+
+// the login of memcached and the roles of its commands, outside buckets
+func TestMemcacheAuth(t *testing.T) {
+	db := openTestDB(t)
+	_, addr := startMemcache(t, db, writeACLTest(t, "ann read-write pw", "bob read-only bobpw", "app none token:token1 app=read-write"))
+	nc, _ := dialRESP(t, addr)
+	memcacheExchange(t, nc, [][2]string{
+		{"get a\r\n", "CLIENT_ERROR unauthenticated\r\n"},
+		{"set a 0 0 6\r\nann no\r\n", "CLIENT_ERROR authentication failure\r\n"},
+		{"set a 0 0 6\r\nann pw\r\n", "STORED\r\n"},
+		{"set a 0 0 1\r\n1\r\n", "STORED\r\n"},
+	})
+	nc, _ = dialRESP(t, addr)
+	memcacheExchange(t, nc, [][2]string{
+		{"set a 0 0 9\r\nbob bobpw\r\n", "STORED\r\n"},
+		{"get a\r\n", "VALUE a 0 1\r\n1\r\nEND\r\n"},
+		{"set a 0 0 1\r\n2\r\n", "CLIENT_ERROR permission denied\r\n"},
+		{"delete a\r\n", "CLIENT_ERROR permission denied\r\n"},
+	})
+	nc, _ = dialRESP(t, addr)
+	memcacheExchange(t, nc, [][2]string{
+		{"set a 0 0 6\r\ntoken1\r\n", "STORED\r\n"},
+		{"get a\r\n", "CLIENT_ERROR permission denied\r\n"},
+	})
+}
+
+// the commits of the clients audited with the user logged in at the address
+// of the client
+func TestAuditPrincipal(t *testing.T) {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "test.db"), storage.WithAuditLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	a := writeACLTest(t, "ann read-write pw", "bob admin bobpw")
+	_, respAddr := startRESP(t, db, a)
+	nc, r := dialRESP(t, respAddr)
+	respPipeline(t, nc, r, respCmd("AUTH", "ann", "pw"), respCmd("SET", "r", "1"))
+	respLocal := nc.LocalAddr().String()
+	_, mcAddr := startMemcache(t, db, a)
+	nc, _ = dialRESP(t, mcAddr)
+	memcacheExchange(t, nc, [][2]string{{"set a 0 0 6\r\nann pw\r\n", "STORED\r\n"}, {"set m 0 0 1\r\n1\r\n", "STORED\r\n"}})
+	mcLocal := nc.LocalAddr().String()
+	url := startHTTP(t, newHTTPServer(db, db.HTTPHandler(), a))
+	req, _ := http.NewRequest("PUT", url+"/kv/h", strings.NewReader("1"))
+	req.SetBasicAuth("ann", "pw")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT: %v %v", resp, err)
+	}
+	var principals []string
+	db.View(func(tx *storage.Tx) error {
+		return tx.AuditLog(0, func(e storage.AuditEntry) error {
+			principals = append(principals, string(e.Changes[0].Key)+" "+e.Principal)
+			return nil
+		})
+	})
+	if len(principals) != 3 || principals[0] != "r ann@"+respLocal || principals[1] != "m ann@"+mcLocal || !strings.HasPrefix(principals[2], "h ann@127.0.0.1:") {
+		t.Fatalf("principals %q", principals)
+	}
+
+	// /audit for the admins
+	for user, want := range map[string]int{"ann": http.StatusForbidden, "bob": http.StatusOK} {
+		req, _ := http.NewRequest("GET", url+"/audit", nil)
+		req.SetBasicAuth(user, map[string]string{"ann": "pw", "bob": "bobpw"}[user])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("/audit for %s: %d, want %d", user, resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// ctx with the principal of the commits of a client, see
+// storage.WithPrincipal: the user logged in if any, at the address of the
+// client
+func principal(ctx context.Context, user string, remote string) context.Context {
+	if user != "" {
+		remote = user + "@" + remote
+	}
+	return storage.WithPrincipal(ctx, remote)
+}
+
+// the connections of a server on a listener, for the graceful shutdown of
+// the protocols
+type connSet struct {
+	closing atomic.Bool
+	mu      sync.Mutex
+	ln      net.Listener
+	conns   map[net.Conn]struct{}
+	wg      sync.WaitGroup
+}
+
+// accept connections and run handle for each until shutdown, then
+// net.ErrClosed is returned
+func (s *connSet) accept(l net.Listener, handle func(net.Conn)) error {
+	s.mu.Lock()
+	s.ln = l
+	s.mu.Unlock()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if s.closing.Load() {
+				return net.ErrClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !s.track(nc) {
+			nc.Close()
+			continue
+		}
+		go func() {
+			defer s.untrack(nc)
+			defer nc.Close()
+			handle(nc)
+		}()
+	}
+}
+
+// add a connection, false once closing
+func (s *connSet) track(nc net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing.Load() {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.conns[nc] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *connSet) untrack(nc net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, nc)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+func (s *connSet) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing.Store(true)
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	// the connections waiting for a command stop reading, those running
+	// one reply first
+	for nc := range s.conns {
+		nc.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for nc := range s.conns {
+		nc.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// the REST API of api, HTTPHandler or that of a Raft node, and the metrics
+// at /metrics: with -acl the ACL API at /acl too, behind the checks of the
+// credentials. The requests commit with the principal of the client.
+type httpServer struct {
+	srv *http.Server
+}
+
+func newHTTPServer(db *storage.DB, api http.Handler, acl *acl) *httpServer {
+	mux := http.NewServeMux()
+	mux.Handle("/", api)
+	mux.Handle("/metrics", db.MetricsHandler())
+	if acl == nil {
+		return &httpServer{&http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mux.ServeHTTP(w, r.WithContext(principal(r.Context(), "", r.RemoteAddr)))
+		})}}
+	}
+	mux.Handle("/acl", acl.handler())
+	mux.Handle("/acl/", acl.handler())
+	return &httpServer{&http.Server{Handler: acl.middleware(mux)}}
+}
+
+func (s *httpServer) serve(l net.Listener) error {
+	if err := s.srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return net.ErrClosed
+}
+
+func (s *httpServer) shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		s.srv.Close()
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// serve the HTTP API on a port of the loopback, shut down when the test is
+// over
+func startHTTP(t *testing.T, srv *httpServer) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.serve(l) }()
+	t.Cleanup(func() {
+		srv.shutdown(context.Background())
+		if err := <-done; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("serve: %v", err)
+		}
+	})
+	return "http://" + l.Addr().String()
+}
+
+func TestHTTPServer(t *testing.T) {
+	db := openTestDB(t)
+	url := startHTTP(t, newHTTPServer(db, db.HTTPHandler(), nil))
+	req, _ := http.NewRequest("PUT", url+"/kv/a", strings.NewReader("b"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("put: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	if v, _, _ := db.Get([]byte("a")); string(v) != "b" {
+		t.Fatalf("a is %q", v)
+	}
+	resp, err = http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(metrics), "commits_total") {
+		t.Fatalf("metrics\n%s", metrics)
+	}
+	// no ACL API without -acl
+	resp, err = http.Get(url + "/acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("/acl without -acl: %d", resp.StatusCode)
+	}
+}
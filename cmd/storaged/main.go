@@ -0,0 +1,328 @@
+// Command storaged serves a database over the network.
+//
+//	storaged [flags] <db>
+//
+// It speaks the Redis protocol, RESP, on -resp: GET, SET with EX, PX,
+// EXAT, PXAT, KEEPTTL, NX, XX and GET, DEL, EXISTS, MGET, TTL, PTTL and
+// SCAN with MATCH and COUNT, plus PING, ECHO, SELECT and QUIT, so that
+// Redis clients can use it. Every command is a transaction, committed with
+// the sync policy of -sync before the reply. Commands can be pipelined.
+// SELECT 0 runs the commands on the keys outside buckets, the default, and
+// SELECT <bucket> on those of the bucket, without expiry.
+//
+// It speaks the memcached text protocol on -memcache: get, set, add,
+// replace, append, prepend, delete, incr, decr and touch, the exptime of
+// memcached is the expiry of the key. The flags are kept in a bucket, and
+// gets and cas are answered ERROR, the keys having no cas unique.
+//
+// It serves the REST API of DB.HTTPHandler on -http, with the metrics at
+// /metrics. Its /changes stream catches up from the WAL segments kept as
+// well.
+//
+// It streams its commits to the followers connecting to -replication, who
+// catch up from the WAL segments kept up to -wal-archive bytes. With
+// -follow it's a replica of the primary at that address, serving reads
+// while it applies the commits, with the lag in the stats: see
+// DB.ServeReplication and WithReplicaOf. storagectl backup -from copies
+// it from -replication too, from a machine without access to its files.
+// Given -wal-archive alone, the segments are kept for the incremental
+// backups and storagectl restore -wal.
+//
+// Built with the raft tag, after go get of github.com/hashicorp/raft, -raft
+// makes it a node of a Raft cluster at that address, its log and snapshots
+// in -raft-dir: see storage.FSM. The nodes of -raft-peers, given the same
+// list, bootstrap the cluster on their first start; the leader adds others
+// with PUT /raft/servers/{id} of -http. The writes of the REST API go
+// through the log of the leader, the followers reply 421 with the ID of the
+// leader, and the reads are served by any node, by the leader after the
+// logs committed before with ?consistent. Each node writes its DB through
+// Raft only, so -resp, -memcache and -follow are refused.
+//
+// With -tls-cert and -tls-key every protocol is served over TLS only, and
+// with -tls-client-ca the clients must present a certificate signed by one
+// of its CAs. On SIGHUP the files are loaded again, for the connections to
+// come. With -tls-ca it follows the primary over TLS, checking its
+// certificate with those CAs and presenting that of -tls-cert if given.
+//
+// With -acl the clients log in as a user of that file, a line per user of
+//
+//	<user> <none | read-only | read-write | admin> <hash of the secret> [<bucket>=<role> ...]
+//
+// the secret being a password, its hash salted by PBKDF2 that storaged
+// -hash-secret prints for a password on stdin, or a token given alone or
+// with the user, that storaged -new-token prints with its hash, the grants of buckets replacing the role in those: a user with role none and
+// a grant of a bucket has that bucket only, for servers shared by
+// applications. Only RESP reaches the buckets, memcached and the REST API
+// serve the keys outside them, and /changes, streaming the buckets as
+// well, is refused to the users with a grant of none. They log in with
+// AUTH [user] secret on RESP, with a set whose data is "<user> <password>"
+// first on memcached as memcached -Y does, with Basic auth or a Bearer
+// token over HTTP, or with a client certificate of -tls-client-ca whose
+// common name is a user. A host failing ACL_LOGIN_BURST logins is refused
+// those past ACL_LOGIN_RATE a second. The role is checked before each
+// command. The admins edit the file with the ACL API /acl of -http, and
+// SIGHUP loads it again. The followers of -replication are checked by -tls-client-ca only.
+//
+// With -audit each commit adds an entry to the audit log of the database,
+// see WithAuditLog: the keys it changed and the client, the user logged in
+// at the address of the connection. The admins read it at /audit of -http.
+//
+// On SIGINT or SIGTERM it stops accepting connections, runs the commands
+// received already and closes the database, waiting up to
+// -shutdown-timeout for the clients.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// a protocol served on a listener
+type server interface {
+	// accept connections until shutdown, then net.ErrClosed is returned
+	serve(l net.Listener) error
+	// stop accepting and wait for the connections to end, those still open
+	// when ctx is done are closed
+	shutdown(ctx context.Context) error
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "storaged: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("storaged", flag.ContinueOnError)
+	respAddr := fs.String("resp", ":6379", "address of the Redis protocol, none if empty")
+	memcacheAddr := fs.String("memcache", "", "address of the memcached protocol, none if empty")
+	httpAddr := fs.String("http", "", "address of the REST API, none if empty")
+	replicationAddr := fs.String("replication", "", "address of the followers, none if empty")
+	archive := fs.Int64("wal-archive", 64<<20, "bytes of WAL segments kept for the followers and /changes")
+	primary := fs.String("follow", "", "address of the replication of the primary to follow")
+	syncPolicy := fs.String("sync", "always", "sync policy: always, interval or never")
+	timeout := fs.Duration("shutdown-timeout", 10*time.Second, "time left to the clients on shutdown")
+	certFile := fs.String("tls-cert", "", "PEM file of the certificate of the servers, TLS if set")
+	keyFile := fs.String("tls-key", "", "PEM file of the key of -tls-cert")
+	clientCAFile := fs.String("tls-client-ca", "", "PEM file of the CAs of the client certificates, required if set")
+	primaryCAFile := fs.String("tls-ca", "", "PEM file of the CAs of the primary of -follow, TLS to it if set")
+	aclFile := fs.String("acl", "", "file of the users, their roles and the hashes of their secrets, login required if set")
+	audit := fs.Bool("audit", false, "keep the audit log of the commits, who changed which keys")
+	scrub := fs.Duration("scrub-interval", 0, "pause between the passes of the scrubber verifying the pages, none if 0")
+	scrubRate := fs.Int("scrub-rate", storage.DEFAULT_SCRUB_RATE, "pages per second read by the scrubber")
+	secureDelete := fs.Bool("secure-delete", false, "zero the pages of the database freed by the commits, see WithSecureDelete")
+	verbose := fs.Bool("v", false, "log the connections")
+	hash := fs.Bool("hash-secret", false, "print the hash for -acl of the password of the first line of stdin, then exit")
+	token := fs.Bool("new-token", false, "print a new token then its hash for -acl, then exit")
+	rc := raftFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: storaged [flags] <db>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *hash {
+		return printSecretHash(os.Stdin, os.Stdout)
+	}
+	if *token {
+		return printNewToken(os.Stdout)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("wrong number of arguments")
+	}
+	if rc.enabled() {
+		// only the FSM writes the DB of a node
+		var conflict string
+		fs.Visit(func(f *flag.Flag) {
+			if (f.Name == "resp" || f.Name == "memcache" || f.Name == "follow") && f.Value.String() != "" {
+				conflict = f.Name
+			}
+		})
+		if conflict != "" {
+			return fmt.Errorf("-%s with -raft: a node serves the REST API of -http only", conflict)
+		}
+		*respAddr = ""
+	}
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	opts := []storage.Option{storage.WithSlog(log.Handler())}
+	switch *syncPolicy {
+	case "always":
+		opts = append(opts, storage.WithSyncPolicy(storage.SyncAlways))
+	case "interval":
+		opts = append(opts, storage.WithSyncPolicy(storage.SyncInterval))
+	case "never":
+		opts = append(opts, storage.WithSyncPolicy(storage.SyncNever))
+	default:
+		return fmt.Errorf("unknown sync policy %q", *syncPolicy)
+	}
+	if *audit {
+		opts = append(opts, storage.WithAuditLog())
+	}
+	if *secureDelete {
+		opts = append(opts, storage.WithSecureDelete())
+	}
+	var cert *storage.TLSCertificate
+	if *certFile != "" || *keyFile != "" {
+		var err error
+		if cert, err = storage.LoadTLSCertificate(*certFile, *keyFile, *clientCAFile); err != nil {
+			return err
+		}
+	} else if *clientCAFile != "" {
+		return errors.New("-tls-client-ca needs -tls-cert and -tls-key")
+	}
+	var users *acl
+	if *aclFile != "" {
+		var err error
+		if users, err = loadACL(*aclFile); err != nil {
+			return err
+		}
+	}
+	if *primary != "" {
+		opts = append(opts, storage.WithReplicaOf(*primary))
+		if *primaryCAFile != "" {
+			cfg, err := storage.TLSClientConfig(*primaryCAFile, cert)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, storage.WithReplicationTLS(cfg))
+		}
+	}
+	archived := *replicationAddr != "" || *httpAddr != ""
+	fs.Visit(func(f *flag.Flag) { archived = archived || f.Name == "wal-archive" })
+	if archived {
+		opts = append(opts, storage.WithWALArchiveSize(*archive))
+	}
+	opts = append(opts, storage.WithScrubInterval(*scrub), storage.WithScrubRate(*scrubRate))
+	db, err := storage.Open(fs.Arg(0), opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	api := db.HTTPHandler()
+	if rc.enabled() {
+		node, err := rc.start(db, fs.Arg(0), log)
+		if err != nil {
+			return err
+		}
+		defer node.close()
+		api = node.handler(api)
+	}
+
+	servers := []struct {
+		name string
+		addr string
+		srv  server
+	}{
+		{"resp", *respAddr, newRESPServer(db, users, log)},
+		{"memcache", *memcacheAddr, newMemcacheServer(db, users, log)},
+		{"http", *httpAddr, newHTTPServer(db, api, users)},
+		{"replication", *replicationAddr, newReplicationServer(db)},
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cert != nil || users != nil {
+		go reloadOnHangup(ctx, cert, users, log)
+	}
+	errc := make(chan error, len(servers))
+	var running []server
+	for _, s := range servers {
+		if s.addr == "" {
+			continue
+		}
+		l, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			shutdown(running, *timeout)
+			return err
+		}
+		if cert != nil {
+			l = tls.NewListener(l, cert.ServerConfig())
+		}
+		log.Info("listening", "protocol", s.name, "addr", l.Addr().String(), "tls", cert != nil)
+		running = append(running, s.srv)
+		go func(srv server) {
+			if err := srv.serve(l); !errors.Is(err, net.ErrClosed) {
+				errc <- err
+			}
+		}(s.srv)
+	}
+	if len(running) == 0 && *primary == "" && !rc.enabled() {
+		return errors.New("no address to listen on")
+	}
+	select {
+	case <-ctx.Done():
+		log.Info("shutting down")
+	case err = <-errc:
+	}
+	if serr := shutdown(running, *timeout); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// load the certificate and the ACL again on each SIGHUP until ctx is done,
+// either may be nil
+func reloadOnHangup(ctx context.Context, cert *storage.TLSCertificate, users *acl, log *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if cert != nil {
+				if err := cert.Reload(); err != nil {
+					log.Error("tls certificate not reloaded", "err", err)
+				} else {
+					log.Info("tls certificate reloaded")
+				}
+			}
+			if users != nil {
+				if err := users.reload(); err != nil {
+					log.Error("acl not reloaded", "err", err)
+				} else {
+					log.Info("acl reloaded")
+				}
+			}
+		}
+	}
+}
+
+// shut the servers down together
+func shutdown(servers []server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s server) {
+			defer wg.Done()
+			errs[i] = s.shutdown(ctx)
+		}(i, s)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
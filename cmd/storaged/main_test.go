@@ -0,0 +1,23 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunTLSFlags(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	for _, c := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-tls-client-ca", filepath.Join(dir, "ca.pem")}, "-tls-client-ca needs -tls-cert and -tls-key"},
+		{[]string{"-tls-cert", filepath.Join(dir, "missing.pem"), "-tls-key", filepath.Join(dir, "missing.key")}, "tls certificate"},
+	} {
+		if err := run(append(c.args, path)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("run %q: %v, want %s", c.args, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+const (
+	MEMCACHE_MAX_KEY      = 250            // bytes of a key, those of memcached
+	MEMCACHE_MAX_RELATIVE = 30 * 24 * 3600 // seconds of an exptime relative to now, a Unix time above
+)
+
+// the bucket of the flags of the keys set with non-zero flags, the values
+// themselves are the keys outside buckets like with RESP
+var MEMCACHE_FLAGS_BUCKET = []byte("memcached flags")
+
+// the memcached text protocol
+type memcacheServer struct {
+	connSet
+	db  *storage.DB
+	acl *acl // nil without -acl
+	log *slog.Logger
+}
+
+func newMemcacheServer(db *storage.DB, acl *acl, log *slog.Logger) *memcacheServer {
+	return &memcacheServer{db: db, acl: acl, log: log}
+}
+
+func (s *memcacheServer) serve(l net.Listener) error {
+	return s.accept(l, s.handle)
+}
+
+type memcacheConn struct {
+	srv    *memcacheServer
+	r      *bufio.Reader
+	w      *bufio.Writer
+	remote net.Addr
+	user   string          // logged in with a set or a client certificate
+	ctx    context.Context // of the writes, with the principal of the client
+}
+
+// errMemcacheClient is a bad command, replied with CLIENT_ERROR
+type errMemcacheClient string
+
+func (e errMemcacheClient) Error() string {
+	return string(e)
+}
+
+func (s *memcacheServer) handle(nc net.Conn) {
+	s.log.Debug("connection", "remote", nc.RemoteAddr().String(), "protocol", "memcache")
+	c := &memcacheConn{srv: s, remote: nc.RemoteAddr(), r: bufio.NewReaderSize(nc, RESP_BUFFER), w: bufio.NewWriterSize(nc, RESP_BUFFER)}
+	c.login(s.acl.certUser(nc))
+	for {
+		line, err := readLine(c.r)
+		if errors.Is(err, errProtocol) {
+			c.w.WriteString("CLIENT_ERROR line too long\r\n")
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !s.closing.Load() {
+				s.log.Debug("connection closed", "remote", nc.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+		quit, err := c.exec(bytes.Fields(line))
+		var client errMemcacheClient
+		switch {
+		case errors.As(err, &client):
+			fmt.Fprintf(c.w, "CLIENT_ERROR %s\r\n", client)
+		case err != nil:
+			fmt.Fprintf(c.w, "SERVER_ERROR %s\r\n", err)
+		}
+		if quit || c.r.Buffered() == 0 {
+			if c.w.Flush() != nil || quit || s.closing.Load() {
+				return
+			}
+		}
+	}
+}
+
+// run a command, true if the connection is to be closed: after quit, or a
+// data block that doesn't end where it should
+func (c *memcacheConn) exec(args [][]byte) (quit bool, err error) {
+	if len(args) == 0 {
+		c.w.WriteString("ERROR\r\n")
+		return false, nil
+	}
+	name, args := string(args[0]), args[1:]
+	noreply := len(args) > 0 && string(args[len(args)-1]) == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	reply := func(s string) {
+		if !noreply {
+			c.w.WriteString(s + "\r\n")
+		}
+	}
+	have := c.srv.acl.role(c.user, nil)
+	switch name {
+	case "get":
+		if len(args) == 0 {
+			c.w.WriteString("ERROR\r\n")
+			return false, nil
+		}
+		if have < roleRead {
+			return false, c.denied()
+		}
+		return false, c.get(args)
+	case "set", "add", "replace", "append", "prepend":
+		if len(args) != 4 {
+			c.w.WriteString("ERROR\r\n")
+			return false, nil
+		}
+		if have < roleWrite {
+			return c.refuse(name, args)
+		}
+		return c.store(name, args, reply)
+	case "delete":
+		if len(args) != 1 {
+			c.w.WriteString("ERROR\r\n")
+			return false, nil
+		}
+		if have < roleWrite {
+			return false, c.denied()
+		}
+		return false, c.delete(args[0], reply)
+	case "incr", "decr":
+		if len(args) != 2 {
+			c.w.WriteString("ERROR\r\n")
+			return false, nil
+		}
+		if have < roleWrite {
+			return false, c.denied()
+		}
+		return false, c.incr(name == "incr", args[0], args[1], reply)
+	case "touch":
+		if len(args) != 2 {
+			c.w.WriteString("ERROR\r\n")
+			return false, nil
+		}
+		if have < roleWrite {
+			return false, c.denied()
+		}
+		return false, c.touch(args[0], args[1], reply)
+	case "version":
+		c.w.WriteString("VERSION storaged\r\n")
+	case "verbosity":
+		reply("OK")
+	case "quit":
+		return true, nil
+	default:
+		// gets and cas among them, the keys have no cas unique
+		c.w.WriteString("ERROR\r\n")
+	}
+	return false, nil
+}
+
+// VALUE <key> <flags> <bytes> per key present, from one snapshot
+func (c *memcacheConn) get(keys [][]byte) error {
+	tx, err := c.srv.db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	flags, err := tx.Bucket(MEMCACHE_FLAGS_BUCKET)
+	if err != nil && !errors.Is(err, storage.ErrBucketNotFound) {
+		return err
+	}
+	var out bytes.Buffer
+	for _, key := range keys {
+		if err := checkMemcacheKey(key); err != nil {
+			return err
+		}
+		value, ok, err := tx.Get(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		f, err := memcacheFlags(flags, key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&out, "VALUE %s %d %d\r\n", key, f, len(value))
+		out.Write(value)
+		out.WriteString("\r\n")
+	}
+	// nothing is written on error
+	out.WriteString("END\r\n")
+	_, err = c.w.Write(out.Bytes())
+	return err
+}
+
+// <command> <key> <flags> <exptime> <bytes>, then the data block
+func (c *memcacheConn) store(cmd string, args [][]byte, reply func(string)) (quit bool, err error) {
+	key := args[0]
+	flags, ferr := strconv.ParseUint(string(args[1]), 10, 32)
+	exptime, eerr := strconv.ParseInt(string(args[2]), 10, 64)
+	size, serr := strconv.Atoi(string(args[3]))
+	if ferr != nil || eerr != nil || serr != nil || size < 0 || size > RESP_MAX_BULK {
+		return true, errMemcacheClient("bad command line format")
+	}
+	data, err := c.readBlock(size)
+	if err != nil {
+		return true, err
+	}
+	if err := checkMemcacheKey(key); err != nil {
+		return false, err
+	}
+	stored, err := c.update(func(tx *storage.Tx) (bool, error) {
+		old, found, err := tx.Get(key)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case cmd == "add" && found,
+			cmd != "set" && cmd != "add" && !found:
+			return false, nil
+		case cmd == "append":
+			data = append(bytes.Clone(old), data...)
+		case cmd == "prepend":
+			data = append(data, old...)
+		}
+		at := memcacheExpiry(exptime)
+		if cmd == "append" || cmd == "prepend" {
+			// the flags and the expiry are kept
+			at, err = tx.Expiry(key)
+			if err != nil {
+				return false, err
+			}
+			return true, setMemcache(tx, key, data, at)
+		}
+		if err := setMemcacheFlags(tx, key, uint32(flags)); err != nil {
+			return false, err
+		}
+		return true, setMemcache(tx, key, data, at)
+	})
+	if err != nil {
+		return false, err
+	}
+	if stored {
+		reply("STORED")
+	} else {
+		reply("NOT_STORED")
+	}
+	return false, nil
+}
+
+// the data block of size bytes of a storage command
+func (c *memcacheConn) readBlock(size int) ([]byte, error) {
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		return nil, errMemcacheClient("bad data chunk")
+	}
+	return data[:size], nil
+}
+
+// skip the data block of a storage command the user can't run, unless it's
+// the login of the ASCII authentication of memcached: a set before any
+// other, its data "<user> <password>" or a token
+func (c *memcacheConn) refuse(cmd string, args [][]byte) (quit bool, err error) {
+	size, err := strconv.Atoi(string(args[3]))
+	if err != nil || size < 0 || size > RESP_MAX_BULK {
+		return true, errMemcacheClient("bad command line format")
+	}
+	data, err := c.readBlock(size)
+	if err != nil {
+		return true, err
+	}
+	if c.srv.acl.known(c.user) || cmd != "set" {
+		return false, c.denied()
+	}
+	name, secret, ok := strings.Cut(string(data), " ")
+	if !ok {
+		name, secret = "", name
+	}
+	user, ok := c.srv.acl.login(c.remote.String(), name, secret)
+	if !ok {
+		return false, errMemcacheClient("authentication failure")
+	}
+	c.login(user)
+	c.w.WriteString("STORED\r\n")
+	return false, nil
+}
+
+func (c *memcacheConn) login(user string) {
+	c.user, c.ctx = user, principal(context.Background(), user, c.remote.String())
+}
+
+// the error of a command the user can't run
+func (c *memcacheConn) denied() error {
+	if !c.srv.acl.known(c.user) {
+		return errMemcacheClient("unauthenticated")
+	}
+	return errMemcacheClient("permission denied")
+}
+
+func (c *memcacheConn) delete(key []byte, reply func(string)) error {
+	if err := checkMemcacheKey(key); err != nil {
+		return err
+	}
+	deleted, err := c.update(func(tx *storage.Tx) (bool, error) {
+		deleted, err := tx.Del(key)
+		if err != nil || !deleted {
+			return false, err
+		}
+		return true, setMemcacheFlags(tx, key, 0)
+	})
+	if err != nil {
+		return err
+	}
+	if deleted {
+		reply("DELETED")
+	} else {
+		reply("NOT_FOUND")
+	}
+	return nil
+}
+
+// incr or decr a decimal value, keeping its expiry: incr wraps at 2^64,
+// decr stops at 0
+func (c *memcacheConn) incr(incr bool, key, delta []byte, reply func(string)) error {
+	if err := checkMemcacheKey(key); err != nil {
+		return err
+	}
+	n, err := strconv.ParseUint(string(delta), 10, 64)
+	if err != nil {
+		return errMemcacheClient("invalid numeric delta argument")
+	}
+	var value uint64
+	found, err := c.update(func(tx *storage.Tx) (bool, error) {
+		old, found, err := tx.Get(key)
+		if err != nil || !found {
+			return false, err
+		}
+		if value, err = strconv.ParseUint(string(bytes.TrimRight(old, " ")), 10, 64); err != nil {
+			return false, errMemcacheClient("cannot increment or decrement non-numeric value")
+		}
+		switch {
+		case incr:
+			value += n
+		case value < n:
+			value = 0
+		default:
+			value -= n
+		}
+		at, err := tx.Expiry(key)
+		if err != nil {
+			return false, err
+		}
+		return true, setMemcache(tx, key, strconv.AppendUint(nil, value, 10), at)
+	})
+	if err != nil {
+		return err
+	}
+	if found {
+		reply(strconv.FormatUint(value, 10))
+	} else {
+		reply("NOT_FOUND")
+	}
+	return nil
+}
+
+func (c *memcacheConn) touch(key, expiry []byte, reply func(string)) error {
+	if err := checkMemcacheKey(key); err != nil {
+		return err
+	}
+	exptime, err := strconv.ParseInt(string(expiry), 10, 64)
+	if err != nil {
+		return errMemcacheClient("invalid exptime argument")
+	}
+	found, err := c.update(func(tx *storage.Tx) (bool, error) {
+		value, found, err := tx.Get(key)
+		if err != nil || !found {
+			return false, err
+		}
+		return true, setMemcache(tx, key, bytes.Clone(value), memcacheExpiry(exptime))
+	})
+	if err != nil {
+		return err
+	}
+	if found {
+		reply("TOUCHED")
+	} else {
+		reply("NOT_FOUND")
+	}
+	return nil
+}
+
+// run fn in a write Tx, committed if it returns true
+func (c *memcacheConn) update(fn func(tx *storage.Tx) (bool, error)) (bool, error) {
+	tx, err := c.srv.db.BeginContext(c.ctx, true)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	ok, err := fn(tx)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// the deadline of an exptime: none if 0, seconds from now up to
+// MEMCACHE_MAX_RELATIVE, a Unix time above, and expired if negative
+func memcacheExpiry(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Unix(0, 1)
+	case exptime <= MEMCACHE_MAX_RELATIVE:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	}
+	return time.Unix(exptime, 0)
+}
+
+// set a key until at, without expiry if zero
+func setMemcache(tx *storage.Tx, key, value []byte, at time.Time) error {
+	if at.IsZero() {
+		return tx.Set(key, value)
+	}
+	return tx.SetWithExpiry(key, value, at)
+}
+
+// the flags of a key, 0 if not in the bucket: those of the last set by
+// memcached, a set by another protocol keeps them
+func memcacheFlags(b *storage.Bucket, key []byte) (uint32, error) {
+	if b == nil {
+		return 0, nil
+	}
+	value, ok, err := b.Get(key)
+	if err != nil || !ok || len(value) != 4 {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(value), nil
+}
+
+// keep the flags of a key, only if not 0 so that most keys have no entry
+func setMemcacheFlags(tx *storage.Tx, key []byte, flags uint32) error {
+	b, err := tx.Bucket(MEMCACHE_FLAGS_BUCKET)
+	if errors.Is(err, storage.ErrBucketNotFound) {
+		if flags == 0 {
+			return nil
+		}
+		b, err = tx.CreateBucket(MEMCACHE_FLAGS_BUCKET)
+	}
+	if err != nil {
+		return err
+	}
+	if flags == 0 {
+		_, err := b.Del(key)
+		return err
+	}
+	return b.Set(key, binary.BigEndian.AppendUint32(nil, flags))
+}
+
+func checkMemcacheKey(key []byte) error {
+	if len(key) > MEMCACHE_MAX_KEY {
+		return errMemcacheClient("key too long")
+	}
+	for _, b := range key {
+		if b <= ' ' || b == 0x7f {
+			return errMemcacheClient("bad key")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func startMemcache(t *testing.T, db *storage.DB, acl *acl) (*memcacheServer, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newMemcacheServer(db, acl, testLog)
+	done := make(chan error, 1)
+	go func() { done <- srv.serve(l) }()
+	t.Cleanup(func() {
+		srv.shutdown(context.Background())
+		if err := <-done; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("serve: %v", err)
+		}
+	})
+	return srv, l.Addr().String()
+}
+
+// send each request, the reply read must be the one wanted
+func memcacheExchange(t *testing.T, nc net.Conn, exchanges [][2]string) {
+	t.Helper()
+	for _, ex := range exchanges {
+		if _, err := io.WriteString(nc, ex[0]); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(ex[1]))
+		nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(nc, got); err != nil || string(got) != ex[1] {
+			t.Fatalf("%q replied %q, want %q: %v", ex[0], got, ex[1], err)
+		}
+	}
+}
+
+func TestMemcache(t *testing.T) {
+	db := openTestDB(t)
+	_, addr := startMemcache(t, db, nil)
+	nc, _ := dialRESP(t, addr)
+	memcacheExchange(t, nc, [][2]string{
+		{"set a 5 0 5\r\nhello\r\n", "STORED\r\n"},
+		{"get a b\r\n", "VALUE a 5 5\r\nhello\r\nEND\r\n"},
+		{"add a 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"replace b 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"append a 0 0 3\r\n!!!\r\n", "STORED\r\n"},
+		{"prepend a 9 0 1\r\n>\r\n", "STORED\r\n"},
+		{"get a\r\n", "VALUE a 5 9\r\n>hello!!!\r\nEND\r\n"},
+		{"gets a\r\n", "ERROR\r\n"},
+		{"cas a 0 0 1 1\r\n", "ERROR\r\n"},
+		{"set n 0 100 2\r\n10\r\n", "STORED\r\n"},
+		{"incr n 5\r\n", "15\r\n"},
+		{"decr n 100\r\n", "0\r\n"},
+		{"incr n 18446744073709551615\r\n", "18446744073709551615\r\n"},
+		{"incr n 1\r\n", "0\r\n"},
+		{"incr a 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		{"incr n x\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n"},
+		{"incr zz 1\r\n", "NOT_FOUND\r\n"},
+		{"touch zz 0\r\n", "NOT_FOUND\r\n"},
+		{"delete a\r\n", "DELETED\r\n"},
+		{"delete a\r\n", "NOT_FOUND\r\n"},
+		{"get a\r\n", "END\r\n"},
+		{"set q 0 -1 1 noreply\r\nx\r\n", ""},
+		{"get q\r\n", "END\r\n"},
+		{"set " + strings.Repeat("k", MEMCACHE_MAX_KEY+1) + " 0 0 1\r\nx\r\n", "CLIENT_ERROR key too long\r\n"},
+		{"get a\x7fb\r\n", "CLIENT_ERROR bad key\r\n"},
+		{"delete a\x7fb\r\n", "CLIENT_ERROR bad key\r\n"},
+		{"incr a\x01b 1\r\n", "CLIENT_ERROR bad key\r\n"},
+		{"decr " + strings.Repeat("k", MEMCACHE_MAX_KEY+1) + " 1\r\n", "CLIENT_ERROR key too long\r\n"},
+		{"touch " + strings.Repeat("k", MEMCACHE_MAX_KEY+1) + " 0\r\n", "CLIENT_ERROR key too long\r\n"},
+		{"foo\r\n", "ERROR\r\n"},
+		{"\r\n", "ERROR\r\n"},
+		{"get\r\n", "ERROR\r\n"},
+		{"set a 0 0\r\n", "ERROR\r\n"},
+		{"verbosity 1\r\n", "OK\r\n"},
+		{"version\r\n", "VERSION storaged\r\n"},
+	})
+	// the expiry kept by incr, the flags in their bucket
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	if at, _ := tx.Expiry([]byte("n")); at.Before(time.Now().Add(90*time.Second)) || at.After(time.Now().Add(100*time.Second)) {
+		t.Fatalf("n expires at %v", at)
+	}
+	if b, err := tx.Bucket(MEMCACHE_FLAGS_BUCKET); err != nil {
+		t.Fatal(err)
+	} else if _, ok, _ := b.Get([]byte("a")); ok {
+		t.Fatal("flags of a deleted key kept")
+	}
+
+	// a data block of the wrong size closes the connection
+	memcacheExchange(t, nc, [][2]string{{"set bad 0 0 2\r\nxyz\r\n", "CLIENT_ERROR bad data chunk\r\n"}})
+	if _, err := nc.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after a bad chunk: %v", err)
+	}
+	nc, _ = dialRESP(t, addr)
+	memcacheExchange(t, nc, [][2]string{{"quit\r\n", ""}})
+	if _, err := nc.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after quit: %v", err)
+	}
+}
+
+// the flags of a key set by another protocol are kept
+func TestMemcacheFlags(t *testing.T) {
+	db := openTestDB(t)
+	_, addr := startMemcache(t, db, nil)
+	nc, _ := dialRESP(t, addr)
+	memcacheExchange(t, nc, [][2]string{
+		{"set a 7 0 1\r\nx\r\n", "STORED\r\n"},
+		{"touch a 100\r\n", "TOUCHED\r\n"},
+	})
+	db.Set([]byte("a"), []byte("from resp"))
+	memcacheExchange(t, nc, [][2]string{
+		{"get a\r\n", "VALUE a 7 9\r\nfrom resp\r\nEND\r\n"},
+		{"set a 0 0 1\r\ny\r\n", "STORED\r\n"},
+		{"get a\r\n", "VALUE a 0 1\r\ny\r\nEND\r\n"},
+	})
+}
+
+func TestMemcacheExpiry(t *testing.T) {
+	now := time.Now()
+	if at := memcacheExpiry(0); !at.IsZero() {
+		t.Fatalf("exptime 0 expires at %v", at)
+	}
+	if at := memcacheExpiry(-1); !at.Before(now) {
+		t.Fatalf("exptime -1 expires at %v", at)
+	}
+	if at := memcacheExpiry(60); at.Sub(now) < 59*time.Second || at.Sub(now) > 61*time.Second {
+		t.Fatalf("exptime 60 expires at %v", at)
+	}
+	if at := memcacheExpiry(MEMCACHE_MAX_RELATIVE + 1); at.Unix() != MEMCACHE_MAX_RELATIVE+1 {
+		t.Fatalf("exptime of a Unix time expires at %v", at)
+	}
+}
+
+// a connection running a long command is closed once the context of the
+// shutdown is done
+func TestConnSetShutdown(t *testing.T) {
+	var s connSet
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.accept(l, func(nc net.Conn) {
+			nc.Read(make([]byte, 1))
+			<-release
+		})
+	}()
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.Write([]byte("x"))
+	for {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		close(release)
+	}()
+	if err := s.shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("accept: %v", err)
+	}
+	if _, err := nc.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection kept after shutdown")
+	}
+}
@@ -0,0 +1,381 @@
+//go:build raft
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// the header naming the leader in the replies of the followers to writes
+const RAFT_LEADER_HEADER = "Storage-Raft-Leader"
+
+// time left to Raft to commit a write or a barrier
+const raftTimeout = 10 * time.Second
+
+// the flags of a node of a Raft cluster, see storage.FSM
+type raftConfig struct {
+	addr  *string
+	id    *string
+	dir   *string
+	peers *string
+}
+
+func raftFlags(fs *flag.FlagSet) *raftConfig {
+	return &raftConfig{
+		addr:  fs.String("raft", "", "address of the Raft transport, a node of a cluster if set"),
+		id:    fs.String("raft-id", "", "ID of the node in the cluster, -raft if empty"),
+		dir:   fs.String("raft-dir", "", "directory of the Raft log and snapshots, <db>.raft if empty"),
+		peers: fs.String("raft-peers", "", "id=addr,... of the nodes bootstrapping the cluster, this one included"),
+	}
+}
+
+func (c *raftConfig) enabled() bool {
+	return *c.addr != ""
+}
+
+// a node of the cluster: the FSM writes db, the log and the stable store
+// are in a DB of their own under -raft-dir
+type raftNode struct {
+	id    raft.ServerID
+	r     *raft.Raft
+	store *storage.DB
+	trans *raft.NetworkTransport
+	db    *storage.DB
+}
+
+// start the node of db at path, bootstrapping the cluster of -raft-peers
+// if the node has no state yet
+func (c *raftConfig) start(db *storage.DB, path string, log *slog.Logger) (*raftNode, error) {
+	dir, id := *c.dir, *c.id
+	if dir == "" {
+		dir = path + ".raft"
+	}
+	if id == "" {
+		id = *c.addr
+	}
+	peers, err := parsePeers(*c.peers)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	out := raftLogWriter{log}
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(id)
+	conf.LogOutput = out
+	conf.LogLevel = "WARN"
+	if log.Enabled(context.Background(), slog.LevelDebug) {
+		conf.LogLevel = "INFO"
+	}
+	n := &raftNode{id: conf.LocalID, db: db}
+	// each log is synced before Raft counts it
+	if n.store, err = storage.Open(filepath.Join(dir, "raft.db"), storage.WithSyncPolicy(storage.SyncAlways), storage.WithSlog(log.Handler())); err != nil {
+		return nil, err
+	}
+	store, err := storage.NewRaftStore(n.store)
+	if err != nil {
+		n.store.Close()
+		return nil, err
+	}
+	snaps, err := raft.NewFileSnapshotStore(dir, 2, out)
+	if err != nil {
+		n.store.Close()
+		return nil, err
+	}
+	addr, err := net.ResolveTCPAddr("tcp", *c.addr)
+	if err != nil {
+		n.store.Close()
+		return nil, err
+	}
+	if n.trans, err = raft.NewTCPTransport(*c.addr, advertised(addr, peers[conf.LocalID]), 3, raftTimeout, out); err != nil {
+		n.store.Close()
+		return nil, err
+	}
+	if len(peers) > 0 {
+		existing, err := raft.HasExistingState(store, store, snaps)
+		if err == nil && !existing {
+			err = raft.BootstrapCluster(conf, store, store, snaps, n.trans, bootstrapConfig(peers, conf.LocalID, n.trans.LocalAddr()))
+		}
+		if err != nil {
+			n.close()
+			return nil, err
+		}
+	}
+	if n.r, err = raft.NewRaft(conf, storage.NewFSM(db), store, store, snaps, n.trans); err != nil {
+		n.close()
+		return nil, err
+	}
+	log.Info("raft started", "id", id, "addr", string(n.trans.LocalAddr()), "dir", dir)
+	return n, nil
+}
+
+// the id=addr,... of -raft-peers
+func parsePeers(s string) (map[raft.ServerID]raft.ServerAddress, error) {
+	peers := map[raft.ServerID]raft.ServerAddress{}
+	for _, peer := range strings.Split(s, ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(peer, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("bad raft peer %q, want id=addr", peer)
+		}
+		peers[raft.ServerID(id)] = raft.ServerAddress(addr)
+	}
+	return peers, nil
+}
+
+// the address given to the other nodes: that of the node in -raft-peers,
+// the address bound otherwise, which must not be unspecified
+func advertised(bound *net.TCPAddr, peer raft.ServerAddress) net.Addr {
+	if peer != "" {
+		if addr, err := net.ResolveTCPAddr("tcp", string(peer)); err == nil {
+			return addr
+		}
+	}
+	if bound.IP == nil || bound.IP.IsUnspecified() {
+		return nil
+	}
+	return bound
+}
+
+// the peers as voters, the node included at the address of its transport
+func bootstrapConfig(peers map[raft.ServerID]raft.ServerAddress, id raft.ServerID, addr raft.ServerAddress) raft.Configuration {
+	if _, ok := peers[id]; !ok {
+		peers[id] = addr
+	}
+	var conf raft.Configuration
+	for id, addr := range peers {
+		conf.Servers = append(conf.Servers, raft.Server{Suffrage: raft.Voter, ID: id, Address: addr})
+	}
+	return conf
+}
+
+func (n *raftNode) close() error {
+	var err error
+	if n.r != nil {
+		err = n.r.Shutdown().Error()
+	}
+	return errors.Join(err, n.trans.Close(), n.store.Close())
+}
+
+// the REST API of api, its writes of /kv/ replicated by Raft: they're
+// served by the leader only, the others reply 421 with the ID of the
+// leader in RAFT_LEADER_HEADER. The reads are those of the DB of the node,
+// up to date with the leader if the query has consistent. Then
+//
+//	GET    /raft                  the state of the node and the servers as JSON
+//	PUT    /raft/servers/{id}     add the node at the address of the body as a voter
+//	DELETE /raft/servers/{id}     remove the node from the cluster
+func (n *raftNode) handler(api http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/kv/"):
+			if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+				n.serveWrite(w, r, []byte(strings.TrimPrefix(r.URL.Path, "/kv/")))
+				return
+			}
+			if r.URL.Query().Has("consistent") && !n.barrier(w) {
+				return
+			}
+			api.ServeHTTP(w, r)
+		case r.URL.Path == "/raft":
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				w.Header().Set("Allow", http.MethodGet)
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			n.serveState(w)
+		case strings.HasPrefix(r.URL.Path, "/raft/servers/"):
+			n.serveServer(w, r, strings.TrimPrefix(r.URL.Path, "/raft/servers/"))
+		default:
+			api.ServeHTTP(w, r)
+		}
+	})
+}
+
+// whether the node is the leader, 421 is replied otherwise
+func (n *raftNode) leading(w http.ResponseWriter) bool {
+	if n.r.State() == raft.Leader {
+		return true
+	}
+	_, id := n.r.LeaderWithID()
+	if id != "" {
+		w.Header().Set(RAFT_LEADER_HEADER, string(id))
+	}
+	http.Error(w, raft.ErrNotLeader.Error(), http.StatusMisdirectedRequest)
+	return false
+}
+
+// wait for the FSM of the leader to apply the logs committed before
+func (n *raftNode) barrier(w http.ResponseWriter) bool {
+	if !n.leading(w) {
+		return false
+	}
+	if err := n.r.Barrier(raftTimeout).Error(); err != nil {
+		raftError(w, err)
+		return false
+	}
+	return true
+}
+
+// a PUT or DELETE of /kv/ as a batch of one op, the deadline of the ttl
+// computed by the leader. DELETE replies 204 whether the key was there or
+// not: the batch doesn't tell.
+func (n *raftNode) serveWrite(w http.ResponseWriter, r *http.Request, key []byte) {
+	if len(key) == 0 {
+		http.Error(w, storage.ErrEmptyKey.Error(), http.StatusBadRequest)
+		return
+	}
+	if !n.leading(w) {
+		return
+	}
+	var b storage.Batch
+	if r.Method == http.MethodDelete {
+		b.Del(key)
+	} else {
+		var at time.Time
+		if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+			d, err := time.ParseDuration(ttl)
+			if err != nil || d <= 0 {
+				http.Error(w, "bad ttl "+strconv.Quote(ttl), http.StatusBadRequest)
+				return
+			}
+			at = time.Now().Add(d)
+		}
+		// the FSM checks the size of the value, this bounds the log
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, storage.BTREE_MAX_VALUE_SIZE))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				raftError(w, storage.ErrValueTooLarge)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		if at.IsZero() {
+			b.Set(key, value)
+		} else {
+			b.SetWithExpiry(key, value, at)
+		}
+	}
+	if err := storage.ApplyBatch(n.r, &b, raftTimeout); err != nil {
+		raftError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type raftState struct {
+	ID      string            `json:"id"`
+	State   string            `json:"state"`
+	Leader  string            `json:"leader,omitempty"`
+	Servers []raftServer      `json:"servers"`
+	Stats   map[string]string `json:"stats"`
+}
+
+type raftServer struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Voter   bool   `json:"voter"`
+}
+
+func (n *raftNode) serveState(w http.ResponseWriter) {
+	f := n.r.GetConfiguration()
+	if err := f.Error(); err != nil {
+		raftError(w, err)
+		return
+	}
+	_, leader := n.r.LeaderWithID()
+	state := raftState{
+		ID:      string(n.id),
+		State:   n.r.State().String(),
+		Leader:  string(leader),
+		Servers: []raftServer{},
+		Stats:   n.r.Stats(),
+	}
+	for _, s := range f.Configuration().Servers {
+		state.Servers = append(state.Servers, raftServer{ID: string(s.ID), Address: string(s.Address), Voter: s.Suffrage == raft.Voter})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(state)
+}
+
+func (n *raftNode) serveServer(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if id == "" {
+		http.Error(w, "no server id", http.StatusBadRequest)
+		return
+	}
+	if !n.leading(w) {
+		return
+	}
+	var f raft.IndexFuture
+	if r.Method == http.MethodDelete {
+		f = n.r.RemoveServer(raft.ServerID(id), 0, raftTimeout)
+	} else {
+		addr, err := io.ReadAll(io.LimitReader(r.Body, 1<<10))
+		if err != nil || len(strings.TrimSpace(string(addr))) == 0 {
+			http.Error(w, "no server address", http.StatusBadRequest)
+			return
+		}
+		f = n.r.AddVoter(raft.ServerID(id), raft.ServerAddress(strings.TrimSpace(string(addr))), 0, raftTimeout)
+	}
+	if err := f.Error(); err != nil {
+		raftError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reply with the status of an error of Raft or of the FSM
+func raftError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, storage.ErrEmptyKey), errors.Is(err, storage.ErrKeyTooLarge):
+		code = http.StatusBadRequest
+	case errors.Is(err, storage.ErrValueTooLarge):
+		code = http.StatusRequestEntityTooLarge
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrLeadershipLost):
+		code = http.StatusMisdirectedRequest
+	case errors.Is(err, raft.ErrEnqueueTimeout), errors.Is(err, raft.ErrRaftShutdown):
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// the lines of the logger of Raft, logged with log
+type raftLogWriter struct {
+	log *slog.Logger
+}
+
+func (w raftLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.log.Info("raft", "log", line)
+	}
+	return len(p), nil
+}
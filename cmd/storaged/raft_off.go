@@ -0,0 +1,37 @@
+//go:build !raft
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// without the raft tag there's no -raft, storaged serves a DB alone
+type raftConfig struct{}
+
+func raftFlags(fs *flag.FlagSet) *raftConfig {
+	return &raftConfig{}
+}
+
+func (c *raftConfig) enabled() bool {
+	return false
+}
+
+type raftNode struct{}
+
+func (c *raftConfig) start(db *storage.DB, path string, log *slog.Logger) (*raftNode, error) {
+	return nil, errors.New("storaged built without the raft tag")
+}
+
+func (n *raftNode) close() error {
+	return nil
+}
+
+func (n *raftNode) handler(api http.Handler) http.Handler {
+	return api
+}
@@ -0,0 +1,222 @@
+//go:build raft
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// a node of the test cluster and the URL of its REST API
+type testNode struct {
+	db   *storage.DB
+	node *raftNode
+	url  string
+}
+
+// start a node of the flags, with its REST API on the loopback
+func startRaft(t *testing.T, args ...string) *testNode {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	rc := raftFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t)
+	node, err := rc.start(db, db.Path, testLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.close() })
+	return &testNode{db, node, startHTTP(t, newHTTPServer(db, node.handler(db.HTTPHandler()), nil))}
+}
+
+// addresses of the loopback free a moment ago
+func freeAddrs(t *testing.T, n int) []string {
+	var addrs []string
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs
+}
+
+func raftDo(t *testing.T, method, url, body string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func TestRaftNodes(t *testing.T) {
+	addrs := freeAddrs(t, 4)
+	peers := fmt.Sprintf("n0=%s,n1=%s,n2=%s", addrs[0], addrs[1], addrs[2])
+	var nodes []*testNode
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, startRaft(t, "-raft", addrs[i], "-raft-id", fmt.Sprint("n", i), "-raft-peers", peers))
+	}
+	leader := func() *testNode {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			for _, n := range nodes {
+				if n.node.r.State().String() == "Leader" {
+					return n
+				}
+			}
+		}
+		t.Fatal("no leader elected")
+		return nil
+	}
+	l := leader()
+	var follower *testNode
+	for _, n := range nodes {
+		if n != l {
+			follower = n
+		}
+	}
+
+	// the followers send the writes to the leader
+	resp, _ := raftDo(t, "PUT", follower.url+"/kv/a", "1")
+	if resp.StatusCode != http.StatusMisdirectedRequest || resp.Header.Get(RAFT_LEADER_HEADER) != string(l.node.id) {
+		t.Fatalf("put to a follower: %d, leader %q", resp.StatusCode, resp.Header.Get(RAFT_LEADER_HEADER))
+	}
+	if resp, body := raftDo(t, "GET", follower.url+"/kv/a?consistent", ""); resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Fatalf("consistent get from a follower: %d %s", resp.StatusCode, body)
+	}
+	for _, put := range [][2]string{{"/kv/a", "1"}, {"/kv/b", "2"}, {"/kv/t?ttl=1h", "x"}} {
+		if resp, body := raftDo(t, "PUT", l.url+put[0], put[1]); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("put %s: %d %s", put[0], resp.StatusCode, body)
+		}
+	}
+	for _, del := range []string{"/kv/b", "/kv/missing"} {
+		if resp, body := raftDo(t, "DELETE", l.url+del, ""); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("delete %s: %d %s", del, resp.StatusCode, body)
+		}
+	}
+	if resp, body := raftDo(t, "GET", l.url+"/kv/a?consistent", ""); resp.StatusCode != http.StatusOK || body != "1" {
+		t.Fatalf("consistent get from the leader: %d %q", resp.StatusCode, body)
+	}
+	for _, bad := range []struct {
+		path, body string
+		code       int
+	}{
+		{"/kv/a?ttl=-1s", "1", http.StatusBadRequest},
+		{"/kv/", "1", http.StatusBadRequest},
+		{"/kv/a", strings.Repeat("x", storage.BTREE_MAX_VALUE_SIZE+1), http.StatusRequestEntityTooLarge},
+		{"/kv/" + strings.Repeat("k", 2000), "1", http.StatusBadRequest},
+	} {
+		if resp, body := raftDo(t, "PUT", l.url+bad.path, bad.body); resp.StatusCode != bad.code {
+			t.Fatalf("put %.20s: %d %s, want %d", bad.path, resp.StatusCode, body, bad.code)
+		}
+	}
+
+	// a node joining later catches up
+	late := startRaft(t, "-raft", addrs[3], "-raft-id", "n3")
+	if resp, body := raftDo(t, "PUT", follower.url+"/raft/servers/n3", addrs[3]); resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Fatalf("join through a follower: %d %s", resp.StatusCode, body)
+	}
+	if resp, body := raftDo(t, "PUT", l.url+"/raft/servers/n3", addrs[3]); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("join: %d %s", resp.StatusCode, body)
+	}
+	nodes = append(nodes, late)
+	for _, n := range nodes {
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+			v, _, _ := n.db.Get([]byte("t"))
+			if string(v) == "x" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("t not replicated to %s", n.node.id)
+			}
+		}
+		if v, _, _ := n.db.Get([]byte("a")); string(v) != "1" {
+			t.Fatalf("a of %s is %q", n.node.id, v)
+		}
+		if _, ok, _ := n.db.Get([]byte("b")); ok {
+			t.Fatalf("b of %s not deleted", n.node.id)
+		}
+		if resp, _ := raftDo(t, "GET", n.url+"/kv/t", ""); resp.Header.Get(storage.HTTP_EXPIRES_HEADER) == "" {
+			t.Fatalf("ttl of the leader lost on %s", n.node.id)
+		}
+	}
+
+	resp, body := raftDo(t, "GET", late.url+"/raft", "")
+	var state raftState
+	if err := json.Unmarshal([]byte(body), &state); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("state: %d %v\n%s", resp.StatusCode, err, body)
+	}
+	if state.ID != "n3" || state.State != "Follower" || state.Leader != string(l.node.id) || len(state.Servers) != 4 {
+		t.Fatalf("state %+v", state)
+	}
+	if resp, body := raftDo(t, "DELETE", l.url+"/raft/servers/n3", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("remove: %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := raftDo(t, "POST", l.url+"/raft", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("post of /raft: %d", resp.StatusCode)
+	}
+}
+
+// the state of a node survives a restart, without bootstrapping again
+func TestRaftRestart(t *testing.T) {
+	addr := freeAddrs(t, 1)[0]
+	dir := t.TempDir()
+	args := []string{"-raft", addr, "-raft-dir", dir, "-raft-peers", "n0=" + addr, "-raft-id", "n0"}
+	n := startRaft(t, args...)
+	for deadline := time.Now().Add(10 * time.Second); n.node.r.State().String() != "Leader"; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader elected")
+		}
+	}
+	if resp, body := raftDo(t, "PUT", n.url+"/kv/a", "1"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("put: %d %s", resp.StatusCode, body)
+	}
+	if err := n.node.close(); err != nil {
+		t.Fatal(err)
+	}
+	n = startRaft(t, args...)
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if v, _, _ := n.db.Get([]byte("a")); string(v) == "1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the log not applied again after the restart")
+		}
+	}
+}
+
+func TestRunRaftConflicts(t *testing.T) {
+	path := t.TempDir() + "/test.db"
+	for _, args := range [][]string{
+		{"-raft", "127.0.0.1:0", "-resp", ":0", path},
+		{"-raft", "127.0.0.1:0", "-resp", "", "-memcache", ":0", path},
+		{"-raft", "127.0.0.1:0", "-follow", "127.0.0.1:1", path},
+	} {
+		if err := run(args); err == nil || !strings.Contains(err.Error(), "with -raft") {
+			t.Fatalf("run %q: %v", args, err)
+		}
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	rc := raftFlags(fs)
+	fs.Parse([]string{"-raft", "127.0.0.1:0", "-raft-peers", "n0"})
+	if _, err := rc.start(nil, path, testLog); err == nil || !strings.Contains(err.Error(), "bad raft peer") {
+		t.Fatalf("start with a bad peer: %v", err)
+	}
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+const (
+	SCAN_COUNT   = 10   // keys walked by SCAN without COUNT
+	SCAN_CURSORS = 4096 // cursors of SCAN kept, the oldest are forgotten
+)
+
+// a command: its arity, negative for at least -arity args with the name,
+// the role it needs on the keys selected with -acl and what it runs
+type redisCommand struct {
+	arity int
+	role  role
+	run   func(c *respConn, args [][]byte)
+}
+
+var redisCommands map[string]redisCommand
+
+func init() {
+	redisCommands = map[string]redisCommand{
+		"get":     {2, roleRead, (*respConn).get},
+		"set":     {-3, roleWrite, (*respConn).set},
+		"del":     {-2, roleWrite, (*respConn).del},
+		"exists":  {-2, roleRead, (*respConn).exists},
+		"mget":    {-2, roleRead, (*respConn).mget},
+		"ttl":     {2, roleRead, func(c *respConn, args [][]byte) { c.ttl(args, time.Second) }},
+		"pttl":    {2, roleRead, func(c *respConn, args [][]byte) { c.ttl(args, time.Millisecond) }},
+		"scan":    {-2, roleRead, (*respConn).scan},
+		"ping":    {-1, roleNone, (*respConn).ping},
+		"echo":    {2, roleNone, func(c *respConn, args [][]byte) { c.bulk(args[1]) }},
+		"select":  {2, roleNone, (*respConn).selectDB},
+		"command": {-1, roleNone, func(c *respConn, args [][]byte) { c.array(0) }},
+		"auth":    {-2, roleNone, (*respConn).auth},
+	}
+}
+
+// run a command, true if the connection is to be closed
+func (c *respConn) exec(args [][]byte) (quit bool) {
+	name := strings.ToLower(string(args[0]))
+	if name == "quit" {
+		c.simple("OK")
+		return true
+	}
+	cmd, ok := redisCommands[name]
+	if !ok {
+		c.errorf("ERR unknown command '%s'", args[0])
+		return false
+	}
+	if cmd.arity > 0 && len(args) != cmd.arity || cmd.arity < 0 && len(args) < -cmd.arity {
+		c.errorf("ERR wrong number of arguments for '%s' command", name)
+		return false
+	}
+	if name != "auth" && !c.srv.acl.known(c.user) {
+		c.error("NOAUTH Authentication required.")
+		return false
+	}
+	if c.srv.acl.role(c.user, c.bucket) < cmd.role {
+		c.denied(name)
+		return false
+	}
+	cmd.run(c, args)
+	return false
+}
+
+func (c *respConn) denied(name string) {
+	if c.bucket == nil {
+		c.errorf("NOPERM User %s has no permissions to run the '%s' command", c.user, name)
+	} else {
+		c.errorf("NOPERM User %s has no permissions to run the '%s' command on bucket %s", c.user, name, c.bucket)
+	}
+}
+
+// the keys of the commands: those outside buckets, *storage.Tx, or those
+// of the bucket selected, *storage.Bucket
+type keySpace interface {
+	Get(key []byte) ([]byte, bool, error)
+	Set(key []byte, value []byte) error
+	Del(key []byte) (bool, error)
+	Cursor() *storage.Cursor
+}
+
+// the keys selected in tx, tx itself outside buckets
+func (c *respConn) keys(tx *storage.Tx) (keySpace, error) {
+	if c.bucket == nil {
+		return tx, nil
+	}
+	b, err := tx.Bucket(c.bucket)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// AUTH [user] secret, a token without the user
+func (c *respConn) auth(args [][]byte) {
+	if len(args) > 3 {
+		c.error("ERR syntax error")
+		return
+	}
+	if c.srv.acl == nil {
+		c.error("ERR AUTH called without any ACL configured")
+		return
+	}
+	name := ""
+	if len(args) == 3 {
+		name = string(args[1])
+	}
+	user, ok := c.srv.acl.login(c.remote.String(), name, string(args[len(args)-1]))
+	if !ok {
+		c.error("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	c.login(user)
+	c.simple("OK")
+}
+
+// reply with the error of the engine
+func (c *respConn) fail(err error) {
+	c.error("ERR " + err.Error())
+}
+
+func (c *respConn) get(args [][]byte) {
+	var value []byte
+	var ok bool
+	var err error
+	if c.bucket == nil {
+		value, ok, err = c.srv.db.Get(args[1])
+	} else {
+		err = c.srv.db.View(func(tx *storage.Tx) error {
+			keys, err := c.keys(tx)
+			if err != nil {
+				return err
+			}
+			value, ok, err = keys.Get(args[1])
+			value = bytes.Clone(value)
+			return err
+		})
+	}
+	switch {
+	case err != nil:
+		c.fail(err)
+	case !ok:
+		c.null()
+	default:
+		c.bulk(value)
+	}
+}
+
+// SET key value [NX | XX] [GET] [EX s | PX ms | EXAT s | PXAT ms | KEEPTTL]
+func (c *respConn) set(args [][]byte) {
+	var nx, xx, get, keepTTL bool
+	var at time.Time
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 == len(args) || !at.IsZero() {
+				c.error("ERR syntax error")
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || n <= 0 {
+				c.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			switch opt {
+			case "EX":
+				at = time.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				at = time.Now().Add(time.Duration(n) * time.Millisecond)
+			case "EXAT":
+				at = time.Unix(n, 0)
+			case "PXAT":
+				at = time.UnixMilli(n)
+			}
+		default:
+			c.error("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx || keepTTL && !at.IsZero() {
+		c.error("ERR syntax error")
+		return
+	}
+	if c.bucket != nil && !at.IsZero() {
+		c.error("ERR the keys of buckets don't expire")
+		return
+	}
+	key, value := args[1], args[2]
+	tx, err := c.srv.db.BeginContext(c.ctx, true)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	defer tx.Rollback()
+	keys, err := c.keys(tx)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	old, found, err := keys.Get(key)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	old = bytes.Clone(old)
+	if nx && found || xx && !found {
+		if get {
+			c.reply(old, found)
+		} else {
+			c.null()
+		}
+		return
+	}
+	if keepTTL && found && c.bucket == nil {
+		if at, err = tx.Expiry(key); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+	if at.IsZero() {
+		err = keys.Set(key, value)
+	} else {
+		err = tx.SetWithExpiry(key, value, at)
+	}
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.fail(err)
+		return
+	}
+	if get {
+		c.reply(old, found)
+	} else {
+		c.simple("OK")
+	}
+}
+
+// a value or null
+func (c *respConn) reply(value []byte, ok bool) {
+	if ok {
+		c.bulk(value)
+	} else {
+		c.null()
+	}
+}
+
+func (c *respConn) del(args [][]byte) {
+	tx, err := c.srv.db.BeginContext(c.ctx, true)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	defer tx.Rollback()
+	keys, err := c.keys(tx)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	var n int64
+	for _, key := range args[1:] {
+		deleted, err := keys.Del(key)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if deleted {
+			n++
+		}
+	}
+	if n > 0 {
+		if err := tx.Commit(); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+	c.integer(n)
+}
+
+func (c *respConn) exists(args [][]byte) {
+	var n int64
+	err := c.srv.db.View(func(tx *storage.Tx) error {
+		keys, err := c.keys(tx)
+		if err != nil {
+			return err
+		}
+		for _, key := range args[1:] {
+			_, ok, err := keys.Get(key)
+			if err != nil {
+				return err
+			}
+			if ok {
+				n++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.integer(n)
+}
+
+// the values are read from one snapshot
+func (c *respConn) mget(args [][]byte) {
+	tx, err := c.srv.db.Begin(false)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	defer tx.Rollback()
+	keys, err := c.keys(tx)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	values := make([][]byte, len(args)-1)
+	found := make([]bool, len(args)-1)
+	for i, key := range args[1:] {
+		if values[i], found[i], err = keys.Get(key); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+	c.array(len(values))
+	for i, value := range values {
+		c.reply(value, found[i])
+	}
+}
+
+// the time left to the key in units, -2 if absent, -1 if it doesn't expire
+// as the keys of buckets
+func (c *respConn) ttl(args [][]byte, unit time.Duration) {
+	var left int64
+	err := c.srv.db.View(func(tx *storage.Tx) error {
+		keys, err := c.keys(tx)
+		if err != nil {
+			return err
+		}
+		_, ok, err := keys.Get(args[1])
+		if err != nil || !ok {
+			left = -2
+			return err
+		}
+		var at time.Time
+		if c.bucket == nil {
+			at, err = tx.Expiry(args[1])
+		}
+		switch {
+		case err != nil:
+			return err
+		case at.IsZero():
+			left = -1
+		default:
+			// rounded like Redis
+			left = int64((time.Until(at) + unit/2) / unit)
+		}
+		return nil
+	})
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.integer(left)
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+//
+// The keys are walked in order from the last key of the cursor, a key
+// present for the whole scan is returned once. A cursor is a number kept
+// by the server, the oldest of SCAN_CURSORS are forgotten.
+func (c *respConn) scan(args [][]byte) {
+	id, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		c.error("ERR invalid cursor")
+		return
+	}
+	var pattern []byte
+	count, none := SCAN_COUNT, false
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count < 1 {
+				c.error("ERR value is not an integer or out of range")
+				return
+			}
+		case "TYPE":
+			none = !strings.EqualFold(string(args[i+1]), "string")
+		default:
+			c.error("ERR syntax error")
+			return
+		}
+	}
+	var from []byte
+	if id != 0 {
+		var ok bool
+		if from, ok = c.srv.cursors.get(id); !ok {
+			c.error("ERR invalid cursor")
+			return
+		}
+	}
+	var keys [][]byte
+	var last []byte
+	err = c.srv.db.View(func(tx *storage.Tx) error {
+		space, err := c.keys(tx)
+		if err != nil {
+			return err
+		}
+		cur := space.Cursor()
+		key, _ := cur.Seek(from)
+		if from != nil && bytes.Equal(key, from) {
+			key, _ = cur.Next()
+		}
+		for n := 0; key != nil && n < count; n++ {
+			if !none && (pattern == nil || globMatch(pattern, key)) {
+				keys = append(keys, bytes.Clone(key))
+			}
+			last = key
+			key, _ = cur.Next()
+		}
+		if key == nil {
+			last = nil // the end
+		} else {
+			last = bytes.Clone(last)
+		}
+		return cur.Err()
+	})
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	next := uint64(0)
+	if last != nil {
+		next = c.srv.cursors.add(last)
+	}
+	c.array(2)
+	c.bulk([]byte(strconv.FormatUint(next, 10)))
+	c.array(len(keys))
+	for _, key := range keys {
+		c.bulk(key)
+	}
+}
+
+func (c *respConn) ping(args [][]byte) {
+	switch len(args) {
+	case 1:
+		c.simple("PONG")
+	case 2:
+		c.bulk(args[1])
+	default:
+		c.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// SELECT 0 for the keys outside buckets, SELECT <bucket> for those of a
+// bucket: created if the user can write to it
+func (c *respConn) selectDB(args [][]byte) {
+	if string(args[1]) == "0" {
+		c.bucket = nil
+		c.simple("OK")
+		return
+	}
+	bucket := bytes.Clone(args[1])
+	have := c.srv.acl.role(c.user, bucket)
+	if have < roleRead {
+		c.errorf("NOPERM User %s has no permissions to access bucket %s", c.user, bucket)
+		return
+	}
+	err := c.srv.db.View(func(tx *storage.Tx) error {
+		_, err := tx.Bucket(bucket)
+		return err
+	})
+	if errors.Is(err, storage.ErrBucketNotFound) && have >= roleWrite {
+		err = c.createBucket(bucket)
+	}
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.bucket = bucket
+	c.simple("OK")
+}
+
+func (c *respConn) createBucket(name []byte) error {
+	tx, err := c.srv.db.BeginContext(c.ctx, true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.CreateBucket(name)
+	if errors.Is(err, storage.ErrBucketExists) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// the last keys of the SCAN cursors by id
+type scanCursors struct {
+	mu    sync.Mutex
+	last  uint64
+	keys  map[uint64][]byte
+	order []uint64 // ids, the oldest first
+}
+
+func (s *scanCursors) add(key []byte) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = map[uint64][]byte{}
+	}
+	if len(s.order) == SCAN_CURSORS {
+		delete(s.keys, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.last++
+	s.keys[s.last] = key
+	s.order = append(s.order, s.last)
+	return s.last
+}
+
+func (s *scanCursors) get(id uint64) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[id]
+	return key, ok
+}
+
+// match a key against a Redis glob pattern: * and ? for any bytes and any
+// byte, [abc], [^a] and [a-z] for sets and \ to escape
+func globMatch(pattern, key []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if globMatch(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			end, ok := globSet(pattern, key[0])
+			if !ok {
+				return false
+			}
+			pattern, key = pattern[end:], key[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		}
+	}
+	return len(key) == 0
+}
+
+// whether b is in the set at the start of pattern, and where the set ends;
+// an unterminated set runs to the end of the pattern
+func globSet(pattern []byte, b byte) (int, bool) {
+	i, negate, match := 1, false, false
+	if i < len(pattern) && pattern[i] == '^' {
+		negate = true
+		i++
+	}
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			match = match || pattern[i] == b
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			match = match || lo <= b && b <= hi
+			i += 2
+		default:
+			match = match || pattern[i] == b
+		}
+	}
+	if i < len(pattern) {
+		i++ // the ]
+	}
+	return i, match != negate
+}
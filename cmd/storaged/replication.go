@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// the commits streamed to the followers by DB.ServeReplication
+type replicationServer struct {
+	db *storage.DB
+	mu sync.Mutex
+	l  net.Listener
+}
+
+func newReplicationServer(db *storage.DB) *replicationServer {
+	return &replicationServer{db: db}
+}
+
+func (s *replicationServer) serve(l net.Listener) error {
+	s.mu.Lock()
+	s.l = l
+	s.mu.Unlock()
+	return s.db.ServeReplication(l)
+}
+
+// closing the listener ends the streams, the followers connect again
+func (s *replicationServer) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.l == nil {
+		return nil
+	}
+	return s.l.Close()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplicationServer(t *testing.T) {
+	db := openTestDB(t)
+	db.Set([]byte("a"), []byte("1"))
+	srv := newReplicationServer(db)
+	if err := srv.shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown before serve: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.serve(l) }()
+
+	follower := openTestDB(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go follower.Follow(ctx, l.Addr().String())
+	for {
+		if v, _, _ := follower.Get([]byte("a")); string(v) == "1" {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal("a not replicated")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := srv.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("serve: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// the limits of a command, those of Redis
+const (
+	RESP_MAX_BULK   = 512 << 20
+	RESP_MAX_ARGS   = 1 << 20
+	RESP_MAX_INLINE = 64 << 10
+	RESP_BUFFER     = 64 << 10
+)
+
+// errProtocol is a malformed request, the connection is closed after the
+// error reply
+var errProtocol = errors.New("Protocol error")
+
+type respServer struct {
+	connSet
+	db      *storage.DB
+	log     *slog.Logger
+	acl     *acl // nil without -acl
+	cursors scanCursors
+}
+
+func newRESPServer(db *storage.DB, acl *acl, log *slog.Logger) *respServer {
+	return &respServer{db: db, acl: acl, log: log}
+}
+
+func (s *respServer) serve(l net.Listener) error {
+	return s.accept(l, s.handle)
+}
+
+// a client connection
+type respConn struct {
+	srv    *respServer
+	r      *bufio.Reader
+	w      *bufio.Writer
+	remote net.Addr
+	user   string          // logged in with AUTH or a client certificate
+	ctx    context.Context // of the writes, with the principal of the client
+	bucket []byte          // of SELECT, nil outside buckets
+}
+
+// run the commands of a connection, the replies of pipelined commands are
+// flushed once those read are run
+func (s *respServer) handle(nc net.Conn) {
+	s.log.Debug("connection", "remote", nc.RemoteAddr().String())
+	c := &respConn{srv: s, remote: nc.RemoteAddr(), r: bufio.NewReaderSize(nc, RESP_BUFFER), w: bufio.NewWriterSize(nc, RESP_BUFFER)}
+	c.login(s.acl.certUser(nc))
+	for {
+		args, err := readCommand(c.r)
+		if errors.Is(err, errProtocol) {
+			c.error(err.Error())
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !s.closing.Load() {
+				s.log.Debug("connection closed", "remote", nc.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := c.exec(args)
+		if quit || c.r.Buffered() == 0 {
+			if c.w.Flush() != nil {
+				return
+			}
+			if quit || s.closing.Load() {
+				return
+			}
+		}
+	}
+}
+
+func (c *respConn) login(user string) {
+	c.user, c.ctx = user, principal(context.Background(), user, c.remote.String())
+}
+
+// read a command, an array of bulk strings or an inline command
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > RESP_MAX_ARGS {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([][]byte, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > RESP_MAX_BULK {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated", errProtocol)
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// a line without its CRLF, a lone LF ends inline commands too
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if len(line) > RESP_MAX_INLINE {
+			return nil, fmt.Errorf("%w: too big inline request", errProtocol)
+		}
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+// the replies
+
+func (c *respConn) simple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *respConn) error(s string) {
+	c.w.WriteString("-" + s + "\r\n")
+}
+
+func (c *respConn) errorf(format string, args ...any) {
+	c.error(fmt.Sprintf(format, args...))
+}
+
+func (c *respConn) integer(n int64) {
+	c.w.WriteByte(':')
+	c.w.WriteString(strconv.FormatInt(n, 10))
+	c.w.WriteString("\r\n")
+}
+
+func (c *respConn) bulk(b []byte) {
+	c.w.WriteByte('$')
+	c.w.WriteString(strconv.Itoa(len(b)))
+	c.w.WriteString("\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (c *respConn) null() {
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *respConn) array(n int) {
+	c.w.WriteByte('*')
+	c.w.WriteString(strconv.Itoa(n))
+	c.w.WriteString("\r\n")
+}
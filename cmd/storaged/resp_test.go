@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+// a logger of the servers under test
+var testLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// open a database in a directory of the test, closed when it's over
+func openTestDB(t *testing.T) *storage.DB {
+	t.Helper()
+	db, err := storage.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// serve the Redis protocol on a port of the loopback, shut down when the
+// test is over
+func startRESP(t *testing.T, db *storage.DB, acl *acl) (*respServer, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newRESPServer(db, acl, testLog)
+	done := make(chan error, 1)
+	go func() { done <- srv.serve(l) }()
+	t.Cleanup(func() {
+		srv.shutdown(context.Background())
+		if err := <-done; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("serve: %v", err)
+		}
+	})
+	return srv, l.Addr().String()
+}
+
+// a command as an array of bulk strings
+func respCmd(args ...string) string {
+	s := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		s += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return s
+}
+
+// read a reply as a string: simple strings and integers as they are,
+// errors in parentheses, bulk strings quoted, null as nil and arrays in
+// brackets
+func readReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "(" + line[1:] + ")", nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "nil", nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return "", err
+		}
+		return strconv.Quote(string(data[:n])), nil
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]string, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return "", err
+			}
+		}
+		return "[" + strings.Join(items, " ") + "]", nil
+	}
+	return "", fmt.Errorf("reply %q", line)
+}
+
+// send the commands at once, returning a reply per command
+func respPipeline(t *testing.T, nc net.Conn, r *bufio.Reader, commands ...string) []string {
+	t.Helper()
+	if _, err := io.WriteString(nc, strings.Join(commands, "")); err != nil {
+		t.Fatal(err)
+	}
+	replies := make([]string, len(commands))
+	for i := range commands {
+		var err error
+		if replies[i], err = readReply(r); err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+	}
+	return replies
+}
+
+func dialRESP(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	return nc, bufio.NewReader(nc)
+}
+
+func TestRESP(t *testing.T) {
+	db := openTestDB(t)
+	_, addr := startRESP(t, db, nil)
+	nc, r := dialRESP(t, addr)
+	for _, tt := range []struct{ cmd, want string }{
+		{respCmd("SET", "a", "1"), "OK"},
+		{respCmd("SET", "b", "2", "EX", "100"), "OK"},
+		{respCmd("GET", "a"), `"1"`},
+		{respCmd("GET", "zz"), "nil"},
+		{respCmd("SET", "a", "3", "NX"), "nil"},
+		{respCmd("SET", "a", "4", "xx", "GET"), `"1"`},
+		{respCmd("SET", "n", "4", "XX", "GET"), "nil"},
+		{respCmd("SET", "a", "5", "NX", "XX"), "(ERR syntax error)"},
+		{respCmd("SET", "a", "5", "EX", "0"), "(ERR invalid expire time in 'set' command)"},
+		{respCmd("SET", "a", "5", "EX", "1", "PX", "1"), "(ERR syntax error)"},
+		{respCmd("TTL", "b"), "100"},
+		{respCmd("SET", "b", "6", "KEEPTTL"), "OK"},
+		{respCmd("PTTL", "b"), ""},
+		{respCmd("TTL", "a"), "-1"},
+		{respCmd("TTL", "q"), "-2"},
+		{"PING\r\n", "PONG"},
+		{"ping hello\n", `"hello"`},
+		{respCmd("ECHO", "x y"), `"x y"`},
+		{respCmd("MGET", "a", "b", "c"), `["4" "6" nil]`},
+		{respCmd("EXISTS", "a", "a", "c"), "2"},
+		{respCmd("DEL", "a", "c"), "1"},
+		{respCmd("DEL", "c"), "0"},
+		{respCmd("foo"), "(ERR unknown command 'foo')"},
+		{respCmd("GET"), "(ERR wrong number of arguments for 'get' command)"},
+		{respCmd("SET", "big", strings.Repeat("v", 2000)), "OK"},
+		{respCmd("SET", "big", strings.Repeat("v", 100000)), "(ERR value is too large: 100000 bytes, at most 3000)"},
+		{respCmd("STRLEN", "big"), "(ERR unknown command 'STRLEN')"},
+	} {
+		if tt.want == "" {
+			// the milliseconds left, a few gone by
+			ms, _ := strconv.Atoi(respPipeline(t, nc, r, respCmd("PTTL", "b"))[0])
+			if ms < 99000 || ms > 100000 {
+				t.Fatalf("%d ms left", ms)
+			}
+			continue
+		}
+		if got := respPipeline(t, nc, r, tt.cmd)[0]; got != tt.want {
+			t.Fatalf("%q replied %s, want %s", tt.cmd, got, tt.want)
+		}
+	}
+	if v, _, _ := db.Get([]byte("big")); len(v) != 2000 {
+		t.Fatalf("value of %d bytes", len(v))
+	}
+
+	// pipelined, and cut by QUIT
+	var commands []string
+	for i := 0; i < 100; i++ {
+		commands = append(commands, respCmd("SET", fmt.Sprintf("k%02d", i), "v"))
+	}
+	commands = append(commands, respCmd("QUIT"))
+	replies := respPipeline(t, nc, r, commands...)
+	if replies[99] != "OK" || replies[100] != "OK" {
+		t.Fatalf("replies %v", replies[99:])
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("read after QUIT: %v", err)
+	}
+}
+
+func TestRESPScan(t *testing.T) {
+	db := openTestDB(t)
+	_, addr := startRESP(t, db, nil)
+	nc, r := dialRESP(t, addr)
+	for i := 0; i < 25; i++ {
+		db.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("v"))
+	}
+	if got := respPipeline(t, nc, r, respCmd("SCAN", "0", "MATCH", "k1[0-5]", "COUNT", "100"))[0]; got !=
+		`["0" ["k10" "k11" "k12" "k13" "k14" "k15"]]` {
+		t.Fatalf("scan with a pattern %s", got)
+	}
+	if got := respPipeline(t, nc, r, respCmd("SCAN", "0", "TYPE", "hash"))[0]; !strings.HasSuffix(got, " []]") {
+		t.Fatalf("scan of hashes %s", got)
+	}
+
+	// by SCAN_COUNT keys from the cursor, each key once
+	var keys []string
+	cursor := "0"
+	for rounds := 0; ; rounds++ {
+		got := respPipeline(t, nc, r, respCmd("SCAN", cursor))[0]
+		fields := strings.Fields(strings.NewReplacer("[", " ", "]", " ", `"`, "").Replace(got))
+		cursor, keys = fields[0], append(keys, fields[1:]...)
+		if cursor == "0" {
+			if rounds != 25/SCAN_COUNT {
+				t.Fatalf("scanned in %d rounds", rounds+1)
+			}
+			break
+		}
+		if rounds == 0 {
+			db.Set([]byte("k00a"), []byte("v")) // before the cursor, not returned
+		}
+	}
+	if len(keys) != 25 || keys[0] != "k00" || keys[24] != "k24" {
+		t.Fatalf("scanned %v", keys)
+	}
+	for _, tt := range []struct{ cmd, want string }{
+		{respCmd("SCAN", "x"), "(ERR invalid cursor)"},
+		{respCmd("SCAN", "12345"), "(ERR invalid cursor)"},
+		{respCmd("SCAN", "0", "COUNT", "0"), "(ERR value is not an integer or out of range)"},
+		{respCmd("SCAN", "0", "MATCH"), "(ERR syntax error)"},
+		{respCmd("SCAN", "0", "LIMIT", "1"), "(ERR syntax error)"},
+	} {
+		if got := respPipeline(t, nc, r, tt.cmd)[0]; got != tt.want {
+			t.Fatalf("%q replied %s, want %s", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestScanCursors(t *testing.T) {
+	var s scanCursors
+	first := s.add([]byte("a"))
+	for i := 0; i < SCAN_CURSORS; i++ {
+		s.add([]byte("b"))
+	}
+	if _, ok := s.get(first); ok {
+		t.Fatal("oldest cursor kept")
+	}
+	if key, ok := s.get(first + SCAN_CURSORS); !ok || string(key) != "b" {
+		t.Fatalf("last cursor %q", key)
+	}
+}
+
+func TestRESPProtocolError(t *testing.T) {
+	db := openTestDB(t)
+	_, addr := startRESP(t, db, nil)
+	for _, req := range []string{"*x\r\n", "*1\r\nGET\r\n", "*1\r\n$-3\r\n", "*1\r\n$3\r\nGETxx"} {
+		nc, r := dialRESP(t, addr)
+		io.WriteString(nc, req)
+		if got, _ := readReply(r); !strings.HasPrefix(got, "(Protocol error: ") {
+			t.Fatalf("%q replied %s", req, got)
+		}
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Fatalf("read after a protocol error: %v", err)
+		}
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$0\r\n\r\n  set  a b \nPING"))
+	for _, want := range []string{`["GET" ""]`, `["set" "a" "b"]`} {
+		args, err := readCommand(r)
+		if err != nil || fmt.Sprintf("%q", args) != want {
+			t.Fatalf("read %q, want %s: %v", args, want, err)
+		}
+	}
+	if _, err := readCommand(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("command cut: %v", err)
+	}
+	long := bufio.NewReaderSize(strings.NewReader(strings.Repeat("x", RESP_MAX_INLINE+100)+"\n"), 16)
+	if _, err := readCommand(long); !errors.Is(err, errProtocol) {
+		t.Fatalf("inline command too long: %v", err)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"*", "", true},
+		{"a*", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abcd", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"a[b-c]", "ad", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`[\]]`, "]", true},
+		{"[abc", "b", true},
+		{"h\\*[^x]l?o*", "h*ello there", true},
+	} {
+		if got := globMatch([]byte(tt.pattern), []byte(tt.key)); got != tt.match {
+			t.Fatalf("%q matching %q: %v", tt.pattern, tt.key, got)
+		}
+	}
+}
+
+// the connections reply to the commands read, then are closed
+func TestRESPShutdown(t *testing.T) {
+	db := openTestDB(t)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	srv := newRESPServer(db, nil, testLog)
+	done := make(chan error, 1)
+	go func() { done <- srv.serve(l) }()
+	nc, r := dialRESP(t, l.Addr().String())
+	if got := respPipeline(t, nc, r, respCmd("PING"))[0]; got != "PONG" {
+		t.Fatal(got)
+	}
+	if err := srv.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("serve: %v", err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("read after shutdown: %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("connected after shutdown")
+	}
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+const COMPACT_PROGRESS_KEYS = 10000 // keys copied between progress reports
+
+// CompactProgress is how far Compact is, the totals are those counted by
+// the commits, see Usage.
+type CompactProgress struct {
+	Keys       int64 // copied, in buckets or not
+	TotalKeys  int64
+	Bytes      int64 // of the keys and values copied
+	TotalBytes int64
+	Pages      uint64 // of the new file so far
+	Elapsed    time.Duration
+}
+
+// Remaining estimates the time left from the bytes copied so far, 0 until
+// some are.
+func (p CompactProgress) Remaining() time.Duration {
+	if p.Bytes == 0 || p.Bytes >= p.TotalBytes {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) * float64(p.TotalBytes-p.Bytes) / float64(p.Bytes))
+}
+
+// CompactResult is the space of the file compacted and of the new one.
+type CompactResult struct {
+	Version  uint64 // the commit copied
+	Keys     int64
+	OldBytes int64 // of the file, the WAL excluded
+	NewBytes int64
+	Duration time.Duration
+}
+
+// Reclaimed is the space saved by the new file, negative if larger.
+func (r CompactResult) Reclaimed() int64 {
+	return r.OldBytes - r.NewBytes
+}
+
+// Compact copies the last commit visible to readers into a new file at
+// path, without its free pages and with its trees packed: the keys are
+// written in order by a Loader. The new file has the page size, the
+// comparator and the encryption key of the DB and is checkpointed, it has
+// no WAL to recover.
+//
+// It reads from a Tx like any reader, writers go on meanwhile and their
+// commits aren't copied. progress, if not nil, is called every
+// COMPACT_PROGRESS_KEYS keys and at the end. The new file is removed if
+// the copy fails or ctx is done.
+func (db *DB) Compact(ctx context.Context, path string, progress func(CompactProgress)) (result CompactResult, err error) {
+	if _, err := os.Stat(path); err == nil {
+		return result, fmt.Errorf("compact to %s: %w", path, os.ErrExist)
+	}
+	tx, err := db.BeginContext(ctx, false)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+	ctx, span := db.startSpan(ctx, "storage_engine.compact")
+	defer func() { endSpan(span, err) }()
+	start := time.Now()
+	usage, err := tx.Usage()
+	if err != nil {
+		return result, err
+	}
+	p := CompactProgress{TotalKeys: usage.Keys.Keys, TotalBytes: usage.Keys.Bytes}
+	for _, b := range usage.Buckets {
+		p.TotalKeys += b.Keys
+		p.TotalBytes += b.Bytes
+	}
+
+	opts := []Option{WithPageSize(db.opts.pageSize), WithSyncPolicy(SyncNever)}
+	if db.opts.cmp != nil {
+		opts = append(opts, WithComparator(db.opts.comparator, db.opts.cmp))
+	}
+	if db.cipher != nil {
+		opts = append(opts, WithEncryptionKey(db.cipher.keys.Load().current.key))
+	}
+	dst, err := Open(path, opts...)
+	if err != nil {
+		return result, err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+			os.Remove(walPath(path))
+		}
+	}()
+	l := dst.NewLoader(ctx)
+	report := func() {
+		if progress != nil {
+			p.Pages, p.Elapsed = dst.Stats().FilePages, time.Since(start)
+			progress(p)
+		}
+	}
+	if err := compactTx(tx, l, &p, report); err != nil {
+		l.Close()
+		return result, err
+	}
+	if err := l.Close(); err != nil {
+		return result, err
+	}
+	if err := dst.Checkpoint(); err != nil {
+		return result, err
+	}
+	report()
+
+	result = CompactResult{Version: tx.Version(), Keys: p.Keys, Duration: time.Since(start)}
+	if result.OldBytes, err = fileSize(db.fp); err == nil {
+		result.NewBytes, err = fileSize(dst.fp)
+	}
+	if err != nil {
+		return result, err
+	}
+	span.set("compact.version", result.Version)
+	span.set("compact.keys", result.Keys)
+	span.set("compact.reclaimed_bytes", result.Reclaimed())
+	db.log.Info("compacted", "path", path, "version", result.Version, "keys", result.Keys,
+		"old_bytes", result.OldBytes, "new_bytes", result.NewBytes, "duration", result.Duration)
+	return result, nil
+}
+
+// copy the keys of the Tx and of its buckets, in order
+func compactTx(tx *Tx, l *Loader, p *CompactProgress, report func()) error {
+	copyKeys := func(path [][]byte, c *Cursor) error {
+		for key, value := c.First(); key != nil; key, value = c.Next() {
+			var at time.Time
+			if path == nil {
+				var err error
+				if at, err = tx.Expiry(key); err != nil {
+					return err
+				}
+			}
+			if err := l.SetWithExpiry(path, key, value, at); err != nil {
+				return err
+			}
+			p.Keys++
+			p.Bytes += int64(len(key) + len(value))
+			if p.Keys%COMPACT_PROGRESS_KEYS == 0 {
+				report()
+			}
+		}
+		return c.Err()
+	}
+	if err := copyKeys(nil, tx.Cursor()); err != nil {
+		return err
+	}
+	var copyBucket func(path [][]byte, b *Bucket) error
+	copyBucket = func(path [][]byte, b *Bucket) error {
+		// created even if empty
+		if err := l.CreateBucket(path); err != nil {
+			return err
+		}
+		if err := copyKeys(path, b.Cursor()); err != nil {
+			return err
+		}
+		return b.ForEachBucket(func(name []byte) error {
+			inner, err := b.Bucket(name)
+			if err != nil {
+				return err
+			}
+			return copyBucket(append(path[:len(path):len(path)], name), inner)
+		})
+	}
+	return tx.ForEachBucket(func(name []byte) error {
+		b, err := tx.Bucket(name)
+		if err != nil {
+			return err
+		}
+		return copyBucket([][]byte{name}, b)
+	})
+}
+
+func fileSize(fp *os.File) (int64, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	db := openTest(t)
+	fillBuckets(t, db)
+	tx, _ := db.Begin(true)
+	for i := 0; i < 20000; i++ {
+		tx.Set([]byte(fmt.Sprintf("d%05d", i)), make([]byte, 100))
+	}
+	tx.SetWithExpiry([]byte("e"), []byte("x"), time.Now().Add(time.Hour))
+	o, _ := tx.Bucket([]byte("other"))
+	o.CreateBucket([]byte("empty"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// most of the keys deleted, their pages free in the file
+	tx, _ = db.Begin(true)
+	for i := 0; i < 20000; i++ {
+		if i%100 != 0 {
+			tx.Del([]byte(fmt.Sprintf("d%05d", i)))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Checkpoint()
+
+	path := filepath.Join(t.TempDir(), "compact.db")
+	var reports []CompactProgress
+	r, err := db.Compact(context.Background(), path, func(p CompactProgress) { reports = append(reports, p) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != db.version || r.Keys != 1+200+1+3001+1 || r.Reclaimed() <= r.OldBytes/2 {
+		t.Fatalf("result %+v", r)
+	}
+	// one report, at the end, for fewer than COMPACT_PROGRESS_KEYS keys
+	if len(reports) != 1 {
+		t.Fatalf("%d progress reports", len(reports))
+	}
+	last := reports[0]
+	if last.Keys != last.TotalKeys || last.Bytes != last.TotalBytes ||
+		last.Pages == 0 || last.Remaining() != 0 {
+		t.Fatalf("progress %+v", last)
+	}
+	if fi, err := os.Stat(walPath(path)); err == nil && fi.Size() > WAL_HEADER {
+		t.Fatalf("WAL of %d bytes left to recover", fi.Size())
+	}
+
+	dst := openTestPath(t, path)
+	checkBuckets(t, dst)
+	checkOK(t, dst)
+	tx, _ = dst.Begin(false)
+	defer tx.Rollback()
+	if n := countKeys(t, tx); n != 1+200+1 {
+		t.Fatalf("%d keys copied", n)
+	}
+	if at, _ := tx.Expiry([]byte("e")); at.IsZero() {
+		t.Fatal("expiry not copied")
+	}
+	o, _ = tx.Bucket([]byte("other"))
+	if _, err := o.Bucket([]byte("empty")); err != nil {
+		t.Fatalf("empty bucket: %v", err)
+	}
+
+	if _, err := db.Compact(context.Background(), path, nil); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("compact to an existing file: %v", err)
+	}
+}
+
+func TestCompactCanceled(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < 3*COMPACT_PROGRESS_KEYS; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%06d", i)), []byte("v"))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "compact.db")
+	_, err := db.Compact(ctx, path, func(p CompactProgress) { cancel() })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("compact canceled: %v", err)
+	}
+	for _, name := range []string{path, walPath(path)} {
+		if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s left: %v", name, err)
+		}
+	}
+}
+
+func TestCompactProgress(t *testing.T) {
+	p := CompactProgress{Bytes: 25, TotalBytes: 100, Elapsed: time.Second}
+	if d := p.Remaining(); d != 3*time.Second {
+		t.Fatalf("%v remaining", d)
+	}
+	if d := (CompactProgress{TotalBytes: 100, Elapsed: time.Second}).Remaining(); d != 0 {
+		t.Fatalf("%v remaining before any byte", d)
+	}
+	if n := (CompactResult{OldBytes: 10, NewBytes: 15}).Reclaimed(); n != -5 {
+		t.Fatalf("%d bytes reclaimed", n)
+	}
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// lock mu unless ctx is done first
+func lockContext(ctx context.Context, mu *sync.Mutex) error {
+	if mu.TryLock() {
+		return nil
+	}
+	if ctx.Done() == nil {
+		mu.Lock()
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// the lock is given back as soon as it's taken
+		go func() {
+			<-locked
+			mu.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// GetContext, SetContext and DelContext are Get, Set and Del with a
+// context, see BeginContext.
+func (db *DB) GetContext(ctx context.Context, key []byte) ([]byte, bool, error) {
+	tx, err := db.BeginContext(ctx, false)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+	return tx.GetCopy(key)
+}
+
+func (db *DB) SetContext(ctx context.Context, key []byte, value []byte) error {
+	tx, err := db.BeginContext(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.Set(key, value); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) DelContext(ctx context.Context, key []byte) (bool, error) {
+	tx, err := db.BeginContext(ctx, true)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	deleted, err := tx.Del(key)
+	if err != nil || !deleted {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestContextScan(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < 5000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 100))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, _ = db.BeginContext(ctx, false)
+	defer tx.Rollback()
+	c := tx.Cursor()
+	n := 0
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if n++; n == 100 {
+			cancel()
+		}
+	}
+	if !errors.Is(c.Err(), context.Canceled) || n > 200 {
+		t.Fatalf("scan of %d keys after the cancel: %v", n, c.Err())
+	}
+}
+
+func TestContextWait(t *testing.T) {
+	db := openTest(t)
+	w, _ := db.Begin(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := db.BeginContext(ctx, true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("begin behind a writer: %v", err)
+	}
+	if err := db.CheckpointContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("checkpoint behind a writer: %v", err)
+	}
+	if err := db.SetContext(ctx, []byte("a"), []byte("1")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("set behind a writer: %v", err)
+	}
+	w.Rollback()
+
+	if err := db.SetContext(context.Background(), []byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := db.GetContext(context.Background(), []byte("a")); err != nil || !ok || string(v) != "1" {
+		t.Fatalf("get %q %v %v", v, ok, err)
+	}
+	if ok, err := db.DelContext(context.Background(), []byte("a")); err != nil || !ok {
+		t.Fatalf("del %v %v", ok, err)
+	}
+}
+
+// a Tx whose context is done can't commit, and releases the writer lock
+func TestContextCommit(t *testing.T) {
+	db := openTest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	w, _ := db.BeginContext(ctx, true)
+	w.Set([]byte("b"), []byte("1"))
+	cancel()
+	if err := w.Commit(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("commit after the cancel: %v", err)
+	}
+	wantValue(t, db, "b", nil)
+	mustSet(t, db, "c", "1")
+}
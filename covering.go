@@ -0,0 +1,100 @@
+package storage
+
+import "fmt"
+
+// Covering scans: an index covers a SELECT on a table if the columns of
+// the table it reads are of the index or of the primary key, both in the
+// entries of the index. The rows are then decoded from the entries, the
+// other columns NULL, without getting the rows. The planner takes such an
+// index over the primary key for a WHERE as good for both, and EXPLAIN
+// shows an index only scan.
+
+// the columns the SELECT reads, by offset in the scope of its tables
+func selectColumns(s *SelectStmt, scope *sqlScope) []bool {
+	read := make([]bool, scope.width())
+	var walk func(e Expr)
+	walk = func(e Expr) {
+		switch e := e.(type) {
+		case *ColumnRef:
+			// an alias of ORDER BY isn't a column
+			if offset, err := scope.resolve(e); err == nil {
+				read[offset] = true
+			}
+		case *UnaryExpr:
+			walk(e.X)
+		case *BinaryExpr:
+			walk(e.X)
+			walk(e.Y)
+		case *IsNullExpr:
+			walk(e.X)
+		case *FuncExpr:
+			walk(e.X)
+		}
+	}
+	for _, c := range s.Columns {
+		if c.Star {
+			for i := range read {
+				read[i] = true
+			}
+		}
+		walk(c.Expr)
+	}
+	for _, j := range s.Joins {
+		walk(j.On)
+	}
+	walk(s.Where)
+	for _, e := range s.GroupBy {
+		walk(e)
+	}
+	walk(s.Having)
+	for _, o := range s.OrderBy {
+		walk(o.Expr)
+	}
+	return read
+}
+
+// whether the entries of the index hold the columns read, nil for all
+func (t *Table) covers(ix *tableIndex, read []bool) bool {
+	if read == nil {
+		return false
+	}
+	held := make([]bool, len(t.schema.Columns))
+	for _, col := range ix.cols {
+		held[col] = true
+	}
+	for _, col := range t.key {
+		held[col] = true
+	}
+	for col, r := range read {
+		if r && !held[col] {
+			return false
+		}
+	}
+	return true
+}
+
+// call fn with the keys and the rows of the entries of an index as
+// scanIndex, the columns not in the entries NULL
+func (t *Table) scanEntries(ix *tableIndex, from, to []byte, reverse bool, fn func(pk []byte, row Row) error) error {
+	return scanBucket(ix.entries, from, to, reverse, func(key, pk []byte) error {
+		values, err := DecodeKey(key)
+		if err != nil {
+			return fmt.Errorf("%w: entry of index %q: %v", ErrCorrupt, ix.Name, err)
+		}
+		keys, err := DecodeKey(pk)
+		if err != nil {
+			return fmt.Errorf("%w: entry of index %q: %v", ErrCorrupt, ix.Name, err)
+		}
+		if len(values) < len(ix.cols) || len(keys) != len(t.key) {
+			return fmt.Errorf("%w: entry %q of index %q of %d values", ErrCorrupt, key, ix.Name, len(values))
+		}
+		row := make(Row, len(t.schema.Columns))
+		for i, col := range ix.cols {
+			row[col] = values[i]
+		}
+		for i, col := range t.key {
+			row[col] = keys[i]
+		}
+		return fn(pk, row)
+	})
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSelectColumns(t *testing.T) {
+	db := itemsTest(t)
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	for query, want := range map[string]string{
+		"SELECT id FROM items":                                               "[true false false false]",
+		"SELECT * FROM items":                                                "[true true true true]",
+		"SELECT COUNT(*) FROM items WHERE -qty > 1":                          "[false false false true]",
+		"SELECT name AS n FROM items ORDER BY n":                             "[false true false false]",
+		"SELECT SUM(price) FROM items GROUP BY name HAVING name IS NOT NULL": "[false true true false]",
+		"SELECT a.id FROM items a JOIN items b ON b.qty = a.qty":             "[true false false true false false false true]",
+	} {
+		s := parseTest(t, query).(*SelectStmt)
+		scope, _, _, err := tx.planSelect(s, nil, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(selectColumns(s, scope)); got != want {
+			t.Errorf("%s: %s, want %s", query, got, want)
+		}
+	}
+	items, _ := tx.Table("items")
+	ix, _ := items.index("by_name")
+	for _, c := range []struct {
+		read []bool
+		want bool
+	}{
+		{[]bool{true, true, false, false}, true},
+		{[]bool{false, false, false, false}, true},
+		{[]bool{true, true, false, true}, false},
+		{nil, false},
+	} {
+		if got := items.covers(ix, c.read); got != c.want {
+			t.Errorf("covers %v: %v", c.read, got)
+		}
+	}
+}
+
+// a SELECT reading the columns of an index and of the primary key only
+// reads the entries of the index, the rows are the same
+func TestCoveringIndex(t *testing.T) {
+	db := itemsTest(t)
+	queries := []struct {
+		query, access string
+	}{
+		{"SELECT id, name FROM items WHERE name = 'n3'", "index only scan by_name"},
+		{"SELECT name FROM items ORDER BY name DESC LIMIT 3", "index only scan by_name"},
+		{"SELECT COUNT(*) FROM items WHERE name >= 'n8'", "index only scan by_name"},
+		{"SELECT name, COUNT(*) FROM items GROUP BY name", "index only scan by_name"},
+		// as good as the range of the primary key
+		{"SELECT id FROM items WHERE id < 10 AND name = 'n0'", "index only scan by_name"},
+		{"SELECT name FROM items", "index only scan by_name"},
+		{"SELECT price FROM items WHERE name = 'n3'", "index scan by_name"},
+		{"SELECT id FROM items WHERE name = 'n3' AND qty = 1", "index scan by_name"},
+		{"SELECT * FROM items WHERE name = 'n3'", "index scan by_name"},
+	}
+	rows := make([]string, len(queries))
+	for i, c := range queries {
+		if got := accessTest(t, db, c.query); got != c.access {
+			t.Errorf("%s: %s, want %s", c.query, got, c.access)
+		}
+		rows[i] = selectTest(t, db, c.query)
+	}
+	if got := selectTest(t, db, "EXPLAIN SELECT a.id FROM items a JOIN items b ON b.name = a.name WHERE a.id = 5"); got != "[[a key lookup <nil> false 1 false] [b index only scan by_name false <nil> false]]" {
+		t.Fatalf("plan %s of a join", got)
+	}
+	// the rows of the index are in the order of the keys
+	execTest(t, db, "DROP INDEX by_name ON items")
+	for i, c := range queries {
+		if got := selectTest(t, db, c.query); got != rows[i] {
+			t.Errorf("%s: %s by the index, %s without", c.query, rows[i], got)
+		}
+	}
+
+	// the columns of a composite key and index from the entries
+	db = eventsTest(t)
+	query := "SELECT user, at, kind FROM events WHERE kind = 'k2' AND at > 5 AND user >= 1"
+	if got := accessTest(t, db, query); got != "index only scan by_kind" {
+		t.Fatalf("access %s", got)
+	}
+	if got := selectTest(t, db, query); got != "[[1 8 k2] [2 8 k2]]" {
+		t.Fatalf("rows %s", got)
+	}
+}
+
+func TestCoveringCorrupt(t *testing.T) {
+	db := itemsTest(t)
+	tx, _ := db.Begin(true)
+	items, _ := tx.Table("items")
+	ix, _ := items.index("by_name")
+	ix.entries.Set([]byte("\xffbad"), []byte("pk"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("SELECT name FROM items"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("scan of a corrupt entry: %v", err)
+	}
+}
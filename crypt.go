@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Encryption at rest: with a key, see WithEncryptionKey and KeyProvider,
+// the pages of the file but the meta page are sealed with AES-GCM by the
+// pager, the nodes are smaller than the pages by PAGE_CRYPT_OVERHEAD. The
+// nonce of a page is its number and the epoch of its write, a counter
+// from a random start at Open written in the page, so that no two writes
+// share a nonce; the number is authenticated too, a page copied elsewhere
+// fails to decrypt. The meta page records the cipher and a check of the
+// key: a file opened without its key, with another or with a key while
+// plaintext fails with ErrEncryptionKey.
+//
+// The records of the WAL are sealed too, 2PC prepares included, with a
+// nonce of the same epochs: its archived segments are copies, sealed
+// as well, and so are the records of the incremental backups. Those are
+// opened with the key of the database reading them, a recovery by
+// RecoverWAL or RestoreIncremental needs a database of the same key. The
+// records sent to the followers aren't sealed, see WithReplicationTLS.
+//
+// page layout, the tag of the node and the number of the page
+// | epoch | node        | tag |
+// | 8B    | page - 24B  | 16B |
+
+const (
+	CIPHER_NONE   = 0
+	CIPHER_AESGCM = 1
+
+	PAGE_CRYPT_OVERHEAD = 8 + 16 // the epoch and the tag
+	WAL_CRYPT_OVERHEAD  = 8 + 16 // of a record, the epoch and the tag
+	KEY_CHECK_LEN       = 16
+	PREVIOUS_KEY_LEN    = 4 + 12 + 32 + 16 // the length, the nonce, the key padded and the tag
+)
+
+var ErrEncryptionKey = errors.New("wrong encryption key")
+
+// WithEncryptionKey encrypts the file with AES-GCM, the key of 16, 24 or
+// 32 bytes for AES-128, AES-192 or AES-256. A file is encrypted when
+// created, it's then opened with the same key only, see RotateEncryptionKey
+// to replace it. An empty key doesn't encrypt, see WithKeyProvider to get
+// the key from elsewhere.
+func WithEncryptionKey(key []byte) Option {
+	return func(db *DB) {
+		db.opts.keys = nil
+		if len(key) > 0 {
+			db.opts.keys = StaticKey(key)
+		}
+	}
+}
+
+// a key of the pages
+type pageKey struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+func newPageKey(key []byte) (*pageKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key: %w", err)
+	}
+	return &pageKey{key: append([]byte(nil), key...), aead: aead}, nil
+}
+
+// the keys of the pages, replaced as a whole by a rotation
+type pageKeys struct {
+	current *pageKey
+	// amid a rotation, and after it for the snapshots older than its end,
+	// the key of the pages not rewritten yet
+	previous *pageKey
+	sealed   []byte // the previous key in the meta page, nil once the rotation is over
+}
+
+// the keys of the pages and, amid a rotation, those sealed with the
+// current one as far as the pager knows, see rekey.go
+type pageCipher struct {
+	keys  atomic.Pointer[pageKeys]
+	epoch atomic.Uint64 // of the last page or WAL record sealed
+	mu    sync.Mutex    // protects fresh
+	fresh []uint64      // bits by page, nil if not rotating
+}
+
+func newPageCipher(key []byte) (*pageCipher, error) {
+	k, err := newPageKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var start [8]byte
+	if _, err := rand.Read(start[:]); err != nil {
+		return nil, fmt.Errorf("epoch of the pages: %w", err)
+	}
+	c := &pageCipher{}
+	c.keys.Store(&pageKeys{current: k})
+	c.epoch.Store(binary.LittleEndian.Uint64(start[:]))
+	return c, nil
+}
+
+// replace the keys, no page is known sealed with the new current one
+func (c *pageCipher) rotate(keys *pageKeys) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys.Store(keys)
+	c.fresh = nil
+}
+
+func (c *pageCipher) rotating() bool {
+	return c.keys.Load().sealed != nil
+}
+
+// a page was read or written sealed with the key
+func (c *pageCipher) sealedWith(ptr uint64, k *pageKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if keys := c.keys.Load(); keys.sealed == nil || k != keys.current {
+		return
+	}
+	if i := int(ptr / 64); i >= len(c.fresh) {
+		c.fresh = append(c.fresh, make([]uint64, i+1-len(c.fresh))...)
+	}
+	c.fresh[ptr/64] |= 1 << (ptr % 64)
+}
+
+// whether a page of the file may be sealed with the previous key, amid a
+// rotation; it's not once read or written with the current one
+func (c *pageCipher) stale(ptr uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys.Load().sealed == nil {
+		return false
+	}
+	i := int(ptr / 64)
+	return i >= len(c.fresh) || c.fresh[i]&(1<<(ptr%64)) == 0
+}
+
+// the nonce of a page and epoch: the page 0 is never sealed, its nonces
+// are free for the check of the key
+func pageNonce(ptr, epoch uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce, uint32(ptr))
+	binary.BigEndian.PutUint64(nonce[4:], epoch)
+	return nonce
+}
+
+// the nonce of a WAL record, with the number of no page: the records
+// and the pages take their epochs from the same counter
+func recordNonce(epoch uint64) []byte {
+	return pageNonce(math.MaxUint32, epoch)
+}
+
+// seal a record encoded by encodeWALRecord with the current key, its
+// version authenticated
+func (c *pageCipher) sealRecord(data []byte) []byte {
+	k := c.keys.Load().current
+	epoch := c.epoch.Add(1)
+	sealed := make([]byte, WAL_RECORD_HEADER+8, len(data)+WAL_CRYPT_OVERHEAD)
+	copy(sealed[8:], data[8:WAL_RECORD_HEADER])
+	binary.LittleEndian.PutUint64(sealed[WAL_RECORD_HEADER:], epoch)
+	sealed = k.aead.Seal(sealed, recordNonce(epoch), data[WAL_RECORD_HEADER:], data[8:WAL_RECORD_HEADER])
+	binary.LittleEndian.PutUint32(sealed[4:], uint32(len(sealed)))
+	binary.LittleEndian.PutUint32(sealed, crc32.ChecksumIEEE(sealed[4:]))
+	return sealed
+}
+
+// the record encoded of a sealed one, with the current key or else the
+// previous one; its checksum and size are those of the sealed record
+func (c *pageCipher) openRecord(sealed []byte) ([]byte, error) {
+	if len(sealed) < WAL_RECORD_HEADER+WAL_CRYPT_OVERHEAD+4 {
+		return nil, fmt.Errorf("%w: sealed record of %d bytes", ErrBadWAL, len(sealed))
+	}
+	version := sealed[8:WAL_RECORD_HEADER]
+	nonce := recordNonce(binary.LittleEndian.Uint64(sealed[WAL_RECORD_HEADER:]))
+	keys := c.keys.Load()
+	for _, k := range []*pageKey{keys.current, keys.previous} {
+		if k == nil {
+			break
+		}
+		if data, err := k.aead.Open(sealed[:WAL_RECORD_HEADER:WAL_RECORD_HEADER], nonce, sealed[WAL_RECORD_HEADER+8:], version); err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: WAL record of version %d doesn't decrypt", ErrEncryptionKey, binary.LittleEndian.Uint64(version))
+}
+
+// the check of the key in the meta page, the tag of nothing
+func (k *pageKey) keyCheck() []byte {
+	return k.aead.Seal(nil, pageNonce(0, 0), nil, []byte(DB_SIG))
+}
+
+// the previous key sealed for the meta page, in PREVIOUS_KEY_LEN bytes:
+// its length, a random nonce, then the key padded to 32 bytes and the tag
+func (k *pageKey) sealKey(previous *pageKey) ([]byte, error) {
+	field := make([]byte, 16, PREVIOUS_KEY_LEN)
+	binary.LittleEndian.PutUint32(field, uint32(len(previous.key)))
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("nonce of the previous key: %w", err)
+	}
+	copy(field[4:], nonce)
+	padded := make([]byte, 32)
+	copy(padded, previous.key)
+	return k.aead.Seal(field, nonce, padded, []byte(DB_SIG)), nil
+}
+
+// the previous key of the meta page
+func (k *pageKey) openKey(field []byte) (*pageKey, error) {
+	n := binary.LittleEndian.Uint32(field)
+	if n != 16 && n != 24 && n != 32 {
+		return nil, fmt.Errorf("%w: previous encryption key of %d bytes", ErrBadMeta, n)
+	}
+	padded, err := k.aead.Open(nil, field[4:16], field[16:PREVIOUS_KEY_LEN], []byte(DB_SIG))
+	if err != nil {
+		return nil, fmt.Errorf("%w: previous encryption key doesn't decrypt", ErrBadMeta)
+	}
+	return newPageKey(padded[:n])
+}
+
+// the previous key of the meta page of a file amid a rotation
+func (c *pageCipher) loadPrevious(field []byte) error {
+	keys := c.keys.Load()
+	previous, err := keys.current.openKey(field)
+	if err != nil {
+		return err
+	}
+	c.rotate(&pageKeys{current: keys.current, previous: previous, sealed: append([]byte(nil), field...)})
+	return nil
+}
+
+// the size of the nodes in pages of the file
+func (db *DB) nodeSize() int {
+	switch {
+	case db.cipher != nil:
+		return db.opts.pageSize - PAGE_CRYPT_OVERHEAD
+	case db.checksums:
+		return db.opts.pageSize - PAGE_CHECKSUM_LEN
+	}
+	return db.opts.pageSize
+}
+
+// the pages of the file sealed, those of the nodes are read and written,
+// the meta page as is
+type cryptPager struct {
+	pager
+	cipher   *pageCipher
+	pageSize int
+}
+
+func newCryptPager(p pager, c *pageCipher, pageSize int) *cryptPager {
+	return &cryptPager{pager: p, cipher: c, pageSize: pageSize}
+}
+
+func (p *cryptPager) readPage(ptr uint64, data []byte) error {
+	if ptr == 0 {
+		return p.pager.readPage(ptr, data)
+	}
+	page := make([]byte, p.pageSize)
+	if err := p.pager.readPage(ptr, page); err != nil {
+		return err
+	}
+	return p.open(ptr, page, data)
+}
+
+func (p *cryptPager) readPages(ptrs []uint64, data [][]byte) error {
+	pages := make([][]byte, len(ptrs))
+	for i := range pages {
+		pages[i] = make([]byte, p.pageSize)
+	}
+	if err := p.pager.readPages(ptrs, pages); err != nil {
+		return err
+	}
+	for i, ptr := range ptrs {
+		if err := p.open(ptr, pages[i], data[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *cryptPager) writePages(pages map[uint64][]byte) error {
+	k := p.cipher.keys.Load().current
+	sealed := make(map[uint64][]byte, len(pages))
+	for ptr, node := range pages {
+		sealed[ptr] = p.seal(k, ptr, node)
+	}
+	if err := p.pager.writePages(sealed); err != nil {
+		return err
+	}
+	for ptr := range pages {
+		p.cipher.sealedWith(ptr, k)
+	}
+	return nil
+}
+
+// the page of a node
+func (p *cryptPager) seal(k *pageKey, ptr uint64, node []byte) []byte {
+	n := p.pageSize - PAGE_CRYPT_OVERHEAD
+	if len(node) < n {
+		node = append(node[:len(node):len(node)], make([]byte, n-len(node))...)
+	}
+	page := make([]byte, 8, p.pageSize)
+	epoch := p.cipher.epoch.Add(1)
+	binary.LittleEndian.PutUint64(page, epoch)
+	return k.aead.Seal(page, pageNonce(ptr, epoch), node[:n], binary.LittleEndian.AppendUint64(nil, ptr))
+}
+
+// decrypt a page into data, the bytes after the node zeroed, with the
+// current key or else the previous one; a page never written is zeros,
+// read as such
+func (p *cryptPager) open(ptr uint64, page, data []byte) error {
+	if allZero(page) {
+		clear(data)
+		return nil
+	}
+	epoch := binary.LittleEndian.Uint64(page)
+	nonce, ad := pageNonce(ptr, epoch), binary.LittleEndian.AppendUint64(nil, ptr)
+	keys := p.cipher.keys.Load()
+	for _, k := range []*pageKey{keys.current, keys.previous} {
+		if k == nil {
+			break
+		}
+		if node, err := k.aead.Open(data[:0], nonce, page[8:], ad); err == nil {
+			clear(data[len(node):])
+			p.cipher.sealedWith(ptr, k)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: page %d doesn't decrypt", ErrCorrupt, ptr)
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func keyTest(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// fail if a file holds the plaintext of a key or a value
+func wantSealed(t *testing.T, name string, data []byte) {
+	t.Helper()
+	for _, s := range []string{"k00042", "secret value", "prepared"} {
+		if bytes.Contains(data, []byte(s)) {
+			t.Fatalf("%s holds %q", name, s)
+		}
+	}
+}
+
+func readFileTest(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, WithEncryptionKey(keyTest(1)), WithWALArchiveSize(1<<30), WithCheckpointSize(1<<40))
+	if info := db.Info(); !info.Encrypted || !info.EncryptedWAL {
+		t.Fatalf("info %+v", info)
+	}
+	for i := 0; i < 500; i++ {
+		writeReplicated(t, db, i)
+	}
+	mustSet(t, db, "s", "secret value")
+	tx, _ := db.Begin(true)
+	tx.Set([]byte("prepared"), []byte("x"))
+	if err := tx.Prepare("id"); err != nil {
+		t.Fatal(err)
+	}
+	good := dumpTest(t, db)
+
+	// the records are sealed in the WAL, recovered with the key
+	wal := readFileTest(t, walPath(path))
+	if string(wal[:8]) != WAL_SIG_SEALED {
+		t.Fatalf("WAL signature %q", wal[:8])
+	}
+	wantSealed(t, "the WAL", wal)
+	crashTest(db)
+	db = openTestPath(t, path, WithEncryptionKey(keyTest(1)), WithWALArchiveSize(1<<30))
+	if got := dumpTest(t, db); got != good {
+		t.Fatalf("recovered\n%s\nwant\n%s", got, good)
+	}
+	if err := db.CommitPrepared("id"); err != nil {
+		t.Fatal(err)
+	}
+	wantValue(t, db, "prepared", []byte("x"))
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := walSegments(path)
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("segments %v: %v", segments, err)
+	}
+	for _, v := range segments {
+		wantSealed(t, "a segment", readFileTest(t, walSegmentPath(path, v)))
+	}
+	db.Close()
+	wantSealed(t, "the file", readFileTest(t, path))
+
+	// without the key, with another, or with a key while plaintext
+	for _, opts := range [][]Option{nil, {WithEncryptionKey(keyTest(2))}} {
+		if db, err := Open(path, opts...); !errors.Is(err, ErrEncryptionKey) {
+			if db != nil {
+				db.Close()
+			}
+			t.Fatalf("open with %d options: %v", len(opts), err)
+		}
+	}
+	plain := openTest(t)
+	if info := plain.Info(); info.Encrypted || info.EncryptedWAL {
+		t.Fatalf("info of a plaintext file %+v", info)
+	}
+	mustSet(t, plain, "a", "b")
+	plain.Close()
+	if db, err := Open(plain.Path, WithEncryptionKey(keyTest(1))); !errors.Is(err, ErrEncryptionKey) {
+		if db != nil {
+			db.Close()
+		}
+		t.Fatalf("plaintext file opened with a key: %v", err)
+	}
+}
+
+// a record flipped ends the log like a torn one, one of another key fails
+func TestSealedRecord(t *testing.T) {
+	c, _ := newPageCipher(keyTest(1))
+	rec := walRecord{version: 7, ops: []walOp{{kind: WAL_OP_SET, key: []byte("k"), value: []byte("secret value")}}}
+	sealed := c.sealRecord(encodeWALRecord(rec))
+	if len(sealed) != len(encodeWALRecord(rec))+WAL_CRYPT_OVERHEAD || bytes.Contains(sealed, []byte("secret value")) {
+		t.Fatalf("sealed record %q", sealed)
+	}
+	if other := c.sealRecord(encodeWALRecord(rec)); bytes.Equal(other[WAL_RECORD_HEADER+8:], sealed[WAL_RECORD_HEADER+8:]) {
+		t.Fatal("two records sealed with the same nonce")
+	}
+	read := func(c *pageCipher, data []byte) ([]walRecord, error) {
+		var recs []walRecord
+		_, err := readWALRecords(bytes.NewReader(data), 0, int64(len(data)), c, func(rec walRecord, _ int64) error {
+			recs = append(recs, rec)
+			return nil
+		})
+		return recs, err
+	}
+	recs, err := read(c, sealed)
+	if err != nil || len(recs) != 1 || recs[0].version != 7 || string(recs[0].ops[0].value) != "secret value" {
+		t.Fatalf("records %v: %v", recs, err)
+	}
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)-1] ^= 1
+	if recs, err := read(c, flipped); len(recs) != 0 || err != nil {
+		t.Fatalf("flipped record read %v: %v", recs, err)
+	}
+	other, _ := newPageCipher(keyTest(2))
+	if _, err := read(other, sealed); !errors.Is(err, ErrEncryptionKey) {
+		t.Fatalf("record of another key: %v", err)
+	}
+	// the version is authenticated
+	moved := bytes.Clone(sealed)
+	moved[8]++
+	binary.LittleEndian.PutUint32(moved, crc32.ChecksumIEEE(moved[4:]))
+	if _, err := read(c, moved); !errors.Is(err, ErrEncryptionKey) {
+		t.Fatalf("record of another version: %v", err)
+	}
+}
+
+// the incremental backups and the archive read by RecoverWAL are sealed,
+// opened by a database of the same key only
+func TestEncryptedBackups(t *testing.T) {
+	src := openTest(t, WithEncryptionKey(keyTest(1)), WithWALArchiveSize(1<<30), WithCheckpointSize(64<<10))
+	for i := 0; i < 100; i++ {
+		writeReplicated(t, src, i)
+	}
+	tx, _ := src.Begin(false)
+	var full bytes.Buffer
+	tx.WriteBackup(&full)
+	base := tx.Version()
+	tx.Rollback()
+	for i := 100; i < 1100; i++ {
+		writeReplicated(t, src, i)
+	}
+	mustSet(t, src, "s", "secret value")
+	restore := func(opts ...Option) *DB {
+		t.Helper()
+		db := openTest(t, opts...)
+		if _, err := db.Restore(context.Background(), bytes.NewReader(full.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	var incremental bytes.Buffer
+	if _, err := src.WriteIncrementalBackup(&incremental, base); err != nil {
+		t.Fatal(err)
+	}
+	if string(incremental.Bytes()[:8]) != INCREMENTAL_SIG_SEALED {
+		t.Fatalf("incremental signature %q", incremental.Bytes()[:8])
+	}
+	wantSealed(t, "the incremental backup", incremental.Bytes())
+	dst := restore(WithEncryptionKey(keyTest(1)))
+	if _, err := dst.RestoreIncremental(context.Background(), bytes.NewReader(incremental.Bytes()), base); err != nil {
+		t.Fatal(err)
+	}
+	wantSameDB(t, src, dst)
+
+	dst = restore(WithEncryptionKey(keyTest(1)))
+	if _, err := dst.RecoverWAL(context.Background(), src.Path, base, RecoveryTarget{}); err != nil {
+		t.Fatal(err)
+	}
+	wantSameDB(t, src, dst)
+
+	for name, opts := range map[string][]Option{"plaintext": nil, "other key": {WithEncryptionKey(keyTest(2))}} {
+		if _, err := restore(opts...).RestoreIncremental(context.Background(), bytes.NewReader(incremental.Bytes()), base); !errors.Is(err, ErrEncryptionKey) {
+			t.Errorf("incremental restored into a %s database: %v", name, err)
+		}
+		if _, err := restore(opts...).RecoverWAL(context.Background(), src.Path, base, RecoveryTarget{}); !errors.Is(err, ErrEncryptionKey) {
+			t.Errorf("WAL recovered into a %s database: %v", name, err)
+		}
+	}
+}
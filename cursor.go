@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"slices"
+	"time"
+)
+
+// Cursor walks the keys of a Tx in order.
+//
+// A cursor sees the same state of the database as the Tx it belongs to:
+// its snapshot plus, for a writable Tx, its own updates, including those
+// made while the cursor is open. Concurrent commits are never seen, the
+// pages of the snapshot are not reused while the Tx is open, however long
+// the scan takes. Cursors are valid until the Tx ends, the moves then
+// return nil. Keys and values returned are valid until the Tx ends and
+// must not be modified.
+//
+// In a Serializable Tx the ranges walked are read too, a concurrent commit
+// adding or removing a key in them makes the Tx conflict.
+//
+// A move that fails, on a corrupt page or a failed read, returns nil like
+// the end of the keys: check Err after a scan. The cursor stays failed.
+// So does a move to another leaf once the context of the Tx is done.
+type Cursor struct {
+	tx   *Tx
+	tree *BTree // the keys of the Tx or of a bucket
+	iter *BIter
+	gen  uint64 // updates of the Tx when iter was positioned
+	key  []byte // the current key, nil before the first or after the last
+	// keys updated by an optimistic Tx, sorted
+	writes    []string
+	writesGen uint64
+	scan      int   // range of Tx.scans extended by the moves, -1 if none
+	leaf      *byte // the leaf of the last move, the context is checked on the next
+	err       error
+	slow      struct {
+		start  time.Time // of the scan, zero if not timed
+		keys   int
+		leaves int
+	}
+	ahead struct {
+		leaf    *byte // the current leaf
+		forward bool
+		steps   int   // leaves walked in a row
+		parent  *byte // the parent of the leaves read ahead
+		end     int   // the last kid of parent read ahead
+	}
+}
+
+// Cursor opens a cursor positioned before the first key.
+func (tx *Tx) Cursor() *Cursor {
+	return &Cursor{tx: tx, tree: &tx.tree, scan: -1}
+}
+
+// First moves to the first key, nil if there are none.
+func (c *Cursor) First() ([]byte, []byte) {
+	return c.Seek(nil)
+}
+
+// Last moves to the last key, nil if there are none.
+func (c *Cursor) Last() (k, v []byte) {
+	if c.tx.done || c.err != nil {
+		return nil, nil
+	}
+	defer catchTreeError(&c.err)
+	c.tx.traceOp("scan", nil)
+	c.iter = c.tree.SeekEnd()
+	c.gen = c.tx.gen
+	c.key = nil
+	c.scan = -1
+	c.startScan()
+	return c.move(false, nil, false)
+}
+
+// Seek moves to the first key greater than or equal to the given one.
+func (c *Cursor) Seek(key []byte) (k, v []byte) {
+	if c.tx.done || c.err != nil {
+		return nil, nil
+	}
+	defer catchTreeError(&c.err)
+	c.tx.traceOp("scan", key)
+	c.iter = c.tree.SeekLE(key)
+	c.gen = c.tx.gen
+	c.key = nil
+	c.scan = -1
+	c.startScan()
+	return c.move(true, key, true)
+}
+
+// Next moves to the key after the current one.
+func (c *Cursor) Next() (k, v []byte) {
+	if c.tx.done || c.err != nil || c.iter == nil || c.key == nil {
+		return nil, nil
+	}
+	defer catchTreeError(&c.err)
+	return c.move(true, c.key, false)
+}
+
+// Prev moves to the key before the current one.
+func (c *Cursor) Prev() (k, v []byte) {
+	if c.tx.done || c.err != nil || c.iter == nil || c.key == nil {
+		return nil, nil
+	}
+	defer catchTreeError(&c.err)
+	return c.move(false, c.key, false)
+}
+
+// Err is the error that stopped the cursor, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// find the nearest key after (or before) from, from itself is skipped unless
+// inclusive. A nil from is before the first key when moving forward and
+// after the last one backward.
+func (c *Cursor) move(forward bool, from []byte, inclusive bool) ([]byte, []byte) {
+	for {
+		key, value := c.step(forward, from, inclusive)
+		if key == nil {
+			c.endScan()
+			return nil, nil
+		}
+		if !c.expired(key) {
+			c.slow.keys++
+			return key, value
+		}
+		from, inclusive = key, false
+	}
+}
+
+// time the scan starting, for WithSlowThreshold
+func (c *Cursor) startScan() {
+	c.endScan()
+	if c.tx.db.opts.slowThreshold > 0 {
+		c.slow.start = time.Now()
+		c.slow.keys, c.slow.leaves = 0, 0
+	}
+}
+
+// the scan reached the end of the keys or the cursor moves elsewhere
+func (c *Cursor) endScan() {
+	if c.slow.start.IsZero() {
+		return
+	}
+	db := c.tx.db
+	if elapsed := time.Since(c.slow.start); db.slow(elapsed) {
+		db.log.Warn("slow scan", "duration", elapsed, "keys", c.slow.keys, "leaves", c.slow.leaves)
+	}
+	c.slow.start = time.Time{}
+}
+
+// whether the key found is expired, only those of the Tx can be
+func (c *Cursor) expired(key []byte) bool {
+	tx := c.tx
+	if c.tree != &tx.tree {
+		return false
+	}
+	if w, ok := tx.writes[string(key)]; ok {
+		return w.expired(tx.clock())
+	}
+	expired, err := tx.expired(key)
+	if err != nil {
+		treeFail(err)
+	}
+	return expired
+}
+
+// move once, expired keys included
+func (c *Cursor) step(forward bool, from []byte, inclusive bool) ([]byte, []byte) {
+	tx := c.tx
+	after := func(k []byte) bool {
+		if from == nil {
+			return true
+		}
+		cmp := c.tree.compare(k, from)
+		if !forward {
+			cmp = -cmp
+		}
+		return cmp > 0 || inclusive && cmp == 0
+	}
+	if c.gen != tx.gen {
+		// the tree changed under the cursor, find the position again
+		c.iter = c.tree.SeekLE(from)
+		c.gen = tx.gen
+	}
+	for len(c.iter.path) > 0 {
+		if c.iter.Valid() {
+			if k, _ := c.iter.Deref(); after(k) {
+				break
+			}
+		} else if c.iter.atEnd() == forward {
+			break // no key left in this direction
+		}
+		if forward {
+			c.iter.Next()
+		} else {
+			c.iter.Prev()
+		}
+	}
+
+	if n := len(c.iter.path); n > 0 && &c.iter.path[n-1].data[0] != c.leaf {
+		c.leaf = &c.iter.path[n-1].data[0]
+		c.slow.leaves++
+		if err := tx.ctx.Err(); err != nil {
+			c.err = err
+			return nil, nil
+		}
+	}
+	c.readAhead(forward)
+
+	var key, value []byte
+	if c.iter.Valid() {
+		key, value = c.iter.Deref()
+	}
+	if tx.optimistic {
+		key, value = c.mergeWrites(forward, from, inclusive, key, value)
+	}
+	c.record(forward, from, key)
+	c.key = key
+	return key, value
+}
+
+// merge the buffered updates of an optimistic Tx with the tree key found
+func (c *Cursor) mergeWrites(forward bool, from []byte, inclusive bool, key, value []byte) ([]byte, []byte) {
+	tx := c.tx
+	if c.writes == nil || c.writesGen != tx.gen {
+		c.writes = c.writes[:0]
+		for k := range tx.writes {
+			c.writes = append(c.writes, k)
+		}
+		slices.SortFunc(c.writes, c.compare)
+		c.writesGen = tx.gen
+	}
+	// the updated keys on the way, nearest first
+	var i, end, dir int
+	if forward {
+		i, _ = slices.BinarySearchFunc(c.writes, string(from), c.compare)
+		if i < len(c.writes) && from != nil && !inclusive && c.writes[i] == string(from) {
+			i++
+		}
+		end, dir = len(c.writes), 1
+	} else {
+		i = len(c.writes)
+		if from != nil {
+			i, _ = slices.BinarySearchFunc(c.writes, string(from), c.compare)
+		}
+		i, end, dir = i-1, -1, -1
+	}
+	for ; i != end; i += dir {
+		w := c.writes[i]
+		if key != nil {
+			cmp := c.tree.compare([]byte(w), key)
+			if forward && cmp > 0 || !forward && cmp < 0 {
+				break // the tree key comes first
+			}
+		}
+		update := tx.writes[w]
+		if !update.deleted && !update.expired(tx.clock()) {
+			return []byte(w), c.pendingValue(w, update)
+		}
+		if key != nil && w == string(key) {
+			// deleted by the Tx, continue from the tree key
+			return c.step(forward, key, false)
+		}
+	}
+	if key != nil {
+		if update, ok := tx.writes[string(key)]; ok && !update.deleted {
+			value = c.pendingValue(string(key), update)
+		}
+	}
+	return key, value
+}
+
+// extend the range walked for Serializable validation
+func (c *Cursor) record(forward bool, from []byte, key []byte) {
+	tx := c.tx
+	if !tx.optimistic {
+		return
+	}
+	tx.touched = true
+	if tx.reads == nil {
+		return // not Serializable
+	}
+	lo, hi := from, append([]byte(nil), key...)
+	if !forward {
+		lo, hi = key, append([]byte(nil), from...)
+	}
+	if c.scan < 0 {
+		tx.scans = append(tx.scans, keyRange{start: lo, end: hi, inclusive: true})
+		c.scan = len(tx.scans) - 1
+		return
+	}
+	r := &tx.scans[c.scan]
+	if c.tree.compare(lo, r.start) < 0 {
+		r.start = lo
+	}
+	if r.end != nil && (hi == nil || c.tree.compare(hi, r.end) > 0) {
+		r.end = hi
+	}
+}
+
+func (c *Cursor) pendingValue(key string, w pendingWrite) []byte {
+	value, _, err := c.tx.pendingValue([]byte(key), w)
+	if err != nil {
+		treeFail(err)
+	}
+	return value
+}
+
+// the key order of the Tx for the buffered updates
+func (c *Cursor) compare(a, b string) int {
+	return c.tree.compare([]byte(a), []byte(b))
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// walk the cursors of the Tx forward, backward and from random keys and
+// compare them with m
+func checkCursor(t *testing.T, tx *Tx, m map[string]string, r *rand.Rand) {
+	t.Helper()
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	c := tx.Cursor()
+	var got []string
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if m[string(k)] != string(v) {
+			t.Fatalf("%q is %q, want %q", k, v, m[string(k)])
+		}
+		got = append(got, string(k))
+	}
+	if !slices.Equal(got, keys) {
+		t.Fatalf("walked %d keys forward, want %d", len(got), len(keys))
+	}
+	got = got[:0]
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		got = append(got, string(k))
+	}
+	slices.Reverse(got)
+	if !slices.Equal(got, keys) {
+		t.Fatalf("walked %d keys backward, want %d", len(got), len(keys))
+	}
+	for i := 0; i < 50; i++ {
+		from := fmt.Sprintf("k%04d", r.Intn(1200))
+		k, _ := c.Seek([]byte(from))
+		j, _ := slices.BinarySearch(keys, from)
+		if j == len(keys) {
+			if k != nil {
+				t.Fatalf("seek %q: %q past the last key", from, k)
+			}
+			continue
+		}
+		if string(k) != keys[j] {
+			t.Fatalf("seek %q: %q, want %q", from, k, keys[j])
+		}
+		k, _ = c.Prev()
+		if j == 0 && k != nil || j > 0 && string(k) != keys[j-1] {
+			t.Fatalf("prev after seek %q: %q", from, k)
+		}
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	db := openTest(t)
+	r := rand.New(rand.NewSource(1))
+	m := map[string]string{}
+	ro, _ := db.Begin(false)
+	checkCursor(t, ro, m, r)
+	ro.Rollback()
+	for round := 0; round < 6; round++ {
+		for _, optimistic := range []bool{false, true} {
+			var tx *Tx
+			if optimistic {
+				tx, _ = db.BeginTx(TxOptions{Writable: true})
+			} else {
+				tx, _ = db.Begin(true)
+			}
+			for i := 0; i < 300; i++ {
+				k := fmt.Sprintf("k%04d", r.Intn(1000))
+				if r.Intn(3) == 0 {
+					tx.Del([]byte(k))
+					delete(m, k)
+				} else {
+					v := fmt.Sprint(r.Intn(1e6))
+					tx.Set([]byte(k), []byte(v))
+					m[k] = v
+				}
+				if i%100 == 0 {
+					checkCursor(t, tx, m, r)
+				}
+			}
+			// the cursor sees the updates made while it walks
+			c := tx.Cursor()
+			n := 0
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				if n++; n > 5000 {
+					t.Fatal("the walk doesn't end")
+				}
+				if n%3 == 0 {
+					tx.Del(k)
+					delete(m, string(k))
+				}
+				if k[0] == 'k' {
+					tx.Set([]byte("j"+string(k)), []byte("x"))
+					m["j"+string(k)] = "x"
+				}
+			}
+			checkCursor(t, tx, m, r)
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			ro, _ := db.Begin(false)
+			checkCursor(t, ro, m, r)
+			ro.Rollback()
+		}
+	}
+}
+
+// a cursor walking a snapshot while commits free its pages and reuse the
+// free ones, and checkpoints write them in place
+func TestCursorConcurrentCommits(t *testing.T) {
+	db := openTest(t, WithCacheSize(16))
+	r := rand.New(rand.NewSource(3))
+	snap := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		k, v := fmt.Sprintf("k%04d", i), fmt.Sprint(r.Int63())
+		mustSet(t, db, k, v)
+		snap[k] = v
+	}
+	db.Checkpoint()
+	ro, _ := db.Begin(false)
+	defer ro.Rollback()
+	c := ro.Cursor()
+	k, v := c.First()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	stop := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		w := rand.New(rand.NewSource(4))
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := []byte(fmt.Sprintf("k%04d", w.Intn(1000)))
+			if i%7 == 0 {
+				db.Del(key)
+			} else {
+				db.Set(key, []byte(fmt.Sprint("new", i)))
+			}
+			if i%100 == 0 {
+				db.Checkpoint()
+			}
+		}
+	}()
+	var keys []string
+	for ; k != nil; k, v = c.Next() {
+		if snap[string(k)] != string(v) {
+			t.Errorf("%q is %q, want %q of the snapshot", k, v, snap[string(k)])
+			break
+		}
+		keys = append(keys, string(k))
+		if len(keys)%50 == 0 {
+			// let some commits free the pages just walked
+			for before := db.Stats().Commits; db.Stats().Commits < before+20; {
+				runtime.Gosched()
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(snap) {
+		t.Fatalf("walked %d keys, the snapshot has %d", len(keys), len(snap))
+	}
+	if s := db.Stats(); s.CacheMisses == 0 || s.FreePages == 0 {
+		t.Fatalf("no page read from the file or freed: %+v", s)
+	}
+	checkCursor(t, ro, snap, r)
+}
+
+func TestCursorPhantom(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "a1", "1")
+	mustSet(t, db, "b1", "1")
+	tx := beginTest(t, db, Serializable)
+	c := tx.Cursor()
+	n := 0
+	for k, _ := c.Seek([]byte("a")); k != nil && k[0] == 'a'; k, _ = c.Next() {
+		n++
+	}
+	tx.Set([]byte("count"), []byte{byte(n)})
+	mustSet(t, db, "a2", "1") // in the range walked
+	var conflict *ConflictError
+	if err := tx.Commit(); !errors.As(err, &conflict) || string(conflict.Key) != "a2" {
+		t.Fatalf("commit after a phantom: %v", err)
+	}
+
+	// outside the range
+	tx = beginTest(t, db, Serializable)
+	c = tx.Cursor()
+	for k, _ := c.Seek([]byte("a")); k != nil && k[0] == 'a'; k, _ = c.Next() {
+	}
+	tx.Set([]byte("count"), []byte{2})
+	mustSet(t, db, "c1", "1")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,843 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DB_SIG         = "StorageEngine-01"
+	FORMAT_VERSION = 8
+	ENGINE_VERSION = "0.1.0"
+
+	// meta page layout, page 0 of the file
+	// | sig | root | npages | free list | version | format | id | created | opened | created by | opened by | page size | comparator | catalog | cipher | key check | previous key | checksum | crc32 |
+	// | 16B | 8B   | 8B     | 8B        | 8B      | 4B     | 16B| 8B      | 8B     | 16B        | 16B       | 4B        | 16B        | 8B      | 4B     | 16B       | 64B          | 4B       | 4B    |
+	// format 3 has neither page size nor comparator, its pages are of
+	// BTREE_PAGE_SIZE and its keys in bytes.Compare order.
+	// format 4 has no bucket catalog.
+	// format 5 isn't encrypted, see crypt.go.
+	// format 6 has no previous key, see rekey.go.
+	// format 7 has no checksum of the pages, see pager.go.
+	META_VERSION_LEN = 16
+	META_NAME_LEN    = 16
+	META_SIZE_V3     = 16 + 8 + 8 + 8 + 8 + 4 + 16 + 8 + 8 + 2*META_VERSION_LEN + 4
+	META_SIZE_V4     = META_SIZE_V3 + 4 + META_NAME_LEN
+	META_SIZE_V5     = META_SIZE_V4 + 8
+	META_SIZE_V6     = META_SIZE_V5 + 4 + KEY_CHECK_LEN
+	META_SIZE_V7     = META_SIZE_V6 + PREVIOUS_KEY_LEN
+	META_SIZE        = META_SIZE_V7 + 4
+
+	DEFAULT_MAX_BATCH_DELAY = time.Millisecond
+	DEFAULT_CHECKPOINT_SIZE = 4 << 20
+)
+
+var (
+	ErrBadMeta  = errors.New("bad meta page")
+	ErrDBClosed = errors.New("database is closed")
+	ErrReadOnly = errors.New("database is read-only")
+)
+
+// DBID identifies a database file for its whole life.
+type DBID [16]byte
+
+func (id DBID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// Info is the identity and creation metadata recorded in the meta page.
+type Info struct {
+	ID            DBID
+	FormatVersion uint32
+	Created       time.Time
+	LastOpened    time.Time
+	CreatedBy     string // engine version that created the file
+	LastOpenedBy  string // engine version that opened the file most recently
+	PageSize      int
+	Comparator    string // name of the key order, empty for bytes.Compare
+	Encrypted     bool   // the pages, see WithEncryptionKey
+	EncryptedWAL  bool   // the records of the WAL, its archive and the incremental backups
+	Checksums     bool   // the pages of a plaintext file have a CRC32, see FORMAT_VERSION 8
+}
+
+// Stats are counters of the database activity since Open.
+type Stats struct {
+	SyncPolicy    SyncPolicy
+	Commits       uint64 // durable commits
+	Unsynced      uint64 // commits visible but not durable yet, lost on a crash
+	WALSyncs      uint64 // fsyncs of the WAL, a batch of commits each
+	LastBatch     uint64 // commits made durable by the last fsync
+	LargestBatch  uint64
+	CacheHits     uint64 // page reads served from memory
+	CacheMisses   uint64 // page reads from the file
+	FlushedPages  uint64 // dirty pages written ahead of the checkpoint
+	ScrubbedPages uint64 // pages verified by Scrub
+	BadPages      int    // quarantined by Scrub
+	ReadAhead     uint64 // pages read ahead of sequential scans
+	PageSize      int
+	FilePages     uint64    // pages of the file, once checkpointed
+	FreePages     int       // reusable now or once no reader needs them
+	FreeListPages int       // pages storing the free list
+	CachedPages   int       // clean and dirty pages in memory
+	WALSize       int64     // bytes of the WAL, emptied by checkpoints
+	PageReads     uint64    // pages read from the file, read ahead included
+	PageWrites    uint64    // pages written in place by checkpoints and the flusher
+	CommitLatency Histogram // of the commits writing a record, fsync included
+	// with WithLatencyHistograms only, of Tx.Get and Tx.Set, optimistic
+	// ones only buffer, and of the fsyncs of commits and checkpoints
+	GetLatency  Histogram
+	SetLatency  Histogram
+	SyncLatency Histogram
+	// with Follow only: the commits of the primary not applied yet, and
+	// the time since the replica was last up to date, as told by the
+	// heartbeats of the primary: up to REPLICATION_HEARTBEAT_INTERVAL when
+	// it's idle, growing while the primary is unreachable
+	ReplicationLag   uint64
+	ReplicationDelay time.Duration
+}
+
+// CacheHitRate is the share of page reads served from memory.
+func (s Stats) CacheHitRate() float64 {
+	if s.CacheHits+s.CacheMisses == 0 {
+		return 0
+	}
+	return float64(s.CacheHits) / float64(s.CacheHits+s.CacheMisses)
+}
+
+type DB struct {
+	Path string
+
+	fp            *os.File
+	opts          options
+	log           Logger
+	pager         pager
+	wal           *wal
+	cipher        *pageCipher // of the pages, nil if not encrypted
+	checksums     bool        // the pages have a CRC32, plaintext files since format 8
+	info          Info
+	writer        sync.Mutex // held by the writable Tx
+	prepareMu     sync.Mutex // protects prepared
+	prepared      *preparedTx
+	writersActive int32                // writable Tx open or waiting to begin
+	sequences     map[string]*sequence // of the AUTO_INCREMENT columns by table, used by the writable Tx
+	schemas       struct {
+		mu     sync.Mutex
+		tables map[string]*cachedTable // handles of the schemas read, by table
+	}
+	rowChecks    rowChecks
+	cache        *pageCache
+	locks        lockTable
+	mu           sync.Mutex // protects the fields below
+	closing      *sync.Cond // signaled when the last read-only Tx ends after Close
+	closed       atomic.Bool
+	nreaders     atomic.Int32 // open read-only Tx
+	root         uint64       // root of the last commit
+	catalog      uint64       // root of the bucket catalog of the last commit
+	version      uint64       // version of the last commit
+	checkpointed uint64       // version of the meta page on disk
+	commits      []commit
+	history      []writeSet               // keys written by recent commits
+	lastWrite    map[string]uint64        // last commit writing each key of history
+	visible      atomic.Pointer[snapshot] // the last durable commit, seen by readers
+	retired      []*snapshot              // older snapshots maybe pinned by readers
+	free         freeList
+	page         struct {
+		flushed uint64 // database size in number of pages
+	}
+	sync struct {
+		mu       sync.Mutex
+		done     *sync.Cond // signaled after each fsync of the WAL
+		syncing  bool       // a committer is running fsync
+		appended uint64     // version of the last record in the WAL
+		durable  uint64     // version of the last durable record
+		err      error      // the database is unusable after a failed fsync
+	}
+	flusher struct {
+		mu   sync.Mutex // held while writing dirty pages in place
+		once sync.Once
+		stop chan struct{}
+		done chan struct{}
+	}
+	syncer struct {
+		once sync.Once
+		stop chan struct{}
+		done chan struct{}
+	}
+	watch   watchers
+	archive struct {
+		mu  sync.RWMutex // held by the checkpoints to empty the WAL, by walReaders to read it
+		gen uint64       // of the WAL, one more at each reset
+	}
+	committed chan struct{} // closed by the next publish, see commitSignal
+	replica   struct {
+		cancel   context.CancelFunc // of the Follow of WithReplicaOf
+		done     chan struct{}
+		applied  atomic.Uint64 // last commit of the primary applied
+		primary  atomic.Uint64 // last commit of the primary known
+		upToDate atomic.Int64  // unix nanoseconds when applied last reached primary
+	}
+	sweeper struct {
+		once   sync.Once
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+	scrub struct {
+		once   sync.Once
+		cancel context.CancelFunc
+		done   chan struct{}
+		mu     sync.Mutex       // protects bad
+		bad    map[uint64]error // the pages quarantined, see Scrub
+	}
+	rekey struct {
+		mu     sync.Mutex
+		cancel context.CancelFunc // of the sweep of RotateEncryptionKey
+		done   chan struct{}      // closed at its end, nil if none started
+		err    error              // that stopped it
+	}
+	stats struct {
+		commits         atomic.Uint64
+		walSyncs        atomic.Uint64
+		lastBatch       atomic.Uint64
+		largestBatch    atomic.Uint64
+		flushedPages    atomic.Uint64
+		scrubbedPages   atomic.Uint64
+		prefetchedPages atomic.Uint64
+		pageReads       atomic.Uint64
+		pageWrites      atomic.Uint64
+		commitLatency   histogram
+		getLatency      histogram
+		setLatency      histogram
+		syncLatency     histogram
+	}
+}
+
+// a commit waiting to be durable
+type commit struct {
+	version uint64
+	root    uint64
+	catalog uint64
+}
+
+func newDBID() (DBID, error) {
+	var id DBID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, err
+	}
+	// RFC 4122 version 4, variant 1
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id, nil
+}
+
+func Open(path string, opts ...Option) (*DB, error) {
+	db := &DB{
+		Path:      path,
+		lastWrite: map[string]uint64{},
+	}
+	db.opts = options{
+		pageSize:       BTREE_PAGE_SIZE,
+		maxBatchDelay:  DEFAULT_MAX_BATCH_DELAY,
+		checkpointSize: DEFAULT_CHECKPOINT_SIZE,
+		cacheSize:      DEFAULT_CACHE_SIZE,
+		flushRate:      DEFAULT_FLUSH_RATE,
+		readAhead:      DEFAULT_READ_AHEAD,
+		sweepInterval:  DEFAULT_SWEEP_INTERVAL,
+		scrubRate:      DEFAULT_SCRUB_RATE,
+		minFreeSpace:   DEFAULT_MIN_FREE_SPACE,
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if err := db.opts.check(); err != nil {
+		return nil, err
+	}
+	if db.log = db.opts.logger; db.log == nil {
+		db.log = nopLogger{}
+	}
+	flag := os.O_RDWR | os.O_CREATE
+	if db.opts.readOnly {
+		flag = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	db.fp = fp
+	db.cache = newPageCache(db.opts.cacheSize)
+	db.closing = sync.NewCond(&db.mu)
+	db.sync.done = sync.NewCond(&db.sync.mu)
+	db.locks.released = sync.NewCond(&db.locks.mu)
+	db.locks.waiting = map[*Tx]keyRange{}
+	if err := db.loadMeta(); err != nil {
+		db.log.Error("open failed", "err", err)
+		if db.pager != nil {
+			db.pager.close()
+		}
+		fp.Close()
+		return nil, err
+	}
+	if db.wal, err = openWAL(path, db.info.ID, db.opts.readOnly, db.cipher); err != nil {
+		db.pager.close()
+		fp.Close()
+		return nil, err
+	}
+	if err := db.recover(); err != nil {
+		db.log.Error("recovery failed", "err", err)
+		db.wal.close()
+		db.pager.close()
+		fp.Close()
+		return nil, err
+	}
+	db.loadSchemas()
+	if db.cipher != nil && db.cipher.rotating() && !db.readOnly(context.Background()) {
+		db.startRekey()
+	}
+	if db.opts.replicaOf != "" {
+		db.startReplica()
+	}
+	return db, nil
+}
+
+// Close waits for all open transactions to finish, checkpoints and closes the files.
+func (db *DB) Close() error {
+	db.stopReplica()
+	db.stopScrubber()
+	defer db.lockWriter()()
+	db.mu.Lock()
+	if db.closed.Swap(true) {
+		db.mu.Unlock()
+		return ErrDBClosed
+	}
+	db.signalCommit() // for the change streams waiting
+	for db.nreaders.Load() > 0 {
+		db.closing.Wait()
+	}
+	db.mu.Unlock()
+	db.stopRekey()
+	db.stopFlusher()
+	db.stopSyncer()
+	db.stopSweeper()
+	db.watch.close()
+
+	var err error
+	if !db.opts.readOnly {
+		err = db.checkpoint()
+	}
+	db.archive.mu.Lock() // no walReader is reading it
+	werr := db.wal.close()
+	db.archive.mu.Unlock()
+	return errors.Join(err, werr, db.pager.close(), db.fp.Close())
+}
+
+// replay the commits of the WAL made after the last checkpoint
+func (db *DB) recover() (err error) {
+	replayed := 0
+	logged := db.wal.size.Load()
+	_, span := db.startSpan(context.Background(), "storage_engine.recover")
+	defer func() {
+		span.set("recover.commits", replayed)
+		span.set("recover.wal_bytes", logged-WAL_HEADER)
+		endSpan(span, err)
+	}()
+	var prepared *walRecord // not resolved yet
+	err = db.wal.replay(func(rec walRecord) error {
+		if len(rec.ops) > 0 {
+			switch rec.ops[0].kind {
+			case WAL_OP_PREPARE:
+				// kept by checkpoints until resolved, whatever the version
+				prepared = &rec
+				return nil
+			case WAL_OP_COMMIT_PREPARED:
+				if prepared == nil || !bytes.Equal(prepared.ops[0].key, rec.ops[0].key) {
+					return fmt.Errorf("%w: commit of unknown prepared transaction %q", ErrBadWAL, rec.ops[0].key)
+				}
+				ops := prepared.ops
+				rec.ops, prepared = append(ops[1:len(ops):len(ops)], rec.ops[1:]...), nil
+			case WAL_OP_ROLLBACK_PREPARED:
+				prepared = nil
+				return nil
+			}
+		}
+		if rec.version <= db.checkpointed {
+			return nil
+		}
+		if rec.version != db.version+1 {
+			return fmt.Errorf("%w: record %d follows version %d", ErrBadWAL, rec.version, db.version)
+		}
+		tx, err := db.beginWrite(context.Background())
+		if err != nil {
+			return err
+		}
+		if err := tx.replay(rec.ops); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.flushUsage(); err != nil {
+			tx.Rollback()
+			return err
+		}
+		tx.publish(rec.version)
+		tx.close()
+		db.sync.durable = rec.version
+		db.publish(rec.version)
+		replayed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if torn := logged - db.wal.size.Load(); torn > 0 {
+		db.log.Warn("dropped the torn end of the WAL", "bytes", torn)
+	}
+	if replayed > 0 {
+		db.log.Info("recovered commits from the WAL", "commits", replayed, "version", db.version)
+	}
+	if prepared != nil {
+		db.log.Warn("prepared transaction in doubt", "id", string(prepared.ops[0].key))
+	}
+	if db.opts.readOnly {
+		// the WAL stays for the next writable Open
+		return nil
+	}
+	if prepared != nil {
+		if err := db.restorePrepared(*prepared); err != nil {
+			return err
+		}
+	} else if replayed == 0 {
+		return db.resetWAL()
+	}
+	defer db.lockWriter()()
+	return db.checkpoint()
+}
+
+// apply the ops of a WAL record
+func (tx *Tx) replay(ops []walOp) error {
+	var err error
+	var bucket *Bucket
+	for _, op := range ops {
+		switch {
+		case op.kind == WAL_OP_SET && bucket != nil:
+			err = bucket.Set(op.key, op.value)
+		case op.kind == WAL_OP_SET:
+			err = tx.set(op.key, op.value)
+		case op.kind == WAL_OP_DEL && bucket != nil:
+			_, err = bucket.Del(op.key)
+		case op.kind == WAL_OP_DEL:
+			_, err = tx.del(op.key)
+		case op.kind == WAL_OP_EXPIRE:
+			var deadline int64
+			if deadline, err = decodeDeadline(op.value); err == nil {
+				err = tx.expire(op.key, deadline)
+			}
+		case op.kind == WAL_OP_REPLICATED:
+			err = tx.replicated(op.value)
+		case op.kind == WAL_OP_TIME:
+			// the commit replaying it has its own
+		case op.kind == WAL_OP_AUDIT:
+			err = tx.auditPart(op.key, op.value)
+		case op.kind == WAL_OP_BUCKET && len(op.key) == 0:
+			bucket = nil
+		case op.kind == WAL_OP_BUCKET:
+			bucket = &Bucket{tx: tx, path: op.key}
+			bucket.tree, err = tx.bucketTree(op.key)
+		case op.kind == WAL_OP_CREATE_BUCKET:
+			err = tx.addBucket(op.key)
+		case op.kind == WAL_OP_DELETE_BUCKET:
+			err = tx.removeBucket(op.key)
+		default:
+			err = fmt.Errorf("%w: bad op type %d", ErrBadWAL, op.kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// make the commits up to the given version visible to readers
+func (db *DB) publish(version uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n := 0
+	for ; n < len(db.commits) && db.commits[n].version <= version; n++ {
+		db.publishSnapshot(db.commits[n])
+	}
+	db.commits = db.commits[n:]
+	db.watch.deliver(version)
+	db.signalCommit()
+}
+
+// a channel closed once a commit is published
+func (db *DB) commitSignal() <-chan struct{} {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.committed == nil {
+		db.committed = make(chan struct{})
+	}
+	return db.committed
+}
+
+// wake the waiters of commitSignal, the caller holds db.mu
+func (db *DB) signalCommit() {
+	if db.committed != nil {
+		close(db.committed)
+		db.committed = nil
+	}
+}
+
+func (db *DB) slow(elapsed time.Duration) bool {
+	return db.opts.slowThreshold > 0 && elapsed >= db.opts.slowThreshold
+}
+
+// the error that made the database unusable, if any
+func (db *DB) failed() error {
+	db.sync.mu.Lock()
+	defer db.sync.mu.Unlock()
+	return db.sync.err
+}
+
+// fail every write from now on
+func (db *DB) poison(err error) {
+	db.sync.mu.Lock()
+	first := db.sync.err == nil
+	if first {
+		db.sync.err = err
+	}
+	db.sync.mu.Unlock()
+	if first {
+		db.log.Error("database failed, writes are refused until it's reopened", "err", err)
+	}
+}
+
+func (db *DB) Stats() Stats {
+	db.sync.mu.Lock()
+	unsynced := db.sync.appended - db.sync.durable
+	db.sync.mu.Unlock()
+	db.mu.Lock()
+	pages, free, listPages := db.page.flushed, db.free.total(), len(db.free.pages)
+	db.mu.Unlock()
+	s := Stats{
+		SyncPolicy:    db.opts.syncPolicy,
+		Unsynced:      unsynced,
+		Commits:       db.stats.commits.Load(),
+		WALSyncs:      db.stats.walSyncs.Load(),
+		LastBatch:     db.stats.lastBatch.Load(),
+		LargestBatch:  db.stats.largestBatch.Load(),
+		CacheHits:     db.cache.hits.Load(),
+		CacheMisses:   db.cache.misses.Load(),
+		FlushedPages:  db.stats.flushedPages.Load(),
+		ScrubbedPages: db.stats.scrubbedPages.Load(),
+		ReadAhead:     db.stats.prefetchedPages.Load(),
+		PageSize:      db.opts.pageSize,
+		FilePages:     pages,
+		FreePages:     free,
+		FreeListPages: listPages,
+		CachedPages:   db.cache.len(),
+		WALSize:       db.wal.size.Load(),
+		PageReads:     db.stats.pageReads.Load(),
+		PageWrites:    db.stats.pageWrites.Load(),
+		CommitLatency: db.stats.commitLatency.snapshot(),
+		GetLatency:    db.stats.getLatency.snapshot(),
+		SetLatency:    db.stats.setLatency.snapshot(),
+		SyncLatency:   db.stats.syncLatency.snapshot(),
+	}
+	s.ReplicationLag, s.ReplicationDelay = db.replicationLag()
+	db.scrub.mu.Lock()
+	s.BadPages = len(db.scrub.bad)
+	db.scrub.mu.Unlock()
+	return s
+}
+
+// Info returns the identity of the database.
+func (db *DB) Info() Info {
+	info := db.info
+	info.PageSize = db.opts.pageSize
+	info.Comparator = db.opts.comparator
+	info.Encrypted = db.cipher != nil
+	info.EncryptedWAL = db.wal.cipher != nil
+	info.Checksums = db.checksums
+	return info
+}
+
+// Get, Set and Del are shortcuts running a single operation in its own Tx.
+// The value returned by Get is a copy since its Tx is over.
+func (db *DB) Get(key []byte) ([]byte, bool, error) {
+	return db.GetContext(context.Background(), key)
+}
+
+func (db *DB) Set(key []byte, value []byte) error {
+	return db.SetContext(context.Background(), key, value)
+}
+
+func (db *DB) Del(key []byte) (bool, error) {
+	return db.DelContext(context.Background(), key)
+}
+
+// read the meta page, or create one for a new file
+func (db *DB) loadMeta() error {
+	fi, err := db.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	now := time.Now()
+	var freeHead uint64
+	if fi.Size() == 0 {
+		if db.opts.readOnly {
+			return fmt.Errorf("%w: empty file", ErrBadMeta)
+		}
+		id, err := newDBID()
+		if err != nil {
+			return fmt.Errorf("generate database id: %w", err)
+		}
+		if err := db.loadKey(id); err != nil {
+			return err
+		}
+		db.info = Info{
+			ID:            id,
+			FormatVersion: FORMAT_VERSION,
+			Created:       now,
+			CreatedBy:     ENGINE_VERSION,
+		}
+		// the encrypted pages have the tag of AES-GCM instead
+		db.checksums = db.cipher == nil
+		db.page.flushed = 1 // reserved for the meta page
+		db.publishSnapshot(commit{})
+	} else {
+		data := make([]byte, META_SIZE)
+		if _, err := db.fp.ReadAt(data, 0); err != nil {
+			return fmt.Errorf("read meta page: %w", err)
+		}
+		if freeHead, err = db.decodeMeta(data); err != nil {
+			return err
+		}
+		if uint64(fi.Size()) < db.page.flushed*uint64(db.opts.pageSize) {
+			return fmt.Errorf("%w: file is smaller than %d pages", ErrBadMeta, db.page.flushed)
+		}
+	}
+	if db.pager, err = newPager(db.fp, db.opts.backend, db.opts.pageSize); err != nil {
+		return err
+	}
+	if db.cipher != nil {
+		db.pager = newCryptPager(db.pager, db.cipher, db.opts.pageSize)
+	} else if db.checksums {
+		db.pager = newChecksumPager(db.pager, db.opts.pageSize)
+	}
+	if freeHead == FREE_LIST_NONE {
+		err = db.rebuildFreeList()
+	} else {
+		err = db.loadFreeList(freeHead)
+	}
+	if err != nil {
+		return err
+	}
+	if db.opts.readOnly {
+		return nil
+	}
+	db.info.FormatVersion = FORMAT_VERSION
+	db.info.LastOpened = now
+	db.info.LastOpenedBy = ENGINE_VERSION
+	return db.writeMeta()
+}
+
+// the version and name fields are zero padded strings
+func putString(dst []byte, str string) {
+	clear(dst[:META_VERSION_LEN])
+	copy(dst[:META_VERSION_LEN], str)
+}
+
+func getString(src []byte) string {
+	return string(bytes.TrimRight(src[:META_VERSION_LEN], "\x00"))
+}
+
+func (db *DB) encodeMeta() []byte {
+	data := make([]byte, db.opts.pageSize)
+	copy(data[:16], DB_SIG)
+	binary.LittleEndian.PutUint64(data[16:], db.root)
+	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	if db.opts.noFreelistSync {
+		binary.LittleEndian.PutUint64(data[32:], FREE_LIST_NONE)
+	} else if len(db.free.pages) > 0 {
+		binary.LittleEndian.PutUint64(data[32:], db.free.pages[0])
+	}
+	binary.LittleEndian.PutUint64(data[40:], db.checkpointed)
+	binary.LittleEndian.PutUint32(data[48:], db.info.FormatVersion)
+	copy(data[52:68], db.info.ID[:])
+	binary.LittleEndian.PutUint64(data[68:], uint64(db.info.Created.UnixNano()))
+	binary.LittleEndian.PutUint64(data[76:], uint64(db.info.LastOpened.UnixNano()))
+	putString(data[84:], db.info.CreatedBy)
+	putString(data[84+META_VERSION_LEN:], db.info.LastOpenedBy)
+	binary.LittleEndian.PutUint32(data[META_SIZE_V3-4:], uint32(db.opts.pageSize))
+	putString(data[META_SIZE_V3:], db.opts.comparator)
+	binary.LittleEndian.PutUint64(data[META_SIZE_V4-4:], db.catalog)
+	if db.cipher != nil {
+		keys := db.cipher.keys.Load()
+		binary.LittleEndian.PutUint32(data[META_SIZE_V5-4:], CIPHER_AESGCM)
+		copy(data[META_SIZE_V5:], keys.current.keyCheck())
+		copy(data[META_SIZE_V6-4:], keys.sealed)
+	}
+	if db.checksums {
+		binary.LittleEndian.PutUint32(data[META_SIZE_V7-4:], PAGE_CHECKSUM_CRC32)
+	}
+	binary.LittleEndian.PutUint32(data[META_SIZE-4:], crc32.ChecksumIEEE(data[:META_SIZE-4]))
+	return data
+}
+
+// decode the meta page, the free list head is returned to be loaded afterward
+func (db *DB) decodeMeta(data []byte) (uint64, error) {
+	format, err := checkMeta(data)
+	if err != nil {
+		return 0, err
+	}
+	pageSize, comparator := BTREE_PAGE_SIZE, ""
+	if format >= 4 {
+		pageSize = int(binary.LittleEndian.Uint32(data[META_SIZE_V3-4:]))
+		comparator = getString(data[META_SIZE_V3:])
+	}
+	if !validPageSize(pageSize) {
+		return 0, fmt.Errorf("%w: bad page size %d", ErrBadMeta, pageSize)
+	}
+	if comparator != db.opts.comparator {
+		return 0, fmt.Errorf("%w: keys ordered by comparator %q, not %q", ErrBadMeta, comparator, db.opts.comparator)
+	}
+	var id DBID
+	copy(id[:], data[52:68])
+	if err := db.loadKey(id); err != nil {
+		return 0, err
+	}
+	cipher := uint32(CIPHER_NONE)
+	if format >= 6 {
+		cipher = binary.LittleEndian.Uint32(data[META_SIZE_V5-4:])
+	}
+	switch {
+	case cipher != CIPHER_NONE && cipher != CIPHER_AESGCM:
+		return 0, fmt.Errorf("%w: unknown cipher %d", ErrBadMeta, cipher)
+	case cipher == CIPHER_AESGCM && db.cipher == nil:
+		return 0, fmt.Errorf("%w: the file is encrypted, no key given", ErrEncryptionKey)
+	case cipher == CIPHER_NONE && db.cipher != nil:
+		return 0, fmt.Errorf("%w: the file isn't encrypted", ErrEncryptionKey)
+	case db.cipher != nil && !bytes.Equal(data[META_SIZE_V5:META_SIZE_V5+KEY_CHECK_LEN], db.cipher.keys.Load().current.keyCheck()):
+		return 0, ErrEncryptionKey
+	}
+	if format >= 7 && db.cipher != nil && binary.LittleEndian.Uint32(data[META_SIZE_V6-4:]) != 0 {
+		if err := db.cipher.loadPrevious(data[META_SIZE_V6-4 : META_SIZE_V7-4]); err != nil {
+			return 0, err
+		}
+	}
+	checksum := uint32(PAGE_CHECKSUM_NONE)
+	if format >= 8 {
+		checksum = binary.LittleEndian.Uint32(data[META_SIZE_V7-4:])
+	}
+	if checksum != PAGE_CHECKSUM_NONE && (checksum != PAGE_CHECKSUM_CRC32 || cipher != CIPHER_NONE) {
+		return 0, fmt.Errorf("%w: unknown page checksum %d", ErrBadMeta, checksum)
+	}
+	db.checksums = checksum == PAGE_CHECKSUM_CRC32
+	db.opts.pageSize = pageSize
+	db.root = binary.LittleEndian.Uint64(data[16:])
+	if format >= 5 {
+		db.catalog = binary.LittleEndian.Uint64(data[META_SIZE_V4-4:])
+	}
+	db.page.flushed = binary.LittleEndian.Uint64(data[24:])
+	freeHead := binary.LittleEndian.Uint64(data[32:])
+	db.checkpointed = binary.LittleEndian.Uint64(data[40:])
+	db.info.FormatVersion = format
+	copy(db.info.ID[:], data[52:68])
+	db.info.Created = time.Unix(0, int64(binary.LittleEndian.Uint64(data[68:])))
+	db.info.LastOpened = time.Unix(0, int64(binary.LittleEndian.Uint64(data[76:])))
+	db.info.CreatedBy = getString(data[84:])
+	db.info.LastOpenedBy = getString(data[84+META_VERSION_LEN:])
+	if db.page.flushed < 1 || db.root >= db.page.flushed || db.catalog >= db.page.flushed {
+		return 0, fmt.Errorf("%w: root %d or catalog %d out of %d pages", ErrBadMeta, db.root, db.catalog, db.page.flushed)
+	}
+	db.version = db.checkpointed
+	db.publishSnapshot(commit{version: db.version, root: db.root, catalog: db.catalog})
+	db.sync.appended, db.sync.durable = db.version, db.version
+	return freeHead, nil
+}
+
+// check the signature and checksum of a meta page, returns its format
+func checkMeta(data []byte) (uint32, error) {
+	if string(data[:16]) != DB_SIG {
+		return 0, fmt.Errorf("%w: bad signature", ErrBadMeta)
+	}
+	format := binary.LittleEndian.Uint32(data[48:])
+	size := META_SIZE
+	switch format {
+	case FORMAT_VERSION:
+	case 7:
+		size = META_SIZE_V7
+	case 6:
+		size = META_SIZE_V6
+	case 5:
+		size = META_SIZE_V5
+	case 4:
+		size = META_SIZE_V4
+	case 3:
+		size = META_SIZE_V3
+	default:
+		return 0, fmt.Errorf("%w: unsupported format version %d", ErrBadMeta, format)
+	}
+	if crc32.ChecksumIEEE(data[:size-4]) != binary.LittleEndian.Uint32(data[size-4:]) {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrBadMeta)
+	}
+	return format, nil
+}
+
+// the meta fields fit in a single sector so that they're updated atomically
+func (db *DB) writeMeta() error {
+	if _, err := db.fp.WriteAt(db.encodeMeta(), 0); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	if err := db.fsync(db.fp); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+// write pages in place and make the file at least npages long,
+// the pages must be durable before the meta page points to them
+func (db *DB) writePages(pages map[uint64][]byte, npages uint64) error {
+	if err := db.pager.writePages(pages); err != nil {
+		return err
+	}
+	db.stats.pageWrites.Add(uint64(len(pages)))
+	fi, err := db.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	// free pages at the end may have never been written
+	if size := int64(npages) * int64(db.opts.pageSize); fi.Size() < size {
+		if err := db.fp.Truncate(size); err != nil {
+			return fmt.Errorf("extend file: %w", err)
+		}
+	}
+	if err := db.fsync(db.fp); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+// fsync a file, timed with latency histograms enabled
+func (db *DB) fsync(fp *os.File) error {
+	if db.opts.latency {
+		defer db.stats.syncLatency.since(time.Now())
+	}
+	return fp.Sync()
+}
+
+func (db *DB) readPage(ptr uint64) (BNode, error) {
+	data := make([]byte, db.opts.pageSize)
+	if err := db.pager.readPage(ptr, data); err != nil {
+		return BNode{}, err
+	}
+	db.stats.pageReads.Add(1)
+	return BNode{data}, nil
+}
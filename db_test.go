@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// open a DB in a directory of the test, closed when the test is over
+func openTest(t testing.TB, opts ...Option) *DB {
+	t.Helper()
+	return openTestPath(t, filepath.Join(t.TempDir(), "test.db"), opts...)
+}
+
+func openTestPath(t testing.TB, path string, opts ...Option) *DB {
+	t.Helper()
+	db, err := Open(path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil && !errors.Is(err, ErrDBClosed) {
+			t.Error(err)
+		}
+	})
+	return db
+}
+
+// close the DB and open its file again
+func reopenTest(t testing.TB, db *DB, opts ...Option) *DB {
+	t.Helper()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return openTestPath(t, db.Path, opts...)
+}
+
+func mustSet(t testing.TB, db *DB, key, value string) {
+	t.Helper()
+	if err := db.Set([]byte(key), []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fail unless key holds value, or is missing for a nil value
+func wantValue(t testing.TB, db *DB, key string, value []byte) {
+	t.Helper()
+	got, ok, err := db.Get([]byte(key))
+	switch {
+	case err != nil:
+		t.Fatalf("get %q: %v", key, err)
+	case value == nil && ok:
+		t.Fatalf("get %q: %q, want none", key, got)
+	case value != nil && (!ok || string(got) != string(value)):
+		t.Fatalf("get %q: %q %v, want %q", key, got, ok, value)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	before := time.Now()
+	db := openTest(t)
+	info := db.Info()
+	if info.ID == (DBID{}) {
+		t.Fatal("no database id")
+	}
+	if info.Created.Before(before) || info.Created.After(time.Now()) {
+		t.Fatalf("created %v", info.Created)
+	}
+	if info.FormatVersion != FORMAT_VERSION || info.CreatedBy != ENGINE_VERSION || info.LastOpenedBy != ENGINE_VERSION {
+		t.Fatalf("versions %+v", info)
+	}
+	if info.PageSize != BTREE_PAGE_SIZE || info.Comparator != "" || info.Encrypted {
+		t.Fatalf("format %+v", info)
+	}
+	if len(info.ID.String()) != 36 {
+		t.Fatalf("id %s", info.ID)
+	}
+
+	time.Sleep(time.Millisecond)
+	db = reopenTest(t, db)
+	again := db.Info()
+	if again.ID != info.ID || !again.Created.Equal(info.Created) {
+		t.Fatalf("identity changed: %+v, was %+v", again, info)
+	}
+	if !again.LastOpened.After(info.LastOpened) {
+		t.Fatalf("last opened %v, was %v", again.LastOpened, info.LastOpened)
+	}
+	if other := openTest(t).Info(); other.ID == info.ID {
+		t.Fatal("two files with one id")
+	}
+}
+
+func TestInfoReadOnly(t *testing.T) {
+	db := openTest(t)
+	info := db.Info()
+	db.Close()
+	ro := openTestPath(t, db.Path, WithReadOnly())
+	if got := ro.Info(); got.ID != info.ID || !got.LastOpened.Equal(info.LastOpened) {
+		t.Fatalf("read-only open changed the meta page: %+v, was %+v", got, info)
+	}
+}
+
+func TestBadMeta(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "k", "v")
+	db.Close()
+	data, err := os.ReadFile(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, corrupt := range map[string]func([]byte){
+		"signature": func(d []byte) { d[0] ^= 1 },
+		"checksum":  func(d []byte) { d[60] ^= 1 },
+	} {
+		bad := append([]byte{}, data...)
+		corrupt(bad)
+		path := filepath.Join(t.TempDir(), "bad.db")
+		if err := os.WriteFile(path, bad, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if db, err := Open(path); !errors.Is(err, ErrBadMeta) {
+			if err == nil {
+				db.Close()
+			}
+			t.Errorf("%s: open %v, want ErrBadMeta", name, err)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	db := openTest(t)
+	for i := 0; i < 500; i++ {
+		mustSet(t, db, fmt.Sprint("k", i), fmt.Sprint("v", i))
+	}
+	if _, err := db.Del([]byte("k3")); err != nil {
+		t.Fatal(err)
+	}
+	db = reopenTest(t, db)
+	for i := 0; i < 500; i++ {
+		if i == 3 {
+			wantValue(t, db, "k3", nil)
+			continue
+		}
+		wantValue(t, db, fmt.Sprint("k", i), []byte(fmt.Sprint("v", i)))
+	}
+}
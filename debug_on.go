@@ -0,0 +1,7 @@
+//go:build debug
+
+package storage
+
+// DEBUG is set by building with the debug tag: tree errors carry the stack
+// of where the inconsistency was found.
+const DEBUG = true
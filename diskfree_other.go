@@ -0,0 +1,9 @@
+//go:build !unix
+
+package storage
+
+import "fmt"
+
+func diskFree(dir string) (uint64, error) {
+	return 0, fmt.Errorf("free disk space: %w", ErrNotSupported)
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package storage
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// the bytes a user can write to the file system of dir
+func diskFree(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, fmt.Errorf("statfs %s: %w", dir, err)
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
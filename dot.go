@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const DOT_KEY_LEN = 24 // bytes of a key shown in a label, longer ones are cut
+
+// WriteDOT writes the trees of the Tx in the DOT language of Graphviz, for
+// debugging: the keys and each bucket in a cluster, a box per page with its
+// id, key count and first and last key, an edge per pointer. Meant for
+// small databases, every page is read.
+func (tx *Tx) WriteDOT(w io.Writer) (err error) {
+	if tx.done {
+		return ErrTxClosed
+	}
+	defer catchTreeError(&err)
+	paths, roots, err := tx.catalogScan(nil)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph storage {")
+	fmt.Fprintln(bw, "\tnode [shape=box, fontname=monospace];")
+	tx.writeDOTTree(bw, 0, "keys", tx.tree.root)
+	for i, path := range paths {
+		if !bytes.HasPrefix(path, []byte{0, 2}) {
+			tx.writeDOTTree(bw, i+1, "bucket "+formatPath(path), roots[i])
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+func (tx *Tx) writeDOTTree(w io.Writer, n int, label string, root uint64) {
+	fmt.Fprintf(w, "\tsubgraph cluster_%d {\n\t\tlabel=\"%s\";\n", n, dotEscape(label))
+	if root != 0 {
+		tx.writeDOTPage(w, root)
+	}
+	fmt.Fprintln(w, "\t}")
+}
+
+func (tx *Tx) writeDOTPage(w io.Writer, ptr uint64) {
+	node := tx.tree.get(ptr)
+	nkeys := node.getNumberOfKeys()
+	kind := "leaf"
+	if node.getNodeType() == BNODE_NODE {
+		kind = "node"
+	}
+	label := fmt.Sprintf("page %d\n%s, %d keys", ptr, kind, nkeys)
+	if nkeys > 0 {
+		label += fmt.Sprintf("\n%s\n%s", dotQuote(node.getKey(0)), dotQuote(node.getKey(nkeys-1)))
+	}
+	fmt.Fprintf(w, "\t\tp%d [label=\"%s\"];\n", ptr, dotEscape(label))
+	if node.getNodeType() != BNODE_NODE {
+		return
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		kid := node.getPointer(i)
+		fmt.Fprintf(w, "\t\tp%d -> p%d;\n", ptr, kid)
+		tx.writeDOTPage(w, kid)
+	}
+}
+
+// a key as an ASCII Go string, cut to DOT_KEY_LEN bytes
+func dotQuote(key []byte) string {
+	if len(key) > DOT_KEY_LEN {
+		return strconv.QuoteToASCII(string(key[:DOT_KEY_LEN])) + "..."
+	}
+	return strconv.QuoteToASCII(string(key))
+}
+
+// a label in a DOT string, lines kept
+func dotEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
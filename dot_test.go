@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWriteDOT(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < 2000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 50))
+	}
+	b, _ := tx.CreateBucket([]byte(`"b"`))
+	b.Set([]byte("x"), []byte("y"))
+	tx.CreateBucket([]byte("empty"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	stats, _ := db.TreeStats()
+
+	tx, _ = db.Begin(false)
+	var buf bytes.Buffer
+	if err := tx.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	if err := tx.WriteDOT(&buf); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("dot of a closed Tx: %v", err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "digraph storage {\n") || !strings.HasSuffix(out, "}\n") {
+		t.Fatalf("graph\n%s", out)
+	}
+	clusters := regexp.MustCompile(`(?m)^\tsubgraph cluster_\d+ \{\n\t\tlabel="(.*)";$`).FindAllStringSubmatch(out, -1)
+	var labels []string
+	for _, m := range clusters {
+		labels = append(labels, m[1])
+	}
+	if got := strings.Join(labels, ", "); got != `keys, bucket \"b\", bucket empty` {
+		t.Fatalf("clusters %s", got)
+	}
+	// one box per page of the keys and the bucket, one edge per page but
+	// the roots
+	boxes := strings.Count(out, " [label=")
+	edges := strings.Count(out, " -> ")
+	if pages := stats.BranchPages + stats.LeafPages; boxes != pages+1 || edges != pages-1 {
+		t.Fatalf("%d boxes, %d edges for %d pages", boxes, edges, pages)
+	}
+	if !strings.Contains(out, `\n\"k01999\""];`) {
+		t.Fatalf("last leaf not in\n%s", out)
+	}
+}
+
+func TestDOTQuote(t *testing.T) {
+	for key, want := range map[string]string{
+		"abc":                              `"abc"`,
+		"a\x00é":                           `"a\x00\u00e9"`,
+		strings.Repeat("x", DOT_KEY_LEN+1): `"` + strings.Repeat("x", DOT_KEY_LEN) + `"...`,
+	} {
+		if got := dotQuote([]byte(key)); got != want {
+			t.Fatalf("%q quoted %s, want %s", key, got, want)
+		}
+	}
+	if got := dotEscape("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Fatalf("escaped %s", got)
+	}
+}
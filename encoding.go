@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Order-preserving encoding: AppendKey encodes typed values one after the
+// other so that bytes.Compare sorts the keys as the values, the first ones
+// first, for range scans over typed keys: the keys of the rows and of the
+// indexes of the tables. A value is a tag, which sorts NULL first, then:
+//
+// | int64, the sign bit flipped | float64, see below | bool | string or bytes     |
+// | 8B BE                       | 8B BE              |      | escaped, terminated |
+//
+// The bits of a float64 have their sign bit flipped if positive, all of
+// them if negative, -0 is 0. The 0x00 of strings and bytes are escaped as
+// 0x00 0xff and they end with 0x00 0x01, as the names of bucket paths, so
+// that a string sorts before those it's a prefix of.
+
+const (
+	KEY_NULL   = 0x01
+	KEY_FALSE  = 0x02
+	KEY_TRUE   = 0x03
+	KEY_INT64  = 0x10
+	KEY_FLOAT  = 0x20
+	KEY_BYTES  = 0x30
+	KEY_STRING = 0x40
+)
+
+var ErrBadKey = errors.New("bad encoded key")
+
+// PrefixEnd returns the key after all those starting with the values of
+// an encoded key, their end for a range scan: the next byte of those is
+// a tag or of an escaped string, below 0xff.
+func PrefixEnd(key []byte) []byte {
+	return append(key[:len(key):len(key)], 0xff)
+}
+
+// AppendKey appends to dst the encoding of the values, each an int64, a
+// float64, a string, a []byte, a bool or nil.
+func AppendKey(dst []byte, values ...any) ([]byte, error) {
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			dst = append(dst, KEY_NULL)
+		case bool:
+			if v {
+				dst = append(dst, KEY_TRUE)
+			} else {
+				dst = append(dst, KEY_FALSE)
+			}
+		case int64:
+			dst = append(dst, KEY_INT64)
+			dst = binary.BigEndian.AppendUint64(dst, uint64(v)^1<<63)
+		case float64:
+			if v == 0 {
+				v = 0 // -0
+			}
+			bits := math.Float64bits(v)
+			if bits&(1<<63) != 0 {
+				bits = ^bits
+			} else {
+				bits |= 1 << 63
+			}
+			dst = append(dst, KEY_FLOAT)
+			dst = binary.BigEndian.AppendUint64(dst, bits)
+		case string:
+			dst = bucketPath(append(dst, KEY_STRING), []byte(v))
+		case []byte:
+			dst = bucketPath(append(dst, KEY_BYTES), v)
+		default:
+			return nil, fmt.Errorf("%w: %T in a key", ErrBadKey, v)
+		}
+	}
+	return dst, nil
+}
+
+// DecodeKey returns the values of a key of AppendKey.
+func DecodeKey(key []byte) ([]any, error) {
+	var values []any
+	for len(key) > 0 {
+		tag := key[0]
+		key = key[1:]
+		switch tag {
+		case KEY_NULL:
+			values = append(values, nil)
+		case KEY_FALSE, KEY_TRUE:
+			values = append(values, tag == KEY_TRUE)
+		case KEY_INT64, KEY_FLOAT:
+			if len(key) < 8 {
+				return nil, fmt.Errorf("%w: number of %d bytes", ErrBadKey, len(key))
+			}
+			bits := binary.BigEndian.Uint64(key)
+			key = key[8:]
+			if tag == KEY_INT64 {
+				values = append(values, int64(bits^1<<63))
+				continue
+			}
+			if bits&(1<<63) != 0 {
+				bits &^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			values = append(values, math.Float64frombits(bits))
+		case KEY_STRING, KEY_BYTES:
+			b, n, err := decodeKeyBytes(key)
+			if err != nil {
+				return nil, err
+			}
+			key = key[n:]
+			if tag == KEY_STRING {
+				values = append(values, string(b))
+			} else {
+				values = append(values, b)
+			}
+		default:
+			return nil, fmt.Errorf("%w: tag %#x", ErrBadKey, tag)
+		}
+	}
+	return values, nil
+}
+
+// the bytes of an escaped value and its size up to the terminator included
+func decodeKeyBytes(key []byte) ([]byte, int, error) {
+	b := []byte{}
+	for i := 0; i+1 < len(key); i++ {
+		if key[i] != 0 {
+			b = append(b, key[i])
+			continue
+		}
+		switch key[i+1] {
+		case 0xff:
+			b = append(b, 0)
+			i++
+		case 1:
+			return b, i + 2, nil
+		default:
+			return nil, 0, fmt.Errorf("%w: bad escape", ErrBadKey)
+		}
+	}
+	return nil, 0, fmt.Errorf("%w: unterminated string", ErrBadKey)
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// the keys of values in order sort in that order
+func TestAppendKeyOrder(t *testing.T) {
+	ordered := [][]any{
+		{nil},
+		{false},
+		{true},
+		{int64(math.MinInt64)},
+		{int64(-1)},
+		{int64(0)},
+		{int64(1), nil},
+		{int64(1), int64(-5)},
+		{int64(1), "a"},
+		{int64(math.MaxInt64)},
+		{math.Inf(-1)},
+		{-1.5},
+		{-math.SmallestNonzeroFloat64},
+		{0.0},
+		{math.SmallestNonzeroFloat64},
+		{2.0},
+		{math.Inf(1)},
+		{[]byte{}},
+		{[]byte{0}},
+		{[]byte{0, 0}},
+		{[]byte{0, 1}},
+		{[]byte{0xff}},
+		{""},
+		{"", ""},
+		{"", "a"},
+		{"\x00"},
+		{"a"},
+		{"a", int64(0)},
+		{"a\x00"},
+		{"a\x00b"},
+		{"a\x01"},
+		{"ab"},
+		{"b"},
+	}
+	var prev []byte
+	for i, values := range ordered {
+		key, err := AppendKey(nil, values...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && bytes.Compare(prev, key) >= 0 {
+			t.Fatalf("key of %v not after that of %v", values, ordered[i-1])
+		}
+		got, err := DecodeKey(key)
+		if err != nil || fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", values) {
+			t.Fatalf("decoded %#v of %#v: %v", got, values, err)
+		}
+		// the keys starting with those values are before PrefixEnd
+		if longer, _ := AppendKey(key, "\xff\xff"); bytes.Compare(longer, PrefixEnd(key)) >= 0 {
+			t.Fatalf("key of %v and more after its PrefixEnd", values)
+		}
+		if i+1 < len(ordered) && len(ordered[i+1]) == 1 && len(values) == 1 {
+			next, _ := AppendKey(nil, ordered[i+1]...)
+			if bytes.Compare(PrefixEnd(key), next) > 0 {
+				t.Fatalf("PrefixEnd of %v after the key of %v", values, ordered[i+1])
+			}
+		}
+		prev = key
+	}
+
+	// -0 is 0, NaN decodes as NaN
+	neg, _ := AppendKey(nil, math.Copysign(0, -1))
+	zero, _ := AppendKey(nil, 0.0)
+	if !bytes.Equal(neg, zero) {
+		t.Fatal("-0 isn't 0")
+	}
+	key, _ := AppendKey(nil, math.NaN())
+	if v, err := DecodeKey(key); err != nil || !math.IsNaN(v[0].(float64)) {
+		t.Fatalf("NaN decoded %v: %v", v, err)
+	}
+	// the prefix of a key is the key of its first values
+	key, _ = AppendKey([]byte("prefix"), int64(1))
+	if first, _ := AppendKey(nil, int64(1)); !bytes.Equal(key[6:], first) || string(key[:6]) != "prefix" {
+		t.Fatalf("appended %q", key)
+	}
+}
+
+func TestDecodeKeyBad(t *testing.T) {
+	if _, err := AppendKey(nil, 1); !errors.Is(err, ErrBadKey) {
+		t.Fatalf("key of an int: %v", err)
+	}
+	for name, key := range map[string][]byte{
+		"tag":          {0x7f},
+		"int":          {KEY_INT64, 1, 2},
+		"float":        {KEY_FLOAT},
+		"unterminated": {KEY_STRING, 'a', 'b'},
+		"escape":       {KEY_BYTES, 'a', 0, 2},
+	} {
+		if v, err := DecodeKey(key); !errors.Is(err, ErrBadKey) {
+			t.Errorf("decoded a bad %s: %v %v", name, v, err)
+		}
+	}
+	if v, err := DecodeKey(nil); v != nil || err != nil {
+		t.Fatalf("empty key decoded %v: %v", v, err)
+	}
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// ExportOptions are the options of DB.Export, the zero values export all
+// the keys outside buckets.
+type ExportOptions struct {
+	Bucket [][]byte // path of the bucket exported, the names from the top, nil for the keys outside buckets
+	Prefix []byte   // only the keys with the prefix
+	Start  []byte   // the first key, nil for the first of the bucket
+	End    []byte   // the key after the last, nil for the end of the bucket
+	// Transform, if not nil, is called with each record before it's
+	// written: it can change its key, value and expiry, it's skipped if
+	// it returns false, the export stops if it returns an error.
+	Transform func(r *ExportRecord) (bool, error)
+}
+
+// ExportRecord is a key exported by DB.Export. Key and Value are only
+// valid until Transform returns.
+type ExportRecord struct {
+	Key    []byte
+	Value  []byte
+	Expiry time.Time // zero if the key doesn't expire, as in buckets
+}
+
+// Export writes the keys of a bucket in order to w from a snapshot, as
+// NDJSON: a line for each key, of the fields key, value and expires, as
+// the records of /scan of ServeHTTP, all the fields base64 if the key or
+// the value isn't UTF-8. The keys are read as they're written, so it fits
+// any number of them, and it holds the snapshot until it returns. It
+// returns the number of lines written.
+func (db *DB) Export(w io.Writer, opts ExportOptions) (n int64, err error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	defer catchTreeError(&err)
+	c, err := tx.pathCursor(opts.Bucket)
+	if err != nil {
+		return 0, err
+	}
+	// the lines before an error are written too
+	bw := bufio.NewWriter(w)
+	defer func() {
+		if ferr := bw.Flush(); err == nil {
+			err = ferr
+		}
+	}()
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	from := opts.Prefix
+	if tx.tree.compare(opts.Start, from) > 0 {
+		from = opts.Start
+	}
+	for key, value := c.Seek(from); key != nil; key, value = c.Next() {
+		if !bytes.HasPrefix(key, opts.Prefix) || opts.End != nil && tx.tree.compare(key, opts.End) >= 0 {
+			break
+		}
+		r := ExportRecord{Key: key, Value: value}
+		if opts.Bucket == nil {
+			if r.Expiry, err = tx.Expiry(key); err != nil {
+				return n, err
+			}
+		}
+		if opts.Transform != nil {
+			ok, err := opts.Transform(&r)
+			if err != nil {
+				return n, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		if err := enc.Encode(newHTTPRecord(r.Key, r.Value, r.Expiry)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, c.Err()
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < 100; i++ {
+		tx.Set([]byte(fmt.Sprintf("a%03d", i)), []byte(fmt.Sprint(i)))
+		tx.Set([]byte(fmt.Sprintf("b%03d", i)), []byte{0xff, byte(i)})
+	}
+	expires := time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC)
+	tx.SetWithExpiry([]byte("a005"), []byte("x"), expires)
+	b, _ := tx.CreateBucket([]byte("bk"))
+	b.Set([]byte("in"), []byte("<side>"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		opts ExportOptions
+		want string
+	}{
+		{ExportOptions{Prefix: []byte("a"), Start: []byte("a003"), End: []byte("a006")}, `{"key":"a003","value":"3"}
+{"key":"a004","value":"4"}
+{"key":"a005","value":"x","expires":"2100-01-02T03:04:05Z"}
+`},
+		// the start before the prefix, the end past it
+		{ExportOptions{Prefix: []byte("a09"), Start: []byte("a"), End: []byte("c")}, "a090 a091 a092 a093 a094 a095 a096 a097 a098 a099"},
+		{ExportOptions{Start: []byte("a098"), End: []byte("b001")}, `{"key":"a098","value":"98"}
+{"key":"a099","value":"99"}
+{"key":"YjAwMA==","value":"/wA=","base64":true}
+`},
+		{ExportOptions{Bucket: [][]byte{[]byte("bk")}}, `{"key":"in","value":"<side>"}
+`},
+		{ExportOptions{Prefix: []byte("z")}, ""},
+	} {
+		var buf bytes.Buffer
+		n, err := db.Export(&buf, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := buf.String()
+		if !strings.Contains(c.want, "{") && c.want != "" {
+			var keys []string
+			for _, line := range strings.Split(strings.TrimSpace(got), "\n") {
+				keys = append(keys, line[8:12])
+			}
+			got = strings.Join(keys, " ")
+		}
+		if got != c.want || n != int64(strings.Count(buf.String(), "\n")) {
+			t.Errorf("export %+v: %d lines\n%s\nwant\n%s", c.opts, n, got, c.want)
+		}
+	}
+
+	// the transform changes the records, skips them or stops
+	var buf bytes.Buffer
+	stop := errors.New("stop")
+	n, err := db.Export(&buf, ExportOptions{Prefix: []byte("a"), Transform: func(r *ExportRecord) (bool, error) {
+		switch {
+		case r.Key[3] == '9':
+			return false, nil
+		case string(r.Key) == "a005":
+			r.Expiry = time.Time{}
+		case string(r.Key) == "a030":
+			return false, stop
+		}
+		r.Key = append([]byte("k"), r.Key...)
+		r.Value = append([]byte("v="), r.Value...)
+		return true, nil
+	}})
+	if !errors.Is(err, stop) || n != 27 {
+		t.Fatalf("export stopped after %d lines: %v", n, err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if lines[5] != `{"key":"ka005","value":"v=x"}` || lines[9] != `{"key":"ka010","value":"v=10"}` {
+		t.Fatalf("transformed export\n%s", buf.String())
+	}
+
+	if _, err := db.Export(&buf, ExportOptions{Bucket: [][]byte{[]byte("missing")}}); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("export of a missing bucket: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+var expvarMu sync.Mutex // expvar.Publish panics on a name taken
+
+// PublishExpvar publishes the metrics of WriteMetrics with expvar, as a map
+// under the given name, served by expvar at /debug/vars. The Stats are only
+// read when the map is, nothing is updated meanwhile. expvar can't unpublish
+// a name: the map of a closed DB stays with its last values.
+func (db *DB) PublishExpvar(name string) error {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("expvar %q is published already", name)
+	}
+	expvar.Publish(name, expvar.Func(func() any {
+		return statsVars(db.Stats())
+	}))
+	return nil
+}
+
+// the metrics of the Stats by name, the histograms as a count, a sum and
+// quantiles in seconds
+func statsVars(s Stats) map[string]any {
+	vars := make(map[string]any, len(statsMetrics)+4*len(statsHistograms))
+	for _, m := range statsMetrics {
+		vars[m.name] = m.value(s)
+	}
+	for _, m := range statsHistograms {
+		h := m.value(s)
+		vars[m.name+"_count"] = h.Count
+		vars[m.name+"_sum"] = h.Sum.Seconds()
+		vars[m.name+"_p50"] = h.Quantile(0.5).Seconds()
+		vars[m.name+"_p99"] = h.Quantile(0.99).Seconds()
+	}
+	return vars
+}
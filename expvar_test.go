@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "a", "b")
+	if err := db.PublishExpvar("test_storage"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PublishExpvar("test_storage"); err == nil {
+		t.Fatal("published twice")
+	}
+	var vars map[string]float64
+	if err := json.Unmarshal([]byte(expvar.Get("test_storage").String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars["commits_total"] != 1 || vars["commit_duration_seconds_count"] != 1 {
+		t.Fatalf("vars %v", vars)
+	}
+	if _, ok := vars["commit_duration_seconds_p99"]; !ok || len(vars) != len(statsMetrics)+4*len(statsHistograms) {
+		t.Fatalf("%d vars %v", len(vars), vars)
+	}
+	// read when the map is
+	mustSet(t, db, "c", "d")
+	json.Unmarshal([]byte(expvar.Get("test_storage").String()), &vars)
+	if vars["commits_total"] != 2 {
+		t.Fatalf("%v commits", vars["commits_total"])
+	}
+}
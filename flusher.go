@@ -0,0 +1,70 @@
+package storage
+
+import "time"
+
+const (
+	DEFAULT_FLUSH_RATE = 4096 // pages per second
+	FLUSH_INTERVAL     = 100 * time.Millisecond
+)
+
+// The flusher writes dirty pages in place in the background, at most
+// WithFlushRate pages per second, so that the checkpoint following a large
+// transaction has few pages left to write.
+//
+// Dirty pages are never part of the checkpointed tree, writing them early
+// is safe: a crash recovers from the meta page and the WAL anyway. They're
+// clean once written, the fsync of the next checkpoint makes them durable.
+// The flusher and the checkpoint write under flusher.mu: a page freed and
+// reused meanwhile must not be overwritten with its older content.
+
+// start the flusher on the first commit, after the DB is configured
+func (db *DB) startFlusher() {
+	db.flusher.once.Do(func() {
+		rate := db.opts.flushRate
+		if rate <= 0 {
+			return
+		}
+		db.flusher.stop = make(chan struct{})
+		db.flusher.done = make(chan struct{})
+		go db.runFlusher(rate * int(FLUSH_INTERVAL) / int(time.Second))
+	})
+}
+
+func (db *DB) runFlusher(limit int) {
+	defer close(db.flusher.done)
+	ticker := time.NewTicker(FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.flusher.stop:
+			return
+		case <-ticker.C:
+			db.flushSome(max(limit, 1))
+		}
+	}
+}
+
+func (db *DB) stopFlusher() {
+	// no flusher can start anymore
+	db.flusher.once.Do(func() {})
+	if db.flusher.stop != nil {
+		close(db.flusher.stop)
+		<-db.flusher.done
+	}
+}
+
+// write at most limit dirty pages
+func (db *DB) flushSome(limit int) {
+	db.flusher.mu.Lock()
+	defer db.flusher.mu.Unlock()
+	pages := db.cache.dirtyPages(limit)
+	if err := db.pager.writePages(pages); err != nil {
+		db.log.Warn("flush of dirty pages failed", "pages", len(pages), "err", err)
+		return // the checkpoint will retry and report it
+	}
+	for ptr, page := range pages {
+		db.cache.clean(ptr, page)
+	}
+	db.stats.flushedPages.Add(uint64(len(pages)))
+	db.stats.pageWrites.Add(uint64(len(pages)))
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFlusher(t *testing.T) {
+	db := openTest(t, WithFlushRate(200), WithCheckpointSize(1<<40)) // 20 pages per interval
+	tx, _ := db.Begin(true)
+	for i := 0; i < 5000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 100))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(FLUSH_INTERVAL*3 + FLUSH_INTERVAL/2)
+	flushed := db.Stats().FlushedPages
+	if flushed == 0 || flushed > 4*20 {
+		t.Fatalf("%d pages flushed in 3 intervals at 20 pages each", flushed)
+	}
+	if dirty := len(db.cache.dirtyPages(0)); dirty == 0 {
+		t.Fatal("the flusher outran its rate")
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	db = reopenTest(t, db)
+	for i := 0; i < 5000; i += 11 {
+		wantValue(t, db, fmt.Sprintf("k%05d", i), make([]byte, 100))
+	}
+}
+
+// pages written ahead of the checkpoint by the flusher don't break the
+// recovery of the checkpointed tree
+func TestFlusherCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	ref := map[string]string{}
+	r := rand.New(rand.NewSource(9))
+	for round := 0; round < 4; round++ {
+		db, err := Open(path, WithCacheSize(32), WithFlushRate(1<<20), WithCheckpointSize(int64(r.Intn(300000))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range ref {
+			wantValue(t, db, k, []byte(v))
+		}
+		for i := 0; i < 400; i++ {
+			tx, _ := db.Begin(true)
+			for j := 0; j < 4; j++ {
+				k := fmt.Sprint("k", r.Intn(1500))
+				if r.Intn(3) == 0 {
+					tx.Del([]byte(k))
+					delete(ref, k)
+					continue
+				}
+				v := fmt.Sprint(r.Int63(), string(make([]byte, r.Intn(300))))
+				tx.Set([]byte(k), []byte(v))
+				ref[k] = v
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if i%100 == 0 {
+				time.Sleep(FLUSH_INTERVAL + FLUSH_INTERVAL/5)
+			}
+		}
+		if db.Stats().FlushedPages == 0 {
+			t.Fatal("no page flushed")
+		}
+		for k, v := range ref {
+			wantValue(t, db, k, []byte(v))
+		}
+		if round%2 == 0 {
+			crashTest(db)
+		} else if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
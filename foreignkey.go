@@ -0,0 +1,320 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Foreign keys: the columns of a foreign key of a table, the child, are
+// the primary key of a row of its parent table, or have a NULL. The parent
+// lists its children in the ReferencedBy of its schema. A row inserted or
+// updated is checked with a Get of its parent row; a row deleted deletes
+// the rows of its children referencing it if the key cascades, else it
+// fails with ErrForeignKey if there's one, found by an index, or the
+// primary key, starting with the columns of the key: CreateTable adds an
+// index of the name of the key if there's none.
+//
+// A cascade is all or nothing, it's rolled back to a savepoint if a row
+// can't be deleted. A table referenced by others can't be dropped.
+
+var ErrForeignKey = errors.New("foreign key violation")
+
+// ForeignKey is a reference of columns of a table to the primary key of a
+// table, its parent.
+type ForeignKey struct {
+	Name       string   `json:"name"` // fk_<table>_<columns> if empty
+	Columns    []string `json:"columns"`
+	Table      string   `json:"table"`
+	References []string `json:"references,omitempty"` // the primary key of Table, nil for it
+	Cascade    bool     `json:"cascade,omitempty"`    // ON DELETE CASCADE, else RESTRICT
+}
+
+// the foreign key of a Table handle
+type tableForeignKey struct {
+	ForeignKey
+	cols []int
+}
+
+// check a foreign key of the schema and add it to the table
+func (t *Table) addForeignKey(fk ForeignKey, columns map[string]int) error {
+	if len(fk.Columns) == 0 || fk.Table == "" {
+		return fmt.Errorf("%w: foreign key %q of no column or table", ErrSchema, fk.Name)
+	}
+	k := tableForeignKey{ForeignKey: fk}
+	for _, other := range t.foreignKeys {
+		if other.Name == fk.Name {
+			return fmt.Errorf("%w: two foreign keys %q in %q", ErrSchema, fk.Name, t.schema.Name)
+		}
+	}
+	for _, name := range fk.Columns {
+		i, ok := columns[name]
+		if !ok {
+			return fmt.Errorf("%w: no column %q of foreign key %q", ErrSchema, name, fk.Name)
+		}
+		for _, j := range k.cols {
+			if j == i {
+				return fmt.Errorf("%w: column %q twice in foreign key %q", ErrSchema, name, fk.Name)
+			}
+		}
+		k.cols = append(k.cols, i)
+	}
+	t.foreignKeys = append(t.foreignKeys, k)
+	return nil
+}
+
+// the default name of a foreign key
+func foreignKeyName(table string, fk ForeignKey) string {
+	return "fk_" + table + "_" + strings.Join(fk.Columns, "_")
+}
+
+// check the parents of the foreign keys of a table created, add the
+// indexes of their columns and the table to the children of the parents;
+// the schema of the table returned
+func (tx *Tx) linkParents(t *Table) (Schema, error) {
+	s := t.schema
+	added := false
+	for _, fk := range t.foreignKeys {
+		parent := t
+		if fk.Table != s.Name {
+			var err error
+			if parent, err = tx.Table(fk.Table); err != nil {
+				return Schema{}, fmt.Errorf("%w: parent of foreign key %q: %v", ErrSchema, fk.Name, err)
+			}
+		}
+		if fk.References != nil && strings.Join(fk.References, "\x00") != strings.Join(parent.schema.PrimaryKey, "\x00") {
+			return Schema{}, fmt.Errorf("%w: foreign key %q not of the primary key of %q", ErrSchema, fk.Name, fk.Table)
+		}
+		if len(fk.cols) != len(parent.key) {
+			return Schema{}, fmt.Errorf("%w: %d columns of foreign key %q for the %d of the primary key of %q", ErrSchema, len(fk.cols), fk.Name, len(parent.key), fk.Table)
+		}
+		for i, col := range fk.cols {
+			c, pc := t.schema.Columns[col], parent.schema.Columns[parent.key[i]]
+			if c.Type != pc.Type {
+				return Schema{}, fmt.Errorf("%w: column %q of foreign key %q of type %v for %v", ErrSchema, c.Name, fk.Name, c.Type, pc.Type)
+			}
+		}
+		if _, ok := t.prefixOf(fk.cols); !ok {
+			s.Indexes = append(s.Indexes[:len(s.Indexes):len(s.Indexes)], Index{Name: fk.Name, Columns: fk.Columns})
+			added = true
+		}
+		if parent == t {
+			s.ReferencedBy = addName(s.ReferencedBy, s.Name)
+		} else if err := parent.setChildren(addName(parent.schema.ReferencedBy, s.Name)); err != nil {
+			return Schema{}, err
+		}
+	}
+	if added {
+		// the handle of the indexes
+		nt, err := newTable(s)
+		if err != nil {
+			return Schema{}, err
+		}
+		*t = *nt
+	}
+	t.schema = s
+	return s, nil
+}
+
+// drop the table from the children of its parents, ErrForeignKey if it
+// has children itself
+func (tx *Tx) unlinkParents(t *Table) error {
+	for _, child := range t.schema.ReferencedBy {
+		if child != t.schema.Name {
+			return fmt.Errorf("%w: table %q referenced by %q", ErrForeignKey, t.schema.Name, child)
+		}
+	}
+	for _, fk := range t.foreignKeys {
+		if fk.Table == t.schema.Name {
+			continue
+		}
+		parent, err := tx.Table(fk.Table)
+		if err != nil {
+			return err
+		}
+		var children []string
+		for _, name := range parent.schema.ReferencedBy {
+			if name != t.schema.Name {
+				children = append(children, name)
+			}
+		}
+		if err := parent.setChildren(children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Table) setChildren(children []string) error {
+	s := t.schema
+	s.ReferencedBy = children
+	s.Version++
+	return t.saveSchema(s)
+}
+
+func addName(names []string, name string) []string {
+	for _, n := range names {
+		if n == name {
+			return names
+		}
+	}
+	return append(names[:len(names):len(names)], name)
+}
+
+// the index, nil for the primary key, starting with the columns, false if
+// none
+func (t *Table) prefixOf(cols []int) (*tableIndex, bool) {
+	if startsWith(t.key, cols) {
+		return nil, true
+	}
+	for i := range t.indexes {
+		if startsWith(t.indexes[i].cols, cols) {
+			return &t.indexes[i], true
+		}
+	}
+	return nil, false
+}
+
+func startsWith(cols, prefix []int) bool {
+	if len(cols) < len(prefix) {
+		return false
+	}
+	for i, col := range prefix {
+		if cols[i] != col {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrForeignKey if a foreign key of a row inserted, or updated from old,
+// has no parent row
+func (t *Table) checkParents(old, row Row) error {
+	for _, fk := range t.foreignKeys {
+		values := columnsOf(fk.cols, row)
+		null := false
+		for _, v := range values {
+			null = null || v == nil
+		}
+		if null {
+			continue
+		}
+		key, err := AppendKey(nil, values...)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			if before, err := AppendKey(nil, columnsOf(fk.cols, old)...); err == nil && bytes.Equal(before, key) {
+				continue
+			}
+		}
+		parent := t
+		if fk.Table != t.schema.Name {
+			if parent, err = t.rows.tx.Table(fk.Table); err != nil {
+				return err
+			}
+		} else if own, err := AppendKey(nil, t.keyOf(row)...); err == nil && bytes.Equal(own, key) {
+			continue // the row itself
+		}
+		k, err := parent.encodeKey(values, false)
+		if err != nil {
+			return err
+		}
+		if _, ok, err := parent.rows.Get(k); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("%w: no row %v in %q for foreign key %q of %q", ErrForeignKey, values, fk.Table, fk.Name, t.schema.Name)
+		}
+	}
+	return nil
+}
+
+// apply the foreign keys of the children to the rows referencing a row
+// deleted: delete them if they cascade and cascade, else ErrForeignKey
+func (t *Table) deleteChildren(row Row, cascade bool) error {
+	values := t.keyOf(row)
+	children, err := t.children()
+	if err != nil {
+		return err
+	}
+	for _, name := range children {
+		child := t
+		if name != t.schema.Name {
+			var err error
+			if child, err = t.rows.tx.Table(name); err != nil {
+				return err
+			}
+		}
+		for _, fk := range child.foreignKeys {
+			if fk.Table != t.schema.Name {
+				continue
+			}
+			var keys [][]any
+			err := child.rowsWith(fk.cols, values, func(row Row) error {
+				keys = append(keys, child.keyOf(row))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				continue
+			}
+			if !fk.Cascade || !cascade {
+				return fmt.Errorf("%w: row %v of %q referenced by foreign key %q of %q", ErrForeignKey, values, t.schema.Name, fk.Name, name)
+			}
+			for _, key := range keys {
+				if _, err := child.delete(key, true); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// the tables referencing this one, of the schema written last: the
+// handle may be of before a child was created
+func (t *Table) children() ([]string, error) {
+	if t.gen == t.rows.tx.schemaGen {
+		return t.schema.ReferencedBy, nil
+	}
+	current, err := t.rows.tx.Table(t.schema.Name)
+	if err != nil {
+		return nil, err
+	}
+	t.schema.ReferencedBy = current.schema.ReferencedBy
+	t.gen = current.gen
+	return t.schema.ReferencedBy, nil
+}
+
+// call fn with the rows whose columns are the values
+func (t *Table) rowsWith(cols []int, values []any, fn func(row Row) error) error {
+	ix, ok := t.prefixOf(cols)
+	switch {
+	case ok && ix != nil:
+		prefix, err := t.encodeColumns(nil, ix.cols, values)
+		if err != nil {
+			return err
+		}
+		return t.scanIndex(ix, prefix, PrefixEnd(prefix), false, func(pk []byte, row Row) error { return fn(row) })
+	case ok:
+		prefix, err := t.encodeKey(values, true)
+		if err != nil {
+			return err
+		}
+		return t.scanRows(prefix, PrefixEnd(prefix), false, func(key []byte, row Row) error { return fn(row) })
+	}
+	// the index was dropped
+	want, err := AppendKey(nil, values...)
+	if err != nil {
+		return err
+	}
+	return t.scanRows(nil, nil, false, func(key []byte, row Row) error {
+		if got, err := AppendKey(nil, columnsOf(cols, row)...); err != nil || !bytes.Equal(got, want) {
+			return err
+		}
+		return fn(row)
+	})
+}
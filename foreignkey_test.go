@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// customers, their orders deleted with them, and the lines of the orders
+// keeping them
+func ordersTest(t *testing.T) *DB {
+	t.Helper()
+	db := openTest(t)
+	execTest(t, db, "CREATE TABLE customers (id INT PRIMARY KEY, name TEXT)")
+	execTest(t, db, "CREATE TABLE orders (id INT PRIMARY KEY, customer INT REFERENCES customers ON DELETE CASCADE, total REAL)")
+	execTest(t, db, "CREATE TABLE lines (order_id INT, n INT, item TEXT, PRIMARY KEY (order_id, n), CONSTRAINT of_order FOREIGN KEY (order_id) REFERENCES orders (id))")
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	for i := 0; i < 10; i++ {
+		execTestTx(t, tx, "INSERT INTO customers VALUES (?, ?)", i, fmt.Sprint("c", i))
+		for j := 0; j < 3; j++ {
+			execTestTx(t, tx, "INSERT INTO orders VALUES (?, ?, ?)", i*10+j, i, float64(j))
+		}
+	}
+	execTestTx(t, tx, "INSERT INTO lines VALUES (10, 1, 'a'), (10, 2, 'b'), (21, 1, 'c')")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestForeignKey(t *testing.T) {
+	db := ordersTest(t)
+	schemas, _ := db.Schemas()
+	if got := fmt.Sprint(schemas[0].ReferencedBy, schemas[2].ReferencedBy, schemas[1].ReferencedBy); got != "[orders] [lines] []" {
+		t.Fatalf("children %s", got)
+	}
+	// an index for the key of the orders, the lines have their primary key
+	if ix := schemas[2].Indexes; len(ix) != 1 || ix[0].Name != "fk_orders_customer" || len(schemas[1].Indexes) != 0 {
+		t.Fatalf("indexes %+v %+v", ix, schemas[1].Indexes)
+	}
+	if fk := schemas[1].ForeignKeys; len(fk) != 1 || fk[0].Name != "of_order" || fk[0].Cascade || fmt.Sprint(fk[0].References) != "[id]" {
+		t.Fatalf("foreign keys %+v", fk)
+	}
+
+	for _, sql := range []string{
+		"INSERT INTO orders VALUES (100, 42, 0)",
+		"INSERT INTO lines VALUES (99, 1, 'x')",
+		"UPDATE orders SET customer = 42 WHERE id = 1",
+		"UPDATE customers SET id = 142 WHERE id = 1",
+		"DELETE FROM orders WHERE id = 10",
+	} {
+		if _, err := db.Exec(sql); !errors.Is(err, ErrForeignKey) {
+			t.Errorf("%s: %v", sql, err)
+		}
+	}
+	execTest(t, db, "INSERT INTO orders VALUES (100, NULL, 0)")
+	execTest(t, db, "UPDATE orders SET total = 5 WHERE customer = 1")
+	execTest(t, db, "UPDATE orders SET customer = 2 WHERE id = 100")
+
+	// the orders of the customer are deleted, all or nothing
+	if _, err := db.Exec("DELETE FROM customers WHERE id = 1"); !errors.Is(err, ErrForeignKey) {
+		t.Fatalf("delete of a customer of an order with lines: %v", err)
+	}
+	if got := selectTest(t, db, "SELECT COUNT(*) FROM orders WHERE customer = 1"); got != "[[3]]" {
+		t.Fatalf("%s orders left by a failed delete", got)
+	}
+	execTest(t, db, "DELETE FROM lines WHERE order_id = 10")
+	if res := execTest(t, db, "DELETE FROM customers WHERE id = 1 OR id = 3"); res.RowsAffected != 2 {
+		t.Fatalf("%d customers deleted", res.RowsAffected)
+	}
+	if got := selectTest(t, db, "SELECT COUNT(*) FROM orders"); got != "[[25]]" {
+		t.Fatalf("%s orders left", got)
+	}
+	tx, _ := db.Begin(true)
+	customers, _ := tx.Table("customers")
+	if _, err := customers.Delete(int64(2)); !errors.Is(err, ErrForeignKey) {
+		tx.Rollback()
+		t.Fatalf("delete of the customer of order 21: %v", err)
+	}
+	// the Tx goes on
+	if ok, err := customers.Delete(int64(4)); !ok || err != nil {
+		tx.Rollback()
+		t.Fatalf("delete of a customer: %v %v", ok, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a table referenced can't be dropped
+	for _, table := range []string{"customers", "orders"} {
+		if _, err := db.Exec("DROP TABLE " + table); !errors.Is(err, ErrForeignKey) {
+			t.Errorf("drop of %s: %v", table, err)
+		}
+	}
+	execTest(t, db, "DROP TABLE lines")
+	execTest(t, db, "DROP TABLE orders")
+	schemas, _ = db.Schemas()
+	if len(schemas) != 1 || len(schemas[0].ReferencedBy) != 0 {
+		t.Fatalf("schemas %+v", schemas)
+	}
+	execTest(t, db, "DROP TABLE customers")
+}
+
+func TestForeignKeySelf(t *testing.T) {
+	db := openTest(t)
+	execTest(t, db, "CREATE TABLE notes (id INT PRIMARY KEY, parent INT REFERENCES notes ON DELETE CASCADE)")
+	execTest(t, db, "INSERT INTO notes VALUES (1, 1), (2, 1), (3, 2), (4, NULL)")
+	if _, err := db.Exec("INSERT INTO notes VALUES (5, 6)"); !errors.Is(err, ErrForeignKey) {
+		t.Fatalf("insert of a missing parent: %v", err)
+	}
+	// the children of the children
+	if res := execTest(t, db, "DELETE FROM notes WHERE id = 1"); res.RowsAffected != 1 {
+		t.Fatalf("%d rows deleted", res.RowsAffected)
+	}
+	if got := selectTest(t, db, "SELECT id FROM notes"); got != "[[4]]" {
+		t.Fatalf("rows %s", got)
+	}
+	// referenced by itself only
+	execTest(t, db, "DROP TABLE notes")
+}
+
+func TestForeignKeySchema(t *testing.T) {
+	db := openTest(t)
+	execTest(t, db, "CREATE TABLE p (a INT, b TEXT, PRIMARY KEY (a, b))")
+	for _, sql := range []string{
+		"CREATE TABLE c (id INT PRIMARY KEY, x INT REFERENCES missing)",
+		"CREATE TABLE c (id INT PRIMARY KEY, x INT REFERENCES p)",
+		"CREATE TABLE c (id INT PRIMARY KEY, x INT, y INT, FOREIGN KEY (x, y) REFERENCES p)",
+		"CREATE TABLE c (id INT PRIMARY KEY, x INT, y TEXT, FOREIGN KEY (x, y) REFERENCES p (b, a))",
+		"CREATE TABLE c (id INT PRIMARY KEY, x INT, y TEXT, FOREIGN KEY (x, x) REFERENCES p)",
+		"CREATE TABLE c (id INT PRIMARY KEY, x INT, y TEXT, FOREIGN KEY (x, z) REFERENCES p)",
+		"CREATE TABLE c (id INT PRIMARY KEY, x INT, y TEXT, CONSTRAINT f FOREIGN KEY (x, y) REFERENCES p, CONSTRAINT f FOREIGN KEY (x, y) REFERENCES p)",
+	} {
+		if _, err := db.Exec(sql); !errors.Is(err, ErrSchema) {
+			t.Errorf("%s: %v", sql, err)
+		}
+	}
+	if _, err := db.Exec("CREATE TABLE c (id INT PRIMARY KEY, x INT REFERENCES p ON DELETE NOTHING)"); !errors.Is(err, ErrSQLSyntax) {
+		t.Fatalf("ON DELETE NOTHING: %v", err)
+	}
+	if schemas, _ := db.Schemas(); len(schemas) != 1 || len(schemas[0].ReferencedBy) != 0 {
+		t.Fatalf("schemas %+v after the failed creates", schemas)
+	}
+	// of an index of the columns of the key
+	execTest(t, db, "CREATE TABLE c (id INT PRIMARY KEY, x INT, y TEXT, FOREIGN KEY (x, y) REFERENCES p ON DELETE RESTRICT)")
+	execTest(t, db, "INSERT INTO p VALUES (1, 'a')")
+	execTest(t, db, "INSERT INTO c VALUES (1, 1, 'a'), (2, 1, NULL), (3, NULL, 'zz')")
+	if _, err := db.Exec("INSERT INTO c VALUES (4, 1, 'b')"); !errors.Is(err, ErrForeignKey) {
+		t.Fatalf("insert of a missing parent: %v", err)
+	}
+	execTest(t, db, "DROP INDEX fk_c_x_y ON c")
+	if _, err := db.Exec("DELETE FROM p"); !errors.Is(err, ErrForeignKey) {
+		t.Fatalf("delete of a parent without the index: %v", err)
+	}
+	execTest(t, db, "DELETE FROM c WHERE id = 1")
+	if res := execTest(t, db, "DELETE FROM p"); res.RowsAffected != 1 {
+		t.Fatalf("%d rows deleted", res.RowsAffected)
+	}
+}
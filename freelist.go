@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	BNODE_FREE = 3
+
+	// free list page layout, the pages form a linked list
+	// | type | count | next | pointers |
+	// | 2B   | 2B    | 8B   | count*8B |
+	FREE_LIST_HEADER = 4 + 8
+	// the free list head of the meta page when the list isn't written
+	FREE_LIST_NONE = math.MaxUint64
+)
+
+// pointers per free list page
+func freeListCap(pageSize int) int {
+	return (pageSize - FREE_LIST_HEADER) / 8
+}
+
+// pages freed by a commit, still reachable from older snapshots
+type pendingFree struct {
+	version uint64   // the version created by the commit
+	pages   []uint64 // pages of the checkpointed tree
+	young   []uint64 // pages created after the last checkpoint
+}
+
+// freeList tracks the unused pages of the file.
+// A page freed by the commit creating version v can be reached by readers
+// of any version before v, so it's only reused once no such reader is open.
+// Pages of the checkpointed tree are needed to recover from the WAL until
+// the next checkpoint, young pages are not written in place before that.
+type freeList struct {
+	free    []uint64      // pages that can be reused right away
+	pending []pendingFree // ordered by version
+	pages   []uint64      // pages storing the free list on disk
+}
+
+// move pending pages to the free pages once no reader before the given
+// version is open, the young pages released are returned and so are the
+// others if all is set
+func (fl *freeList) release(oldest uint64, checkpointed uint64, all bool) []uint64 {
+	var young, old []uint64
+	n := 0
+	for i := range fl.pending {
+		p := &fl.pending[i]
+		if p.version <= oldest {
+			young = append(young, p.young...)
+			p.young = nil
+			if p.version <= checkpointed {
+				old = append(old, p.pages...)
+				p.pages = nil
+			}
+		}
+		if len(p.pages)+len(p.young) > 0 {
+			fl.pending[n] = *p
+			n++
+		}
+	}
+	fl.pending = fl.pending[:n]
+	fl.free = append(append(fl.free, old...), young...)
+	if all {
+		return append(young, old...)
+	}
+	return young
+}
+
+// number of pages tracked, free or pending
+func (fl *freeList) total() int {
+	n := len(fl.free)
+	for _, p := range fl.pending {
+		n += len(p.pages) + len(p.young)
+	}
+	return n
+}
+
+func freeListPages(count int, pageSize int) int {
+	return (count + freeListCap(pageSize) - 1) / freeListCap(pageSize)
+}
+
+// serialize the pointers into the given pages
+func encodeFreeList(pointers []uint64, pages []uint64, pageSize int) [][]byte {
+	out := make([][]byte, len(pages))
+	for i := range pages {
+		data := make([]byte, pageSize)
+		n := min(len(pointers), freeListCap(pageSize))
+		binary.LittleEndian.PutUint16(data[0:2], BNODE_FREE)
+		binary.LittleEndian.PutUint16(data[2:4], uint16(n))
+		if i+1 < len(pages) {
+			binary.LittleEndian.PutUint64(data[4:12], pages[i+1])
+		}
+		for j, ptr := range pointers[:n] {
+			binary.LittleEndian.PutUint64(data[FREE_LIST_HEADER+8*j:], ptr)
+		}
+		pointers = pointers[n:]
+		out[i] = data
+	}
+	return out
+}
+
+// read the free list starting at the given page,
+// every free page is reusable since no reader survives a restart
+func (db *DB) loadFreeList(head uint64) error {
+	fl := &db.free
+	for ptr := head; ptr != 0; {
+		if ptr >= db.page.flushed || len(fl.pages) > int(db.page.flushed) {
+			return fmt.Errorf("%w: bad free list page %d", ErrBadMeta, ptr)
+		}
+		node, err := db.readPage(ptr)
+		if err != nil {
+			return fmt.Errorf("read free list page %d: %w", ptr, err)
+		}
+		data := node.data
+		count := binary.LittleEndian.Uint16(data[2:4])
+		if binary.LittleEndian.Uint16(data[0:2]) != BNODE_FREE || int(count) > freeListCap(db.nodeSize()) {
+			return fmt.Errorf("%w: bad free list page %d", ErrBadMeta, ptr)
+		}
+		for j := uint16(0); j < count; j++ {
+			fl.free = append(fl.free, binary.LittleEndian.Uint64(data[FREE_LIST_HEADER+8*j:]))
+		}
+		fl.pages = append(fl.pages, ptr)
+		ptr = binary.LittleEndian.Uint64(data[4:12])
+	}
+	return nil
+}
+
+// find the free pages when the free list isn't written, those that the trees
+// don't reach: the keys, the catalog and the trees of the buckets
+func (db *DB) rebuildFreeList() error {
+	used := make([]bool, db.page.flushed)
+	used[0] = true // the meta page
+	var err error
+	var walk func(ptr uint64, catalog bool) error
+	walk = func(ptr uint64, catalog bool) error {
+		if ptr == 0 || ptr >= db.page.flushed || used[ptr] {
+			return fmt.Errorf("%w: bad pointer to page %d", ErrCorrupt, ptr)
+		}
+		used[ptr] = true
+		node, err := db.readPage(ptr)
+		if err == nil {
+			err = checkNode(node)
+		}
+		if err != nil {
+			return fmt.Errorf("read page %d: %w", ptr, err)
+		}
+		for i := uint16(0); i < node.getNumberOfKeys(); i++ {
+			switch {
+			case node.getNodeType() == BNODE_NODE:
+				err = walk(node.getPointer(i), catalog)
+			case catalog && len(node.getKey(i)) > 0:
+				// the root of a bucket, 0 while it's empty
+				value := node.getValue(i)
+				if len(value) != 8 {
+					return fmt.Errorf("%w: bad catalog entry in page %d", ErrCorrupt, ptr)
+				}
+				if root := binary.LittleEndian.Uint64(value); root != 0 {
+					err = walk(root, false)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if db.root != 0 {
+		err = walk(db.root, false)
+	}
+	if err == nil && db.catalog != 0 {
+		err = walk(db.catalog, true)
+	}
+	if err != nil {
+		return fmt.Errorf("rebuild free list: %w", err)
+	}
+	for ptr, ok := range used {
+		if !ok {
+			db.free.free = append(db.free.free, uint64(ptr))
+		}
+	}
+	return nil
+}
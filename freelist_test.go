@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestFreeListRelease(t *testing.T) {
+	fl := freeList{pending: []pendingFree{
+		{version: 2, pages: []uint64{10}, young: []uint64{11}},
+		{version: 3, pages: []uint64{12}, young: []uint64{13}},
+		{version: 5, young: []uint64{14}},
+	}}
+	// a reader of version 2 may still reach the pages freed by 3 and 5
+	if young := fl.release(2, 1, false); !slices.Equal(young, []uint64{11}) {
+		t.Fatalf("young %v", young)
+	}
+	if !slices.Equal(fl.free, []uint64{11}) || fl.total() != 5 {
+		t.Fatalf("free %v, %d tracked", fl.free, fl.total())
+	}
+	// the old pages wait for the checkpoint
+	fl.release(5, 2, false)
+	if slices.Sort(fl.free); !slices.Equal(fl.free, []uint64{10, 11, 13, 14}) {
+		t.Fatalf("free %v", fl.free)
+	}
+	if all := fl.release(5, 5, true); !slices.Equal(all, []uint64{12}) {
+		t.Fatalf("released %v", all)
+	}
+	if len(fl.pending) != 0 || fl.total() != 5 {
+		t.Fatalf("pending %v", fl.pending)
+	}
+}
+
+// the pages a reader can reach aren't reused, and are once it's over
+func TestFreeListReaders(t *testing.T) {
+	db := openTest(t)
+	ref := map[string]string{}
+	r := rand.New(rand.NewSource(2))
+	var reader *Tx
+	var snap map[string]string
+	var size int64
+	for i := 0; i < 3000; i++ {
+		switch i {
+		case 1000:
+			reader, _ = db.Begin(false)
+			snap = map[string]string{}
+			for k, v := range ref {
+				snap[k] = v
+			}
+		case 2000:
+			for k, v := range snap {
+				if got, ok, _ := reader.Get([]byte(k)); !ok || string(got) != v {
+					t.Fatalf("snapshot %q: %q %v", k, got, ok)
+				}
+			}
+			reader.Rollback()
+			db.Checkpoint()
+			size = testFileSize(t, db.Path)
+		}
+		tx, _ := db.Begin(true)
+		for j := 0; j < 5; j++ {
+			k := fmt.Sprint("k", r.Intn(2000))
+			if r.Intn(4) == 0 {
+				tx.Del([]byte(k))
+				delete(ref, k)
+				continue
+			}
+			v := fmt.Sprint(r.Int63(), string(make([]byte, r.Intn(200))))
+			tx.Set([]byte(k), []byte(v))
+			ref[k] = v
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Checkpoint()
+	if grown := testFileSize(t, db.Path) - size; grown > size/4 {
+		t.Errorf("the file grew by %d bytes to %d with no reader open", grown, size+grown)
+	}
+
+	db = reopenTest(t, db)
+	for k, v := range ref {
+		wantValue(t, db, k, []byte(v))
+	}
+	report, err := db.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := report.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testFileSize(t testing.TB, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// the values deleted or overwritten are zeroed in the file and the WAL with
+// WithSecureDelete, kept in the free pages without
+func TestSecureDelete(t *testing.T) {
+	fill := func(opts ...Option) *DB {
+		db := openTest(t, opts...)
+		for i := 0; i < 2000; i++ {
+			mustSet(t, db, fmt.Sprintf("k%04d", i), fmt.Sprintf("secret value %04d", i))
+		}
+		db.Checkpoint()
+		tx, _ := db.Begin(true)
+		for i := 0; i < 2000; i++ {
+			if i%2 == 0 {
+				tx.Del([]byte(fmt.Sprintf("k%04d", i)))
+			} else {
+				tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("overwritten"))
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		// the pages freed are released by the writes after the checkpoint
+		for i := 0; i < 3; i++ {
+			db.Checkpoint()
+			mustSet(t, db, "x", fmt.Sprint(i))
+		}
+		db.Checkpoint()
+		return db
+	}
+	plain := fill()
+	plain.Close()
+	if !bytes.Contains(readFileTest(t, plain.Path), []byte("secret value")) {
+		t.Fatal("no value left in the free pages without secure delete")
+	}
+
+	for _, opts := range [][]Option{{WithSecureDelete()}, {WithSecureDelete(), WithCacheSize(16)}, {WithSecureDelete(), WithEncryptionKey(keyTest(1))}} {
+		db := fill(opts...)
+		if r, err := db.Check(context.Background()); err != nil || !r.OK() {
+			t.Fatalf("check: %v %v", r.Problems, err)
+		}
+		db.Close()
+		for _, name := range []string{db.Path, walPath(db.Path)} {
+			if bytes.Contains(readFileTest(t, name), []byte("secret value")) {
+				t.Fatalf("%s holds a value deleted", name)
+			}
+		}
+		db = openTestPath(t, db.Path, opts...)
+		wantValue(t, db, "k0001", []byte("overwritten"))
+		wantValue(t, db, "k0000", nil)
+		wantValue(t, db, "x", []byte("2"))
+	}
+}
@@ -0,0 +1,313 @@
+//go:build grpc
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/kevinjad/storage-engine/kvpb"
+)
+
+const (
+	GRPC_SCAN_KEYS  = 256      // keys of a ScanResponse at most
+	GRPC_SCAN_BYTES = 64 << 10 // bytes of a ScanResponse, a larger key is sent alone
+)
+
+// the header of a Scan with the version of its snapshot
+const GRPC_VERSION_HEADER = "storage-version"
+
+// KVServer serves the KV service of kvpb/kv.proto on a DB, to embed in a
+// gRPC server with RegisterKV. It's built with the grpc tag, after go get
+// of grpc-go. The server is over TLS with the credentials.NewTLS of
+// TLSCertificate.ServerConfig.
+//
+// Each call is a Tx begun with the context of the call: its deadline bounds
+// the wait for the writer lock and the commit, and the spans of the Tx are
+// children of the span the interceptors put in it. Only the keys outside
+// buckets are served.
+type KVServer struct {
+	kvpb.UnimplementedKVServer
+	db *DB
+}
+
+func NewKVServer(db *DB) *KVServer {
+	return &KVServer{db: db}
+}
+
+// RegisterKV registers the KV service of the DB with s.
+func (db *DB) RegisterKV(s grpc.ServiceRegistrar) {
+	kvpb.RegisterKVServer(s, NewKVServer(db))
+}
+
+func (s *KVServer) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	tx, err := s.db.BeginContext(ctx, false)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer tx.Rollback()
+	resp, err := grpcGet(tx, req)
+	return resp, grpcError(err)
+}
+
+func (s *KVServer) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	tx, err := s.db.BeginContext(ctx, true)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer tx.Rollback()
+	resp, err := grpcPut(tx, req)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return resp, nil
+}
+
+func (s *KVServer) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	tx, err := s.db.BeginContext(ctx, true)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer tx.Rollback()
+	resp, err := grpcDelete(tx, req)
+	if err == nil && resp.Deleted {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return resp, nil
+}
+
+// Txn is a single write Tx: the ops see the updates of those before them.
+func (s *KVServer) Txn(ctx context.Context, req *kvpb.TxnRequest) (*kvpb.TxnResponse, error) {
+	tx, err := s.db.BeginContext(ctx, true)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer tx.Rollback()
+	resp, err := grpcTxn(tx, req)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return resp, nil
+}
+
+func grpcTxn(tx *Tx, req *kvpb.TxnRequest) (*kvpb.TxnResponse, error) {
+	resp := &kvpb.TxnResponse{Succeeded: true, Version: tx.Version()}
+	for _, cmp := range req.Compare {
+		ok, err := grpcCompare(tx, cmp)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			resp.Succeeded = false
+			break
+		}
+	}
+	ops := req.Success
+	if !resp.Succeeded {
+		ops = req.Failure
+	}
+	written := false
+	for _, op := range ops {
+		var r kvpb.OpResponse
+		switch op := op.Op.(type) {
+		case *kvpb.Op_Get:
+			get, err := grpcGet(tx, op.Get)
+			if err != nil {
+				return nil, err
+			}
+			r.Response = &kvpb.OpResponse_Get{Get: get}
+		case *kvpb.Op_Put:
+			put, err := grpcPut(tx, op.Put)
+			if err != nil {
+				return nil, err
+			}
+			written = true
+			r.Response = &kvpb.OpResponse_Put{Put: put}
+		case *kvpb.Op_Delete:
+			del, err := grpcDelete(tx, op.Delete)
+			if err != nil {
+				return nil, err
+			}
+			written = written || del.Deleted
+			r.Response = &kvpb.OpResponse_Delete{Delete: del}
+		default:
+			return nil, status.Error(codes.InvalidArgument, "empty op")
+		}
+		resp.Responses = append(resp.Responses, &r)
+	}
+	if written {
+		resp.Version = tx.Version() + 1
+	}
+	return resp, nil
+}
+
+func grpcCompare(tx *Tx, cmp *kvpb.Compare) (bool, error) {
+	value, found, err := tx.Get(cmp.Key)
+	if err != nil {
+		return false, err
+	}
+	switch cmp.Result {
+	case kvpb.Compare_EQUAL:
+		return found && bytes.Equal(value, cmp.Value), nil
+	case kvpb.Compare_NOT_EQUAL:
+		return !found || !bytes.Equal(value, cmp.Value), nil
+	case kvpb.Compare_EXISTS:
+		return found, nil
+	case kvpb.Compare_NOT_EXISTS:
+		return !found, nil
+	}
+	return false, status.Errorf(codes.InvalidArgument, "unknown compare result %d", cmp.Result)
+}
+
+func grpcGet(tx *Tx, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	resp := &kvpb.GetResponse{Version: tx.Version()}
+	value, found, err := tx.GetCopy(req.Key)
+	if err != nil || !found {
+		return resp, err
+	}
+	kv, err := grpcKeyValue(tx, req.Key, value)
+	if err != nil {
+		return nil, err
+	}
+	resp.Found, resp.Kv = true, kv
+	return resp, nil
+}
+
+func grpcPut(tx *Tx, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	var err error
+	if req.Expires != nil {
+		err = tx.SetWithExpiry(req.Key, req.Value, req.Expires.AsTime())
+	} else {
+		err = tx.Set(req.Key, req.Value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &kvpb.PutResponse{Version: tx.Version() + 1}, nil
+}
+
+func grpcDelete(tx *Tx, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	deleted, err := tx.Del(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	resp := &kvpb.DeleteResponse{Deleted: deleted, Version: tx.Version()}
+	if deleted {
+		resp.Version++
+	}
+	return resp, nil
+}
+
+// a key with its expiry
+func grpcKeyValue(tx *Tx, key, value []byte) (*kvpb.KeyValue, error) {
+	kv := &kvpb.KeyValue{Key: bytes.Clone(key), Value: value}
+	at, err := tx.Expiry(key)
+	if err != nil {
+		return nil, err
+	}
+	if !at.IsZero() {
+		kv.Expires = timestamppb.New(at)
+	}
+	return kv, nil
+}
+
+// Scan streams the range from one read Tx, kept until the last key is
+// sent: a slow client holds its snapshot, and so the pages it needs. The
+// prefix is of the bytes of the keys, whatever the comparator.
+func (s *KVServer) Scan(req *kvpb.ScanRequest, stream kvpb.KV_ScanServer) error {
+	ctx := stream.Context()
+	tx, err := s.db.BeginContext(ctx, false)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer tx.Rollback()
+	header := metadata.Pairs(GRPC_VERSION_HEADER, strconv.FormatUint(tx.Version(), 10))
+	if err := stream.SendHeader(header); err != nil {
+		return err
+	}
+	start := req.Start
+	if len(req.Prefix) > 0 && tx.tree.compare(req.Prefix, start) > 0 {
+		start = req.Prefix
+	}
+	cur := tx.Cursor()
+	key, value := cur.Seek(start)
+	var resp kvpb.ScanResponse
+	size, sent := 0, uint64(0)
+	for ; key != nil; key, value = cur.Next() {
+		if len(req.Prefix) > 0 && !bytes.HasPrefix(key, req.Prefix) ||
+			len(req.End) > 0 && tx.tree.compare(key, req.End) >= 0 ||
+			req.Limit > 0 && sent == req.Limit {
+			break
+		}
+		kv := &kvpb.KeyValue{Key: bytes.Clone(key)}
+		if !req.KeysOnly {
+			if kv, err = grpcKeyValue(tx, key, bytes.Clone(value)); err != nil {
+				return grpcError(err)
+			}
+		}
+		resp.Kvs = append(resp.Kvs, kv)
+		size += len(kv.Key) + len(kv.Value)
+		sent++
+		if len(resp.Kvs) == GRPC_SCAN_KEYS || size >= GRPC_SCAN_BYTES {
+			if err := stream.Send(&resp); err != nil {
+				return err
+			}
+			resp.Kvs, size = nil, 0
+		}
+		if err := ctx.Err(); err != nil {
+			return grpcError(err)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return grpcError(err)
+	}
+	if len(resp.Kvs) > 0 {
+		return stream.Send(&resp)
+	}
+	return nil
+}
+
+// the status of an error of the engine
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Internal
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, ErrEmptyKey), errors.Is(err, ErrKeyTooLarge), errors.Is(err, ErrValueTooLarge):
+		code = codes.InvalidArgument
+	case errors.Is(err, ErrReadOnly):
+		code = codes.FailedPrecondition
+	case errors.Is(err, ErrConflict):
+		code = codes.Aborted
+	case errors.Is(err, ErrDBClosed):
+		code = codes.Unavailable
+	case errors.Is(err, ErrCorrupt):
+		code = codes.DataLoss
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,233 @@
+//go:build grpc
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/kevinjad/storage-engine/kvpb"
+)
+
+// a client of the KV service of the DB, over a pipe
+func grpcTest(t *testing.T, db *DB) kvpb.KVClient {
+	t.Helper()
+	l := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	db.RegisterKV(s)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return kvpb.NewKVClient(conn)
+}
+
+func wantCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("error %v, want %v", err, code)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	db := openTest(t)
+	c := grpcTest(t, db)
+	ctx := context.Background()
+	put, err := c.Put(ctx, &kvpb.PutRequest{Key: []byte("a"), Value: []byte("1")})
+	if err != nil || put.Version != db.version {
+		t.Fatalf("put %v: %v", put, err)
+	}
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	c.Put(ctx, &kvpb.PutRequest{Key: []byte("b"), Value: []byte("2"), Expires: timestamppb.New(expires)})
+	get, err := c.Get(ctx, &kvpb.GetRequest{Key: []byte("b")})
+	if err != nil || !get.Found || string(get.Kv.Value) != "2" || !get.Kv.Expires.AsTime().Equal(expires) ||
+		get.Version != db.version {
+		t.Fatalf("get %v: %v", get, err)
+	}
+	if get, _ := c.Get(ctx, &kvpb.GetRequest{Key: []byte("zz")}); get.Found || get.Kv != nil {
+		t.Fatalf("get of a missing key %v", get)
+	}
+	del, err := c.Delete(ctx, &kvpb.DeleteRequest{Key: []byte("a")})
+	if err != nil || !del.Deleted || del.Version != db.version {
+		t.Fatalf("delete %v: %v", del, err)
+	}
+	if del, _ := c.Delete(ctx, &kvpb.DeleteRequest{Key: []byte("a")}); del.Deleted || del.Version != db.version {
+		t.Fatalf("delete of a missing key %v", del)
+	}
+
+	_, err = c.Put(ctx, &kvpb.PutRequest{Key: nil, Value: []byte("x")})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = c.Put(ctx, &kvpb.PutRequest{Key: []byte("k"), Value: make([]byte, 1<<16)})
+	wantCode(t, err, codes.InvalidArgument)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = c.Get(canceled, &kvpb.GetRequest{Key: []byte("b")})
+	wantCode(t, err, codes.Canceled)
+	db.Close()
+	_, err = c.Get(ctx, &kvpb.GetRequest{Key: []byte("b")})
+	wantCode(t, err, codes.Unavailable)
+}
+
+func TestGRPCTxn(t *testing.T) {
+	db := openTest(t)
+	c := grpcTest(t, db)
+	ctx := context.Background()
+	mustSet(t, db, "a", "1")
+	put := func(k, v string) *kvpb.Op {
+		return &kvpb.Op{Op: &kvpb.Op_Put{Put: &kvpb.PutRequest{Key: []byte(k), Value: []byte(v)}}}
+	}
+	get := &kvpb.Op{Op: &kvpb.Op_Get{Get: &kvpb.GetRequest{Key: []byte("a")}}}
+	del := &kvpb.Op{Op: &kvpb.Op_Delete{Delete: &kvpb.DeleteRequest{Key: []byte("b")}}}
+	// b is set by the ops on success, deleted on failure
+	for _, tt := range []struct {
+		cmp       *kvpb.Compare
+		succeeded bool
+	}{
+		{&kvpb.Compare{Key: []byte("a"), Result: kvpb.Compare_EQUAL, Value: []byte("1")}, true},
+		{&kvpb.Compare{Key: []byte("a"), Result: kvpb.Compare_NOT_EQUAL, Value: []byte("1")}, false},
+		{&kvpb.Compare{Key: []byte("b"), Result: kvpb.Compare_EXISTS}, false},
+		{&kvpb.Compare{Key: []byte("b"), Result: kvpb.Compare_NOT_EXISTS}, true},
+		{&kvpb.Compare{Key: []byte("b"), Result: kvpb.Compare_EXISTS}, true},
+	} {
+		mustSet(t, db, "a", "1")
+		resp, err := c.Txn(ctx, &kvpb.TxnRequest{
+			Compare: []*kvpb.Compare{tt.cmp},
+			Success: []*kvpb.Op{put("a", "2"), put("b", "x"), get},
+			Failure: []*kvpb.Op{put("a", "3"), del, get},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "3"
+		if tt.succeeded {
+			want = "2"
+		}
+		// the get sees the put before it
+		read := resp.Responses[2].GetGet()
+		if resp.Succeeded != tt.succeeded || string(read.Kv.Value) != want || resp.Version != db.version {
+			t.Fatalf("%v: txn %v", tt.cmp, resp)
+		}
+	}
+
+	mustSet(t, db, "a", "0")
+	resp, err := c.Txn(ctx, &kvpb.TxnRequest{
+		Compare: []*kvpb.Compare{{Key: []byte("a"), Result: kvpb.Compare_EQUAL, Value: []byte("1")}},
+		Success: []*kvpb.Op{put("a", "2")},
+		Failure: []*kvpb.Op{del, get},
+	})
+	if err != nil || resp.Succeeded || !resp.Responses[0].GetDelete().Deleted ||
+		string(resp.Responses[1].GetGet().Kv.Value) != "0" || resp.Version != db.version {
+		t.Fatalf("failed txn %v: %v", resp, err)
+	}
+
+	// a failed op writes nothing
+	version := db.version
+	_, err = c.Txn(ctx, &kvpb.TxnRequest{Success: []*kvpb.Op{put("c", "1"), put("", "1")}})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = c.Txn(ctx, &kvpb.TxnRequest{Success: []*kvpb.Op{{}}})
+	wantCode(t, err, codes.InvalidArgument)
+	if db.version != version {
+		t.Fatal("failed txn committed")
+	}
+	wantValue(t, db, "c", nil)
+}
+
+func TestGRPCScan(t *testing.T) {
+	db := openTest(t)
+	c := grpcTest(t, db)
+	tx, _ := db.Begin(true)
+	for i := 0; i < 1000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 200))
+	}
+	tx.Set([]byte("z"), []byte("z"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	scan := func(req *kvpb.ScanRequest) ([]string, int, uint64) {
+		t.Helper()
+		stream, err := c.Scan(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		responses := 0
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				if status.Code(err) != codes.OK && !errors.Is(err, io.EOF) {
+					t.Fatal(err)
+				}
+				break
+			}
+			responses++
+			for _, kv := range resp.Kvs {
+				if !req.KeysOnly && len(kv.Value) == 0 || req.KeysOnly && kv.Value != nil {
+					t.Fatalf("value of %d bytes", len(kv.Value))
+				}
+				keys = append(keys, string(kv.Key))
+			}
+		}
+		header, _ := stream.Header()
+		var version uint64
+		fmt.Sscan(header.Get(GRPC_VERSION_HEADER)[0], &version)
+		return keys, responses, version
+	}
+	keys, responses, version := scan(&kvpb.ScanRequest{})
+	if len(keys) != 1001 || keys[0] != "k0000" || keys[1000] != "z" || version != db.version {
+		t.Fatalf("scanned %d keys of version %d", len(keys), version)
+	}
+	// cut by bytes, 200000 of them
+	if responses < 200000/GRPC_SCAN_BYTES {
+		t.Fatalf("%d responses", responses)
+	}
+	keys, responses, _ = scan(&kvpb.ScanRequest{KeysOnly: true})
+	if len(keys) != 1001 || responses != (1001+GRPC_SCAN_KEYS-1)/GRPC_SCAN_KEYS {
+		t.Fatalf("%d keys only in %d responses", len(keys), responses)
+	}
+	keys, _, _ = scan(&kvpb.ScanRequest{Prefix: []byte("k01"), Start: []byte("k0150"), Limit: 20})
+	if len(keys) != 20 || keys[0] != "k0150" || keys[19] != "k0169" {
+		t.Fatalf("scanned %v", keys)
+	}
+	keys, _, _ = scan(&kvpb.ScanRequest{Start: []byte("k0990"), End: []byte("k0995")})
+	if fmt.Sprint(keys) != "[k0990 k0991 k0992 k0993 k0994]" {
+		t.Fatalf("scanned %v", keys)
+	}
+	keys, _, _ = scan(&kvpb.ScanRequest{Prefix: []byte("k09"), Start: []byte("a")})
+	if len(keys) != 100 || keys[0] != "k0900" {
+		t.Fatalf("scanned %d keys from %v", len(keys), keys[:1])
+	}
+}
+
+func TestGRPCError(t *testing.T) {
+	for err, code := range map[error]codes.Code{
+		nil:                                  codes.OK,
+		context.DeadlineExceeded:             codes.DeadlineExceeded,
+		ErrKeyTooLarge:                       codes.InvalidArgument,
+		ErrReadOnly:                          codes.FailedPrecondition,
+		ErrConflict:                          codes.Aborted,
+		fmt.Errorf("%w: page 3", ErrCorrupt): codes.DataLoss,
+		errors.New("other"):                  codes.Internal,
+		status.Error(codes.NotFound, "x"):    codes.NotFound,
+	} {
+		if got := status.Code(grpcError(err)); got != code {
+			t.Fatalf("code of %v is %v, want %v", err, got, code)
+		}
+	}
+}
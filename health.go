@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DEFAULT_MIN_FREE_SPACE = 64 << 20
+	HEALTH_SAMPLES         = 8 // walks from the root to a leaf by Health
+)
+
+// HealthCheck is the result of a check of Health. A check that can't run,
+// like the WAL of a read-only DB, is skipped and passes.
+type HealthCheck struct {
+	Name     string // meta, pages, wal, disk or scrub
+	Err      error  // nil if passed
+	Skipped  bool
+	Detail   string
+	Duration time.Duration
+}
+
+// Health is the state of a DB for a readiness or liveness probe.
+type Health struct {
+	Checks []HealthCheck
+}
+
+// OK is whether every check passed.
+func (h Health) OK() bool {
+	return h.Err() == nil
+}
+
+// Err joins the errors of the failed checks, nil if healthy.
+func (h Health) Err() error {
+	var errs []error
+	for _, c := range h.Checks {
+		if c.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name, c.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Health checks the DB without blocking commits: the meta page on disk,
+// the pages of HEALTH_SAMPLES random walks of the tree read from the file,
+// whether the WAL can be written, the free space of the disk against
+// WithMinFreeSpace and the pages quarantined by Scrub. It reads a few
+// pages, cheap enough to run every few seconds. The checks not run once
+// ctx is done fail with its error.
+func (db *DB) Health(ctx context.Context) Health {
+	if db.closed.Load() {
+		return Health{Checks: []HealthCheck{{Name: "open", Err: ErrDBClosed}}}
+	}
+	checks := []struct {
+		name string
+		run  func() (detail string, err error)
+	}{
+		{"meta", db.checkMetaPage},
+		{"pages", func() (string, error) { return db.samplePages(ctx) }},
+		{"wal", db.checkWAL},
+		{"disk", db.checkDisk},
+		{"scrub", db.checkScrub},
+	}
+	var health Health
+	for _, check := range checks {
+		c := HealthCheck{Name: check.name}
+		start := time.Now()
+		if c.Err = ctx.Err(); c.Err == nil {
+			c.Detail, c.Err = check.run()
+		}
+		if errors.Is(c.Err, errSkipped) {
+			c.Skipped, c.Err = true, nil
+		}
+		c.Duration = time.Since(start)
+		health.Checks = append(health.Checks, c)
+	}
+	return health
+}
+
+// a check that doesn't apply, its detail says why
+var errSkipped = errors.New("skipped")
+
+func (db *DB) checkMetaPage() (string, error) {
+	data := make([]byte, db.opts.pageSize)
+	if _, err := db.fp.ReadAt(data, 0); err != nil {
+		return "", fmt.Errorf("read meta page: %w", err)
+	}
+	format, err := checkMeta(data)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(data[52:68], db.info.ID[:]) {
+		return "", fmt.Errorf("%w: database id changed", ErrBadMeta)
+	}
+	return fmt.Sprintf("format %d", format), nil
+}
+
+// read the pages of random walks from the file, verified as by Scrub:
+// their checksum, their layout, and those in memory that are clean must
+// be the same
+func (db *DB) samplePages(ctx context.Context) (detail string, err error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	defer catchTreeError(&err)
+	if tx.tree.root == 0 {
+		return "", fmt.Errorf("%w: no keys yet", errSkipped)
+	}
+	read := 0
+	for i := 0; i < HEALTH_SAMPLES; i++ {
+		for ptr := tx.tree.root; ; {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			var node BNode
+			if cached, dirty := db.cache.peek(ptr); dirty {
+				node = BNode{cached} // not in the file yet
+			} else {
+				if node, err = db.readPage(ptr); err == nil {
+					err = layoutErr(node)
+				}
+				if err == nil && cached != nil && !bytes.Equal(cached, node.data[:len(cached)]) {
+					err = fmt.Errorf("%w: differs from the page in memory", ErrCorrupt)
+				}
+				if err != nil {
+					return "", fmt.Errorf("page %d: %w", ptr, err)
+				}
+				read++
+			}
+			if node.getNodeType() != BNODE_NODE {
+				break
+			}
+			ptr = node.getPointer(uint16(rand.Intn(int(node.getNumberOfKeys()))))
+		}
+	}
+	return fmt.Sprintf("%d pages read", read), nil
+}
+
+func (db *DB) checkWAL() (string, error) {
+	if db.opts.readOnly {
+		return "", fmt.Errorf("%w: read-only", errSkipped)
+	}
+	if err := db.failed(); err != nil {
+		return "", err
+	}
+	// the file may have become read-only, or its disk
+	fp, err := os.OpenFile(walPath(db.Path), os.O_WRONLY, 0)
+	if err != nil {
+		return "", fmt.Errorf("open WAL: %w", err)
+	}
+	fp.Close()
+	return fmt.Sprintf("%d bytes", db.wal.size.Load()), nil
+}
+
+func (db *DB) checkDisk() (string, error) {
+	free, err := diskFree(filepath.Dir(db.Path))
+	if errors.Is(err, ErrNotSupported) {
+		return "", fmt.Errorf("%w: %v", errSkipped, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	detail := fmt.Sprintf("%d bytes free", free)
+	if db.opts.minFreeSpace > 0 && free < uint64(db.opts.minFreeSpace) {
+		return detail, fmt.Errorf("%d bytes free, under %d", free, db.opts.minFreeSpace)
+	}
+	return detail, nil
+}
+
+func (db *DB) checkScrub() (string, error) {
+	scrubbed := db.stats.scrubbedPages.Load()
+	if scrubbed == 0 {
+		return "", fmt.Errorf("%w: no page scrubbed yet", errSkipped)
+	}
+	detail := fmt.Sprintf("%d pages scrubbed", scrubbed)
+	pages, err := db.quarantinedPages()
+	if err != nil {
+		return detail, fmt.Errorf("%d pages quarantined, page %d: %w", len(pages), pages[0], err)
+	}
+	return detail, nil
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+// the result of each check by name
+func healthChecks(h Health) map[string]HealthCheck {
+	checks := map[string]HealthCheck{}
+	for _, c := range h.Checks {
+		checks[c.Name] = c
+	}
+	return checks
+}
+
+func TestHealth(t *testing.T) {
+	db := openTest(t, WithMinFreeSpace(1))
+	checks := healthChecks(db.Health(context.Background()))
+	if len(checks) != 5 || !checks["pages"].Skipped || !checks["scrub"].Skipped {
+		t.Fatalf("checks of an empty DB %+v", checks)
+	}
+	for i := 0; i < 2000; i++ {
+		mustSet(t, db, fmt.Sprintf("k%05d", i), "v")
+	}
+	db.Checkpoint()
+	if _, err := db.Scrub(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h := db.Health(context.Background())
+	if !h.OK() {
+		t.Fatal(h.Err())
+	}
+	for _, c := range h.Checks {
+		if c.Skipped && c.Name != "disk" || c.Err != nil {
+			t.Fatalf("check %+v", c)
+		}
+	}
+
+	db = reopenTest(t, db, WithReadOnly(), WithMinFreeSpace(math.MaxInt64))
+	checks = healthChecks(db.Health(context.Background()))
+	if !checks["wal"].Skipped {
+		t.Fatalf("WAL of a read-only DB checked %+v", checks["wal"])
+	}
+	if c := checks["disk"]; !c.Skipped && c.Err == nil {
+		t.Fatalf("disk check passed under the minimum %+v", c)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if h := db.Health(ctx); !errors.Is(h.Err(), context.Canceled) {
+		t.Fatalf("health after the cancel: %v", h.Err())
+	}
+	db.Close()
+	if h := db.Health(context.Background()); !errors.Is(h.Err(), ErrDBClosed) {
+		t.Fatalf("health of a closed DB: %v", h.Err())
+	}
+}
+
+// the pages and the meta page are read from the file, not the cache
+func TestHealthCorrupt(t *testing.T) {
+	db := openTest(t)
+	for i := 0; i < 2000; i++ {
+		mustSet(t, db, fmt.Sprintf("k%05d", i), "v")
+	}
+	db.Checkpoint()
+	tx, _ := db.Begin(false)
+	root := tx.tree.root
+	tx.Rollback()
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	fp.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(root)*BTREE_PAGE_SIZE+2)
+	checks := healthChecks(db.Health(context.Background()))
+	if !errors.Is(checks["pages"].Err, ErrCorrupt) || checks["meta"].Err != nil {
+		t.Fatalf("checks %+v", checks)
+	}
+	// a root node without keys, its checksum matching, read from the file
+	// with no copy in memory
+	db.Close()
+	node := BNode{make([]byte, BTREE_PAGE_SIZE-PAGE_CHECKSUM_LEN)}
+	node.setHeaders(BNODE_NODE, 0)
+	newChecksumPager(filePager{fp, BTREE_PAGE_SIZE}, BTREE_PAGE_SIZE).writePages(map[uint64][]byte{root: node.data})
+	db = openTestPath(t, db.Path)
+	if checks = healthChecks(db.Health(context.Background())); !errors.Is(checks["pages"].Err, ErrCorrupt) || !strings.Contains(checks["pages"].Err.Error(), "no keys") {
+		t.Fatalf("checks of a root without keys %+v", checks)
+	}
+	fp.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+	if checks = healthChecks(db.Health(context.Background())); !errors.Is(checks["meta"].Err, ErrBadMeta) {
+		t.Fatalf("meta check %+v", checks["meta"])
+	}
+}
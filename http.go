@@ -0,0 +1,453 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	HTTP_SCAN_LIMIT = 100   // keys of /scan without limit
+	HTTP_SCAN_MAX   = 10000 // keys of /scan at most
+)
+
+// the header of the deadline of a key, RFC 3339
+const HTTP_EXPIRES_HEADER = "Storage-Expires"
+
+// HTTPHandler serves the keys of the DB as a REST API, for integrations
+// and curl. It's mounted on any mux, under a prefix with http.StripPrefix:
+//
+//	GET    /kv/{key}                    the value, 404 if absent
+//	PUT    /kv/{key}?ttl=1h             set to the body, until ttl if given
+//	DELETE /kv/{key}                    204, 404 if absent
+//	GET    /scan?prefix=&after=&limit=  the keys in order as JSON
+//	GET    /stats                       the metrics of WriteMetrics as JSON
+//	GET    /schemas                     the schemas of the tables as JSON
+//	GET    /changes?after=              the commits after, a line of JSON each
+//	GET    /audit?after=&limit=         the entries of the audit log after, as JSON
+//
+// The key is the rest of the path, unescaped. Each request is a Tx begun
+// with its context. Only the keys outside buckets are served, the changes
+// of /changes are those of DB.Changes, in buckets too. There's no
+// authentication: it's for a trusted network, or behind a handler that
+// checks.
+func (db *DB) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/kv/"):
+			db.serveKey(w, r, []byte(strings.TrimPrefix(r.URL.Path, "/kv/")))
+		case r.URL.Path == "/scan":
+			if allowMethods(w, r, http.MethodGet) {
+				db.serveScan(w, r)
+			}
+		case r.URL.Path == "/changes":
+			if allowMethods(w, r, http.MethodGet) {
+				db.serveChanges(w, r)
+			}
+		case r.URL.Path == "/stats":
+			if allowMethods(w, r, http.MethodGet) {
+				writeJSON(w, statsVars(db.Stats()))
+			}
+		case r.URL.Path == "/schemas":
+			if !allowMethods(w, r, http.MethodGet) {
+				return
+			}
+			schemas, err := db.Schemas()
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+			if schemas == nil {
+				schemas = []Schema{}
+			}
+			writeJSON(w, schemas)
+		case r.URL.Path == "/audit":
+			if allowMethods(w, r, http.MethodGet) {
+				db.serveAudit(w, r)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (db *DB) serveKey(w http.ResponseWriter, r *http.Request, key []byte) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+	if len(key) == 0 {
+		http.Error(w, ErrEmptyKey.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		tx, err := db.BeginContext(ctx, false)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		defer tx.Rollback()
+		value, ok, err := tx.Get(key)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		at, err := tx.Expiry(key)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if !at.IsZero() {
+			w.Header().Set(HTTP_EXPIRES_HEADER, at.UTC().Format(time.RFC3339Nano))
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		if r.Method == http.MethodGet {
+			w.Write(value)
+		}
+	case http.MethodPut:
+		var at time.Time
+		if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+			d, err := time.ParseDuration(ttl)
+			if err != nil || d <= 0 {
+				http.Error(w, "bad ttl "+strconv.Quote(ttl), http.StatusBadRequest)
+				return
+			}
+			at = time.Now().Add(d)
+		}
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxValueSize(db.nodeSize()))))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				httpError(w, ErrValueTooLarge)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		tx, err := db.BeginContext(ctx, true)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		defer tx.Rollback()
+		if at.IsZero() {
+			err = tx.Set(key, value)
+		} else {
+			err = tx.SetWithExpiry(key, value, at)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		deleted, err := db.DelContext(ctx, key)
+		switch {
+		case err != nil:
+			httpError(w, err)
+		case !deleted:
+			http.NotFound(w, r)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// a key of /scan and of DB.Export, like the records of storagectl dump:
+// text, or base64 if the key or the value isn't UTF-8
+type httpRecord struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Expires string `json:"expires,omitempty"` // RFC 3339
+	Base64  bool   `json:"base64,omitempty"`
+}
+
+// the keys with the prefix after the key after, at most limit of them in
+// order from one snapshot: more is set if there are others, to get with
+// after set to the last key
+func (db *DB) serveScan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, after := []byte(query.Get("prefix")), []byte(query.Get("after"))
+	limit := HTTP_SCAN_LIMIT
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > HTTP_SCAN_MAX {
+			http.Error(w, "bad limit "+strconv.Quote(s), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	tx, err := db.BeginContext(r.Context(), false)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer tx.Rollback()
+	resp := struct {
+		Version uint64       `json:"version"`
+		Records []httpRecord `json:"records"`
+		More    bool         `json:"more"`
+	}{Version: tx.Version(), Records: []httpRecord{}}
+	from := prefix
+	if tx.tree.compare(after, from) > 0 {
+		from = after
+	}
+	cur := tx.Cursor()
+	key, value := cur.Seek(from)
+	if len(after) > 0 && bytes.Equal(key, after) {
+		key, value = cur.Next()
+	}
+	for ; key != nil && bytes.HasPrefix(key, prefix); key, value = cur.Next() {
+		if len(resp.Records) == limit {
+			resp.More = true
+			break
+		}
+		at, err := tx.Expiry(key)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		resp.Records = append(resp.Records, newHTTPRecord(key, value, at))
+	}
+	if err := cur.Err(); err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// a commit of /changes
+type httpChange struct {
+	Seq     uint64           `json:"seq"`
+	Changes []httpChangeItem `json:"changes"`
+}
+
+type httpChangeItem struct {
+	Op      string   `json:"op"`
+	Bucket  []string `json:"bucket,omitempty"`
+	Key     string   `json:"key"`
+	Value   string   `json:"value,omitempty"`
+	Expires string   `json:"expires,omitempty"` // RFC 3339
+	Base64  bool     `json:"base64,omitempty"`  // of the bucket, key and value
+}
+
+// the commits of DB.Changes after the sequence number after as they come,
+// until the client goes away: 410 if they're no longer kept
+func (db *DB) serveChanges(w http.ResponseWriter, r *http.Request) {
+	var after uint64
+	if s := r.URL.Query().Get("after"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "bad after "+strconv.Quote(s), http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+	stream := db.Changes(after)
+	// the first one read before the reply, so that an error has its status
+	rec, err := stream.Next(r.Context())
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for err == nil {
+		if err = enc.Encode(newHTTPChange(rec)); err != nil {
+			return
+		}
+		if flusher != nil && len(stream.recs) == 0 {
+			flusher.Flush()
+		}
+		rec, err = stream.Next(r.Context())
+	}
+}
+
+// an entry of /audit, the bucket and key like those of /changes
+type httpAuditEntry struct {
+	Version   uint64          `json:"version"`
+	Time      string          `json:"time"` // RFC 3339
+	Principal string          `json:"principal,omitempty"`
+	Changes   []httpAuditItem `json:"changes"`
+}
+
+type httpAuditItem struct {
+	Op     string   `json:"op"`
+	Bucket []string `json:"bucket,omitempty"`
+	Key    string   `json:"key"`
+	Table  string   `json:"table,omitempty"`
+	Base64 bool     `json:"base64,omitempty"` // of the bucket and key
+}
+
+// the entries of the audit log after the version after, at most limit of
+// them: more is set if there are others, to get with after set to the
+// version of the last one
+func (db *DB) serveAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var after uint64
+	if s := query.Get("after"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "bad after "+strconv.Quote(s), http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+	limit := HTTP_SCAN_LIMIT
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > HTTP_SCAN_MAX {
+			http.Error(w, "bad limit "+strconv.Quote(s), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	tx, err := db.BeginContext(r.Context(), false)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer tx.Rollback()
+	resp := struct {
+		Entries []httpAuditEntry `json:"entries"`
+		More    bool             `json:"more"`
+	}{Entries: []httpAuditEntry{}}
+	errLimit := errors.New("limit")
+	err = tx.AuditLog(after, func(e AuditEntry) error {
+		if len(resp.Entries) == limit {
+			resp.More = true
+			return errLimit
+		}
+		resp.Entries = append(resp.Entries, newHTTPAuditEntry(e))
+		return nil
+	})
+	if err != nil && err != errLimit {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func newHTTPAuditEntry(e AuditEntry) httpAuditEntry {
+	he := httpAuditEntry{
+		Version:   e.Version,
+		Time:      e.Time.UTC().Format(time.RFC3339Nano),
+		Principal: e.Principal,
+		Changes:   make([]httpAuditItem, len(e.Changes)),
+	}
+	for i, c := range e.Changes {
+		item := httpAuditItem{Op: c.Op.String(), Table: c.Table}
+		valid := utf8.Valid(c.Key)
+		for _, name := range c.Bucket {
+			valid = valid && utf8.Valid(name)
+		}
+		encode := func(b []byte) string { return string(b) }
+		if !valid {
+			encode, item.Base64 = base64.StdEncoding.EncodeToString, true
+		}
+		for _, name := range c.Bucket {
+			item.Bucket = append(item.Bucket, encode(name))
+		}
+		item.Key = encode(c.Key)
+		he.Changes[i] = item
+	}
+	return he
+}
+
+func newHTTPChange(rec ChangeRecord) httpChange {
+	hc := httpChange{Seq: rec.Seq, Changes: make([]httpChangeItem, len(rec.Changes))}
+	for i, c := range rec.Changes {
+		item := httpChangeItem{Op: c.Op.String()}
+		valid := utf8.Valid(c.Key) && utf8.Valid(c.Value)
+		for _, name := range c.Bucket {
+			valid = valid && utf8.Valid(name)
+		}
+		encode := func(b []byte) string { return string(b) }
+		if !valid {
+			encode, item.Base64 = base64.StdEncoding.EncodeToString, true
+		}
+		for _, name := range c.Bucket {
+			item.Bucket = append(item.Bucket, encode(name))
+		}
+		item.Key, item.Value = encode(c.Key), encode(c.Value)
+		if !c.Expiry.IsZero() {
+			item.Expires = c.Expiry.UTC().Format(time.RFC3339Nano)
+		}
+		hc.Changes[i] = item
+	}
+	return hc
+}
+
+func newHTTPRecord(key, value []byte, expires time.Time) httpRecord {
+	var r httpRecord
+	if utf8.Valid(key) && utf8.Valid(value) {
+		r.Key, r.Value = string(key), string(value)
+	} else {
+		r.Key, r.Value = base64.StdEncoding.EncodeToString(key), base64.StdEncoding.EncodeToString(value)
+		r.Base64 = true
+	}
+	if !expires.IsZero() {
+		r.Expires = expires.UTC().Format(time.RFC3339Nano)
+	}
+	return r
+}
+
+// whether the method of the request is one of those, HEAD with GET, 405
+// is replied otherwise
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m || r.Method == http.MethodHead && m == http.MethodGet {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// reply with the status of an error of the engine
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrEmptyKey), errors.Is(err, ErrKeyTooLarge):
+		code = http.StatusBadRequest
+	case errors.Is(err, ErrValueTooLarge):
+		code = http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrReadOnly):
+		code = http.StatusForbidden
+	case errors.Is(err, ErrConflict):
+		code = http.StatusConflict
+	case errors.Is(err, ErrWALGone):
+		code = http.StatusGone
+	case errors.Is(err, ErrDBClosed):
+		code = http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		code = http.StatusGatewayTimeout
+	}
+	http.Error(w, err.Error(), code)
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// an HTTP response of the handler of the test
+type httpResponse struct {
+	code   int
+	header http.Header
+	body   string
+}
+
+// serve the HTTPHandler of the DB under /db/, returning a function doing a
+// request to it
+func httpTest(t *testing.T, db *DB) func(method, path, body string) httpResponse {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("/db/", http.StripPrefix("/db", db.HTTPHandler()))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return func(method, path, body string) httpResponse {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+"/db"+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return httpResponse{resp.StatusCode, resp.Header, string(b)}
+	}
+}
+
+func TestHTTPKey(t *testing.T) {
+	db := openTest(t)
+	do := httpTest(t, db)
+	for _, tt := range []struct {
+		method, path, body string
+		code               int
+		want               string
+	}{
+		{"PUT", "/kv/a%2Fb", "hello", 204, ""},
+		{"GET", "/kv/a/b", "", 200, "hello"},
+		{"HEAD", "/kv/a/b", "", 200, ""},
+		{"GET", "/kv/zz", "", 404, "404 page not found\n"},
+		{"POST", "/kv/zz", "", 405, "method not allowed\n"},
+		{"PUT", "/kv/", "x", 400, ErrEmptyKey.Error() + "\n"},
+		{"PUT", "/kv/t?ttl=x", "", 400, "bad ttl \"x\"\n"},
+		{"PUT", "/kv/t?ttl=-1s", "", 400, "bad ttl \"-1s\"\n"},
+		{"PUT", "/kv/big", strings.Repeat("x", 100000), 413, ""},
+		{"PUT", "/kv/" + strings.Repeat("k", 2000), "", 400, ""},
+		{"PUT", "/kv/bin", "\xff\x00", 204, ""},
+		{"GET", "/kv/bin", "", 200, "\xff\x00"},
+		{"DELETE", "/kv/bin", "", 204, ""},
+		{"DELETE", "/kv/bin", "", 404, "404 page not found\n"},
+		{"GET", "/nothing", "", 404, "404 page not found\n"},
+	} {
+		resp := do(tt.method, tt.path, tt.body)
+		if resp.code != tt.code || tt.want != "" && resp.body != tt.want {
+			t.Fatalf("%s %.40s: %d %q", tt.method, tt.path, resp.code, resp.body)
+		}
+	}
+	if resp := do("POST", "/kv/a", ""); resp.header.Get("Allow") != "GET, PUT, DELETE" {
+		t.Fatalf("allowed %q", resp.header.Get("Allow"))
+	}
+	if resp := do("GET", "/kv/a/b", ""); resp.header.Get(HTTP_EXPIRES_HEADER) != "" ||
+		resp.header.Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("header %v", resp.header)
+	}
+
+	before := time.Now()
+	do("PUT", "/kv/t?ttl=1h", "x")
+	resp := do("GET", "/kv/t", "")
+	at, err := time.Parse(time.RFC3339Nano, resp.header.Get(HTTP_EXPIRES_HEADER))
+	if err != nil || at.Before(before.Add(time.Hour)) || at.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("expires %q: %v", resp.header.Get(HTTP_EXPIRES_HEADER), err)
+	}
+	db.Close()
+	if resp := do("GET", "/kv/t", ""); resp.code != 503 {
+		t.Fatalf("get from a closed DB: %d %q", resp.code, resp.body)
+	}
+}
+
+func TestHTTPScan(t *testing.T) {
+	db := openTest(t)
+	do := httpTest(t, db)
+	for i := 0; i < 5; i++ {
+		mustSet(t, db, fmt.Sprintf("p%d", i), "v")
+	}
+	mustSet(t, db, "q", "\xff")
+	db.SetWithTTL([]byte("r"), []byte("v"), time.Hour)
+	type scan struct {
+		Version uint64
+		Records []httpRecord
+		More    bool
+	}
+	get := func(query string) scan {
+		t.Helper()
+		resp := do("GET", "/scan"+query, "")
+		var s scan
+		if err := json.Unmarshal([]byte(resp.body), &s); err != nil || resp.code != 200 {
+			t.Fatalf("scan%s: %d %q", query, resp.code, resp.body)
+		}
+		return s
+	}
+	keys := func(s scan) string {
+		var keys []string
+		for _, r := range s.Records {
+			keys = append(keys, r.Key)
+		}
+		return fmt.Sprint(keys, s.More)
+	}
+	if s := get("?prefix=p&limit=3"); keys(s) != "[p0 p1 p2] true" || s.Version != db.version {
+		t.Fatalf("scan %v", s)
+	}
+	if s := get("?prefix=p&after=p2"); keys(s) != "[p3 p4] false" {
+		t.Fatalf("scan after %v", s)
+	}
+	if s := get("?after=a"); keys(s) != "[p0 p1 p2 p3 p4 cQ== r] false" {
+		t.Fatalf("scan %v", s)
+	}
+	s := get("?prefix=q")
+	if r := s.Records[0]; !r.Base64 || r.Value != base64.StdEncoding.EncodeToString([]byte("\xff")) {
+		t.Fatalf("record of a binary value %+v", r)
+	}
+	if r := get("?prefix=r").Records[0]; r.Expires == "" {
+		t.Fatalf("record of an expiring key %+v", r)
+	}
+	if s := get("?prefix=x"); s.Records == nil || len(s.Records) != 0 {
+		t.Fatalf("empty scan %v", s)
+	}
+	for _, query := range []string{"?limit=0", fmt.Sprint("?limit=", HTTP_SCAN_MAX+1), "?limit=x"} {
+		if resp := do("GET", "/scan"+query, ""); resp.code != 400 {
+			t.Fatalf("scan%s: %d", query, resp.code)
+		}
+	}
+	if resp := do("POST", "/scan", ""); resp.code != 405 {
+		t.Fatalf("post of /scan: %d", resp.code)
+	}
+}
+
+func TestHTTPStats(t *testing.T) {
+	db := openTest(t)
+	do := httpTest(t, db)
+	mustSet(t, db, "a", "b")
+	resp := do("GET", "/stats", "")
+	var vars map[string]float64
+	if err := json.Unmarshal([]byte(resp.body), &vars); err != nil || resp.header.Get("Content-Type") != "application/json" {
+		t.Fatalf("stats %q: %v", resp.body, err)
+	}
+	if vars["commits_total"] != 1 || len(vars) != len(statsMetrics)+4*len(statsHistograms) {
+		t.Fatalf("stats %v", vars)
+	}
+}
+
+func TestHTTPChanges(t *testing.T) {
+	db := openTest(t, WithWALArchiveSize(1))
+	srv := httptest.NewServer(db.HTTPHandler())
+	t.Cleanup(srv.Close)
+	mustSet(t, db, "a", "1")
+	db.SetWithTTL([]byte("t"), []byte("x"), time.Hour)
+	db.Set([]byte{0xff}, []byte("bin"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/changes?after=1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("changes: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	dec := json.NewDecoder(resp.Body)
+	next := func() httpChange {
+		t.Helper()
+		var c httpChange
+		if err := dec.Decode(&c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	if c := next(); c.Seq != 2 || len(c.Changes) != 2 || c.Changes[0].Key != "t" || c.Changes[1].Op != "expire" || c.Changes[1].Expires == "" {
+		t.Fatalf("change %+v", c)
+	}
+	if c := next(); c.Seq != 3 || !c.Changes[0].Base64 || c.Changes[0].Key != base64.StdEncoding.EncodeToString([]byte{0xff}) {
+		t.Fatalf("change %+v", c)
+	}
+	// the commits to come are streamed as well
+	mustSet(t, db, "b", "2")
+	if c := next(); c.Seq != 4 || c.Changes[0].Key != "b" || c.Changes[0].Value != "2" {
+		t.Fatalf("change %+v", c)
+	}
+	cancel()
+
+	do := httpTest(t, db)
+	if r := do("GET", "/changes?after=x", ""); r.code != 400 {
+		t.Fatalf("bad after: %d %s", r.code, r.body)
+	}
+	db.Checkpoint()
+	mustSet(t, db, "c", "3")
+	db.Checkpoint()
+	if r := do("GET", "/changes", ""); r.code != 410 {
+		t.Fatalf("changes no longer kept: %d %s", r.code, r.body)
+	}
+	if r := do("POST", "/changes", ""); r.code != 405 {
+		t.Fatalf("post: %d", r.code)
+	}
+}
+
+func TestHTTPSchemas(t *testing.T) {
+	db := openTest(t)
+	do := httpTest(t, db)
+	if resp := do("GET", "/schemas", ""); resp.code != http.StatusOK || resp.body != "[]\n" {
+		t.Fatalf("schemas %d %q", resp.code, resp.body)
+	}
+	execTest(t, db, "CREATE TABLE t (id INT PRIMARY KEY, v TEXT NOT NULL DEFAULT 'x')")
+	resp := do("GET", "/schemas", "")
+	var schemas []Schema
+	if err := json.Unmarshal([]byte(resp.body), &schemas); err != nil || resp.header.Get("Content-Type") != "application/json" {
+		t.Fatalf("schemas %q: %v", resp.body, err)
+	}
+	if len(schemas) != 1 || schemas[0].Name != "t" || len(schemas[0].Columns) != 2 || schemas[0].Columns[1].Default != "x" {
+		t.Fatalf("schemas %+v", schemas)
+	}
+	if resp := do("POST", "/schemas", ""); resp.code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /schemas: %d", resp.code)
+	}
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Imports load the keys of another database with a Loader, ImportBolt,
+// ImportLevelDB and ImportBadger: they report their progress, and they're
+// throttled to WithImportRate bytes per second so that the other clients of
+// the DB keep their share of the disk.
+
+const (
+	IMPORT_PROGRESS_KEYS = 10000 // keys loaded between progress reports
+	IMPORT_MIN_SLEEP     = 10 * time.Millisecond
+)
+
+// ImportProgress is how far an import is.
+type ImportProgress struct {
+	Keys    int64 // loaded, in buckets or not
+	Buckets int64
+	Bytes   int64 // of the keys and values loaded
+	Read    int64 // bytes of the source read, estimated by some
+	Size    int64 // bytes of the source
+	Elapsed time.Duration
+}
+
+// an import in progress
+type importer struct {
+	ctx      context.Context
+	l        *Loader
+	p        ImportProgress
+	rate     int64
+	start    time.Time
+	read     func() int64 // the bytes of the source read so far
+	progress func(ImportProgress)
+}
+
+func (db *DB) newImporter(ctx context.Context, size int64, read func() int64, progress func(ImportProgress)) *importer {
+	return &importer{
+		ctx:      ctx,
+		l:        db.NewLoader(ctx),
+		p:        ImportProgress{Size: size},
+		rate:     db.opts.importRate,
+		start:    time.Now(),
+		read:     read,
+		progress: progress,
+	}
+}
+
+// load a key, waiting first if it would go past the rate
+func (im *importer) set(path [][]byte, key, value []byte) error {
+	return im.setWithExpiry(path, key, value, time.Time{})
+}
+
+// set with a deadline, none if zero; only the keys outside buckets expire
+func (im *importer) setWithExpiry(path [][]byte, key, value []byte, at time.Time) error {
+	if err := im.l.SetWithExpiry(path, key, value, at); err != nil {
+		return err
+	}
+	im.p.Keys++
+	im.p.Bytes += int64(len(key) + len(value))
+	if im.p.Keys%IMPORT_PROGRESS_KEYS == 0 {
+		im.report()
+	}
+	return im.throttle()
+}
+
+func (im *importer) createBucket(path [][]byte) error {
+	im.p.Buckets++
+	return im.l.CreateBucket(path)
+}
+
+func (im *importer) throttle() error {
+	if im.rate <= 0 {
+		return nil
+	}
+	due := time.Duration(float64(im.p.Bytes) / float64(im.rate) * float64(time.Second))
+	ahead := due - time.Since(im.start)
+	if ahead < IMPORT_MIN_SLEEP {
+		return nil
+	}
+	t := time.NewTimer(ahead)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-im.ctx.Done():
+		return im.ctx.Err()
+	}
+}
+
+func (im *importer) report() {
+	im.p.Read, im.p.Elapsed = im.read(), time.Since(im.start)
+	if im.progress != nil {
+		im.progress(im.p)
+	}
+}
+
+// commit the keys left after the source is read, and the counts at the end
+func (im *importer) close(err error) (ImportProgress, error) {
+	if cerr := im.l.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		im.p.Read, im.p.Elapsed = im.read(), time.Since(im.start)
+		return im.p, err
+	}
+	im.report()
+	return im.p, nil
+}
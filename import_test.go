@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestImporter(t *testing.T) {
+	db := openTest(t)
+	var reports []ImportProgress
+	read := int64(0)
+	im := db.newImporter(context.Background(), 1000, func() int64 { return read }, func(p ImportProgress) { reports = append(reports, p) })
+	if err := im.createBucket([][]byte{[]byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*IMPORT_PROGRESS_KEYS+5; i++ {
+		read = int64(i)
+		if err := im.set([][]byte{[]byte("b")}, []byte(fmt.Sprintf("k%05d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	im.setWithExpiry(nil, []byte("t"), []byte("x"), time.Now().Add(time.Hour))
+	p, err := im.close(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Keys != 2*IMPORT_PROGRESS_KEYS+6 || p.Buckets != 1 || p.Bytes != p.Keys*7-5 || p.Size != 1000 || p.Read != read {
+		t.Fatalf("progress %+v", p)
+	}
+	if len(reports) != 3 || reports[0].Keys != IMPORT_PROGRESS_KEYS || reports[2] != p {
+		t.Fatalf("reports %+v", reports)
+	}
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	if at, _ := tx.Expiry([]byte("t")); at.IsZero() {
+		t.Fatal("expiry not imported")
+	}
+}
+
+// the imports go at WithImportRate, ctx ends the wait
+func TestImportRate(t *testing.T) {
+	db := openTest(t, WithImportRate(100_000))
+	im := db.newImporter(context.Background(), 0, func() int64 { return 0 }, nil)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := im.set(nil, []byte(fmt.Sprintf("k%03d", i)), make([]byte, 196)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := im.close(nil); err != nil {
+		t.Fatal(err)
+	}
+	// 20000 bytes at 100000 per second, less the last sleep skipped
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("20000 bytes imported in %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	im = db.newImporter(ctx, 0, func() int64 { return 0 }, nil)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := im.set(nil, []byte("big"), make([]byte, 3000))
+	for i := 0; err == nil && i < 100; i++ {
+		err = im.set(nil, []byte(fmt.Sprint("big", i)), make([]byte, 3000))
+	}
+	if _, cerr := im.close(err); !errors.Is(cerr, context.Canceled) {
+		t.Fatalf("import canceled while throttled: %v", cerr)
+	}
+}
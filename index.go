@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Secondary indexes: an index of a table is a bucket inside the bucket of
+// its rows, of the name of the index. Its keys are the indexed columns of
+// each row then its primary key, both encoded as the keys of the rows,
+// the values the key of the row. They're updated with the rows in the same
+// Tx. A row with a NULL in the indexed columns isn't in the index. The keys
+// of a unique index are the indexed columns only, checked before the row
+// is written.
+
+var (
+	ErrIndexNotFound = errors.New("index not found")
+	ErrDuplicate     = errors.New("duplicate key of unique index")
+)
+
+// Index is a secondary index of a table, on some of its columns in order.
+type Index struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique,omitempty"` // no two rows with the same indexed columns, but those with a NULL
+}
+
+// the index of a Table handle
+type tableIndex struct {
+	Index
+	cols    []int   // of the columns indexed
+	entries *Bucket // nil while the table is created
+}
+
+// check an index of the schema and add it to the table
+func (t *Table) addIndex(index Index, columns map[string]int) error {
+	if index.Name == "" {
+		return fmt.Errorf("%w: index with no name in %q", ErrSchema, t.schema.Name)
+	}
+	if len(index.Columns) == 0 {
+		return fmt.Errorf("%w: no column in index %q", ErrSchema, index.Name)
+	}
+	ix := tableIndex{Index: index}
+	for _, other := range t.indexes {
+		if other.Name == index.Name {
+			return fmt.Errorf("%w: two indexes %q in %q", ErrSchema, index.Name, t.schema.Name)
+		}
+	}
+	for _, name := range index.Columns {
+		i, ok := columns[name]
+		if !ok {
+			return fmt.Errorf("%w: no column %q of index %q", ErrSchema, name, index.Name)
+		}
+		for _, j := range ix.cols {
+			if j == i {
+				return fmt.Errorf("%w: column %q twice in index %q", ErrSchema, name, index.Name)
+			}
+		}
+		ix.cols = append(ix.cols, i)
+	}
+	t.indexes = append(t.indexes, ix)
+	return nil
+}
+
+// CreateIndex adds an index to the table and the entries of its rows, or
+// nothing if it fails: ErrDuplicate if it's unique and two rows have the
+// same entry.
+func (t *Table) CreateIndex(index Index) error {
+	columns := map[string]int{}
+	for i, c := range t.schema.Columns {
+		columns[c.Name] = i
+	}
+	if err := t.addIndex(index, columns); err != nil {
+		return err
+	}
+	old := t.schema
+	err := t.rows.tx.atomic(func() error { return t.fillIndex(&t.indexes[len(t.indexes)-1]) })
+	if err != nil {
+		t.schema = old
+		t.indexes = t.indexes[:len(t.indexes)-1]
+	}
+	return err
+}
+
+// write the schema with an index added and its entries
+func (t *Table) fillIndex(ix *tableIndex) error {
+	s := t.schema
+	s.Indexes = append(s.Indexes[:len(s.Indexes):len(s.Indexes)], ix.Index)
+	s.Version++
+	if err := t.saveSchema(s); err != nil {
+		return err
+	}
+	var err error
+	if ix.entries, err = t.rows.CreateBucket([]byte(ix.Name)); err != nil {
+		return err
+	}
+	c := t.rows.Cursor()
+	for key, value := c.First(); key != nil; key, value = c.Next() {
+		row, err := t.decodeRow(value)
+		if err != nil {
+			return err
+		}
+		if err := t.addEntry(ix, key, row); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// DropIndex removes an index of the table, or nothing if it fails.
+func (t *Table) DropIndex(name string) error {
+	for i, ix := range t.indexes {
+		if ix.Name != name {
+			continue
+		}
+		s := t.schema
+		s.Version++
+		s.Indexes = nil
+		for _, index := range t.schema.Indexes {
+			if index.Name != name {
+				s.Indexes = append(s.Indexes, index)
+			}
+		}
+		old := t.schema
+		err := t.rows.tx.atomic(func() error {
+			if err := t.saveSchema(s); err != nil {
+				return err
+			}
+			return t.rows.DeleteBucket([]byte(name))
+		})
+		if err != nil {
+			t.schema = old
+			return err
+		}
+		t.indexes = append(t.indexes[:i:i], t.indexes[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("%w: %q in %q", ErrIndexNotFound, name, t.schema.Name)
+}
+
+// write the schema of the table
+func (t *Table) saveSchema(s Schema) error {
+	data, err := encodeSchema(s)
+	if err != nil {
+		return err
+	}
+	if err := t.tables.Set([]byte(s.Name), data); err != nil {
+		return err
+	}
+	t.schema = s
+	t.rows.tx.schemaGen++
+	t.gen = t.rows.tx.schemaGen
+	return nil
+}
+
+// Lookup calls fn with the rows whose indexed columns start with values,
+// in the order of the index.
+func (t *Table) Lookup(index string, values []any, fn func(row Row) error) error {
+	ix, err := t.index(index)
+	if err != nil {
+		return err
+	}
+	prefix, err := t.indexKey(ix, values)
+	if err != nil {
+		return err
+	}
+	return t.scanIndex(ix, prefix, PrefixEnd(prefix), false, func(pk []byte, row Row) error { return fn(row) })
+}
+
+// ScanIndex calls fn with the rows from the indexed columns start to those
+// before end, in the order of the index; start and end may be the first
+// columns of the index only, nil for the first and after the last entry.
+// It stops at the first error of fn, returned.
+func (t *Table) ScanIndex(index string, start, end []any, fn func(row Row) error) error {
+	ix, err := t.index(index)
+	if err != nil {
+		return err
+	}
+	from, err := t.indexKey(ix, start)
+	if err != nil {
+		return err
+	}
+	var to []byte
+	if end != nil {
+		if to, err = t.indexKey(ix, end); err != nil {
+			return err
+		}
+	}
+	return t.scanIndex(ix, from, to, false, func(pk []byte, row Row) error { return fn(row) })
+}
+
+// ScanIndexThrough is ScanIndex to the last entry starting with the
+// columns last, included: the entries of a range of the first columns.
+func (t *Table) ScanIndexThrough(index string, start, last []any, fn func(row Row) error) error {
+	ix, err := t.index(index)
+	if err != nil {
+		return err
+	}
+	from, err := t.indexKey(ix, start)
+	if err != nil {
+		return err
+	}
+	to, err := t.indexKey(ix, last)
+	if err != nil {
+		return err
+	}
+	return t.scanIndex(ix, from, PrefixEnd(to), false, func(pk []byte, row Row) error { return fn(row) })
+}
+
+// call fn with the keys and rows of the entries from the key from to the
+// one before to, nil for the end, from the last if reverse
+func (t *Table) scanIndex(ix *tableIndex, from, to []byte, reverse bool, fn func(pk []byte, row Row) error) error {
+	return scanBucket(ix.entries, from, to, reverse, func(key, pk []byte) error {
+		row, ok, err := t.getRow(pk)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: entry of index %q without its row", ErrCorrupt, ix.Name)
+		}
+		return fn(pk, row)
+	})
+}
+
+// the index of the handle of that name
+func (t *Table) index(name string) (*tableIndex, error) {
+	for i := range t.indexes {
+		if t.indexes[i].Name == name {
+			return &t.indexes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q in %q", ErrIndexNotFound, name, t.schema.Name)
+}
+
+// the key of the values of the first indexed columns
+func (t *Table) indexKey(ix *tableIndex, values []any) ([]byte, error) {
+	if len(values) > len(ix.cols) {
+		return nil, fmt.Errorf("%w: %d values for the %d columns of index %q", ErrBadRow, len(values), len(ix.cols), ix.Name)
+	}
+	return t.encodeColumns(nil, ix.cols, values)
+}
+
+// the key of the entry of a row, nil if a column indexed is NULL
+func (t *Table) entryKey(ix *tableIndex, pk []byte, row Row) ([]byte, error) {
+	values := columnsOf(ix.cols, row)
+	for _, v := range values {
+		if v == nil {
+			return nil, nil
+		}
+	}
+	key, err := t.encodeColumns(nil, ix.cols, values)
+	if err != nil || ix.Unique {
+		return key, err
+	}
+	return append(key, pk...), nil
+}
+
+// add the entry of a row to an index
+func (t *Table) addEntry(ix *tableIndex, pk []byte, row Row) error {
+	key, err := t.entryKey(ix, pk, row)
+	if err != nil || key == nil {
+		return err
+	}
+	if err := t.checkEntry(ix, key, pk, row); err != nil {
+		return err
+	}
+	return ix.entries.Set(key, pk)
+}
+
+// ErrDuplicate if the entry of a unique index is another row's
+func (t *Table) checkEntry(ix *tableIndex, key, pk []byte, row Row) error {
+	if !ix.Unique {
+		return nil
+	}
+	other, ok, err := ix.entries.Get(key)
+	if err != nil {
+		return err
+	}
+	if ok && !bytes.Equal(other, pk) {
+		return fmt.Errorf("%w: %v of index %q in %q", ErrDuplicate, columnsOf(ix.cols, row), ix.Name, t.schema.Name)
+	}
+	return nil
+}
+
+// check the entries of a row written in the unique indexes
+func (t *Table) checkUnique(pk []byte, row Row) error {
+	for i := range t.indexes {
+		ix := &t.indexes[i]
+		if !ix.Unique {
+			continue
+		}
+		key, err := t.entryKey(ix, pk, row)
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			if err := t.checkEntry(ix, key, pk, row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replace the entries of the row old, nil if inserted, by those of the
+// row new, nil if deleted
+func (t *Table) updateIndexes(pk []byte, old, new Row) error {
+	for i := range t.indexes {
+		ix := &t.indexes[i]
+		var before, after []byte
+		var err error
+		if old != nil {
+			if before, err = t.entryKey(ix, pk, old); err != nil {
+				return err
+			}
+		}
+		if new != nil {
+			if after, err = t.entryKey(ix, pk, new); err != nil {
+				return err
+			}
+		}
+		if bytes.Equal(before, after) {
+			continue
+		}
+		if before != nil {
+			if _, err := ix.entries.Del(before); err != nil {
+				return err
+			}
+		}
+		if after != nil {
+			if err := ix.entries.Set(after, pk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// the ids of the rows fn is called with
+func rowIDsTest(t *testing.T, scan func(fn func(row Row) error) error) string {
+	t.Helper()
+	var ids []int64
+	if err := scan(func(row Row) error {
+		ids = append(ids, row[0].(int64))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(ids)
+}
+
+// the number of entries of an index
+func countEntriesTest(t *testing.T, table *Table, name string) int {
+	t.Helper()
+	ix, err := table.index(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	c := ix.entries.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+func TestIndex(t *testing.T) {
+	db := openTest(t)
+	s := usersSchemaTest()
+	s.Indexes = []Index{{Name: "by_name", Columns: []string{"name"}}, {Name: "by_score", Columns: []string{"score", "admin"}}}
+	createTableTest(t, db, s, func(users *Table) error {
+		for i := int64(0); i < 100; i++ {
+			row := Row{i, fmt.Sprint("n", i%10), float64(i % 7), nil, i%2 == 0}
+			if i%5 == 0 {
+				row[2] = nil // not in by_score
+			}
+			if _, err := users.Insert(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db = reopenTest(t, db)
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	users, err := tx.Table("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countEntriesTest(t, users, "by_name"); n != 100 {
+		t.Fatalf("%d entries of by_name", n)
+	}
+	if n := countEntriesTest(t, users, "by_score"); n != 80 {
+		t.Fatalf("%d entries of by_score, the NULLs left out", n)
+	}
+	// the rows of an entry in the order of their keys
+	if got := rowIDsTest(t, func(fn func(Row) error) error { return users.Lookup("by_name", []any{"n3"}, fn) }); got != "[3 13 23 33 43 53 63 73 83 93]" {
+		t.Fatalf("rows of n3 %s", got)
+	}
+	if got := rowIDsTest(t, func(fn func(Row) error) error { return users.Lookup("by_score", []any{6.0, true}, fn) }); got != "[6 34 48 62 76]" {
+		t.Fatalf("rows of 6 true %s", got)
+	}
+	// the first columns of an index
+	if got := rowIDsTest(t, func(fn func(Row) error) error { return users.Lookup("by_score", []any{6.0}, fn) }); got != "[13 27 41 69 83 97 6 34 48 62 76]" {
+		t.Fatalf("rows of 6 %s", got)
+	}
+	if got := rowIDsTest(t, func(fn func(Row) error) error {
+		return users.ScanIndex("by_name", []any{"n8"}, nil, fn)
+	}); got != "[8 18 28 38 48 58 68 78 88 98 9 19 29 39 49 59 69 79 89 99]" {
+		t.Fatalf("rows from n8 %s", got)
+	}
+	if got := rowIDsTest(t, func(fn func(Row) error) error {
+		return users.ScanIndex("by_name", []any{"n1"}, []any{"n2"}, fn)
+	}); got != "[1 11 21 31 41 51 61 71 81 91]" {
+		t.Fatalf("rows from n1 to n2 %s", got)
+	}
+
+	// the entries follow the updates and deletes of the rows
+	if err := users.Update(Row{int64(3), "renamed", nil, nil, false}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Delete(int64(13)); err != nil {
+		t.Fatal(err)
+	}
+	if got := rowIDsTest(t, func(fn func(Row) error) error { return users.Lookup("by_name", []any{"n3"}, fn) }); got != "[23 33 43 53 63 73 83 93]" {
+		t.Fatalf("rows of n3 after the changes %s", got)
+	}
+	if got := rowIDsTest(t, func(fn func(Row) error) error { return users.Lookup("by_name", []any{"renamed"}, fn) }); got != "[3]" {
+		t.Fatalf("rows of renamed %s", got)
+	}
+	if n := countEntriesTest(t, users, "by_score"); n != 78 {
+		t.Fatalf("%d entries of by_score after the changes", n)
+	}
+
+	if err := users.Lookup("missing", nil, func(Row) error { return nil }); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("lookup of a missing index: %v", err)
+	}
+	if err := users.Lookup("by_name", []any{"a", "b"}, func(Row) error { return nil }); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("lookup of too many columns: %v", err)
+	}
+	if err := users.Lookup("by_name", []any{int64(1)}, func(Row) error { return nil }); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("lookup of a value of another type: %v", err)
+	}
+
+	// an index created over the rows, then dropped
+	if err := users.CreateIndex(Index{Name: "by_admin", Columns: []string{"admin"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countEntriesTest(t, users, "by_admin"); n != 99 {
+		t.Fatalf("%d entries of the index created", n)
+	}
+	for name, index := range map[string]Index{
+		"no name":      {Columns: []string{"id"}},
+		"no column":    {Name: "x"},
+		"same name":    {Name: "by_name", Columns: []string{"id"}},
+		"not column":   {Name: "x", Columns: []string{"missing"}},
+		"column twice": {Name: "x", Columns: []string{"id", "id"}},
+	} {
+		if err := users.CreateIndex(index); !errors.Is(err, ErrSchema) {
+			t.Errorf("index with %s: %v", name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, _ = db.Begin(true)
+	users, _ = tx.Table("users")
+	if s := users.Schema(); len(s.Indexes) != 3 || s.Indexes[2].Name != "by_admin" {
+		t.Fatalf("indexes %+v", s.Indexes)
+	}
+	if got := rowIDsTest(t, func(fn func(Row) error) error { return users.Lookup("by_admin", []any{true}, fn) }); got != fmt.Sprint(evenIDsTest(100)) {
+		t.Fatalf("rows of admin %s", got)
+	}
+	if err := users.DropIndex("by_admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.DropIndex("by_admin"); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("drop twice: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = db.Begin(false)
+	defer tx.Rollback()
+	users, _ = tx.Table("users")
+	if s := users.Schema(); len(s.Indexes) != 2 {
+		t.Fatalf("indexes %+v after the drop", s.Indexes)
+	}
+	if _, err := users.rows.Bucket([]byte("by_admin")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("bucket of the dropped index: %v", err)
+	}
+}
+
+// the even ids from 0 to n
+func evenIDsTest(n int64) []int64 {
+	var ids []int64
+	for i := int64(0); i < n; i += 2 {
+		ids = append(ids, i)
+	}
+	return ids
+}
+
+func TestUniqueIndex(t *testing.T) {
+	db := openTest(t)
+	s := usersSchemaTest()
+	s.Indexes = []Index{{Name: "by_data", Columns: []string{"data"}, Unique: true}}
+	createTableTest(t, db, s, func(users *Table) error {
+		for i := int64(0); i < 10; i++ {
+			// the NULLs of a unique index aren't duplicates
+			row := Row{i, "n", nil, nil, false}
+			if i < 5 {
+				row[3] = []byte{byte(i)}
+			}
+			if _, err := users.Insert(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	users, _ := tx.Table("users")
+	if _, err := users.Insert(Row{int64(10), "n", nil, []byte{1}, false}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("insert of a duplicate: %v", err)
+	}
+	if _, ok, _ := users.Get(int64(10)); ok {
+		t.Fatal("duplicate row inserted")
+	}
+	if err := users.Update(Row{int64(7), "n", nil, []byte{2}, false}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("update to a duplicate: %v", err)
+	}
+	if row, _, _ := users.Get(int64(7)); row[3] != nil {
+		t.Fatalf("row updated to a duplicate: %v", row)
+	}
+	// the row keeping its entry, or moving it to a free one
+	if err := users.Update(Row{int64(1), "renamed", nil, []byte{1}, false}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Update(Row{int64(2), "n", nil, []byte{9}, false}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Insert(Row{int64(10), "n", nil, []byte{2}, false}); err != nil {
+		t.Fatalf("insert of the entry freed: %v", err)
+	}
+	if got := rowIDsTest(t, func(fn func(Row) error) error { return users.ScanIndex("by_data", nil, nil, fn) }); got != "[0 1 10 3 4 2]" {
+		t.Fatalf("rows of the index %s", got)
+	}
+	if n := countEntriesTest(t, users, "by_data"); n != 6 {
+		t.Fatalf("%d entries", n)
+	}
+
+	// a unique index of duplicates isn't created
+	if err := users.CreateIndex(Index{Name: "by_name", Columns: []string{"name"}, Unique: true}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("unique index of duplicates: %v", err)
+	}
+	if len(users.Schema().Indexes) != 1 {
+		t.Fatalf("indexes %+v", users.Schema().Indexes)
+	}
+	if _, err := users.rows.Bucket([]byte("by_name")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("bucket of the index not created: %v", err)
+	}
+	if err := users.CreateIndex(Index{Name: "by_id_name", Columns: []string{"name", "id"}, Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db = reopenTest(t, db)
+	tx, _ = db.Begin(true)
+	defer tx.Rollback()
+	users, _ = tx.Table("users")
+	if _, err := users.Insert(Row{int64(11), "n", nil, []byte{0}, false}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("insert of a duplicate after reopening: %v", err)
+	}
+}
+
+func TestScanIndexThrough(t *testing.T) {
+	db := eventsTest(t)
+	for _, c := range []struct {
+		name string
+		scan func(events *Table, fn func(row Row) error) error
+		want string
+	}{
+		// k1\xff is after the entries of k1
+		{"first column", func(e *Table, fn func(Row) error) error {
+			return e.ScanIndexThrough("by_kind", []any{"k1"}, []any{"k1"}, fn)
+		}, "[-2:1 -1:1 0:1 1:1 2:1 -2:4 -1:4 0:4 1:4 2:4 -2:7 -1:7 0:7 1:7 2:7]"},
+		{"two columns", func(e *Table, fn func(Row) error) error {
+			return e.ScanIndexThrough("by_kind", []any{"k1", int64(7)}, []any{"k1\xff", int64(9)}, fn)
+		}, "[-2:7 -1:7 0:7 1:7 2:7 -2:9 -1:9 0:9 1:9 2:9]"},
+		{"from the first", func(e *Table, fn func(Row) error) error {
+			return e.ScanIndexThrough("by_kind", nil, []any{"k0", int64(0)}, fn)
+		}, "[-2:0 -1:0 0:0 1:0 2:0]"},
+		{"lookup", func(e *Table, fn func(Row) error) error {
+			return e.Lookup("by_kind", []any{"k1\xff"}, fn)
+		}, "[-2:9 -1:9 0:9 1:9 2:9]"},
+		{"scan", func(e *Table, fn func(Row) error) error {
+			return e.ScanIndex("by_kind", []any{"k2", int64(8)}, []any{"k3"}, fn)
+		}, "[-2:8 -1:8 0:8 1:8 2:8]"},
+	} {
+		if got := eventKeysTest(t, db, c.scan); got != c.want {
+			t.Errorf("%s: %s, want %s", c.name, got, c.want)
+		}
+	}
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	events, _ := tx.Table("events")
+	if err := events.ScanIndexThrough("missing", nil, nil, func(Row) error { return nil }); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("scan of a missing index: %v", err)
+	}
+	if err := events.ScanIndexThrough("by_kind", nil, []any{int64(1)}, func(Row) error { return nil }); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("scan through an int64 for a string: %v", err)
+	}
+}
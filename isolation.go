@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+const MAX_CONFLICT_RETRIES = 16
+
+var ErrConflict = errors.New("transaction conflicts with a concurrent commit")
+
+// ConflictError is returned by Commit when a key read or written by an
+// optimistic Tx was written by a commit made after its snapshot.
+type ConflictError struct {
+	Key     []byte
+	Version uint64 // the conflicting commit
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: key %q written by version %d", ErrConflict, e.Key, e.Version)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// Isolation is the isolation level of a writable Tx begun with BeginTx.
+//
+// Such a Tx reads from the snapshot taken at Begin and buffers its updates,
+// writers don't block each other. Commit validates the Tx against the
+// commits made since Begin and fails with ErrConflict if the level would be
+// violated, the Tx can then be retried from the start.
+//
+// A Tx from Begin(true) holds the writer lock for its whole life instead,
+// it never conflicts and is serializable.
+type Isolation int
+
+const (
+	// Serializable fails the Tx if a key it read or wrote was written by a
+	// concurrent commit, so the outcome is the same as if the transactions
+	// ran one after the other. On top of what SnapshotIsolation prevents,
+	// it prevents write skew: with the invariant "x + y > 0", a Tx reading
+	// both and decrementing x and a concurrent one decrementing y can't both
+	// commit.
+	Serializable Isolation = iota
+	// SnapshotIsolation fails the Tx if a key it wrote was written by a
+	// concurrent commit, the first committer wins. It prevents dirty reads,
+	// non-repeatable reads and phantoms since every read sees the snapshot,
+	// and lost updates: two Tx incrementing the same counter can't both
+	// commit. Write skew is allowed as the read keys are not checked.
+	SnapshotIsolation
+)
+
+func (l Isolation) String() string {
+	switch l {
+	case Serializable:
+		return "serializable"
+	case SnapshotIsolation:
+		return "snapshot"
+	default:
+		return "unknown"
+	}
+}
+
+type TxOptions struct {
+	Writable  bool
+	Isolation Isolation // ignored for read-only Tx, they always see a snapshot
+}
+
+// the keys written by a commit, kept while a concurrent Tx may conflict with it
+type writeSet struct {
+	version uint64
+	keys    []string
+}
+
+// an update buffered by an optimistic Tx
+type pendingWrite struct {
+	value    []byte
+	deleted  bool
+	operands [][]byte // of Merge, folded into the committed value if no Set or Del came before
+	expires  int64    // deadline set by the Tx, -1 if removed, 0 if unchanged
+}
+
+// an expired key is absent, whatever its value
+func (w pendingWrite) expired(now int64) bool {
+	return w.expires > 0 && w.expires <= now
+}
+
+// BeginTx starts a transaction with the given options.
+// A writable Tx is optimistic, see Isolation.
+func (db *DB) BeginTx(opts TxOptions) (*Tx, error) {
+	if opts.Writable && (db.opts.readOnly || db.opts.replicaOf != "") {
+		return nil, ErrReadOnly
+	}
+	tx, err := db.Begin(false)
+	if err != nil || !opts.Writable {
+		return tx, err
+	}
+	tx.writable = true
+	tx.optimistic = true
+	tx.span.set("tx.writable", true)
+	tx.span.set("tx.optimistic", true)
+	tx.isolation = opts.Isolation
+	tx.writes = map[string]pendingWrite{}
+	if opts.Isolation == Serializable {
+		tx.reads = map[string]struct{}{}
+	}
+	return tx, nil
+}
+
+// read a key through the buffered updates of an optimistic Tx
+func (tx *Tx) optimisticGet(key []byte) ([]byte, bool, error) {
+	tx.touched = true
+	if tx.reads != nil {
+		tx.reads[string(key)] = struct{}{}
+	}
+	if w, ok := tx.writes[string(key)]; ok {
+		return tx.pendingValue(key, w)
+	}
+	return tx.treeGet(key)
+}
+
+// the value of a key updated by an optimistic Tx
+func (tx *Tx) pendingValue(key []byte, w pendingWrite) ([]byte, bool, error) {
+	if w.expired(tx.clock()) {
+		return nil, false, nil
+	}
+	if w.operands == nil {
+		return w.value, !w.deleted, nil
+	}
+	value, _, err := tx.treeGet(key)
+	if err != nil {
+		return nil, false, err
+	}
+	return tx.db.opts.merge(key, value[:len(value):len(value)], w.operands), true, nil
+}
+
+func (tx *Tx) bufferWrite(op walOp) {
+	tx.touched = true
+	tx.gen++
+	tx.ops = append(tx.ops, op)
+	tx.writeOp(op)
+}
+
+func (tx *Tx) writeOp(op walOp) {
+	w := tx.writes[string(op.key)]
+	switch op.kind {
+	case WAL_OP_MERGE:
+		w.operands = append(w.operands, op.value)
+	case WAL_OP_EXPIRE:
+		w.expires = -1
+		if len(op.value) > 0 {
+			w.expires, _ = decodeDeadline(op.value)
+		}
+	default:
+		// a deadline past is dropped by the update on commit
+		if w.expired(tx.clock()) {
+			w.expires = 0
+		}
+		w = pendingWrite{value: op.value, deleted: op.kind == WAL_OP_DEL, expires: w.expires}
+	}
+	tx.writes[string(op.key)] = w
+}
+
+// rebuild the buffered updates after a rollback to a savepoint
+func (tx *Tx) rebuildWrites() {
+	clear(tx.writes)
+	for _, op := range tx.ops {
+		tx.writeOp(op)
+	}
+}
+
+// apply an optimistic Tx to the latest tree if it doesn't conflict
+func (tx *Tx) commitOptimistic() (err error) {
+	defer func() {
+		tx.endSpan(err)
+		tx.close()
+	}()
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	latest, err := tx.applyOptimistic()
+	if err != nil {
+		return err
+	}
+	return latest.Commit()
+}
+
+// replay the updates of an optimistic Tx on a writable Tx from the latest
+// commit, which holds the writer lock
+func (tx *Tx) applyOptimistic() (*Tx, error) {
+	db := tx.db
+	latest, err := db.BeginContext(tx.ctx, true) // a span under the one of tx
+	if err != nil {
+		return nil, err
+	}
+	if err := db.conflicts(tx); err != nil {
+		latest.Rollback()
+		return nil, err
+	}
+	for _, op := range tx.ops {
+		switch op.kind {
+		case WAL_OP_SET:
+			// a key expired since the snapshot was absent for the Tx
+			if err = latest.dropExpired(op.key); err == nil {
+				err = latest.set(op.key, op.value)
+			}
+		case WAL_OP_DEL:
+			_, err = latest.del(op.key)
+		case WAL_OP_MERGE:
+			// on the latest value, whatever the snapshot had
+			err = latest.Merge(op.key, op.value)
+		case WAL_OP_EXPIRE:
+			var deadline int64
+			if deadline, err = decodeDeadline(op.value); err == nil {
+				err = latest.expire(op.key, deadline)
+			}
+		}
+		if err != nil {
+			latest.Rollback()
+			return nil, err
+		}
+	}
+	return latest, nil
+}
+
+// check the keys of the Tx against the commits made after its snapshot,
+// the caller holds the writer lock so that no commit happens meanwhile
+func (db *DB) conflicts(tx *Tx) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	check := func(key string) error {
+		if version := db.lastWrite[key]; version > tx.version {
+			return &ConflictError{Key: []byte(key), Version: version}
+		}
+		return nil
+	}
+	for key, w := range tx.writes {
+		if w.operands != nil {
+			continue // merged into the latest value, unless read
+		}
+		if err := check(key); err != nil {
+			return err
+		}
+	}
+	for key := range tx.reads {
+		if err := check(key); err != nil {
+			return err
+		}
+	}
+	if len(tx.scans) == 0 {
+		return nil
+	}
+	// a key added or removed in a range walked
+	for key, version := range db.lastWrite {
+		if version <= tx.version {
+			continue
+		}
+		for _, r := range tx.scans {
+			if r.contains([]byte(key), tx.tree.compare) {
+				return &ConflictError{Key: []byte(key), Version: version}
+			}
+		}
+	}
+	return nil
+}
+
+// record the keys of a commit and forget the ones no Tx can conflict with,
+// the caller holds db.mu
+func (db *DB) recordWrites(version uint64, ops []walOp, oldest uint64) {
+	n := 0
+	for ; n < len(db.history) && db.history[n].version <= oldest; n++ {
+		for _, key := range db.history[n].keys {
+			if db.lastWrite[key] == db.history[n].version {
+				delete(db.lastWrite, key)
+			}
+		}
+	}
+	db.history = db.history[n:]
+	ws := writeSet{version: version, keys: make([]string, 0, len(ops))}
+	inBucket := false
+	for _, op := range ops {
+		// optimistic Tx only see the keys outside buckets
+		switch op.kind {
+		case WAL_OP_BUCKET:
+			inBucket = len(op.key) > 0
+			continue
+		case WAL_OP_CREATE_BUCKET, WAL_OP_DELETE_BUCKET:
+			continue
+		}
+		if inBucket {
+			continue
+		}
+		key := string(op.key)
+		if db.lastWrite[key] != version {
+			db.lastWrite[key] = version
+			ws.keys = append(ws.keys, key)
+		}
+	}
+	db.history = append(db.history, ws)
+}
+
+// Update runs fn in a Serializable Tx and commits it, fn is run again from
+// a new snapshot when the commit conflicts, up to MAX_CONFLICT_RETRIES times.
+// The Tx is rolled back if fn returns an error.
+// The retry begins once the conflicting commit is visible, otherwise the
+// new snapshot would conflict again.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	var err error
+	for i := 0; i < MAX_CONFLICT_RETRIES; i++ {
+		var tx *Tx
+		if tx, err = db.BeginTx(TxOptions{Writable: true}); err != nil {
+			return err
+		}
+		if err = fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) {
+			return err
+		}
+		if db.opts.syncPolicy == SyncAlways {
+			if err := db.waitDurable(conflict.Version); err != nil {
+				return err
+			}
+		}
+	}
+	return err
+}
+
+// View runs fn in a read-only Tx.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(tx)
+}
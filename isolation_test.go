@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func beginTest(t testing.TB, db *DB, isolation Isolation) *Tx {
+	t.Helper()
+	tx, err := db.BeginTx(TxOptions{Writable: true, Isolation: isolation})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tx.Rollback() })
+	return tx
+}
+
+func TestIsolationLostUpdate(t *testing.T) {
+	for _, level := range []Isolation{SnapshotIsolation, Serializable} {
+		t.Run(level.String(), func(t *testing.T) {
+			db := openTest(t)
+			mustSet(t, db, "x", "1")
+			a, b := beginTest(t, db, level), beginTest(t, db, level)
+			a.Set([]byte("x"), []byte("2"))
+			b.Set([]byte("x"), []byte("3"))
+			if err := a.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Commit(); !errors.Is(err, ErrConflict) {
+				t.Fatalf("second writer of x: %v, want ErrConflict", err)
+			}
+			wantValue(t, db, "x", []byte("2"))
+		})
+	}
+}
+
+// a and b read x and y and each write one of them
+func writeSkew(t *testing.T, level Isolation) error {
+	db := openTest(t)
+	mustSet(t, db, "x", "1")
+	mustSet(t, db, "y", "1")
+	a, b := beginTest(t, db, level), beginTest(t, db, level)
+	for _, tx := range []*Tx{a, b} {
+		tx.Get([]byte("x"))
+		tx.Get([]byte("y"))
+	}
+	a.Set([]byte("x"), []byte("0"))
+	b.Set([]byte("y"), []byte("0"))
+	if err := a.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Commit()
+}
+
+func TestIsolationWriteSkew(t *testing.T) {
+	if err := writeSkew(t, SnapshotIsolation); err != nil {
+		t.Fatalf("snapshot isolation allows write skew: %v", err)
+	}
+	if err := writeSkew(t, Serializable); !errors.Is(err, ErrConflict) {
+		t.Fatalf("serializable: %v, want ErrConflict", err)
+	}
+}
+
+func TestIsolationReads(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "x", "1")
+	tx := beginTest(t, db, SnapshotIsolation)
+	mustSet(t, db, "x", "2")
+	if v, _, _ := tx.Get([]byte("x")); string(v) != "1" {
+		t.Fatalf("read %q, not the snapshot", v)
+	}
+	tx.Set([]byte("z"), []byte("1"))
+	sp, _ := tx.Savepoint()
+	tx.Del([]byte("x"))
+	if _, ok, _ := tx.Get([]byte("x")); ok {
+		t.Fatal("own delete not seen")
+	}
+	tx.RollbackTo(sp)
+	if v, _, _ := tx.Get([]byte("x")); string(v) != "1" {
+		t.Fatalf("read %q after the rollback to a savepoint", v)
+	}
+	// x was only read
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wantValue(t, db, "z", []byte("1"))
+	wantValue(t, db, "x", []byte("2"))
+}
+
+func TestConflictError(t *testing.T) {
+	db := openTest(t)
+	tx := beginTest(t, db, Serializable)
+	tx.Get([]byte("n"))
+	tx.Set([]byte("q"), []byte("1"))
+	mustSet(t, db, "n", "1")
+	var conflict *ConflictError
+	if err := tx.Commit(); !errors.As(err, &conflict) {
+		t.Fatalf("commit: %v, want a ConflictError", err)
+	}
+	if string(conflict.Key) != "n" || conflict.Version <= tx.Version() {
+		t.Fatalf("conflict on %q at version %d, the Tx read version %d", conflict.Key, conflict.Version, tx.Version())
+	}
+	wantValue(t, db, "q", nil)
+}
+
+// concurrent increments retried by Update lose none
+func TestUpdateRetry(t *testing.T) {
+	db := openTest(t)
+	const writers, increments = 8, 50
+	var wg sync.WaitGroup
+	var done atomic.Int64
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				err := db.Update(func(tx *Tx) error {
+					v, _, err := tx.Get([]byte("n"))
+					if err != nil {
+						return err
+					}
+					n, _ := strconv.Atoi(string(v))
+					runtime.Gosched() // let the others commit meanwhile
+					return tx.Set([]byte("n"), []byte(strconv.Itoa(n+1)))
+				})
+				if err == nil {
+					done.Add(1)
+				} else if !errors.Is(err, ErrConflict) {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	v, _, _ := db.Get([]byte("n"))
+	if n, _ := strconv.Atoi(string(v)); int64(n) != done.Load() || n == 0 {
+		t.Fatalf("counter at %d after %d increments", n, done.Load())
+	}
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// Key providers: the engine handles no secret itself, the encryption key
+// of a file comes from the KeyProvider of WithKeyProvider at Open: a
+// static key, the hex of an environment variable, a key file, or a
+// KeyFunc asking a KMS like AWS KMS or Vault, by the id of the file. The
+// key is kept in memory until Close only.
+
+// KeyProvider gives the encryption key of a file at Open, 16, 24 or 32
+// bytes. The id is that of the file, new if it's being created.
+type KeyProvider interface {
+	EncryptionKey(id DBID) ([]byte, error)
+}
+
+// KeyFunc is a KeyProvider calling a function, the client of a KMS
+// unwrapping the key of the file for instance.
+type KeyFunc func(id DBID) ([]byte, error)
+
+func (f KeyFunc) EncryptionKey(id DBID) ([]byte, error) {
+	return f(id)
+}
+
+// WithKeyProvider encrypts the file with the key of p, see
+// WithEncryptionKey.
+func WithKeyProvider(p KeyProvider) Option {
+	return func(db *DB) {
+		db.opts.keys = p
+	}
+}
+
+// StaticKey provides the same key for every file.
+func StaticKey(key []byte) KeyProvider {
+	key = append([]byte(nil), key...)
+	return KeyFunc(func(DBID) ([]byte, error) {
+		return key, nil
+	})
+}
+
+// EnvKey provides the key in hex of an environment variable, read at
+// each Open.
+func EnvKey(name string) KeyProvider {
+	return KeyFunc(func(DBID) ([]byte, error) {
+		h, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("%s isn't set", name)
+		}
+		key, err := hex.DecodeString(h)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return key, nil
+	})
+}
+
+// FileKey provides the key of a file, in hex or its raw bytes, read at
+// each Open.
+func FileKey(path string) KeyProvider {
+	return KeyFunc(func(DBID) ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("key file: %w", err)
+		}
+		if key, err := hex.DecodeString(string(bytes.TrimSpace(data))); err == nil && checkKeySize(key) == nil {
+			return key, nil
+		}
+		return data, nil
+	})
+}
+
+// the cipher of the key of the provider, none without one
+func (db *DB) loadKey(id DBID) error {
+	if db.opts.keys == nil {
+		return nil
+	}
+	key, err := db.opts.keys.EncryptionKey(id)
+	if err != nil {
+		return fmt.Errorf("encryption key: %w", err)
+	}
+	if err := checkKeySize(key); err != nil {
+		return err
+	}
+	db.cipher, err = newPageCipher(key)
+	return err
+}
+
+func checkKeySize(key []byte) error {
+	if n := len(key); n != 16 && n != 24 && n != 32 {
+		return fmt.Errorf("encryption key of %d bytes, not 16, 24 or 32", n)
+	}
+	return nil
+}
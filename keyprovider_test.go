@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyProvider(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	key := keyTest(9)
+	var ids []DBID
+	kms := KeyFunc(func(id DBID) ([]byte, error) {
+		ids = append(ids, id)
+		return key, nil
+	})
+	db := openTestPath(t, path, WithKeyProvider(kms))
+	mustSet(t, db, "a", "b")
+	if info := db.Info(); !info.Encrypted || len(ids) != 1 || ids[0] != info.ID {
+		t.Fatalf("key asked for %v, the file is %s", ids, info.ID)
+	}
+	db = reopenTest(t, db, WithKeyProvider(kms))
+	if len(ids) != 2 || ids[1] != db.Info().ID {
+		t.Fatalf("key asked for %v at reopening", ids)
+	}
+	db.Close()
+
+	// the same key from the environment, a key file in hex or raw
+	t.Setenv("KEY_TEST", hex.EncodeToString(key))
+	hexFile, rawFile := filepath.Join(dir, "key.hex"), filepath.Join(dir, "key")
+	os.WriteFile(hexFile, []byte(hex.EncodeToString(key)+"\n"), 0o600)
+	os.WriteFile(rawFile, key, 0o600)
+	for name, p := range map[string]KeyProvider{"env": EnvKey("KEY_TEST"), "hex file": FileKey(hexFile), "raw file": FileKey(rawFile), "static": StaticKey(key)} {
+		db, err := Open(path, WithKeyProvider(p))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		wantValue(t, db, "a", []byte("b"))
+		db.Close()
+	}
+
+	t.Setenv("KEY_BAD_TEST", "not hex")
+	for name, c := range map[string]struct {
+		p   KeyProvider
+		err string
+	}{
+		"unset":    {EnvKey("KEY_UNSET_TEST"), "KEY_UNSET_TEST isn't set"},
+		"not hex":  {EnvKey("KEY_BAD_TEST"), "KEY_BAD_TEST"},
+		"no file":  {FileKey(filepath.Join(dir, "missing")), "key file"},
+		"kms down": {KeyFunc(func(DBID) ([]byte, error) { return nil, errors.New("kms down") }), "kms down"},
+		"short":    {StaticKey([]byte("short")), "5 bytes"},
+	} {
+		if db, err := Open(path, WithKeyProvider(c.p)); err == nil || !strings.Contains(err.Error(), c.err) {
+			if db != nil {
+				db.Close()
+			}
+			t.Errorf("%s: %v, want %s", name, err, c.err)
+		}
+	}
+	if db, err := Open(path, WithKeyProvider(StaticKey(bytes.Repeat([]byte{1}, 16)))); !errors.Is(err, ErrEncryptionKey) {
+		if db != nil {
+			db.Close()
+		}
+		t.Fatalf("open with another key: %v", err)
+	}
+	// an empty key doesn't encrypt
+	if db := openTest(t, WithEncryptionKey(nil)); db.Info().Encrypted {
+		t.Fatal("encrypted without a key")
+	}
+}
+
+// the key of a provider is copied
+func TestStaticKey(t *testing.T) {
+	key := keyTest(1)
+	p := StaticKey(key)
+	key[0] = 2
+	if got, _ := p.EncryptionKey(DBID{}); !bytes.Equal(got, keyTest(1)) {
+		t.Fatalf("key %x", got)
+	}
+}
@@ -0,0 +1,10 @@
+// Package kvpb holds the messages and the client and server stubs of the KV
+// service of kv.proto, generated with protoc-gen-go and protoc-gen-go-grpc:
+// go generate writes kv.pb.go and kv_grpc.pb.go, which need the protobuf
+// and grpc-go modules. Like storage.KVServer, the server on a DB, they are
+// built with the grpc tag only, which go generate adds to them, so the
+// module needs neither without it.
+package kvpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kv.proto
+//go:generate sed -i -e "1i //go:build grpc\n" kv.pb.go kv_grpc.pb.go
@@ -0,0 +1,68 @@
+//go:build leveldb
+
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ImportLevelDB loads the keys of a LevelDB database, the directory of
+// goleveldb or of the C++ library, in key order from a snapshot: they're
+// set outside buckets, over those of the DB. It's built with the leveldb
+// tag after go get of goleveldb. The database is opened read-only, and
+// fails if another process has it open.
+//
+// progress, if not nil, is called every IMPORT_PROGRESS_KEYS keys and at
+// the end, whose counts are returned; the bytes read are estimated by
+// LevelDB from its tables, of the size of the tables, without the keys of
+// its log. It goes at WithImportRate at most. A failed import leaves the
+// batches committed.
+func (db *DB) ImportLevelDB(ctx context.Context, dir string, progress func(ImportProgress)) (p ImportProgress, err error) {
+	ldb, err := leveldb.OpenFile(dir, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return p, err
+	}
+	defer ldb.Close()
+	var size int64
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, e := range entries {
+			ext := filepath.Ext(e.Name())
+			if fi, err := e.Info(); err == nil && (ext == ".ldb" || ext == ".sst") {
+				size += fi.Size()
+			}
+		}
+	}
+	ctx, span := db.startSpan(ctx, "storage_engine.import")
+	defer func() { endSpan(span, err) }()
+	span.set("import.source", "leveldb")
+	it := ldb.NewIterator(nil, nil)
+	defer it.Release()
+	read := func() int64 {
+		if !it.Valid() {
+			return size
+		}
+		sizes, err := ldb.SizeOf([]util.Range{{Limit: it.Key()}})
+		if err != nil {
+			return 0
+		}
+		return sizes.Sum()
+	}
+	im := db.newImporter(ctx, size, read, progress)
+	for it.Next() {
+		if err = im.set(nil, it.Key(), it.Value()); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = it.Error()
+	}
+	p, err = im.close(err)
+	span.set("import.keys", p.Keys)
+	return p, err
+}
@@ -0,0 +1,54 @@
+//go:build leveldb
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestImportLevelDB(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "leveldb")
+	ldb, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30000; i++ {
+		ldb.Put([]byte(fmt.Sprintf("k%05d", i)), []byte(fmt.Sprint(i)), nil)
+	}
+	ldb.CompactRange(struct{ Start, Limit []byte }{})
+	// in the log only
+	ldb.Put([]byte("last"), []byte("x"), nil)
+	ldb.Delete([]byte("k00000"), nil)
+	ldb.Close()
+
+	db := openTest(t)
+	var reports []ImportProgress
+	p, err := db.ImportLevelDB(context.Background(), dir, func(p ImportProgress) { reports = append(reports, p) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Keys != 30000 || p.Size == 0 || p.Read != p.Size || len(reports) != 4 {
+		t.Fatalf("progress %+v, %d reports", p, len(reports))
+	}
+	if r := reports[1]; r.Read == 0 || r.Read > p.Size {
+		t.Fatalf("report %+v of a source of %d bytes", r, p.Size)
+	}
+	wantValue(t, db, "k12345", []byte("12345"))
+	wantValue(t, db, "last", []byte("x"))
+	wantValue(t, db, "k00000", nil)
+
+	if _, err := db.ImportLevelDB(context.Background(), filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Fatal("import of a missing database")
+	}
+	// the database of a process holding it
+	ldb, _ = leveldb.OpenFile(dir, nil)
+	defer ldb.Close()
+	if _, err := db.ImportLevelDB(context.Background(), dir, nil); err == nil {
+		t.Fatal("import of a database held by another")
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const LOADER_BATCH = 4 << 20 // bytes of keys and values per Tx of a Loader
+
+// Loader writes many keys with few commits, for imports: they're in Txs of
+// LOADER_BATCH bytes committed as they fill up. A failed Loader stops, the
+// batches committed stay. Not safe for concurrent use.
+type Loader struct {
+	db     *DB
+	ctx    context.Context
+	tx     *Tx
+	bucket struct {
+		path [][]byte // of b, nil for the keys of the Tx
+		b    *Bucket
+	}
+	size int // of the batch
+	keys int64
+	err  error
+}
+
+// NewLoader returns a Loader whose Txs are begun with ctx, see BeginContext.
+func (db *DB) NewLoader(ctx context.Context) *Loader {
+	return &Loader{db: db, ctx: ctx}
+}
+
+// Set sets a key of the bucket at the path, the names from the top, nil
+// for the keys outside buckets. Those missing are created.
+func (l *Loader) Set(path [][]byte, key []byte, value []byte) error {
+	return l.SetWithExpiry(path, key, value, time.Time{})
+}
+
+// SetWithExpiry is Set with a deadline, see Tx.SetWithExpiry: only the keys
+// outside buckets can expire.
+func (l *Loader) SetWithExpiry(path [][]byte, key []byte, value []byte, at time.Time) error {
+	if err := l.begin(); err != nil {
+		return err
+	}
+	var err error
+	switch {
+	case len(path) > 0 && !at.IsZero():
+		err = ErrBucketTx
+	case len(path) > 0:
+		var b *Bucket
+		if b, err = l.openBucket(path); err == nil {
+			err = b.Set(key, value)
+		}
+	case at.IsZero():
+		err = l.tx.Set(key, value)
+	default:
+		err = l.tx.SetWithExpiry(key, value, at)
+	}
+	if err != nil {
+		return l.fail(err)
+	}
+	l.keys++
+	l.size += len(key) + len(value)
+	if l.size >= LOADER_BATCH {
+		return l.Flush()
+	}
+	return nil
+}
+
+// CreateBucket creates the bucket at the path and those above if missing.
+func (l *Loader) CreateBucket(path [][]byte) error {
+	if err := l.begin(); err != nil {
+		return err
+	}
+	if _, err := l.openBucket(path); err != nil {
+		return l.fail(err)
+	}
+	return nil
+}
+
+// Keys is the number of keys set so far, committed or not.
+func (l *Loader) Keys() int64 {
+	return l.keys
+}
+
+// Flush commits the keys set so far.
+func (l *Loader) Flush() error {
+	if l.err != nil || l.tx == nil {
+		return l.err
+	}
+	tx := l.tx
+	l.tx, l.bucket.b, l.bucket.path, l.size = nil, nil, nil, 0
+	if err := tx.Commit(); err != nil {
+		return l.fail(err)
+	}
+	return nil
+}
+
+// Close flushes the Loader, which can't be used anymore.
+func (l *Loader) Close() error {
+	err := l.Flush()
+	if l.err == nil {
+		l.err = ErrTxClosed
+	}
+	return err
+}
+
+func (l *Loader) begin() error {
+	if l.err != nil || l.tx != nil {
+		return l.err
+	}
+	tx, err := l.db.BeginContext(l.ctx, true)
+	if err != nil {
+		return l.fail(err)
+	}
+	l.tx = tx
+	return nil
+}
+
+func (l *Loader) fail(err error) error {
+	if l.tx != nil {
+		l.tx.Rollback()
+		l.tx = nil
+	}
+	l.err = err
+	return err
+}
+
+// the bucket at the path, created if missing; the last one is kept since
+// keys come by bucket
+func (l *Loader) openBucket(path [][]byte) (*Bucket, error) {
+	if l.bucket.b != nil && samePath(l.bucket.path, path) {
+		return l.bucket.b, nil
+	}
+	var b *Bucket
+	for i, name := range path {
+		open, create := l.tx.Bucket, l.tx.CreateBucket
+		if i > 0 {
+			open, create = b.Bucket, b.CreateBucket
+		}
+		next, err := open(name)
+		if errors.Is(err, ErrBucketNotFound) {
+			next, err = create(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		b = next
+	}
+	l.bucket.path, l.bucket.b = copyPath(path), b
+	return b, nil
+}
+
+func samePath(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if string(a[i]) != string(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func copyPath(path [][]byte) [][]byte {
+	cp := make([][]byte, len(path))
+	for i, name := range path {
+		cp[i] = append([]byte(nil), name...)
+	}
+	return cp
+}
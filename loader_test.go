@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoader(t *testing.T) {
+	db := openTest(t)
+	l := db.NewLoader(context.Background())
+	value := make([]byte, 1000)
+	users := [][]byte{[]byte("users")}
+	inner := [][]byte{[]byte("users"), []byte("inner")}
+	for i := 0; i < 10000; i++ {
+		path := [][][]byte{nil, users, inner}[i%3]
+		if err := l.Set(path, []byte(fmt.Sprintf("k%05d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.SetWithExpiry(nil, []byte("t"), value, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetWithExpiry(users, []byte("t"), value, time.Now().Add(time.Hour)); !errors.Is(err, ErrBucketTx) {
+		t.Fatalf("expiring key in a bucket: %v", err)
+	}
+	// failed, what's committed stays
+	if err := l.Set(nil, []byte("after"), nil); !errors.Is(err, ErrBucketTx) {
+		t.Fatalf("set after a failure: %v", err)
+	}
+	commits := db.Stats().Commits
+	if commits < 10000*1000/LOADER_BATCH || commits > 10000*1000/LOADER_BATCH+1 {
+		t.Fatalf("%d commits of %d bytes", commits, LOADER_BATCH)
+	}
+	if l.Keys() != 10001 {
+		t.Fatalf("%d keys set", l.Keys())
+	}
+	l.Close()
+
+	l = db.NewLoader(context.Background())
+	l.Set(nil, []byte("k00000"), []byte("v"))
+	l.Set(users, []byte("k00001"), []byte("v"))
+	l.CreateBucket([][]byte{[]byte("empty")})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set(nil, []byte("a"), nil); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("set after close: %v", err)
+	}
+	wantValue(t, db, "k00000", []byte("v"))
+	wantValue(t, db, "k00003", value)
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	if got := fmt.Sprintf("%q", listBuckets(tx, nil)); got != `["empty" "users"]` {
+		t.Fatalf("buckets %s", got)
+	}
+	b, _ := tx.Bucket([]byte("users"))
+	if v, _, _ := b.Get([]byte("k00001")); string(v) != "v" {
+		t.Fatalf("k00001 of users %q", v)
+	}
+	b, _ = b.Bucket([]byte("inner"))
+	if v, _, _ := b.Get([]byte("k00002")); len(v) != len(value) {
+		t.Fatalf("k00002 of inner %q", v)
+	}
+}
+
+func TestLoaderContext(t *testing.T) {
+	db := openTest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	l := db.NewLoader(ctx)
+	l.Set(nil, []byte("a"), []byte("1"))
+	l.Flush()
+	cancel()
+	l.Set(nil, []byte("b"), []byte("1"))
+	if err := l.Close(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("close after the cancel: %v", err)
+	}
+	wantValue(t, db, "a", []byte("1"))
+	wantValue(t, db, "b", nil)
+}
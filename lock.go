@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrDeadlock = errors.New("lock would deadlock")
+
+// DeadlockError is returned by Lock when waiting for the key would close a
+// cycle of transactions waiting for each other. The Tx should be rolled back
+// so that the others can go on, it can then be retried.
+type DeadlockError struct {
+	Key []byte // start of the range requested
+}
+
+func (e *DeadlockError) Error() string {
+	return fmt.Sprintf("%v: key %q", ErrDeadlock, e.Key)
+}
+
+func (e *DeadlockError) Unwrap() error {
+	return ErrDeadlock
+}
+
+// keys in [start, end), or [start, end] if inclusive, a nil end is the end
+// of the key space. The ranges follow the key order of the tree.
+type keyRange struct {
+	start     []byte
+	end       []byte
+	inclusive bool
+}
+
+func (r keyRange) beforeEnd(key []byte, cmp func(a, b []byte) int) bool {
+	if r.end == nil {
+		return true
+	}
+	c := cmp(key, r.end)
+	return c < 0 || c == 0 && r.inclusive
+}
+
+func (r keyRange) overlaps(o keyRange, cmp func(a, b []byte) int) bool {
+	return o.beforeEnd(r.start, cmp) && r.beforeEnd(o.start, cmp)
+}
+
+func (r keyRange) contains(key []byte, cmp func(a, b []byte) int) bool {
+	return cmp(r.start, key) <= 0 && r.beforeEnd(key, cmp)
+}
+
+type heldLock struct {
+	tx *Tx
+	keyRange
+}
+
+// lockTable holds the key locks of the open transactions. Locks are
+// exclusive and kept until the Tx ends.
+type lockTable struct {
+	mu       sync.Mutex
+	released *sync.Cond // signaled when a Tx releases its locks
+	held     []heldLock
+	waiting  map[*Tx]keyRange // the range each blocked Tx waits for
+}
+
+// the transactions holding a lock that overlaps the range, except tx
+func (lt *lockTable) blockers(tx *Tx, r keyRange) []*Tx {
+	var out []*Tx
+	for _, l := range lt.held {
+		if l.tx != tx && l.overlaps(r, tx.tree.compare) {
+			out = append(out, l.tx)
+		}
+	}
+	return out
+}
+
+// whether tx is reachable from the given transactions in the wait-for graph
+func (lt *lockTable) reaches(from []*Tx, tx *Tx, seen map[*Tx]bool) bool {
+	for _, t := range from {
+		if t == tx {
+			return true
+		}
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		if r, ok := lt.waiting[t]; ok && lt.reaches(lt.blockers(t, r), tx, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+func (lt *lockTable) lock(tx *Tx, r keyRange) error {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	for {
+		blockers := lt.blockers(tx, r)
+		if len(blockers) == 0 {
+			break
+		}
+		if lt.reaches(blockers, tx, map[*Tx]bool{}) {
+			return &DeadlockError{Key: r.start}
+		}
+		lt.waiting[tx] = r
+		lt.released.Wait()
+		delete(lt.waiting, tx)
+	}
+	lt.held = append(lt.held, heldLock{tx: tx, keyRange: r})
+	return nil
+}
+
+func (lt *lockTable) release(tx *Tx) {
+	lt.mu.Lock()
+	n := 0
+	for _, l := range lt.held {
+		if l.tx != tx {
+			lt.held[n] = l
+			n++
+		}
+	}
+	clear(lt.held[n:])
+	lt.held = lt.held[:n]
+	lt.released.Broadcast()
+	lt.mu.Unlock()
+}
+
+// Lock takes an exclusive lock on the key, see LockRange.
+func (tx *Tx) Lock(key []byte) error {
+	key = append([]byte(nil), key...)
+	return tx.lockRange(keyRange{start: key, end: key, inclusive: true})
+}
+
+// LockRange takes an exclusive lock on the keys in [start, end), a nil end
+// locks every key from start on. It blocks while another Tx holds a lock
+// overlapping the range, all locks are released when the Tx ends.
+// A deadlock fails the Tx that would close the cycle with a DeadlockError.
+//
+// Locks serialize the optimistic transactions of BeginTx over hot keys
+// instead of retrying them on conflict: a Tx that locks before its first Get
+// or update moves to the latest commit, which includes those of the previous
+// holders. Locks are advisory, only other calls to Lock wait for them.
+// A Tx from Begin(true) already runs alone among those, Lock is a no-op.
+func (tx *Tx) LockRange(start, end []byte) error {
+	r := keyRange{start: append([]byte(nil), start...)}
+	if end != nil {
+		r.end = append([]byte(nil), end...)
+	}
+	return tx.lockRange(r)
+}
+
+func (tx *Tx) lockRange(r keyRange) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if !tx.optimistic {
+		return nil
+	}
+	db := tx.db
+	if err := db.locks.lock(tx, r); err != nil {
+		return err
+	}
+	tx.locked = true
+	if !tx.touched {
+		s := db.pinSnapshot()
+		db.unpinSnapshot(tx.snap)
+		tx.snap, tx.version, tx.tree.root = s, s.version, s.root
+		tx.catalog.root = s.catalog
+	}
+	return nil
+}
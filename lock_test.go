@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// increments locking the key first never conflict
+func TestLockCounter(t *testing.T) {
+	db := openTest(t)
+	const writers, increments = 8, 25
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				tx, _ := db.BeginTx(TxOptions{Writable: true})
+				if err := tx.Lock([]byte("n")); err != nil {
+					t.Error(err)
+					tx.Rollback()
+					return
+				}
+				v, _, _ := tx.Get([]byte("n"))
+				n, _ := strconv.Atoi(string(v))
+				tx.Set([]byte("n"), []byte(strconv.Itoa(n+1)))
+				if err := tx.Commit(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	wantValue(t, db, "n", []byte(strconv.Itoa(writers*increments)))
+}
+
+func TestLockDeadlock(t *testing.T) {
+	db := openTest(t)
+	a := beginTest(t, db, Serializable)
+	b := beginTest(t, db, Serializable)
+	if err := a.Lock([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Lock([]byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan error)
+	go func() { locked <- b.Lock([]byte("x")) }()
+	waitLockWaiters(t, db, 1)
+	var deadlock *DeadlockError
+	if err := a.Lock([]byte("y")); !errors.As(err, &deadlock) || !bytes.Equal(deadlock.Key, []byte("y")) {
+		t.Fatalf("lock closing a cycle: %v", err)
+	}
+	a.Rollback()
+	if err := <-locked; err != nil {
+		t.Fatalf("lock after the other Tx rolled back: %v", err)
+	}
+}
+
+func TestLockRange(t *testing.T) {
+	db := openTest(t)
+	a := beginTest(t, db, Serializable)
+	if err := a.LockRange([]byte("b"), []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	b := beginTest(t, db, Serializable)
+	if err := b.Lock([]byte("d")); err != nil {
+		t.Fatalf("lock past the end of the range: %v", err)
+	}
+	if err := b.Lock([]byte("a")); err != nil {
+		t.Fatalf("lock before the range: %v", err)
+	}
+	locked := make(chan error)
+	go func() { locked <- b.Lock([]byte("c")) }()
+	waitLockWaiters(t, db, 1)
+	select {
+	case err := <-locked:
+		t.Fatalf("lock in the range held: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err := a.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockBegin(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	if err := tx.Lock([]byte("x")); err != nil {
+		t.Fatalf("lock in a Tx holding the writer lock: %v", err)
+	}
+	r, _ := db.Begin(false)
+	defer r.Rollback()
+	if err := r.Lock([]byte("x")); !errors.Is(err, ErrTxNotWritable) {
+		t.Fatalf("lock in a read-only Tx: %v", err)
+	}
+}
+
+// wait until n transactions are blocked in Lock
+func waitLockWaiters(t testing.TB, db *DB, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		db.locks.mu.Lock()
+		waiting := len(db.locks.waiting)
+		db.locks.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d transactions waiting for a lock, want %d", waiting, n)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package storage
+
+import "log/slog"
+
+// Logger receives the operational events of the DB: recovery, checkpoints,
+// failed I/O and corruption. The args are key-value pairs like those of
+// slog, a *slog.Logger is a Logger.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+var _ Logger = (*slog.Logger)(nil)
+
+// the Logger of a DB opened without WithLogger
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// WithLogger sends the events of the DB to l, they're dropped by default.
+func WithLogger(l Logger) Option {
+	return func(db *DB) {
+		db.opts.logger = l
+	}
+}
+
+// WithSlog sends the events of the DB to a slog handler, with the path of
+// the database on each record.
+func WithSlog(h slog.Handler) Option {
+	return func(db *DB) {
+		db.opts.logger = slog.New(h).With("db", db.Path)
+	}
+}
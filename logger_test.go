@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a Logger recording the messages, for the tests
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) log(level, msg string, args []any) {
+	l.lines = append(l.lines, fmt.Sprint(level, " ", msg, args))
+}
+
+func (l *testLogger) Debug(msg string, args ...any) { l.log("DEBUG", msg, args) }
+func (l *testLogger) Info(msg string, args ...any)  { l.log("INFO", msg, args) }
+func (l *testLogger) Warn(msg string, args ...any)  { l.log("WARN", msg, args) }
+func (l *testLogger) Error(msg string, args ...any) { l.log("ERROR", msg, args) }
+
+func (l *testLogger) find(prefix string) string {
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestLogger(t *testing.T) {
+	db := openTest(t, WithCheckpointSize(1<<40))
+	mustSet(t, db, "a", "b")
+	mustSet(t, db, "c", "d")
+	crashTest(db)
+	var log testLogger
+	db = openTestPath(t, db.Path, WithLogger(&log))
+	if line := log.find("INFO recovered commits from the WAL"); !strings.Contains(line, "commits 2") {
+		t.Fatalf("recovery logged %q", log.lines)
+	}
+	db.Checkpoint()
+	if log.find("INFO checkpoint") == "" {
+		t.Fatalf("checkpoint not logged %q", log.lines)
+	}
+}
+
+func TestSlog(t *testing.T) {
+	var buf bytes.Buffer
+	db := openTest(t, WithSlog(slog.NewTextHandler(&buf, nil)))
+	mustSet(t, db, "a", "b")
+	db.Checkpoint()
+	if out := buf.String(); !strings.Contains(out, "msg=checkpoint") || !strings.Contains(out, "db="+db.Path) {
+		t.Fatalf("logged %s", out)
+	}
+}
+
+func TestSlowThreshold(t *testing.T) {
+	for _, threshold := range []time.Duration{0, time.Nanosecond} {
+		var log testLogger
+		db := openTest(t, WithLogger(&log), WithSlowThreshold(threshold))
+		tx, _ := db.Begin(true)
+		for i := 0; i < 1000; i++ {
+			tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v"))
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		tx, _ = db.Begin(false)
+		c := tx.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		}
+		tx.Rollback()
+		db.Checkpoint()
+		for _, slow := range []string{"WARN slow commit", "WARN slow scan", "WARN slow checkpoint"} {
+			if line := log.find(slow); (line != "") != (threshold > 0) {
+				t.Fatalf("threshold %v: %q logged %q", threshold, slow, line)
+			}
+		}
+		if threshold > 0 && !strings.Contains(log.find("WARN slow commit"), "ops 1000") {
+			t.Fatalf("slow commit logged %q", log.find("WARN slow commit"))
+		}
+		if threshold > 0 && !strings.Contains(log.find("WARN slow scan"), "keys 1000") {
+			t.Fatalf("slow scan logged %q", log.find("WARN slow scan"))
+		}
+	}
+}
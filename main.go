@@ -1,23 +1,41 @@
-package main
+// Package storage is a key-value store in a single file: a copy-on-write
+// B+tree of pages with a write-ahead log, transactions and buckets. See
+// cmd/storagectl for a command line tool on its files.
+package storage
 
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/bits"
 	"math/rand"
 	"os"
+	"runtime/debug"
+	"sync"
+	"unsafe"
 )
 
 const (
 	BNODE_NODE = 1
 	BNODE_LEAF = 2
 
-	HEADER               = 4
-	BTREE_PAGE_SIZE      = 4096
+	HEADER          = 4
+	BTREE_PAGE_SIZE = 4096 // the default page size
+	MIN_PAGE_SIZE   = 1024
+	MAX_PAGE_SIZE   = 16384 // nodes being split span 2 pages, offsets are 16 bits
+	// the limits for the default page size, they scale with it
 	BTREE_MAX_KEY_SIZE   = 1000
 	BTREE_MAX_VALUE_SIZE = 3000
 )
 
+var (
+	ErrCorrupt       = errors.New("database is corrupt")
+	ErrEmptyKey      = errors.New("empty keys are reserved for the sentinel")
+	ErrKeyTooLarge   = errors.New("key is too large")
+	ErrValueTooLarge = errors.New("value is too large")
+)
+
 type BNode struct {
 	data []byte
 }
@@ -29,6 +47,47 @@ type BTree struct {
 	get func(uint64) BNode // dereference a Page pointer to BNode
 	new func(BNode) uint64 //allocate a new page
 	del func(uint64)       //deallocate a new page
+	// buffers of the pages built, allocated one by one if nil
+	arena *arena
+	size  int                   // page size, BTREE_PAGE_SIZE if 0
+	cmp   func(a, b []byte) int // key order, bytes.Compare if nil
+	usage *treeUsage            // counts the keys updated, nil if not tracked
+}
+
+func (tree *BTree) pageSize() int {
+	if tree.size == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return tree.size
+}
+
+// the order of the keys, the empty sentinel key is always the first
+func (tree *BTree) compare(a, b []byte) int {
+	if tree.cmp == nil || len(a) == 0 || len(b) == 0 {
+		return bytes.Compare(a, b)
+	}
+	return tree.cmp(a, b)
+}
+
+func validPageSize(size int) bool {
+	return size >= MIN_PAGE_SIZE && size <= MAX_PAGE_SIZE && size&(size-1) == 0
+}
+
+func maxKeySize(pageSize int) int {
+	return limitSize(pageSize) * BTREE_MAX_KEY_SIZE / BTREE_PAGE_SIZE
+}
+
+func maxValueSize(pageSize int) int {
+	return limitSize(pageSize) * BTREE_MAX_VALUE_SIZE / BTREE_PAGE_SIZE
+}
+
+// the limits of a node smaller than its page by the checksum are those of
+// the page, the largest key and value fit the node still
+func limitSize(size int) int {
+	if validPageSize(size + PAGE_CHECKSUM_LEN) {
+		return size + PAGE_CHECKSUM_LEN
+	}
+	return size
 }
 
 func init() {
@@ -38,6 +97,68 @@ func init() {
 	}
 }
 
+// The tree code stops at the first inconsistency, a corrupt page or a failed
+// read, by panicking with a treeError. The BTree methods and the cursors
+// recover it and return the error. Built with the debug tag, the error
+// carries the stack of the panic.
+type treeError struct {
+	err error
+}
+
+func (e treeError) Error() string {
+	return e.err.Error()
+}
+
+func treeFail(err error) {
+	if DEBUG {
+		err = fmt.Errorf("%w\n\n%s", err, debug.Stack())
+	}
+	panic(treeError{err})
+}
+
+func corrupt(format string, args ...any) {
+	treeFail(fmt.Errorf("%w: "+format, append([]any{ErrCorrupt}, args...)...))
+}
+
+// recover a tree error into *err, deferred by the callers of the tree code
+func catchTreeError(err *error) {
+	if r := recover(); r != nil {
+		te, ok := r.(treeError)
+		if !ok {
+			panic(r)
+		}
+		*err = te.err
+	}
+}
+
+// check that a page read from the file is a node, so that a corrupt page is
+// reported instead of decoded out of bounds
+func checkNode(node BNode) error {
+	nodeType, nkeys := node.getNodeType(), node.getNumberOfKeys()
+	if nodeType != BNODE_NODE && nodeType != BNODE_LEAF {
+		return fmt.Errorf("%w: bad node type %d", ErrCorrupt, nodeType)
+	}
+	if nodeType == BNODE_NODE && nkeys == 0 {
+		return fmt.Errorf("%w: node without keys", ErrCorrupt)
+	}
+	if HEADER+10*int(nkeys) > len(node.data) {
+		return fmt.Errorf("%w: %d keys overflow the page", ErrCorrupt, nkeys)
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		pos := int(node.getKeyValuePosition(i))
+		end := int(HEADER + 10*nkeys + node.getOffset(i+1))
+		if pos+4 > end || end > len(node.data) {
+			return fmt.Errorf("%w: key %d overflows the page", ErrCorrupt, i)
+		}
+		klen := binary.LittleEndian.Uint16(node.data[pos:])
+		vlen := binary.LittleEndian.Uint16(node.data[pos+2:])
+		if pos+4+int(klen)+int(vlen) != end {
+			return fmt.Errorf("%w: bad length of key %d", ErrCorrupt, i)
+		}
+	}
+	return nil
+}
+
 // Methods to get stuff from our BNode byte array
 // Header
 func (bnode BNode) getNodeType() uint16 {
@@ -54,7 +175,7 @@ func (bnode BNode) setHeaders(nodeType uint16, numberOfKeys uint16) {
 // Pointer
 func (bnode BNode) getPointer(index uint16) uint64 {
 	if index >= bnode.getNumberOfKeys() {
-		panic("getPointer called with index greater than number of keys for the node")
+		corrupt("getPointer index %d of %d keys", index, bnode.getNumberOfKeys())
 	}
 	pos := HEADER + 8*index
 	return binary.LittleEndian.Uint64(bnode.data[pos:])
@@ -62,7 +183,7 @@ func (bnode BNode) getPointer(index uint16) uint64 {
 
 func (bnode BNode) setPointer(index uint16, value uint64) {
 	if index >= bnode.getNumberOfKeys() {
-		panic("setPointer called with index greater than number of keys for the node")
+		corrupt("setPointer index %d of %d keys", index, bnode.getNumberOfKeys())
 	}
 	pos := HEADER + 8*index
 	binary.LittleEndian.PutUint64(bnode.data[pos:], value)
@@ -71,7 +192,7 @@ func (bnode BNode) setPointer(index uint16, value uint64) {
 // offset list
 func offsetPosition(bnode BNode, index uint16) uint16 {
 	if index > bnode.getNumberOfKeys() || index < 1 {
-		panic("offsetPosition called with index greater than number of keys for the node or index is less than 1")
+		corrupt("offsetPosition index %d of %d keys", index, bnode.getNumberOfKeys())
 	}
 	return HEADER + 8*bnode.getNumberOfKeys() + (2 * (index - 1))
 }
@@ -90,12 +211,12 @@ func (bnode BNode) setOffset(index uint16, offset uint16) {
 // key-value list
 func (bnode BNode) getKeyValuePosition(index uint16) uint16 {
 	offset := bnode.getOffset(index)
-	return HEADER + 8*bnode.getNumberOfKeys() + (2*bnode.getNumberOfKeys() - 1) + offset
+	return HEADER + 8*bnode.getNumberOfKeys() + 2*bnode.getNumberOfKeys() + offset
 }
 
 func (bnode BNode) getKey(index uint16) []byte {
 	if index >= bnode.getNumberOfKeys() {
-		panic("getKey called with index greater than number of keys for the node")
+		corrupt("getKey index %d of %d keys", index, bnode.getNumberOfKeys())
 	}
 	kvPos := bnode.getKeyValuePosition(index)
 	keylen := binary.LittleEndian.Uint16(bnode.data[kvPos:])
@@ -104,7 +225,7 @@ func (bnode BNode) getKey(index uint16) []byte {
 
 func (bnode BNode) getValue(index uint16) []byte {
 	if index >= bnode.getNumberOfKeys() {
-		panic("getValue called with index greater than number of keys for the node")
+		corrupt("getValue index %d of %d keys", index, bnode.getNumberOfKeys())
 	}
 	kvPos := bnode.getKeyValuePosition(index)
 	keylen := binary.LittleEndian.Uint16(bnode.data[kvPos:])
@@ -118,13 +239,17 @@ func (bnode BNode) nbytes() uint16 {
 }
 
 // 8 6 4 1
-func nodeLookUp(node BNode, key []byte) uint16 {
+func nodeLookUp(tree *BTree, node BNode, key []byte) uint16 {
 	nKeys := uint16(node.getNumberOfKeys())
+	// increasing keys go to the last one, check it first
+	if nKeys > 1 && tree.compare(node.getKey(nKeys-1), key) <= 0 {
+		return nKeys - 1
+	}
 	var i uint16 = 1
 	var found uint16 = 0
 	for ; i < nKeys; i++ {
 		k := node.getKey(i)
-		c := bytes.Compare(k, key)
+		c := tree.compare(k, key)
 		if c <= 0 {
 			found = i
 		} else if c > 0 {
@@ -149,14 +274,15 @@ func leafUpdate(old BNode, new BNode, index uint16, key []byte, value []byte) {
 }
 
 // part of treeInsert(): KV insert to an internal node
-func nodeInsert(tree *BTree, new BNode, node BNode, index uint16, key []byte, value []byte) {
+func nodeInsert(tree *BTree, new BNode, node BNode, index uint16, key []byte, value []byte, update updateFunc, edge bool) {
 	nodePointer := node.getPointer(index)
 	child := tree.get(nodePointer)
 	tree.del(nodePointer)
-	child = treeInsert(tree, child, key, value)
+	edge = edge && index == node.getNumberOfKeys()-1
+	child = treeInsert(tree, child, key, value, update, edge)
 	//todo 4 nov 2023 - go from here
 	// split the result
-	nsplit, splited := nodeSplit3(child)
+	nsplit, splited := nodeSplit3(tree, child, appended(child, key, edge))
 	// update the kid links
 	nodeReplaceKidN(tree, new, node, index, splited[:nsplit]...)
 }
@@ -177,67 +303,502 @@ func nodeReplaceKidN(
 
 // split a bigger-than-allowed node into two.
 // the second node always fits on a page.
-func nodeSplit2(left BNode, right BNode, old BNode) {
-	// code omitted...
+// a packed split leaves the first node as full as possible.
+func nodeSplit2(tree *BTree, left BNode, right BNode, old BNode, packed bool) {
+	pageSize := uint16(tree.pageSize())
 	nKeys := uint16(old.getNumberOfKeys())
-	left.setHeaders(old.getNodeType(), nKeys/2)
-	bnodeAppendRange(left, old, 0, 0, nKeys/2)
-	bnodeAppendRange(right, old, 0, (nKeys/2)+1, nKeys)
+	if nKeys < 2 {
+		corrupt("nodeSplit2 on a node of %d keys", nKeys)
+	}
+	// start from the middle, then shift until the right half fits
+	nLeft := nKeys / 2
+	if packed {
+		nLeft = nKeys - 1
+	}
+	leftBytes := func() uint16 {
+		return HEADER + 8*nLeft + 2*nLeft + old.getOffset(nLeft)
+	}
+	for leftBytes() > pageSize {
+		nLeft--
+	}
+	rightBytes := func() uint16 {
+		return old.nbytes() - leftBytes() + HEADER
+	}
+	for rightBytes() > pageSize {
+		nLeft++
+	}
+	if nLeft < 1 || nLeft >= nKeys {
+		corrupt("nodeSplit2 found no split point")
+	}
+	nRight := nKeys - nLeft
+	left.setHeaders(old.getNodeType(), nLeft)
+	right.setHeaders(old.getNodeType(), nRight)
+	bnodeAppendRange(left, old, 0, 0, nLeft)
+	bnodeAppendRange(right, old, 0, nLeft, nRight)
 }
 
 // split a node if it's too big. the results are 1~3 nodes.
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old.data = old.data[:BTREE_PAGE_SIZE]
-		return 1, [3]BNode{old}
-	}
-	left := BNode{make([]byte, 2*BTREE_PAGE_SIZE)} // might be split later
-	right := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	nodeSplit2(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left.data = left.data[:BTREE_PAGE_SIZE]
-		return 2, [3]BNode{left, right}
+// old is a scratch node from treeInsert, it's recycled and the results are
+// new pages.
+func nodeSplit3(tree *BTree, old BNode, packed bool) (uint16, [3]BNode) {
+	defer freeScratch(old)
+	pageSize := uint16(tree.pageSize())
+	if old.nbytes() <= pageSize {
+		return 1, [3]BNode{pageCopy(tree, old)}
+	}
+	left := tree.newScratch() // might be split later
+	defer freeScratch(left)
+	right := tree.newPage()
+	nodeSplit2(tree, left, right, old, packed)
+	if left.nbytes() <= pageSize {
+		return 2, [3]BNode{pageCopy(tree, left), right}
 	}
 	// the left node is still too large
-	leftleft := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	nodeSplit2(leftleft, middle, left)
-	if leftleft.nbytes() > BTREE_PAGE_SIZE {
-		panic("leftleft.nbytes() > BTREE_PAGE_SIZE in nodesplit3")
+	leftleft := tree.newPage()
+	middle := tree.newPage()
+	nodeSplit2(tree, leftleft, middle, left, packed)
+	if leftleft.nbytes() > pageSize {
+		corrupt("nodeSplit3 left node of %d bytes", leftleft.nbytes())
 	}
 	return 3, [3]BNode{leftleft, middle, right}
 }
 
-// The main function to insert a key
-func treeInsert(tree *BTree, node BNode, key []byte, value []byte) BNode {
+// Nodes being built can be larger than a page until they're split, the
+// buffers for them are pooled since every insert needs one per level. There's
+// a pool per page size, of pointers to the buffers so that Put doesn't
+// allocate.
+var scratchPools [16]sync.Pool // by log2 of the size, 2*MAX_PAGE_SIZE at most
+
+// off to measure what the pools save, see BenchmarkInsert
+var poolScratch = true
+
+func (tree *BTree) newScratch() BNode {
+	size := 2 * tree.pageSize()
+	if p, ok := scratchPools[bits.TrailingZeros(uint(size))].Get().(*byte); ok {
+		return BNode{data: unsafe.Slice(p, size)}
+	}
+	return BNode{data: make([]byte, size)}
+}
+
+func freeScratch(node BNode) {
+	if poolScratch {
+		scratchPools[bits.TrailingZeros(uint(len(node.data)))].Put(&node.data[0])
+	}
+}
+
+// a new empty page
+func (tree *BTree) newPage() BNode {
+	return BNode{data: tree.arena.page(tree.pageSize())}
+}
+
+// copy a node that fits into a new page
+func pageCopy(tree *BTree, node BNode) BNode {
+	page := tree.newPage()
+	copy(page.data, node.data[:node.nbytes()])
+	return page
+}
+
+// Keys appended to the right edge of the tree, increasing keys like
+// timestamps or sequences, fill the nodes: they're split as full as
+// possible instead of in halves that would stay half empty. The node the
+// key was appended to ends with it, at every level since the node split
+// below it put the key alone in its last kid.
+func appended(node BNode, key []byte, edge bool) bool {
+	return edge && bytes.Equal(node.getKey(node.getNumberOfKeys()-1), key)
+}
+
+// computes the value of a key from its current one, see BTree.Update
+type updateFunc func(old []byte, ok bool) []byte
+
+// the value of update for the key at the index of the leaf
+func leafValue(tree *BTree, leaf BNode, index uint16, key []byte, found bool, update updateFunc) []byte {
+	var old []byte
+	if found {
+		// appending to it must not write into the page
+		old = leaf.getValue(index)
+		old = old[:len(old):len(old)]
+	}
+	value := update(old, found)
+	if err := tree.checkKeyValue(key, value); err != nil {
+		treeFail(err)
+	}
+	return value
+}
+
+// The main function to insert a key, edge is whether the node is the last
+// one of its level. The value is computed by update unless it's nil.
+func treeInsert(tree *BTree, node BNode, key []byte, value []byte, update updateFunc, edge bool) BNode {
 	// the result node.
 	// it's allowed to be bigger than 1 page and will be split if so
-	new := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	new := tree.newScratch()
 	// find where to insert the key
-	index := nodeLookUp(node, key)
+	index := nodeLookUp(tree, node, key)
 	//act depending on the node type
 	switch node.getNodeType() {
 	case BNODE_LEAF:
-		if bytes.Equal(key, node.getKey(index)) {
+		found := bytes.Equal(key, node.getKey(index))
+		if update != nil {
+			value = leafValue(tree, node, index, key, found, update)
+		}
+		if tree.usage != nil {
+			tree.usage.set(key, value, node.getValue(index), found)
+		}
+		if found {
 			leafUpdate(node, new, index, key, value)
 		} else {
 			leafInsert(node, new, index+1, key, value)
 		}
 	case BNODE_NODE:
-		nodeInsert(tree, new, node, index, key, value)
+		nodeInsert(tree, new, node, index, key, value, update, edge)
 	default:
-		panic("Bad node type!")
+		corrupt("bad node type %d", node.getNodeType())
+	}
+
+	return new
+}
+
+// remove a key from a leaf node
+func leafDelete(new BNode, old BNode, index uint16) {
+	new.setHeaders(BNODE_LEAF, old.getNumberOfKeys()-1)
+	bnodeAppendRange(new, old, 0, 0, index)
+	bnodeAppendRange(new, old, index, index+1, old.getNumberOfKeys()-(index+1))
+}
+
+// merge 2 nodes into 1
+func nodeMerge(new BNode, left BNode, right BNode) {
+	new.setHeaders(left.getNodeType(), left.getNumberOfKeys()+right.getNumberOfKeys())
+	bnodeAppendRange(new, left, 0, 0, left.getNumberOfKeys())
+	bnodeAppendRange(new, right, left.getNumberOfKeys(), 0, right.getNumberOfKeys())
+}
+
+// replace 2 adjacent links with 1
+func nodeReplace2Kid(new BNode, old BNode, index uint16, pointer uint64, key []byte) {
+	new.setHeaders(BNODE_NODE, old.getNumberOfKeys()-1)
+	bnodeAppendRange(new, old, 0, 0, index)
+	bnodeAppendKV(new, pointer, key, nil, index)
+	bnodeAppendRange(new, old, index+1, index+2, old.getNumberOfKeys()-(index+2))
+}
+
+// should the updated kid be merged with a sibling?
+// returns -1 for the left sibling, +1 for the right one and 0 for no merge
+func shouldMerge(tree *BTree, node BNode, index uint16, updated BNode) (int, BNode) {
+	pageSize := uint16(tree.pageSize())
+	if updated.nbytes() > pageSize/4 {
+		return 0, BNode{}
+	}
+	if index > 0 {
+		sibling := tree.get(node.getPointer(index - 1))
+		merged := sibling.nbytes() + updated.nbytes() - HEADER
+		if merged <= pageSize {
+			return -1, sibling
+		}
+	}
+	if index+1 < node.getNumberOfKeys() {
+		sibling := tree.get(node.getPointer(index + 1))
+		merged := sibling.nbytes() + updated.nbytes() - HEADER
+		if merged <= pageSize {
+			return +1, sibling
+		}
+	}
+	return 0, BNode{}
+}
+
+// part of treeDelete(): delete a key from an internal node
+func nodeDelete(tree *BTree, node BNode, index uint16, key []byte) BNode {
+	nodePointer := node.getPointer(index)
+	updated := treeDelete(tree, tree.get(nodePointer), key)
+	if len(updated.data) == 0 {
+		return BNode{} // not found
 	}
+	tree.del(nodePointer)
 
+	new := tree.newPage()
+	mergeDir, sibling := shouldMerge(tree, node, index, updated)
+	switch {
+	case mergeDir < 0: // left
+		merged := tree.newPage()
+		nodeMerge(merged, sibling, updated)
+		tree.del(node.getPointer(index - 1))
+		nodeReplace2Kid(new, node, index-1, tree.new(merged), merged.getKey(0))
+	case mergeDir > 0: // right
+		merged := tree.newPage()
+		nodeMerge(merged, updated, sibling)
+		tree.del(node.getPointer(index + 1))
+		nodeReplace2Kid(new, node, index, tree.new(merged), merged.getKey(0))
+	case updated.getNumberOfKeys() == 0:
+		// the kid is empty and has no sibling to merge with,
+		// this only happens when the parent has a single kid
+		if node.getNumberOfKeys() != 1 || index != 0 {
+			corrupt("nodeDelete got an empty kid with siblings")
+		}
+		new.setHeaders(BNODE_NODE, 0)
+	default:
+		nodeReplaceKidN(tree, new, node, index, updated)
+	}
 	return new
 }
 
+// delete a key from the tree, an empty node is returned if the key is not found
+func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+	index := nodeLookUp(tree, node, key)
+	switch node.getNodeType() {
+	case BNODE_LEAF:
+		if !bytes.Equal(key, node.getKey(index)) {
+			return BNode{} // not found
+		}
+		if tree.usage != nil {
+			tree.usage.remove(key, node.getValue(index))
+		}
+		new := tree.newPage()
+		leafDelete(new, node, index)
+		return new
+	case BNODE_NODE:
+		return nodeDelete(tree, node, index, key)
+	default:
+		corrupt("bad node type %d", node.getNodeType())
+		return BNode{}
+	}
+}
+
+// look up a key starting from the given node
+func treeGet(tree *BTree, node BNode, key []byte) ([]byte, bool) {
+	index := nodeLookUp(tree, node, key)
+	switch node.getNodeType() {
+	case BNODE_LEAF:
+		if !bytes.Equal(key, node.getKey(index)) {
+			return nil, false
+		}
+		return node.getValue(index), true
+	case BNODE_NODE:
+		return treeGet(tree, tree.get(node.getPointer(index)), key)
+	default:
+		corrupt("bad node type %d", node.getNodeType())
+		return nil, false
+	}
+}
+
+// BIter is a position in the tree, the path of nodes from the root to a
+// leaf and the index in each of them.
+// The position before the first key is the sentinel, the one after the
+// last key is past the end of the last leaf, neither is Valid.
+type BIter struct {
+	tree *BTree
+	path []BNode
+	pos  []uint16
+}
+
+// find the last key less than or equal to the given one
+func (tree *BTree) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		index := nodeLookUp(tree, node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, index)
+		ptr = 0
+		if node.getNodeType() == BNODE_NODE {
+			ptr = node.getPointer(index)
+		}
+	}
+	return iter
+}
+
+// position past the last key
+func (tree *BTree) SeekEnd() *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		nkeys := node.getNumberOfKeys()
+		iter.path = append(iter.path, node)
+		ptr = 0
+		if node.getNodeType() == BNODE_NODE {
+			iter.pos = append(iter.pos, nkeys-1)
+			ptr = node.getPointer(nkeys - 1)
+		} else {
+			iter.pos = append(iter.pos, nkeys)
+		}
+	}
+	return iter
+}
+
+func (iter *BIter) Valid() bool {
+	if len(iter.path) == 0 {
+		return false
+	}
+	leaf, pos := iter.path[len(iter.path)-1], iter.pos[len(iter.pos)-1]
+	return pos < leaf.getNumberOfKeys() && len(leaf.getKey(pos)) > 0
+}
+
+// whether the position is past the last key
+func (iter *BIter) atEnd() bool {
+	level := len(iter.path) - 1
+	return level < 0 || iter.pos[level] >= iter.path[level].getNumberOfKeys()
+}
+
+// the key and value at the position, only if Valid
+func (iter *BIter) Deref() ([]byte, []byte) {
+	leaf, pos := iter.path[len(iter.path)-1], iter.pos[len(iter.pos)-1]
+	return leaf.getKey(pos), leaf.getValue(pos)
+}
+
+// move to the next key, or past the end
+func (iter *BIter) Next() {
+	if len(iter.path) == 0 {
+		return
+	}
+	level := len(iter.path) - 1
+	if !iterNext(iter, level) {
+		iter.pos[level] = iter.path[level].getNumberOfKeys()
+	}
+}
+
+// move to the previous key, or to the sentinel
+func (iter *BIter) Prev() {
+	if len(iter.path) > 0 {
+		iterPrev(iter, len(iter.path)-1)
+	}
+}
+
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].getNumberOfKeys() {
+		iter.pos[level]++
+	} else if level == 0 || !iterNext(iter, level-1) {
+		return false
+	}
+	if level+1 < len(iter.path) {
+		// the kid changed, start from its first key
+		kid := iter.tree.get(iter.path[level].getPointer(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+	}
+	return true
+}
+
+func iterPrev(iter *BIter, level int) bool {
+	if iter.pos[level] > 0 {
+		iter.pos[level]--
+	} else if level == 0 || !iterPrev(iter, level-1) {
+		return false
+	}
+	if level+1 < len(iter.path) {
+		// the kid changed, start from its last key
+		kid := iter.tree.get(iter.path[level].getPointer(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.getNumberOfKeys() - 1
+	}
+	return true
+}
+
+func (tree *BTree) checkKeyValue(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if max := maxKeySize(tree.pageSize()); len(key) > max {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrKeyTooLarge, len(key), max)
+	}
+	if max := maxValueSize(tree.pageSize()); len(value) > max {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrValueTooLarge, len(value), max)
+	}
+	return nil
+}
+
+func (tree *BTree) Get(key []byte) (value []byte, ok bool, err error) {
+	if tree.root == 0 {
+		return nil, false, nil
+	}
+	defer catchTreeError(&err)
+	value, ok = treeGet(tree, tree.get(tree.root), key)
+	return value, ok, nil
+}
+
+// Insert adds or updates a key. On a tree error the pages already updated
+// are left as they are, the caller discards the tree.
+func (tree *BTree) Insert(key []byte, value []byte) error {
+	if err := tree.checkKeyValue(key, value); err != nil {
+		return err
+	}
+	return tree.insert(key, value, nil)
+}
+
+// Update sets the key to the value fn returns for its current one, walking
+// the tree once. ok is whether the key exists. The value is checked like
+// those of Insert, but once pages are updated: a bad one is a tree error.
+func (tree *BTree) Update(key []byte, fn func(old []byte, ok bool) []byte) error {
+	if err := tree.checkKeyValue(key, nil); err != nil {
+		return err
+	}
+	return tree.insert(key, nil, fn)
+}
+
+func (tree *BTree) insert(key []byte, value []byte, update updateFunc) (err error) {
+	defer catchTreeError(&err)
+	if tree.root == 0 {
+		if update != nil {
+			value = update(nil, false)
+			if err := tree.checkKeyValue(key, value); err != nil {
+				return err
+			}
+		}
+		// first insert, create a leaf with the empty sentinel key
+		// so that nodeLookUp always finds a key less than or equal to the one asked
+		root := tree.newPage()
+		root.setHeaders(BNODE_LEAF, 2)
+		bnodeAppendKV(root, 0, nil, nil, 0)
+		bnodeAppendKV(root, 0, key, value, 1)
+		if tree.usage != nil {
+			tree.usage.set(key, value, nil, false)
+		}
+		tree.root = tree.new(root)
+		return nil
+	}
+
+	node := tree.get(tree.root)
+	tree.del(tree.root)
+	node = treeInsert(tree, node, key, value, update, true)
+	nsplit, splited := nodeSplit3(tree, node, appended(node, key, true))
+	if nsplit > 1 {
+		// the root was split, add a new level
+		root := tree.newPage()
+		root.setHeaders(BNODE_NODE, nsplit)
+		for i, kid := range splited[:nsplit] {
+			bnodeAppendKV(root, tree.new(kid), kid.getKey(0), nil, uint16(i))
+		}
+		tree.root = tree.new(root)
+	} else {
+		tree.root = tree.new(splited[0])
+	}
+	return nil
+}
+
+// Delete removes a key, see Insert for the errors.
+func (tree *BTree) Delete(key []byte) (deleted bool, err error) {
+	if err := tree.checkKeyValue(key, nil); err != nil {
+		return false, err
+	}
+	if tree.root == 0 {
+		return false, nil
+	}
+	defer catchTreeError(&err)
+	updated := treeDelete(tree, tree.get(tree.root), key)
+	if len(updated.data) == 0 {
+		return false, nil // not found
+	}
+	tree.del(tree.root)
+	if updated.getNodeType() == BNODE_NODE && updated.getNumberOfKeys() == 1 {
+		// remove a level
+		tree.root = updated.getPointer(0)
+	} else {
+		tree.root = tree.new(updated)
+	}
+	return true, nil
+}
+
 func bnodeAppendRange(new BNode, old BNode, dstNew uint16, srcOld uint16, n uint16) {
-	if dstNew+n > n {
-		panic("nodeAppendRange dstNew+n is greater than n")
+	if dstNew+n > new.getNumberOfKeys() {
+		corrupt("nodeAppendRange to %d of %d keys", dstNew+n, new.getNumberOfKeys())
 	}
-	if srcOld+n > n {
-		panic("nodeAppendRange scrOld+n is greater than n")
+	if srcOld+n > old.getNumberOfKeys() {
+		corrupt("nodeAppendRange from %d of %d keys", srcOld+n, old.getNumberOfKeys())
 	}
 
 	if n == 0 {
@@ -277,10 +838,6 @@ func bnodeAppendKV(new BNode, pointer uint64, key []byte, value []byte, index ui
 	new.setOffset(index+1, new.getOffset(index)+4+uint16((len(key)+len(value))))
 }
 
-func main() {
-	saveDataAtomic("/home/kevin/db.file", []byte("kevin"))
-}
-
 func saveDataAtomic(path string, data []byte) error {
 	tempFile := fmt.Sprintf("%s.tmp.%d", path, rand.Int())
 	fp, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0064)
@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// a tree over pages in memory, checking that they're freed once
+type memTree struct {
+	tree  BTree
+	pages map[uint64]BNode
+	next  uint64
+}
+
+func newMemTree(t testing.TB) *memTree {
+	m := &memTree{pages: map[uint64]BNode{}, next: 1}
+	m.tree.get = func(ptr uint64) BNode {
+		node, ok := m.pages[ptr]
+		if !ok {
+			t.Fatalf("page %d not allocated", ptr)
+		}
+		return node
+	}
+	m.tree.new = func(node BNode) uint64 {
+		if node.nbytes() > BTREE_PAGE_SIZE {
+			t.Fatalf("page of %d bytes", node.nbytes())
+		}
+		m.next++
+		m.pages[m.next] = BNode{append([]byte(nil), node.data[:BTREE_PAGE_SIZE]...)}
+		return m.next
+	}
+	m.tree.del = func(ptr uint64) {
+		if _, ok := m.pages[ptr]; !ok {
+			t.Fatalf("page %d freed twice", ptr)
+		}
+		delete(m.pages, ptr)
+	}
+	return m
+}
+
+// random updates against a map, the scratch buffers recycled by each
+// insert must not leak into the pages of the tree
+func TestTreeRandom(t *testing.T) {
+	m := newMemTree(t)
+	ref := map[string]string{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		k := fmt.Sprintf("k%d", r.Intn(5000))
+		if r.Intn(3) == 2 {
+			_, ok := ref[k]
+			if deleted, err := m.tree.Delete([]byte(k)); err != nil || deleted != ok {
+				t.Fatalf("delete %q: %v %v, want %v", k, deleted, err, ok)
+			}
+			delete(ref, k)
+			continue
+		}
+		v := make([]byte, r.Intn(300))
+		r.Read(v)
+		if err := m.tree.Insert([]byte(k), v); err != nil {
+			t.Fatal(err)
+		}
+		ref[k] = string(v)
+	}
+	for k, v := range ref {
+		if got, ok, err := m.tree.Get([]byte(k)); err != nil || !ok || string(got) != v {
+			t.Fatalf("get %q: %q %v %v", k, got, ok, err)
+		}
+	}
+	for k := range ref {
+		if deleted, err := m.tree.Delete([]byte(k)); err != nil || !deleted {
+			t.Fatalf("delete %q: %v %v", k, deleted, err)
+		}
+	}
+	if len(m.pages) > 1 {
+		t.Fatalf("%d pages left in an empty tree", len(m.pages))
+	}
+}
+
+func TestTreeLargeKeys(t *testing.T) {
+	m := newMemTree(t)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%0990d", i)) }
+	for i := 0; i < 2000; i++ {
+		if err := m.tree.Insert(key(i), make([]byte, 3000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2000; i++ {
+		if v, ok, _ := m.tree.Get(key(i)); !ok || len(v) != 3000 {
+			t.Fatalf("key %d: %d bytes, %v", i, len(v), ok)
+		}
+	}
+}
+
+// the allocations per insert with and without the pools of scratch nodes
+func BenchmarkInsert(b *testing.B) {
+	for _, pooled := range []bool{false, true} {
+		name := "unpooled"
+		if pooled {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			defer func(was bool) { poolScratch = was }(poolScratch)
+			poolScratch = pooled
+			m := newMemTree(b)
+			m.tree.new = func(node BNode) uint64 {
+				m.next++
+				m.pages[m.next] = BNode{node.data[:BTREE_PAGE_SIZE]}
+				return m.next
+			}
+			key := make([]byte, 8)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				binary.BigEndian.PutUint64(key, uint64(i)*2654435761)
+				if err := m.tree.Insert(key, key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// pages of the tree reachable from ptr
+func countPages(tree *BTree, ptr uint64) int {
+	node := tree.get(ptr)
+	n := 1
+	if node.getNodeType() == BNODE_NODE {
+		for i := uint16(0); i < node.getNumberOfKeys(); i++ {
+			n += countPages(tree, node.getPointer(i))
+		}
+	}
+	return n
+}
+
+// keys appended at the right edge fill the nodes, the others split them
+// in halves
+func TestTreeAppend(t *testing.T) {
+	const keys = 50000
+	pages := map[bool]int{}
+	for _, sequential := range []bool{true, false} {
+		m := newMemTree(t)
+		r := rand.New(rand.NewSource(1))
+		order := r.Perm(keys)
+		key := make([]byte, 8)
+		for i := 0; i < keys; i++ {
+			k := uint64(i)
+			if !sequential {
+				k = uint64(order[i])
+			}
+			binary.BigEndian.PutUint64(key, k)
+			if err := m.tree.Insert(key, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		iter := m.tree.SeekLE(nil)
+		n := 0
+		for iter.Next(); iter.Valid(); iter.Next() {
+			k, _ := iter.Deref()
+			if binary.BigEndian.Uint64(k) != uint64(n) {
+				t.Fatalf("key %d is %x", n, k)
+			}
+			n++
+		}
+		if n != keys {
+			t.Fatalf("%d keys in the tree, want %d", n, keys)
+		}
+		pages[sequential] = countPages(&m.tree, m.tree.root)
+	}
+	if pages[true]*4 > pages[false]*3 {
+		t.Fatalf("%d pages for appended keys, %d for random ones", pages[true], pages[false])
+	}
+	// an insert in the middle of full nodes still works
+	m := newMemTree(t)
+	key := make([]byte, 8)
+	for i := 0; i < keys; i += 2 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		m.tree.Insert(key, key)
+	}
+	for i := 1; i < keys; i += 2 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := m.tree.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < keys; i += 97 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if _, ok, _ := m.tree.Get(key); !ok {
+			t.Fatalf("key %d missing", i)
+		}
+	}
+}
+
+func BenchmarkInsertAppend(b *testing.B) {
+	m := newMemTree(b)
+	key := make([]byte, 8)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		m.tree.Insert(key, key)
+	}
+}
+
+func TestTreeSizeErrors(t *testing.T) {
+	m := newMemTree(t)
+	if err := m.tree.Insert(make([]byte, maxKeySize(BTREE_PAGE_SIZE)+1), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("insert of a large key: %v", err)
+	}
+	if err := m.tree.Insert([]byte("k"), make([]byte, maxValueSize(BTREE_PAGE_SIZE)+1)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("insert of a large value: %v", err)
+	}
+	if err := m.tree.Insert(nil, nil); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("insert of an empty key: %v", err)
+	}
+	if err := m.tree.Insert(make([]byte, maxKeySize(BTREE_PAGE_SIZE)), make([]byte, maxValueSize(BTREE_PAGE_SIZE))); err != nil {
+		t.Fatalf("insert of the largest key and value: %v", err)
+	}
+}
+
+// a tree with a bad page, and a key of that page
+func corruptTree(t *testing.T) (*memTree, []byte) {
+	m := newMemTree(t)
+	for i := 0; i < 2000; i++ {
+		m.tree.Insert([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 50))
+	}
+	// the pages are checked when read, as from the file
+	get := m.tree.get
+	m.tree.get = func(ptr uint64) BNode {
+		node := get(ptr)
+		if err := checkNode(node); err != nil {
+			treeFail(err)
+		}
+		return node
+	}
+	kid := m.pages[m.tree.get(m.tree.root).getPointer(1)]
+	key := append([]byte{}, kid.getKey(0)...)
+	binary.LittleEndian.PutUint16(kid.data[2:], 0xffff) // the number of keys
+	return m, key
+}
+
+// a bad page fails the operations reaching it instead of crashing, the
+// tree is discarded after a failed update
+func TestTreeCorrupt(t *testing.T) {
+	m, key := corruptTree(t)
+	_, _, err := m.tree.Get(key)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("get: %v", err)
+	}
+	if DEBUG != strings.Contains(err.Error(), "treeFail") {
+		t.Fatalf("stack of the error in a debug build %v: %v", DEBUG, err)
+	}
+	if _, ok, err := m.tree.Get([]byte("k00000")); !ok || err != nil {
+		t.Fatalf("get from a good page: %v %v", ok, err)
+	}
+	if err := m.tree.Insert(key, nil); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("insert: %v", err)
+	}
+	m, key = corruptTree(t)
+	if _, err := m.tree.Delete(key); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("delete: %v", err)
+	}
+}
+
+func TestCorruptFile(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < 5000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 50))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := fp.Stat()
+	for p := int64(1); p < fi.Size()/BTREE_PAGE_SIZE; p++ {
+		fp.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 9, 9, 9, 9}, p*BTREE_PAGE_SIZE+2)
+	}
+	fp.Close()
+	db = openTestPath(t, db.Path)
+	if _, _, err := db.Get([]byte("k00010")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("get: %v", err)
+	}
+	if err := db.Set([]byte("k00010"), nil); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("set: %v", err)
+	}
+	r, _ := db.Begin(false)
+	defer r.Rollback()
+	c := r.Cursor()
+	if k, _ := c.First(); k != nil || !errors.Is(c.Err(), ErrCorrupt) {
+		t.Fatalf("cursor at %q: %v", k, c.Err())
+	}
+}
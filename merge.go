@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrNoMergeOperator = errors.New("no merge operator, see WithMergeOperator")
+
+// MergeFunc folds the operands of Merge into the value of the key, in the
+// order they were merged. existing is nil if the key is absent. It must be
+// deterministic and must not keep or modify its arguments.
+type MergeFunc func(key []byte, existing []byte, operands [][]byte) []byte
+
+// Merge updates the key with the merge operator of the DB, appending to a
+// list or adding to a set without reading the value first.
+//
+// A Tx from Begin folds the operand right away, in the same walk of the
+// tree as the update. An optimistic Tx buffers it: Get folds the buffered
+// operands into the value of the snapshot, Commit into the latest value.
+// A key the Tx only merges doesn't conflict with concurrent updates, unless
+// the Tx reads it too.
+func (tx *Tx) Merge(key []byte, operand []byte) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if tx.db.opts.merge == nil {
+		return ErrNoMergeOperator
+	}
+	if err := tx.tree.checkKeyValue(key, operand); err != nil {
+		return err
+	}
+	tx.traceOp("merge", key)
+	key, operand = append([]byte(nil), key...), append([]byte(nil), operand...)
+	if !tx.optimistic {
+		if err := tx.dropExpired(key); err != nil {
+			return err
+		}
+		op, err := tx.merge(key, operand)
+		if err != nil {
+			tx.err = err
+			return err
+		}
+		tx.logOp(nil, op)
+		tx.gen++
+		return nil
+	}
+	w, ok := tx.writes[string(key)]
+	if !ok || w.operands != nil {
+		tx.bufferWrite(walOp{kind: WAL_OP_MERGE, key: key, value: operand})
+		return nil
+	}
+	// set or deleted by the Tx, the value is known already
+	var old []byte
+	if !w.deleted && !w.expired(tx.clock()) {
+		old = w.value
+	}
+	value := tx.db.opts.merge(key, old, [][]byte{operand})
+	if err := tx.tree.checkKeyValue(key, value); err != nil {
+		return fmt.Errorf("merged value: %w", err)
+	}
+	tx.bufferWrite(walOp{kind: WAL_OP_SET, key: key, value: value})
+	return nil
+}
+
+// fold an operand into the tree, it returns the SET to log
+func (tx *Tx) merge(key []byte, operand []byte) (walOp, error) {
+	op := walOp{kind: WAL_OP_SET, key: key}
+	err := tx.tree.Update(key, func(old []byte, ok bool) []byte {
+		// a copy, the pages of old may be reused before the commit
+		op.value = append([]byte(nil), tx.db.opts.merge(key, old, [][]byte{operand})...)
+		return op.value
+	})
+	return op, err
+}
+
+// Merge runs Tx.Merge in its own Tx.
+func (db *DB) Merge(key []byte, operand []byte) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.Merge(key, operand); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
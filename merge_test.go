@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func appendMerge(key, existing []byte, operands [][]byte) []byte {
+	for _, op := range operands {
+		existing = append(existing, op...)
+	}
+	return existing
+}
+
+func TestMergeNoOperator(t *testing.T) {
+	db := openTest(t)
+	if err := db.Merge([]byte("k"), []byte("a")); !errors.Is(err, ErrNoMergeOperator) {
+		t.Fatalf("merge without an operator: %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	db := openTest(t, WithMergeOperator(appendMerge))
+	mustSet(t, db, "l", "0")
+	db.Merge([]byte("l"), []byte("1"))
+	db.Merge([]byte("n"), []byte("x"))
+	wantValue(t, db, "l", []byte("01"))
+	wantValue(t, db, "n", []byte("x"))
+
+	// the optimistic merges of concurrent Txs don't conflict
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				tx, _ := db.BeginTx(TxOptions{Writable: true, Isolation: Serializable})
+				tx.Merge([]byte("m"), []byte("."))
+				tx.Merge([]byte("m"), []byte("."))
+				if err := tx.Commit(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	wantValue(t, db, "m", bytes.Repeat([]byte("."), 200))
+
+	// the operands are folded over the latest value at commit
+	tx, _ := db.BeginTx(TxOptions{Writable: true, Isolation: SnapshotIsolation})
+	tx.Merge([]byte("l"), []byte("2"))
+	if v, _, _ := tx.Get([]byte("l")); string(v) != "012" {
+		t.Fatalf("merged %q in the Tx", v)
+	}
+	sp, _ := tx.Savepoint()
+	tx.Set([]byte("l"), []byte("x"))
+	tx.Merge([]byte("l"), []byte("y"))
+	if v, _, _ := tx.Get([]byte("l")); string(v) != "xy" {
+		t.Fatalf("merged %q over a set", v)
+	}
+	tx.RollbackTo(sp)
+	var got []string
+	c := tx.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if len(v) < 10 {
+			got = append(got, string(k)+"="+string(v))
+		}
+	}
+	if strings.Join(got, " ") != "l=012 n=x" {
+		t.Fatalf("scanned %v", got)
+	}
+	db.Merge([]byte("l"), []byte("3"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wantValue(t, db, "l", []byte("0132"))
+
+	for i := 0; i < 300; i++ {
+		db.Merge([]byte("big"), []byte("zzzzz"))
+		mustSet(t, db, string([]byte{0xff, byte(i)}), "filler")
+	}
+	db = reopenTest(t, db, WithMergeOperator(appendMerge))
+	wantValue(t, db, "big", bytes.Repeat([]byte("z"), 1500))
+	wantValue(t, db, "l", []byte("0132"))
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The latency buckets are log-linear like an HDR histogram: each power of
+// two from 2^HIST_MIN_SHIFT ns is split in 1<<HIST_SUB_BITS buckets, the
+// error of a quantile is under 25% whatever the latency. The bucket of a
+// duration is found from its bits, without a search.
+const (
+	HIST_SUB_BITS  = 2
+	HIST_MIN_SHIFT = 10 // ~1us, the bound of the first bucket
+	HIST_OCTAVES   = 25 // up to ~34s, the last bucket has no bound
+)
+
+// upper bounds of the latency buckets
+var latencyBounds = func() (bounds [1 + HIST_OCTAVES<<HIST_SUB_BITS]time.Duration) {
+	bounds[0] = 1 << HIST_MIN_SHIFT
+	for i := 1; i < len(bounds); i++ {
+		octave, sub := (i-1)>>HIST_SUB_BITS, (i-1)&(1<<HIST_SUB_BITS-1)
+		base := time.Duration(1) << (HIST_MIN_SHIFT + octave)
+		bounds[i] = base + base*time.Duration(sub+1)>>HIST_SUB_BITS
+	}
+	return bounds
+}()
+
+// histogram of durations updated without locks, a snapshot may see an
+// observation in the count and not yet in the sum
+type histogram struct {
+	counts [len(latencyBounds) + 1]atomic.Uint64
+	sum    atomic.Int64 // nanoseconds
+}
+
+// the bucket of a duration, the smallest bound not below it
+func histBucket(d time.Duration) int {
+	if d <= 1<<HIST_MIN_SHIFT {
+		return 0
+	}
+	v := uint64(d - 1)
+	octave := bits.Len64(v) - 1
+	if octave >= HIST_MIN_SHIFT+HIST_OCTAVES {
+		return len(latencyBounds)
+	}
+	sub := int(v>>(octave-HIST_SUB_BITS)) & (1<<HIST_SUB_BITS - 1)
+	return 1 + (octave-HIST_MIN_SHIFT)<<HIST_SUB_BITS + sub
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.counts[histBucket(d)].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// observe the time since start, for a defer
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{Bounds: latencyBounds[:], Counts: make([]uint64, len(h.counts))}
+	for i := range h.counts {
+		s.Counts[i] = h.counts[i].Load()
+		s.Count += s.Counts[i]
+	}
+	s.Sum = time.Duration(h.sum.Load())
+	return s
+}
+
+// Histogram is a distribution of durations: Counts[i] is the number of
+// durations in (Bounds[i-1], Bounds[i]], the last count those above the
+// last bound.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Quantile estimates the duration below which a share q of the durations
+// fall, from 0 to 1: the bound of the bucket reaching it, or the last
+// bound if it's above. 0 if there are none.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 || len(h.Bounds) == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.Count)))
+	var n uint64
+	for i, bound := range h.Bounds {
+		if n += h.Counts[i]; n >= rank && n > 0 {
+			return bound
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// Mean is the average duration, 0 if there are none.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// the counters and gauges of Stats exported, the same for every exporter
+var statsMetrics = []struct {
+	name    string
+	help    string
+	counter bool // a gauge otherwise
+	value   func(s Stats) uint64
+}{
+	{"commits_total", "Durable commits.", true, func(s Stats) uint64 { return s.Commits }},
+	{"wal_syncs_total", "Fsyncs of the WAL.", true, func(s Stats) uint64 { return s.WALSyncs }},
+	{"unsynced_commits", "Commits visible but not durable yet.", false, func(s Stats) uint64 { return s.Unsynced }},
+	{"page_reads_total", "Pages read from the file.", true, func(s Stats) uint64 { return s.PageReads }},
+	{"page_writes_total", "Pages written to the file.", true, func(s Stats) uint64 { return s.PageWrites }},
+	{"cache_hits_total", "Page reads served from memory.", true, func(s Stats) uint64 { return s.CacheHits }},
+	{"cache_misses_total", "Page reads from the file, read ahead excluded.", true, func(s Stats) uint64 { return s.CacheMisses }},
+	{"cached_pages", "Pages in memory.", false, func(s Stats) uint64 { return uint64(s.CachedPages) }},
+	{"file_pages", "Pages of the database file.", false, func(s Stats) uint64 { return s.FilePages }},
+	{"free_pages", "Free pages, reusable now or once no reader needs them.", false, func(s Stats) uint64 { return uint64(s.FreePages) }},
+	{"wal_bytes", "Size of the WAL.", false, func(s Stats) uint64 { return uint64(s.WALSize) }},
+	{"scrubbed_pages_total", "Pages verified by the scrubber.", true, func(s Stats) uint64 { return s.ScrubbedPages }},
+	{"bad_pages", "Pages quarantined by the scrubber.", false, func(s Stats) uint64 { return uint64(s.BadPages) }},
+	{"replication_lag_commits", "Commits of the primary not applied yet by the replica.", false, func(s Stats) uint64 { return s.ReplicationLag }},
+	{"replication_delay_seconds", "Whole seconds since the replica was last up to date.", false, func(s Stats) uint64 { return uint64(s.ReplicationDelay / time.Second) }},
+}
+
+// the latency histograms of Stats exported, empty ones included
+var statsHistograms = []struct {
+	name  string
+	help  string
+	value func(s Stats) Histogram
+}{
+	{"commit_duration_seconds", "Latency of the commits, fsync included.", func(s Stats) Histogram { return s.CommitLatency }},
+	{"get_duration_seconds", "Latency of Tx.Get, with latency histograms enabled.", func(s Stats) Histogram { return s.GetLatency }},
+	{"set_duration_seconds", "Latency of Tx.Set, with latency histograms enabled.", func(s Stats) Histogram { return s.SetLatency }},
+	{"fsync_duration_seconds", "Latency of the fsyncs of the WAL and the file, with latency histograms enabled.", func(s Stats) Histogram { return s.SyncLatency }},
+}
+
+// WriteMetrics writes the Stats of the DB in the Prometheus text format,
+// see MetricsHandler. Build with the prometheus tag for a collector to
+// register with the client library instead.
+func (db *DB) WriteMetrics(w io.Writer) error {
+	s := db.Stats()
+	bw := bufio.NewWriter(w)
+	for _, m := range statsMetrics {
+		kind := "gauge"
+		if m.counter {
+			kind = "counter"
+		}
+		name := "storage_engine_" + m.name
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, m.help, name, kind, name, m.value(s))
+	}
+	for _, m := range statsHistograms {
+		writeHistogram(bw, m.name, m.help, m.value(s))
+	}
+	return bw.Flush()
+}
+
+func writeHistogram(w io.Writer, name, help string, h Histogram) {
+	name = "storage_engine_" + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var n uint64
+	for i, bound := range h.Bounds {
+		n += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound.Seconds(), n)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.Sum.Seconds(), name, h.Count)
+}
+
+// MetricsHandler serves WriteMetrics, for a Prometheus server to scrape.
+func (db *DB) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		db.WriteMetrics(w)
+	})
+}
@@ -0,0 +1,61 @@
+//go:build prometheus
+
+package storage
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Collector exports the Stats of a DB to the Prometheus client library,
+// it's built with the prometheus tag, after go get of the library: the
+// default build has no dependency. Metrics are read at each scrape.
+type Collector struct {
+	db    *DB
+	descs map[string]*prometheus.Desc
+}
+
+// NewCollector returns the collector of the DB, labels are added to all
+// its metrics to tell databases apart.
+func NewCollector(db *DB, labels prometheus.Labels) *Collector {
+	c := &Collector{db: db, descs: map[string]*prometheus.Desc{}}
+	for _, m := range statsMetrics {
+		c.descs[m.name] = prometheus.NewDesc("storage_engine_"+m.name, m.help, nil, labels)
+	}
+	for _, m := range statsHistograms {
+		c.descs[m.name] = prometheus.NewDesc("storage_engine_"+m.name, m.help, nil, labels)
+	}
+	return c
+}
+
+// RegisterMetrics registers the collector of the DB with reg.
+func (db *DB) RegisterMetrics(reg prometheus.Registerer, labels prometheus.Labels) error {
+	return reg.Register(NewCollector(db, labels))
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.db.Stats()
+	for _, m := range statsMetrics {
+		kind := prometheus.GaugeValue
+		if m.counter {
+			kind = prometheus.CounterValue
+		}
+		ch <- prometheus.MustNewConstMetric(c.descs[m.name], kind, float64(m.value(s)))
+	}
+	for _, m := range statsHistograms {
+		ch <- constHistogram(c.descs[m.name], m.value(s))
+	}
+}
+
+func constHistogram(desc *prometheus.Desc, h Histogram) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.Bounds))
+	var n uint64
+	for i, bound := range h.Bounds {
+		n += h.Counts[i]
+		buckets[bound.Seconds()] = n
+	}
+	return prometheus.MustNewConstHistogram(desc, h.Count, h.Sum.Seconds(), buckets)
+}
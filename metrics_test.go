@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "a", "b")
+	mustSet(t, db, "c", "d")
+	db.Checkpoint()
+	var buf bytes.Buffer
+	if err := db.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE storage_engine_commits_total counter\nstorage_engine_commits_total 2\n",
+		"# TYPE storage_engine_cached_pages gauge\n",
+		"# TYPE storage_engine_commit_duration_seconds histogram\n",
+		`storage_engine_commit_duration_seconds_bucket{le="+Inf"} 2` + "\n",
+		"storage_engine_commit_duration_seconds_count 2\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("no %q in\n%s", want, out)
+		}
+	}
+	// every line is a comment or a sample
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if !strings.HasPrefix(line, "# ") && !strings.HasPrefix(line, "storage_engine_") {
+			t.Fatalf("line %q", line)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	db.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") || !bytes.Contains(body, []byte("storage_engine_commits_total 2")) {
+		t.Fatalf("served %s %q", rec.Header().Get("Content-Type"), body)
+	}
+}
+
+// each duration falls in the bucket of the smallest bound not below it
+func TestHistBucket(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		d := time.Duration(r.Int63n(int64(40 * time.Second)))
+		if i < 2000 {
+			d = time.Duration(i)
+		}
+		b := histBucket(d)
+		if b < len(latencyBounds) && d > latencyBounds[b] || b > 0 && d <= latencyBounds[b-1] {
+			t.Fatalf("%v in bucket %d", d, b)
+		}
+	}
+	for i := 1; i < len(latencyBounds); i++ {
+		if latencyBounds[i] <= latencyBounds[i-1] || latencyBounds[i] > latencyBounds[i-1]*5/4 {
+			t.Fatalf("bounds %v then %v", latencyBounds[i-1], latencyBounds[i])
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	if s := h.snapshot(); s.Quantile(0.5) != 0 || s.Mean() != 0 {
+		t.Fatal("quantiles without durations")
+	}
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	h.observe(time.Hour)
+	s := h.snapshot()
+	if s.Count != 101 || s.Sum != 5050*time.Millisecond+time.Hour {
+		t.Fatalf("count %d sum %v", s.Count, s.Sum)
+	}
+	for _, q := range []struct {
+		q    float64
+		want time.Duration
+	}{{0.5, 51 * time.Millisecond}, {0.9, 91 * time.Millisecond}, {0.99, 100 * time.Millisecond}} {
+		// within the error of the buckets
+		if got := s.Quantile(q.q); got < q.want || got > q.want*5/4 {
+			t.Fatalf("quantile %v is %v, want %v", q.q, got, q.want)
+		}
+	}
+	if got := s.Quantile(1); got != latencyBounds[len(latencyBounds)-1] {
+		t.Fatalf("quantile above the last bound %v", got)
+	}
+}
+
+func TestLatencyHistograms(t *testing.T) {
+	for _, latency := range []bool{false, true} {
+		var opts []Option
+		if latency {
+			opts = append(opts, WithLatencyHistograms())
+		}
+		db := openTest(t, opts...)
+		for i := 0; i < 10; i++ {
+			mustSet(t, db, "a", "b")
+			db.Get([]byte("a"))
+		}
+		s := db.Stats()
+		if s.CommitLatency.Count != 10 || s.CommitLatency.Mean() == 0 {
+			t.Fatalf("%d commits timed", s.CommitLatency.Count)
+		}
+		want := uint64(0)
+		if latency {
+			want = 10
+		}
+		if s.GetLatency.Count != want || s.SetLatency.Count != want || s.SyncLatency.Count < want || !latency && s.SyncLatency.Count != 0 {
+			t.Fatalf("latency %v: %d gets, %d sets, %d fsyncs timed", latency, s.GetLatency.Count, s.SetLatency.Count, s.SyncLatency.Count)
+		}
+	}
+}
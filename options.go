@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// Option configures a DB at Open. The options a file is created with that
+// define its format, the page size and the comparator, are kept by the file.
+type Option func(db *DB)
+
+// the options that can't change once the DB is open
+type options struct {
+	backend        IOBackend
+	pageSize       int
+	readOnly       bool
+	noFreelistSync bool
+	comparator     string                // name of cmp, recorded in the meta page
+	cmp            func(a, b []byte) int // nil for bytes.Compare
+	merge          MergeFunc
+	logger         Logger
+	latency        bool        // time Get, Set and fsync
+	tracer         tracer      // nil for no spans
+	replicaOf      string      // address of the primary, see WithReplicaOf
+	keys           KeyProvider // of the encryption key, see WithKeyProvider
+	replicationTLS *tls.Config // of the connections to the primary, see WithReplicationTLS
+	audit          bool        // see WithAuditLog
+	secureDelete   bool        // see WithSecureDelete
+	syncPolicy     SyncPolicy
+	syncInterval   time.Duration
+	maxBatchDelay  time.Duration
+	checkpointSize int64 // WAL bytes
+	cacheSize      int   // clean pages
+	flushRate      int   // dirty pages per second
+	readAhead      int   // leaves
+	slowThreshold  time.Duration
+	sweepInterval  time.Duration
+	scrubInterval  time.Duration
+	scrubRate      int // pages per second
+	minFreeSpace   int64
+	walArchiveSize int64
+	importRate     int64 // bytes per second
+}
+
+// WithIOBackend selects how pages are read and written, IOSync by default.
+func WithIOBackend(backend IOBackend) Option {
+	return func(db *DB) {
+		db.opts.backend = backend
+	}
+}
+
+// WithPageSize sets the page size of a new file, a power of two from
+// MIN_PAGE_SIZE to MAX_PAGE_SIZE, BTREE_PAGE_SIZE by default. The largest
+// keys and values scale with it. An existing file keeps its page size.
+func WithPageSize(size int) Option {
+	return func(db *DB) {
+		db.opts.pageSize = size
+	}
+}
+
+// WithCacheSize sets the number of clean pages kept in memory,
+// DEFAULT_CACHE_SIZE by default.
+func WithCacheSize(pages int) Option {
+	return func(db *DB) {
+		db.opts.cacheSize = pages
+	}
+}
+
+// WithSyncPolicy sets when commits are made durable, SyncAlways by default.
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(db *DB) {
+		db.opts.syncPolicy = policy
+	}
+}
+
+// WithSyncInterval sets the period of the fsyncs of SyncInterval,
+// DEFAULT_SYNC_INTERVAL by default.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(db *DB) {
+		db.opts.syncInterval = interval
+	}
+}
+
+// WithMaxBatchDelay sets how long a commit waits for others to share its
+// fsync, it only waits when other writers are active.
+// DEFAULT_MAX_BATCH_DELAY by default, 0 doesn't wait.
+func WithMaxBatchDelay(delay time.Duration) Option {
+	return func(db *DB) {
+		db.opts.maxBatchDelay = delay
+	}
+}
+
+// WithCheckpointSize sets the WAL size that triggers a checkpoint,
+// DEFAULT_CHECKPOINT_SIZE by default.
+func WithCheckpointSize(size int64) Option {
+	return func(db *DB) {
+		db.opts.checkpointSize = size
+	}
+}
+
+// WithFlushRate sets the number of dirty pages per second written ahead of
+// the checkpoint in the background, DEFAULT_FLUSH_RATE by default, 0
+// disables it.
+func WithFlushRate(pages int) Option {
+	return func(db *DB) {
+		db.opts.flushRate = pages
+	}
+}
+
+// WithReadAhead sets the number of leaves read ahead of a cursor walking
+// leaves in a row, DEFAULT_READ_AHEAD by default, 0 disables it.
+func WithReadAhead(leaves int) Option {
+	return func(db *DB) {
+		db.opts.readAhead = leaves
+	}
+}
+
+// WithSlowThreshold logs the commits, checkpoints and scans taking longer
+// than threshold as slow, with what they did.
+func WithSlowThreshold(threshold time.Duration) Option {
+	return func(db *DB) {
+		db.opts.slowThreshold = threshold
+	}
+}
+
+// WithSweepInterval sets the period of the deletion of expired keys,
+// DEFAULT_SWEEP_INTERVAL by default, 0 disables it.
+func WithSweepInterval(interval time.Duration) Option {
+	return func(db *DB) {
+		db.opts.sweepInterval = interval
+	}
+}
+
+// WithScrubInterval starts a scrubber pausing interval between its passes
+// over the pages, see Scrub.
+func WithScrubInterval(interval time.Duration) Option {
+	return func(db *DB) {
+		db.opts.scrubInterval = interval
+	}
+}
+
+// WithScrubRate sets the number of pages per second Scrub reads at most,
+// DEFAULT_SCRUB_RATE by default.
+func WithScrubRate(pages int) Option {
+	return func(db *DB) {
+		db.opts.scrubRate = pages
+	}
+}
+
+// WithMinFreeSpace sets the free space of the disk under which Health
+// fails, DEFAULT_MIN_FREE_SPACE by default, 0 disables the check.
+func WithMinFreeSpace(bytes int64) Option {
+	return func(db *DB) {
+		db.opts.minFreeSpace = bytes
+	}
+}
+
+// WithWALArchiveSize keeps up to size bytes of WAL segments after the
+// checkpoints, for the followers of ServeReplication and the streams of
+// Changes to catch up from.
+func WithWALArchiveSize(size int64) Option {
+	return func(db *DB) {
+		db.opts.walArchiveSize = size
+	}
+}
+
+// WithImportRate limits the bytes of keys and values per second loaded by
+// ImportBolt, ImportLevelDB and ImportBadger.
+func WithImportRate(bytes int64) Option {
+	return func(db *DB) {
+		db.opts.importRate = bytes
+	}
+}
+
+// WithReadOnly opens the file without writing to it, writable transactions
+// fail with ErrReadOnly. The commits in the WAL are recovered in memory and
+// left to the next writable Open, so are prepared transactions.
+func WithReadOnly() Option {
+	return func(db *DB) {
+		db.opts.readOnly = true
+	}
+}
+
+// WithNoFreelistSync skips writing the free list on checkpoints, which
+// saves writing a large free list every time. Open rebuilds it by walking
+// the tree instead of reading it.
+func WithNoFreelistSync() Option {
+	return func(db *DB) {
+		db.opts.noFreelistSync = true
+	}
+}
+
+// WithComparator orders the keys with cmp instead of bytes.Compare, it must
+// return 0 only for equal keys. The name is recorded by a new file, opening
+// it with another comparator fails: its keys would be out of order.
+func WithComparator(name string, cmp func(a, b []byte) int) Option {
+	return func(db *DB) {
+		db.opts.comparator = name
+		db.opts.cmp = cmp
+	}
+}
+
+// WithMergeOperator sets the function folding the operands of Merge.
+func WithMergeOperator(merge MergeFunc) Option {
+	return func(db *DB) {
+		db.opts.merge = merge
+	}
+}
+
+// WithLatencyHistograms times every Tx.Get, Tx.Set and fsync in the
+// histograms of Stats, at the cost of reading the clock twice per call.
+// Commits are always timed.
+func WithLatencyHistograms() Option {
+	return func(db *DB) {
+		db.opts.latency = true
+	}
+}
+
+// WithReplicaOf opens the DB as a replica of the primary serving
+// ServeReplication at addr: Open starts to Follow it and Close stops, the
+// Txs see its commits as they're applied. Writable transactions other
+// than those of the replication fail with ErrReadOnly, and expired keys
+// are left to the sweeper of the primary. Stats has the replication lag.
+func WithReplicaOf(addr string) Option {
+	return func(db *DB) {
+		db.opts.replicaOf = addr
+	}
+}
+
+// WithReplicationTLS connects to the primary of Follow, BackupFrom and
+// WithReplicaOf over TLS, see TLSClientConfig.
+func WithReplicationTLS(cfg *tls.Config) Option {
+	return func(db *DB) {
+		db.opts.replicationTLS = cfg
+	}
+}
+
+// WithSecureDelete zeroes the pages freed by the commits once no snapshot
+// reaches them, so that the values deleted or overwritten can't be read
+// back from the free space of the file: the flusher or the checkpoint
+// writes the zeros in place, ahead of any reuse. The checkpoint zeroes the
+// records of the WAL before truncating it too. The values fit in their
+// pages, there are no overflow pages to shred apart.
+//
+// The pages free when the DB is opened are left as they are, and so are
+// the segments of the WAL archive and the backups.
+func WithSecureDelete() Option {
+	return func(db *DB) {
+		db.opts.secureDelete = true
+	}
+}
+
+func (o *options) check() error {
+	if !validPageSize(o.pageSize) {
+		return fmt.Errorf("bad page size %d", o.pageSize)
+	}
+	if len(o.comparator) > META_NAME_LEN || (o.comparator == "") != (o.cmp == nil) {
+		return fmt.Errorf("bad comparator %q", o.comparator)
+	}
+	if o.replicaOf != "" && o.readOnly {
+		return fmt.Errorf("a replica of %s can't be read-only", o.replicaOf)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+// the tuning options are read by the commits, set at Open only
+func TestOptions(t *testing.T) {
+	fill := func(db *DB) {
+		for i := 0; i < 500; i++ {
+			mustSet(t, db, fmt.Sprintf("k%04d", i), fmt.Sprintf("%0200d", i))
+		}
+	}
+	db := openTest(t, WithCheckpointSize(1<<40), WithFlushRate(0))
+	fill(db)
+	if s := db.Stats(); s.WALSize < 500*200 || s.FlushedPages != 0 {
+		t.Fatalf("WAL of %d bytes, %d pages flushed without checkpoints nor flusher", s.WALSize, s.FlushedPages)
+	}
+
+	db = openTest(t, WithCheckpointSize(1<<14), WithCacheSize(CACHE_SHARDS))
+	fill(db)
+	if s := db.Stats(); s.WALSize > 1<<15 {
+		t.Fatalf("WAL of %d bytes past a checkpoint size of %d", s.WALSize, 1<<14)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i += 7 {
+		wantValue(t, db, fmt.Sprintf("k%04d", i), []byte(fmt.Sprintf("%0200d", i)))
+	}
+	if s := db.Stats(); s.CachedPages > 2*CACHE_SHARDS {
+		t.Fatalf("%d pages cached, the cache holds %d", s.CachedPages, CACHE_SHARDS)
+	}
+}
@@ -0,0 +1,66 @@
+//go:build otel
+
+package storage
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const TRACER_NAME = "github.com/kevinjad/storage-engine"
+
+// WithTracerProvider emits the spans of the DB with a tracer of tp. It's
+// built with the otel tag, after go get of the OpenTelemetry API.
+//
+// A Tx is a span from Begin to Commit or Rollback, under the span of the
+// context of BeginContext, with the pages it wrote and the bytes it logged.
+// Checkpoints and recovery are spans of their own.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(db *DB) {
+		db.opts.tracer = otelTracer{tp.Tracer(TRACER_NAME)}
+	}
+}
+
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func (t otelTracer) start(ctx context.Context, name string) (context.Context, span) {
+	ctx, s := t.tracer.Start(ctx, name)
+	return ctx, otelSpan{s}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) set(key string, value any) {
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case int:
+		kv = attribute.Int(key, v)
+	case int64:
+		kv = attribute.Int64(key, v)
+	case uint64:
+		kv = attribute.Int64(key, int64(v))
+	case string:
+		kv = attribute.String(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	default:
+		return
+	}
+	s.span.SetAttributes(kv)
+}
+
+func (s otelSpan) fail(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) end() {
+	s.span.End()
+}
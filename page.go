@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Page is a page of the file as read from it, decoded for inspection. The
+// pages of the commits not checkpointed yet may be newer in the WAL.
+type Page struct {
+	ID   uint64
+	Type uint16 // BNODE_NODE, BNODE_LEAF or BNODE_FREE, 0 for the meta page
+	Data []byte
+	// the keys of a node or leaf, with the
+	// pointers to the kids of a node
+	Keys []PageKey
+	Used int // bytes of a node or leaf, headers included
+	// the pointers of a free list page and the next one
+	Free []uint64
+	Next uint64
+	Err  error // why the page couldn't be decoded, ErrCorrupt or ErrBadMeta
+}
+
+// PageKey is a key of a node or leaf page.
+type PageKey struct {
+	Pointer uint64 // 0 in a leaf
+	Offset  uint16 // of the key after the offsets
+	Key     []byte
+	Value   []byte // empty in a node
+}
+
+// ReadPage reads and decodes a page of the file. A page that isn't a valid
+// node or free list page is returned with Err set, as is one that doesn't
+// match its checksum, undecoded then.
+func (db *DB) ReadPage(id uint64) (Page, error) {
+	if db.closed.Load() {
+		return Page{}, ErrDBClosed
+	}
+	db.mu.Lock()
+	pages := db.page.flushed
+	db.mu.Unlock()
+	if id >= pages {
+		return Page{}, fmt.Errorf("page %d is past the end of the file, at %d pages", id, pages)
+	}
+	node, err := db.readPage(id)
+	if errors.Is(err, ErrCorrupt) && db.checksums {
+		// the bytes of the file, to be inspected
+		data := make([]byte, db.opts.pageSize)
+		if _, err := db.fp.ReadAt(data, int64(id)*int64(db.opts.pageSize)); err != nil {
+			return Page{}, err
+		}
+		return Page{ID: id, Type: BNode{data}.getNodeType(), Data: data, Err: err}, nil
+	}
+	if err != nil {
+		return Page{}, err
+	}
+	page := Page{ID: id, Data: node.data}
+	if id == 0 {
+		// decoded by Info
+		_, page.Err = checkMeta(node.data)
+		return page, nil
+	}
+	page.Type = node.getNodeType()
+	switch page.Type {
+	case BNODE_FREE:
+		count := int(binary.LittleEndian.Uint16(node.data[2:]))
+		if count > freeListCap(len(node.data)) {
+			page.Err = fmt.Errorf("%w: %d pointers overflow the page", ErrCorrupt, count)
+			return page, nil
+		}
+		page.Next = binary.LittleEndian.Uint64(node.data[4:])
+		for i := 0; i < count; i++ {
+			page.Free = append(page.Free, binary.LittleEndian.Uint64(node.data[FREE_LIST_HEADER+8*i:]))
+		}
+	default:
+		if page.Err = checkNode(node); page.Err != nil {
+			return page, nil
+		}
+		page.Used = int(node.nbytes())
+		for i := uint16(0); i < node.getNumberOfKeys(); i++ {
+			page.Keys = append(page.Keys, PageKey{
+				Pointer: node.getPointer(i),
+				Offset:  node.getOffset(i),
+				Key:     node.getKey(i),
+				Value:   node.getValue(i),
+			})
+		}
+	}
+	return page, nil
+}
+
+// PageField is a range of bytes of a page, for annotated dumps.
+type PageField struct {
+	Start int
+	End   int
+	Name  string
+	Value string // decoded, empty for keys and values
+}
+
+// Fields splits the data of the page in its fields, in order: the headers,
+// the pointers and offsets, and the lengths, key and value of each key,
+// then the unused bytes. What couldn't be decoded is a single field.
+func (page Page) Fields() []PageField {
+	var fields []PageField
+	pos := 0
+	add := func(size int, name string, value string) {
+		if size == 0 {
+			return // an empty key or value
+		}
+		fields = append(fields, PageField{pos, pos + size, name, value})
+		pos += size
+	}
+	u16 := func() string { return fmt.Sprint(binary.LittleEndian.Uint16(page.Data[pos:])) }
+	u32 := func() string { return fmt.Sprint(binary.LittleEndian.Uint32(page.Data[pos:])) }
+	u64 := func() string { return fmt.Sprint(binary.LittleEndian.Uint64(page.Data[pos:])) }
+	unixNano := func() string {
+		return time.Unix(0, int64(binary.LittleEndian.Uint64(page.Data[pos:]))).UTC().Format(time.RFC3339Nano)
+	}
+	str := func() string { return fmt.Sprintf("%q", getString(page.Data[pos:pos+META_NAME_LEN])) }
+	rest := func(name string) {
+		if pos < len(page.Data) {
+			add(len(page.Data)-pos, name, "")
+		}
+	}
+	switch {
+	case page.ID == 0:
+		if page.Err != nil {
+			rest("meta, undecoded")
+			break
+		}
+		format := binary.LittleEndian.Uint32(page.Data[48:])
+		add(16, "signature", fmt.Sprintf("%q", page.Data[:16]))
+		add(8, "root", u64())
+		add(8, "pages", u64())
+		add(8, "free list", u64())
+		add(8, "version", u64())
+		add(4, "format", u32())
+		var id DBID
+		copy(id[:], page.Data[pos:])
+		add(16, "id", id.String())
+		add(8, "created", unixNano())
+		add(8, "opened", unixNano())
+		add(META_VERSION_LEN, "created by", str())
+		add(META_VERSION_LEN, "opened by", str())
+		if format >= 4 {
+			add(4, "page size", u32())
+			add(META_NAME_LEN, "comparator", str())
+		}
+		if format >= 5 {
+			add(8, "catalog", u64())
+		}
+		add(4, "crc32", fmt.Sprintf("%#08x", binary.LittleEndian.Uint32(page.Data[pos:])))
+		rest("unused")
+	case page.Type == BNODE_FREE:
+		add(2, "type", "free list")
+		add(2, "count", u16())
+		if page.Err != nil {
+			rest("undecoded")
+			break
+		}
+		add(8, "next", u64())
+		for i := range page.Free {
+			add(8, fmt.Sprintf("free %d", i), u64())
+		}
+		rest("unused")
+	default:
+		kind := map[uint16]string{BNODE_NODE: "node", BNODE_LEAF: "leaf"}[page.Type]
+		if kind == "" {
+			kind = fmt.Sprintf("unknown %d", page.Type)
+		}
+		add(2, "type", kind)
+		add(2, "keys", u16())
+		if page.Err != nil {
+			rest("undecoded")
+			break
+		}
+		for i := range page.Keys {
+			add(8, fmt.Sprintf("pointer %d", i), u64())
+		}
+		for i := range page.Keys {
+			add(2, fmt.Sprintf("offset %d", i+1), u16())
+		}
+		for i, k := range page.Keys {
+			add(4, fmt.Sprintf("lengths %d", i), fmt.Sprintf("%d, %d", len(k.Key), len(k.Value)))
+			add(len(k.Key), fmt.Sprintf("key %d", i), "")
+			add(len(k.Value), fmt.Sprintf("value %d", i), "")
+		}
+		rest("unused")
+	}
+	return fields
+}
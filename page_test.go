@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestReadPage(t *testing.T) {
+	db := openTest(t)
+	for round := 0; round < 2; round++ {
+		tx, _ := db.Begin(true)
+		for i := 0; i < 3000; i++ {
+			tx.Set([]byte(fmt.Sprintf("k%05d", i)), []byte(fmt.Sprint(round)))
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		db.Checkpoint()
+	}
+	if page, err := db.ReadPage(0); err != nil || page.Err != nil || page.Type != 0 {
+		t.Fatalf("meta page %+v %v", page.Err, err)
+	}
+	tx, _ := db.Begin(false)
+	root := tx.tree.root
+	tx.Rollback()
+	page, err := db.ReadPage(root)
+	if err != nil || page.Err != nil || page.Type != BNODE_NODE || len(page.Keys) < 2 {
+		t.Fatalf("root %d: %d keys %v %v", page.Type, len(page.Keys), page.Err, err)
+	}
+	leaf, err := db.ReadPage(page.Keys[1].Pointer)
+	if err != nil || leaf.Type != BNODE_LEAF || string(leaf.Keys[0].Key) != string(page.Keys[1].Key) {
+		t.Fatalf("leaf %d: %v %v", leaf.Type, leaf.Err, err)
+	}
+	for i, k := range leaf.Keys {
+		if k.Pointer != 0 || string(k.Value) != "1" || i > 0 && k.Offset <= leaf.Keys[i-1].Offset {
+			t.Fatalf("key %d of the leaf %+v", i, k)
+		}
+	}
+	if leaf.Used <= 0 || leaf.Used > BTREE_PAGE_SIZE || len(leaf.Data) != BTREE_PAGE_SIZE {
+		t.Fatalf("leaf of %d bytes used", leaf.Used)
+	}
+
+	// the free list is in the file
+	free := 0
+	pages := db.Stats().FilePages
+	for id := uint64(1); id < pages; id++ {
+		if page, _ := db.ReadPage(id); page.Type == BNODE_FREE {
+			free += len(page.Free)
+		}
+	}
+	if free == 0 {
+		t.Fatal("no free list page")
+	}
+	if _, err := db.ReadPage(pages); err == nil {
+		t.Fatal("read past the end of the file")
+	}
+
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteAt([]byte{0xff, 0xff}, int64(root)*BTREE_PAGE_SIZE+2)
+	fp.Close()
+	if page, err := db.ReadPage(root); err != nil || !errors.Is(page.Err, ErrCorrupt) {
+		t.Fatalf("corrupt page %v %v", page.Err, err)
+	}
+	db.Close()
+	if _, err := db.ReadPage(root); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("read from a closed DB: %v", err)
+	}
+}
+
+// the fields of a page follow each other from the first byte to the last
+func checkFields(t *testing.T, page Page) map[string]string {
+	t.Helper()
+	fields := page.Fields()
+	values := map[string]string{}
+	pos := 0
+	for _, f := range fields {
+		if f.Start != pos || f.End <= f.Start {
+			t.Fatalf("page %d: field %+v after byte %d", page.ID, f, pos)
+		}
+		pos = f.End
+		values[f.Name] = f.Value
+	}
+	if pos != len(page.Data) {
+		t.Fatalf("page %d: fields to byte %d of %d", page.ID, pos, len(page.Data))
+	}
+	return values
+}
+
+func TestPageFields(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < 3000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("v"))
+	}
+	tx.Commit()
+	tx, _ = db.Begin(true)
+	for i := 0; i < 3000; i += 2 {
+		tx.Del([]byte(fmt.Sprintf("k%05d", i)))
+	}
+	tx.Commit()
+	db.Checkpoint()
+
+	meta, _ := db.ReadPage(0)
+	values := checkFields(t, meta)
+	if values["root"] != fmt.Sprint(db.root) || values["version"] != fmt.Sprint(db.version) ||
+		values["id"] != db.Info().ID.String() || values["page size"] != fmt.Sprint(BTREE_PAGE_SIZE) {
+		t.Fatalf("meta fields %v", values)
+	}
+	types := map[string]bool{}
+	for id := uint64(1); id < db.Stats().FilePages; id++ {
+		page, err := db.ReadPage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := checkFields(t, page)
+		types[values["type"]] = true
+		if page.Type == BNODE_LEAF && values["lengths 0"] != fmt.Sprintf("%d, %d", len(page.Keys[0].Key), len(page.Keys[0].Value)) {
+			t.Fatalf("leaf %d: lengths %q", id, values["lengths 0"])
+		}
+	}
+	if !types["node"] || !types["leaf"] || !types["free list"] {
+		t.Fatalf("page types %v", types)
+	}
+
+	// a corrupt page is a header then what couldn't be decoded
+	fields := Page{ID: 3, Type: BNODE_LEAF, Data: make([]byte, 64), Err: ErrCorrupt}.Fields()
+	if got := fmt.Sprint(fields); got != "[{0 2 type leaf} {2 4 keys 0} {4 64 undecoded }]" {
+		t.Fatalf("fields of a corrupt page %s", got)
+	}
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+var ErrNotSupported = errors.New("not supported on this platform")
+
+// IOBackend is how pages are read and written.
+type IOBackend int
+
+const (
+	// IOSync issues a pread or pwrite per page, the portable default.
+	IOSync IOBackend = iota
+	// IOUring submits batches of page writes, and reads of scans, through an
+	// io_uring on Linux, on amd64 and arm64: Open fails with ErrNotSupported
+	// elsewhere. Single page reads still use pread, a round trip
+	// through the ring is no faster for them.
+	IOUring
+)
+
+func (b IOBackend) String() string {
+	switch b {
+	case IOSync:
+		return "sync"
+	case IOUring:
+		return "io_uring"
+	default:
+		return "unknown"
+	}
+}
+
+// pager does the page I/O of the database file, the meta page, fsync and
+// the file size are handled on the file directly.
+type pager interface {
+	readPage(ptr uint64, data []byte) error
+	// read several pages, the I/O may run concurrently
+	readPages(ptrs []uint64, data [][]byte) error
+	writePages(pages map[uint64][]byte) error
+	close() error
+}
+
+func newPager(fp *os.File, backend IOBackend, pageSize int) (pager, error) {
+	switch backend {
+	case IOSync:
+		return filePager{fp, pageSize}, nil
+	case IOUring:
+		return newRingPager(fp, pageSize)
+	default:
+		return nil, fmt.Errorf("unknown I/O backend %d", backend)
+	}
+}
+
+type filePager struct {
+	fp       *os.File
+	pageSize int
+}
+
+func (p filePager) readPage(ptr uint64, data []byte) error {
+	_, err := p.fp.ReadAt(data, int64(ptr)*int64(p.pageSize))
+	return err
+}
+
+func (p filePager) readPages(ptrs []uint64, data [][]byte) error {
+	for i, ptr := range ptrs {
+		if err := p.readPage(ptr, data[i]); err != nil {
+			return fmt.Errorf("read page %d: %w", ptr, err)
+		}
+	}
+	return nil
+}
+
+func (p filePager) writePages(pages map[uint64][]byte) error {
+	for ptr, page := range pages {
+		if _, err := p.fp.WriteAt(page, int64(ptr)*int64(p.pageSize)); err != nil {
+			return fmt.Errorf("write page %d: %w", ptr, err)
+		}
+	}
+	return nil
+}
+
+func (p filePager) close() error {
+	return nil
+}
+
+// Page checksums: the pages of a plaintext file created since format 8 but
+// the meta page end with a CRC32 of their node and number, the nodes are
+// smaller than the pages by PAGE_CHECKSUM_LEN. A page that doesn't match
+// it, a torn write or one written elsewhere, fails its read with
+// ErrCorrupt, those of Check, Health and Scrub included. The files of
+// older formats have none, Compact copies one into a file that has. The
+// encrypted pages don't need one, their tag is checked.
+//
+// page layout
+// | node      | crc32 |
+// | page - 4B | 4B    |
+
+const (
+	PAGE_CHECKSUM_NONE  = 0
+	PAGE_CHECKSUM_CRC32 = 1
+
+	PAGE_CHECKSUM_LEN = 4
+)
+
+type checksumPager struct {
+	pager
+	pageSize int
+}
+
+func newChecksumPager(p pager, pageSize int) *checksumPager {
+	return &checksumPager{pager: p, pageSize: pageSize}
+}
+
+func (p *checksumPager) readPage(ptr uint64, data []byte) error {
+	if err := p.pager.readPage(ptr, data); err != nil || ptr == 0 {
+		return err
+	}
+	return p.verify(ptr, data)
+}
+
+func (p *checksumPager) readPages(ptrs []uint64, data [][]byte) error {
+	if err := p.pager.readPages(ptrs, data); err != nil {
+		return err
+	}
+	for i, ptr := range ptrs {
+		if ptr == 0 {
+			continue
+		}
+		if err := p.verify(ptr, data[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *checksumPager) writePages(pages map[uint64][]byte) error {
+	summed := make(map[uint64][]byte, len(pages))
+	for ptr, node := range pages {
+		page := make([]byte, p.pageSize)
+		n := p.pageSize - PAGE_CHECKSUM_LEN
+		copy(page[:n], node)
+		binary.LittleEndian.PutUint32(page[n:], pageChecksum(ptr, page[:n]))
+		summed[ptr] = page
+	}
+	return p.pager.writePages(summed)
+}
+
+// check the CRC32 of a page read, then zero it; a page never written is
+// zeros, read as such
+func (p *checksumPager) verify(ptr uint64, data []byte) error {
+	n := p.pageSize - PAGE_CHECKSUM_LEN
+	if allZero(data) {
+		return nil
+	}
+	if binary.LittleEndian.Uint32(data[n:]) != pageChecksum(ptr, data[:n]) {
+		return fmt.Errorf("%w: page %d: checksum mismatch", ErrCorrupt, ptr)
+	}
+	clear(data[n:])
+	return nil
+}
+
+// the CRC32 of a node and the number of its page
+func pageChecksum(ptr uint64, node []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(binary.LittleEndian.AppendUint64(nil, ptr)), crc32.IEEETable, node)
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIOBackends(t *testing.T) {
+	for _, backend := range []IOBackend{IOSync, IOUring} {
+		t.Run(backend.String(), func(t *testing.T) {
+			db, err := Open(t.TempDir()+"/test.db", WithIOBackend(backend), WithCacheSize(1))
+			if backend == IOUring && err != nil {
+				if !uringPlatform() && !errors.Is(err, ErrNotSupported) {
+					t.Fatalf("open with io_uring on %s/%s: %v", runtime.GOOS, runtime.GOARCH, err)
+				}
+				t.Skip("no io_uring:", err)
+			}
+			if backend == IOUring && !uringPlatform() {
+				t.Fatalf("io_uring opened on %s/%s", runtime.GOOS, runtime.GOARCH)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.Close() })
+			for i := 0; i < 2000; i++ {
+				mustSet(t, db, fmt.Sprintf("k%05d", i), fmt.Sprint(i))
+			}
+			// the checkpoint writes a batch of pages
+			if err := db.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			db = reopenTest(t, db, WithIOBackend(backend), WithCacheSize(1))
+			for i := 0; i < 2000; i++ {
+				wantValue(t, db, fmt.Sprintf("k%05d", i), []byte(fmt.Sprint(i)))
+			}
+			// a scan reads the leaves ahead through the backend
+			tx, _ := db.Begin(false)
+			defer tx.Rollback()
+			n := 0
+			c := tx.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				n++
+			}
+			if n != 2000 || c.Err() != nil {
+				t.Fatalf("scanned %d keys: %v", n, c.Err())
+			}
+		})
+	}
+}
+
+func TestIOBackendUnknown(t *testing.T) {
+	if _, err := Open(t.TempDir()+"/test.db", WithIOBackend(IOBackend(9))); err == nil {
+		t.Fatal("open with an unknown backend")
+	}
+}
+
+// the platforms of pager_uring_linux.go
+func uringPlatform() bool {
+	return runtime.GOOS == "linux" && (runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64")
+}
+
+// a byte flipped where the layout is still valid, or a page copied over
+// another, fails the reads of its page
+func TestPageChecksums(t *testing.T) {
+	db := openTest(t)
+	if info := db.Info(); !info.Checksums || info.FormatVersion != FORMAT_VERSION {
+		t.Fatalf("info %+v", info)
+	}
+	fillScrubTest(t, db)
+	leaf := scrubLeafTest(t, db)
+	node, err := db.readPage(leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := node.getKey(1)
+	if !allZero(node.data[db.nodeSize():]) {
+		t.Fatal("checksum read with the node")
+	}
+	db.Close()
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	// the last byte of the node, free space
+	fp.WriteAt([]byte{1}, int64(leaf+1)*BTREE_PAGE_SIZE-PAGE_CHECKSUM_LEN-1)
+	db = openTestPath(t, db.Path)
+	if _, _, err := db.Get(key); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("get from a bad page: %v", err)
+	}
+	r, err := db.Check(context.Background())
+	if err != nil || len(r.Problems) != 1 || r.Problems[0].Check != CHECK_CHECKSUM || r.Problems[0].Page != leaf {
+		t.Fatalf("check %v: %v", r.Problems, err)
+	}
+	if page, err := db.ReadPage(leaf); err != nil || !errors.Is(page.Err, ErrCorrupt) || page.Type != BNODE_LEAF || len(page.Data) != BTREE_PAGE_SIZE {
+		t.Fatalf("page %d: %v %v", page.Type, page.Err, err)
+	}
+	if s, err := db.Scrub(context.Background()); err != nil || !slices.Equal(s.Bad, []uint64{leaf}) {
+		t.Fatalf("scrubbed %+v: %v", s, err)
+	}
+
+	// the next leaf in place of this one
+	next := make([]byte, BTREE_PAGE_SIZE)
+	fp.ReadAt(next, int64(leaf+1)*BTREE_PAGE_SIZE)
+	db.Close()
+	fp.WriteAt(next, int64(leaf)*BTREE_PAGE_SIZE)
+	db = openTestPath(t, db.Path)
+	if r, err := db.Check(context.Background()); err != nil || r.OK() || r.Problems[0].Check != CHECK_CHECKSUM || r.Problems[0].Page != leaf {
+		t.Fatalf("check of a page copied over another %v: %v", r.Problems, err)
+	}
+
+	// the encrypted pages have the tag instead
+	enc := openTest(t, WithEncryptionKey(keyTest(1)))
+	if info := enc.Info(); info.Checksums {
+		t.Fatalf("info %+v", info)
+	}
+}
+
+// a file of format 7 has no checksum, kept so once opened
+func TestPageChecksumsFormat7(t *testing.T) {
+	db := openTest(t)
+	db.checksums = false
+	db.pager = db.pager.(*checksumPager).pager
+	value := bytes.Repeat([]byte{'v'}, BTREE_MAX_VALUE_SIZE)
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, fmt.Sprintf("k%03d", i), string(value))
+	}
+	db.Close()
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := make([]byte, META_SIZE)
+	fp.ReadAt(meta, 0)
+	binary.LittleEndian.PutUint32(meta[48:], 7)
+	binary.LittleEndian.PutUint32(meta[META_SIZE_V7-4:], crc32.ChecksumIEEE(meta[:META_SIZE_V7-4]))
+	fp.WriteAt(meta, 0)
+	fp.Close()
+
+	for round := 0; round < 2; round++ {
+		db = openTestPath(t, db.Path)
+		if info := db.Info(); info.Checksums || info.FormatVersion != FORMAT_VERSION || db.nodeSize() != BTREE_PAGE_SIZE {
+			t.Fatalf("info %+v", info)
+		}
+		mustSet(t, db, fmt.Sprint("round", round), string(value))
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		if r, err := db.Check(context.Background()); err != nil || !r.OK() {
+			t.Fatalf("check %v: %v", r.Problems, err)
+		}
+		wantValue(t, db, "k099", value)
+		db.Close()
+	}
+}
+
+// the limits of the nodes of a page less its checksum are those of the page
+func TestLimitSize(t *testing.T) {
+	for size := MIN_PAGE_SIZE; size <= MAX_PAGE_SIZE; size *= 2 {
+		node := size - PAGE_CHECKSUM_LEN
+		if maxKeySize(node) != maxKeySize(size) || maxValueSize(node) != maxValueSize(size) {
+			t.Errorf("limits of %d bytes %d %d", node, maxKeySize(node), maxValueSize(node))
+		}
+		if HEADER+8+2+4+maxKeySize(node)+maxValueSize(node) > node {
+			t.Errorf("largest key and value overflow %d bytes", node)
+		}
+		if crypt := size - PAGE_CRYPT_OVERHEAD; HEADER+8+2+4+maxKeySize(crypt)+maxValueSize(crypt) > crypt {
+			t.Errorf("largest key and value overflow %d bytes", crypt)
+		}
+	}
+}
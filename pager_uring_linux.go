@@ -0,0 +1,211 @@
+//go:build linux && (amd64 || arm64)
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// A minimal io_uring, see io_uring_setup(2), without liburing: the rings
+// are mapped once and every batch is submitted then waited for as a whole.
+// The syscall numbers are those of amd64 and arm64, the other platforms
+// get ErrNotSupported.
+
+const (
+	SYS_IO_URING_SETUP = 425
+	SYS_IO_URING_ENTER = 426
+
+	IORING_OFF_SQ_RING = 0
+	IORING_OFF_CQ_RING = 0x8000000
+	IORING_OFF_SQES    = 0x10000000
+
+	IORING_FEAT_SINGLE_MMAP = 1 << 0
+	IORING_ENTER_GETEVENTS  = 1 << 0
+
+	IORING_OP_READ  = 22
+	IORING_OP_WRITE = 23
+
+	RING_ENTRIES = 256
+	SQE_SIZE     = 64
+	CQE_SIZE     = 16
+)
+
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  sqringOffsets
+	cqOff                                                                  cqringOffsets
+}
+
+type ringPager struct {
+	fp       *os.File
+	pageSize int
+	mu       sync.Mutex // one batch at a time
+	fd       int
+	sq       []byte // the submission ring
+	cq       []byte // the completion ring, may be the same mapping
+	sqes     []byte
+	p        uringParams
+	err      error // the rings are out of sync after a failed io_uring_enter
+}
+
+func newRingPager(fp *os.File, pageSize int) (pager, error) {
+	r := &ringPager{fp: fp, pageSize: pageSize}
+	fd, _, errno := syscall.Syscall(SYS_IO_URING_SETUP, RING_ENTRIES, uintptr(unsafe.Pointer(&r.p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+	r.fd = int(fd)
+	sqSize := int(r.p.sqOff.array) + int(r.p.sqEntries)*4
+	cqSize := int(r.p.cqOff.cqes) + int(r.p.cqEntries)*CQE_SIZE
+	if r.p.features&IORING_FEAT_SINGLE_MMAP != 0 {
+		sqSize = max(sqSize, cqSize)
+	}
+	var err error
+	if r.sq, err = syscall.Mmap(r.fd, IORING_OFF_SQ_RING, sqSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, fmt.Errorf("mmap io_uring: %w", err)
+	}
+	r.cq = r.sq
+	if r.p.features&IORING_FEAT_SINGLE_MMAP == 0 {
+		if r.cq, err = syscall.Mmap(r.fd, IORING_OFF_CQ_RING, cqSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+			r.close()
+			return nil, fmt.Errorf("mmap io_uring: %w", err)
+		}
+	}
+	if r.sqes, err = syscall.Mmap(r.fd, IORING_OFF_SQES, int(r.p.sqEntries)*SQE_SIZE, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, fmt.Errorf("mmap io_uring: %w", err)
+	}
+	return r, nil
+}
+
+func ringWord(ring []byte, off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&ring[off]))
+}
+
+// run the operations on the given pages and wait for all of them
+func (r *ringPager) submit(op byte, ptrs []uint64, data [][]byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer runtime.KeepAlive(data)
+	if r.err != nil {
+		return r.err
+	}
+	for len(ptrs) > 0 {
+		n := min(len(ptrs), int(r.p.sqEntries))
+		mask := *ringWord(r.sq, r.p.sqOff.ringMask)
+		tail := atomic.LoadUint32(ringWord(r.sq, r.p.sqOff.tail))
+		for i := 0; i < n; i++ {
+			idx := (tail + uint32(i)) & mask
+			sqe := r.sqes[idx*SQE_SIZE : (idx+1)*SQE_SIZE]
+			clear(sqe)
+			sqe[0] = op
+			*(*int32)(unsafe.Pointer(&sqe[4])) = int32(r.fp.Fd())
+			*(*uint64)(unsafe.Pointer(&sqe[8])) = ptrs[i] * uint64(r.pageSize)
+			*(*uint64)(unsafe.Pointer(&sqe[16])) = uint64(uintptr(unsafe.Pointer(&data[i][0])))
+			*(*uint32)(unsafe.Pointer(&sqe[24])) = uint32(len(data[i]))
+			*(*uint64)(unsafe.Pointer(&sqe[32])) = uint64(i)
+			*ringWord(r.sq, r.p.sqOff.array+4*idx) = idx
+		}
+		atomic.StoreUint32(ringWord(r.sq, r.p.sqOff.tail), tail+uint32(n))
+		for submitted := 0; submitted < n; {
+			got, _, errno := syscall.Syscall6(SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(n-submitted), uintptr(n-submitted), IORING_ENTER_GETEVENTS, 0, 0)
+			if errno == syscall.EINTR {
+				continue
+			}
+			if errno != 0 {
+				r.err = fmt.Errorf("io_uring_enter: %w", errno)
+				return r.err
+			}
+			submitted += int(got)
+		}
+		// every completion must be consumed, even after an error
+		var err error
+		for done := 0; done < n; {
+			head := atomic.LoadUint32(ringWord(r.cq, r.p.cqOff.head))
+			tail := atomic.LoadUint32(ringWord(r.cq, r.p.cqOff.tail))
+			if head == tail {
+				if _, _, errno := syscall.Syscall6(SYS_IO_URING_ENTER, uintptr(r.fd), 0, 1, IORING_ENTER_GETEVENTS, 0, 0); errno != 0 && errno != syscall.EINTR {
+					r.err = fmt.Errorf("io_uring_enter: %w", errno)
+					return r.err
+				}
+				continue
+			}
+			cqMask := *ringWord(r.cq, r.p.cqOff.ringMask)
+			for ; head != tail; head++ {
+				cqe := r.cq[r.p.cqOff.cqes+(head&cqMask)*CQE_SIZE:]
+				i := *(*uint64)(unsafe.Pointer(&cqe[0]))
+				res := *(*int32)(unsafe.Pointer(&cqe[8]))
+				switch {
+				case err != nil:
+				case res < 0:
+					err = fmt.Errorf("page %d: %w", ptrs[i], syscall.Errno(-res))
+				case int(res) != len(data[i]) && op == IORING_OP_WRITE:
+					err = fmt.Errorf("write page %d: %w", ptrs[i], io.ErrShortWrite)
+				case int(res) != len(data[i]):
+					err = fmt.Errorf("read page %d: %w", ptrs[i], io.ErrUnexpectedEOF)
+				}
+				done++
+			}
+			atomic.StoreUint32(ringWord(r.cq, r.p.cqOff.head), head)
+		}
+		if err != nil {
+			return err
+		}
+		ptrs, data = ptrs[n:], data[n:]
+	}
+	return nil
+}
+
+func (r *ringPager) readPage(ptr uint64, data []byte) error {
+	_, err := r.fp.ReadAt(data, int64(ptr)*int64(r.pageSize))
+	return err
+}
+
+func (r *ringPager) readPages(ptrs []uint64, data [][]byte) error {
+	return r.submit(IORING_OP_READ, ptrs, data)
+}
+
+func (r *ringPager) writePages(pages map[uint64][]byte) error {
+	ptrs := make([]uint64, 0, len(pages))
+	data := make([][]byte, 0, len(pages))
+	for ptr, page := range pages {
+		ptrs = append(ptrs, ptr)
+		data = append(data, page)
+	}
+	return r.submit(IORING_OP_WRITE, ptrs, data)
+}
+
+func (r *ringPager) close() error {
+	var errs []error
+	if r.sqes != nil {
+		errs = append(errs, syscall.Munmap(r.sqes))
+	}
+	if r.cq != nil && &r.cq[0] != &r.sq[0] {
+		errs = append(errs, syscall.Munmap(r.cq))
+	}
+	if r.sq != nil {
+		errs = append(errs, syscall.Munmap(r.sq))
+	}
+	errs = append(errs, syscall.Close(r.fd))
+	return errors.Join(errs...)
+}
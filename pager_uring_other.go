@@ -0,0 +1,12 @@
+//go:build !linux || !(amd64 || arm64)
+
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+func newRingPager(fp *os.File, pageSize int) (pager, error) {
+	return nil, fmt.Errorf("io_uring: %w", ErrNotSupported)
+}
@@ -0,0 +1,484 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Parquet export: Tx.ExportParquet writes the keys of a bucket of a
+// snapshot as a Parquet file of two columns, key and value, for Spark,
+// DuckDB and the other tools that read Parquet. The values of a bucket
+// have no schema, they're written as they are, bytes or strings; those of
+// a table of records.go have one, its rows are written as the columns of
+// its schema, of their types, the nullable ones optional.
+//
+// The file is the magic, the row groups, then the file metadata: the
+// columns of each row group are a chunk of pages one after the other, a
+// page is its header, the definition levels of an optional column, then
+// the values but the NULLs, compressed with gzip. The headers and the
+// metadata are Thrift structs of the compact protocol. The levels are runs
+// of the RLE hybrid encoding, the bools are bits from the lowest.
+//
+// file layout
+// | magic | row groups... | metadata | metadata size | magic |
+// | 4B    |               |          | 4B            | 4B    |
+// row group layout
+// | column chunk... |
+// page layout, the levels and values compressed
+// | header | levels size | levels... | values... |
+// |        | 4B          |           |           |
+// value layout of the bytes and strings, little-endian like the numbers
+// | len | bytes |
+// | 4B  |       |
+
+const (
+	PARQUET_MAGIC          = "PAR1"
+	PARQUET_PAGE_SIZE      = 1 << 20  // bytes of the values of a page before it's cut
+	PARQUET_ROW_GROUP_SIZE = 64 << 20 // bytes of the keys and values of a row group before the next one
+
+	// of parquet.thrift
+	parquetBoolean      = 0
+	parquetInt64        = 2
+	parquetDouble       = 5
+	parquetByteArray    = 6
+	parquetRequired     = 0
+	parquetOptional     = 1
+	parquetUTF8         = 0
+	parquetPlain        = 0
+	parquetRLE          = 3
+	parquetUncompressed = 0
+	parquetGzip         = 2
+	parquetDataPage     = 0
+
+	// types of the Thrift compact protocol
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// ParquetOptions are the options of Tx.ExportParquet, the zero values are
+// the defaults.
+type ParquetOptions struct {
+	Bucket       [][]byte // path of the bucket exported, the names from the top, nil for the keys outside buckets
+	Table        string   // a table exported instead, as its columns
+	Strings      bool     // the key and value columns are UTF-8 strings, bytes otherwise
+	Uncompressed bool     // pages not compressed
+	PageSize     int      // PARQUET_PAGE_SIZE if 0
+	RowGroupSize int64    // PARQUET_ROW_GROUP_SIZE if 0
+}
+
+// ExportParquet writes the keys of a bucket of the Tx to w as a Parquet
+// file, in the order of the comparator of the DB, or the rows of a table
+// in the order of its primary key, and returns the number of rows. The
+// version of the Tx is in the metadata of the file, as
+// storage_engine.version; the expiry of the keys isn't kept. A row group
+// is held in memory until it's written.
+func (tx *Tx) ExportParquet(w io.Writer, opts ParquetOptions) (rows int64, err error) {
+	if tx.done {
+		return 0, ErrTxClosed
+	}
+	defer catchTreeError(&err)
+	if opts.PageSize == 0 {
+		opts.PageSize = PARQUET_PAGE_SIZE
+	}
+	if opts.RowGroupSize == 0 {
+		opts.RowGroupSize = PARQUET_ROW_GROUP_SIZE
+	}
+	if opts.Table != "" {
+		return tx.exportParquetTable(w, opts)
+	}
+	c, err := tx.pathCursor(opts.Bucket)
+	if err != nil {
+		return 0, err
+	}
+	pw := newParquetWriter(w, opts, []parquetColumn{
+		{name: "key", typ: parquetByteArray, utf8: opts.Strings},
+		{name: "value", typ: parquetByteArray, utf8: opts.Strings},
+	})
+	if err := pw.write([]byte(PARQUET_MAGIC)); err != nil {
+		return 0, err
+	}
+	for key, value := c.First(); key != nil; key, value = c.Next() {
+		if err := pw.add([]any{key, value}); err != nil {
+			return pw.rows, err
+		}
+	}
+	if err := c.Err(); err != nil {
+		return pw.rows, err
+	}
+	return pw.rows, pw.close(tx.version)
+}
+
+// the rows of a table, a column of the type of each of the schema
+func (tx *Tx) exportParquetTable(w io.Writer, opts ParquetOptions) (int64, error) {
+	if opts.Bucket != nil {
+		return 0, fmt.Errorf("parquet export of the table %q and of a bucket", opts.Table)
+	}
+	t, err := tx.Table(opts.Table)
+	if err != nil {
+		return 0, err
+	}
+	var cols []parquetColumn
+	for _, c := range t.schema.Columns {
+		col := parquetColumn{name: c.Name, optional: c.Nullable}
+		switch c.Type {
+		case ColumnInt64:
+			col.typ = parquetInt64
+		case ColumnFloat64:
+			col.typ = parquetDouble
+		case ColumnString:
+			col.typ, col.utf8 = parquetByteArray, true
+		case ColumnBytes:
+			col.typ = parquetByteArray
+		case ColumnBool:
+			col.typ = parquetBoolean
+		}
+		cols = append(cols, col)
+	}
+	pw := newParquetWriter(w, opts, cols)
+	if err := pw.write([]byte(PARQUET_MAGIC)); err != nil {
+		return 0, err
+	}
+	err = t.Scan(nil, nil, func(r Row) error {
+		return pw.add(r)
+	})
+	if err != nil {
+		return pw.rows, err
+	}
+	return pw.rows, pw.close(tx.version)
+}
+
+type parquetWriter struct {
+	w      io.Writer
+	opts   ParquetOptions
+	offset int64
+	cols   []parquetColumn
+	rows   int64
+	groups []parquetRowGroup
+	group  parquetRowGroup // the one being built
+	size   int64           // bytes of its values
+	gzip   *gzip.Writer
+	packed bytes.Buffer
+}
+
+func newParquetWriter(w io.Writer, opts ParquetOptions, cols []parquetColumn) *parquetWriter {
+	pw := &parquetWriter{w: w, opts: opts, cols: cols}
+	pw.gzip, _ = gzip.NewWriterLevel(&pw.packed, gzip.BestSpeed)
+	return pw
+}
+
+// a column of the row group being built
+type parquetColumn struct {
+	name         string
+	typ          int32        // physical type of parquet.thrift
+	utf8         bool         // of the byte arrays
+	optional     bool         // nullable, its pages have definition levels
+	chunk        bytes.Buffer // the pages written
+	page         []byte       // the values of the next one
+	levels       []byte       // of its values, 0 for NULL, if optional
+	bits         int          // bools of the page
+	pageValues   int
+	uncompressed int64 // of the chunk, headers included
+}
+
+// a row group written, for the metadata
+type parquetRowGroup struct {
+	rows    int64
+	size    int64 // uncompressed
+	columns []parquetChunk
+}
+
+type parquetChunk struct {
+	offset                   int64
+	compressed, uncompressed int64
+}
+
+func (pw *parquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+// add a row, a value of the Go type of each column, nil for NULL
+func (pw *parquetWriter) add(row []any) error {
+	for i, v := range row {
+		c := &pw.cols[i]
+		pw.size += int64(c.add(v))
+		if len(c.page) >= pw.opts.PageSize {
+			if err := pw.flushPage(c); err != nil {
+				return err
+			}
+		}
+	}
+	pw.rows++
+	pw.group.rows++
+	if pw.size >= pw.opts.RowGroupSize {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+// add a value to the page, returns its size without its length
+func (c *parquetColumn) add(v any) int {
+	c.pageValues++
+	if c.optional {
+		c.levels = append(c.levels, boolByte(v != nil))
+	}
+	switch v := v.(type) {
+	case []byte:
+		c.page = binary.LittleEndian.AppendUint32(c.page, uint32(len(v)))
+		c.page = append(c.page, v...)
+		return len(v)
+	case string:
+		c.page = binary.LittleEndian.AppendUint32(c.page, uint32(len(v)))
+		c.page = append(c.page, v...)
+		return len(v)
+	case int64:
+		c.page = binary.LittleEndian.AppendUint64(c.page, uint64(v))
+		return 8
+	case float64:
+		c.page = binary.LittleEndian.AppendUint64(c.page, math.Float64bits(v))
+		return 8
+	case bool:
+		if c.bits%8 == 0 {
+			c.page = append(c.page, 0)
+		}
+		c.page[len(c.page)-1] |= boolByte(v) << (c.bits % 8)
+		c.bits++
+		return 1
+	}
+	return 0 // NULL
+}
+
+// add the page of the values so far to the chunk of the column
+func (pw *parquetWriter) flushPage(c *parquetColumn) error {
+	data := c.page
+	if c.optional {
+		levels := parquetLevels(c.levels)
+		data = append(binary.LittleEndian.AppendUint32(nil, uint32(len(levels))), levels...)
+		data = append(data, c.page...)
+	}
+	size := len(data)
+	if !pw.opts.Uncompressed {
+		pw.packed.Reset()
+		pw.gzip.Reset(&pw.packed)
+		pw.gzip.Write(data)
+		if err := pw.gzip.Close(); err != nil {
+			return err
+		}
+		data = pw.packed.Bytes()
+	}
+	var t thriftWriter
+	t.i32(1, parquetDataPage)
+	t.i32(2, int32(size))
+	t.i32(3, int32(len(data)))
+	t.begin(5) // data page header
+	t.i32(1, int32(c.pageValues))
+	t.i32(2, parquetPlain)
+	t.i32(3, parquetRLE)
+	t.i32(4, parquetRLE)
+	t.end()
+	t.stop()
+	c.chunk.Write(t.buf)
+	c.chunk.Write(data)
+	c.uncompressed += int64(len(t.buf) + size)
+	c.page, c.levels, c.bits, c.pageValues = c.page[:0], c.levels[:0], 0, 0
+	return nil
+}
+
+// the definition levels of a page, 0 or 1, as runs of the RLE hybrid
+// encoding of a bit width of 1: the count shifted, then the level
+func parquetLevels(levels []byte) []byte {
+	var runs []byte
+	for i := 0; i < len(levels); {
+		n := 1
+		for i+n < len(levels) && levels[i+n] == levels[i] {
+			n++
+		}
+		runs = binary.AppendUvarint(runs, uint64(n)<<1)
+		runs = append(runs, levels[i])
+		i += n
+	}
+	return runs
+}
+
+// write the chunks of the row group being built
+func (pw *parquetWriter) flushRowGroup() error {
+	for i := range pw.cols {
+		c := &pw.cols[i]
+		if c.pageValues > 0 {
+			if err := pw.flushPage(c); err != nil {
+				return err
+			}
+		}
+		chunk := parquetChunk{offset: pw.offset, compressed: int64(c.chunk.Len()), uncompressed: c.uncompressed}
+		if err := pw.write(c.chunk.Bytes()); err != nil {
+			return err
+		}
+		pw.group.columns = append(pw.group.columns, chunk)
+		pw.group.size += c.uncompressed
+		c.chunk.Reset()
+		c.uncompressed = 0
+	}
+	pw.groups = append(pw.groups, pw.group)
+	pw.group, pw.size = parquetRowGroup{}, 0
+	return nil
+}
+
+// write the last row group and the metadata
+func (pw *parquetWriter) close(version uint64) error {
+	if pw.group.rows > 0 {
+		if err := pw.flushRowGroup(); err != nil {
+			return err
+		}
+	}
+	codec := int32(parquetGzip)
+	if pw.opts.Uncompressed {
+		codec = parquetUncompressed
+	}
+	var t thriftWriter
+	t.i32(1, 1)
+	t.list(2, thriftStruct, 1+len(pw.cols)) // schema
+	t.begin(0)
+	t.binary(4, []byte("schema"))
+	t.i32(5, int32(len(pw.cols)))
+	t.end()
+	for _, c := range pw.cols {
+		repetition := int32(parquetRequired)
+		if c.optional {
+			repetition = parquetOptional
+		}
+		t.begin(0)
+		t.i32(1, c.typ)
+		t.i32(3, repetition)
+		t.binary(4, []byte(c.name))
+		if c.utf8 {
+			t.i32(6, parquetUTF8)
+			t.begin(10) // logical type
+			t.begin(1)  // string
+			t.end()
+			t.end()
+		}
+		t.end()
+	}
+	t.i64(3, pw.rows)
+	t.list(4, thriftStruct, len(pw.groups))
+	for _, g := range pw.groups {
+		t.begin(0)
+		t.list(1, thriftStruct, len(g.columns))
+		var compressed int64
+		for i, ch := range g.columns {
+			compressed += ch.compressed
+			t.begin(0)
+			t.i64(2, ch.offset)
+			t.begin(3) // column metadata
+			t.i32(1, pw.cols[i].typ)
+			t.list(2, thriftI32, 2)
+			t.varint(uint64(zigzag(parquetPlain)))
+			t.varint(uint64(zigzag(parquetRLE)))
+			t.list(3, thriftBinary, 1)
+			t.bytes([]byte(pw.cols[i].name))
+			t.i32(4, codec)
+			t.i64(5, g.rows)
+			t.i64(6, ch.uncompressed)
+			t.i64(7, ch.compressed)
+			t.i64(9, ch.offset)
+			t.end()
+			t.end()
+		}
+		t.i64(2, g.size)
+		t.i64(3, g.rows)
+		t.i64(5, g.columns[0].offset)
+		t.i64(6, compressed)
+		t.end()
+	}
+	t.list(5, thriftStruct, 1) // key value metadata
+	t.begin(0)
+	t.binary(1, []byte("storage_engine.version"))
+	t.binary(2, []byte(strconv.FormatUint(version, 10)))
+	t.end()
+	t.binary(6, []byte("storage-engine"))
+	t.stop()
+	t.buf = binary.LittleEndian.AppendUint32(t.buf, uint32(len(t.buf)))
+	t.buf = append(t.buf, PARQUET_MAGIC...)
+	return pw.write(t.buf)
+}
+
+// a Thrift struct of the compact protocol: the fields are a header, the
+// delta of their id from the one before and their type, then the value,
+// integers zigzag varints
+type thriftWriter struct {
+	buf  []byte
+	last int16   // id of the field before
+	outs []int16 // of the structs the one being written is in
+}
+
+func zigzag(v int64) int64 { return v<<1 ^ v>>63 }
+
+func (t *thriftWriter) varint(v uint64) { t.buf = binary.AppendUvarint(t.buf, v) }
+
+func (t *thriftWriter) bytes(b []byte) {
+	t.varint(uint64(len(b)))
+	t.buf = append(t.buf, b...)
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.varint(uint64(zigzag(int64(id))))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(uint64(zigzag(int64(v))))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(uint64(zigzag(v)))
+}
+
+func (t *thriftWriter) binary(id int16, b []byte) {
+	t.field(id, thriftBinary)
+	t.bytes(b)
+}
+
+// a list field, its n elements follow without headers
+func (t *thriftWriter) list(id int16, typ byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|typ)
+	} else {
+		t.buf = append(t.buf, 0xf0|typ)
+		t.varint(uint64(n))
+	}
+}
+
+// a struct field, or an element of a list if id is 0, until end
+func (t *thriftWriter) begin(id int16) {
+	if id > 0 {
+		t.field(id, thriftStruct)
+	}
+	t.outs = append(t.outs, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) end() {
+	t.stop()
+	t.last = t.outs[len(t.outs)-1]
+	t.outs = t.outs[:len(t.outs)-1]
+}
+
+// the end of the fields of a struct
+func (t *thriftWriter) stop() { t.buf = append(t.buf, 0) }
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"testing"
+)
+
+// a reader of the Thrift compact protocol: a struct is a map of its
+// fields by id, a list a slice, the integers int64 and binaries []byte
+type thriftReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		panic("bad varint")
+	}
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case thriftI32, thriftI64:
+		v := r.varint()
+		return int64(v>>1) ^ -int64(v&1)
+	case thriftBinary:
+		n := int(r.varint())
+		b := r.buf[r.pos : r.pos+n]
+		r.pos += n
+		return b
+	case thriftList:
+		h := r.buf[r.pos]
+		r.pos++
+		n, elem := int(h>>4), h&0xf
+		if n == 15 {
+			n = int(r.varint())
+		}
+		list := make([]any, n)
+		for i := range list {
+			list[i] = r.value(elem)
+		}
+		return list
+	case thriftStruct:
+		fields := map[int16]any{}
+		var id int16
+		for {
+			h := r.buf[r.pos]
+			r.pos++
+			if h == 0 {
+				return fields
+			}
+			if delta := int16(h >> 4); delta > 0 {
+				id += delta
+			} else {
+				v := r.varint()
+				id = int16(int64(v>>1) ^ -int64(v&1))
+			}
+			fields[id] = r.value(h & 0xf)
+		}
+	}
+	panic(fmt.Sprintf("thrift type %d", typ))
+}
+
+type parquetFileTest struct {
+	meta    map[int16]any
+	columns [][]any // the values of each column, []byte, int64, float64, bool or nil
+}
+
+// read a file written by ExportParquet, checking its metadata
+func readParquetTest(t *testing.T, file []byte) *parquetFileTest {
+	t.Helper()
+	n := len(file)
+	if string(file[:4]) != PARQUET_MAGIC || string(file[n-4:]) != PARQUET_MAGIC {
+		t.Fatal("bad magic")
+	}
+	size := int(binary.LittleEndian.Uint32(file[n-8:]))
+	meta := (&thriftReader{buf: file[n-8-size : n-8]}).value(thriftStruct).(map[int16]any)
+	schema := meta[2].([]any)[1:]
+	pf := &parquetFileTest{meta: meta, columns: make([][]any, len(schema))}
+	var rows int64
+	for _, g := range meta[4].([]any) {
+		group := g.(map[int16]any)
+		for i, c := range group[1].([]any) {
+			cm := c.(map[int16]any)[3].(map[int16]any)
+			el := schema[i].(map[int16]any)
+			if cm[1] != el[1] {
+				t.Fatalf("column %d of type %d, %d in the schema", i, cm[1], el[1])
+			}
+			offset, values := cm[9].(int64), int64(0)
+			end := offset + cm[7].(int64)
+			for offset < end {
+				r := &thriftReader{buf: file[offset:]}
+				header := r.value(thriftStruct).(map[int16]any)
+				data := file[offset+int64(r.pos) : offset+int64(r.pos)+header[3].(int64)]
+				offset += int64(r.pos) + header[3].(int64)
+				if cm[4].(int64) == parquetGzip {
+					zr, err := gzip.NewReader(bytes.NewReader(data))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if data, err = io.ReadAll(zr); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if int64(len(data)) != header[2].(int64) {
+					t.Fatalf("page of %d bytes, %d in its header", len(data), header[2])
+				}
+				count := header[5].(map[int16]any)[1].(int64)
+				levels := make([]byte, count)
+				if el[3].(int64) == parquetOptional {
+					l := binary.LittleEndian.Uint32(data)
+					runs := data[4 : 4+l]
+					data = data[4+l:]
+					for j := 0; len(runs) > 0; runs = runs[1:] {
+						h, n := binary.Uvarint(runs)
+						runs = runs[n:]
+						for k := 0; k < int(h>>1); k++ {
+							levels[j] = runs[0]
+							j++
+						}
+					}
+				} else {
+					for j := range levels {
+						levels[j] = 1
+					}
+				}
+				bits := 0
+				for j := int64(0); j < count; j++ {
+					var v any
+					switch {
+					case levels[j] == 0:
+					case cm[1].(int64) == parquetByteArray:
+						l := binary.LittleEndian.Uint32(data)
+						v, data = data[4:4+l], data[4+l:]
+					case cm[1].(int64) == parquetInt64:
+						v, data = int64(binary.LittleEndian.Uint64(data)), data[8:]
+					case cm[1].(int64) == parquetDouble:
+						v, data = math.Float64frombits(binary.LittleEndian.Uint64(data)), data[8:]
+					case cm[1].(int64) == parquetBoolean:
+						v = data[0]>>(bits%8)&1 == 1
+						if bits++; bits%8 == 0 {
+							data = data[1:]
+						}
+					}
+					pf.columns[i] = append(pf.columns[i], v)
+				}
+				if bits%8 != 0 {
+					data = data[1:]
+				}
+				if len(data) != 0 {
+					t.Fatalf("%d bytes after the values of a page", len(data))
+				}
+				values += count
+			}
+			if values != group[3].(int64) || values != cm[5].(int64) {
+				t.Fatalf("%d values in a chunk of %d rows", values, group[3])
+			}
+		}
+		rows += group[3].(int64)
+	}
+	if rows != meta[3].(int64) {
+		t.Fatalf("%d rows in the groups, %d in the file", rows, meta[3])
+	}
+	for i := range pf.columns {
+		if len(pf.columns[i]) != int(rows) {
+			t.Fatalf("%d values of column %d in %d rows", len(pf.columns[i]), i, rows)
+		}
+	}
+	return pf
+}
+
+func TestExportParquet(t *testing.T) {
+	const keys = 30000
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < keys; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%06d", i)), []byte(fmt.Sprintf("value %d", i*i)))
+	}
+	b, _ := tx.CreateBucket([]byte("b"))
+	b.Set([]byte("x"), []byte("y"))
+	tx.CreateBucket([]byte("c"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = db.Begin(false)
+	defer tx.Rollback()
+	for _, c := range []struct {
+		name   string
+		opts   ParquetOptions
+		rows   int
+		groups int
+	}{
+		{"gzip", ParquetOptions{Strings: true, PageSize: 10000, RowGroupSize: 100000}, keys, 7},
+		{"uncompressed", ParquetOptions{Uncompressed: true}, keys, 1},
+		{"bucket", ParquetOptions{Bucket: [][]byte{[]byte("b")}}, 1, 1},
+		{"empty", ParquetOptions{Bucket: [][]byte{[]byte("c")}}, 0, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			rows, err := tx.ExportParquet(&buf, c.opts)
+			if err != nil || rows != int64(c.rows) {
+				t.Fatalf("%d rows: %v", rows, err)
+			}
+			pf := readParquetTest(t, buf.Bytes())
+			if groups := len(pf.meta[4].([]any)); groups != c.groups {
+				t.Fatalf("%d row groups", groups)
+			}
+			for i := range pf.columns[0] {
+				key, value := fmt.Sprintf("k%06d", i), fmt.Sprintf("value %d", i*i)
+				if c.opts.Bucket != nil {
+					key, value = "x", "y"
+				}
+				if string(pf.columns[0][i].([]byte)) != key || string(pf.columns[1][i].([]byte)) != value {
+					t.Fatalf("row %d is %q %q", i, pf.columns[0][i], pf.columns[1][i])
+				}
+			}
+			// the schema is the root and the two columns, strings if asked
+			schema := pf.meta[2].([]any)
+			for i, name := range []string{"schema", "key", "value"} {
+				el := schema[i].(map[int16]any)
+				if string(el[4].([]byte)) != name {
+					t.Fatalf("schema element %d is %q", i, el[4])
+				}
+				if _, utf8 := el[6]; i > 0 && utf8 != c.opts.Strings {
+					t.Fatalf("column %s a string %v", name, utf8)
+				}
+			}
+			kv := pf.meta[5].([]any)[0].(map[int16]any)
+			if string(kv[1].([]byte)) != "storage_engine.version" || string(kv[2].([]byte)) != strconv.FormatUint(tx.version, 10) {
+				t.Fatalf("metadata %q=%q", kv[1], kv[2])
+			}
+		})
+	}
+	if _, err := tx.ExportParquet(io.Discard, ParquetOptions{Bucket: [][]byte{[]byte("missing")}}); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("export of a missing bucket: %v", err)
+	}
+	tx.Rollback()
+	if _, err := tx.ExportParquet(io.Discard, ParquetOptions{}); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("export of a closed Tx: %v", err)
+	}
+}
+
+// the rows of a table as its columns, of their types, NULL in the
+// optional ones
+func TestExportParquetTable(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	table, err := tx.CreateTable(Schema{
+		Name: "t",
+		Columns: []Column{
+			{Name: "id", Type: ColumnInt64},
+			{Name: "name", Type: ColumnString, Nullable: true},
+			{Name: "score", Type: ColumnFloat64},
+			{Name: "ok", Type: ColumnBool},
+			{Name: "data", Type: ColumnBytes, Nullable: true},
+		},
+		PrimaryKey: []string{"id"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const rows = 3000
+	for i := 0; i < rows; i++ {
+		r := Row{int64(i - 10), fmt.Sprint("n", i), float64(i) / 4, i%3 == 0, []byte{byte(i)}}
+		if i%7 == 0 {
+			r[1], r[4] = nil, nil
+		}
+		if _, err := table.Insert(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx.Set([]byte("k"), []byte("v"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = db.Begin(false)
+	defer tx.Rollback()
+	for _, opts := range []ParquetOptions{{Table: "t"}, {Table: "t", Uncompressed: true, PageSize: 100, RowGroupSize: 5000}} {
+		var buf bytes.Buffer
+		n, err := tx.ExportParquet(&buf, opts)
+		if err != nil || n != rows {
+			t.Fatalf("%d rows: %v", n, err)
+		}
+		pf := readParquetTest(t, buf.Bytes())
+		if groups := len(pf.meta[4].([]any)); opts.RowGroupSize != 0 && groups < 2 {
+			t.Fatalf("%d row groups", groups)
+		}
+		schema := pf.meta[2].([]any)
+		for i, want := range []struct {
+			name       string
+			typ        int64
+			repetition int64
+			utf8       bool
+		}{
+			{"id", parquetInt64, parquetRequired, false},
+			{"name", parquetByteArray, parquetOptional, true},
+			{"score", parquetDouble, parquetRequired, false},
+			{"ok", parquetBoolean, parquetRequired, false},
+			{"data", parquetByteArray, parquetOptional, false},
+		} {
+			el := schema[i+1].(map[int16]any)
+			if _, utf8 := el[6]; string(el[4].([]byte)) != want.name || el[1] != want.typ || el[3] != want.repetition || utf8 != want.utf8 {
+				t.Fatalf("schema element %d %v", i+1, el)
+			}
+		}
+		for i := 0; i < rows; i++ {
+			want := []any{int64(i - 10), []byte(fmt.Sprint("n", i)), float64(i) / 4, i%3 == 0, []byte{byte(i)}}
+			if i%7 == 0 {
+				want[1], want[4] = nil, nil
+			}
+			for j := range want {
+				if fmt.Sprint(pf.columns[j][i]) != fmt.Sprint(want[j]) {
+					t.Fatalf("row %d column %d is %v, not %v", i, j, pf.columns[j][i], want[j])
+				}
+			}
+		}
+	}
+	if _, err := tx.ExportParquet(io.Discard, ParquetOptions{Table: "missing"}); !errors.Is(err, ErrTableNotFound) {
+		t.Fatalf("export of a missing table: %v", err)
+	}
+	if _, err := tx.ExportParquet(io.Discard, ParquetOptions{Table: "t", Bucket: [][]byte{[]byte("b")}}); err == nil {
+		t.Fatal("export of a table and a bucket")
+	}
+}
+
+func TestThriftWriter(t *testing.T) {
+	var w thriftWriter
+	w.i32(1, -3)
+	w.i64(20, 1<<40)
+	w.binary(21, []byte("x"))
+	w.list(22, thriftI32, 20)
+	for i := 0; i < 20; i++ {
+		w.varint(uint64(zigzag(int64(i))))
+	}
+	w.begin(23)
+	w.i32(2, 7)
+	w.end()
+	w.i32(24, 1)
+	w.stop()
+	got := (&thriftReader{buf: w.buf}).value(thriftStruct)
+	want := "map[1:-3 20:1099511627776 21:[120] 22:[0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19] 23:map[2:7] 24:1]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("decoded %v, want %s", got, want)
+	}
+}
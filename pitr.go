@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// Point-in-time recovery: a backup restored, then the commits after it
+// replayed from the WAL archive of the database backed up, see
+// WithWALArchiveSize, up to a version or a time, the one before a bad commit.
+// Each record of the WAL has the time of its commit, a WAL_OP_TIME op.
+
+// RecoveryTarget is the last commit replayed by RecoverWAL, the zero value
+// replays them all.
+type RecoveryTarget struct {
+	Version uint64    // the version of the last commit replayed, 0 for no limit
+	Time    time.Time // the commits made at that time at the latest, zero for no limit
+}
+
+// RecoverWAL replays into the DB, restored up to version by Restore or
+// RestoreIncremental, the commits after it kept by the WAL segments and the
+// WAL of the database at path, up to target, and returns the version of the
+// last one replayed: the database it was as of the target. The files are
+// read as they are, the database can be open meanwhile; it's another one
+// than the DB. ErrWALGone if the commits after version aren't kept anymore,
+// or if those up to target.Version aren't there yet. The records of an
+// encrypted database are opened with the key of the DB, ErrEncryptionKey if
+// it's another.
+//
+// The commits are applied as they're read, INCREMENTAL_APPLY of them in a
+// Tx begun with ctx: a failed RecoverWAL leaves those before the failure.
+func (db *DB) RecoverWAL(ctx context.Context, path string, version uint64, target RecoveryTarget) (uint64, error) {
+	last := uint64(math.MaxUint64)
+	if target.Version != 0 {
+		if target.Version < version {
+			return 0, fmt.Errorf("%w: target version %d before the version restored %d", ErrBackupChain, target.Version, version)
+		}
+		last = target.Version
+	}
+	var recs []walRecord
+	apply := func() error {
+		err := db.replayRecords(ctx, recs)
+		recs = recs[:0]
+		return err
+	}
+	r := &walReader{version: version}
+	err := readWALArchive(path, r, db.cipher, func(rec walRecord) error {
+		if rec.version > last {
+			return errWALStop
+		}
+		if !target.Time.IsZero() {
+			at, err := recordTime(rec)
+			if err != nil {
+				return err
+			}
+			if at.After(target.Time) {
+				return errWALStop
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		version = rec.version
+		if recs = append(recs, stripReplicated(rec)); len(recs) == INCREMENTAL_APPLY {
+			return apply()
+		}
+		return nil
+	})
+	if err != nil && err != errWALStop {
+		return 0, err
+	}
+	if len(recs) > 0 {
+		if err := apply(); err != nil {
+			return 0, err
+		}
+	}
+	if target.Version != 0 && version < target.Version {
+		return version, fmt.Errorf("%w: WAL ends at version %d", ErrWALGone, version)
+	}
+	return version, nil
+}
+
+// the commits after the version of r in the segments then the WAL of the
+// database at path, read again while the segments change: a checkpoint
+// archives the WAL meanwhile. A segment removed is a gap that r.resolve
+// finds. The sealed records are opened with the cipher.
+func readWALArchive(path string, r *walReader, c *pageCipher, fn func(rec walRecord) error) error {
+	versions, err := walSegments(path)
+	if err != nil {
+		return err
+	}
+	for {
+		from := r.version
+		var names []string
+		for _, v := range versions {
+			if v > r.version {
+				names = append(names, walSegmentPath(path, v))
+			}
+		}
+		names = append(names, walPath(path))
+		for i, name := range names {
+			err := readWALFile(name, c, func(rec walRecord) error {
+				rec, ok, err := r.resolve(rec, math.MaxUint64)
+				if err != nil || !ok {
+					return err
+				}
+				r.version = rec.version
+				return fn(rec)
+			})
+			if errors.Is(err, os.ErrNotExist) && i < len(names)-1 {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		last := versions
+		if versions, err = walSegments(path); err != nil {
+			return err
+		}
+		if r.version == from && len(versions) == len(last) && (len(last) == 0 || versions[len(versions)-1] == last[len(last)-1]) {
+			return nil
+		}
+	}
+}
+
+// the records of a WAL file, up to its end or a torn record, opened with
+// the cipher if sealed
+func readWALFile(name string, c *pageCipher, fn func(rec walRecord) error) error {
+	fp, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	var header [WAL_HEADER]byte
+	if _, err := fp.ReadAt(header[:], 0); err != nil {
+		return fmt.Errorf("%w: %s", ErrBadWAL, name)
+	}
+	switch string(header[:8]) {
+	case WAL_SIG:
+		c = nil
+	case WAL_SIG_SEALED:
+		if c == nil {
+			return fmt.Errorf("%w: %s is sealed, the database isn't encrypted", ErrEncryptionKey, name)
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrBadWAL, name)
+	}
+	_, err = readWALRecords(fp, WAL_HEADER, fi.Size(), c, func(rec walRecord, next int64) error {
+		return fn(rec)
+	})
+	return err
+}
+
+// apply commits in a Tx begun with ctx
+func (db *DB) replayRecords(ctx context.Context, recs []walRecord) error {
+	tx, err := db.BeginContext(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, rec := range recs {
+		if err := tx.replay(rec.ops); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// the op of the time of a commit
+func commitTime(at time.Time) walOp {
+	return walOp{kind: WAL_OP_TIME, value: binary.BigEndian.AppendUint64(nil, uint64(at.UnixNano()))}
+}
+
+// the time of a commit, of its last op
+func recordTime(rec walRecord) (time.Time, error) {
+	if n := len(rec.ops); n > 0 && rec.ops[n-1].kind == WAL_OP_TIME {
+		op := rec.ops[n-1]
+		if len(op.value) != 8 {
+			return time.Time{}, fmt.Errorf("%w: commit time of %d bytes", ErrBadWAL, len(op.value))
+		}
+		return time.Unix(0, int64(binary.BigEndian.Uint64(op.value))), nil
+	}
+	return time.Time{}, fmt.Errorf("%w: commit %d logged without its time", ErrBadWAL, rec.version)
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// a backup restored, the commits after it replayed up to the one before a
+// bad commit, by version or by time
+func TestRecoverWAL(t *testing.T) {
+	src := openTest(t, WithWALArchiveSize(1<<30), WithCheckpointSize(64<<10))
+	for i := 0; i < 50; i++ {
+		writeReplicated(t, src, i)
+	}
+	tx, _ := src.Begin(false)
+	var full bytes.Buffer
+	tx.WriteBackup(&full)
+	base := tx.Version()
+	tx.Rollback()
+	for i := 50; i < 1500; i++ {
+		writeReplicated(t, src, i)
+	}
+	// a commit of 2PC is logged by its prepare and its commit
+	tx, _ = src.Begin(true)
+	tx.Set([]byte("prepared"), []byte("x"))
+	if err := tx.Prepare("id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.CommitPrepared("id"); err != nil {
+		t.Fatal(err)
+	}
+	good := dumpTest(t, src)
+	tx, _ = src.Begin(false)
+	target := tx.Version()
+	tx.Rollback()
+	time.Sleep(10 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	tx, _ = src.Begin(true)
+	for i := 0; i < 1500; i++ {
+		tx.Del([]byte(fmt.Sprintf("k%05d", i)))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	src.Checkpoint()
+	mustSet(t, src, "after", "x")
+	if segments, _ := walSegments(src.Path); len(segments) < 2 {
+		t.Fatalf("%d segments archived", len(segments))
+	}
+
+	restore := func() *DB {
+		t.Helper()
+		db := openTest(t)
+		if v, err := db.Restore(context.Background(), bytes.NewReader(full.Bytes())); err != nil || v != base {
+			t.Fatalf("restored version %d of %d: %v", v, base, err)
+		}
+		return db
+	}
+	for name, rt := range map[string]RecoveryTarget{"version": {Version: target}, "time": {Time: at}} {
+		db := restore()
+		v, err := db.RecoverWAL(context.Background(), src.Path, base, rt)
+		if err != nil || v != target {
+			t.Fatalf("recovered up to the %s: version %d of %d: %v", name, v, target, err)
+		}
+		if got := dumpTest(t, db); got != good {
+			t.Fatalf("recovered up to the %s\n%s\nwant\n%s", name, got, good)
+		}
+	}
+	db := restore()
+	v, err := db.RecoverWAL(context.Background(), src.Path, base, RecoveryTarget{})
+	if err != nil || v != target+2 {
+		t.Fatalf("recovered version %d of %d: %v", v, target+2, err)
+	}
+	wantSameDB(t, src, db)
+
+	if _, err := db.RecoverWAL(context.Background(), src.Path, v, RecoveryTarget{Version: v + 10}); !errors.Is(err, ErrWALGone) {
+		t.Fatalf("recovery up to a version not logged: %v", err)
+	}
+	if _, err := db.RecoverWAL(context.Background(), src.Path, v, RecoveryTarget{Version: v - 1}); !errors.Is(err, ErrBackupChain) {
+		t.Fatalf("recovery up to a version before the one restored: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := restore().RecoverWAL(ctx, src.Path, base, RecoveryTarget{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("recovery with ctx done: %v", err)
+	}
+
+	// the commits after the backup pruned from the archive
+	src = reopenTest(t, src, WithWALArchiveSize(1))
+	mustSet(t, src, "a", "1")
+	src.Checkpoint()
+	if _, err := restore().RecoverWAL(context.Background(), src.Path, base, RecoveryTarget{}); !errors.Is(err, ErrWALGone) {
+		t.Fatalf("recovery of pruned commits: %v", err)
+	}
+}
+
+func TestRecordTime(t *testing.T) {
+	now := time.Now()
+	rec := walRecord{version: 1, ops: []walOp{{kind: WAL_OP_SET, key: []byte("k")}, commitTime(now)}}
+	if at, err := recordTime(rec); err != nil || !at.Equal(time.Unix(0, now.UnixNano())) {
+		t.Fatalf("time %v of %v: %v", at, now, err)
+	}
+	rec.ops = rec.ops[:1]
+	if _, err := recordTime(rec); !errors.Is(err, ErrBadWAL) {
+		t.Fatalf("time of a commit without it: %v", err)
+	}
+	rec.ops = []walOp{{kind: WAL_OP_TIME, value: []byte{1}}}
+	if _, err := recordTime(rec); !errors.Is(err, ErrBadWAL) {
+		t.Fatalf("time of 1 byte: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotPrepared = errors.New("no prepared transaction with this id")
+	ErrBadPrepare  = errors.New("bad prepared transaction id")
+	ErrInDoubt     = errors.New("prepared transaction in doubt")
+)
+
+// Two-phase commit: Prepare makes the updates of a Tx durable without
+// publishing them, the Tx is then sure to commit if asked to. The outcome
+// decided by the coordinator is applied with CommitPrepared or
+// RollbackPrepared, even after a restart: Open recovers the prepared Tx
+// from the WAL, in doubt until the coordinator resolves it.
+//
+// A prepared Tx keeps the writer lock, Begin(true) and the commits of
+// optimistic transactions wait until it's resolved, readers go on. So at
+// most one Tx is prepared at a time. Checkpoint and Close don't wait for
+// it, the prepared Tx stays in the WAL.
+//
+// The one recovered by Open has no coordinator in the process to resolve
+// it, so the writers don't wait for it: they fail with ErrInDoubt until
+// CommitPrepared or RollbackPrepared is called, see Prepared.
+
+type preparedTx struct {
+	id      string
+	tx      *Tx       // holds the writer lock and the updated tree
+	record  walRecord // as logged, appended again by checkpoints
+	inDoubt bool      // recovered by Open
+}
+
+// Prepare makes the updates of the Tx durable under the given id, the
+// transaction of the coordinator. The Tx can't be used afterwards, see
+// CommitPrepared and RollbackPrepared. An optimistic Tx fails with
+// ErrConflict like Commit, nothing is prepared then.
+func (tx *Tx) Prepare(id string) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if id == "" || len(id) > maxKeySize(tx.db.nodeSize()) {
+		return ErrBadPrepare
+	}
+	if !tx.optimistic {
+		return tx.prepare(id)
+	}
+	defer tx.close()
+	latest, err := tx.applyOptimistic()
+	if err != nil {
+		return err
+	}
+	return latest.prepare(id)
+}
+
+// the caller holds the writer lock, kept by the prepared Tx
+func (tx *Tx) prepare(id string) error {
+	db := tx.db
+	if err := tx.audit(); err != nil {
+		tx.close()
+		return err
+	}
+	rec := walRecord{version: tx.version + 1}
+	rec.ops = append(rec.ops, walOp{kind: WAL_OP_PREPARE, key: []byte(id)})
+	rec.ops = append(rec.ops, tx.ops...)
+	if err := db.logPrepared(rec); err != nil {
+		tx.close()
+		return err
+	}
+	tx.done = true
+	db.prepareMu.Lock()
+	db.prepared = &preparedTx{id: id, tx: tx, record: rec}
+	db.prepareMu.Unlock()
+	return nil
+}
+
+// append a record of 2PC and wait until it's durable, on its own since no
+// commit can share the fsync: the writer lock is held
+func (db *DB) logPrepared(rec walRecord) error {
+	if err := db.failed(); err != nil {
+		return err
+	}
+	if err := db.wal.append(rec); err != nil {
+		return err
+	}
+	if err := db.fsync(db.wal.fp); err != nil {
+		err = fmt.Errorf("fsync WAL: %w", err)
+		db.poison(err)
+		return err
+	}
+	return nil
+}
+
+// Prepared returns the ids of the prepared transactions not resolved yet.
+func (db *DB) Prepared() []string {
+	db.prepareMu.Lock()
+	defer db.prepareMu.Unlock()
+	if db.prepared == nil {
+		return nil
+	}
+	return []string{db.prepared.id}
+}
+
+// CommitPrepared commits the Tx prepared under the given id. It returns
+// once the commit is durable, like Commit.
+func (db *DB) CommitPrepared(id string) error {
+	p, err := db.takePrepared(id)
+	if err != nil {
+		return err
+	}
+	return p.tx.commit([]walOp{{kind: WAL_OP_COMMIT_PREPARED, key: []byte(id)}})
+}
+
+// RollbackPrepared discards the Tx prepared under the given id.
+func (db *DB) RollbackPrepared(id string) error {
+	p, err := db.takePrepared(id)
+	if err != nil {
+		return err
+	}
+	defer p.tx.close()
+	return db.logPrepared(walRecord{
+		version: p.record.version,
+		ops:     []walOp{{kind: WAL_OP_ROLLBACK_PREPARED, key: []byte(id)}},
+	})
+}
+
+// forget the prepared Tx, its writer lock goes to the caller
+func (db *DB) takePrepared(id string) (*preparedTx, error) {
+	db.prepareMu.Lock()
+	defer db.prepareMu.Unlock()
+	if db.closed.Load() {
+		return nil, ErrDBClosed
+	}
+	p := db.prepared
+	if p == nil || p.id != id {
+		return nil, ErrNotPrepared
+	}
+	db.prepared = nil
+	return p, nil
+}
+
+// take the writer lock, or borrow it from the prepared Tx holding it,
+// the returned function gives it back
+func (db *DB) lockWriter() func() {
+	unlock, _ := db.lockWriterContext(context.Background())
+	return unlock
+}
+
+// lockWriter unless ctx is done first
+func (db *DB) lockWriterContext(ctx context.Context) (func(), error) {
+	db.prepareMu.Lock()
+	if db.prepared != nil {
+		return db.prepareMu.Unlock, nil
+	}
+	db.prepareMu.Unlock()
+	if err := lockContext(ctx, &db.writer); err != nil {
+		return nil, err
+	}
+	return db.writer.Unlock, nil
+}
+
+// prepare again the Tx found in doubt by the recovery
+func (db *DB) restorePrepared(rec walRecord) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	if err := tx.replay(rec.ops[1:]); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if tx.version+1 != rec.version {
+		tx.Rollback()
+		return fmt.Errorf("%w: prepared record %d follows version %d", ErrBadWAL, rec.version, tx.version)
+	}
+	tx.done = true
+	db.prepared = &preparedTx{id: string(rec.ops[0].key), tx: tx, record: rec, inDoubt: true}
+	return nil
+}
+
+// the writers fail rather than wait for the prepared Tx recovered by Open
+func (db *DB) checkInDoubt() error {
+	db.prepareMu.Lock()
+	defer db.prepareMu.Unlock()
+	if p := db.prepared; p != nil && p.inDoubt {
+		return fmt.Errorf("%w: %q holds the writer lock until it's committed or rolled back", ErrInDoubt, p.id)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPrepare(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "a", "0")
+	tx, _ := db.Begin(true)
+	tx.Set([]byte("a"), []byte("1"))
+	if err := tx.Prepare("g1"); err != nil {
+		t.Fatal(err)
+	}
+	wantValue(t, db, "a", []byte("0"))
+	if err := tx.Commit(); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("commit of a prepared Tx: %v", err)
+	}
+	if p := db.Prepared(); len(p) != 1 || p[0] != "g1" {
+		t.Fatalf("prepared %q", p)
+	}
+	// the writers wait for the coordinator of the process
+	done := make(chan error)
+	go func() { done <- db.Set([]byte("b"), []byte("x")) }()
+	select {
+	case err := <-done:
+		t.Fatalf("set while a Tx is prepared: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err := db.CommitPrepared("g2"); !errors.Is(err, ErrNotPrepared) {
+		t.Fatalf("commit of an unknown id: %v", err)
+	}
+	if err := db.CommitPrepared("g1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	wantValue(t, db, "a", []byte("1"))
+	wantValue(t, db, "b", []byte("x"))
+	if len(db.Prepared()) != 0 {
+		t.Fatalf("prepared %q after the commit", db.Prepared())
+	}
+}
+
+func TestPrepareBadID(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	if err := tx.Prepare(""); !errors.Is(err, ErrBadPrepare) {
+		t.Fatalf("prepare with no id: %v", err)
+	}
+	r, _ := db.Begin(false)
+	defer r.Rollback()
+	if err := r.Prepare("g1"); !errors.Is(err, ErrTxNotWritable) {
+		t.Fatalf("prepare of a read-only Tx: %v", err)
+	}
+}
+
+// a crash leaves the prepared Tx in doubt, the writers fail until it's
+// resolved instead of waiting forever
+func TestPrepareInDoubt(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "a", "0")
+	tx, _ := db.Begin(true)
+	tx.Set([]byte("a"), []byte("1"))
+	if err := tx.Prepare("g1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	crashTest(db)
+
+	db = openTestPath(t, db.Path)
+	if p := db.Prepared(); len(p) != 1 || p[0] != "g1" {
+		t.Fatalf("prepared %q after the crash", p)
+	}
+	wantValue(t, db, "a", []byte("0"))
+	failed := make(chan error, 4)
+	go func() {
+		_, err := db.Begin(true)
+		failed <- err
+		failed <- db.Set([]byte("b"), []byte("x"))
+		failed <- db.Update(func(tx *Tx) error { return tx.Set([]byte("b"), []byte("x")) })
+		_, err = db.Exec("CREATE TABLE t (id INT PRIMARY KEY)")
+		failed <- err
+	}()
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-failed:
+			if !errors.Is(err, ErrInDoubt) {
+				t.Fatalf("write %d with a Tx in doubt: %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("write %d blocked by the Tx in doubt", i)
+		}
+	}
+	if r, err := db.Begin(false); err != nil {
+		t.Fatalf("read with a Tx in doubt: %v", err)
+	} else {
+		r.Rollback()
+	}
+
+	// still in doubt after a clean restart
+	db = reopenTest(t, db)
+	if err := db.Set([]byte("b"), []byte("x")); !errors.Is(err, ErrInDoubt) {
+		t.Fatalf("set after a restart: %v", err)
+	}
+	if err := db.CommitPrepared("g1"); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "b", "x")
+	wantValue(t, db, "a", []byte("1"))
+
+	crashTest(db)
+	db = openTestPath(t, db.Path)
+	wantValue(t, db, "a", []byte("1"))
+	wantValue(t, db, "b", []byte("x"))
+	if len(db.Prepared()) != 0 {
+		t.Fatalf("prepared %q after the commit", db.Prepared())
+	}
+}
+
+func TestPrepareRollbackInDoubt(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.BeginTx(TxOptions{Writable: true})
+	tx.Set([]byte("c"), []byte("1"))
+	if err := tx.Prepare("g3"); err != nil {
+		t.Fatal(err)
+	}
+	crashTest(db)
+	db = openTestPath(t, db.Path)
+	if err := db.RollbackPrepared("g3"); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "d", "1")
+	crashTest(db)
+	db = openTestPath(t, db.Path)
+	wantValue(t, db, "c", nil)
+	wantValue(t, db, "d", []byte("1"))
+	if len(db.Prepared()) != 0 {
+		t.Fatalf("prepared %q after the rollback", db.Prepared())
+	}
+}
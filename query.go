@@ -0,0 +1,1621 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Query execution: a statement of ParseSQL runs in a Tx. The WHERE of a
+// SELECT, UPDATE or DELETE is split into its AND terms, those comparing a
+// column to a constant choose how the rows are read: by primary key if all
+// its columns are equal to constants, else by the primary key or the index
+// with the most columns equal to constants in front, then a range of the
+// next one, else all the rows. The WHERE is evaluated on each row read.
+// The rows of an ORDER BY of columns are read in its order, forward or
+// reverse, from the primary key or an index that has it, not sorted, then
+// only up to the LIMIT.
+//
+// NULL is as in SQL: a comparison or an operation with NULL is NULL, and a
+// row is kept where the WHERE is TRUE. The numbers compare as numbers, an
+// int64 and a float64 as float64s; the other types only with their own.
+
+var ErrSQL = errors.New("SQL error")
+
+// Result is the result of a statement.
+type Result struct {
+	Columns      []string // of the rows of a SELECT
+	Rows         [][]any
+	RowsAffected int64 // rows inserted, updated or deleted
+	LastInsertID int64 // value of the AUTO_INCREMENT column of the last row inserted, 0 if none
+}
+
+// Exec parses and runs a statement of ParseSQL, with the values of its
+// parameters: int64, float64, string, []byte, bool or nil, the other ints
+// are int64s and a float32 a float64. The Tx must be from Begin.
+func (tx *Tx) Exec(query string, args ...any) (*Result, error) {
+	stmt, err := ParseSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	return tx.ExecStatement(stmt, args...)
+}
+
+// Exec runs a statement in a Tx of its own, read-only for a SELECT.
+func (db *DB) Exec(query string, args ...any) (*Result, error) {
+	stmt, err := ParseSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	return db.execStatement(stmt, args, nil)
+}
+
+// run a statement in a Tx of its own, with the plans of a PreparedStmt
+func (db *DB) execStatement(stmt Statement, args []any, plans *planRecorder) (*Result, error) {
+	_, read := stmt.(*SelectStmt)
+	if _, ok := stmt.(*ExplainStmt); ok {
+		read = true
+	}
+	tx, err := db.Begin(!read)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	tx.sqlPlans = plans
+	res, err := tx.ExecStatement(stmt, args...)
+	if err != nil || read {
+		return res, err
+	}
+	return res, tx.Commit()
+}
+
+// ExecStatement runs a statement of ParseSQL, see Exec.
+func (tx *Tx) ExecStatement(stmt Statement, args ...any) (*Result, error) {
+	args, err := bindArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	switch s := stmt.(type) {
+	case *CreateTableStmt:
+		_, err := tx.CreateTable(s.Schema)
+		return &Result{}, err
+	case *CreateIndexStmt:
+		t, err := tx.Table(s.Table)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{}, t.CreateIndex(s.Index)
+	case *AlterTableStmt:
+		t, err := tx.Table(s.Table)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{}, t.AddColumn(s.Add)
+	case *DropTableStmt:
+		return &Result{}, tx.DropTable(s.Table)
+	case *DropIndexStmt:
+		t, err := tx.Table(s.Table)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{}, t.DropIndex(s.Index)
+	case *InsertStmt:
+		return tx.execInsert(s, args)
+	case *SelectStmt:
+		return tx.execSelect(s, args)
+	case *UpdateStmt:
+		return tx.execUpdate(s, args)
+	case *DeleteStmt:
+		return tx.execDelete(s, args)
+	case *ExplainStmt:
+		return tx.explain(s.Stmt, args)
+	}
+	return nil, fmt.Errorf("%w: statement %T", ErrSQL, stmt)
+}
+
+func (tx *Tx) execInsert(s *InsertStmt, args []any) (*Result, error) {
+	t, err := tx.Table(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	columns := t.schema.Columns
+	cols := make([]int, len(columns))
+	for i := range cols {
+		cols[i] = i
+	}
+	if s.Columns != nil {
+		cols = cols[:0]
+		for _, name := range s.Columns {
+			i := columnIndex(columns, name)
+			if i < 0 {
+				return nil, fmt.Errorf("%w: no column %q in %q", ErrSQL, name, s.Table)
+			}
+			cols = append(cols, i)
+		}
+	}
+	res := &Result{}
+	for _, values := range s.Rows {
+		if len(values) != len(cols) {
+			return nil, fmt.Errorf("%w: %d values for %d columns", ErrSQL, len(values), len(cols))
+		}
+		// the columns not inserted have their default
+		row := make(Row, len(columns))
+		for i, c := range columns {
+			row[i] = c.Default
+		}
+		for i, e := range values {
+			eval, err := compileExpr(e, &sqlScope{}, args)
+			if err != nil {
+				return nil, err
+			}
+			v, err := eval(nil)
+			if err != nil {
+				return nil, err
+			}
+			row[cols[i]] = coerceValue(columns[cols[i]], v)
+		}
+		id, err := t.Insert(row)
+		if err != nil {
+			return nil, err
+		}
+		res.RowsAffected++
+		res.LastInsertID = id
+	}
+	return res, nil
+}
+
+func (tx *Tx) execSelect(s *SelectStmt, args []any) (*Result, error) {
+	limit, offset := int64(-1), int64(0)
+	var err error
+	if s.Limit != nil {
+		if limit, err = constCount(s.Limit, args, "LIMIT"); err != nil {
+			return nil, err
+		}
+	}
+	if s.Offset != nil {
+		if offset, err = constCount(s.Offset, args, "OFFSET"); err != nil {
+			return nil, err
+		}
+	}
+	if isAggregate(s) {
+		return tx.execAggregate(s, limit, offset, args)
+	}
+	scope, plans, where, err := tx.planSelect(s, s.OrderBy, limit >= 0, args)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	var evals []sqlEval
+	for _, c := range s.Columns {
+		if c.Star {
+			for _, t := range scope.tables {
+				for i, col := range t.columns {
+					i := t.offset + i
+					res.Columns = append(res.Columns, col.Name)
+					evals = append(evals, func(row []any) (any, error) { return row[i], nil })
+				}
+			}
+			continue
+		}
+		eval, err := compileExpr(c.Expr, scope, args)
+		if err != nil {
+			return nil, err
+		}
+		name := c.Alias
+		if name == "" {
+			name = exprString(c.Expr)
+		}
+		res.Columns = append(res.Columns, name)
+		evals = append(evals, eval)
+	}
+	var orders []sqlEval
+	if !plans[0].ordered {
+		for _, o := range s.OrderBy {
+			eval, err := compileOrder(o.Expr, scope, res.Columns, evals, args)
+			if err != nil {
+				return nil, err
+			}
+			orders = append(orders, eval)
+		}
+	}
+
+	var rows []sortedRow
+	// without a sort the rows come in the order of the scan, it stops at
+	// the limit
+	full := errors.New("limit")
+	err = scanJoin(plans, nil, func(row []any) error {
+		if where != nil {
+			v, err := where(row)
+			if err != nil || v != true {
+				return err
+			}
+		}
+		r, err := evalRow(row, evals, orders)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, r)
+		if orders == nil && limit >= 0 && int64(len(rows)) >= offset+limit {
+			return full
+		}
+		return nil
+	})
+	if err != nil && err != full {
+		return nil, err
+	}
+	if orders != nil {
+		if err := sortRows(rows, s.OrderBy); err != nil {
+			return nil, err
+		}
+	}
+	res.Rows = pageRows(rows, limit, offset)
+	return res, nil
+}
+
+// a row of a result and the values of its ORDER BY
+type sortedRow struct {
+	out  []any
+	keys []any
+}
+
+func evalRow(row []any, evals, orders []sqlEval) (sortedRow, error) {
+	r := sortedRow{out: make([]any, len(evals))}
+	for i, eval := range evals {
+		v, err := eval(row)
+		if err != nil {
+			return r, err
+		}
+		r.out[i] = v
+	}
+	for _, eval := range orders {
+		v, err := eval(row)
+		if err != nil {
+			return r, err
+		}
+		r.keys = append(r.keys, v)
+	}
+	return r, nil
+}
+
+func sortRows(rows []sortedRow, order []OrderTerm) error {
+	var err error
+	sort.SliceStable(rows, func(i, j int) bool {
+		for k, o := range order {
+			c, cerr := compareValues(rows[i].keys[k], rows[j].keys[k])
+			if cerr != nil && err == nil {
+				err = cerr
+			}
+			if c != 0 {
+				return c < 0 != o.Desc
+			}
+		}
+		return false
+	})
+	return err
+}
+
+// the rows of the OFFSET and LIMIT, -1 for none
+func pageRows(rows []sortedRow, limit, offset int64) [][]any {
+	if offset >= int64(len(rows)) {
+		rows = nil
+	} else {
+		rows = rows[offset:]
+	}
+	if limit >= 0 && limit < int64(len(rows)) {
+		rows = rows[:limit]
+	}
+	out := make([][]any, len(rows))
+	for i, r := range rows {
+		out[i] = r.out
+	}
+	return out
+}
+
+func (tx *Tx) execUpdate(s *UpdateStmt, args []any) (*Result, error) {
+	t, err := tx.Table(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	scope := tableScope(t)
+	p, err := planScan(t, scope, 0, s.Where, nil, false, nil, args)
+	if err != nil {
+		return nil, err
+	}
+	type assignment struct {
+		col  int
+		eval sqlEval
+	}
+	var set []assignment
+	keyChanged := false
+	for _, a := range s.Set {
+		i := columnIndex(t.schema.Columns, a.Column)
+		if i < 0 {
+			return nil, fmt.Errorf("%w: no column %q in %q", ErrSQL, a.Column, s.Table)
+		}
+		eval, err := compileExpr(a.Value, scope, args)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, assignment{i, eval})
+		for _, k := range t.key {
+			keyChanged = keyChanged || k == i
+		}
+	}
+	// the rows are read, then updated
+	var olds, news []Row
+	err = p.scan(nil, func(key []byte, row []any) error {
+		updated := append(Row(nil), row...)
+		for _, a := range set {
+			v, err := a.eval(row)
+			if err != nil {
+				return err
+			}
+			updated[a.col] = coerceValue(t.schema.Columns[a.col], v)
+		}
+		olds, news = append(olds, row), append(news, updated)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	if keyChanged {
+		// the rows moved are deleted first, so that they can take the
+		// keys of each other, not those referencing them
+		for _, row := range olds {
+			if _, err := t.delete(t.keyOf(row), false); err != nil {
+				return nil, err
+			}
+		}
+		for _, row := range news {
+			if _, err := t.Insert(row); err != nil {
+				return nil, err
+			}
+			res.RowsAffected++
+		}
+		return res, nil
+	}
+	for _, row := range news {
+		if err := t.Update(row); err != nil {
+			return nil, err
+		}
+		res.RowsAffected++
+	}
+	return res, nil
+}
+
+func (tx *Tx) execDelete(s *DeleteStmt, args []any) (*Result, error) {
+	t, err := tx.Table(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	p, err := planScan(t, tableScope(t), 0, s.Where, nil, false, nil, args)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]any
+	err = p.scan(nil, func(key []byte, row []any) error {
+		keys = append(keys, t.keyOf(row))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	for _, key := range keys {
+		deleted, err := t.Delete(key...)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			res.RowsAffected++
+		}
+	}
+	return res, nil
+}
+
+// the value of LIMIT or OFFSET
+func constCount(e Expr, args []any, what string) (int64, error) {
+	eval, err := compileExpr(e, &sqlScope{}, args)
+	if err != nil {
+		return 0, err
+	}
+	v, err := eval(nil)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("%w: %s of %v", ErrSQL, what, v)
+	}
+	return n, nil
+}
+
+// an int64 for a float64 column is converted
+func coerceValue(c Column, v any) any {
+	if i, ok := v.(int64); ok && c.Type == ColumnFloat64 {
+		return float64(i)
+	}
+	return v
+}
+
+func columnIndex(columns []Column, name string) int {
+	for i, c := range columns {
+		if c.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Plans: how the rows of a table are read for a WHERE.
+
+type accessPath int
+
+const (
+	accessFull      accessPath = iota // all the rows
+	accessKey                         // the row of a primary key
+	accessKeyRange                    // a range of primary keys
+	accessIndex                       // a range of an index
+	accessIndexOnly                   // a range of an index covering the columns read, see covering.go
+)
+
+func (a accessPath) String() string {
+	switch a {
+	case accessKey:
+		return "key lookup"
+	case accessKeyRange:
+		return "key range scan"
+	case accessIndex:
+		return "index scan"
+	case accessIndexOnly:
+		return "index only scan"
+	}
+	return "full scan"
+}
+
+// the plan of a statement as the rows of a Result, one for each table, or
+// each MIN and MAX read from the first key: the table, how its rows are
+// read, the index if any, whether from the last key, the rows read, counted
+// from the keys of the plan without reading the rows, at most those of the
+// LIMIT if not sorted, NULL for a table joined by the values of the rows
+// before, and whether they're sorted after
+func (tx *Tx) explain(stmt Statement, args []any) (*Result, error) {
+	var plans []*scanPlan
+	var names []string
+	var name string
+	var where Expr
+	limit := int64(-1)
+	sorted, seeks := false, false
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		if s.Limit != nil {
+			offset := int64(0)
+			var err error
+			if limit, err = constCount(s.Limit, args, "LIMIT"); err != nil {
+				return nil, err
+			}
+			if s.Offset != nil {
+				if offset, err = constCount(s.Offset, args, "OFFSET"); err != nil {
+					return nil, err
+				}
+			}
+			limit += offset
+		}
+		if isAggregate(s) {
+			q, err := tx.planAggregate(s, args)
+			if err != nil {
+				return nil, err
+			}
+			plans, sorted, limit = q.plans, s.OrderBy != nil, -1
+			for _, t := range q.scope.tables {
+				names = append(names, t.name)
+			}
+			if q.seeks != nil {
+				plans, seeks, names = q.seeks, true, nil
+				for range plans {
+					names = append(names, q.scope.tables[0].name)
+				}
+			}
+			break
+		}
+		scope, levels, _, err := tx.planSelect(s, s.OrderBy, limit >= 0, args)
+		if err != nil {
+			return nil, err
+		}
+		plans = levels
+		for _, t := range scope.tables {
+			names = append(names, t.name)
+		}
+		sorted = s.OrderBy != nil && !levels[0].ordered
+	case *UpdateStmt:
+		name, where = s.Table, s.Where
+	case *DeleteStmt:
+		name, where = s.Table, s.Where
+	default:
+		return nil, fmt.Errorf("%w: EXPLAIN of %T", ErrSQL, stmt)
+	}
+	if plans == nil {
+		t, err := tx.Table(name)
+		if err != nil {
+			return nil, err
+		}
+		p, err := planScan(t, tableScope(t), 0, where, nil, false, nil, args)
+		if err != nil {
+			return nil, err
+		}
+		plans, names = []*scanPlan{p}, []string{name}
+	}
+	res := &Result{Columns: []string{"table", "access", "index", "reverse", "rows", "sort"}}
+	for i, p := range plans {
+		var rows, index any
+		if !p.joined {
+			n, err := p.count()
+			if err != nil {
+				return nil, err
+			}
+			if seeks {
+				n = min(n, 1)
+			} else if i == 0 && !sorted && limit >= 0 {
+				n = min(n, limit)
+			}
+			rows = n
+		}
+		if p.index != nil {
+			index = p.index.Name
+		}
+		res.Rows = append(res.Rows, []any{names[i], p.access.String(), index, p.reverse, rows, i == 0 && sorted})
+	}
+	return res, nil
+}
+
+// Joins: the rows of the tables of a SELECT are read in nested loops, those
+// of a table joined for each row of the tables before it, the row of a
+// join their columns one after the other. The terms of the ON of a table
+// and of the WHERE with its columns and those before it choose how its
+// rows are read, as for a table alone, the columns of the tables before it
+// as constants: a term t.a = s.b reads the rows of a of an index of t for
+// each row of s, the others all the rows for each. The terms of the WHERE
+// with the columns of a table of a LEFT JOIN are evaluated on the rows
+// joined, with the NULLs of that table.
+
+// the scope of a SELECT, the plans of its tables, the first in the order
+// if any, and the terms of the WHERE evaluated on the rows joined, nil for
+// none
+func (tx *Tx) planSelect(s *SelectStmt, order []OrderTerm, limited bool, args []any) (*sqlScope, []*scanPlan, sqlEval, error) {
+	scope := &sqlScope{}
+	var tables []*Table
+	joins := append([]Join{{Table: s.From, As: s.As}}, s.Joins...)
+	for _, j := range joins {
+		t, err := tx.Table(j.Table)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		name := j.As
+		if name == "" {
+			name = j.Table
+		}
+		for _, other := range scope.tables {
+			if other.name == name {
+				return nil, nil, nil, fmt.Errorf("%w: table %q twice in FROM", ErrSQL, name)
+			}
+		}
+		scope.tables = append(scope.tables, scopeTable{name: name, columns: t.schema.Columns, offset: scope.width()})
+		tables = append(tables, t)
+	}
+	// the terms of each table, the rest after the joins
+	terms := make([][]Expr, len(tables))
+	for i, j := range joins[1:] {
+		terms[i+1] = conjuncts(j.On)
+	}
+	var rest []Expr
+	if s.Where != nil {
+		for _, term := range conjuncts(s.Where) {
+			i, err := scope.lastTable(term)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if i > 0 && joins[i].Left {
+				rest = append(rest, term)
+			} else {
+				terms[i] = append(terms[i], term)
+			}
+		}
+	}
+	var plans []*scanPlan
+	read := selectColumns(s, scope)
+	for i, t := range tables {
+		var ordered []OrderTerm
+		if i == 0 {
+			ordered = order
+		}
+		offset := scope.tables[i].offset
+		p, err := planScan(t, scope, offset, andExpr(terms[i]), ordered, limited && i == 0, read[offset:offset+len(t.schema.Columns)], args)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		p.left = joins[i].Left
+		plans = append(plans, p)
+	}
+	var where sqlEval
+	if rest != nil {
+		var err error
+		if where, err = compileExpr(andExpr(rest), scope, args); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return scope, plans, where, nil
+}
+
+// call fn with the rows joined of the plans after the row outer of those
+// before them
+func scanJoin(plans []*scanPlan, outer []any, fn func(row []any) error) error {
+	p := plans[0]
+	next := func(row []any) error {
+		if len(plans) == 1 {
+			return fn(row)
+		}
+		return scanJoin(plans[1:], row, fn)
+	}
+	found := false
+	err := p.scan(outer, func(key []byte, row []any) error {
+		found = true
+		return next(row)
+	})
+	if err != nil || found || !p.left {
+		return err
+	}
+	return next(append(outer[:len(outer):len(outer)], make([]any, len(p.table.schema.Columns))...))
+}
+
+// the AND of terms, nil for none
+func andExpr(terms []Expr) Expr {
+	var e Expr
+	for _, term := range terms {
+		if e == nil {
+			e = term
+		} else {
+			e = &BinaryExpr{Op: "AND", X: e, Y: term}
+		}
+	}
+	return e
+}
+
+type scanPlan struct {
+	table    *Table
+	base     int // the offset of its columns in the rows joined
+	access   accessPath
+	index    *tableIndex // of accessIndex
+	cols     []int       // of the key or the index
+	bounds   []sqlBound
+	key      []byte // of accessKey
+	from, to []byte // of the ranges, nil for no bound
+	eq       int    // columns of the key or the index equal to constants
+	bounded  bool   // a range of the next one
+	joined   bool   // bounds of columns of the tables before
+	none     bool   // no row: a bound of the tables before is NULL
+	reverse  bool   // from the last key
+	ordered  bool   // in the order of the ORDER BY
+	left     bool   // of a LEFT JOIN: NULLs if no row
+	where    sqlEval
+}
+
+// a term of the WHERE, column op constant or a column of the tables before
+type sqlBound struct {
+	col   int // of the table
+	op    string
+	value any
+	outer sqlEval // of the value if of the tables before, nil if constant
+}
+
+// a term of the ORDER BY that's a column of the table
+type orderColumn struct {
+	col  int
+	desc bool
+}
+
+// the plan of a scan of the table, its columns at base in scope, for the
+// WHERE, in the order of the ORDER BY if order. The rows of the primary key
+// or of an index are in the order of its columns, then of the primary key
+// for an index: it's chosen for the order if it's that or the best for the
+// WHERE, or if limited, with a LIMIT, not to read all the rows to sort them.
+// The columns of the table read, nil for all, choose the indexes covering
+// them.
+func planScan(t *Table, scope *sqlScope, base int, where Expr, order []OrderTerm, limited bool, read []bool, args []any) (*scanPlan, error) {
+	p := &scanPlan{table: t, base: base, cols: t.key}
+	var err error
+	var bounds []sqlBound
+	var notNull []int // columns IS NOT NULL
+	if where != nil {
+		if p.where, err = compileExpr(where, scope, args); err != nil {
+			return nil, err
+		}
+		for _, term := range conjuncts(where) {
+			if b, ok := boundOf(t, scope, base, term, args); ok {
+				bounds = append(bounds, b)
+			}
+			if n, ok := term.(*IsNullExpr); ok && n.Not && isColumnOf(scope, n.X, base, len(t.schema.Columns)) {
+				offset, _ := scope.resolve(n.X.(*ColumnRef))
+				notNull = append(notNull, offset-base)
+			}
+		}
+	}
+	orders, orderable := orderColumns(scope, base, len(t.schema.Columns), order)
+
+	plans := t.rows.tx.sqlPlans
+	c, ok := plans.replay(t)
+	if !ok {
+		c = choosePath(t, bounds, notNull, orders, orderable && order != nil, limited, read)
+	}
+	plans.record(t, c)
+	best, score := c.best, c.score
+	p.ordered, p.reverse = c.ordered, c.reverse
+	if best < 0 && score == 0 {
+		return p, nil
+	}
+	if best >= 0 {
+		p.index = &t.indexes[best]
+		p.cols = p.index.cols
+	}
+	p.eq, p.bounded = matchBounds(p.cols, bounds)
+	switch {
+	case best >= 0 && c.covering:
+		p.access = accessIndexOnly
+	case best >= 0:
+		p.access = accessIndex
+	case p.eq == len(t.key):
+		p.access = accessKey
+	default:
+		p.access = accessKeyRange
+	}
+	// the bounds of the columns of the range
+	used := p.cols[:min(p.eq+1, len(p.cols))]
+	for _, b := range bounds {
+		for _, col := range used {
+			if b.col == col {
+				p.bounds = append(p.bounds, b)
+				p.joined = p.joined || b.outer != nil
+				break
+			}
+		}
+	}
+	if !p.joined {
+		return p, p.bind(nil)
+	}
+	return p, nil
+}
+
+// the access path of a plan: the primary key, -1, or an index, and its
+// score, whether it's in the order of the ORDER BY, and whether the index
+// covers the columns read
+type planChoice struct {
+	best     int
+	score    int
+	ordered  bool
+	reverse  bool
+	covering bool
+}
+
+// choose the best access path for the bounds, and of those in the order
+// if orderable, for the columns read
+func choosePath(t *Table, bounds []sqlBound, notNull []int, orders []orderColumn, orderable, limited bool, read []bool) planChoice {
+	// the primary key, then the indexes: the best for the WHERE, an index
+	// covering the columns read the best of the same score, and the best
+	// of those in the order
+	best, score, covering := -1, -1, false
+	bestOrdered, orderedScore, reverse := -1, -1, false
+	for i := -1; i < len(t.indexes); i++ {
+		cols, all := t.key, t.key
+		if i >= 0 {
+			ix := &t.indexes[i]
+			if !indexCovers(t, ix.cols, bounds, notNull) {
+				continue
+			}
+			cols, all = ix.cols, ix.cols
+			if !ix.Unique {
+				all = append(ix.cols[:len(ix.cols):len(ix.cols)], t.key...)
+			}
+		}
+		eq, bounded := matchBounds(cols, bounds)
+		s := 2*eq + boolInt(bounded)
+		if eq == len(cols) && (i < 0 || t.indexes[i].Unique) {
+			s += 1000 // a single row
+		}
+		covers := i >= 0 && t.covers(&t.indexes[i], read)
+		if s > score || s == score && covers && !covering {
+			best, score, covering = i, s, covers
+		}
+		if !orderable || s <= orderedScore {
+			continue
+		}
+		if r, ok := inOrder(all, eq, orders); ok || s >= 1000 {
+			bestOrdered, orderedScore, reverse = i, s, r
+		}
+	}
+	if orderedScore >= 0 && (orderedScore == score || limited) {
+		covers := bestOrdered >= 0 && t.covers(&t.indexes[bestOrdered], read)
+		return planChoice{best: bestOrdered, score: orderedScore, ordered: true, reverse: reverse, covering: covers}
+	}
+	return planChoice{best: best, score: score, covering: covering}
+}
+
+// the columns of the terms of an ORDER BY of the table of n columns at
+// base, false if one isn't one of them
+func orderColumns(scope *sqlScope, base, n int, order []OrderTerm) ([]orderColumn, bool) {
+	var orders []orderColumn
+	for _, o := range order {
+		ref, ok := o.Expr.(*ColumnRef)
+		if !ok {
+			return nil, false
+		}
+		offset, err := scope.resolve(ref)
+		if err != nil || offset < base || offset >= base+n {
+			return nil, false
+		}
+		orders = append(orders, orderColumn{offset - base, o.Desc})
+	}
+	return orders, true
+}
+
+// whether the keys of the columns all, the first eq equal to constants,
+// are in the order of the ORDER BY, reversed or not
+func inOrder(all []int, eq int, orders []orderColumn) (reverse, ok bool) {
+	next := eq
+	first := true
+	for _, o := range orders {
+		if next == len(all) {
+			break // the order of the keys is total
+		}
+		constant := false
+		for _, col := range all[:eq] {
+			constant = constant || o.col == col
+		}
+		if constant {
+			continue
+		}
+		if o.col != all[next] || !first && o.desc != reverse {
+			return false, false
+		}
+		reverse, first = o.desc, false
+		next++
+	}
+	return reverse, true
+}
+
+// the columns of cols in front equal to constants, and whether the next
+// one has a bound
+func matchBounds(cols []int, bounds []sqlBound) (int, bool) {
+	eq := 0
+	for _, col := range cols {
+		if findBound(bounds, col, "=") == nil {
+			break
+		}
+		eq++
+	}
+	if eq == len(cols) {
+		return eq, false
+	}
+	for _, b := range bounds {
+		if b.col == cols[eq] && b.op != "=" {
+			return eq, true
+		}
+	}
+	return eq, false
+}
+
+// whether the rows of the WHERE are in an index: those with a NULL in the
+// columns indexed aren't, they're not of the WHERE if it bounds the column
+// or it's of those notNull
+func indexCovers(t *Table, cols []int, bounds []sqlBound, notNull []int) bool {
+	for _, col := range cols {
+		if !t.schema.Columns[col].Nullable {
+			continue
+		}
+		bounded := false
+		for _, b := range bounds {
+			bounded = bounded || b.col == col
+		}
+		for _, c := range notNull {
+			bounded = bounded || c == col
+		}
+		if !bounded {
+			return false
+		}
+	}
+	return true
+}
+
+func findBound(bounds []sqlBound, col int, op string) *sqlBound {
+	for i := range bounds {
+		if bounds[i].col == col && bounds[i].op == op {
+			return &bounds[i]
+		}
+	}
+	return nil
+}
+
+// the range of keys of the columns equal to constants then of the bounds
+// of the next one: from the first key to the one before to. A key
+// followed by 0xff is after all those it's a prefix of, the values of
+// AppendKey start with a tag below it.
+func boundKeys(cols []int, bounds []sqlBound, eq int, bounded bool) (from, to []byte, err error) {
+	var prefix []byte
+	for _, col := range cols[:eq] {
+		if prefix, err = AppendKey(prefix, findBound(bounds, col, "=").value); err != nil {
+			return nil, nil, err
+		}
+	}
+	from = prefix
+	if eq > 0 {
+		to = PrefixEnd(prefix)
+	}
+	if !bounded {
+		return from, to, nil
+	}
+	col := cols[eq]
+	for _, b := range bounds {
+		if b.col != col || b.op == "=" {
+			continue
+		}
+		key, err := AppendKey(prefix[:len(prefix):len(prefix)], b.value)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch b.op {
+		case ">":
+			key = PrefixEnd(key)
+			fallthrough
+		case ">=":
+			if bytes.Compare(key, from) > 0 {
+				from = key
+			}
+		case "<=":
+			key = PrefixEnd(key)
+			fallthrough
+		case "<":
+			if to == nil || bytes.Compare(key, to) < 0 {
+				to = key
+			}
+		}
+	}
+	return from, to, nil
+}
+
+// the terms of the ANDs of an expression
+func conjuncts(e Expr) []Expr {
+	if b, ok := e.(*BinaryExpr); ok && b.Op == "AND" {
+		return append(conjuncts(b.X), conjuncts(b.Y)...)
+	}
+	return []Expr{e}
+}
+
+var flippedOps = map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// the bound of a term column op constant or column of the tables before,
+// of the type of the column
+func boundOf(t *Table, scope *sqlScope, base int, e Expr, args []any) (sqlBound, bool) {
+	b, ok := e.(*BinaryExpr)
+	if !ok || flippedOps[b.Op] == "" {
+		return sqlBound{}, false
+	}
+	// the column of the table first
+	x, y, op := b.X, b.Y, b.Op
+	if !isColumnOf(scope, x, base, len(t.schema.Columns)) {
+		x, y, op = y, x, flippedOps[op]
+	}
+	if !isColumnOf(scope, x, base, len(t.schema.Columns)) {
+		return sqlBound{}, false
+	}
+	offset, _ := scope.resolve(x.(*ColumnRef))
+	c := t.schema.Columns[offset-base]
+	if ref, ok := y.(*ColumnRef); ok {
+		other, err := scope.resolve(ref)
+		if err != nil || other >= base {
+			return sqlBound{}, false
+		}
+		oc := scope.column(other)
+		if oc.Type != c.Type && (oc.Type != ColumnInt64 || c.Type != ColumnFloat64) {
+			return sqlBound{}, false
+		}
+		return sqlBound{col: offset - base, op: op, outer: func(row []any) (any, error) { return row[other], nil }}, true
+	}
+	if !isConst(y) {
+		return sqlBound{}, false
+	}
+	eval, err := compileExpr(y, scope, args)
+	if err != nil {
+		return sqlBound{}, false
+	}
+	v, err := eval(nil)
+	if err != nil || v == nil {
+		return sqlBound{}, false
+	}
+	v = coerceValue(c, v)
+	if checkColumn(c, v) != nil || isNaN(v) {
+		return sqlBound{}, false
+	}
+	return sqlBound{col: offset - base, op: op, value: v}, true
+}
+
+// whether an expression is a column of the table of n columns at base
+func isColumnOf(scope *sqlScope, e Expr, base, n int) bool {
+	ref, ok := e.(*ColumnRef)
+	if !ok {
+		return false
+	}
+	offset, err := scope.resolve(ref)
+	return err == nil && offset >= base && offset < base+n
+}
+
+func isNaN(v any) bool {
+	f, ok := v.(float64)
+	return ok && math.IsNaN(f)
+}
+
+// whether an expression has no column
+func isConst(e Expr) bool {
+	switch e := e.(type) {
+	case *ColumnRef:
+		return false
+	case *UnaryExpr:
+		return isConst(e.X)
+	case *BinaryExpr:
+		return isConst(e.X) && isConst(e.Y)
+	case *IsNullExpr:
+		return isConst(e.X)
+	}
+	return true
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// the keys the plan reads
+func (p *scanPlan) count() (int64, error) {
+	b := p.table.rows
+	switch p.access {
+	case accessKey:
+		_, ok, err := b.Get(p.key)
+		return int64(boolInt(ok)), err
+	case accessIndex, accessIndexOnly:
+		b = p.index.entries
+	}
+	n := int64(0)
+	err := scanBucket(b, p.from, p.to, false, func(key, value []byte) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// compute the keys of the bounds for the row of the tables before
+func (p *scanPlan) bind(outer []any) error {
+	bounds := p.bounds
+	p.none = false
+	if p.joined {
+		bounds = append([]sqlBound(nil), p.bounds...)
+		for i := range bounds {
+			b := &bounds[i]
+			if b.outer == nil {
+				continue
+			}
+			v, err := b.outer(outer)
+			if err != nil {
+				return err
+			}
+			if v == nil || isNaN(v) {
+				p.none = true
+				return nil
+			}
+			b.value = coerceValue(p.table.schema.Columns[b.col], v)
+		}
+	}
+	var err error
+	p.from, p.to, err = boundKeys(p.cols, bounds, p.eq, p.bounded)
+	if p.access == accessKey {
+		p.key = p.from
+	}
+	return err
+}
+
+// call fn with the rows of the plan after the row outer of the tables
+// before, where the WHERE is TRUE
+func (p *scanPlan) scan(outer []any, fn func(key []byte, row []any) error) error {
+	t := p.table
+	if p.joined {
+		if err := p.bind(outer); err != nil || p.none {
+			return err
+		}
+	}
+	filter := func(key []byte, row Row) error {
+		joined := []any(row)
+		if outer != nil {
+			joined = append(outer[:len(outer):len(outer)], row...)
+		}
+		if p.where != nil {
+			v, err := p.where(joined)
+			if err != nil {
+				return err
+			}
+			if v != true {
+				return nil
+			}
+		}
+		return fn(key, joined)
+	}
+	switch p.access {
+	case accessKey:
+		row, ok, err := t.getRow(p.key)
+		if err != nil || !ok {
+			return err
+		}
+		return filter(p.key, row)
+	case accessIndex:
+		return t.scanIndex(p.index, p.from, p.to, p.reverse, filter)
+	case accessIndexOnly:
+		return t.scanEntries(p.index, p.from, p.to, p.reverse, filter)
+	default:
+		return t.scanRows(p.from, p.to, p.reverse, filter)
+	}
+}
+
+// Expressions, compiled into functions of the row.
+
+type sqlEval func(row []any) (any, error)
+
+// the columns of the rows of the expressions: those of the table, one
+// after the other for a join
+type sqlScope struct {
+	tables []scopeTable
+	// of the expressions of the groups of an aggregate, see aggregates
+	grouped func(e Expr) (sqlEval, bool, error)
+}
+
+type scopeTable struct {
+	name    string
+	columns []Column
+	offset  int // of its first column in the row
+}
+
+func tableScope(t *Table) *sqlScope {
+	return &sqlScope{tables: []scopeTable{{name: t.schema.Name, columns: t.schema.Columns}}}
+}
+
+// the columns of the rows
+func (s *sqlScope) width() int {
+	n := 0
+	for _, t := range s.tables {
+		n += len(t.columns)
+	}
+	return n
+}
+
+// the column at an offset
+func (s *sqlScope) column(offset int) Column {
+	for _, t := range s.tables {
+		if offset < t.offset+len(t.columns) {
+			return t.columns[offset-t.offset]
+		}
+	}
+	return Column{}
+}
+
+// the last table of the columns of an expression, 0 for none
+func (s *sqlScope) lastTable(e Expr) (int, error) {
+	last := 0
+	var walk func(e Expr) error
+	walk = func(e Expr) error {
+		switch e := e.(type) {
+		case *ColumnRef:
+			offset, err := s.resolve(e)
+			if err != nil {
+				return err
+			}
+			for i, t := range s.tables {
+				if offset >= t.offset && offset < t.offset+len(t.columns) {
+					last = max(last, i)
+				}
+			}
+		case *UnaryExpr:
+			return walk(e.X)
+		case *BinaryExpr:
+			if err := walk(e.X); err != nil {
+				return err
+			}
+			return walk(e.Y)
+		case *IsNullExpr:
+			return walk(e.X)
+		}
+		return nil
+	}
+	return last, walk(e)
+}
+
+// the offset of a column in the row
+func (s *sqlScope) resolve(ref *ColumnRef) (int, error) {
+	found := -1
+	for _, t := range s.tables {
+		if ref.Table != "" && ref.Table != t.name {
+			continue
+		}
+		if i := columnIndex(t.columns, ref.Column); i >= 0 {
+			if found >= 0 {
+				return 0, fmt.Errorf("%w: column %q is ambiguous", ErrSQL, ref.Column)
+			}
+			found = t.offset + i
+		}
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("%w: no column %s", ErrSQL, exprString(ref))
+	}
+	return found, nil
+}
+
+func compileExpr(e Expr, scope *sqlScope, args []any) (sqlEval, error) {
+	if scope.grouped != nil {
+		if eval, ok, err := scope.grouped(e); ok || err != nil {
+			return eval, err
+		}
+	}
+	switch e := e.(type) {
+	case *Literal:
+		v := e.Value
+		return func([]any) (any, error) { return v, nil }, nil
+	case *Param:
+		if e.N > len(args) {
+			return nil, fmt.Errorf("%w: no value for parameter %d", ErrSQL, e.N)
+		}
+		v := args[e.N-1]
+		if err := checkValue(v); err != nil {
+			return nil, err
+		}
+		return func([]any) (any, error) { return v, nil }, nil
+	case *ColumnRef:
+		i, err := scope.resolve(e)
+		if err != nil {
+			return nil, err
+		}
+		return func(row []any) (any, error) { return row[i], nil }, nil
+	case *IsNullExpr:
+		x, err := compileExpr(e.X, scope, args)
+		if err != nil {
+			return nil, err
+		}
+		not := e.Not
+		return func(row []any) (any, error) {
+			v, err := x(row)
+			if err != nil {
+				return nil, err
+			}
+			return (v == nil) != not, nil
+		}, nil
+	case *UnaryExpr:
+		x, err := compileExpr(e.X, scope, args)
+		if err != nil {
+			return nil, err
+		}
+		op := e.Op
+		return func(row []any) (any, error) {
+			v, err := x(row)
+			if err != nil || v == nil {
+				return nil, err
+			}
+			switch v := v.(type) {
+			case bool:
+				if op == "NOT" {
+					return !v, nil
+				}
+			case int64:
+				if op == "-" {
+					return -v, nil
+				}
+			case float64:
+				if op == "-" {
+					return -v, nil
+				}
+			}
+			return nil, fmt.Errorf("%w: %s of %T", ErrSQL, op, v)
+		}, nil
+	case *BinaryExpr:
+		x, err := compileExpr(e.X, scope, args)
+		if err != nil {
+			return nil, err
+		}
+		y, err := compileExpr(e.Y, scope, args)
+		if err != nil {
+			return nil, err
+		}
+		op := e.Op
+		if op == "AND" || op == "OR" {
+			return logicalEval(op, x, y), nil
+		}
+		return func(row []any) (any, error) {
+			a, err := x(row)
+			if err != nil {
+				return nil, err
+			}
+			b, err := y(row)
+			if err != nil {
+				return nil, err
+			}
+			return binaryOp(op, a, b)
+		}, nil
+	case *FuncExpr:
+		return nil, fmt.Errorf("%w: aggregate %s not allowed here", ErrSQL, e.Name)
+	}
+	return nil, fmt.Errorf("%w: expression %T", ErrSQL, e)
+}
+
+// AND and OR of three-valued logic, Y not evaluated if X decides
+func logicalEval(op string, x, y sqlEval) sqlEval {
+	decides := op == "OR" // the value of X that is that of the result
+	return func(row []any) (any, error) {
+		a, err := x(row)
+		if err != nil {
+			return nil, err
+		}
+		if a == decides {
+			return decides, nil
+		}
+		b, err := y(row)
+		if err != nil {
+			return nil, err
+		}
+		if b == decides {
+			return decides, nil
+		}
+		for _, v := range []any{a, b} {
+			if _, ok := v.(bool); !ok && v != nil {
+				return nil, fmt.Errorf("%w: %s of %T", ErrSQL, op, v)
+			}
+		}
+		if a == nil || b == nil {
+			return nil, nil
+		}
+		return !decides, nil
+	}
+}
+
+// a value of an operator other than AND and OR
+func binaryOp(op string, a, b any) (any, error) {
+	if a == nil || b == nil {
+		return nil, nil
+	}
+	switch op {
+	case "=", "!=", "<", "<=", ">", ">=":
+		c, err := compareValues(a, b)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "=":
+			return c == 0, nil
+		case "!=":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}
+	i, iok := a.(int64)
+	j, jok := b.(int64)
+	if iok && jok {
+		switch op {
+		case "+":
+			return i + j, nil
+		case "-":
+			return i - j, nil
+		case "*":
+			return i * j, nil
+		case "/", "%":
+			if j == 0 {
+				return nil, fmt.Errorf("%w: division by zero", ErrSQL)
+			}
+			if op == "/" {
+				return i / j, nil
+			}
+			return i % j, nil
+		}
+	}
+	f, fok := toFloat(a)
+	g, gok := toFloat(b)
+	if !fok || !gok {
+		return nil, fmt.Errorf("%w: %T %s %T", ErrSQL, a, op, b)
+	}
+	switch op {
+	case "+":
+		return f + g, nil
+	case "-":
+		return f - g, nil
+	case "*":
+		return f * g, nil
+	case "/":
+		return f / g, nil
+	default:
+		return math.Mod(f, g), nil
+	}
+}
+
+func toFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// the order of two values, NULL first: the numbers together, the other
+// types with their own
+func compareValues(a, b any) (int, error) {
+	switch {
+	case a == nil && b == nil:
+		return 0, nil
+	case a == nil:
+		return -1, nil
+	case b == nil:
+		return 1, nil
+	}
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			return cmpOrdered(a, b), nil
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	case []byte:
+		if b, ok := b.([]byte); ok {
+			return bytes.Compare(a, b), nil
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			return cmpOrdered(boolInt(a), boolInt(b)), nil
+		}
+	}
+	f, fok := toFloat(a)
+	g, gok := toFloat(b)
+	if !fok || !gok {
+		return 0, fmt.Errorf("%w: comparison of %T and %T", ErrSQL, a, b)
+	}
+	return cmpOrdered(f, g), nil
+}
+
+func cmpOrdered[T int | int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// check that a parameter is of a type of the columns
+// the values of the parameters of the types of the columns
+func bindArgs(args []any) ([]any, error) {
+	bound := make([]any, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case int:
+			bound[i] = int64(v)
+		case int8:
+			bound[i] = int64(v)
+		case int16:
+			bound[i] = int64(v)
+		case int32:
+			bound[i] = int64(v)
+		case uint8:
+			bound[i] = int64(v)
+		case uint16:
+			bound[i] = int64(v)
+		case uint32:
+			bound[i] = int64(v)
+		case uint:
+			if uint64(v) > math.MaxInt64 {
+				return nil, fmt.Errorf("%w: parameter %d overflows int64", ErrSQL, i+1)
+			}
+			bound[i] = int64(v)
+		case uint64:
+			if v > math.MaxInt64 {
+				return nil, fmt.Errorf("%w: parameter %d overflows int64", ErrSQL, i+1)
+			}
+			bound[i] = int64(v)
+		case float32:
+			bound[i] = float64(v)
+		default:
+			if err := checkValue(arg); err != nil {
+				return nil, fmt.Errorf("%w: parameter %d of type %T", ErrSQL, i+1, arg)
+			}
+			bound[i] = arg
+		}
+	}
+	return bound, nil
+}
+
+func checkValue(v any) error {
+	switch v.(type) {
+	case nil, int64, float64, string, []byte, bool:
+		return nil
+	}
+	return fmt.Errorf("%w: parameter of type %T", ErrSQL, v)
+}
+
+// an expression of ORDER BY: a name of a column of the result, else an
+// expression of the row
+func compileOrder(e Expr, scope *sqlScope, names []string, evals []sqlEval, args []any) (sqlEval, error) {
+	if ref, ok := e.(*ColumnRef); ok && ref.Table == "" {
+		if _, err := scope.resolve(ref); err != nil {
+			for i, name := range names {
+				if name == ref.Column {
+					return evals[i], nil
+				}
+			}
+		}
+	}
+	return compileExpr(e, scope, args)
+}
+
+// the SQL of an expression
+func exprString(e Expr) string {
+	switch e := e.(type) {
+	case *Literal:
+		return literalString(e.Value)
+	case *ColumnRef:
+		if e.Table != "" {
+			return e.Table + "." + e.Column
+		}
+		return e.Column
+	case *Param:
+		return "?"
+	case *UnaryExpr:
+		if e.Op == "NOT" {
+			return "NOT " + exprString(e.X)
+		}
+		return e.Op + exprString(e.X)
+	case *BinaryExpr:
+		return "(" + exprString(e.X) + " " + e.Op + " " + exprString(e.Y) + ")"
+	case *IsNullExpr:
+		if e.Not {
+			return exprString(e.X) + " IS NOT NULL"
+		}
+		return exprString(e.X) + " IS NULL"
+	case *FuncExpr:
+		if e.Star {
+			return e.Name + "(*)"
+		}
+		return e.Name + "(" + exprString(e.X) + ")"
+	}
+	return "?"
+}
+
+func literalString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case []byte:
+		return fmt.Sprintf("x'%x'", v)
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return fmt.Sprint(v)
+}
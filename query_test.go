@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// run a statement in a Tx of its own
+func execTest(t *testing.T, db *DB, query string, args ...any) *Result {
+	t.Helper()
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return res
+}
+
+// the rows of a SELECT
+func selectTest(t *testing.T, db *DB, query string, args ...any) string {
+	t.Helper()
+	return fmt.Sprint(execTest(t, db, query, args...).Rows)
+}
+
+// the table items of 100 rows: id, name of 10 rows each, price and qty,
+// NULL for the ids of 7s
+func itemsTest(t *testing.T) *DB {
+	t.Helper()
+	db := openTest(t)
+	execTest(t, db, "CREATE TABLE items (id INT PRIMARY KEY, name TEXT NOT NULL, price REAL, qty INT)")
+	execTest(t, db, "CREATE INDEX by_name ON items (name)")
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	for i := 0; i < 100; i++ {
+		var qty any = int64(i % 3)
+		if i%7 == 0 {
+			qty = nil
+		}
+		if _, err := tx.Exec("INSERT INTO items VALUES (?, ?, ?, ?)", i, fmt.Sprint("n", i/10), float64(i)/4, qty); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// how the rows of the first table of a SELECT are read
+func accessTest(t *testing.T, db *DB, query string, args ...any) string {
+	t.Helper()
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	s := parseTest(t, query).(*SelectStmt)
+	_, plans, _, err := tx.planSelect(s, s.OrderBy, s.Limit != nil, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := plans[0]; p.index != nil {
+		return p.access.String() + " " + p.index.Name
+	}
+	return plans[0].access.String()
+}
+
+func TestExecSelect(t *testing.T) {
+	db := itemsTest(t)
+	for _, c := range []struct {
+		query, access, rows string
+	}{
+		{"SELECT name, price FROM items WHERE id = 5", "key lookup", "[[n0 1.25]]"},
+		{"SELECT id FROM items WHERE id = 500", "key lookup", "[]"},
+		{"SELECT id FROM items WHERE 42 = id AND qty IS NULL", "key lookup", "[[42]]"},
+		{"SELECT id FROM items WHERE id >= 95", "key range scan", "[[95] [96] [97] [98] [99]]"},
+		{"SELECT id FROM items WHERE id > 10 AND id < 13", "key range scan", "[[11] [12]]"},
+		{"SELECT id FROM items WHERE id > 2.5 AND id <= 4", "key range scan", "[[3] [4]]"},
+		{"SELECT id FROM items WHERE name = 'n3' AND qty = 2", "index scan by_name", "[[32] [38]]"},
+		{"SELECT id, qty FROM items WHERE name > 'n8' AND qty = 0", "index scan by_name", "[[90 0] [93 0] [96 0] [99 0]]"},
+		{"SELECT id FROM items WHERE qty IS NULL AND id < 30", "key range scan", "[[0] [7] [14] [21] [28]]"},
+		{"SELECT id FROM items WHERE qty + 1 = 3 AND price < 3", "full scan", "[[2] [5] [8] [11]]"},
+		{"SELECT * FROM items WHERE id = 1 OR id = 2", "full scan", "[[1 n0 0.25 1] [2 n0 0.5 2]]"},
+		{"SELECT id * 2, -price, name = 'n0' FROM items WHERE id = 3", "key lookup", "[[6 -0.75 true]]"},
+		{"SELECT id, qty % 2 FROM items WHERE id < 3", "key range scan", "[[0 <nil>] [1 1] [2 0]]"},
+		{"SELECT id FROM items WHERE NOT (qty >= 1) AND id < 10", "key range scan", "[[3] [6] [9]]"},
+	} {
+		if got := selectTest(t, db, c.query); got != c.rows {
+			t.Errorf("%s: rows %s, want %s", c.query, got, c.rows)
+		}
+		if got := accessTest(t, db, c.query); got != c.access {
+			t.Errorf("%s: %s, want %s", c.query, got, c.access)
+		}
+	}
+	res := execTest(t, db, "SELECT * FROM items WHERE id = ?", 9)
+	if fmt.Sprint(res.Columns) != "[id name price qty]" || fmt.Sprint(res.Rows) != "[[9 n0 2.25 0]]" {
+		t.Fatalf("result %+v", res)
+	}
+	res = execTest(t, db, "SELECT id + 1, name AS n FROM items WHERE id = 0")
+	if fmt.Sprint(res.Columns) != "[(id + 1) n]" {
+		t.Fatalf("columns %v", res.Columns)
+	}
+
+	for query, args := range map[string][]any{
+		"SELECT * FROM missing":                 nil,
+		"SELECT missing FROM items":             nil,
+		"SELECT id FROM items WHERE name = 1":   nil,
+		"SELECT id FROM items WHERE id / 0 = 1": nil,
+		"SELECT id FROM items WHERE id = ?":     nil,
+		"SELECT id FROM items WHERE id = ? ":    {struct{}{}},
+		"SELECT id FROM items WHERE id = ?  ":   {uint64(1 << 63)},
+		"SELECT id FROM items LIMIT -1":         nil,
+		"SELECT id FROM items LIMIT 'x'":        nil,
+	} {
+		if _, err := db.Exec(query, args...); err == nil {
+			t.Errorf("%s ran", query)
+		} else if !errors.Is(err, ErrSQL) && !errors.Is(err, ErrTableNotFound) {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+}
+
+func TestExecWrite(t *testing.T) {
+	db := itemsTest(t)
+	res := execTest(t, db, "INSERT INTO items (name, id) VALUES ('new', 100), ('new', 101)")
+	if res.RowsAffected != 2 {
+		t.Fatalf("%d rows inserted", res.RowsAffected)
+	}
+	// the columns not inserted are NULL, an int converted for a REAL
+	execTest(t, db, "UPDATE items SET price = 1, qty = qty + 10 WHERE name = 'new'")
+	if got := selectTest(t, db, "SELECT * FROM items WHERE id >= 100"); got != "[[100 new 1 <nil>] [101 new 1 <nil>]]" {
+		t.Fatalf("rows %s", got)
+	}
+	if _, err := db.Exec("INSERT INTO items (id, name) VALUES (100, 'again')"); !errors.Is(err, ErrRowExists) {
+		t.Fatalf("insert of a key twice: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO items (id) VALUES (102)"); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("insert of a NULL name: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO items (id, missing) VALUES (102, 1)"); !errors.Is(err, ErrSQL) {
+		t.Fatalf("insert of a missing column: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO items VALUES (102, 'x')"); !errors.Is(err, ErrSQL) {
+		t.Fatalf("insert of 2 values for 4 columns: %v", err)
+	}
+
+	res = execTest(t, db, "UPDATE items SET qty = 0, name = 'n9' WHERE qty IS NULL AND id < 50")
+	if res.RowsAffected != 8 {
+		t.Fatalf("%d rows updated", res.RowsAffected)
+	}
+	if got := selectTest(t, db, "SELECT id FROM items WHERE name = 'n9' AND id < 90"); got != "[[0] [7] [14] [21] [28] [35] [42] [49]]" {
+		t.Fatalf("rows of the index updated %s", got)
+	}
+	// the keys shifted, taking those of each other
+	res = execTest(t, db, "UPDATE items SET id = id + 1 WHERE id >= 90")
+	if res.RowsAffected != 12 {
+		t.Fatalf("%d keys updated", res.RowsAffected)
+	}
+	if got := selectTest(t, db, "SELECT id FROM items WHERE id >= 99"); got != "[[99] [100] [101] [102]]" {
+		t.Fatalf("keys %s", got)
+	}
+	if _, err := db.Exec("UPDATE items SET missing = 1"); !errors.Is(err, ErrSQL) {
+		t.Fatalf("update of a missing column: %v", err)
+	}
+	if _, err := db.Exec("UPDATE items SET name = NULL WHERE id = 1"); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("update to a NULL name: %v", err)
+	}
+
+	res = execTest(t, db, "DELETE FROM items WHERE name = 'n9'")
+	if res.RowsAffected != 18 {
+		t.Fatalf("%d rows deleted", res.RowsAffected)
+	}
+	if res := execTest(t, db, "DELETE FROM items"); res.RowsAffected != 84 {
+		t.Fatalf("%d rows deleted", res.RowsAffected)
+	}
+	if got := selectTest(t, db, "SELECT * FROM items"); got != "[]" {
+		t.Fatalf("rows %s after deleting them", got)
+	}
+
+	// a statement failing in a Tx leaves the Tx going on
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT INTO items (id, name) VALUES (1, 'a'), (1, 'b')"); !errors.Is(err, ErrRowExists) {
+		t.Fatalf("insert of a key twice: %v", err)
+	}
+	if _, err := tx.Exec("INSERT INTO items (id, name) VALUES (2, 'c')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// NULL in comparisons and the logic of AND and OR
+func TestExecNull(t *testing.T) {
+	db := itemsTest(t)
+	for where, want := range map[string]string{
+		"qty = NULL":                 "[]",
+		"qty != 1":                   "[[2] [3] [5] [6]]",
+		"qty IS NOT NULL AND id < 4": "[[1] [2] [3]]",
+		"qty > 0 OR qty IS NULL":     "[[0] [1] [2] [4] [5]]",
+		"NOT (qty = 1)":              "[[2] [3] [5] [6]]",
+		"qty = 1 OR NULL":            "[[1] [4]]",
+	} {
+		if got := selectTest(t, db, "SELECT id FROM items WHERE id < 7 AND ("+where+")"); got != want {
+			t.Errorf("WHERE %s: %s, want %s", where, got, want)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	db := itemsTest(t)
+	res := execTest(t, db, "EXPLAIN SELECT * FROM items WHERE id >= 90")
+	if fmt.Sprint(res.Columns) != "[table access index reverse rows sort]" {
+		t.Fatalf("columns %v", res.Columns)
+	}
+	for query, want := range map[string]string{
+		"SELECT * FROM items WHERE id >= 90":                     "[[items key range scan <nil> false 10 false]]",
+		"SELECT * FROM items WHERE id = 5":                       "[[items key lookup <nil> false 1 false]]",
+		"SELECT * FROM items WHERE id = 500":                     "[[items key lookup <nil> false 0 false]]",
+		"SELECT * FROM items WHERE name = 'n1'":                  "[[items index scan by_name false 10 false]]",
+		"SELECT * FROM items WHERE qty = 1":                      "[[items full scan <nil> false 100 false]]",
+		"SELECT * FROM items WHERE qty = 1 LIMIT 5":              "[[items full scan <nil> false 5 false]]",
+		"SELECT * FROM items WHERE qty = 1 LIMIT 5 OFFSET 3":     "[[items full scan <nil> false 8 false]]",
+		"SELECT * FROM items ORDER BY price LIMIT 5":             "[[items full scan <nil> false 100 true]]",
+		"SELECT * FROM items WHERE id = ?":                       "[[items key lookup <nil> false 1 false]]",
+		"UPDATE items SET qty = 1 WHERE name = 'n2' AND id > 25": "[[items index scan by_name false 10 false]]",
+		"DELETE FROM items WHERE id < 3":                         "[[items key range scan <nil> false 3 false]]",
+	} {
+		if got := selectTest(t, db, "EXPLAIN "+query, 7); got != want {
+			t.Errorf("EXPLAIN %s: %s, want %s", query, got, want)
+		}
+	}
+	// nothing run
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	if _, err := tx.Exec("EXPLAIN DELETE FROM items"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(execTestTx(t, tx, "SELECT id FROM items WHERE id = 1").Rows); got != "[[1]]" {
+		t.Fatalf("row of the EXPLAIN DELETE %s", got)
+	}
+	if _, err := tx.Exec("EXPLAIN SELECT * FROM missing"); !errors.Is(err, ErrTableNotFound) {
+		t.Fatalf("EXPLAIN of a missing table: %v", err)
+	}
+	if _, err := ParseSQL("EXPLAIN INSERT INTO items VALUES (1)"); !errors.Is(err, ErrSQLSyntax) {
+		t.Fatalf("EXPLAIN INSERT: %v", err)
+	}
+	if explain, ok := parseTest(t, "EXPLAIN UPDATE items SET qty = 1").(*ExplainStmt); !ok || explain.Stmt.(*UpdateStmt).Table != "items" {
+		t.Fatalf("parsed %#v", explain)
+	}
+}
+
+func execTestTx(t *testing.T, tx *Tx, query string, args ...any) *Result {
+	t.Helper()
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return res
+}
+
+// an ORDER BY of the primary key or of an index reads the rows in order,
+// up to the LIMIT
+func TestOrderByPushdown(t *testing.T) {
+	db := itemsTest(t)
+	for _, c := range []struct {
+		query, plan, rows string
+	}{
+		{"SELECT id FROM items ORDER BY id LIMIT 3", "[[items full scan <nil> false 3 false]]", "[[0] [1] [2]]"},
+		{"SELECT id FROM items ORDER BY id DESC LIMIT 3 OFFSET 1", "[[items full scan <nil> true 4 false]]", "[[98] [97] [96]]"},
+		{"SELECT id FROM items WHERE id < 50 ORDER BY id DESC LIMIT 2", "[[items key range scan <nil> true 2 false]]", "[[49] [48]]"},
+		{"SELECT id, price FROM items ORDER BY name LIMIT 3", "[[items index scan by_name false 3 false]]", "[[0 0] [1 0.25] [2 0.5]]"},
+		{"SELECT id, price FROM items ORDER BY name DESC, id DESC LIMIT 2", "[[items index scan by_name true 2 false]]", "[[99 24.75] [98 24.5]]"},
+		{"SELECT id, price FROM items WHERE name = 'n3' ORDER BY id DESC LIMIT 2", "[[items index scan by_name true 2 false]]", "[[39 9.75] [38 9.5]]"},
+		{"SELECT id, price FROM items WHERE id > 50 ORDER BY name LIMIT 2", "[[items index scan by_name false 2 false]]", "[[51 12.75] [52 13]]"},
+		{"SELECT id, price FROM items WHERE id > 50 ORDER BY name", "[[items key range scan <nil> false 49 true]]", ""},
+		{"SELECT id, price FROM items ORDER BY name, id DESC LIMIT 2", "[[items full scan <nil> false 100 true]]", "[[9 2.25] [8 2]]"},
+		{"SELECT id FROM items ORDER BY qty LIMIT 2", "[[items full scan <nil> false 100 true]]", "[[0] [7]]"},
+		{"SELECT id, price FROM items ORDER BY id + 0 DESC LIMIT 1", "[[items full scan <nil> false 100 true]]", "[[99 24.75]]"},
+	} {
+		if got := selectTest(t, db, "EXPLAIN "+c.query); got != c.plan {
+			t.Errorf("EXPLAIN %s: %s, want %s", c.query, got, c.plan)
+		}
+		if got := selectTest(t, db, c.query); c.rows != "" && got != c.rows {
+			t.Errorf("%s: %s, want %s", c.query, got, c.rows)
+		}
+	}
+	// the rows read in order are those sorted
+	ordered := execTest(t, db, "SELECT id, name FROM items ORDER BY name DESC, id DESC").Rows
+	for i, row := range ordered {
+		if want := int64(99 - i); row[0] != want {
+			t.Fatalf("row %d of the reverse order is %v", i, row)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	db := itemsTest(t)
+	execTest(t, db, "CREATE TABLE orders (oid INT PRIMARY KEY, item INT, n INT NOT NULL)")
+	execTest(t, db, "CREATE INDEX by_item ON orders (item)")
+	execTest(t, db, "INSERT INTO orders VALUES (1, 5, 2), (2, 5, 1), (3, 42, 7), (4, NULL, 1), (5, 1000, 3)")
+	for _, c := range []struct {
+		query, plan, rows string
+	}{
+		// the items of each order by their key
+		{"SELECT o.oid, i.name FROM orders o JOIN items i ON i.id = o.item",
+			"[[o full scan <nil> false 5 false] [i key lookup <nil> false <nil> false]]",
+			"[[1 n0] [2 n0] [3 n4]]"},
+		// the orders of each item by the index of the orders
+		{"SELECT id, oid, n FROM items INNER JOIN orders ON item = id WHERE id < 10",
+			"[[items key range scan <nil> false 10 false] [orders index scan by_item false <nil> false]]",
+			"[[5 1 2] [5 2 1]]"},
+		{"SELECT oid, id FROM orders LEFT OUTER JOIN items ON id = item ORDER BY oid",
+			"[[orders full scan <nil> false 5 false] [items key lookup <nil> false <nil> false]]",
+			"[[1 5] [2 5] [3 42] [4 <nil>] [5 <nil>]]"},
+		// the WHERE of a table of a LEFT JOIN is evaluated on the rows joined
+		{"SELECT oid FROM orders LEFT JOIN items ON id = item WHERE id IS NULL",
+			"[[orders full scan <nil> false 5 false] [items key lookup <nil> false <nil> false]]",
+			"[[4] [5]]"},
+		{"SELECT oid, id FROM orders LEFT JOIN items ON id = item AND qty IS NULL WHERE n > 1",
+			"[[orders full scan <nil> false 5 false] [items key lookup <nil> false <nil> false]]",
+			"[[1 <nil>] [3 42] [5 <nil>]]"},
+		// a join without a term on the columns reads all the rows for each
+		{"SELECT a.oid, b.oid FROM orders a JOIN orders b ON a.n < b.n WHERE b.n = 3",
+			"[[a full scan <nil> false 5 false] [b full scan <nil> false 5 false]]",
+			"[[1 5] [2 5] [4 5]]"},
+		{"SELECT items.id, o.oid, x.id FROM items JOIN orders o ON o.item = items.id JOIN items x ON x.id = o.n",
+			"", "[[5 1 2] [5 2 1] [42 3 7]]"},
+	} {
+		if c.plan != "" {
+			if got := selectTest(t, db, "EXPLAIN "+c.query); got != c.plan {
+				t.Errorf("EXPLAIN %s: %s, want %s", c.query, got, c.plan)
+			}
+		}
+		if got := selectTest(t, db, c.query); got != c.rows {
+			t.Errorf("%s: %s, want %s", c.query, got, c.rows)
+		}
+	}
+	res := execTest(t, db, "SELECT * FROM orders JOIN items ON id = item WHERE oid = 3")
+	if fmt.Sprint(res.Columns) != "[oid item n id name price qty]" || fmt.Sprint(res.Rows) != "[[3 42 7 42 n4 10.5 <nil>]]" {
+		t.Fatalf("result %+v", res)
+	}
+	for _, query := range []string{
+		"SELECT n FROM orders a JOIN orders b ON a.oid = b.oid",
+		"SELECT * FROM orders JOIN orders ON oid = oid",
+		"SELECT * FROM orders o JOIN items ON orders.oid = id",
+		"SELECT * FROM orders JOIN missing ON 1 = 1",
+	} {
+		if _, err := db.Exec(query); !errors.Is(err, ErrSQL) && !errors.Is(err, ErrTableNotFound) {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+	sel := parseTest(t, "SELECT * FROM a x LEFT JOIN b AS y ON x.i = y.i INNER JOIN c ON c.j = y.j").(*SelectStmt)
+	if len(sel.Joins) != 2 || fmt.Sprintf("%s %s %v", sel.Joins[0].Table, sel.Joins[0].As, sel.Joins[0].Left) != "b y true" || sel.Joins[1].Left || exprTest(sel.Joins[1].On) != "(= c.j y.j)" {
+		t.Fatalf("joins %+v", sel.Joins)
+	}
+}
@@ -0,0 +1,295 @@
+//go:build raft
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// the buckets of a RaftStore
+var (
+	RAFT_LOG_BUCKET    = []byte("raft log")
+	RAFT_STABLE_BUCKET = []byte("raft stable")
+)
+
+const (
+	// log layout in a RaftStore, under the big-endian index
+	// | term | type | appended at | dlen | data | extensions |
+	// | 8B   | 1B   | 8B          | 4B   | ...  | ...        |
+	RAFT_LOG_HEADER = 8 + 1 + 8 + 4
+)
+
+// FSM is the state machine of a DB replicated with hashicorp/raft, built
+// with the raft tag after go get of the library. The commands of the log
+// are Batches, see ApplyBatch, applied in one Tx each; snapshots are the
+// backups of WriteBackup and restoring one replaces the keys and buckets
+// of the DB with those of the backup.
+//
+// Only the FSM writes the DB: on every node the other writers would drift
+// from the log. Reads are served by the DB of any node, those that must
+// see the last writes go to the leader after Raft.VerifyLeader.
+type FSM struct {
+	db *DB
+}
+
+func NewFSM(db *DB) *FSM {
+	return &FSM{db: db}
+}
+
+// Apply returns the error of DB.Write, nil once written. A batch that
+// can't be decoded is an error of the log: it panics, the node can't
+// follow the others.
+func (f *FSM) Apply(l *raft.Log) any {
+	if l.Type != raft.LogCommand {
+		return nil
+	}
+	var b Batch
+	if err := b.UnmarshalBinary(l.Data); err != nil {
+		panic(fmt.Sprintf("raft log %d: %v", l.Index, err))
+	}
+	return f.db.Write(context.Background(), &b)
+}
+
+// Snapshot pins the version of a read Tx until the snapshot is persisted:
+// the commits go on meanwhile.
+func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
+	tx, err := f.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return fsmSnapshot{tx}, nil
+}
+
+func (f *FSM) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	ctx := context.Background()
+	if err := f.db.clear(ctx); err != nil {
+		return err
+	}
+	version, err := f.db.Restore(ctx, r)
+	if err == nil {
+		f.db.log.Info("raft snapshot restored", "version", version)
+	}
+	return err
+}
+
+type fsmSnapshot struct {
+	tx *Tx
+}
+
+func (s fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.tx.WriteBackup(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s fsmSnapshot) Release() {
+	s.tx.Rollback()
+}
+
+// ApplyBatch replicates the batch with r, the leader, and returns once it's
+// applied by the FSM of the leader, with its error.
+func ApplyBatch(r *raft.Raft, b *Batch, timeout time.Duration) error {
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	f := r.Apply(data, timeout)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// RaftStore is the LogStore and the StableStore of hashicorp/raft in two
+// buckets of a DB, a DB of its own rather than that of the FSM: each log
+// is committed with the sync policy of the DB, SyncAlways for Raft to hold.
+type RaftStore struct {
+	db *DB
+}
+
+var errRaftNotFound = errors.New("not found") // the text raft expects
+
+// NewRaftStore creates the buckets of the store if missing.
+func NewRaftStore(db *DB) (*RaftStore, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, name := range [][]byte{RAFT_LOG_BUCKET, RAFT_STABLE_BUCKET} {
+		if _, err := tx.CreateBucket(name); err != nil && !errors.Is(err, ErrBucketExists) {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &RaftStore{db: db}, nil
+}
+
+// run fn on a bucket of the store, in a write Tx committed if fn succeeds
+func (s *RaftStore) bucket(writable bool, name []byte, fn func(b *Bucket) error) error {
+	tx, err := s.db.Begin(writable)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	b, err := tx.Bucket(name)
+	if err != nil {
+		return err
+	}
+	if err := fn(b); err != nil || !writable {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *RaftStore) FirstIndex() (uint64, error) {
+	return s.edgeIndex(true)
+}
+
+func (s *RaftStore) LastIndex() (uint64, error) {
+	return s.edgeIndex(false)
+}
+
+// the first or last index, 0 without logs
+func (s *RaftStore) edgeIndex(first bool) (index uint64, err error) {
+	err = s.bucket(false, RAFT_LOG_BUCKET, func(b *Bucket) error {
+		c := b.Cursor()
+		key, _ := c.Last()
+		if first {
+			key, _ = c.First()
+		}
+		if len(key) == 8 {
+			index = binary.BigEndian.Uint64(key)
+		}
+		return c.Err()
+	})
+	return index, err
+}
+
+func (s *RaftStore) GetLog(index uint64, log *raft.Log) error {
+	return s.bucket(false, RAFT_LOG_BUCKET, func(b *Bucket) error {
+		value, ok, err := b.Get(binary.BigEndian.AppendUint64(nil, index))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return raft.ErrLogNotFound
+		}
+		return decodeRaftLog(index, value, log)
+	})
+}
+
+func (s *RaftStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+func (s *RaftStore) StoreLogs(logs []*raft.Log) error {
+	return s.bucket(true, RAFT_LOG_BUCKET, func(b *Bucket) error {
+		for _, log := range logs {
+			if err := b.Set(binary.BigEndian.AppendUint64(nil, log.Index), encodeRaftLog(log)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *RaftStore) DeleteRange(min, max uint64) error {
+	return s.bucket(true, RAFT_LOG_BUCKET, func(b *Bucket) error {
+		for i := min; i <= max; i++ {
+			if _, err := b.Del(binary.BigEndian.AppendUint64(nil, i)); err != nil {
+				return err
+			}
+			if i == max { // max may be the last uint64
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (s *RaftStore) Set(key []byte, value []byte) error {
+	return s.bucket(true, RAFT_STABLE_BUCKET, func(b *Bucket) error {
+		return b.Set(key, value)
+	})
+}
+
+func (s *RaftStore) Get(key []byte) (value []byte, err error) {
+	err = s.bucket(false, RAFT_STABLE_BUCKET, func(b *Bucket) error {
+		v, ok, err := b.Get(key)
+		if err == nil && !ok {
+			err = errRaftNotFound
+		}
+		value = bytes.Clone(v)
+		return err
+	})
+	return value, err
+}
+
+func (s *RaftStore) SetUint64(key []byte, value uint64) error {
+	return s.Set(key, binary.BigEndian.AppendUint64(nil, value))
+}
+
+// GetUint64 is 0 for a key not set, like the stores of raft
+func (s *RaftStore) GetUint64(key []byte) (uint64, error) {
+	value, err := s.Get(key)
+	switch {
+	case errors.Is(err, errRaftNotFound):
+		return 0, nil
+	case err != nil:
+		return 0, err
+	case len(value) != 8:
+		return 0, fmt.Errorf("%w: raft value %q of %d bytes", ErrCorrupt, key, len(value))
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+func encodeRaftLog(log *raft.Log) []byte {
+	data := make([]byte, RAFT_LOG_HEADER, RAFT_LOG_HEADER+len(log.Data)+len(log.Extensions))
+	binary.BigEndian.PutUint64(data, log.Term)
+	data[8] = byte(log.Type)
+	var appended int64
+	if !log.AppendedAt.IsZero() {
+		appended = log.AppendedAt.UnixNano()
+	}
+	binary.BigEndian.PutUint64(data[9:], uint64(appended))
+	binary.BigEndian.PutUint32(data[17:], uint32(len(log.Data)))
+	data = append(data, log.Data...)
+	return append(data, log.Extensions...)
+}
+
+func decodeRaftLog(index uint64, data []byte, log *raft.Log) error {
+	if len(data) < RAFT_LOG_HEADER {
+		return fmt.Errorf("%w: raft log %d of %d bytes", ErrCorrupt, index, len(data))
+	}
+	dlen := int(binary.BigEndian.Uint32(data[17:]))
+	if len(data) < RAFT_LOG_HEADER+dlen {
+		return fmt.Errorf("%w: raft log %d is cut", ErrCorrupt, index)
+	}
+	*log = raft.Log{Index: index, Term: binary.BigEndian.Uint64(data), Type: raft.LogType(data[8])}
+	if appended := int64(binary.BigEndian.Uint64(data[9:])); appended != 0 {
+		log.AppendedAt = time.Unix(0, appended)
+	}
+	rest := data[RAFT_LOG_HEADER:]
+	log.Data = bytes.Clone(rest[:dlen])
+	if len(rest) > dlen {
+		log.Extensions = bytes.Clone(rest[dlen:])
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+//go:build raft
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestRaftStore(t *testing.T) {
+	db := openTest(t)
+	s, err := NewRaftStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := s.FirstIndex(); first != 0 {
+		t.Fatalf("first index %d without logs", first)
+	}
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, &raft.Log{
+			Index: i, Term: i / 4, Type: raft.LogCommand, Data: []byte(fmt.Sprint("data", i)),
+			AppendedAt: time.Unix(0, int64(i)),
+		})
+	}
+	logs[3].Extensions = []byte("ext")
+	logs[4].Data, logs[4].AppendedAt = nil, time.Time{}
+	if err := s.StoreLogs(logs[:9]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreLog(logs[9]); err != nil {
+		t.Fatal(err)
+	}
+	check := func(first, last uint64) {
+		t.Helper()
+		if got, _ := s.FirstIndex(); got != first {
+			t.Fatalf("first index %d, want %d", got, first)
+		}
+		if got, _ := s.LastIndex(); got != last {
+			t.Fatalf("last index %d, want %d", got, last)
+		}
+		for i := first; i <= last; i++ {
+			var log raft.Log
+			if err := s.GetLog(i, &log); err != nil {
+				t.Fatal(err)
+			}
+			want := *logs[i-1]
+			if want.Data == nil {
+				want.Data = []byte{}
+			}
+			if fmt.Sprint(log) != fmt.Sprint(want) {
+				t.Fatalf("log %d is %v, want %v", i, log, want)
+			}
+		}
+	}
+	check(1, 10)
+	if err := s.DeleteRange(1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteRange(9, 10); err != nil {
+		t.Fatal(err)
+	}
+	var log raft.Log
+	if err := s.GetLog(2, &log); !errors.Is(err, raft.ErrLogNotFound) {
+		t.Fatalf("get of a deleted log: %v", err)
+	}
+	db = reopenTest(t, db)
+	s, _ = NewRaftStore(db)
+	check(4, 8)
+
+	if _, err := s.Get([]byte("k")); err == nil || err.Error() != "not found" {
+		t.Fatalf("get of a key not set: %v", err)
+	}
+	if n, err := s.GetUint64([]byte("k")); n != 0 || err != nil {
+		t.Fatalf("uint64 of a key not set: %d %v", n, err)
+	}
+	s.Set([]byte("k"), []byte("v"))
+	s.SetUint64([]byte("n"), 1<<40)
+	if v, _ := s.Get([]byte("k")); string(v) != "v" {
+		t.Fatalf("k is %q", v)
+	}
+	if n, _ := s.GetUint64([]byte("n")); n != 1<<40 {
+		t.Fatalf("n is %d", n)
+	}
+	if _, err := s.GetUint64([]byte("k")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("uint64 of 1 byte: %v", err)
+	}
+
+	// cut logs are ErrCorrupt
+	data := encodeRaftLog(logs[3])
+	for _, bad := range [][]byte{data[:RAFT_LOG_HEADER-1], data[:RAFT_LOG_HEADER+2]} {
+		if err := decodeRaftLog(4, bad, &log); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("decode of %d bytes: %v", len(bad), err)
+		}
+	}
+}
+
+// a snapshot sink of memory
+type testSink struct {
+	bytes.Buffer
+	canceled bool
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Cancel() error { s.canceled = true; return nil }
+func (s *testSink) Close() error  { return nil }
+
+func TestFSM(t *testing.T) {
+	db := openTest(t)
+	f := NewFSM(db)
+	apply := func(index uint64, b *Batch) any {
+		t.Helper()
+		data, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.Apply(&raft.Log{Index: index, Type: raft.LogCommand, Data: data})
+	}
+	var b Batch
+	b.Set([]byte("a"), []byte("1"))
+	b.SetWithExpiry([]byte("t"), []byte("x"), time.Now().Add(time.Hour))
+	if res := apply(1, &b); res != nil {
+		t.Fatalf("apply: %v", res)
+	}
+	wantValue(t, db, "a", []byte("1"))
+	b.Reset()
+	b.Set(nil, []byte("1"))
+	if err, _ := apply(2, &b).(error); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("apply of an empty key: %v", err)
+	}
+	if res := f.Apply(&raft.Log{Index: 3, Type: raft.LogNoop}); res != nil {
+		t.Fatalf("apply of a noop: %v", res)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("apply of a bad batch didn't panic")
+			}
+		}()
+		f.Apply(&raft.Log{Index: 4, Type: raft.LogCommand, Data: []byte("bad")})
+	}()
+
+	// the snapshot is that of its version
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, "later", "x")
+	var sink testSink
+	if err := snap.Persist(&sink); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+
+	dst := openTest(t)
+	mustSet(t, dst, "gone", "x")
+	if err := NewFSM(dst).Restore(io.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+		t.Fatal(err)
+	}
+	wantValue(t, dst, "a", []byte("1"))
+	wantValue(t, dst, "later", nil)
+	wantValue(t, dst, "gone", nil)
+	if at, _ := func() (time.Time, error) {
+		tx, _ := dst.Begin(false)
+		defer tx.Rollback()
+		return tx.Expiry([]byte("t"))
+	}(); at.IsZero() {
+		t.Fatal("expiry not restored")
+	}
+	if err := NewFSM(dst).Restore(io.NopCloser(bytes.NewReader(sink.Bytes()[:10]))); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("restore of a cut snapshot: %v", err)
+	}
+
+	// a released snapshot fails to persist, canceling the sink
+	sink = testSink{}
+	if err := snap.Persist(&sink); !errors.Is(err, ErrTxClosed) || !sink.canceled {
+		t.Fatalf("persist after release: %v, canceled %v", err, sink.canceled)
+	}
+}
+
+// a cluster of 3 in memory: the batches applied by the leader reach every
+// DB, and a node left behind the snapshots catches up from one
+func TestRaftCluster(t *testing.T) {
+	type node struct {
+		db    *DB
+		r     *raft.Raft
+		trans *raft.InmemTransport
+	}
+	var nodes []*node
+	var servers []raft.Server
+	start := func(i int, bootstrap bool) *node {
+		t.Helper()
+		conf := raft.DefaultConfig()
+		conf.LocalID = raft.ServerID(fmt.Sprint("n", i))
+		conf.HeartbeatTimeout = 50 * time.Millisecond
+		conf.ElectionTimeout = 50 * time.Millisecond
+		conf.LeaderLeaseTimeout = 50 * time.Millisecond
+		conf.CommitTimeout = 5 * time.Millisecond
+		conf.SnapshotThreshold = 10
+		conf.TrailingLogs = 5
+		conf.LogOutput = io.Discard
+		addr, trans := raft.NewInmemTransport(raft.ServerAddress(conf.LocalID))
+		store, err := NewRaftStore(openTest(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := &node{db: openTest(t), trans: trans}
+		if bootstrap {
+			servers = append(servers, raft.Server{ID: conf.LocalID, Address: addr})
+		}
+		snaps := raft.NewInmemSnapshotStore()
+		if n.r, err = raft.NewRaft(conf, NewFSM(n.db), store, store, snaps, trans); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { n.r.Shutdown().Error() })
+		for _, other := range nodes {
+			other.trans.Connect(addr, trans)
+			trans.Connect(other.trans.LocalAddr(), other.trans)
+		}
+		nodes = append(nodes, n)
+		return n
+	}
+	for i := 0; i < 3; i++ {
+		start(i, true)
+	}
+	if err := nodes[0].r.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+		t.Fatal(err)
+	}
+	leader := func() *raft.Raft {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			for _, n := range nodes {
+				if n.r.State() == raft.Leader {
+					return n.r
+				}
+			}
+		}
+		t.Fatal("no leader elected")
+		return nil
+	}
+	for i := 0; i < 30; i++ {
+		var b Batch
+		b.Set([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint(i)))
+		b.Del([]byte(fmt.Sprint("k", i-1)))
+		if err := ApplyBatch(leader(), &b, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b Batch
+	b.Set(nil, nil)
+	if err := ApplyBatch(leader(), &b, 5*time.Second); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("batch of an empty key: %v", err)
+	}
+	if err := ApplyBatch(nodes[0].r, &Batch{}, time.Second); leader() != nodes[0].r && !errors.Is(err, raft.ErrNotLeader) {
+		t.Fatalf("batch applied by a follower: %v", err)
+	}
+	if err := leader().Snapshot().Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the logs before the snapshot are gone, the new node restores it
+	n := start(3, false)
+	if err := leader().AddVoter("n3", n.trans.LocalAddr(), 0, 5*time.Second).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader().Barrier(5 * time.Second).Error(); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if v, _, _ := n.db.Get([]byte("k29")); string(v) == "29" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("k29 not replicated")
+			}
+		}
+		wantValue(t, n.db, "k28", nil)
+	}
+}
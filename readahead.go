@@ -0,0 +1,93 @@
+package storage
+
+const (
+	DEFAULT_READ_AHEAD = 32 // leaves
+	READ_AHEAD_TRIGGER = 2  // leaves walked in a row before reading ahead
+)
+
+// A cursor walking leaves in a row reads the next ones ahead, in the
+// background and into the page cache, so that a long scan doesn't wait
+// for a read per leaf. There's no mapping of the file to madvise, the
+// pages are read with the pager: concurrently with the io_uring backend.
+// The leaves ahead are the next kids of the parent of the current leaf,
+// the read ahead starts over in the parent after it.
+
+// read ahead of the cursor if it walks leaves in a row
+func (c *Cursor) readAhead(forward bool) {
+	tx := c.tx
+	window := tx.db.opts.readAhead
+	n := len(c.iter.path)
+	if window <= 0 || n < 2 {
+		return
+	}
+	leaf := &c.iter.path[n-1].data[0]
+	if leaf == c.ahead.leaf {
+		return
+	}
+	if c.ahead.leaf != nil && c.ahead.forward == forward {
+		c.ahead.steps++
+	} else {
+		c.ahead.steps = 0
+	}
+	c.ahead.leaf, c.ahead.forward = leaf, forward
+	if c.ahead.steps < READ_AHEAD_TRIGGER {
+		return
+	}
+
+	parent, pos := c.iter.path[n-2], int(c.iter.pos[n-2])
+	dir := 1
+	if !forward {
+		dir = -1
+	}
+	if &parent.data[0] != c.ahead.parent || (c.ahead.end-pos)*dir < 0 {
+		c.ahead.parent, c.ahead.end = &parent.data[0], pos
+	}
+	if (c.ahead.end-pos)*dir > window/2 {
+		return // still enough read ahead
+	}
+	var ptrs []uint64
+	nkids := int(parent.getNumberOfKeys())
+	for i := c.ahead.end + dir; i >= 0 && i < nkids && (i-pos)*dir <= window; i += dir {
+		ptr := parent.getPointer(uint16(i))
+		if _, ok := tx.page.updates[ptr]; !ok && !tx.db.cache.contains(ptr) {
+			ptrs = append(ptrs, ptr)
+		}
+		c.ahead.end = i
+	}
+	if len(ptrs) > 0 {
+		tx.prefetch(ptrs)
+	}
+}
+
+// read pages of the Tx into the cache in the background. The Tx waits for
+// them before it ends: the pages may be freed and reused after it.
+func (tx *Tx) prefetch(ptrs []uint64) {
+	if tx.prefetched == nil {
+		tx.prefetched = map[uint64]bool{}
+	}
+	for _, ptr := range ptrs {
+		tx.prefetched[ptr] = true
+	}
+	tx.prefetching.Add(1)
+	go func() {
+		defer tx.prefetching.Done()
+		tx.db.prefetch(ptrs)
+	}()
+}
+
+func (db *DB) prefetch(ptrs []uint64) {
+	data := make([][]byte, len(ptrs))
+	for i := range data {
+		data[i] = make([]byte, db.opts.pageSize)
+	}
+	if err := db.pager.readPages(ptrs, data); err != nil {
+		return // the scan reads them again and reports it
+	}
+	db.stats.pageReads.Add(uint64(len(ptrs)))
+	for i, ptr := range ptrs {
+		if checkNode(BNode{data[i]}) == nil {
+			db.cache.addClean(ptr, data[i])
+			db.stats.prefetchedPages.Add(1)
+		}
+	}
+}
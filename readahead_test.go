@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+// scans forward and backward, with and without reading ahead
+func TestReadAhead(t *testing.T) {
+	const keys = 20000
+	for _, backend := range []IOBackend{IOSync, IOUring} {
+		for _, window := range []int{0, DEFAULT_READ_AHEAD} {
+			t.Run(fmt.Sprint(backend, "/", window), func(t *testing.T) {
+				db, err := Open(t.TempDir()+"/test.db", WithIOBackend(backend))
+				if err != nil {
+					t.Skip(err)
+				}
+				t.Cleanup(func() { db.Close() })
+				tx, _ := db.Begin(true)
+				for i := 0; i < keys; i++ {
+					tx.Set([]byte(fmt.Sprintf("k%06d", i)), make([]byte, 100))
+				}
+				if err := tx.Commit(); err != nil {
+					t.Fatal(err)
+				}
+				db = reopenTest(t, db, WithIOBackend(backend), WithReadAhead(window))
+				for _, forward := range []bool{true, false} {
+					tx, _ := db.Begin(false)
+					c := tx.Cursor()
+					move, k := c.Next, []byte(nil)
+					if forward {
+						k, _ = c.First()
+					} else {
+						move = c.Prev
+						k, _ = c.Last()
+					}
+					n := 0
+					for ; k != nil; k, _ = move() {
+						want := fmt.Sprintf("k%06d", n)
+						if !forward {
+							want = fmt.Sprintf("k%06d", keys-1-n)
+						}
+						if string(k) != want {
+							t.Fatalf("key %d is %q, want %q", n, k, want)
+						}
+						n++
+					}
+					if err := c.Err(); err != nil || n != keys {
+						t.Fatalf("scanned %d keys: %v", n, err)
+					}
+					tx.Rollback()
+				}
+				s := db.Stats()
+				if window == 0 && s.ReadAhead != 0 || window > 0 && s.ReadAhead == 0 {
+					t.Fatalf("%d pages read ahead with a window of %d", s.ReadAhead, window)
+				}
+				if window > 0 && s.CacheHits < s.CacheMisses {
+					t.Fatalf("%d hits, %d misses", s.CacheHits, s.CacheMisses)
+				}
+			})
+		}
+	}
+}
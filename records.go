@@ -0,0 +1,713 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Records: tables of rows of typed columns over the buckets. A table is a
+// bucket inside TABLES_BUCKET, the keys its rows by primary key; its schema
+// is the key of its name in TABLES_BUCKET, see schemas.go. The rows are updated
+// in the Tx like the other keys, logged and replicated as bucket updates,
+// and so are the schemas: a CreateTable, DropTable, CreateIndex or
+// DropIndex that fails is rolled back to a savepoint before it, the Tx
+// goes on.
+//
+// A row is a value for each column, in the order of the schema, nil for
+// NULL. The key of a row is its primary key columns as AppendKey encodes
+// them, in the order of the values, the value all its columns: the rows of
+// a key of several columns sort by the first ones, ScanPrefix and
+// ScanThrough scan those of some first columns. An index is a bucket
+// inside that of the table, see Index.
+//
+// value layout, for each column, the ints zigzag varints
+// | tag | value |
+// | 1B  | ...   |
+
+const (
+	TABLES_BUCKET = "\x00tables"
+
+	rowNull  = 0
+	rowValue = 1
+)
+
+var (
+	ErrTableNotFound = errors.New("table not found")
+	ErrTableExists   = errors.New("table already exists")
+	ErrSchema        = errors.New("bad table schema")
+	ErrBadRow        = errors.New("bad row")
+	ErrRowExists     = errors.New("row already exists")
+	ErrRowNotFound   = errors.New("row not found")
+)
+
+type ColumnType int
+
+const (
+	ColumnInt64   ColumnType = iota + 1 // int64
+	ColumnFloat64                       // float64
+	ColumnString                        // string
+	ColumnBytes                         // []byte
+	ColumnBool                          // bool
+)
+
+func (t ColumnType) String() string {
+	switch t {
+	case ColumnInt64:
+		return "int64"
+	case ColumnFloat64:
+		return "float64"
+	case ColumnString:
+		return "string"
+	case ColumnBytes:
+		return "bytes"
+	case ColumnBool:
+		return "bool"
+	default:
+		return "unknown"
+	}
+}
+
+type Column struct {
+	Name          string     `json:"name"`
+	Type          ColumnType `json:"type"`
+	Nullable      bool       `json:"nullable,omitempty"`       // NULL allowed, never in the primary key
+	AutoIncrement bool       `json:"auto_increment,omitempty"` // int64 not nullable, NULL inserted takes the next value, see sequence.go
+	Default       any        `json:"default,omitempty"`        // of the column when not inserted, nil for NULL
+	Added         int        `json:"added,omitempty"`          // version of the schema adding the column, 0 if created with it
+}
+
+// Schema is the definition of a table.
+type Schema struct {
+	Name       string   `json:"name"`
+	Columns    []Column `json:"columns"`
+	PrimaryKey []string `json:"primary_key"`       // names of the columns of the key, in order
+	Indexes    []Index  `json:"indexes,omitempty"` // secondary indexes
+	Version    int      `json:"version,omitempty"` // bumped by each change
+	// references to the primary keys of tables, and the tables with one
+	// to this one
+	ForeignKeys  []ForeignKey `json:"foreign_keys,omitempty"`
+	ReferencedBy []string     `json:"referenced_by,omitempty"`
+	Checks       []Check      `json:"checks,omitempty"` // rejecting the rows inserted or updated
+}
+
+// Row is the values of the columns of a table in the order of its schema,
+// of the Go types of ColumnType, nil for NULL.
+type Row []any
+
+// Table is a handle on a table, valid until the Tx ends or the table is
+// dropped.
+type Table struct {
+	schema  Schema
+	tables  *Bucket // of the schemas
+	rows    *Bucket
+	key     []int // indexes of the columns of the primary key
+	indexes []tableIndex
+	auto    int // index of the AUTO_INCREMENT column, -1 if none
+
+	foreignKeys []tableForeignKey
+	checks      []tableCheck
+	gen         uint64 // Tx.schemaGen when the schema was read
+}
+
+// CreateTable adds an empty table, with the buckets of its indexes, or
+// nothing if it fails. The Tx must be from Begin.
+func (tx *Tx) CreateTable(s Schema) (*Table, error) {
+	var t *Table
+	err := tx.atomic(func() (err error) {
+		t, err = tx.createTable(s)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (tx *Tx) createTable(s Schema) (*Table, error) {
+	t, err := newTable(s)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := tx.tablesBucket(true)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok, err := tables.Get([]byte(s.Name)); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, fmt.Errorf("%w: %q", ErrTableExists, s.Name)
+	}
+	if s, err = tx.linkParents(t); err != nil {
+		return nil, err
+	}
+	data, err := encodeSchema(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := tables.Set([]byte(s.Name), data); err != nil {
+		return nil, err
+	}
+	if t.rows, err = tables.CreateBucket([]byte(s.Name)); err != nil {
+		return nil, err
+	}
+	t.tables = tables
+	t.gen = tx.schemaGen
+	for i := range t.indexes {
+		if t.indexes[i].entries, err = t.rows.CreateBucket([]byte(t.indexes[i].Name)); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Table opens a table.
+func (tx *Tx) Table(name string) (*Table, error) {
+	tables, err := tx.tablesBucket(false)
+	if errors.Is(err, ErrBucketNotFound) {
+		return nil, fmt.Errorf("%w: %q", ErrTableNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, ok, err := tables.Get([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrTableNotFound, name)
+	}
+	t, err := tx.db.tableOf(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if t.rows, err = tables.Bucket([]byte(name)); err != nil {
+		return nil, err
+	}
+	t.tables = tables
+	t.gen = tx.schemaGen
+	for i := range t.indexes {
+		if t.indexes[i].entries, err = t.rows.Bucket([]byte(t.indexes[i].Name)); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// DropTable removes a table, its rows and its indexes, or nothing if it
+// fails.
+func (tx *Tx) DropTable(name string) error {
+	return tx.atomic(func() error { return tx.dropTable(name) })
+}
+
+func (tx *Tx) dropTable(name string) error {
+	tables, err := tx.tablesBucket(false)
+	if errors.Is(err, ErrBucketNotFound) {
+		return fmt.Errorf("%w: %q", ErrTableNotFound, name)
+	}
+	if err != nil {
+		return err
+	}
+	t, err := tx.Table(name)
+	if err != nil {
+		return err
+	}
+	if err := tx.unlinkParents(t); err != nil {
+		return err
+	}
+	if _, err := tables.Del([]byte(name)); err != nil {
+		return err
+	}
+	if _, err := tables.Del([]byte(SEQUENCE_PREFIX + name)); err != nil {
+		return err
+	}
+	return tables.DeleteBucket([]byte(name))
+}
+
+// Tables returns the names of the tables, in order.
+func (tx *Tx) Tables() ([]string, error) {
+	tables, err := tx.tablesBucket(false)
+	if errors.Is(err, ErrBucketNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	err = tables.ForEachBucket(func(name []byte) error {
+		names = append(names, string(name))
+		return nil
+	})
+	return names, err
+}
+
+// the bucket of the tables, created if asked
+func (tx *Tx) tablesBucket(create bool) (*Bucket, error) {
+	b, err := tx.Bucket([]byte(TABLES_BUCKET))
+	if errors.Is(err, ErrBucketNotFound) && create {
+		return tx.CreateBucket([]byte(TABLES_BUCKET))
+	}
+	return b, err
+}
+
+// a handle of the schema, checked
+func newTable(s Schema) (*Table, error) {
+	if s.Name == "" {
+		return nil, fmt.Errorf("%w: no name", ErrSchema)
+	}
+	if len(s.Columns) == 0 {
+		return nil, fmt.Errorf("%w: no column in %q", ErrSchema, s.Name)
+	}
+	columns := map[string]int{}
+	auto := -1
+	s.Columns = append([]Column(nil), s.Columns...)
+	for i, c := range s.Columns {
+		if c.Name == "" {
+			return nil, fmt.Errorf("%w: column %d of %q has no name", ErrSchema, i+1, s.Name)
+		}
+		if _, ok := columns[c.Name]; ok {
+			return nil, fmt.Errorf("%w: two columns %q in %q", ErrSchema, c.Name, s.Name)
+		}
+		if c.Type < ColumnInt64 || c.Type > ColumnBool {
+			return nil, fmt.Errorf("%w: column %q of type %d", ErrSchema, c.Name, c.Type)
+		}
+		if c.AutoIncrement {
+			if c.Type != ColumnInt64 || c.Nullable {
+				return nil, fmt.Errorf("%w: AUTO_INCREMENT column %q not int64 or nullable", ErrSchema, c.Name)
+			}
+			if auto >= 0 {
+				return nil, fmt.Errorf("%w: two AUTO_INCREMENT columns in %q", ErrSchema, s.Name)
+			}
+			auto = i
+		}
+		var err error
+		if s.Columns[i].Default, err = columnDefault(c); err != nil {
+			return nil, err
+		}
+		if c.Added > s.Version || c.Added == 0 && i > 0 && s.Columns[i-1].Added > 0 {
+			return nil, fmt.Errorf("%w: column %q added in version %d", ErrSchema, c.Name, c.Added)
+		}
+		columns[c.Name] = i
+	}
+	if len(s.PrimaryKey) == 0 {
+		return nil, fmt.Errorf("%w: no primary key in %q", ErrSchema, s.Name)
+	}
+	t := &Table{schema: s, auto: auto}
+	for _, name := range s.PrimaryKey {
+		i, ok := columns[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: no column %q of the primary key in %q", ErrSchema, name, s.Name)
+		}
+		if s.Columns[i].Nullable {
+			return nil, fmt.Errorf("%w: column %q of the primary key is nullable", ErrSchema, name)
+		}
+		for _, j := range t.key {
+			if j == i {
+				return nil, fmt.Errorf("%w: column %q twice in the primary key", ErrSchema, name)
+			}
+		}
+		t.key = append(t.key, i)
+	}
+	for _, index := range s.Indexes {
+		if err := t.addIndex(index, columns); err != nil {
+			return nil, err
+		}
+	}
+	s.ForeignKeys = append([]ForeignKey(nil), s.ForeignKeys...)
+	for i := range s.ForeignKeys {
+		if s.ForeignKeys[i].Name == "" {
+			s.ForeignKeys[i].Name = foreignKeyName(s.Name, s.ForeignKeys[i])
+		}
+		if err := t.addForeignKey(s.ForeignKeys[i], columns); err != nil {
+			return nil, err
+		}
+	}
+	s.Checks = append([]Check(nil), s.Checks...)
+	for i := range s.Checks {
+		if s.Checks[i].Name == "" {
+			s.Checks[i].Name = checkName(s.Name, i+1)
+		}
+		if err := t.addCheck(s.Checks[i]); err != nil {
+			return nil, err
+		}
+	}
+	t.schema = s
+	return t, nil
+}
+
+// Schema returns the schema of the table.
+func (t *Table) Schema() Schema {
+	return t.schema
+}
+
+// Insert adds a row, ErrRowExists if there's one with its primary key,
+// ErrDuplicate if another row has its entry of a unique index,
+// ErrForeignKey if a foreign key has no parent row, a *CheckError if a
+// check of the table rejects it. It returns
+// the value of the AUTO_INCREMENT column, taken from its sequence if NULL
+// in row, 0 if the table has none.
+func (t *Table) Insert(row Row) (int64, error) {
+	row, id, err := t.autoIncrement(row)
+	if err != nil {
+		return 0, err
+	}
+	key, value, err := t.encodeRow(row)
+	if err != nil {
+		return 0, err
+	}
+	if err := t.checkRow(row); err != nil {
+		return 0, err
+	}
+	if _, ok, err := t.rows.Get(key); err != nil {
+		return 0, err
+	} else if ok {
+		return 0, fmt.Errorf("%w: %v in %q", ErrRowExists, t.keyOf(row), t.schema.Name)
+	}
+	if err := t.checkUnique(key, row); err != nil {
+		return 0, err
+	}
+	if err := t.checkParents(nil, row); err != nil {
+		return 0, err
+	}
+	if err := t.rows.Set(key, value); err != nil {
+		return 0, err
+	}
+	return id, t.updateIndexes(key, nil, row)
+}
+
+// Update replaces the row of the primary key of row, ErrRowNotFound if
+// there's none, ErrDuplicate, ErrForeignKey and a *CheckError as Insert.
+func (t *Table) Update(row Row) error {
+	key, value, err := t.encodeRow(row)
+	if err != nil {
+		return err
+	}
+	if err := t.checkRow(row); err != nil {
+		return err
+	}
+	old, ok, err := t.getRow(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %v in %q", ErrRowNotFound, t.keyOf(row), t.schema.Name)
+	}
+	if err := t.checkUnique(key, row); err != nil {
+		return err
+	}
+	if err := t.checkParents(old, row); err != nil {
+		return err
+	}
+	if err := t.rows.Set(key, value); err != nil {
+		return err
+	}
+	return t.updateIndexes(key, old, row)
+}
+
+// Get returns the row of a primary key, the values of its columns in the
+// order of the schema.
+func (t *Table) Get(key ...any) (Row, bool, error) {
+	k, err := t.encodeKey(key, false)
+	if err != nil {
+		return nil, false, err
+	}
+	return t.getRow(k)
+}
+
+// the row of an encoded key
+func (t *Table) getRow(key []byte) (Row, bool, error) {
+	value, ok, err := t.rows.Get(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	row, err := t.decodeRow(value)
+	return row, err == nil, err
+}
+
+// Delete removes the row of a primary key, false if there's none, and the
+// rows referencing it by a foreign key ON DELETE CASCADE; ErrForeignKey if
+// one references it by another, nothing deleted.
+func (t *Table) Delete(key ...any) (bool, error) {
+	return t.delete(key, true)
+}
+
+// delete a row and apply the foreign keys of the rows referencing it, see
+// deleteChildren
+func (t *Table) delete(key []any, cascade bool) (bool, error) {
+	k, err := t.encodeKey(key, false)
+	if err != nil {
+		return false, err
+	}
+	old, ok, err := t.getRow(k)
+	if err != nil || !ok {
+		return false, err
+	}
+	del := func() error {
+		if _, err := t.rows.Del(k); err != nil {
+			return err
+		}
+		if err := t.updateIndexes(k, old, nil); err != nil {
+			return err
+		}
+		return t.deleteChildren(old, cascade)
+	}
+	if children, err := t.children(); err != nil {
+		return false, err
+	} else if len(children) == 0 {
+		return true, del()
+	}
+	return true, t.rows.tx.atomic(del)
+}
+
+// Scan calls fn with the rows from the primary key start to the one before
+// end, in the order of their keys, that of the values with the default
+// comparator of the DB; start and end may be the
+// first columns of a key only, nil for the first and after the last row.
+// It stops at the first error of fn, returned.
+func (t *Table) Scan(start, end []any, fn func(row Row) error) error {
+	from, err := t.encodeKey(start, true)
+	if err != nil {
+		return err
+	}
+	var to []byte
+	if end != nil {
+		if to, err = t.encodeKey(end, true); err != nil {
+			return err
+		}
+	}
+	return t.scanRows(from, to, false, func(key []byte, row Row) error { return fn(row) })
+}
+
+// ScanPrefix calls fn with the rows whose primary key starts with values,
+// the first columns of the key, in the order of their keys.
+func (t *Table) ScanPrefix(values []any, fn func(row Row) error) error {
+	prefix, err := t.encodeKey(values, true)
+	if err != nil {
+		return err
+	}
+	return t.scanRows(prefix, PrefixEnd(prefix), false, func(key []byte, row Row) error { return fn(row) })
+}
+
+// ScanThrough is Scan to the last row whose primary key starts with last,
+// included: the rows of a range of the first columns of the key.
+func (t *Table) ScanThrough(start, last []any, fn func(row Row) error) error {
+	from, err := t.encodeKey(start, true)
+	if err != nil {
+		return err
+	}
+	to, err := t.encodeKey(last, true)
+	if err != nil {
+		return err
+	}
+	return t.scanRows(from, PrefixEnd(to), false, func(key []byte, row Row) error { return fn(row) })
+}
+
+// call fn with the keys and rows from the key from to the one before to,
+// nil for the end, from the last if reverse
+func (t *Table) scanRows(from, to []byte, reverse bool, fn func(key []byte, row Row) error) error {
+	return scanBucket(t.rows, from, to, reverse, func(key, value []byte) error {
+		row, err := t.decodeRow(value)
+		if err != nil {
+			return err
+		}
+		return fn(key, row)
+	})
+}
+
+// call fn with the keys and values of a bucket from the key from to the one
+// before to, nil for the end, from the last if reverse
+func scanBucket(b *Bucket, from, to []byte, reverse bool, fn func(key, value []byte) error) error {
+	c := b.Cursor()
+	var key, value []byte
+	switch {
+	case !reverse:
+		key, value = c.Seek(from)
+	case to == nil:
+		key, value = c.Last()
+	default:
+		if key, _ = c.Seek(to); key == nil {
+			key, value = c.Last()
+		} else {
+			key, value = c.Prev()
+		}
+	}
+	for key != nil {
+		if reverse && from != nil && b.tree.compare(key, from) < 0 || !reverse && to != nil && b.tree.compare(key, to) >= 0 {
+			break
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+		if reverse {
+			key, value = c.Prev()
+		} else {
+			key, value = c.Next()
+		}
+	}
+	return c.Err()
+}
+
+// the values of the primary key of a row
+func (t *Table) keyOf(row Row) []any {
+	return columnsOf(t.key, row)
+}
+
+// the values of some columns of a row
+func columnsOf(cols []int, row Row) []any {
+	values := make([]any, len(cols))
+	for i, col := range cols {
+		values[i] = row[col]
+	}
+	return values
+}
+
+// the key and value of a row, checked against the schema
+func (t *Table) encodeRow(row Row) (key, value []byte, err error) {
+	if len(row) != len(t.schema.Columns) {
+		return nil, nil, fmt.Errorf("%w: %d values for the %d columns of %q", ErrBadRow, len(row), len(t.schema.Columns), t.schema.Name)
+	}
+	for i, c := range t.schema.Columns {
+		if row[i] == nil {
+			if !c.Nullable {
+				return nil, nil, fmt.Errorf("%w: column %q isn't nullable", ErrBadRow, c.Name)
+			}
+			value = append(value, rowNull)
+			continue
+		}
+		if err := checkColumn(c, row[i]); err != nil {
+			return nil, nil, err
+		}
+		value = append(value, rowValue)
+		switch v := row[i].(type) {
+		case int64:
+			value = binary.AppendVarint(value, v)
+		case float64:
+			value = binary.BigEndian.AppendUint64(value, math.Float64bits(v))
+		case string:
+			value = binary.AppendUvarint(value, uint64(len(v)))
+			value = append(value, v...)
+		case []byte:
+			value = binary.AppendUvarint(value, uint64(len(v)))
+			value = append(value, v...)
+		case bool:
+			value = append(value, boolByte(v))
+		}
+	}
+	key, err = t.encodeKey(t.keyOf(row), false)
+	return key, value, err
+}
+
+// the key of the values of the primary key, or of its first columns if
+// prefix
+func (t *Table) encodeKey(values []any, prefix bool) ([]byte, error) {
+	if len(values) > len(t.key) || !prefix && len(values) != len(t.key) {
+		return nil, fmt.Errorf("%w: %d values for the %d columns of the primary key of %q", ErrBadRow, len(values), len(t.key), t.schema.Name)
+	}
+	return t.encodeColumns(nil, t.key, values)
+}
+
+// append the key of the values of the first columns of cols
+func (t *Table) encodeColumns(key []byte, cols []int, values []any) ([]byte, error) {
+	for i, v := range values {
+		c := t.schema.Columns[cols[i]]
+		if err := checkColumn(c, v); err != nil {
+			return nil, err
+		}
+	}
+	return AppendKey(key, values...)
+}
+
+// the row of a value
+func (t *Table) decodeRow(value []byte) (Row, error) {
+	row, _, err := t.decodeColumns(value)
+	return row, err
+}
+
+// the row of a value and the number of its columns in it, those added
+// after it was written have their default
+func (t *Table) decodeColumns(value []byte) (Row, int, error) {
+	bad := func() error { return fmt.Errorf("%w: bad row of %q", ErrCorrupt, t.schema.Name) }
+	row := make(Row, len(t.schema.Columns))
+	for i, c := range t.schema.Columns {
+		if len(value) == 0 {
+			if c.Added == 0 {
+				return nil, 0, bad()
+			}
+			for j := i; j < len(row); j++ {
+				row[j] = t.schema.Columns[j].Default
+				if b, ok := row[j].([]byte); ok {
+					row[j] = append([]byte(nil), b...)
+				}
+			}
+			return row, i, nil
+		}
+		tag := value[0]
+		value = value[1:]
+		if tag == rowNull {
+			continue
+		}
+		switch c.Type {
+		case ColumnInt64:
+			v, n := binary.Varint(value)
+			if n <= 0 {
+				return nil, 0, bad()
+			}
+			row[i], value = v, value[n:]
+		case ColumnFloat64:
+			if len(value) < 8 {
+				return nil, 0, bad()
+			}
+			row[i], value = math.Float64frombits(binary.BigEndian.Uint64(value)), value[8:]
+		case ColumnString, ColumnBytes:
+			size, n := binary.Uvarint(value)
+			if n <= 0 || uint64(len(value)-n) < size {
+				return nil, 0, bad()
+			}
+			b := value[n : n+int(size)]
+			if c.Type == ColumnString {
+				row[i] = string(b)
+			} else {
+				row[i] = append([]byte(nil), b...)
+			}
+			value = value[n+int(size):]
+		case ColumnBool:
+			if len(value) < 1 {
+				return nil, 0, bad()
+			}
+			row[i], value = value[0] != 0, value[1:]
+		}
+	}
+	if len(value) != 0 {
+		return nil, 0, bad()
+	}
+	return row, len(row), nil
+}
+
+// check that a value is of the type of its column
+func checkColumn(c Column, v any) error {
+	ok := false
+	switch v.(type) {
+	case int64:
+		ok = c.Type == ColumnInt64
+	case float64:
+		ok = c.Type == ColumnFloat64
+	case string:
+		ok = c.Type == ColumnString
+	case []byte:
+		ok = c.Type == ColumnBytes
+	case bool:
+		ok = c.Type == ColumnBool
+	}
+	if !ok {
+		return fmt.Errorf("%w: %T for column %q of type %v", ErrBadRow, v, c.Name, c.Type)
+	}
+	return nil
+}
+
+func boolByte(v bool) byte {
+	if v {
+		return 1
+	}
+	return 0
+}
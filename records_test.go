@@ -0,0 +1,437 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// the schema of the users: id, name, score, data and admin
+func usersSchemaTest() Schema {
+	return Schema{
+		Name: "users",
+		Columns: []Column{
+			{Name: "id", Type: ColumnInt64},
+			{Name: "name", Type: ColumnString},
+			{Name: "score", Type: ColumnFloat64, Nullable: true},
+			{Name: "data", Type: ColumnBytes, Nullable: true},
+			{Name: "admin", Type: ColumnBool},
+		},
+		PrimaryKey: []string{"id"},
+	}
+}
+
+// create the table of s, with rows fill adds
+func createTableTest(t *testing.T, db *DB, s Schema, fill func(t *Table) error) {
+	t.Helper()
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	table, err := tx.CreateTable(s)
+	if err == nil && fill != nil {
+		err = fill(table)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+}
+
+// the rows of a table in the order of its primary key
+func tableRowsTest(t *testing.T, db *DB, name string) []Row {
+	t.Helper()
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	table, err := tx.Table(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []Row
+	if err := table.Scan(nil, nil, func(row Row) error {
+		rows = append(rows, row)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestTable(t *testing.T) {
+	db := openTest(t)
+	createTableTest(t, db, usersSchemaTest(), func(users *Table) error {
+		for i := int64(-5); i < 995; i++ {
+			row := Row{i, fmt.Sprint("user", i), float64(i) / 2, nil, i%2 == 0}
+			if i%3 == 0 {
+				row[2], row[3] = nil, []byte{byte(i)}
+			}
+			if _, err := users.Insert(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	check := func(db *DB) {
+		t.Helper()
+		rows := tableRowsTest(t, db, "users")
+		if len(rows) != 1000 {
+			t.Fatalf("%d rows", len(rows))
+		}
+		// the negative keys first
+		for j, row := range rows {
+			i := int64(j - 5)
+			want := fmt.Sprint(Row{i, fmt.Sprint("user", i), float64(i) / 2, nil, i%2 == 0})
+			if i%3 == 0 {
+				want = fmt.Sprint(Row{i, fmt.Sprint("user", i), nil, []byte{byte(i)}, i%2 == 0})
+			}
+			if fmt.Sprint(row) != want {
+				t.Fatalf("row %d is %v, want %s", j, row, want)
+			}
+		}
+	}
+	check(db)
+	crashTest(db)
+	db = openTestPath(t, db.Path)
+	check(db)
+	db = reopenTest(t, db)
+	check(db)
+
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	users, err := tx.Table("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Insert(Row{int64(1), "again", nil, nil, false}); !errors.Is(err, ErrRowExists) {
+		t.Fatalf("insert of a key twice: %v", err)
+	}
+	if err := users.Update(Row{int64(1), "renamed", math.Inf(1), nil, true}); err != nil {
+		t.Fatal(err)
+	}
+	if row, ok, err := users.Get(int64(1)); !ok || err != nil || fmt.Sprint(row) != "[1 renamed +Inf <nil> true]" {
+		t.Fatalf("updated row %v %v: %v", row, ok, err)
+	}
+	if err := users.Update(Row{int64(5000), "x", nil, nil, false}); !errors.Is(err, ErrRowNotFound) {
+		t.Fatalf("update of a missing row: %v", err)
+	}
+	if ok, err := users.Delete(int64(2)); !ok || err != nil {
+		t.Fatalf("delete: %v %v", ok, err)
+	}
+	if ok, err := users.Delete(int64(2)); ok || err != nil {
+		t.Fatalf("delete twice: %v %v", ok, err)
+	}
+	if _, ok, err := users.Get(int64(2)); ok || err != nil {
+		t.Fatalf("get of a deleted row: %v %v", ok, err)
+	}
+	for name, row := range map[string]Row{
+		"short":    {int64(9000), "x"},
+		"type":     {"9000", "x", nil, nil, false},
+		"int":      {9000, "x", nil, nil, false},
+		"not null": {int64(9000), nil, nil, nil, false},
+	} {
+		if _, err := users.Insert(row); !errors.Is(err, ErrBadRow) {
+			t.Errorf("insert of a row %s: %v", name, err)
+		}
+	}
+	if _, _, err := users.Get("1"); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("get of a key of another type: %v", err)
+	}
+	if _, _, err := users.Get(int64(1), int64(2)); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("get of a key of two columns: %v", err)
+	}
+
+	// the rows from a key to the one before another
+	var ids []int64
+	users.Scan([]any{int64(10)}, []any{int64(15)}, func(row Row) error {
+		ids = append(ids, row[0].(int64))
+		return nil
+	})
+	if fmt.Sprint(ids) != "[10 11 12 13 14]" {
+		t.Fatalf("scanned %v", ids)
+	}
+	stop := errors.New("stop")
+	if err := users.Scan(nil, nil, func(row Row) error { return stop }); err != stop {
+		t.Fatalf("scan stopped by %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if rows := tableRowsTest(t, db, "users"); len(rows) != 999 {
+		t.Fatalf("%d rows after the delete", len(rows))
+	}
+}
+
+func TestTableSchema(t *testing.T) {
+	db := openTest(t)
+	createTableTest(t, db, usersSchemaTest(), nil)
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	if _, err := tx.CreateTable(usersSchemaTest()); !errors.Is(err, ErrTableExists) {
+		t.Fatalf("create twice: %v", err)
+	}
+	for name, change := range map[string]func(s *Schema){
+		"no name":         func(s *Schema) { s.Name = "" },
+		"no column":       func(s *Schema) { s.Columns = nil },
+		"no column name":  func(s *Schema) { s.Columns[1].Name = "" },
+		"two columns":     func(s *Schema) { s.Columns[1].Name = "id" },
+		"bad type":        func(s *Schema) { s.Columns[1].Type = 9 },
+		"no primary key":  func(s *Schema) { s.PrimaryKey = nil },
+		"key not column":  func(s *Schema) { s.PrimaryKey = []string{"missing"} },
+		"key nullable":    func(s *Schema) { s.PrimaryKey = []string{"score"} },
+		"key twice":       func(s *Schema) { s.PrimaryKey = []string{"id", "id"} },
+		"bad default":     func(s *Schema) { s.Columns[1].Default = int64(1) },
+		"added in future": func(s *Schema) { s.Columns[1].Added = 3 },
+	} {
+		s := usersSchemaTest()
+		s.Name = "other"
+		change(&s)
+		if _, err := tx.CreateTable(s); !errors.Is(err, ErrSchema) {
+			t.Errorf("create with %s: %v", name, err)
+		}
+	}
+	if names, err := tx.Tables(); err != nil || fmt.Sprint(names) != "[users]" {
+		t.Fatalf("tables %v: %v", names, err)
+	}
+	users, _ := tx.Table("users")
+	if s := users.Schema(); s.Name != "users" || len(s.Columns) != 5 || s.Columns[2].Type != ColumnFloat64 {
+		t.Fatalf("schema %+v", s)
+	}
+
+	if err := tx.DropTable("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Table("users"); !errors.Is(err, ErrTableNotFound) {
+		t.Fatalf("dropped table: %v", err)
+	}
+	if err := tx.DropTable("users"); !errors.Is(err, ErrTableNotFound) {
+		t.Fatalf("drop twice: %v", err)
+	}
+	if names, _ := tx.Tables(); len(names) != 0 {
+		t.Fatalf("tables %v after the drop", names)
+	}
+	// a table isn't a bucket of the keys
+	if names := listBuckets(tx, nil); fmt.Sprintf("%q", names) != `["\x00tables"]` {
+		t.Fatalf("buckets %q", names)
+	}
+}
+
+func TestDecodeRowCorrupt(t *testing.T) {
+	table, err := newTable(usersSchemaTest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, value, err := table.encodeRow(Row{int64(1), "name", 1.5, []byte("d"), true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row, err := table.decodeRow(value); err != nil || fmt.Sprint(row) != "[1 name 1.5 [100] true]" {
+		t.Fatalf("decoded %v: %v", row, err)
+	}
+	for _, n := range []int{0, 2, len(value) - 1} {
+		if _, err := table.decodeRow(value[:n]); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("row of %d bytes: %v", n, err)
+		}
+	}
+	if _, err := table.decodeRow(append(value, 0)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("row with a byte after it: %v", err)
+	}
+}
+
+// a CREATE or DROP that fails leaves the Tx as before it, the Tx goes on
+func TestTableDDLAtomic(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	execTestTx(t, tx, "CREATE TABLE t (id INT PRIMARY KEY, v TEXT)")
+	for i := 0; i < 500; i++ {
+		execTestTx(t, tx, "INSERT INTO t VALUES (?, 'x')", i)
+	}
+	if _, err := tx.Exec("CREATE UNIQUE INDEX by_v ON t (v)"); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("unique index of equal values: %v", err)
+	}
+	execTestTx(t, tx, "INSERT INTO t VALUES (1000, 'y')")
+	s := usersSchemaTest()
+	s.Indexes = []Index{{Name: "i", Columns: []string{"name"}}, {Name: "i", Columns: []string{"admin"}}}
+	if _, err := tx.CreateTable(s); !errors.Is(err, ErrSchema) {
+		t.Fatalf("create with two indexes i: %v", err)
+	}
+	if _, err := tx.Exec("DROP INDEX missing ON t"); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("drop of a missing index: %v", err)
+	}
+	if len(tx.savepoints) != 0 {
+		t.Fatalf("%d savepoints left", len(tx.savepoints))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *DB) {
+		t.Helper()
+		if got := selectTest(t, db, "SELECT COUNT(*) FROM t"); got != "[[501]]" {
+			t.Fatalf("%s rows", got)
+		}
+		tx, _ := db.Begin(false)
+		defer tx.Rollback()
+		if names, _ := tx.Tables(); fmt.Sprint(names) != "[t]" {
+			t.Fatalf("tables %v", names)
+		}
+		tb, _ := tx.Table("t")
+		if len(tb.Schema().Indexes) != 0 {
+			t.Fatalf("indexes %v", tb.Schema().Indexes)
+		}
+		if names := listBuckets(tx, tb.rows); len(names) != 0 {
+			t.Fatalf("buckets %q of the table", names)
+		}
+	}
+	check(db)
+	crashTest(db)
+	db = openTestPath(t, db.Path)
+	check(db)
+
+	// the savepoints of the DDL are released, their pages reused
+	tx, _ = db.Begin(true)
+	sp, _ := tx.Savepoint()
+	for i := 0; i < 100; i++ {
+		execTestTx(t, tx, "CREATE INDEX by_v ON t (v)")
+		execTestTx(t, tx, "DROP INDEX by_v ON t")
+	}
+	if len(tx.savepoints) != 1 {
+		tx.Rollback()
+		t.Fatalf("%d savepoints", len(tx.savepoints))
+	}
+	execTestTx(t, tx, "DROP TABLE t")
+	if names, _ := tx.Tables(); len(names) != 0 {
+		tx.Rollback()
+		t.Fatalf("tables %v after the drop", names)
+	}
+	// back to a savepoint of the caller before them
+	if err := tx.RollbackTo(sp); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	execTestTx(t, tx, "CREATE INDEX by_v ON t (v)")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := selectTest(t, db, "SELECT id FROM t WHERE v = 'y'"); got != "[[1000]]" {
+		t.Fatalf("rows %s by the index", got)
+	}
+	if report, err := db.Check(context.Background()); err != nil || len(report.Problems) != 0 {
+		t.Fatalf("check %+v: %v", report, err)
+	}
+
+	execTest(t, db, "DROP TABLE t")
+	if _, err := db.Exec("SELECT * FROM t"); !errors.Is(err, ErrTableNotFound) {
+		t.Fatalf("select of a dropped table: %v", err)
+	}
+	for _, sql := range []string{"DROP t", "DROP INDEX i", "DROP TABLE", "DROP INDEX ON t"} {
+		if _, err := db.Exec(sql); !errors.Is(err, ErrSQLSyntax) {
+			t.Errorf("%s: %v", sql, err)
+		}
+	}
+}
+
+// the table events of a composite key, user from -2 to 2 and at from 0 to
+// 9, the kind k of at%3 indexed with at, k1\xff for at 9
+func eventsTest(t *testing.T) *DB {
+	t.Helper()
+	db := openTest(t)
+	createTableTest(t, db, Schema{
+		Name: "events",
+		Columns: []Column{
+			{Name: "user", Type: ColumnInt64},
+			{Name: "at", Type: ColumnInt64},
+			{Name: "kind", Type: ColumnString},
+		},
+		PrimaryKey: []string{"user", "at"},
+		Indexes:    []Index{{Name: "by_kind", Columns: []string{"kind", "at"}}},
+	}, func(events *Table) error {
+		for user := int64(-2); user <= 2; user++ {
+			for at := int64(0); at < 10; at++ {
+				kind := fmt.Sprint("k", at%3)
+				if at == 9 {
+					kind = "k1\xff"
+				}
+				if _, err := events.Insert(Row{user, at, kind}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return db
+}
+
+// the user:at of the rows of a scan of the events
+func eventKeysTest(t *testing.T, db *DB, scan func(events *Table, fn func(row Row) error) error) string {
+	t.Helper()
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	events, err := tx.Table("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	if err := scan(events, func(row Row) error {
+		keys = append(keys, fmt.Sprintf("%d:%d", row[0], row[1]))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(keys)
+}
+
+func TestScanPrefix(t *testing.T) {
+	db := eventsTest(t)
+	for _, c := range []struct {
+		name string
+		scan func(events *Table, fn func(row Row) error) error
+		want string
+	}{
+		{"prefix", func(e *Table, fn func(Row) error) error { return e.ScanPrefix([]any{int64(-1)}, fn) },
+			"[-1:0 -1:1 -1:2 -1:3 -1:4 -1:5 -1:6 -1:7 -1:8 -1:9]"},
+		{"whole key", func(e *Table, fn func(Row) error) error { return e.ScanPrefix([]any{int64(1), int64(4)}, fn) },
+			"[1:4]"},
+		{"no rows", func(e *Table, fn func(Row) error) error { return e.ScanPrefix([]any{int64(3)}, fn) },
+			"[]"},
+		{"through", func(e *Table, fn func(Row) error) error {
+			return e.ScanThrough([]any{int64(0), int64(8)}, []any{int64(1), int64(1)}, fn)
+		}, "[0:8 0:9 1:0 1:1]"},
+		{"through the first column", func(e *Table, fn func(Row) error) error {
+			return e.ScanThrough([]any{int64(1)}, []any{int64(2)}, fn)
+		}, "[1:0 1:1 1:2 1:3 1:4 1:5 1:6 1:7 1:8 1:9 2:0 2:1 2:2 2:3 2:4 2:5 2:6 2:7 2:8 2:9]"},
+		// Scan is to the row before end
+		{"scan", func(e *Table, fn func(Row) error) error {
+			return e.Scan([]any{int64(1), int64(8)}, []any{int64(2)}, fn)
+		},
+			"[1:8 1:9]"},
+	} {
+		if got := eventKeysTest(t, db, c.scan); got != c.want {
+			t.Errorf("%s: %s, want %s", c.name, got, c.want)
+		}
+	}
+	// the SQL reads the same ranges
+	for query, want := range map[string]string{
+		"SELECT at FROM events WHERE user = -2 AND at >= 7":                "[[7] [8] [9]]",
+		"SELECT at FROM events WHERE user = 0 AND at > 2 AND at <= 4":      "[[3] [4]]",
+		"SELECT user, at FROM events WHERE user <= -2 AND at = 9":          "[[-2 9]]",
+		"SELECT user FROM events WHERE user > 1 AND at < 1":                "[[2]]",
+		"SELECT at FROM events WHERE kind = 'k1' AND at <= 7 AND user = 1": "[[1] [4] [7]]",
+	} {
+		if got := selectTest(t, db, query); got != want {
+			t.Errorf("%s: %s, want %s", query, got, want)
+		}
+	}
+
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	events, _ := tx.Table("events")
+	if err := events.ScanPrefix([]any{"x"}, func(Row) error { return nil }); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("prefix of a string for an int64: %v", err)
+	}
+	if err := events.ScanThrough(nil, []any{int64(1), int64(2), int64(3)}, func(Row) error { return nil }); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("scan through three columns of two: %v", err)
+	}
+}
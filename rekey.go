@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Key rotation: RotateEncryptionKey seals the pages written from then on
+// with a new key, those of the file stay sealed with the previous one
+// until they're rewritten. The meta page holds the previous key sealed
+// with the new one, so that the file is opened with the new key only,
+// even amid a rotation, and the pager decrypts a page with either key.
+// The pager also tracks which pages it read or wrote with the new key.
+//
+// The copy-on-write trees write no page in place, a rotation rewrites
+// the others the same way: a sweep in the background copies the pages
+// sealed with the previous key to new pages, and the nodes above them,
+// REKEY_BATCH_PAGES per Tx committed without ops, walking the keys, the
+// trees of the catalog and the catalog in order. The writers moving pages
+// meanwhile, a snapshot is then checked to have none left, or the sweep
+// starts over. The next checkpoint drops the previous key from the meta
+// page, it's kept in memory for the older snapshots. A rotation not over
+// goes on after Open.
+
+const REKEY_BATCH_PAGES = 256 // pages rewritten per Tx by the sweep
+
+var ErrRotating = errors.New("encryption key rotation not over")
+
+// the stages of a pass of the sweep
+const (
+	rekeyKeys = iota
+	rekeyBuckets
+	rekeyCatalog
+	rekeyDone
+)
+
+// where a pass of the sweep goes on
+type rekeyCursor struct {
+	stage int
+	path  []byte // the first catalog entry left, during rekeyBuckets
+	key   []byte // the first key left in the tree, nil at its start
+}
+
+// RotateEncryptionKey replaces the key of an encrypted file: the pages are
+// sealed with the new one from now on and rewritten in the background,
+// see WaitKeyRotation, readers and writers go on meanwhile. The file is
+// opened with the new key afterward, even before the pages are rewritten;
+// the meta page is written before RotateEncryptionKey returns, the
+// KeyProvider of the DB is to give the new key from then on. It fails
+// with ErrRotating if the previous rotation isn't over.
+func (db *DB) RotateEncryptionKey(key []byte) error {
+	if db.cipher == nil {
+		return fmt.Errorf("%w: the file isn't encrypted", ErrEncryptionKey)
+	}
+	if err := checkKeySize(key); err != nil {
+		return err
+	}
+	if db.readOnly(context.Background()) {
+		return ErrReadOnly
+	}
+	next, err := newPageKey(key)
+	if err != nil {
+		return err
+	}
+	defer db.lockWriter()()
+	if db.closed.Load() {
+		return ErrDBClosed
+	}
+	keys := db.cipher.keys.Load()
+	if keys.sealed != nil {
+		return ErrRotating
+	}
+	sealed, err := next.sealKey(keys.current)
+	if err != nil {
+		return err
+	}
+	db.cipher.rotate(&pageKeys{current: next, previous: keys.current, sealed: sealed})
+	if err := db.writeKeys(); err != nil {
+		return err
+	}
+	db.log.Info("encryption key rotation started", "file_pages", db.page.flushed)
+	db.startRekey()
+	return nil
+}
+
+// WaitKeyRotation waits for the end of the sweep of the last rotation,
+// started by RotateEncryptionKey or Open, and returns the error that
+// stopped it; a rotation stopped goes on at the next Open. It returns nil
+// right away if no sweep was started.
+func (db *DB) WaitKeyRotation(ctx context.Context) error {
+	db.rekey.mu.Lock()
+	done := db.rekey.done
+	db.rekey.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+	}
+	db.rekey.mu.Lock()
+	defer db.rekey.mu.Unlock()
+	return db.rekey.err
+}
+
+// write the meta page with the keys, checkpointing first so that it's of
+// the last commit; the caller holds the writer lock
+func (db *DB) writeKeys() error {
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	err := db.writeMeta()
+	db.mu.Unlock()
+	if err != nil {
+		db.poison(fmt.Errorf("key rotation: %w", err))
+	}
+	return err
+}
+
+func (db *DB) startRekey() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	db.rekey.mu.Lock()
+	db.rekey.cancel, db.rekey.done, db.rekey.err = cancel, done, nil
+	db.rekey.mu.Unlock()
+	go func() {
+		defer close(done)
+		err := db.rekeyPages(ctx)
+		if err != nil && ctx.Err() == nil {
+			db.log.Warn("encryption key rotation stopped", "err", err)
+		}
+		db.rekey.mu.Lock()
+		db.rekey.err = err
+		db.rekey.mu.Unlock()
+	}()
+}
+
+// stop the sweep, it may be waiting for the writer lock held by Close
+func (db *DB) stopRekey() {
+	db.rekey.mu.Lock()
+	cancel, done := db.rekey.cancel, db.rekey.done
+	db.rekey.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// rewrite the pages sealed with the previous key until a snapshot has none
+func (db *DB) rekeyPages(ctx context.Context) error {
+	for {
+		var at rekeyCursor
+		for at.stage != rekeyDone {
+			if err := db.rekeyBatch(ctx, &at); err != nil {
+				return err
+			}
+		}
+		// the snapshot checked is the last commit, or a later one
+		db.mu.Lock()
+		version := db.version
+		db.mu.Unlock()
+		if err := db.waitDurable(version); err != nil {
+			return err
+		}
+		n, err := db.stalePages()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	unlock, err := db.lockWriterContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if db.closed.Load() {
+		return ErrDBClosed
+	}
+	keys := db.cipher.keys.Load()
+	db.cipher.rotate(&pageKeys{current: keys.current, previous: keys.previous})
+	if err := db.writeKeys(); err != nil {
+		return err
+	}
+	db.log.Info("encryption key rotation done", "version", db.version)
+	return nil
+}
+
+// rewrite REKEY_BATCH_PAGES pages at most from the cursor on
+func (db *DB) rekeyBatch(ctx context.Context, at *rekeyCursor) error {
+	tx, err := db.BeginContext(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// the pages of the Tx and the dirty ones are written with the current key
+	stale := func(ptr uint64) bool {
+		_, ok := tx.page.updates[ptr]
+		return !ok && !db.cache.isDirty(ptr) && db.cipher.stale(ptr)
+	}
+	n := REKEY_BATCH_PAGES
+	for n > 0 && at.stage != rekeyDone {
+		stage := at.stage
+		switch stage {
+		case rekeyKeys:
+			at.key, err = tx.tree.rewrite(at.key, stale, &n)
+		case rekeyBuckets:
+			err = tx.rekeyBucket(at, stale, &n)
+		case rekeyCatalog:
+			at.key, err = tx.catalog.rewrite(at.key, stale, &n)
+		}
+		if err != nil {
+			return err
+		}
+		// rekeyBucket goes on to the catalog by itself
+		if at.key == nil && stage != rekeyBuckets {
+			at.stage++
+		}
+	}
+	if n == REKEY_BATCH_PAGES {
+		return nil
+	}
+	return tx.commit(nil)
+}
+
+// rewrite the tree of the first catalog entry left, or go on to the
+// catalog once there's none
+func (tx *Tx) rekeyBucket(at *rekeyCursor, stale func(uint64) bool, n *int) error {
+	paths, roots, err := tx.catalogScan(nil)
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(paths), func(i int) bool { return bytes.Compare(paths[i], at.path) >= 0 })
+	if i == len(paths) {
+		at.stage, at.key = rekeyCatalog, nil
+		return nil
+	}
+	tree := tx.tree
+	tree.root, tree.usage = roots[i], nil
+	if bytes.HasPrefix(paths[i], []byte{0, 2}) {
+		tree.cmp = nil // an internal tree
+	}
+	if at.key, err = tree.rewrite(at.key, stale, n); err != nil {
+		return err
+	}
+	if tree.root != roots[i] {
+		if err := tx.setBucketRoot(paths[i], tree.root); err != nil {
+			return err
+		}
+	}
+	if at.key == nil {
+		at.path = append(paths[i], 0)
+	}
+	return nil
+}
+
+// the pages of the trees of the last durable commit the sweep has to
+// rewrite
+func (db *DB) stalePages() (n int, err error) {
+	stale := func(ptr uint64) bool {
+		return !db.cache.isDirty(ptr) && db.cipher.stale(ptr)
+	}
+	err = db.View(func(tx *Tx) (err error) {
+		_, roots, err := tx.catalogScan(nil)
+		if err != nil {
+			return err
+		}
+		defer catchTreeError(&err)
+		for _, root := range append(roots, tx.tree.root, tx.catalog.root) {
+			n += tx.countStale(root, stale)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// a tree error panics
+func (tx *Tx) countStale(ptr uint64, stale func(uint64) bool) int {
+	if ptr == 0 {
+		return 0
+	}
+	n := 0
+	node := tx.pageGet(ptr)
+	if stale(ptr) {
+		n++
+	}
+	if node.getNodeType() == BNODE_NODE {
+		for i := uint16(0); i < node.getNumberOfKeys(); i++ {
+			n += tx.countStale(node.getPointer(i), stale)
+		}
+	}
+	return n
+}
+
+// copy the pages stale reports to new pages, and the nodes above them,
+// from the kid holding the key from on, n pages at most counted down.
+// Returns the key to go on from, nil at the end of the tree.
+func (tree *BTree) rewrite(from []byte, stale func(uint64) bool, n *int) (next []byte, err error) {
+	if tree.root == 0 {
+		return nil, nil
+	}
+	defer catchTreeError(&err)
+	tree.root, next = treeRewrite(tree, tree.root, from, stale, n)
+	return next, nil
+}
+
+func treeRewrite(tree *BTree, ptr uint64, from []byte, stale func(uint64) bool, n *int) (uint64, []byte) {
+	node := tree.get(ptr)
+	var copied BNode
+	var next []byte
+	if node.getNodeType() == BNODE_NODE {
+		nkeys := node.getNumberOfKeys()
+		for i := uint16(0); i < nkeys; i++ {
+			if from != nil && i+1 < nkeys && tree.compare(node.getKey(i+1), from) <= 0 {
+				continue // before the cursor, done by a previous batch
+			}
+			if *n == 0 {
+				next = append([]byte{}, node.getKey(i)...)
+				break
+			}
+			kid, kidNext := treeRewrite(tree, node.getPointer(i), from, stale, n)
+			if kid != node.getPointer(i) {
+				if copied.data == nil {
+					copied = pageCopy(tree, node)
+				}
+				copied.setPointer(i, kid)
+			}
+			if kidNext != nil {
+				next = kidNext
+				break
+			}
+		}
+	}
+	if copied.data == nil {
+		if *n == 0 || !stale(ptr) {
+			return ptr, next
+		}
+		copied = pageCopy(tree, node)
+	}
+	if *n > 0 {
+		*n--
+	}
+	tree.del(ptr)
+	return tree.new(copied), next
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// the keys and a bucket, then the checkpoint writing the pages
+func fillRekeyTest(t *testing.T, db *DB) {
+	t.Helper()
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	for i := 0; i < 20000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%06d", i)), bytes.Repeat([]byte{byte(i)}, i%300))
+	}
+	b, _ := tx.CreateBucket([]byte("b"))
+	for i := 0; i < 3000; i++ {
+		b.Set([]byte(fmt.Sprint(i)), []byte("x"))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func wantRekeyed(t *testing.T, db *DB, want string) {
+	t.Helper()
+	if r, err := db.Check(context.Background()); err != nil || !r.OK() {
+		t.Fatalf("check: %v %v", r.Problems, err)
+	}
+	if got := dumpTest(t, db); got != want {
+		t.Fatal("keys changed by the rotation")
+	}
+}
+
+func TestRotateEncryptionKey(t *testing.T) {
+	k1, k2, k3 := keyTest(1), bytes.Repeat([]byte{2}, 16), bytes.Repeat([]byte{3}, 24)
+	db := openTest(t, WithEncryptionKey(k1), WithWALArchiveSize(1<<30), WithCacheSize(16))
+	fillRekeyTest(t, db)
+	old, _ := db.Begin(false)
+	defer old.Rollback()
+	before := dumpTest(t, db)
+
+	if err := db.RotateEncryptionKey(k2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RotateEncryptionKey(k3); !errors.Is(err, ErrRotating) {
+		t.Fatalf("rotation amid another: %v", err)
+	}
+	// the writers go on meanwhile, sealing with the new key
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("k%06d", (i*7919)%20000)), []byte("new")); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%500 == 0 {
+				db.Checkpoint()
+			}
+		}
+	}()
+	if err := db.WaitKeyRotation(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if db.cipher.rotating() {
+		t.Fatal("rotating after the sweep")
+	}
+	// a snapshot older than the end reads the pages of the previous key
+	n := 0
+	c := old.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	if n != 20000 {
+		t.Fatalf("%d keys in the snapshot before the rotation", n)
+	}
+	old.Rollback()
+	// and so do the WAL records archived before it
+	if recs := readWALTest(t, db.newWALReader(0)); len(recs) == 0 {
+		t.Fatal("no commit read")
+	}
+	after := dumpTest(t, db)
+	wantRekeyed(t, db, after)
+
+	// the file opens with the new key only, no page left of the previous
+	db.Close()
+	if db, err := Open(db.Path, WithEncryptionKey(k1)); !errors.Is(err, ErrEncryptionKey) {
+		if db != nil {
+			db.Close()
+		}
+		t.Fatalf("open with the previous key: %v", err)
+	}
+	db = openTestPath(t, db.Path, WithEncryptionKey(k2), WithWALArchiveSize(1<<30), WithCacheSize(16))
+	if keys := db.cipher.keys.Load(); keys.previous != nil || keys.sealed != nil {
+		t.Fatal("previous key after reopening")
+	}
+	wantRekeyed(t, db, after)
+	if before == after {
+		t.Fatal("no write during the rotation")
+	}
+	// the segments sealed with the previous key are gone for the readers
+	if _, err := db.newWALReader(0).next(); !errors.Is(err, ErrWALGone) {
+		t.Fatalf("read of the segments of the previous key: %v", err)
+	}
+}
+
+// a rotation interrupted goes on at Open, the commits meanwhile recovered
+func TestRotateEncryptionKeyCrash(t *testing.T) {
+	k1, k2 := keyTest(1), keyTest(2)
+	db := openTest(t, WithEncryptionKey(k1))
+	fillRekeyTest(t, db)
+	if err := db.RotateEncryptionKey(k2); err != nil {
+		t.Fatal(err)
+	}
+	db.stopRekey()
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, fmt.Sprintf("k%06d", i), "during")
+	}
+	want := dumpTest(t, db)
+	crashTest(db)
+	if db, err := Open(db.Path, WithEncryptionKey(k1)); !errors.Is(err, ErrEncryptionKey) {
+		if db != nil {
+			db.Close()
+		}
+		t.Fatalf("open with the previous key amid a rotation: %v", err)
+	}
+	db = openTestPath(t, db.Path, WithEncryptionKey(k2))
+	if err := db.WaitKeyRotation(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wantRekeyed(t, db, want)
+	db = reopenTest(t, db, WithEncryptionKey(k2))
+	if db.cipher.rotating() {
+		t.Fatal("rotating after reopening")
+	}
+	wantRekeyed(t, db, want)
+}
+
+func TestRotateEncryptionKeyBad(t *testing.T) {
+	if err := openTest(t).RotateEncryptionKey(keyTest(1)); !errors.Is(err, ErrEncryptionKey) {
+		t.Fatalf("rotation of a plaintext file: %v", err)
+	}
+	db := openTest(t, WithEncryptionKey(keyTest(1)))
+	if err := db.RotateEncryptionKey([]byte("short")); err == nil {
+		t.Fatal("rotation to a key of 5 bytes")
+	}
+	mustSet(t, db, "a", "b")
+	db = reopenTest(t, db, WithEncryptionKey(keyTest(1)), WithReadOnly())
+	if err := db.RotateEncryptionKey(keyTest(2)); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("rotation of a read-only file: %v", err)
+	}
+	if err := db.WaitKeyRotation(context.Background()); err != nil {
+		t.Fatalf("wait without a rotation: %v", err)
+	}
+	db = reopenTest(t, db, WithEncryptionKey(keyTest(1)))
+	db.Close()
+	if err := db.RotateEncryptionKey(keyTest(2)); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("rotation of a closed DB: %v", err)
+	}
+}
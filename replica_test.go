@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplica(t *testing.T) {
+	primary := openTest(t, WithWALArchiveSize(1<<30))
+	for i := 0; i < 100; i++ {
+		writeReplicated(t, primary, i)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		primary.ServeReplication(l)
+	}()
+	defer func() {
+		l.Close()
+		<-served
+	}()
+
+	replica := openTest(t, WithReplicaOf(l.Addr().String()))
+	waitFollower(t, primary, replica)
+	wantSameDB(t, primary, replica)
+	for i := 100; i < 200; i++ {
+		writeReplicated(t, primary, i)
+	}
+	waitFollower(t, primary, replica)
+	wantSameDB(t, primary, replica)
+
+	// only the replication writes it
+	if err := replica.Set([]byte("a"), []byte("1")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("set on a replica: %v", err)
+	}
+	if _, err := replica.Begin(true); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("write Tx on a replica: %v", err)
+	}
+	if _, err := replica.BeginTx(TxOptions{Writable: true}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("optimistic Tx on a replica: %v", err)
+	}
+
+	s := replica.Stats()
+	if s.ReplicationLag != 0 || s.ReplicationDelay <= 0 || s.ReplicationDelay > 2*REPLICATION_HEARTBEAT_INTERVAL {
+		t.Fatalf("lag of %d commits, delay %v once up to date", s.ReplicationLag, s.ReplicationDelay)
+	}
+	if s := primary.Stats(); s.ReplicationLag != 0 || s.ReplicationDelay != 0 {
+		t.Fatalf("lag of %d commits, delay %v on the primary", s.ReplicationLag, s.ReplicationDelay)
+	}
+	var metrics strings.Builder
+	replica.WriteMetrics(&metrics)
+	if !strings.Contains(metrics.String(), "replication_lag_commits 0") {
+		t.Fatalf("metrics\n%s", metrics.String())
+	}
+
+	// the delay grows while the primary is away
+	l.Close()
+	<-served
+	before := replica.Stats().ReplicationDelay
+	time.Sleep(50 * time.Millisecond)
+	if after := replica.Stats().ReplicationDelay; after < before+50*time.Millisecond {
+		t.Fatalf("delay %v, %v before the primary left", after, before)
+	}
+	// Close stops following
+	if err := replica.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(t.TempDir()+"/test.db", WithReplicaOf("127.0.0.1:1"), WithReadOnly()); err == nil {
+		t.Fatal("replica opened read-only")
+	}
+}
+
+func TestReplicationLag(t *testing.T) {
+	db := openTest(t)
+	if lag, delay := db.replicationLag(); lag != 0 || delay != 0 {
+		t.Fatalf("lag %d, delay %v before following", lag, delay)
+	}
+	db.trackReplica(5, 10)
+	if lag, _ := db.replicationLag(); lag != 0 {
+		t.Fatalf("lag %d never up to date", lag)
+	}
+	db.replica.upToDate.Store(time.Now().Add(-time.Minute).UnixNano())
+	if lag, delay := db.replicationLag(); lag != 5 || delay < time.Minute {
+		t.Fatalf("lag %d, delay %v", lag, delay)
+	}
+	db.trackReplica(10, 0)
+	if lag, delay := db.replicationLag(); lag != 0 || delay > time.Second {
+		t.Fatalf("lag %d, delay %v once up to date", lag, delay)
+	}
+	// the replication writes a replica, not the others
+	replica := &DB{}
+	replica.opts.replicaOf = "primary"
+	if !replica.readOnly(context.Background()) || replica.readOnly(context.WithValue(context.Background(), replicationKey{}, true)) {
+		t.Fatal("writes of the replication and of others mixed up")
+	}
+}
@@ -0,0 +1,585 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	REPLICATION_MAGIC = "SEREPL01"
+
+	// hello of both sides, the follower first with the database it
+	// follows and the version of its last commit applied, zero for none;
+	// the primary replies with its own id and last version
+	// | magic | database id | version |
+	// | 8B    | 16B         | 8B      |
+	REPLICATION_HELLO = 8 + 16 + 8
+	// then frames from the primary
+	// | type | len | payload |
+	// | 1B   | 4B  | ...     |
+	REPLICATION_FRAME_HEADER = 1 + 4
+
+	REPLICATION_RECORD       = 'r' // a commit, a WAL record
+	REPLICATION_SNAPSHOT     = 's' // a chunk of a backup, see WriteBackup
+	REPLICATION_SNAPSHOT_END = 'S' // after the last chunk
+	REPLICATION_HEARTBEAT    = 'h' // the last version of the primary, 8B
+
+	REPLICATION_HEARTBEAT_INTERVAL = time.Second      // between heartbeats of an idle primary
+	REPLICATION_TIMEOUT            = 30 * time.Second // without a frame, or to send one
+	REPLICATION_RETRY              = time.Second      // between two connections of a follower
+	REPLICATION_APPLY              = 1000             // records applied by a Tx of the follower at most
+	REPLICATION_MAX_FRAME          = 1 << 30          // bytes of a frame at most
+
+	// internal tree of the position of a follower
+	REPLICATION_PATH     = "\x00\x02replication"
+	REPLICATION_POSITION = "position"
+)
+
+// the context of the Txs of Follow, writable on a replica
+type replicationKey struct{}
+
+// Replication: a primary serves its commits to followers over TCP with
+// ServeReplication, from the WAL archive and the WAL (see WithWALArchiveSize),
+// and the followers replay them in order with Follow, asynchronously: a
+// commit of the primary doesn't wait for them. A follower applies the
+// records received together in one Tx, with a WAL_OP_REPLICATED op of the
+// version of the last one: its position is durable with the keys, and a
+// follower reconnecting resumes from there.
+//
+// A follower behind the commits kept by the primary, or following another
+// database, is resynchronized: the primary sends a backup of a read Tx,
+// which replaces the keys and buckets of the follower, then the commits
+// after it. Only Follow must write a follower, the writes of others are
+// lost at the next resync.
+
+var ErrBadReplication = errors.New("bad replication stream")
+
+// ServeReplication streams the commits to the followers connecting to l
+// until l is closed, then closes their connections. It returns the error
+// of Accept. A listener of tls.NewListener serves them over TLS.
+func (db *DB) ServeReplication(l net.Listener) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	conns := map[net.Conn]struct{}{}
+	defer func() {
+		mu.Lock()
+		for c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		conns[c] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.serveFollower(c)
+			db.log.Info("follower disconnected", "remote", c.RemoteAddr().String(), "err", err)
+			c.Close()
+			mu.Lock()
+			delete(conns, c)
+			mu.Unlock()
+		}()
+	}
+}
+
+func (db *DB) serveFollower(c net.Conn) error {
+	c.SetReadDeadline(time.Now().Add(REPLICATION_TIMEOUT))
+	id, version, err := readReplicationHello(c)
+	if err != nil {
+		return err
+	}
+	c.SetReadDeadline(time.Time{})
+	w := &frameWriter{conn: c, w: bufio.NewWriter(c)}
+	last := db.visible.Load().version
+	w.w.Write(replicationHello(db.info.ID, last))
+	db.log.Info("follower connected", "remote", c.RemoteAddr().String(), "version", version)
+	r := db.newWALReader(version)
+	signal := db.commitSignal()
+	var recs []walRecord
+	if id != db.info.ID || version > last {
+		err = ErrWALGone
+	} else {
+		recs, err = r.next()
+	}
+	heartbeat := time.NewTicker(REPLICATION_HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+	for {
+		if errors.Is(err, ErrWALGone) {
+			db.log.Info("follower resynced from a snapshot", "remote", c.RemoteAddr().String(), "version", r.version, "reason", err)
+			if r, err = db.sendSnapshot(w); err == nil {
+				signal = db.commitSignal()
+				recs, err = r.next()
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if err := w.frame(REPLICATION_RECORD, encodeWALRecord(stripReplicated(rec))); err != nil {
+				return err
+			}
+		}
+		if len(recs) > 0 {
+			// how far behind the follower is once it applies them
+			err = w.heartbeat(db.visible.Load().version)
+		} else if err = w.flush(); err == nil {
+			select {
+			case <-signal:
+			case <-heartbeat.C:
+				err = w.heartbeat(db.visible.Load().version)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if db.closed.Load() {
+			return ErrDBClosed
+		}
+		signal = db.commitSignal()
+		recs, err = r.next()
+	}
+}
+
+// send a backup of the last commit, and return a reader of the commits
+// after it
+func (db *DB) sendSnapshot(w *frameWriter) (*walReader, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	w.kind = REPLICATION_SNAPSHOT
+	if err := tx.WriteBackup(w); err != nil {
+		return nil, err
+	}
+	if err := w.frame(REPLICATION_SNAPSHOT_END, nil); err != nil {
+		return nil, err
+	}
+	return db.newWALReader(tx.version), nil
+}
+
+// the position ops of a primary following another one are its own
+func stripReplicated(rec walRecord) walRecord {
+	ops := rec.ops[:0:0]
+	for _, op := range rec.ops {
+		if op.kind != WAL_OP_REPLICATED {
+			ops = append(ops, op)
+		}
+	}
+	rec.ops = ops
+	return rec
+}
+
+// the frames sent to a follower, the chunks of a backup through Write
+type frameWriter struct {
+	conn net.Conn
+	w    *bufio.Writer
+	kind byte // of the frames written by Write
+}
+
+func (w *frameWriter) frame(kind byte, payload []byte) error {
+	var h [REPLICATION_FRAME_HEADER]byte
+	h[0] = kind
+	binary.BigEndian.PutUint32(h[1:], uint32(len(payload)))
+	w.conn.SetWriteDeadline(time.Now().Add(REPLICATION_TIMEOUT))
+	w.w.Write(h[:])
+	_, err := w.w.Write(payload)
+	return err
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	if err := w.frame(w.kind, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *frameWriter) heartbeat(version uint64) error {
+	return w.frame(REPLICATION_HEARTBEAT, binary.BigEndian.AppendUint64(nil, version))
+}
+
+func (w *frameWriter) flush() error {
+	w.conn.SetWriteDeadline(time.Now().Add(REPLICATION_TIMEOUT))
+	return w.w.Flush()
+}
+
+// Follow replicates the primary serving ServeReplication at addr into the
+// DB until ctx is done, connecting again after REPLICATION_RETRY when the
+// connection fails. It returns the error of ctx, or ErrDBClosed.
+func (db *DB) Follow(ctx context.Context, addr string) error {
+	ctx = context.WithValue(ctx, replicationKey{}, true)
+	for {
+		c, err := db.dialPrimary(ctx, addr)
+		if err == nil {
+			stop := context.AfterFunc(ctx, func() { c.Close() })
+			err = db.follow(ctx, c, false)
+			stop()
+			c.Close()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		db.log.Warn("replication failed", "primary", addr, "err", err)
+		if errors.Is(err, ErrDBClosed) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(REPLICATION_RETRY):
+		}
+	}
+}
+
+// BackupFrom copies into the DB the database of the primary serving
+// ServeReplication at addr, up to its last commit when it replies, and
+// returns the version copied: the commits after the last copy if the DB
+// is a backup of that primary made before, and the primary still keeps
+// them, else a snapshot that replaces the keys and buckets of the DB, and
+// the commits after it. A failed BackupFrom leaves a DB that the next one
+// goes on from, or starts over.
+func (db *DB) BackupFrom(ctx context.Context, addr string) (uint64, error) {
+	ctx = context.WithValue(ctx, replicationKey{}, true)
+	c, err := db.dialPrimary(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	if err := db.follow(ctx, c, true); err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, err
+	}
+	_, version, err := db.ReplicationPosition()
+	return version, err
+}
+
+// connect to the primary, over TLS with WithReplicationTLS
+func (db *DB) dialPrimary(ctx context.Context, addr string) (net.Conn, error) {
+	if db.opts.replicationTLS != nil {
+		d := tls.Dialer{Config: db.opts.replicationTLS}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// replay the frames of the primary, until the DB has its last commit if
+// once is set
+func (db *DB) follow(ctx context.Context, c net.Conn, once bool) error {
+	id, version, err := db.ReplicationPosition()
+	if err != nil {
+		return err
+	}
+	if _, err := c.Write(replicationHello(id, version)); err != nil {
+		return err
+	}
+	r := &frameReader{conn: c, r: bufio.NewReader(c)}
+	primary, last, err := readReplicationHello(r.r)
+	if err != nil {
+		return err
+	}
+	if primary != id {
+		version = 0
+	}
+	db.trackReplica(version, last)
+	db.log.Info("following", "primary", primary.String(), "version", version, "primary_version", last)
+	var recs []walRecord
+	for {
+		if once && primary == id && version >= last && len(recs) == 0 {
+			return nil
+		}
+		kind, payload, err := r.frame()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case REPLICATION_RECORD:
+			rec, err := decodeReplicatedRecord(payload)
+			if err != nil {
+				return err
+			}
+			if rec.version != version+1 {
+				return fmt.Errorf("%w: version %d follows %d", ErrBadReplication, rec.version, version)
+			}
+			version = rec.version
+			recs = append(recs, rec)
+			if len(recs) < REPLICATION_APPLY && r.next() == REPLICATION_RECORD {
+				continue // applied with the next ones
+			}
+			if err := db.applyReplicated(ctx, primary, recs); err != nil {
+				return err
+			}
+			recs = recs[:0]
+			db.trackReplica(version, 0)
+		case REPLICATION_SNAPSHOT:
+			r.chunk = payload
+			if version, err = db.resync(ctx, primary, r); err != nil {
+				return err
+			}
+			id = primary
+			db.trackReplica(version, 0)
+		case REPLICATION_HEARTBEAT:
+			if len(payload) != 8 {
+				return fmt.Errorf("%w: heartbeat of %d bytes", ErrBadReplication, len(payload))
+			}
+			db.trackReplica(version, binary.BigEndian.Uint64(payload))
+		default:
+			return fmt.Errorf("%w: frame of type %d", ErrBadReplication, kind)
+		}
+	}
+}
+
+// apply the records of the primary in one Tx, with the position of the last
+func (db *DB) applyReplicated(ctx context.Context, primary DBID, recs []walRecord) error {
+	tx, err := db.BeginContext(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, rec := range recs {
+		if err := tx.replay(rec.ops); err != nil {
+			return err
+		}
+	}
+	if err := tx.replicated(replicationPosition(primary, recs[len(recs)-1].version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replace the keys and buckets by the backup from r, and return its
+// version: the position is reset first, a follower stopped meanwhile
+// starts the resync over
+func (db *DB) resync(ctx context.Context, primary DBID, r *frameReader) (uint64, error) {
+	setPosition := func(value []byte) error {
+		tx, err := db.BeginContext(ctx, true)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := tx.replicated(value); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if err := setPosition(nil); err != nil {
+		return 0, err
+	}
+	if err := db.clear(ctx); err != nil {
+		return 0, err
+	}
+	version, err := db.Restore(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+	// the backup ends with its last chunk
+	for !r.snapshotDone {
+		if _, err := r.Read(make([]byte, 1)); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	r.snapshotDone = false
+	db.log.Info("resynced from a snapshot", "primary", primary.String(), "version", version)
+	return version, setPosition(replicationPosition(primary, version))
+}
+
+// the frames received from the primary, the chunks of a backup through Read
+type frameReader struct {
+	conn         net.Conn
+	r            *bufio.Reader
+	chunk        []byte // of a backup, not read yet
+	snapshotDone bool   // the end of the backup was read
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.snapshotDone {
+			return 0, io.EOF
+		}
+		kind, payload, err := r.frame()
+		if err != nil {
+			return 0, err
+		}
+		switch kind {
+		case REPLICATION_SNAPSHOT:
+			r.chunk = payload
+		case REPLICATION_SNAPSHOT_END:
+			r.snapshotDone = true
+		default:
+			return 0, fmt.Errorf("%w: frame of type %d in a snapshot", ErrBadReplication, kind)
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (r *frameReader) frame() (byte, []byte, error) {
+	r.conn.SetReadDeadline(time.Now().Add(REPLICATION_TIMEOUT))
+	var h [REPLICATION_FRAME_HEADER]byte
+	if _, err := io.ReadFull(r.r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(h[1:])
+	if size > REPLICATION_MAX_FRAME {
+		return 0, nil, fmt.Errorf("%w: frame of %d bytes", ErrBadReplication, size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return h[0], payload, nil
+}
+
+// the type of the next frame if it's received already, 0 otherwise
+func (r *frameReader) next() byte {
+	if r.r.Buffered() == 0 {
+		return 0
+	}
+	b, _ := r.r.Peek(1)
+	return b[0]
+}
+
+func decodeReplicatedRecord(data []byte) (walRecord, error) {
+	if len(data) < WAL_RECORD_HEADER+4 || binary.LittleEndian.Uint32(data[4:]) != uint32(len(data)) {
+		return walRecord{}, fmt.Errorf("%w: record of %d bytes", ErrBadReplication, len(data))
+	}
+	if crc32.ChecksumIEEE(data[4:]) != binary.LittleEndian.Uint32(data) {
+		return walRecord{}, fmt.Errorf("%w: bad record checksum", ErrBadReplication)
+	}
+	return decodeWALRecord(data)
+}
+
+func replicationHello(id DBID, version uint64) []byte {
+	hello := append([]byte(REPLICATION_MAGIC), id[:]...)
+	return binary.BigEndian.AppendUint64(hello, version)
+}
+
+func readReplicationHello(r io.Reader) (DBID, uint64, error) {
+	var hello [REPLICATION_HELLO]byte
+	if _, err := io.ReadFull(r, hello[:]); err != nil {
+		return DBID{}, 0, err
+	}
+	if string(hello[:8]) != REPLICATION_MAGIC {
+		return DBID{}, 0, fmt.Errorf("%w: not a replication peer", ErrBadReplication)
+	}
+	return DBID(hello[8:24]), binary.BigEndian.Uint64(hello[24:]), nil
+}
+
+func replicationPosition(primary DBID, version uint64) []byte {
+	return binary.BigEndian.AppendUint64(primary[:], version)
+}
+
+// ReplicationPosition is the primary followed by the DB and the version of
+// its last commit applied, zero if it follows none.
+func (db *DB) ReplicationPosition() (primary DBID, version uint64, err error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return primary, 0, err
+	}
+	defer tx.Rollback()
+	tree, err := tx.internalTree(REPLICATION_PATH)
+	if err != nil {
+		return primary, 0, err
+	}
+	value, ok, err := tree.Get([]byte(REPLICATION_POSITION))
+	if err != nil || !ok {
+		return primary, 0, err
+	}
+	if len(value) != 16+8 {
+		return primary, 0, fmt.Errorf("%w: replication position of %d bytes", ErrCorrupt, len(value))
+	}
+	return DBID(value[:16]), binary.BigEndian.Uint64(value[16:]), nil
+}
+
+// set the position of the follower, or remove it if empty
+func (tx *Tx) replicated(position []byte) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	op := walOp{kind: WAL_OP_REPLICATED, value: append([]byte(nil), position...)}
+	tree, err := tx.internalTree(REPLICATION_PATH)
+	if err != nil {
+		return err
+	}
+	if len(position) > 0 {
+		err = tree.Insert([]byte(REPLICATION_POSITION), op.value)
+	} else {
+		_, err = tree.Delete([]byte(REPLICATION_POSITION))
+	}
+	if err == nil {
+		err = tx.setBucketRoot([]byte(REPLICATION_PATH), tree.root)
+	}
+	if err != nil {
+		tx.err = err
+		return err
+	}
+	tx.logOp(nil, op)
+	return nil
+}
+
+// follow the primary of WithReplicaOf until Close
+func (db *DB) startReplica() {
+	ctx, cancel := context.WithCancel(context.Background())
+	db.replica.cancel, db.replica.done = cancel, make(chan struct{})
+	go func() {
+		defer close(db.replica.done)
+		db.Follow(ctx, db.opts.replicaOf)
+	}()
+}
+
+func (db *DB) stopReplica() {
+	if db.replica.cancel != nil {
+		db.replica.cancel()
+		<-db.replica.done
+	}
+}
+
+// note the commits of the primary applied, and the last one if known
+func (db *DB) trackReplica(applied, primary uint64) {
+	r := &db.replica
+	r.applied.Store(applied)
+	if primary != 0 {
+		r.primary.Store(primary)
+	}
+	if applied >= r.primary.Load() {
+		r.upToDate.Store(time.Now().UnixNano())
+	}
+}
+
+// the commits of the primary not applied yet and the time since the last
+// one was, zero if the DB follows none
+func (db *DB) replicationLag() (uint64, time.Duration) {
+	r := &db.replica
+	upToDate := r.upToDate.Load()
+	if upToDate == 0 {
+		return 0, 0
+	}
+	var lag uint64
+	if applied, primary := r.applied.Load(), r.primary.Load(); primary > applied {
+		lag = primary - applied
+	}
+	return lag, time.Since(time.Unix(0, upToDate))
+}
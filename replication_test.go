@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve the replication of db on the loopback until the test is over
+func servePrimary(t *testing.T, db *DB) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.ServeReplication(l)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	return l.Addr().String()
+}
+
+// follow the primary at addr until the returned func is called
+func startFollow(t *testing.T, db *DB, addr string) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- db.Follow(ctx, addr) }()
+	stop := func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("follow: %v", err)
+		}
+		done <- context.Canceled
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return stop
+}
+
+// wait for the follower to apply the last commit of the primary
+func waitFollower(t *testing.T, primary, follower *DB) {
+	t.Helper()
+	want := primary.visible.Load().version
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if id, version, _ := follower.ReplicationPosition(); id == primary.info.ID && version == want {
+			return
+		}
+	}
+	id, version, err := follower.ReplicationPosition()
+	t.Fatalf("follower at version %d of %s (%v), want %d of %s", version, id, err, want, primary.info.ID)
+}
+
+// the keys, values, deadlines and buckets of db, a line each
+func dumpTest(t *testing.T, db *DB) string {
+	t.Helper()
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	var out strings.Builder
+	var dump func(prefix string, c *Cursor, b *Bucket)
+	dump = func(prefix string, c *Cursor, b *Bucket) {
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			fmt.Fprintf(&out, "%s%q=%q", prefix, k, v)
+			if b == nil {
+				if at, _ := tx.Expiry(k); !at.IsZero() {
+					fmt.Fprintf(&out, " until %d", at.UnixNano())
+				}
+			}
+			out.WriteByte('\n')
+		}
+		var names []string
+		if b == nil {
+			names = listBuckets(tx, nil)
+		} else {
+			names = listBuckets(tx, b)
+		}
+		for _, name := range names {
+			var inner *Bucket
+			if b == nil {
+				inner, err = tx.Bucket([]byte(name))
+			} else {
+				inner, err = b.Bucket([]byte(name))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			dump(fmt.Sprintf("%s%q/", prefix, name), inner.Cursor(), inner)
+		}
+	}
+	dump("", tx.Cursor(), nil)
+	return out.String()
+}
+
+func wantSameDB(t *testing.T, primary, follower *DB) {
+	t.Helper()
+	if p, f := dumpTest(t, primary), dumpTest(t, follower); p != f {
+		t.Fatalf("follower differs from the primary\n%s\nfollower\n%s", p, f)
+	}
+}
+
+// a write of about every kind: keys, expiry, buckets and deletes
+func writeReplicated(t *testing.T, db *DB, i int) {
+	t.Helper()
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	tx.Set([]byte(fmt.Sprintf("k%05d", i)), bytes.Repeat([]byte{byte(i)}, 200))
+	if i%7 == 0 {
+		tx.Del([]byte(fmt.Sprintf("k%05d", i/7)))
+	}
+	if i%3 == 0 {
+		tx.SetWithExpiry([]byte(fmt.Sprintf("e%05d", i)), []byte("e"), time.Now().Add(time.Hour))
+	}
+	if i%50 == 0 {
+		b, err := tx.CreateBucket([]byte(fmt.Sprint("b", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Set([]byte("k"), []byte(fmt.Sprint(i)))
+		inner, _ := b.CreateBucket([]byte("inner"))
+		inner.Set([]byte("k"), []byte("inner"))
+	}
+	if i%100 == 10 {
+		tx.DeleteBucket([]byte(fmt.Sprint("b", i-10)))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primary := openTest(t, WithWALArchiveSize(1<<30), WithCheckpointSize(64<<10))
+	// commits archived before the follower connects
+	for i := 0; i < 500; i++ {
+		writeReplicated(t, primary, i)
+	}
+	addr := servePrimary(t, primary)
+	follower := openTest(t)
+	stop := startFollow(t, follower, addr)
+	for i := 500; i < 2000; i++ {
+		writeReplicated(t, primary, i)
+	}
+	// a prepared Tx reaches the follower with its commit
+	tx, _ := primary.Begin(true)
+	tx.Set([]byte("prepared"), []byte("1"))
+	if err := tx.Prepare("p1"); err != nil {
+		t.Fatal(err)
+	}
+	primary.Checkpoint()
+	if err := primary.CommitPrepared("p1"); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = primary.Begin(true)
+	tx.Set([]byte("rolled back"), []byte("1"))
+	tx.Prepare("p2")
+	if err := primary.RollbackPrepared("p2"); err != nil {
+		t.Fatal(err)
+	}
+	if segments, _ := walSegments(primary.Path); len(segments) < 2 {
+		t.Fatalf("%d WAL segments archived", len(segments))
+	}
+	waitFollower(t, primary, follower)
+	wantSameDB(t, primary, follower)
+	stop()
+
+	// the follower resumes from its position, durable with its keys
+	_, before, _ := follower.ReplicationPosition()
+	crashTest(follower)
+	follower = openTestPath(t, follower.Path)
+	if _, version, _ := follower.ReplicationPosition(); version != before {
+		t.Fatalf("position %d after a crash, %d before", version, before)
+	}
+	for i := 2000; i < 2100; i++ {
+		writeReplicated(t, primary, i)
+	}
+	startFollow(t, follower, addr)
+	waitFollower(t, primary, follower)
+	wantSameDB(t, primary, follower)
+	for i := 2100; i < 2200; i++ {
+		writeReplicated(t, primary, i)
+	}
+	waitFollower(t, primary, follower)
+	wantSameDB(t, primary, follower)
+}
+
+// a follower behind the archive, or of another primary, restores a snapshot
+func TestReplicationResync(t *testing.T) {
+	primary := openTest(t, WithWALArchiveSize(1), WithCheckpointSize(16<<10))
+	for i := 0; i < 100; i++ {
+		writeReplicated(t, primary, i)
+	}
+	addr := servePrimary(t, primary)
+	follower := openTest(t)
+	mustSet(t, follower, "own", "lost by the resync")
+	stop := startFollow(t, follower, addr)
+	waitFollower(t, primary, follower)
+	wantSameDB(t, primary, follower)
+	stop()
+
+	for i := 100; i < 1000; i++ {
+		writeReplicated(t, primary, i)
+	}
+	primary.Checkpoint()
+	if _, err := primary.newWALReader(101).next(); !errors.Is(err, ErrWALGone) {
+		t.Fatalf("read of pruned commits: %v", err)
+	}
+	mustSet(t, follower, "own", "lost by the resync")
+	startFollow(t, follower, addr)
+	waitFollower(t, primary, follower)
+	wantSameDB(t, primary, follower)
+	for i := 1000; i < 1100; i++ {
+		writeReplicated(t, primary, i)
+	}
+	waitFollower(t, primary, follower)
+	wantSameDB(t, primary, follower)
+
+	// following another database starts over
+	other := openTest(t)
+	mustSet(t, other, "other", "1")
+	startFollow(t, follower, servePrimary(t, other))
+	waitFollower(t, other, follower)
+	wantSameDB(t, other, follower)
+}
+
+func TestReplicationProtocol(t *testing.T) {
+	if _, _, err := readReplicationHello(strings.NewReader("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")); !errors.Is(err, ErrBadReplication) {
+		t.Fatalf("hello of another protocol: %v", err)
+	}
+	id := DBID{1, 2, 3}
+	if got, version, err := readReplicationHello(bytes.NewReader(replicationHello(id, 42))); got != id || version != 42 || err != nil {
+		t.Fatalf("hello %s %d: %v", got, version, err)
+	}
+	rec := encodeWALRecord(walRecord{version: 7, ops: []walOp{{kind: WAL_OP_SET, key: []byte("k"), value: []byte("v")}}})
+	if got, err := decodeReplicatedRecord(rec); err != nil || got.version != 7 || string(got.ops[0].key) != "k" {
+		t.Fatalf("record %+v: %v", got, err)
+	}
+	bad := bytes.Clone(rec)
+	bad[len(bad)-1] ^= 1
+	for _, data := range [][]byte{bad, rec[:len(rec)-1], nil} {
+		if _, err := decodeReplicatedRecord(data); !errors.Is(err, ErrBadReplication) {
+			t.Fatalf("decode of a bad record: %v", err)
+		}
+	}
+
+	// a primary sending frames of no known type or too large
+	for _, frame := range [][]byte{{'x', 0, 0, 0, 0}, {REPLICATION_RECORD, 0xff, 0xff, 0xff, 0xff}, {REPLICATION_HEARTBEAT, 0, 0, 0, 1, 0}} {
+		primary, follower := net.Pipe()
+		go func() {
+			defer primary.Close()
+			readReplicationHello(primary)
+			primary.Write(append(replicationHello(DBID{9}, 1), frame...))
+		}()
+		db := openTest(t)
+		if err := db.follow(context.Background(), follower, false); !errors.Is(err, ErrBadReplication) {
+			t.Fatalf("frame %q: %v", frame, err)
+		}
+		follower.Close()
+	}
+}
+
+func TestBackupFrom(t *testing.T) {
+	primary := openTest(t, WithWALArchiveSize(1<<30), WithCheckpointSize(64<<10))
+	for i := 0; i < 500; i++ {
+		writeReplicated(t, primary, i)
+	}
+	addr := servePrimary(t, primary)
+	// a database of another primary is replaced by the snapshot
+	backup := openTest(t)
+	mustSet(t, backup, "other", "x")
+	version, err := backup.BackupFrom(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := primary.visible.Load().version; version != want {
+		t.Fatalf("backed up version %d, want %d", version, want)
+	}
+	wantSameDB(t, primary, backup)
+
+	// the commits after are copied onto the backup, reopened
+	for i := 500; i < 800; i++ {
+		writeReplicated(t, primary, i)
+	}
+	backup = reopenTest(t, backup)
+	if version, err = backup.BackupFrom(context.Background(), addr); err != nil {
+		t.Fatal(err)
+	}
+	if want := primary.visible.Load().version; version != want {
+		t.Fatalf("backed up version %d, want %d", version, want)
+	}
+	wantSameDB(t, primary, backup)
+	// nothing to copy
+	if again, err := backup.BackupFrom(context.Background(), addr); again != version || err != nil {
+		t.Fatalf("backed up version %d again: %v", again, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := openTest(t).BackupFrom(ctx, addr); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled backup: %v", err)
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+	if _, err := openTest(t).BackupFrom(context.Background(), closed); err == nil {
+		t.Fatal("backup from no server")
+	}
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Row checks: a CHECK of a schema is an expression of the SQL over the
+// columns of the table, a row is rejected if it's FALSE, not if it's NULL.
+// A RowCheck is a check of Go set on the DB for a table, not part of the
+// schema: it's set again after each Open. Insert and Update run the
+// checks of a row before writing it, a row rejected is a *CheckError.
+
+var ErrCheck = errors.New("row check failed")
+
+// Check is an expression the rows of a table can't make FALSE.
+type Check struct {
+	Name string `json:"name"` // check_<table>_<n> if empty, n from 1
+	Expr string `json:"expr"` // of the SQL, the columns of the table and no parameters
+}
+
+// RowCheck checks a row about to be inserted or updated in the Tx, the
+// error rejecting it.
+type RowCheck func(tx *Tx, row Row) error
+
+// CheckError is a row rejected by a check of its table.
+type CheckError struct {
+	Table string
+	Check string
+	Row   Row
+	Err   error // of the RowCheck, nil for a CHECK
+}
+
+func (e *CheckError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %q of %q: %v", ErrCheck, e.Check, e.Table, e.Err)
+	}
+	return fmt.Sprintf("%v: %q of %q for row %v", ErrCheck, e.Check, e.Table, e.Row)
+}
+
+func (e *CheckError) Unwrap() []error {
+	if e.Err != nil {
+		return []error{ErrCheck, e.Err}
+	}
+	return []error{ErrCheck}
+}
+
+// the checks of Go of the tables, by table and name
+type rowChecks struct {
+	mu     sync.RWMutex
+	tables map[string]map[string]RowCheck
+}
+
+// the CHECK of a Table handle
+type tableCheck struct {
+	Check
+	eval sqlEval
+}
+
+// SetRowCheck sets the check name of a table, or removes it if fn is nil.
+// The checks of a table run in the order of their names, after its CHECKs.
+func (db *DB) SetRowCheck(table, name string, fn RowCheck) {
+	db.rowChecks.mu.Lock()
+	defer db.rowChecks.mu.Unlock()
+	if fn == nil {
+		delete(db.rowChecks.tables[table], name)
+		return
+	}
+	if db.rowChecks.tables == nil {
+		db.rowChecks.tables = map[string]map[string]RowCheck{}
+	}
+	if db.rowChecks.tables[table] == nil {
+		db.rowChecks.tables[table] = map[string]RowCheck{}
+	}
+	db.rowChecks.tables[table][name] = fn
+}
+
+// compile a CHECK of the schema and add it to the table
+func (t *Table) addCheck(c Check) error {
+	for _, other := range t.checks {
+		if other.Name == c.Name {
+			return fmt.Errorf("%w: two checks %q in %q", ErrSchema, c.Name, t.schema.Name)
+		}
+	}
+	e, err := parseExpr(c.Expr)
+	if err != nil {
+		return fmt.Errorf("%w: check %q: %v", ErrSchema, c.Name, err)
+	}
+	scope := &sqlScope{tables: []scopeTable{{name: t.schema.Name, columns: t.schema.Columns}}}
+	eval, err := compileExpr(e, scope, nil)
+	if err != nil {
+		return fmt.Errorf("%w: check %q: %v", ErrSchema, c.Name, err)
+	}
+	t.checks = append(t.checks, tableCheck{Check: c, eval: eval})
+	return nil
+}
+
+// the default name of the nth CHECK of a table
+func checkName(table string, n int) string {
+	return "check_" + table + "_" + strconv.Itoa(n)
+}
+
+// a *CheckError if a check rejects a row inserted or updated
+func (t *Table) checkRow(row Row) error {
+	for _, c := range t.checks {
+		v, err := c.eval(row)
+		if err != nil {
+			return fmt.Errorf("%w: check %q of %q: %v", ErrSQL, c.Name, t.schema.Name, err)
+		}
+		if v != nil && v != true {
+			return &CheckError{Table: t.schema.Name, Check: c.Name, Row: row}
+		}
+	}
+	db := t.rows.tx.db
+	db.rowChecks.mu.RLock()
+	checks := db.rowChecks.tables[t.schema.Name]
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fns := make([]RowCheck, len(names))
+	for i, name := range names {
+		fns[i] = checks[name]
+	}
+	db.rowChecks.mu.RUnlock()
+	for i, fn := range fns {
+		if err := fn(t.rows.tx, row); err != nil {
+			return &CheckError{Table: t.schema.Name, Check: names[i], Row: row, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRowCheck(t *testing.T) {
+	db := openTest(t)
+	execTest(t, db, "CREATE TABLE accounts (id INT PRIMARY KEY, balance REAL CHECK (balance >= 0), kind TEXT, CONSTRAINT known CHECK (kind = 'a' OR kind = 'b'))")
+	schemas, _ := db.Schemas()
+	if got := fmt.Sprintf("%+v", schemas[0].Checks); got != "[{Name:check_accounts_1 Expr:balance >= 0} {Name:known Expr:kind = 'a' OR kind = 'b'}]" {
+		t.Fatalf("checks %s", got)
+	}
+	execTest(t, db, "INSERT INTO accounts VALUES (1, 10, 'a'), (2, 0, 'b')")
+	// NULL isn't FALSE
+	execTest(t, db, "INSERT INTO accounts VALUES (3, NULL, NULL)")
+	for _, c := range []struct {
+		sql, check string
+	}{
+		{"INSERT INTO accounts VALUES (4, -1, 'a')", "check_accounts_1"},
+		{"INSERT INTO accounts VALUES (4, 1, 'c')", "known"},
+		{"UPDATE accounts SET balance = balance - 5 WHERE id <= 2", "check_accounts_1"},
+	} {
+		_, err := db.Exec(c.sql)
+		var ce *CheckError
+		if !errors.As(err, &ce) || !errors.Is(err, ErrCheck) || ce.Check != c.check || ce.Table != "accounts" || ce.Err != nil {
+			t.Errorf("%s: %v", c.sql, err)
+		}
+	}
+	if got := selectTest(t, db, "SELECT balance FROM accounts"); got != "[[10] [0] [<nil>]]" {
+		t.Fatalf("balances %s", got)
+	}
+
+	// the checks of Go run after the CHECKs, by name
+	var calls []string
+	db.SetRowCheck("accounts", "b", func(tx *Tx, row Row) error {
+		calls = append(calls, "b")
+		if row[0].(int64) > 100 {
+			return errors.New("id too large")
+		}
+		return nil
+	})
+	db.SetRowCheck("accounts", "a", func(tx *Tx, row Row) error {
+		calls = append(calls, "a")
+		// the Tx of the write
+		_, ok, err := tx.Get([]byte("allow"))
+		if err == nil && !ok {
+			err = errors.New("not allowed")
+		}
+		return err
+	})
+	_, err := db.Exec("INSERT INTO accounts VALUES (5, 1, 'a')")
+	var ce *CheckError
+	if !errors.As(err, &ce) || ce.Check != "a" || ce.Err == nil || ce.Err.Error() != "not allowed" {
+		t.Fatalf("insert rejected by a: %v", err)
+	}
+	tx, _ := db.Begin(true)
+	tx.Set([]byte("allow"), nil)
+	execTestTx(t, tx, "INSERT INTO accounts VALUES (5, 1, 'a')")
+	_, err = tx.Exec("INSERT INTO accounts VALUES (500, 1, 'a')")
+	if !errors.As(err, &ce) || ce.Check != "b" || fmt.Sprint(ce.Row) != "[500 1 a]" {
+		tx.Rollback()
+		t.Fatalf("insert rejected by b: %v", err)
+	}
+	if _, err := tx.Exec("INSERT INTO accounts VALUES (6, -1, 'a')"); !errors.As(err, &ce) || ce.Check != "check_accounts_1" {
+		tx.Rollback()
+		t.Fatalf("insert rejected by the CHECK: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(calls) != "[a a b a b]" {
+		t.Fatalf("checks called %v", calls)
+	}
+	db.SetRowCheck("accounts", "a", nil)
+	db.SetRowCheck("accounts", "b", nil)
+	db.SetRowCheck("missing", "a", nil)
+	execTest(t, db, "INSERT INTO accounts VALUES (7, 1, 'b')")
+
+	// the CHECKs are of the schema, the checks of Go of the DB
+	db.SetRowCheck("accounts", "b", func(*Tx, Row) error { return errors.New("no") })
+	db = reopenTest(t, db)
+	execTest(t, db, "INSERT INTO accounts VALUES (8, 1, 'b')")
+	if _, err := db.Exec("INSERT INTO accounts VALUES (9, -1, 'b')"); !errors.Is(err, ErrCheck) {
+		t.Fatalf("insert after reopening: %v", err)
+	}
+}
+
+func TestRowCheckSchema(t *testing.T) {
+	db := openTest(t)
+	for _, sql := range []string{
+		"CREATE TABLE t (id INT PRIMARY KEY, CHECK (missing > 0))",
+		"CREATE TABLE t (id INT PRIMARY KEY, CHECK (id > ?))",
+		"CREATE TABLE t (id INT PRIMARY KEY, CONSTRAINT c CHECK (id > 0), CONSTRAINT c CHECK (id < 9))",
+	} {
+		if _, err := db.Exec(sql); !errors.Is(err, ErrSchema) && !errors.Is(err, ErrSQLSyntax) {
+			t.Errorf("%s: %v", sql, err)
+		}
+	}
+	s := usersSchemaTest()
+	s.Checks = []Check{{Expr: "score >"}}
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	if _, err := tx.CreateTable(s); !errors.Is(err, ErrSchema) {
+		t.Fatalf("check of bad SQL: %v", err)
+	}
+	// evaluated on the row, an error of the SQL isn't a *CheckError
+	s.Checks = []Check{{Expr: "name > 1"}}
+	users, err := tx.CreateTable(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.Insert(Row{int64(1), "a", nil, nil, false})
+	var ce *CheckError
+	if !errors.Is(err, ErrSQL) || errors.As(err, &ce) {
+		t.Fatalf("check of a string and an int: %v", err)
+	}
+}
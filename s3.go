@@ -0,0 +1,415 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backups to object storage: BackupS3 uploads a backup of WriteBackup to
+// an S3-compatible bucket in the parts of a multipart upload, RestoreS3
+// loads it back; BackupS3Incremental and RestoreS3Incremental do the same
+// with the incremental backups of WriteIncrementalBackup. The requests are signed with AWS Signature Version 4, the
+// bucket in the path as AWS, MinIO and Ceph accept.
+//
+// A request failing on the network, a 5xx or a 429 is sent again, up to
+// S3Store.Retries times with a delay doubled each time: a part is kept in
+// memory until it's uploaded, a download is resumed from the byte reached
+// with a range request on the same ETag. An upload that fails is aborted,
+// its parts are removed.
+
+const (
+	S3_PART_SIZE      = 16 << 20 // bytes of a part by default
+	S3_MIN_PART_SIZE  = 5 << 20  // bytes of a part at least, but the last
+	S3_RETRIES        = 5
+	S3_RETRY_DELAY    = 200 * time.Millisecond
+	S3_VERSION_HEADER = "X-Amz-Meta-Storage-Version" // the version of the backup
+)
+
+var ErrS3 = errors.New("S3 request failed")
+
+// S3Store is a bucket of an S3-compatible object storage. Region is
+// us-east-1 for the stores that don't have regions.
+type S3Store struct {
+	Endpoint     string // URL of the service, like https://s3.us-east-1.amazonaws.com
+	Region       string
+	Bucket       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string       // of temporary credentials, if any
+	HTTPClient   *http.Client // http.DefaultClient if nil
+	PartSize     int64        // S3_PART_SIZE if 0
+	Retries      int          // S3_RETRIES if 0, none if negative
+}
+
+// BackupS3 uploads a backup of the last commit to the object key of the
+// store and returns its version, also in the metadata of the object. The
+// snapshot is kept until the upload ends, see WriteBackup.
+func (db *DB) BackupS3(ctx context.Context, s *S3Store, key string) (version uint64, err error) {
+	tx, err := db.BeginContext(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	return db.uploadBackup(ctx, s, key, tx.Version(), tx.WriteBackup)
+}
+
+// BackupS3Incremental uploads an incremental backup of the commits after
+// since to the object key of the store, see WriteIncrementalBackup, and
+// returns its version, also in the metadata of the object.
+func (db *DB) BackupS3Incremental(ctx context.Context, s *S3Store, key string, since uint64) (uint64, error) {
+	version := db.visible.Load().version
+	return db.uploadBackup(ctx, s, key, version, func(w io.Writer) error {
+		return db.writeIncrementalBackup(w, since, version)
+	})
+}
+
+// upload what write writes, in the stream of the parts
+func (db *DB) uploadBackup(ctx context.Context, s *S3Store, key string, version uint64, write func(w io.Writer) error) (uint64, error) {
+	if s.PartSize != 0 && s.PartSize < S3_MIN_PART_SIZE {
+		return 0, fmt.Errorf("%w: parts of %d bytes, %d at least", ErrS3, s.PartSize, S3_MIN_PART_SIZE)
+	}
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+	header := http.Header{S3_VERSION_HEADER: {strconv.FormatUint(version, 10)}}
+	err := s.upload(ctx, key, pr, header)
+	pr.Close() // ends the writer if the upload failed
+	if werr := <-written; err == nil {
+		err = werr
+	}
+	if err != nil {
+		return 0, err
+	}
+	db.log.Info("backup uploaded", "bucket", s.Bucket, "key", key, "version", version)
+	return version, nil
+}
+
+// RestoreS3 loads a backup of BackupS3 from the object key of the store,
+// see Restore, and returns its version.
+func (db *DB) RestoreS3(ctx context.Context, s *S3Store, key string) (uint64, error) {
+	r := &s3Reader{ctx: ctx, s: s, key: key}
+	defer r.close()
+	return db.Restore(ctx, r)
+}
+
+// RestoreS3Incremental applies an incremental backup of
+// BackupS3Incremental from the object key of the store to a DB restored up
+// to version, see RestoreIncremental, and returns its version.
+func (db *DB) RestoreS3Incremental(ctx context.Context, s *S3Store, key string, version uint64) (uint64, error) {
+	r := &s3Reader{ctx: ctx, s: s, key: key}
+	defer r.close()
+	return db.RestoreIncremental(ctx, r, version)
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// upload the content of r to the object key in parts, aborted on failure
+func (s *S3Store) upload(ctx context.Context, key string, r io.Reader, header http.Header) (err error) {
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := s.call(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, &created); err != nil {
+		return err
+	}
+	upload := url.Values{"uploadId": {created.UploadID}}
+	defer func() {
+		if err != nil {
+			// with a context of its own, ctx may be the cause
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if aerr := s.call(ctx, http.MethodDelete, key, upload, nil, nil, nil); aerr != nil {
+				err = errors.Join(err, fmt.Errorf("abort upload: %w", aerr))
+			}
+		}
+	}()
+	size := s.PartSize
+	if size == 0 {
+		size = S3_PART_SIZE
+	}
+	buf := make([]byte, size)
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}
+	for n := 1; ; n++ {
+		m, rerr := io.ReadFull(r, buf)
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			return rerr
+		}
+		if m > 0 {
+			query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {created.UploadID}}
+			resp, err := s.do(ctx, http.MethodPut, key, query, nil, buf[:m])
+			if err != nil {
+				return fmt.Errorf("part %d: %w", n, err)
+			}
+			resp.Body.Close()
+			complete.Parts = append(complete.Parts, s3Part{Number: n, ETag: resp.Header.Get("ETag")})
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	return s.call(ctx, http.MethodPost, key, upload, nil, body, nil)
+}
+
+// send a request and decode the XML of the response into v if not nil:
+// a 200 can still be an error for a complete
+func (s *S3Store) call(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte, v any) error {
+	resp, err := s.do(ctx, method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return s3Error(method, key, resp.StatusCode, data)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %s %s: %v", ErrS3, method, key, err)
+	}
+	return nil
+}
+
+// send a request, again while it fails on the network, with a 5xx or a
+// 429, and return the response if it's a 2xx
+func (s *S3Store) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := s.request(ctx, method, key, query, header, body)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+		retry := true
+		if err == nil {
+			data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			resp.Body.Close()
+			err = s3Error(method, key, resp.StatusCode, data)
+			retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		}
+		if !retry {
+			return nil, err
+		}
+		if err := s.wait(ctx, attempt, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait before the retry after a failed attempt, the error is returned if
+// there are no more
+func (s *S3Store) wait(ctx context.Context, attempt int, err error) error {
+	retries := s.Retries
+	if retries == 0 {
+		retries = S3_RETRIES
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if attempt >= retries {
+		return err
+	}
+	t := time.NewTimer(S3_RETRY_DELAY << attempt)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func s3Error(method, key string, status int, body []byte) error {
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return fmt.Errorf("%w: %s %s: %d %s: %s", ErrS3, method, key, status, e.Code, e.Message)
+	}
+	return fmt.Errorf("%w: %s %s: %d %s", ErrS3, method, key, status, http.StatusText(status))
+}
+
+// a signed request on the object key
+func (s *S3Store) request(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("%w: endpoint: %v", ErrS3, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + key
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, body, time.Now())
+	return req, nil
+}
+
+// sign a request with AWS Signature Version 4, its body in the signature
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	scope := stamp[:8] + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-type" || name == "content-md5" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n" + req.URL.EscapedPath() + "\n" + req.URL.RawQuery + "\n")
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical.WriteString("\n" + signed + "\n" + payload)
+
+	hashed := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	k := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{stamp[:8], s.Region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(part))
+		k = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%x",
+		s.AccessKey, scope, signed, k))
+}
+
+// the query in canonical form, sorted and escaped
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escape all but the unreserved characters, and the slashes of a path
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// the body of an object, requested again from the byte reached after an
+// error, as long as the object has the same ETag
+type s3Reader struct {
+	ctx      context.Context
+	s        *S3Store
+	key      string
+	body     io.ReadCloser
+	etag     string
+	pos      int64
+	failures int
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			header := http.Header{}
+			if r.pos > 0 {
+				header.Set("Range", fmt.Sprintf("bytes=%d-", r.pos))
+				header.Set("If-Match", r.etag)
+			}
+			resp, err := r.s.do(r.ctx, http.MethodGet, r.key, nil, header, nil)
+			if err != nil {
+				return 0, err
+			}
+			r.body = resp.Body
+			if r.etag == "" {
+				r.etag = resp.Header.Get("ETag")
+			}
+		}
+		n, err := r.body.Read(p)
+		r.pos += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		r.close()
+		if n > 0 {
+			return n, nil // resumed by the next read
+		}
+		if err := r.s.wait(r.ctx, r.failures, err); err != nil {
+			return 0, err
+		}
+		r.failures++
+	}
+}
+
+func (r *s3Reader) close() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
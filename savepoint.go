@@ -0,0 +1,155 @@
+package storage
+
+import "errors"
+
+var ErrBadSavepoint = errors.New("savepoint is not active in this transaction")
+
+// Savepoint marks a point in a writable Tx that it can be rolled back to.
+type Savepoint struct {
+	tx    *Tx
+	index int
+}
+
+type savepoint struct {
+	root    uint64
+	catalog uint64
+	bucket  []byte          // bucket of the last op logged
+	nfreed  int             // length of Tx.page.freed
+	nops    int             // length of Tx.ops
+	live    map[uint64]bool // pages written by the Tx and reachable from root
+	usage   map[string]treeUsage
+}
+
+// Savepoint records the current state of the Tx.
+// Savepoints are nested, rolling back to one discards those taken after it.
+func (tx *Tx) Savepoint() (Savepoint, error) {
+	if err := tx.checkWritable(); err != nil {
+		return Savepoint{}, err
+	}
+	sp := savepoint{
+		root:    tx.tree.root,
+		catalog: tx.catalog.root,
+		bucket:  tx.opBucket,
+		nfreed:  len(tx.page.freed),
+		nops:    len(tx.ops),
+		live:    tx.livePages(),
+		usage:   make(map[string]treeUsage, len(tx.usage)),
+	}
+	for path, u := range tx.usage {
+		sp.usage[path] = *u
+	}
+	if tx.page.sealed == nil {
+		tx.page.sealed = map[uint64]bool{}
+	}
+	// the pages must survive until the savepoint is gone
+	for ptr := range sp.live {
+		tx.page.sealed[ptr] = true
+	}
+	tx.savepoints = append(tx.savepoints, sp)
+	return Savepoint{tx: tx, index: len(tx.savepoints) - 1}, nil
+}
+
+// RollbackTo undoes the updates made after the savepoint, which stays active.
+func (tx *Tx) RollbackTo(s Savepoint) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if s.tx != tx || s.index >= len(tx.savepoints) {
+		return ErrBadSavepoint
+	}
+	sp := tx.savepoints[s.index]
+	tx.savepoints = tx.savepoints[:s.index+1]
+
+	clear(tx.page.sealed)
+	for _, sp := range tx.savepoints {
+		for ptr := range sp.live {
+			tx.page.sealed[ptr] = true
+		}
+	}
+	// pages written after the savepoint are garbage now, unless an older
+	// savepoint needs them, and the retired ones it can reach are live again
+	current := tx.livePages()
+	for _, ptr := range tx.page.retired {
+		current[ptr] = true
+	}
+	tx.page.retired = tx.page.retired[:0]
+	for ptr := range current {
+		switch {
+		case sp.live[ptr]:
+		case tx.page.sealed[ptr]:
+			tx.page.retired = append(tx.page.retired, ptr)
+		default:
+			tx.page.recycled = append(tx.page.recycled, ptr)
+		}
+	}
+	tx.page.freed = tx.page.freed[:sp.nfreed]
+	tx.ops = tx.ops[:sp.nops]
+	if tx.optimistic {
+		tx.rebuildWrites()
+	}
+	tx.tree.root = sp.root
+	tx.catalog.root = sp.catalog
+	tx.opBucket = sp.bucket
+	for path, u := range tx.usage {
+		*u = sp.usage[path] // the trees count in place
+	}
+	tx.reloadBuckets()
+	tx.gen++
+	tx.schemaGen++
+	return nil
+}
+
+// pages written by the Tx that are still in use
+func (tx *Tx) livePages() map[uint64]bool {
+	live := make(map[uint64]bool, len(tx.page.updates))
+	for ptr := range tx.page.updates {
+		live[ptr] = true
+	}
+	for _, ptr := range tx.page.recycled {
+		delete(live, ptr)
+	}
+	for _, ptr := range tx.page.retired {
+		delete(live, ptr)
+	}
+	return live
+}
+
+// run fn as one update of a Tx from Begin: if it fails the Tx is rolled
+// back to before it, the error returned
+func (tx *Tx) atomic(fn func() error) error {
+	sp, err := tx.Savepoint()
+	if err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if tx.RollbackTo(sp) == nil {
+			tx.release(sp)
+		}
+		return err
+	}
+	tx.release(sp)
+	return nil
+}
+
+// drop the last savepoint, its pages not kept for the others are free
+func (tx *Tx) release(s Savepoint) {
+	if s.index != len(tx.savepoints)-1 {
+		return
+	}
+	tx.savepoints = tx.savepoints[:s.index]
+	clear(tx.page.sealed)
+	for _, sp := range tx.savepoints {
+		for ptr := range sp.live {
+			tx.page.sealed[ptr] = true
+		}
+	}
+	retired := tx.page.retired[:0]
+	for _, ptr := range tx.page.retired {
+		if tx.page.sealed[ptr] {
+			retired = append(retired, ptr)
+		} else {
+			tx.page.recycled = append(tx.page.recycled, ptr)
+		}
+	}
+	tx.page.retired = retired
+}
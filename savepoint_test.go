@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"testing"
+)
+
+func TestSavepoint(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	tx.Set([]byte("a"), []byte("1"))
+	sp1, err := tx.Savepoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Set([]byte("a"), []byte("2"))
+	tx.Set([]byte("b"), []byte("2"))
+	sp2, _ := tx.Savepoint()
+	tx.Del([]byte("a"))
+	if err := tx.RollbackTo(sp2); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := tx.Get([]byte("a")); string(v) != "2" {
+		t.Fatalf("a is %q after the rollback to the second savepoint", v)
+	}
+	if err := tx.RollbackTo(sp1); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := tx.Get([]byte("a")); string(v) != "1" {
+		t.Fatalf("a is %q after the rollback to the first savepoint", v)
+	}
+	if _, ok, _ := tx.Get([]byte("b")); ok {
+		t.Fatal("b survived the rollback")
+	}
+	// sp2 was taken after sp1, it's gone
+	if err := tx.RollbackTo(sp2); !errors.Is(err, ErrBadSavepoint) {
+		t.Fatalf("rollback to a discarded savepoint: %v", err)
+	}
+	other, _ := openTest(t).Begin(true)
+	defer other.Rollback()
+	if err := other.RollbackTo(sp1); !errors.Is(err, ErrBadSavepoint) {
+		t.Fatalf("rollback to a savepoint of another Tx: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wantValue(t, db, "a", []byte("1"))
+	wantValue(t, db, "b", nil)
+}
+
+// random updates and rollbacks to savepoints against a map
+func TestSavepointRandom(t *testing.T) {
+	db := openTest(t)
+	r := rand.New(rand.NewSource(11))
+	ref := map[string]string{}
+	for round := 0; round < 30; round++ {
+		tx, _ := db.Begin(true)
+		cur := maps.Clone(ref)
+		var sps []Savepoint
+		var states []map[string]string
+		for op := 0; op < 300; op++ {
+			switch x := r.Intn(20); {
+			case x == 0:
+				sp, err := tx.Savepoint()
+				if err != nil {
+					t.Fatal(err)
+				}
+				sps = append(sps, sp)
+				states = append(states, maps.Clone(cur))
+			case x == 1 && len(sps) > 0:
+				i := r.Intn(len(sps))
+				if err := tx.RollbackTo(sps[i]); err != nil {
+					t.Fatal(err)
+				}
+				sps, states = sps[:i+1], states[:i+1]
+				cur = maps.Clone(states[i])
+			case x < 6:
+				k := fmt.Sprint("k", r.Intn(500))
+				tx.Del([]byte(k))
+				delete(cur, k)
+			default:
+				k := fmt.Sprint("k", r.Intn(500))
+				v := fmt.Sprint(r.Int63(), string(make([]byte, r.Intn(100))))
+				tx.Set([]byte(k), []byte(v))
+				cur[k] = v
+			}
+		}
+		for k, v := range cur {
+			if got, ok, _ := tx.Get([]byte(k)); !ok || string(got) != v {
+				t.Fatalf("round %d: %q is %q %v, want %q", round, k, got, ok, v)
+			}
+		}
+		if r.Intn(3) == 0 {
+			tx.Rollback()
+		} else {
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			ref = cur
+		}
+	}
+	// the pages of the rolled back updates went back to the free list
+	db = reopenTest(t, db)
+	for k, v := range ref {
+		wantValue(t, db, k, []byte(v))
+	}
+	report, err := db.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := report.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
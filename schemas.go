@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+)
+
+// Schema catalog: the schemas of the tables are the keys of their names in
+// TABLES_BUCKET, with the format of the record and a checksum of the JSON;
+// a bare JSON record is of before the format, read the same. The version
+// of a Schema is bumped by each change. The handles of the schemas read are
+// cached in the DB by their record, a Table reads its record only; Open
+// loads them all, checking them.
+//
+// record layout, the crc32 of the JSON
+// | format | crc32 | JSON |
+// | 1B     | 4B    | ...  |
+
+const SCHEMA_FORMAT = 1
+
+// the record of a schema
+func encodeSchema(s Schema) ([]byte, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, 5, 5+len(data))
+	record[0] = SCHEMA_FORMAT
+	binary.LittleEndian.PutUint32(record[1:], crc32.ChecksumIEEE(data))
+	return append(record, data...), nil
+}
+
+// the schema of a record, checked
+func decodeSchema(name string, record []byte) (Schema, error) {
+	data := record
+	if len(record) > 0 && record[0] != '{' {
+		if len(record) < 5 || record[0] != SCHEMA_FORMAT {
+			return Schema{}, fmt.Errorf("%w: schema of table %q of unknown format", ErrCorrupt, name)
+		}
+		data = record[5:]
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(record[1:]) {
+			return Schema{}, fmt.Errorf("%w: bad checksum of the schema of table %q", ErrCorrupt, name)
+		}
+	}
+	var s Schema
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // the defaults of int64 columns
+	if err := dec.Decode(&s); err != nil {
+		return Schema{}, fmt.Errorf("%w: schema of table %q: %v", ErrCorrupt, name, err)
+	}
+	if s.Name != name {
+		return Schema{}, fmt.Errorf("%w: schema of table %q named %q", ErrCorrupt, name, s.Name)
+	}
+	return s, nil
+}
+
+// a handle of a table cached, with no buckets
+type cachedTable struct {
+	record []byte
+	table  *Table
+}
+
+// a handle of the schema of a record, without its buckets
+func (db *DB) tableOf(name string, record []byte) (*Table, error) {
+	db.schemas.mu.Lock()
+	c := db.schemas.tables[name]
+	db.schemas.mu.Unlock()
+	if c == nil || !bytes.Equal(c.record, record) {
+		s, err := decodeSchema(name, record)
+		if err != nil {
+			return nil, err
+		}
+		t, err := newTable(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		c = &cachedTable{record: append([]byte(nil), record...), table: t}
+		db.schemas.mu.Lock()
+		if db.schemas.tables == nil {
+			db.schemas.tables = map[string]*cachedTable{}
+		}
+		db.schemas.tables[name] = c
+		db.schemas.mu.Unlock()
+	}
+	// the handles are copies, they add indexes in place
+	t := *c.table
+	t.indexes = append([]tableIndex(nil), t.indexes...)
+	return &t, nil
+}
+
+// load the schemas of the tables in the cache at Open, logging those
+// corrupt, Table fails on them
+func (db *DB) loadSchemas() {
+	err := db.View(func(tx *Tx) error {
+		names, err := tx.Tables()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, err := tx.Table(name); err != nil {
+				db.log.Error("bad table schema", "table", name, "err", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.log.Error("loading the table schemas failed", "err", err)
+	}
+}
+
+// Schemas returns the schemas of the tables of the last commit, in the
+// order of their names.
+func (db *DB) Schemas() ([]Schema, error) {
+	var schemas []Schema
+	err := db.View(func(tx *Tx) error {
+		names, err := tx.Tables()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			t, err := tx.Table(name)
+			if err != nil {
+				return err
+			}
+			schemas = append(schemas, t.Schema())
+		}
+		return nil
+	})
+	return schemas, err
+}
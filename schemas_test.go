@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// set the record of the schema of a table as is
+func setSchemaRecordTest(t *testing.T, db *DB, name string, record []byte) {
+	t.Helper()
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	tables, err := tx.tablesBucket(true)
+	if err == nil {
+		err = tables.Set([]byte(name), record)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeSchema(t *testing.T) {
+	s := usersSchemaTest()
+	s.Indexes = []Index{{Name: "by_name", Columns: []string{"name"}}}
+	s.Columns[1].Default = "x"
+	record, err := encodeSchema(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record[0] != SCHEMA_FORMAT {
+		t.Fatalf("format %d", record[0])
+	}
+	got, err := decodeSchema("users", record)
+	if err != nil || fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", s) {
+		t.Fatalf("decoded %+v: %v", got, err)
+	}
+	// a record of before the format
+	bare, _ := json.Marshal(s)
+	if got, err := decodeSchema("users", bare); err != nil || got.Name != "users" || len(got.Indexes) != 1 {
+		t.Fatalf("decoded %+v of bare JSON: %v", got, err)
+	}
+	for name, corrupt := range map[string]func([]byte) []byte{
+		"empty":    func(b []byte) []byte { return nil },
+		"short":    func(b []byte) []byte { return b[:4] },
+		"format":   func(b []byte) []byte { b[0] = SCHEMA_FORMAT + 1; return b },
+		"checksum": func(b []byte) []byte { b[1] ^= 1; return b },
+		"flipped":  func(b []byte) []byte { b[len(b)-3] ^= 1; return b },
+		"JSON":     func(b []byte) []byte { return b[5:10] },
+	} {
+		if _, err := decodeSchema("users", corrupt(bytes.Clone(record))); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := decodeSchema("other", record); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("schema of another name: %v", err)
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	db := openTest(t)
+	if schemas, err := db.Schemas(); err != nil || schemas != nil {
+		t.Fatalf("schemas %v: %v", schemas, err)
+	}
+	execTest(t, db, "CREATE TABLE t (id INT PRIMARY KEY, v TEXT)")
+	execTest(t, db, "CREATE INDEX by_v ON t (v)")
+	// a record of before the format is read the same
+	bare, _ := json.Marshal(Schema{Name: "old", Columns: []Column{{Name: "a", Type: ColumnInt64}}, PrimaryKey: []string{"a"}})
+	tx, _ := db.Begin(true)
+	tables, _ := tx.tablesBucket(false)
+	tables.Set([]byte("old"), bare)
+	if _, err := tables.CreateBucket([]byte("old")); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	execTest(t, db, "INSERT INTO old VALUES (1)")
+	execTest(t, db, "INSERT INTO t VALUES (1, 'x')")
+
+	var buf bytes.Buffer
+	db = reopenTest(t, db, WithSlog(slog.NewTextHandler(&buf, nil)))
+	// loaded at Open
+	if len(db.schemas.tables) != 2 {
+		t.Fatalf("%d schemas loaded", len(db.schemas.tables))
+	}
+	cached := db.schemas.tables["t"]
+	schemas, err := db.Schemas()
+	if err != nil || len(schemas) != 2 || schemas[0].Name != "old" || schemas[1].Name != "t" || len(schemas[1].Indexes) != 1 {
+		t.Fatalf("schemas %+v: %v", schemas, err)
+	}
+	if db.schemas.tables["t"] != cached {
+		t.Fatal("schema of t read again")
+	}
+	// a handle is a copy
+	tx, _ = db.Begin(true)
+	tb, _ := tx.Table("t")
+	if err := tb.CreateIndex(Index{Name: "by_id", Columns: []string{"id", "v"}}); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if len(cached.table.indexes) != 1 {
+		tx.Rollback()
+		t.Fatalf("%d indexes of the cached handle", len(cached.table.indexes))
+	}
+	tx.Rollback()
+	execTest(t, db, "ALTER TABLE t ADD n INT")
+	if got := selectTest(t, db, "SELECT * FROM t"); got != "[[1 x <nil>]]" {
+		t.Fatalf("rows %s", got)
+	}
+	if db.schemas.tables["t"] == cached {
+		t.Fatal("schema of t not read after a change")
+	}
+	if strings.Contains(buf.String(), "bad table schema") {
+		t.Fatalf("logged %s", buf.String())
+	}
+
+	// a corrupt schema fails its table only, logged at Open
+	tx, _ = db.Begin(false)
+	tables, _ = tx.tablesBucket(false)
+	record, _, _ := tables.Get([]byte("t"))
+	record = bytes.Clone(record)
+	tx.Rollback()
+	record[len(record)-3] ^= 1
+	setSchemaRecordTest(t, db, "t", record)
+	db = reopenTest(t, db, WithSlog(slog.NewTextHandler(&buf, nil)))
+	if !strings.Contains(buf.String(), "bad table schema") || !strings.Contains(buf.String(), "table=t") {
+		t.Fatalf("logged %s", buf.String())
+	}
+	if _, err := db.Exec("SELECT * FROM t"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("select of a corrupt schema: %v", err)
+	}
+	if _, err := db.Schemas(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("schemas with one corrupt: %v", err)
+	}
+	if got := selectTest(t, db, "SELECT * FROM old"); got != "[[1]]" {
+		t.Fatalf("rows %s of old", got)
+	}
+	// a schema not valid
+	bad, _ := encodeSchema(Schema{Name: "t", Columns: []Column{{Name: "a", Type: ColumnInt64}}})
+	setSchemaRecordTest(t, db, "t", bad)
+	if _, err := db.Exec("SELECT * FROM t"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("select of a schema without a primary key: %v", err)
+	}
+}
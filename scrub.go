@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Scrubbing: Scrub and the scrubber, see WithScrubInterval, read the pages
+// of the trees from the file, not from the cache, and verify them before a
+// reader hits a bad one: each must match its checksum, or decrypt when the
+// file is encrypted, see pager.go, have the layout Check verifies, keys
+// and a root included, and match its clean copy in memory if any.
+// The pages are walked as the key rotation does, the keys, the trees of
+// the catalog then the catalog, SCRUB_BATCH_PAGES per snapshot so that no
+// snapshot pins the freed pages for long, WithScrubRate pages per second at
+// most. The dirty pages aren't in the file yet, they're skipped.
+//
+// A bad page is logged and quarantined until Close: Health fails with it,
+// Stats counts it, and it's never reused once a commit frees it, it's
+// reported as leaked by Check then.
+
+const (
+	SCRUB_BATCH_PAGES  = 64  // pages verified per snapshot
+	DEFAULT_SCRUB_RATE = 256 // pages per second
+)
+
+// the stages of a pass
+const (
+	scrubKeys = iota
+	scrubBuckets
+	scrubCatalog
+	scrubDone
+)
+
+// where a pass goes on
+type scrubCursor struct {
+	stage int
+	path  []byte // the first catalog entry left, during scrubBuckets
+	key   []byte // the first key left in the tree, nil at its start
+}
+
+// ScrubResult is what a pass of Scrub verified.
+type ScrubResult struct {
+	Pages    int64    // read from the file and verified
+	Dirty    int64    // skipped, not in the file yet
+	Bad      []uint64 // quarantined by the pass
+	Duration time.Duration
+}
+
+// Scrub verifies the pages of the trees once, see the scrubber: the bad
+// ones are quarantined and the pass goes on. The pages quarantined before
+// aren't read again. It stops when ctx is done with its error.
+func (db *DB) Scrub(ctx context.Context) (result ScrubResult, err error) {
+	start := time.Now()
+	rate := db.opts.scrubRate
+	if rate <= 0 {
+		rate = DEFAULT_SCRUB_RATE
+	}
+	var at scrubCursor
+	for at.stage != scrubDone {
+		pages := result.Pages
+		if err := db.scrubBatch(ctx, &at, &result); err != nil {
+			return result, err
+		}
+		pause := time.NewTimer(time.Duration(result.Pages-pages) * time.Second / time.Duration(rate))
+		select {
+		case <-ctx.Done():
+			pause.Stop()
+			return result, ctx.Err()
+		case <-pause.C:
+		}
+	}
+	result.Duration = time.Since(start)
+	if len(result.Bad) > 0 {
+		db.log.Warn("scrub found bad pages", "pages", result.Pages, "bad", len(result.Bad), "duration", result.Duration)
+	} else {
+		db.log.Info("scrub", "pages", result.Pages, "duration", result.Duration)
+	}
+	return result, nil
+}
+
+// verify SCRUB_BATCH_PAGES pages at most from the cursor on
+func (db *DB) scrubBatch(ctx context.Context, at *scrubCursor, r *ScrubResult) (err error) {
+	tx, err := db.BeginContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	defer catchTreeError(&err)
+	n := SCRUB_BATCH_PAGES
+	for n > 0 && at.stage != scrubDone {
+		switch at.stage {
+		case scrubKeys:
+			if at.key = db.scrubTree(&tx.tree, tx.tree.root, at.key, &n, r); at.key == nil {
+				at.stage = scrubBuckets
+			}
+		case scrubBuckets:
+			if err := db.scrubBucket(tx, at, &n, r); err != nil {
+				return err
+			}
+		case scrubCatalog:
+			if at.key = db.scrubTree(&tx.catalog, tx.catalog.root, at.key, &n, r); at.key == nil {
+				at.stage = scrubDone
+			}
+		}
+	}
+	return nil
+}
+
+// verify the tree of the first catalog entry left, or go on to the
+// catalog once there's none
+func (db *DB) scrubBucket(tx *Tx, at *scrubCursor, n *int, r *ScrubResult) error {
+	paths, roots, err := tx.catalogScan(nil)
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(paths), func(i int) bool { return bytes.Compare(paths[i], at.path) >= 0 })
+	if i == len(paths) {
+		at.stage, at.key = scrubCatalog, nil
+		return nil
+	}
+	tree := tx.tree
+	if bytes.HasPrefix(paths[i], []byte{0, 2}) {
+		tree.cmp = nil // an internal tree
+	}
+	if at.key = db.scrubTree(&tree, roots[i], at.key, n, r); at.key == nil {
+		at.path = append(paths[i], 0)
+	}
+	return nil
+}
+
+// verify the page and the kids holding the key from on, n pages at most
+// counted down. Returns the key to go on from, nil at the end of the tree.
+// The kids of a bad page are left out.
+func (db *DB) scrubTree(tree *BTree, ptr uint64, from []byte, n *int, r *ScrubResult) []byte {
+	if ptr == 0 {
+		return nil
+	}
+	node, ok := db.scrubPage(ptr, r)
+	*n = max(*n-1, 0)
+	if !ok || node.getNodeType() != BNODE_NODE {
+		return nil
+	}
+	nkeys := node.getNumberOfKeys()
+	for i := uint16(0); i < nkeys; i++ {
+		if from != nil && i+1 < nkeys && tree.compare(node.getKey(i+1), from) <= 0 {
+			continue // before the cursor, done by a previous batch
+		}
+		if *n == 0 {
+			return append([]byte{}, node.getKey(i)...)
+		}
+		if next := db.scrubTree(tree, node.getPointer(i), from, n, r); next != nil {
+			return next
+		}
+	}
+	return nil
+}
+
+// read a page from the file and verify it, the dirty ones from memory;
+// false if it's bad
+func (db *DB) scrubPage(ptr uint64, r *ScrubResult) (BNode, bool) {
+	cached, dirty := db.cache.peek(ptr)
+	if dirty {
+		r.Dirty++
+		return BNode{cached}, true
+	}
+	if db.quarantined(ptr) {
+		return BNode{}, false // reported already
+	}
+	node, err := db.readPage(ptr)
+	if err == nil {
+		err = layoutErr(node)
+	}
+	if err == nil && cached != nil && !bytes.Equal(cached, node.data[:len(cached)]) {
+		err = fmt.Errorf("%w: differs from the page in memory", ErrCorrupt)
+	}
+	r.Pages++
+	db.stats.scrubbedPages.Add(1)
+	if err != nil {
+		db.quarantine(ptr, err)
+		r.Bad = append(r.Bad, ptr)
+		return BNode{}, false
+	}
+	return node, true
+}
+
+func (db *DB) quarantine(ptr uint64, err error) {
+	db.log.Error("bad page quarantined", "page", ptr, "err", err)
+	db.scrub.mu.Lock()
+	defer db.scrub.mu.Unlock()
+	if db.scrub.bad == nil {
+		db.scrub.bad = map[uint64]error{}
+	}
+	db.scrub.bad[ptr] = err
+}
+
+func (db *DB) quarantined(ptr uint64) bool {
+	db.scrub.mu.Lock()
+	defer db.scrub.mu.Unlock()
+	return db.scrub.bad[ptr] != nil
+}
+
+// the quarantined pages in order, and the error of the first
+func (db *DB) quarantinedPages() ([]uint64, error) {
+	db.scrub.mu.Lock()
+	defer db.scrub.mu.Unlock()
+	pages := make([]uint64, 0, len(db.scrub.bad))
+	for ptr := range db.scrub.bad {
+		pages = append(pages, ptr)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	if len(pages) == 0 {
+		return nil, nil
+	}
+	return pages, db.scrub.bad[pages[0]]
+}
+
+// start the scrubber on the first commit, after the DB is configured
+func (db *DB) startScrubber() {
+	db.scrub.once.Do(func() {
+		interval := db.opts.scrubInterval
+		if interval <= 0 {
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		db.scrub.cancel = cancel
+		db.scrub.done = make(chan struct{})
+		go db.runScrubber(ctx, interval)
+	})
+}
+
+func (db *DB) runScrubber(ctx context.Context, interval time.Duration) {
+	defer close(db.scrub.done)
+	for {
+		// the bad pages are quarantined by the pass, a failed pass is retried
+		if _, err := db.Scrub(ctx); err != nil && ctx.Err() == nil {
+			db.log.Warn("scrub failed", "err", err)
+		}
+		pause := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			pause.Stop()
+			return
+		case <-pause.C:
+		}
+	}
+}
+
+// stop the scrubber, before Close waits for the readers
+func (db *DB) stopScrubber() {
+	db.scrub.once.Do(func() {})
+	if db.scrub.cancel != nil {
+		db.scrub.cancel()
+		<-db.scrub.done
+	}
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the keys and a bucket over more pages than a batch, checkpointed
+func fillScrubTest(t *testing.T, db *DB) {
+	t.Helper()
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+	for i := 0; i < 20000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%05d", i)), bytes.Repeat([]byte{'v'}, 40))
+	}
+	b, _ := tx.CreateBucket([]byte("b"))
+	for i := 0; i < 1000; i++ {
+		b.Set([]byte(fmt.Sprintf("b%05d", i)), []byte("x"))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a leaf of the keys, the second of its parent
+func scrubLeafTest(t *testing.T, db *DB) uint64 {
+	t.Helper()
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	ptr := tx.tree.root
+	for {
+		node, err := db.readPage(ptr)
+		if err != nil {
+			t.Fatalf("page %d: %v", ptr, err)
+		}
+		if node.getNodeType() == BNODE_LEAF {
+			return ptr
+		}
+		ptr = node.getPointer(1)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithEncryptionKey(keyTest(1))}} {
+		db := openTest(t, append(opts, WithScrubRate(1<<20))...)
+		fillScrubTest(t, db)
+		r, err := db.Scrub(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		check, err := db.Check(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every page of the trees, the meta page aside, and the nodes above
+		// the batches again
+		trees := int64(check.UsedPages - 1)
+		if trees < 2*SCRUB_BATCH_PAGES || r.Pages+r.Dirty < trees || r.Pages+r.Dirty > trees+10 || len(r.Bad) != 0 {
+			t.Fatalf("scrubbed %+v, %d pages used", r, check.UsedPages)
+		}
+		if s := db.Stats(); s.ScrubbedPages != uint64(r.Pages) || s.BadPages != 0 {
+			t.Fatalf("stats %d scrubbed, %d bad", s.ScrubbedPages, s.BadPages)
+		}
+		if h := db.Health(context.Background()); !h.OK() {
+			t.Fatal(h.Err())
+		}
+
+		// a page flipped in the file is quarantined, the others verified
+		leaf := scrubLeafTest(t, db)
+		db.Close()
+		fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp.WriteAt([]byte{0xab, 0xab}, int64(leaf)*int64(db.opts.pageSize))
+		fp.Close()
+		db = openTestPath(t, db.Path, append(opts, WithScrubRate(1<<20))...)
+		bad, err := db.Scrub(context.Background())
+		if err != nil || !slices.Equal(bad.Bad, []uint64{leaf}) || bad.Pages != r.Pages {
+			t.Fatalf("scrubbed %+v: %v", bad, err)
+		}
+		h := db.Health(context.Background())
+		if err := h.Err(); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("page %d", leaf)) {
+			t.Fatalf("health: %v", err)
+		}
+		if s := db.Stats(); s.BadPages != 1 {
+			t.Fatalf("%d bad pages", s.BadPages)
+		}
+		// read once, reported by the first pass only
+		if again, err := db.Scrub(context.Background()); err != nil || len(again.Bad) != 0 || again.Pages != r.Pages-1 {
+			t.Fatalf("scrubbed again %+v: %v", again, err)
+		}
+		db.Close()
+	}
+}
+
+// a page quarantined and freed by a commit is never reused, it's leaked
+func TestScrubQuarantine(t *testing.T) {
+	db := openTest(t)
+	fillScrubTest(t, db)
+	leaf := scrubLeafTest(t, db)
+	db.quarantine(leaf, fmt.Errorf("%w: test", ErrCorrupt))
+	for i := 0; i < 3; i++ {
+		tx, _ := db.Begin(true)
+		for j := 0; j < 20000; j += 10 {
+			tx.Set([]byte(fmt.Sprintf("k%05d", j)), []byte(fmt.Sprint(i)))
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		db.Checkpoint()
+	}
+	if slices.Contains(db.free.free, leaf) {
+		t.Fatalf("page %d quarantined is free", leaf)
+	}
+	r, err := db.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 1 || r.Problems[0].Check != CHECK_LEAK || r.Problems[0].Page != leaf || !strings.Contains(r.Problems[0].String(), "quarantined") {
+		t.Fatalf("problems %v", r.Problems)
+	}
+}
+
+// the scrubber runs its passes from the first commit until Close, at the
+// rate of WithScrubRate
+func TestScrubber(t *testing.T) {
+	db := openTest(t, WithScrubInterval(10*time.Millisecond), WithScrubRate(1<<20))
+	fillScrubTest(t, db)
+	for deadline := time.Now().Add(10 * time.Second); db.Stats().ScrubbedPages == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no page scrubbed")
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	scrubbed := db.Stats().ScrubbedPages
+	time.Sleep(50 * time.Millisecond)
+	if db.Stats().ScrubbedPages != scrubbed {
+		t.Fatal("scrubbing after Close")
+	}
+
+	// a batch then a pause of its pages at the rate, cut by ctx
+	db = openTest(t, WithScrubRate(10))
+	fillScrubTest(t, db)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	r, err := db.Scrub(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || r.Pages+r.Dirty != SCRUB_BATCH_PAGES || time.Since(start) > 5*time.Second {
+		t.Fatalf("scrubbed %+v in %s: %v", r, time.Since(start), err)
+	}
+	if s := db.Stats(); s.ScrubbedPages != uint64(r.Pages) {
+		t.Fatalf("stats %d scrubbed", s.ScrubbedPages)
+	}
+}
+
+// a root without keys, its checksum matching, is quarantined as by Check
+func TestScrubEmptyRoot(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "a", "1")
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	root := db.root
+	db.Close()
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := BNode{make([]byte, BTREE_PAGE_SIZE-PAGE_CHECKSUM_LEN)}
+	node.setHeaders(BNODE_LEAF, 0)
+	if err := newChecksumPager(filePager{fp, BTREE_PAGE_SIZE}, BTREE_PAGE_SIZE).writePages(map[uint64][]byte{root: node.data}); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	db = openTestPath(t, db.Path)
+	r, err := db.Scrub(context.Background())
+	if err != nil || !slices.Equal(r.Bad, []uint64{root}) {
+		t.Fatalf("scrubbed %+v: %v", r, err)
+	}
+	if _, err := db.quarantinedPages(); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "no keys") {
+		t.Fatalf("quarantined: %v", err)
+	}
+	check, err := db.Check(context.Background())
+	if err != nil || len(check.Problems) != 1 || check.Problems[0].Check != CHECK_SIZE {
+		t.Fatalf("check %v: %v", check.Problems, err)
+	}
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Auto-increment: the AUTO_INCREMENT column of a table takes the next value
+// of its sequence in a row inserted with NULL in it, from 1. The sequence
+// is the key SEQUENCE_PREFIX + the name of the table in TABLES_BUCKET, the
+// first value not reserved, 8B BE: the values are reserved SEQUENCE_BATCH
+// at a time, then taken in memory, so that most inserts don't write it.
+// A value given that's not before it reserves those up to it.
+//
+// The memory is of the writable Tx: if the key isn't the end reserved the
+// values are reserved again from it, those of rows rolled back taken again.
+// The values not taken before the DB is closed are lost, the values have
+// gaps.
+
+const (
+	SEQUENCE_PREFIX = "\x00next\x00"
+	SEQUENCE_BATCH  = 64
+)
+
+// the values of a sequence reserved, in the DB
+type sequence struct {
+	next int64 // the next value taken
+	end  int64 // the first value not reserved, the key when written
+}
+
+// the row with the value of its AUTO_INCREMENT column, taken from the
+// sequence if NULL, and that value
+func (t *Table) autoIncrement(row Row) (Row, int64, error) {
+	if t.auto < 0 || len(row) != len(t.schema.Columns) {
+		return row, 0, nil
+	}
+	key := []byte(SEQUENCE_PREFIX + t.schema.Name)
+	data, ok, err := t.tables.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	stored := int64(1)
+	if ok {
+		if len(data) != 8 {
+			return nil, 0, fmt.Errorf("%w: sequence of %q", ErrCorrupt, t.schema.Name)
+		}
+		stored = int64(binary.BigEndian.Uint64(data))
+	}
+	// the sequences are used by the writable Tx only
+	db := t.rows.tx.db
+	if db.sequences == nil {
+		db.sequences = map[string]*sequence{}
+	}
+	seq := db.sequences[t.schema.Name]
+	if seq == nil || seq.end != stored {
+		// empty, or reserved by a Tx rolled back
+		seq = &sequence{next: stored, end: stored}
+		db.sequences[t.schema.Name] = seq
+	}
+	v, given := row[t.auto].(int64)
+	if !given {
+		if row[t.auto] != nil {
+			return row, 0, nil // not an int64, see encodeRow
+		}
+		v = seq.next
+	}
+	if v >= seq.next {
+		if v == math.MaxInt64 {
+			return nil, 0, fmt.Errorf("%w: sequence of %q exhausted", ErrBadRow, t.schema.Name)
+		}
+		seq.next = v + 1
+	}
+	if v >= seq.end {
+		end := v + 1 + SEQUENCE_BATCH
+		if end < v {
+			end = math.MaxInt64
+		}
+		if err := t.tables.Set(key, binary.BigEndian.AppendUint64(nil, uint64(end))); err != nil {
+			return nil, 0, err
+		}
+		seq.end = end
+	}
+	if !given {
+		row = append(Row(nil), row...)
+		row[t.auto] = v
+	}
+	return row, v, nil
+}
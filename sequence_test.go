@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// the end reserved of the sequence of a table
+func sequenceEndTest(t *testing.T, db *DB, table string) int64 {
+	t.Helper()
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	tables, err := tx.tablesBucket(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, _ := tables.Get([]byte(SEQUENCE_PREFIX + table))
+	if len(data) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(data))
+}
+
+func TestAutoIncrement(t *testing.T) {
+	db := openTest(t)
+	execTest(t, db, "CREATE TABLE notes (id SERIAL PRIMARY KEY, text TEXT)")
+	for i := int64(1); i <= 100; i++ {
+		res := execTest(t, db, "INSERT INTO notes (text) VALUES ('x')")
+		if res.LastInsertID != i {
+			t.Fatalf("inserted id %d, want %d", res.LastInsertID, i)
+		}
+	}
+	// reserved in batches
+	if end := sequenceEndTest(t, db, "notes"); end != 1+2*(SEQUENCE_BATCH+1) {
+		t.Fatalf("end reserved %d", end)
+	}
+	res := execTest(t, db, "INSERT INTO notes (text) VALUES ('a'), ('b')")
+	if res.RowsAffected != 2 || res.LastInsertID != 102 {
+		t.Fatalf("result %+v", res)
+	}
+	// a value given after the next reserves those up to it
+	execTest(t, db, "INSERT INTO notes VALUES (1000, 'given')")
+	if res := execTest(t, db, "INSERT INTO notes VALUES (NULL, 'after')"); res.LastInsertID != 1001 {
+		t.Fatalf("id %d after one given", res.LastInsertID)
+	}
+	execTest(t, db, "INSERT INTO notes VALUES (500, 'before')")
+	if res := execTest(t, db, "INSERT INTO notes (text) VALUES ('next')"); res.LastInsertID != 1002 {
+		t.Fatalf("id %d after one given before", res.LastInsertID)
+	}
+
+	// a Tx rolled back after reserving leaves the values from the key
+	end := sequenceEndTest(t, db, "notes")
+	tx, _ := db.Begin(true)
+	notes, _ := tx.Table("notes")
+	notes.Insert(Row{int64(2000), "rolled back"})
+	id, err := notes.Insert(Row{nil, "rolled back"})
+	tx.Rollback()
+	if err != nil || id != 2001 {
+		t.Fatalf("id %d: %v", id, err)
+	}
+	tx, _ = db.Begin(true)
+	notes, _ = tx.Table("notes")
+	id, err = notes.Insert(Row{nil, "again"})
+	if err != nil || id != end {
+		tx.Rollback()
+		t.Fatalf("id %d after a rollback, want %d: %v", id, end, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the values not taken are lost at Close, not those taken
+	db = reopenTest(t, db)
+	res = execTest(t, db, "INSERT INTO notes (text) VALUES ('reopened')")
+	if res.LastInsertID <= end || res.LastInsertID > end+SEQUENCE_BATCH+1 {
+		t.Fatalf("id %d after reopening", res.LastInsertID)
+	}
+	if got := selectTest(t, db, "SELECT COUNT(*) FROM notes"); got != "[[108]]" {
+		t.Fatalf("%s rows", got)
+	}
+
+	tx, _ = db.Begin(true)
+	defer tx.Rollback()
+	notes, _ = tx.Table("notes")
+	if _, err := notes.Insert(Row{int64(math.MaxInt64), "last"}); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("insert of the last int64: %v", err)
+	}
+	for _, sql := range []string{
+		"CREATE TABLE a (id INT PRIMARY KEY, n INT AUTO_INCREMENT NULL)",
+		"CREATE TABLE b (id TEXT AUTO_INCREMENT PRIMARY KEY)",
+		"CREATE TABLE c (id SERIAL PRIMARY KEY, n SERIAL)",
+	} {
+		if _, err := tx.Exec(sql); !errors.Is(err, ErrSchema) {
+			t.Errorf("%s: %v", sql, err)
+		}
+	}
+	// a table without one inserts 0
+	if _, err := tx.Exec("CREATE TABLE plain (id INT PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := tx.Exec("INSERT INTO plain VALUES (5)"); err != nil || res.LastInsertID != 0 {
+		t.Fatalf("result %+v: %v", res, err)
+	}
+	// the sequence is dropped with its table
+	if err := tx.DropTable("notes"); err != nil {
+		t.Fatal(err)
+	}
+	tables, _ := tx.tablesBucket(false)
+	if _, ok, _ := tables.Get([]byte(SEQUENCE_PREFIX + "notes")); ok {
+		t.Fatal("sequence of a dropped table")
+	}
+}
@@ -0,0 +1,58 @@
+package storage
+
+import "sync/atomic"
+
+// Readers don't take any lock: the last durable commit is published as a
+// snapshot behind an atomic pointer, a reader loads it and pins it with a
+// counter. The tree being copy-on-write, the pages of a snapshot never
+// change, only their reuse must wait for the readers to end.
+//
+// A superseded snapshot is retired, the writer keeps it in a list until no
+// reader pins it. A reader pinning a snapshot retired meanwhile unpins it
+// and loads the new one, so once the writer sees a retired snapshot
+// unpinned, no reader can be using it anymore.
+
+type snapshot struct {
+	commit
+	readers atomic.Int32 // read-only Tx pinning the snapshot
+	retired atomic.Bool  // superseded by a newer commit
+}
+
+// pin the last durable commit
+func (db *DB) pinSnapshot() *snapshot {
+	for {
+		s := db.visible.Load()
+		s.readers.Add(1)
+		if !s.retired.Load() {
+			return s
+		}
+		s.readers.Add(-1)
+	}
+}
+
+func (db *DB) unpinSnapshot(s *snapshot) {
+	s.readers.Add(-1)
+}
+
+// make a commit the snapshot of new readers, the caller holds db.mu
+func (db *DB) publishSnapshot(c commit) {
+	old := db.visible.Swap(&snapshot{commit: c})
+	if old != nil {
+		old.retired.Store(true)
+		db.retired = append(db.retired, old)
+	}
+}
+
+// the oldest version a reader may still see, the caller holds db.mu.
+// Pages freed by that commit or before can be reused.
+func (db *DB) oldestReader() uint64 {
+	n := 0
+	for ; n < len(db.retired) && db.retired[n].readers.Load() == 0; n++ {
+		db.retired[n] = nil
+	}
+	db.retired = db.retired[n:]
+	if len(db.retired) > 0 {
+		return db.retired[0].version
+	}
+	return db.visible.Load().version
+}
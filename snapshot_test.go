@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "a", "1")
+	r, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Rollback()
+	version := r.Version()
+	for i := 0; i < 200; i++ {
+		mustSet(t, db, fmt.Sprint("k", i), "x")
+		mustSet(t, db, "a", fmt.Sprint(i))
+	}
+	if v, _, _ := r.Get([]byte("a")); string(v) != "1" {
+		t.Fatalf("snapshot sees %q", v)
+	}
+	if _, ok, _ := r.Get([]byte("k5")); ok {
+		t.Fatal("snapshot sees a later commit")
+	}
+	if r.Version() != version {
+		t.Fatalf("version %d, was %d", r.Version(), version)
+	}
+	wantValue(t, db, "a", []byte("199"))
+}
+
+// the readers see either all or none of the keys of each commit
+func TestSnapshotConcurrent(t *testing.T) {
+	db := openTest(t)
+	const keys = 20
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tx, err := db.Begin(false)
+				if err != nil {
+					errs <- err
+					return
+				}
+				first, _, _ := tx.Get([]byte("k0"))
+				for i := 1; i < keys; i++ {
+					if v, _, _ := tx.Get([]byte(fmt.Sprint("k", i))); string(v) != string(first) {
+						errs <- fmt.Errorf("version %d: k%d is %q, k0 is %q", tx.Version(), i, v, first)
+						tx.Rollback()
+						return
+					}
+				}
+				tx.Rollback()
+			}
+		}()
+	}
+	for n := 0; n < 200; n++ {
+		err := db.Update(func(tx *Tx) error {
+			for i := 0; i < keys; i++ {
+				if err := tx.Set([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint(n))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// readers begin and read while the writer holds its lock
+func TestSnapshotWriterOpen(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "a", "1")
+	w, _ := db.Begin(true)
+	defer w.Rollback()
+	w.Set([]byte("a"), []byte("2"))
+	read := make(chan []byte)
+	go func() {
+		v, _, _ := db.Get([]byte("a"))
+		read <- v
+	}()
+	select {
+	case v := <-read:
+		if string(v) != "1" {
+			t.Fatalf("read %q, an update not committed", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reader waits for the writer")
+	}
+}
@@ -0,0 +1,45 @@
+package storage
+
+import "context"
+
+// Spans of the transactions, checkpoints and recovery go to a tracer set by
+// an option, WithTracerProvider for OpenTelemetry: the default build has no
+// dependency on it, see otel.go. Without one the spans cost nothing.
+
+type tracer interface {
+	start(ctx context.Context, name string) (context.Context, span)
+}
+
+type span interface {
+	set(key string, value any) // an int, int64, uint64, string or bool
+	fail(err error)
+	end()
+}
+
+type nopSpan struct{}
+
+func (nopSpan) set(string, any) {}
+func (nopSpan) fail(error)      {}
+func (nopSpan) end()            {}
+
+func (db *DB) startSpan(ctx context.Context, name string) (context.Context, span) {
+	if db.opts.tracer == nil {
+		return ctx, nopSpan{}
+	}
+	return db.opts.tracer.start(ctx, name)
+}
+
+func endSpan(s span, err error) {
+	if err != nil {
+		s.fail(err)
+	}
+	s.end()
+}
+
+// end the span of the Tx, the Tx of replay has none
+func (tx *Tx) endSpan(err error) {
+	if tx.span != nil {
+		endSpan(tx.span, err)
+		tx.span = nil
+	}
+}
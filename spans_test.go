@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// a tracer keeping the spans ended, for the tests
+type testTracer struct {
+	mu    sync.Mutex
+	ended []*testSpan
+}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+	parent *testSpan
+	attrs  map[string]any
+	err    error
+}
+
+type testSpanKey struct{}
+
+func (tr *testTracer) start(ctx context.Context, name string) (context.Context, span) {
+	parent, _ := ctx.Value(testSpanKey{}).(*testSpan)
+	s := &testSpan{tracer: tr, name: name, parent: parent, attrs: map[string]any{}}
+	return context.WithValue(ctx, testSpanKey{}, s), s
+}
+
+func (s *testSpan) set(key string, value any) { s.attrs[key] = value }
+func (s *testSpan) fail(err error)            { s.err = err }
+
+func (s *testSpan) end() {
+	s.tracer.mu.Lock()
+	s.tracer.ended = append(s.tracer.ended, s)
+	s.tracer.mu.Unlock()
+}
+
+// the spans ended with the name
+func (tr *testTracer) spans(name string) []*testSpan {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var spans []*testSpan
+	for _, s := range tr.ended {
+		if s.name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func withTestTracer(tr *testTracer) Option {
+	return func(db *DB) {
+		db.opts.tracer = tr
+	}
+}
+
+func TestSpans(t *testing.T) {
+	var tr testTracer
+	db := openTest(t, withTestTracer(&tr), WithCheckpointSize(1<<40))
+	if spans := tr.spans("storage_engine.recover"); len(spans) != 1 || spans[0].attrs["recover.commits"] != 0 {
+		t.Fatalf("recover spans %+v", spans)
+	}
+	mustSet(t, db, "a", "1")
+	db.View(func(tx *Tx) error { return nil })
+	failed := errors.New("failed")
+	db.Update(func(tx *Tx) error { return failed })
+	tx, _ := db.Begin(true)
+	tx.Set([]byte("b"), []byte("2"))
+	tx.Commit()
+
+	// the Txs after those of Open
+	spans := tr.spans("storage_engine.tx")
+	if len(spans) < 4 {
+		t.Fatalf("%d tx spans", len(spans))
+	}
+	spans = spans[len(spans)-4:]
+	if spans[0].attrs["tx.commit"] != uint64(1) || spans[0].attrs["tx.ops"] != 1 {
+		t.Fatalf("commit span %v", spans[0].attrs)
+	}
+	if spans[1].attrs["tx.writable"] != false || spans[2].attrs["tx.optimistic"] != true {
+		t.Fatalf("spans %v %v", spans[1].attrs, spans[2].attrs)
+	}
+	if _, ok := spans[2].attrs["tx.commit"]; ok {
+		t.Fatalf("commit of a failed Update %v", spans[2].attrs)
+	}
+	if spans[3].attrs["tx.commit"] != uint64(2) || spans[3].err != nil {
+		t.Fatalf("commit span %v %v", spans[3].attrs, spans[3].err)
+	}
+
+	// the spans are children of those of the contexts
+	ctx, parent := tr.start(context.Background(), "parent")
+	tx, _ = db.BeginContext(ctx, false)
+	tx.Rollback()
+	parent.end()
+	if spans = tr.spans("storage_engine.tx"); spans[len(spans)-1].parent != parent {
+		t.Fatal("the span of the Tx isn't a child of the context's")
+	}
+
+	// recovery counts the commits replayed
+	crashTest(db)
+	tr = testTracer{}
+	db = openTestPath(t, db.Path, withTestTracer(&tr))
+	if spans = tr.spans("storage_engine.recover"); len(spans) != 1 || fmt.Sprint(spans[0].attrs["recover.commits"]) != "2" {
+		t.Fatalf("recover spans %+v", spans)
+	}
+	db.Checkpoint()
+	if spans = tr.spans("storage_engine.checkpoint"); len(spans) != 1 || spans[0].err != nil {
+		t.Fatalf("checkpoint spans %+v", spans)
+	}
+}
@@ -0,0 +1,1196 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SQL: ParseSQL parses a statement of a subset of SQL over the tables, see
+// Schema, into its AST. The keywords are case-insensitive, the names are
+// as written, or quoted with "". The types of the columns are those of
+// ColumnType: INT, INTEGER or BIGINT, REAL, FLOAT or DOUBLE, TEXT, VARCHAR
+// or STRING, BLOB or BYTES, BOOL or BOOLEAN; SERIAL is an INT NOT NULL
+// AUTO_INCREMENT.
+//
+//	CREATE TABLE t (a INT [NOT NULL] [AUTO_INCREMENT] PRIMARY KEY, b TEXT NOT NULL [DEFAULT 'x'] [CHECK (expr)],
+//		c INT REFERENCES u [(x)] [ON DELETE CASCADE | RESTRICT], ... [, PRIMARY KEY (a, ...)]
+//		[, [CONSTRAINT fk] FOREIGN KEY (b, c) REFERENCES v [(x, y)] [ON DELETE CASCADE | RESTRICT]]
+//		[, [CONSTRAINT ck] CHECK (expr)] ...)
+//	ALTER TABLE t ADD [COLUMN] c INT [NOT NULL] [DEFAULT 0]
+//	DROP TABLE t
+//	DROP INDEX i ON t
+//	CREATE [UNIQUE] INDEX i ON t (b, ...)
+//	INSERT INTO t [(a, ...)] VALUES (1, 'x', ...), ...
+//	SELECT * | expr [AS name], ... FROM t [[AS] a] [[INNER | LEFT [OUTER]] JOIN u [[AS] b] ON expr] ...
+//		[WHERE expr] [GROUP BY expr, ... [HAVING expr]] [ORDER BY expr [ASC | DESC], ...]
+//		[LIMIT n [OFFSET m]]
+//	UPDATE t SET b = expr, ... [WHERE expr]
+//	DELETE FROM t [WHERE expr]
+//	EXPLAIN SELECT ... | UPDATE ... | DELETE ...
+//
+// The expressions are the literals, 12, 1.5, 'it''s', x'00ff', TRUE, FALSE
+// and NULL, the columns, a or t.a of the table or alias t, the parameters
+// ?, the operators OR, AND, NOT, =, != or <>, <, <=, >, >=, IS [NOT] NULL,
+// +, -, *, / and %, parentheses, and in a SELECT the aggregate functions
+// COUNT(*), COUNT, SUM, MIN, MAX and AVG.
+
+var ErrSQLSyntax = errors.New("SQL syntax error")
+
+// Statement is a statement of ParseSQL, one of the *Stmt types.
+type Statement interface {
+	statement()
+}
+
+type CreateTableStmt struct {
+	Schema Schema
+}
+
+type CreateIndexStmt struct {
+	Table string
+	Index Index
+}
+
+type DropTableStmt struct {
+	Table string
+}
+
+type DropIndexStmt struct {
+	Table string
+	Index string
+}
+
+// AlterTableStmt adds the column Add to Table, see AddColumn.
+type AlterTableStmt struct {
+	Table string
+	Add   Column
+}
+
+type InsertStmt struct {
+	Table   string
+	Columns []string // nil for those of the table in order
+	Rows    [][]Expr
+}
+
+type SelectStmt struct {
+	Columns []SelectColumn
+	From    string
+	As      string // the alias of From, empty without
+	Joins   []Join
+	Where   Expr // nil without WHERE
+	GroupBy []Expr
+	Having  Expr // nil without HAVING
+	OrderBy []OrderTerm
+	Limit   Expr // nil without LIMIT
+	Offset  Expr // nil without OFFSET
+}
+
+// SelectColumn is an expression of the result of a SELECT, or * for the
+// columns of the table.
+type SelectColumn struct {
+	Star  bool
+	Expr  Expr
+	Alias string
+}
+
+// Join is a JOIN of the tables before it and Table, with NULLs for its
+// columns if Left and no row is of On.
+type Join struct {
+	Table string
+	As    string
+	Left  bool
+	On    Expr
+}
+
+type OrderTerm struct {
+	Expr Expr
+	Desc bool
+}
+
+type UpdateStmt struct {
+	Table string
+	Set   []Assignment
+	Where Expr
+}
+
+type Assignment struct {
+	Column string
+	Value  Expr
+}
+
+type DeleteStmt struct {
+	Table string
+	Where Expr
+}
+
+// ExplainStmt is the plan of a SELECT, UPDATE or DELETE, not run.
+type ExplainStmt struct {
+	Stmt Statement
+}
+
+func (*CreateTableStmt) statement() {}
+func (*CreateIndexStmt) statement() {}
+func (*AlterTableStmt) statement()  {}
+func (*DropTableStmt) statement()   {}
+func (*DropIndexStmt) statement()   {}
+func (*InsertStmt) statement()      {}
+func (*SelectStmt) statement()      {}
+func (*UpdateStmt) statement()      {}
+func (*DeleteStmt) statement()      {}
+func (*ExplainStmt) statement()     {}
+
+// Expr is an expression, one of Literal, ColumnRef, Param, UnaryExpr,
+// BinaryExpr, IsNullExpr and FuncExpr.
+type Expr interface {
+	expr()
+}
+
+// Literal is a value of the Go types of ColumnType, nil for NULL.
+type Literal struct {
+	Value any
+}
+
+// ColumnRef is a column, of the table Table if it's not empty.
+type ColumnRef struct {
+	Table  string
+	Column string
+}
+
+// Param is the parameter ?, numbered from 1 in the statement.
+type Param struct {
+	N int
+}
+
+// UnaryExpr is NOT or the - of a number.
+type UnaryExpr struct {
+	Op string
+	X  Expr
+}
+
+// BinaryExpr is X Op Y, Op one of OR, AND, =, !=, <, <=, >, >=, +, -, *,
+// / and %: <> is !=.
+type BinaryExpr struct {
+	Op   string
+	X, Y Expr
+}
+
+// IsNullExpr is X IS NULL, or X IS NOT NULL if Not.
+type IsNullExpr struct {
+	X   Expr
+	Not bool
+}
+
+// FuncExpr is an aggregate function, COUNT, SUM, MIN, MAX or AVG, of X, or
+// COUNT(*) if Star.
+type FuncExpr struct {
+	Name string
+	X    Expr
+	Star bool
+}
+
+func (*Literal) expr()    {}
+func (*ColumnRef) expr()  {}
+func (*Param) expr()      {}
+func (*UnaryExpr) expr()  {}
+func (*BinaryExpr) expr() {}
+func (*IsNullExpr) expr() {}
+func (*FuncExpr) expr()   {}
+
+// the words that aren't names unless quoted
+var sqlKeywords = map[string]bool{
+	"ADD": true, "ALTER": true, "AND": true, "AS": true, "ASC": true, "BY": true,
+	"CHECK": true, "CONSTRAINT": true, "CREATE": true, "DEFAULT": true, "DELETE": true, "DESC": true, "DROP": true, "EXPLAIN": true, "FALSE": true, "FOREIGN": true, "FROM": true, "GROUP": true, "HAVING": true,
+	"INDEX": true, "INNER": true, "INSERT": true, "INTO": true, "IS": true, "JOIN": true,
+	"KEY": true, "LEFT": true, "LIMIT": true, "NOT": true, "NULL": true, "OFFSET": true,
+	"ON": true, "OR": true, "ORDER": true, "OUTER": true, "PRIMARY": true, "REFERENCES": true, "SELECT": true,
+	"SET": true, "TABLE": true, "TRUE": true, "UNIQUE": true, "UPDATE": true, "VALUES": true,
+	"WHERE": true,
+}
+
+var sqlFuncs = map[string]bool{"COUNT": true, "SUM": true, "MIN": true, "MAX": true, "AVG": true}
+
+var sqlTypes = map[string]ColumnType{
+	"INT": ColumnInt64, "INTEGER": ColumnInt64, "BIGINT": ColumnInt64,
+	"REAL": ColumnFloat64, "FLOAT": ColumnFloat64, "DOUBLE": ColumnFloat64,
+	"TEXT": ColumnString, "VARCHAR": ColumnString, "STRING": ColumnString,
+	"BLOB": ColumnBytes, "BYTES": ColumnBytes,
+	"BOOL": ColumnBool, "BOOLEAN": ColumnBool,
+}
+
+type sqlTokenKind int
+
+const (
+	sqlEOF    sqlTokenKind = iota
+	sqlWord                // a keyword or a name
+	sqlQuoted              // a quoted name
+	sqlNumber
+	sqlString
+	sqlBlob
+	sqlParam
+	sqlPunct // an operator or a punctuation
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string // of a word as written, unquoted or decoded otherwise
+	pos  int
+}
+
+// the tokens of a statement
+func lexSQL(src string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			continue
+		case r == '-' && strings.HasPrefix(src[i:], "--"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case (r == 'x' || r == 'X') && i+1 < len(src) && src[i+1] == '\'':
+			s, n, err := lexSQLString(src, i+1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := hexBytes(s)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad blob at offset %d", ErrSQLSyntax, start)
+			}
+			tokens = append(tokens, sqlToken{kind: sqlBlob, text: string(b), pos: start})
+			i = n
+		case r == '_' || unicode.IsLetter(r):
+			for i < len(src) {
+				r, size := utf8.DecodeRuneInString(src[i:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, sqlToken{kind: sqlWord, text: src[start:i], pos: start})
+		case r >= '0' && r <= '9' || r == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+					i++
+				}
+			}
+			tokens = append(tokens, sqlToken{kind: sqlNumber, text: src[start:i], pos: start})
+		case r == '\'':
+			s, n, err := lexSQLString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, sqlToken{kind: sqlString, text: s, pos: start})
+			i = n
+		case r == '"':
+			end := strings.IndexByte(src[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated name at offset %d", ErrSQLSyntax, start)
+			}
+			tokens = append(tokens, sqlToken{kind: sqlQuoted, text: src[i+1 : i+1+end], pos: start})
+			i += end + 2
+		case r == '?':
+			tokens = append(tokens, sqlToken{kind: sqlParam, text: "?", pos: start})
+			i++
+		default:
+			op := src[i : i+1]
+			if two := src[i:min(i+2, len(src))]; two == "<=" || two == ">=" || two == "!=" || two == "<>" {
+				op = two
+			} else if !strings.Contains("(),;*=<>+-/%.", op) {
+				return nil, fmt.Errorf("%w: unexpected %q at offset %d", ErrSQLSyntax, r, start)
+			}
+			tokens = append(tokens, sqlToken{kind: sqlPunct, text: op, pos: start})
+			i += len(op)
+		}
+	}
+	return append(tokens, sqlToken{kind: sqlEOF, pos: len(src)}), nil
+}
+
+// a string literal from its quote, a quote doubled in it, and the offset
+// after it
+func lexSQLString(src string, i int) (string, int, error) {
+	var b strings.Builder
+	for j := i + 1; j < len(src); j++ {
+		if src[j] != '\'' {
+			b.WriteByte(src[j])
+			continue
+		}
+		if j+1 < len(src) && src[j+1] == '\'' {
+			b.WriteByte('\'')
+			j++
+			continue
+		}
+		return b.String(), j + 1, nil
+	}
+	return "", 0, fmt.Errorf("%w: unterminated string at offset %d", ErrSQLSyntax, i)
+}
+
+func hexBytes(s string) ([]byte, error) {
+	if len(s)%2 != 0 {
+		return nil, ErrSQLSyntax
+	}
+	b := make([]byte, len(s)/2)
+	for i := range b {
+		v, err := strconv.ParseUint(s[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return nil, err
+		}
+		b[i] = byte(v)
+	}
+	return b, nil
+}
+
+type sqlParser struct {
+	src    string
+	tokens []sqlToken
+	pos    int
+	params int
+}
+
+// ParseSQL parses a statement, with or without a ; at the end.
+func ParseSQL(src string) (Statement, error) {
+	stmt, _, err := parseSQL(src)
+	return stmt, err
+}
+
+// the statement and the number of its parameters
+func parseSQL(src string) (Statement, int, error) {
+	tokens, err := lexSQL(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	p := &sqlParser{src: src, tokens: tokens}
+	stmt, err := p.statement()
+	if err != nil {
+		return nil, 0, err
+	}
+	p.punct(";")
+	if t := p.peek(); t.kind != sqlEOF {
+		return nil, 0, p.unexpected("the end")
+	}
+	return stmt, p.params, nil
+}
+
+// an expression alone, without parameters, that of a Check
+func parseExpr(src string) (Expr, error) {
+	tokens, err := lexSQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{src: src, tokens: tokens}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != sqlEOF {
+		return nil, p.unexpected("the end")
+	}
+	if p.params > 0 {
+		return nil, fmt.Errorf("%w: parameter in %q", ErrSQLSyntax, src)
+	}
+	return e, nil
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *sqlParser) next() sqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != sqlEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *sqlParser) unexpected(want string) error {
+	t := p.peek()
+	found := strconv.Quote(t.text)
+	switch t.kind {
+	case sqlEOF:
+		found = "the end"
+	case sqlString:
+		found = "a string"
+	case sqlBlob:
+		found = "a blob"
+	}
+	return fmt.Errorf("%w: expected %s at offset %d, found %s", ErrSQLSyntax, want, t.pos, found)
+}
+
+// whether the next token is the keyword, consumed if so
+func (p *sqlParser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == sqlWord && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// the keywords in a row, or an error
+func (p *sqlParser) expect(kws ...string) error {
+	for _, kw := range kws {
+		if !p.keyword(kw) {
+			return p.unexpected(kw)
+		}
+	}
+	return nil
+}
+
+// whether the next token is the punctuation, consumed if so
+func (p *sqlParser) punct(s string) bool {
+	if t := p.peek(); t.kind == sqlPunct && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectPunct(s string) error {
+	if !p.punct(s) {
+		return p.unexpected(strconv.Quote(s))
+	}
+	return nil
+}
+
+// a name, a word not a keyword or a quoted one
+func (p *sqlParser) name(what string) (string, error) {
+	t := p.peek()
+	if t.kind == sqlQuoted && t.text != "" || t.kind == sqlWord && !sqlKeywords[strings.ToUpper(t.text)] {
+		p.pos++
+		return t.text, nil
+	}
+	return "", p.unexpected(what)
+}
+
+// names in parentheses
+func (p *sqlParser) names(what string) ([]string, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		name, err := p.name(what)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.punct(",") {
+			break
+		}
+	}
+	return names, p.expectPunct(")")
+}
+
+func (p *sqlParser) statement() (Statement, error) {
+	switch {
+	case p.keyword("CREATE"):
+		if p.keyword("TABLE") {
+			return p.createTable()
+		}
+		unique := p.keyword("UNIQUE")
+		if !p.keyword("INDEX") {
+			return nil, p.unexpected("TABLE or INDEX")
+		}
+		return p.createIndex(unique)
+	case p.keyword("ALTER"):
+		return p.alterTable()
+	case p.keyword("DROP"):
+		return p.drop()
+	case p.keyword("INSERT"):
+		return p.insert()
+	case p.keyword("SELECT"):
+		return p.selectStmt()
+	case p.keyword("UPDATE"):
+		return p.update()
+	case p.keyword("DELETE"):
+		return p.delete()
+	case p.keyword("EXPLAIN"):
+		stmt := &ExplainStmt{}
+		var err error
+		switch {
+		case p.keyword("SELECT"):
+			stmt.Stmt, err = p.selectStmt()
+		case p.keyword("UPDATE"):
+			stmt.Stmt, err = p.update()
+		case p.keyword("DELETE"):
+			stmt.Stmt, err = p.delete()
+		default:
+			return nil, p.unexpected("SELECT, UPDATE or DELETE")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return stmt, nil
+	}
+	return nil, p.unexpected("a statement")
+}
+
+func (p *sqlParser) createTable() (Statement, error) {
+	var err error
+	stmt := &CreateTableStmt{}
+	s := &stmt.Schema
+	if s.Name, err = p.name("a table name"); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	for {
+		if p.keyword("PRIMARY") {
+			if err := p.expect("KEY"); err != nil {
+				return nil, err
+			}
+			if s.PrimaryKey != nil {
+				return nil, fmt.Errorf("%w: two primary keys", ErrSQLSyntax)
+			}
+			if s.PrimaryKey, err = p.names("a column name"); err != nil {
+				return nil, err
+			}
+		} else if t := p.peek(); t.kind == sqlWord && (strings.EqualFold(t.text, "CONSTRAINT") || strings.EqualFold(t.text, "FOREIGN") || strings.EqualFold(t.text, "CHECK")) {
+			if err := p.constraint(s); err != nil {
+				return nil, err
+			}
+		} else {
+			c, primary, err := p.columnDef(s)
+			if err != nil {
+				return nil, err
+			}
+			if primary {
+				if s.PrimaryKey != nil {
+					return nil, fmt.Errorf("%w: two primary keys", ErrSQLSyntax)
+				}
+				s.PrimaryKey = []string{c.Name}
+			}
+			s.Columns = append(s.Columns, c)
+		}
+		if !p.punct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	// the columns of the key aren't nullable
+	for _, name := range s.PrimaryKey {
+		for i := range s.Columns {
+			if s.Columns[i].Name == name {
+				s.Columns[i].Nullable = false
+			}
+		}
+	}
+	return stmt, nil
+}
+
+// a foreign key or a check of CREATE TABLE, [CONSTRAINT name] first
+func (p *sqlParser) constraint(s *Schema) error {
+	var name string
+	if p.keyword("CONSTRAINT") {
+		var err error
+		if name, err = p.name("a constraint name"); err != nil {
+			return err
+		}
+	}
+	if p.keyword("CHECK") {
+		expr, err := p.checkExpr()
+		if err != nil {
+			return err
+		}
+		s.Checks = append(s.Checks, Check{Name: name, Expr: expr})
+		return nil
+	}
+	if err := p.expect("FOREIGN", "KEY"); err != nil {
+		return err
+	}
+	fk := ForeignKey{Name: name}
+	var err error
+	if fk.Columns, err = p.names("a column name"); err != nil {
+		return err
+	}
+	if err := p.expect("REFERENCES"); err != nil {
+		return err
+	}
+	if err := p.references(&fk); err != nil {
+		return err
+	}
+	s.ForeignKeys = append(s.ForeignKeys, fk)
+	return nil
+}
+
+// a column of CREATE TABLE, true if it's the primary key; its REFERENCES
+// and CHECK added to the schema, not allowed if nil
+func (p *sqlParser) columnDef(s *Schema) (Column, bool, error) {
+	name, err := p.name("a column name")
+	if err != nil {
+		return Column{}, false, err
+	}
+	t := p.peek()
+	typ, ok := sqlTypes[strings.ToUpper(t.text)]
+	serial := strings.EqualFold(t.text, "SERIAL")
+	if t.kind != sqlWord || !ok && !serial {
+		return Column{}, false, p.unexpected("a column type")
+	}
+	p.pos++
+	if p.punct("(") { // the length of VARCHAR(n), ignored
+		if p.next().kind != sqlNumber {
+			p.pos--
+			return Column{}, false, p.unexpected("a length")
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return Column{}, false, err
+		}
+	}
+	c := Column{Name: name, Type: typ, Nullable: true}
+	if serial {
+		c = Column{Name: name, Type: ColumnInt64, AutoIncrement: true}
+	}
+	primary := false
+	for {
+		switch {
+		case p.keyword("NOT"):
+			if err := p.expect("NULL"); err != nil {
+				return Column{}, false, err
+			}
+			c.Nullable = false
+		case p.keyword("NULL"):
+			c.Nullable = true
+		case p.keyword("AUTO_INCREMENT"), p.keyword("AUTOINCREMENT"):
+			// not nullable unless NULL follows
+			c.AutoIncrement = true
+			c.Nullable = false
+		case p.keyword("PRIMARY"):
+			if err := p.expect("KEY"); err != nil {
+				return Column{}, false, err
+			}
+			primary = true
+		case p.keyword("DEFAULT"):
+			x, err := p.unary()
+			if err != nil {
+				return Column{}, false, err
+			}
+			l, ok := x.(*Literal)
+			if !ok {
+				return Column{}, false, fmt.Errorf("%w: DEFAULT of column %q not a literal", ErrSQLSyntax, name)
+			}
+			c.Default = coerceValue(c, l.Value)
+		case p.keyword("REFERENCES"):
+			if s == nil {
+				return Column{}, false, fmt.Errorf("%w: REFERENCES of a column added", ErrSQLSyntax)
+			}
+			fk := ForeignKey{Columns: []string{name}}
+			if err := p.references(&fk); err != nil {
+				return Column{}, false, err
+			}
+			s.ForeignKeys = append(s.ForeignKeys, fk)
+		case p.keyword("CHECK"):
+			if s == nil {
+				return Column{}, false, fmt.Errorf("%w: CHECK of a column added", ErrSQLSyntax)
+			}
+			expr, err := p.checkExpr()
+			if err != nil {
+				return Column{}, false, err
+			}
+			s.Checks = append(s.Checks, Check{Expr: expr})
+		default:
+			return c, primary, nil
+		}
+	}
+}
+
+// the source of the expression in parentheses after CHECK
+func (p *sqlParser) checkExpr() (string, error) {
+	if err := p.expectPunct("("); err != nil {
+		return "", err
+	}
+	from, params := p.peek().pos, p.params
+	if _, err := p.expr(); err != nil {
+		return "", err
+	}
+	if p.params > params {
+		return "", fmt.Errorf("%w: parameter in a CHECK", ErrSQLSyntax)
+	}
+	to := p.peek().pos
+	return p.src[from:to], p.expectPunct(")")
+}
+
+// the parent of a foreign key after REFERENCES, its columns and ON DELETE
+func (p *sqlParser) references(fk *ForeignKey) error {
+	var err error
+	if fk.Table, err = p.name("a table name"); err != nil {
+		return err
+	}
+	if p.peek().kind == sqlPunct && p.peek().text == "(" {
+		if fk.References, err = p.names("a column name"); err != nil {
+			return err
+		}
+	}
+	if !p.keyword("ON") {
+		return nil
+	}
+	if err := p.expect("DELETE"); err != nil {
+		return err
+	}
+	switch {
+	case p.keyword("CASCADE"):
+		fk.Cascade = true
+	case p.keyword("RESTRICT"):
+	default:
+		return p.unexpected("CASCADE or RESTRICT")
+	}
+	return nil
+}
+
+func (p *sqlParser) alterTable() (Statement, error) {
+	if err := p.expect("TABLE"); err != nil {
+		return nil, err
+	}
+	var err error
+	stmt := &AlterTableStmt{}
+	if stmt.Table, err = p.name("a table name"); err != nil {
+		return nil, err
+	}
+	if err := p.expect("ADD"); err != nil {
+		return nil, err
+	}
+	p.keyword("COLUMN")
+	c, primary, err := p.columnDef(nil)
+	if err != nil {
+		return nil, err
+	}
+	if primary {
+		return nil, fmt.Errorf("%w: PRIMARY KEY of a column added", ErrSQLSyntax)
+	}
+	stmt.Add = c
+	return stmt, nil
+}
+
+func (p *sqlParser) drop() (Statement, error) {
+	var err error
+	if p.keyword("TABLE") {
+		stmt := &DropTableStmt{}
+		if stmt.Table, err = p.name("a table name"); err != nil {
+			return nil, err
+		}
+		return stmt, nil
+	}
+	if !p.keyword("INDEX") {
+		return nil, p.unexpected("TABLE or INDEX")
+	}
+	stmt := &DropIndexStmt{}
+	if stmt.Index, err = p.name("an index name"); err != nil {
+		return nil, err
+	}
+	if err := p.expect("ON"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.name("a table name"); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) createIndex(unique bool) (Statement, error) {
+	var err error
+	stmt := &CreateIndexStmt{Index: Index{Unique: unique}}
+	if stmt.Index.Name, err = p.name("an index name"); err != nil {
+		return nil, err
+	}
+	if err := p.expect("ON"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.name("a table name"); err != nil {
+		return nil, err
+	}
+	if stmt.Index.Columns, err = p.names("a column name"); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) insert() (Statement, error) {
+	var err error
+	stmt := &InsertStmt{}
+	if err := p.expect("INTO"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.name("a table name"); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == sqlPunct && t.text == "(" {
+		if stmt.Columns, err = p.names("a column name"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		var row []Expr
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, e)
+			if !p.punct(",") {
+				break
+			}
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.punct(",") {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *sqlParser) selectStmt() (Statement, error) {
+	var err error
+	stmt := &SelectStmt{}
+	for {
+		var c SelectColumn
+		if p.punct("*") {
+			c.Star = true
+		} else {
+			if c.Expr, err = p.expr(); err != nil {
+				return nil, err
+			}
+			if p.keyword("AS") {
+				if c.Alias, err = p.name("a column name"); err != nil {
+					return nil, err
+				}
+			}
+		}
+		stmt.Columns = append(stmt.Columns, c)
+		if !p.punct(",") {
+			break
+		}
+	}
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	if stmt.From, stmt.As, err = p.tableAs(); err != nil {
+		return nil, err
+	}
+	for {
+		var j Join
+		if j.Left = p.keyword("LEFT"); j.Left {
+			p.keyword("OUTER")
+		} else if p.keyword("INNER") {
+			if err := p.expect("JOIN"); err != nil {
+				return nil, err
+			}
+		} else if !p.keyword("JOIN") {
+			break
+		}
+		if j.Left {
+			if err := p.expect("JOIN"); err != nil {
+				return nil, err
+			}
+		}
+		if j.Table, j.As, err = p.tableAs(); err != nil {
+			return nil, err
+		}
+		if err := p.expect("ON"); err != nil {
+			return nil, err
+		}
+		if j.On, err = p.expr(); err != nil {
+			return nil, err
+		}
+		stmt.Joins = append(stmt.Joins, j)
+	}
+	if stmt.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+	if p.keyword("GROUP") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.GroupBy = append(stmt.GroupBy, e)
+			if !p.punct(",") {
+				break
+			}
+		}
+		if p.keyword("HAVING") {
+			if stmt.Having, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.keyword("ORDER") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			var o OrderTerm
+			if o.Expr, err = p.expr(); err != nil {
+				return nil, err
+			}
+			if p.keyword("DESC") {
+				o.Desc = true
+			} else {
+				p.keyword("ASC")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, o)
+			if !p.punct(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("LIMIT") {
+		if stmt.Limit, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if p.keyword("OFFSET") {
+			if stmt.Offset, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return stmt, nil
+}
+
+// a table name and its alias, after AS or not
+func (p *sqlParser) tableAs() (name, as string, err error) {
+	if name, err = p.name("a table name"); err != nil {
+		return "", "", err
+	}
+	if t := p.peek(); p.keyword("AS") || t.kind == sqlQuoted || t.kind == sqlWord && !sqlKeywords[strings.ToUpper(t.text)] {
+		as, err = p.name("an alias")
+	}
+	return name, as, err
+}
+
+func (p *sqlParser) update() (Statement, error) {
+	var err error
+	stmt := &UpdateStmt{}
+	if stmt.Table, err = p.name("a table name"); err != nil {
+		return nil, err
+	}
+	if err := p.expect("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		var a Assignment
+		if a.Column, err = p.name("a column name"); err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("="); err != nil {
+			return nil, err
+		}
+		if a.Value, err = p.expr(); err != nil {
+			return nil, err
+		}
+		stmt.Set = append(stmt.Set, a)
+		if !p.punct(",") {
+			break
+		}
+	}
+	if stmt.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) delete() (Statement, error) {
+	var err error
+	stmt := &DeleteStmt{}
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.name("a table name"); err != nil {
+		return nil, err
+	}
+	if stmt.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// the expression of WHERE, nil without one
+func (p *sqlParser) where() (Expr, error) {
+	if !p.keyword("WHERE") {
+		return nil, nil
+	}
+	return p.expr()
+}
+
+// expressions by precedence, lowest first: OR, AND, NOT, comparisons and
+// IS NULL, + and -, *, / and %, unary -, then the operands
+func (p *sqlParser) expr() (Expr, error) {
+	return p.binary(0)
+}
+
+var sqlLevels = [][]string{
+	{"OR"},
+	{"AND"},
+	nil, // NOT
+	{"=", "!=", "<>", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *sqlParser) binary(level int) (Expr, error) {
+	if level == len(sqlLevels) {
+		return p.unary()
+	}
+	if sqlLevels[level] == nil {
+		if p.keyword("NOT") {
+			x, err := p.binary(level)
+			if err != nil {
+				return nil, err
+			}
+			return &UnaryExpr{Op: "NOT", X: x}, nil
+		}
+		return p.binary(level + 1)
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if level == 3 && p.keyword("IS") {
+			not := p.keyword("NOT")
+			if err := p.expect("NULL"); err != nil {
+				return nil, err
+			}
+			x = &IsNullExpr{X: x, Not: not}
+			continue
+		}
+		op, ok := p.operator(sqlLevels[level])
+		if !ok {
+			return x, nil
+		}
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		if op == "<>" {
+			op = "!="
+		}
+		x = &BinaryExpr{Op: op, X: x, Y: y}
+	}
+}
+
+// the next token if it's one of the operators, consumed
+func (p *sqlParser) operator(ops []string) (string, bool) {
+	t := p.peek()
+	for _, op := range ops {
+		if t.kind == sqlPunct && t.text == op || t.kind == sqlWord && strings.EqualFold(t.text, op) {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *sqlParser) unary() (Expr, error) {
+	if p.punct("-") {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		// a negative literal, for the minimum of int64
+		if l, ok := x.(*Literal); ok {
+			switch v := l.Value.(type) {
+			case int64:
+				return &Literal{Value: -v}, nil
+			case float64:
+				return &Literal{Value: -v}, nil
+			}
+		}
+		return &UnaryExpr{Op: "-", X: x}, nil
+	}
+	return p.operand()
+}
+
+func (p *sqlParser) operand() (Expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case sqlNumber:
+		p.pos++
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return &Literal{Value: i}, nil
+		}
+		// 9223372036854775808 only after a -
+		if t.text == "9223372036854775808" && p.pos >= 2 && p.tokens[p.pos-2].text == "-" {
+			return &Literal{Value: int64(-1 << 63)}, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			p.pos--
+			return nil, p.unexpected("a number")
+		}
+		return &Literal{Value: f}, nil
+	case sqlString:
+		p.pos++
+		return &Literal{Value: t.text}, nil
+	case sqlBlob:
+		p.pos++
+		return &Literal{Value: []byte(t.text)}, nil
+	case sqlParam:
+		p.pos++
+		p.params++
+		return &Param{N: p.params}, nil
+	case sqlPunct:
+		if p.punct("(") {
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expectPunct(")")
+		}
+	case sqlWord:
+		switch strings.ToUpper(t.text) {
+		case "TRUE", "FALSE":
+			p.pos++
+			return &Literal{Value: strings.EqualFold(t.text, "TRUE")}, nil
+		case "NULL":
+			p.pos++
+			return &Literal{}, nil
+		}
+	}
+	name, err := p.name("an expression")
+	if err != nil {
+		return nil, err
+	}
+	if f := strings.ToUpper(name); sqlFuncs[f] && t.kind == sqlWord && p.punct("(") {
+		call := &FuncExpr{Name: f}
+		if call.Star = f == "COUNT" && p.punct("*"); !call.Star {
+			if call.X, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		return call, p.expectPunct(")")
+	}
+	if p.punct(".") {
+		column, err := p.name("a column name")
+		if err != nil {
+			return nil, err
+		}
+		return &ColumnRef{Table: name, Column: column}, nil
+	}
+	return &ColumnRef{Column: name}, nil
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// an expression in prefix form, the literals as %#v
+func exprTest(e Expr) string {
+	switch e := e.(type) {
+	case nil:
+		return "<nil>"
+	case *Literal:
+		return fmt.Sprintf("%#v", e.Value)
+	case *ColumnRef:
+		if e.Table != "" {
+			return e.Table + "." + e.Column
+		}
+		return e.Column
+	case *Param:
+		return fmt.Sprint("?", e.N)
+	case *UnaryExpr:
+		return fmt.Sprintf("(%s %s)", e.Op, exprTest(e.X))
+	case *BinaryExpr:
+		return fmt.Sprintf("(%s %s %s)", e.Op, exprTest(e.X), exprTest(e.Y))
+	case *IsNullExpr:
+		if e.Not {
+			return fmt.Sprintf("(NOTNULL %s)", exprTest(e.X))
+		}
+		return fmt.Sprintf("(ISNULL %s)", exprTest(e.X))
+	case *FuncExpr:
+		if e.Star {
+			return e.Name + "(*)"
+		}
+		return fmt.Sprintf("%s(%s)", e.Name, exprTest(e.X))
+	}
+	return fmt.Sprintf("%T", e)
+}
+
+func parseTest(t *testing.T, src string) Statement {
+	t.Helper()
+	stmt, err := ParseSQL(src)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return stmt
+}
+
+func TestParseExpr(t *testing.T) {
+	for src, want := range map[string]string{
+		"1":                           "1",
+		"-9223372036854775808":        "-9223372036854775808",
+		"9223372036854775808":         "9.223372036854776e+18", // too big for an int64
+		"1.5e3":                       "1500",
+		".5":                          "0.5",
+		"'it''s'":                     `"it's"`,
+		"x'00ff'":                     "[]byte{0x0, 0xff}",
+		"TRUE AND false":              "(AND true false)",
+		"NULL":                        "<nil>",
+		"a = 1 OR b <> 2 AND c":       "(OR (= a 1) (AND (!= b 2) c))",
+		"NOT a = 1":                   "(NOT (= a 1))",
+		"(a OR b) AND c":              "(AND (OR a b) c)",
+		"1 + 2 * 3 - 4 % 2":           "(- (+ 1 (* 2 3)) (% 4 2))",
+		"-a / 2":                      "(/ (- a) 2)",
+		"a IS NULL AND b IS NOT NULL": "(AND (ISNULL a) (NOTNULL b))",
+		`u.a >= "select"`:             "(>= u.a select)",
+		"a < ? AND b <= ?":            "(AND (< a ?1) (<= b ?2))",
+		"a > 1 -- a comment":          "(> a 1)",
+		"\"Name\" = 'x'":              `(= Name "x")`,
+	} {
+		stmt := parseTest(t, "SELECT * FROM t WHERE "+src).(*SelectStmt)
+		if got := exprTest(stmt.Where); got != want {
+			t.Errorf("%s parsed as %s, want %s", src, got, want)
+		}
+	}
+}
+
+func TestParseStatements(t *testing.T) {
+	create := parseTest(t, `create table "users" (id INT PRIMARY KEY, name VARCHAR(20) NOT NULL DEFAULT 'x', score DOUBLE, data BLOB, admin BOOL);`).(*CreateTableStmt)
+	s := create.Schema
+	if s.Name != "users" || fmt.Sprint(s.PrimaryKey) != "[id]" || len(s.Columns) != 5 {
+		t.Fatalf("schema %+v", s)
+	}
+	for i, want := range []Column{
+		{Name: "id", Type: ColumnInt64},
+		{Name: "name", Type: ColumnString, Default: "x"},
+		{Name: "score", Type: ColumnFloat64, Nullable: true},
+		{Name: "data", Type: ColumnBytes, Nullable: true},
+		{Name: "admin", Type: ColumnBool, Nullable: true},
+	} {
+		if fmt.Sprint(s.Columns[i]) != fmt.Sprint(want) {
+			t.Errorf("column %+v, want %+v", s.Columns[i], want)
+		}
+	}
+	// the primary key of several columns, not nullable
+	create = parseTest(t, "CREATE TABLE t (a INT, b TEXT, PRIMARY KEY (b, a))").(*CreateTableStmt)
+	if fmt.Sprint(create.Schema.PrimaryKey) != "[b a]" || create.Schema.Columns[0].Nullable || create.Schema.Columns[1].Nullable {
+		t.Fatalf("schema %+v", create.Schema)
+	}
+
+	index := parseTest(t, "CREATE UNIQUE INDEX by_name ON users (name, id)").(*CreateIndexStmt)
+	if index.Table != "users" || fmt.Sprint(index.Index) != "{by_name [name id] true}" {
+		t.Fatalf("index %+v", index)
+	}
+
+	insert := parseTest(t, "INSERT INTO users (id, name) VALUES (1, 'a'), (2, ?)").(*InsertStmt)
+	if insert.Table != "users" || fmt.Sprint(insert.Columns) != "[id name]" || len(insert.Rows) != 2 || exprTest(insert.Rows[1][1]) != "?1" {
+		t.Fatalf("insert %+v", insert)
+	}
+	if insert := parseTest(t, "INSERT INTO users VALUES (1)").(*InsertStmt); insert.Columns != nil {
+		t.Fatalf("columns %v of an insert without them", insert.Columns)
+	}
+
+	sel := parseTest(t, "SELECT id, name AS n, * FROM users u WHERE id > 1 ORDER BY name DESC, id LIMIT 10 OFFSET ?").(*SelectStmt)
+	if sel.From != "users" || sel.As != "u" || len(sel.Columns) != 3 || sel.Columns[1].Alias != "n" || !sel.Columns[2].Star {
+		t.Fatalf("select %+v", sel)
+	}
+	if len(sel.OrderBy) != 2 || !sel.OrderBy[0].Desc || sel.OrderBy[1].Desc || exprTest(sel.Limit) != "10" || exprTest(sel.Offset) != "?1" {
+		t.Fatalf("select %+v", sel)
+	}
+
+	update := parseTest(t, "UPDATE users SET name = 'b', score = score + 1 WHERE id = 1").(*UpdateStmt)
+	if update.Table != "users" || len(update.Set) != 2 || update.Set[1].Column != "score" || exprTest(update.Set[1].Value) != "(+ score 1)" || exprTest(update.Where) != "(= id 1)" {
+		t.Fatalf("update %+v", update)
+	}
+	del := parseTest(t, "DELETE FROM users").(*DeleteStmt)
+	if del.Table != "users" || del.Where != nil {
+		t.Fatalf("delete %+v", del)
+	}
+}
+
+func TestParseSQLErrors(t *testing.T) {
+	for src, want := range map[string]string{
+		"":                               "expected a statement at offset 0, found the end",
+		"SELEC 1":                        `found "SELEC"`,
+		"SELECT * FROM":                  "expected a table name",
+		"SELECT * FROM t WHERE":          "expected an expression",
+		"SELECT * FROM t WHERE a = 'x":   "unterminated string",
+		`SELECT * FROM "t`:               "unterminated name",
+		"SELECT * FROM t WHERE a = x'0'": "bad blob",
+		"SELECT * FROM t WHERE a = 1 1":  "expected the end at offset 28",
+		"SELECT * FROM t; SELECT":        "expected the end",
+		"SELECT * FROM t WHERE a # 1":    "unexpected '#'",
+		"SELECT * FROM select":           "expected a table name",
+		"CREATE TABLE t (a INT PRIMARY KEY, b INT PRIMARY KEY)": "two primary keys",
+		"CREATE TABLE t (a DATE)":                               "expected a column type",
+		"CREATE TABLE t (a INT DEFAULT b)":                      "not a literal",
+		"CREATE VIEW v":                                         "expected TABLE or INDEX",
+		"INSERT INTO t VALUES 1":                                `expected "("`,
+		"UPDATE t SET a 1":                                      `expected "="`,
+		"DELETE t":                                              "expected FROM",
+	} {
+		if _, err := ParseSQL(src); !errors.Is(err, ErrSQLSyntax) || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, want %s", src, err, want)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+// Package sqldriver is the database/sql driver of the SQL of the storage
+// engine, registered as "storage-engine": the data source name is the path
+// of the DB, opened by the first connection and closed with the last one.
+// OpenDB serves a DB already open.
+//
+//	db, err := sql.Open("storage-engine", "/var/lib/app.db")
+//	res, err := db.Exec("INSERT INTO t VALUES (?, ?)", 1, "x")
+//
+// The statements are prepared with storage.PrepareSQL, the parameters are
+// positional. A statement outside a transaction runs in a Tx of its own,
+// read-only for a query; a transaction is a writable Tx, read-only if asked,
+// so the writes of the DB wait for it to end.
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func init() {
+	sql.Register("storage-engine", &Driver{})
+}
+
+// Driver opens the connections of sql.Open, sharing a DB by path.
+type Driver struct {
+	mu  sync.Mutex
+	dbs map[string]*sharedDB
+}
+
+// a DB opened by the driver and the connections on it
+type sharedDB struct {
+	db    *storage.DB
+	conns int
+}
+
+// Open opens a connection to the DB at the path name.
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	c, err := d.OpenConnector(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
+}
+
+// OpenConnector returns a connector of the DB at the path name.
+func (d *Driver) OpenConnector(name string) (driver.Connector, error) {
+	return &connector{driver: d, path: name}, nil
+}
+
+// OpenDB returns a sql.DB on a DB already open, left open by Close.
+func OpenDB(db *storage.DB) *sql.DB {
+	return sql.OpenDB(&connector{driver: &Driver{}, db: db})
+}
+
+type connector struct {
+	driver *Driver
+	path   string      // of the DB opened by the driver
+	db     *storage.DB // or open
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	if c.db != nil {
+		return &conn{db: c.db}, nil
+	}
+	d := c.driver
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	shared := d.dbs[c.path]
+	if shared == nil {
+		db, err := storage.Open(c.path)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedDB{db: db}
+		if d.dbs == nil {
+			d.dbs = map[string]*sharedDB{}
+		}
+		d.dbs[c.path] = shared
+	}
+	shared.conns++
+	return &conn{db: shared.db, release: func() error { return d.release(c.path) }}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// close the DB of the path after its last connection
+func (d *Driver) release(path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	shared := d.dbs[path]
+	if shared.conns--; shared.conns > 0 {
+		return nil
+	}
+	delete(d.dbs, path)
+	return shared.db.Close()
+}
+
+// conn is a connection, with the Tx of its transaction if any.
+type conn struct {
+	db      *storage.DB
+	tx      *storage.Tx
+	release func() error // nil if the DB isn't the driver's
+	closed  bool
+}
+
+var (
+	_ driver.ConnBeginTx            = (*conn)(nil)
+	_ driver.ConnPrepareContext     = (*conn)(nil)
+	_ driver.ExecerContext          = (*conn)(nil)
+	_ driver.QueryerContext         = (*conn)(nil)
+	_ driver.NamedValueChecker      = (*conn)(nil)
+	_ driver.StmtExecContext        = (*stmt)(nil)
+	_ driver.StmtQueryContext       = (*stmt)(nil)
+	_ driver.RowsColumnTypeScanType = (*rows)(nil)
+)
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	ps, err := c.db.PrepareSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{conn: c, ps: ps}, nil
+}
+
+func (c *conn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.tx != nil {
+		c.tx.Rollback()
+		c.tx = nil
+	}
+	if c.release != nil {
+		return c.release()
+	}
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx begins a Tx, writable unless read-only. The Txs of the DB are
+// serializable, the other isolation levels fail.
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, errors.New("sqldriver: transaction already begun")
+	}
+	switch sql.IsolationLevel(opts.Isolation) {
+	case sql.LevelDefault, sql.LevelSerializable:
+	default:
+		return nil, fmt.Errorf("sqldriver: isolation level %v not supported", sql.IsolationLevel(opts.Isolation))
+	}
+	tx, err := c.db.BeginContext(ctx, !opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	c.tx = tx
+	return &sqlTx{conn: c}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ps, err := c.db.PrepareSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	return (&stmt{conn: c, ps: ps}).ExecContext(ctx, args)
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	ps, err := c.db.PrepareSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	return (&stmt{conn: c, ps: ps}).QueryContext(ctx, args)
+}
+
+// CheckNamedValue takes the values of database/sql, the parameters are
+// positional only.
+func (c *conn) CheckNamedValue(v *driver.NamedValue) error {
+	if v.Name != "" {
+		return fmt.Errorf("sqldriver: named parameter %q", v.Name)
+	}
+	var err error
+	v.Value, err = driver.DefaultParameterConverter.ConvertValue(v.Value)
+	return err
+}
+
+// run a statement in the Tx of the transaction, else in a Tx of its own
+func (c *conn) exec(ctx context.Context, ps *storage.PreparedStmt, args []driver.NamedValue, writable bool) (*storage.Result, error) {
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	if c.tx != nil {
+		return ps.ExecTx(c.tx, values...)
+	}
+	tx, err := c.db.BeginContext(ctx, writable)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	res, err := ps.ExecTx(tx, values...)
+	if err != nil || !writable {
+		return res, err
+	}
+	return res, tx.Commit()
+}
+
+type sqlTx struct {
+	conn *conn
+}
+
+func (t *sqlTx) Commit() error {
+	tx := t.conn.tx
+	t.conn.tx = nil
+	if tx == nil {
+		return sql.ErrTxDone
+	}
+	return tx.Commit()
+}
+
+func (t *sqlTx) Rollback() error {
+	tx := t.conn.tx
+	t.conn.tx = nil
+	if tx == nil {
+		return sql.ErrTxDone
+	}
+	return tx.Rollback()
+}
+
+type stmt struct {
+	conn *conn
+	ps   *storage.PreparedStmt
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return s.ps.NumParams()
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	res, err := s.conn.exec(ctx, s.ps, args, true)
+	if err != nil {
+		return nil, err
+	}
+	return result{res}, nil
+}
+
+// QueryContext runs a SELECT or an EXPLAIN, the other statements have
+// no rows.
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	writable := true
+	switch s.ps.Statement().(type) {
+	case *storage.SelectStmt, *storage.ExplainStmt:
+		writable = false
+	}
+	res, err := s.conn.exec(ctx, s.ps, args, writable)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{res: res}, nil
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+type result struct {
+	res *storage.Result
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return r.res.LastInsertID, nil
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return r.res.RowsAffected, nil
+}
+
+// rows are the rows of a Result, read by then.
+type rows struct {
+	res  *storage.Result
+	next int
+}
+
+func (r *rows) Columns() []string {
+	return r.res.Columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next == len(r.res.Rows) {
+		return io.EOF
+	}
+	for i, v := range r.res.Rows[r.next] {
+		dest[i] = v
+	}
+	r.next++
+	return nil
+}
+
+// ColumnTypeScanType returns the type of the values of a column in the
+// rows, any if they're all NULL or of several types.
+func (r *rows) ColumnTypeScanType(i int) reflect.Type {
+	var t reflect.Type
+	for _, row := range r.res.Rows {
+		if row[i] == nil {
+			continue
+		}
+		if rt := reflect.TypeOf(row[i]); t == nil {
+			t = rt
+		} else if t != rt {
+			return anyType
+		}
+	}
+	if t == nil {
+		return anyType
+	}
+	return t
+}
+
+var anyType = reflect.TypeOf((*any)(nil)).Elem()
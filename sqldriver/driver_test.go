@@ -0,0 +1,209 @@
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	storage "github.com/kevinjad/storage-engine"
+)
+
+func TestDriver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	d := &Driver{}
+	c, _ := d.OpenConnector(path)
+	db := sql.OpenDB(c)
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE t (id SERIAL PRIMARY KEY, name TEXT, score REAL, data BLOB, ok BOOL)"); err != nil {
+		t.Fatal(err)
+	}
+	ins, err := db.Prepare("INSERT INTO t (name, score, data, ok) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ins.Close()
+	for i := 0; i < 10; i++ {
+		var name any = fmt.Sprint("n", i)
+		if i == 3 {
+			name = nil
+		}
+		res, err := ins.Exec(name, float32(i)/2, []byte{byte(i)}, i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, _ := res.LastInsertId(); id != int64(i+1) {
+			t.Fatalf("inserted id %d", id)
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			t.Fatalf("%d rows inserted", n)
+		}
+	}
+	res, err := db.Exec("UPDATE t SET score = score + 1 WHERE ok")
+	if n, _ := res.RowsAffected(); err != nil || n != 5 {
+		t.Fatalf("%d rows updated: %v", n, err)
+	}
+
+	rows, err := db.Query("SELECT id, name, score, data, ok FROM t WHERE id <= ? ORDER BY id", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, _ := rows.ColumnTypes()
+	var scanTypes []string
+	for _, ct := range types {
+		scanTypes = append(scanTypes, ct.ScanType().String())
+	}
+	if fmt.Sprint(scanTypes) != "[int64 string float64 []uint8 bool]" {
+		t.Fatalf("scan types %v", scanTypes)
+	}
+	var got []string
+	for rows.Next() {
+		var id int64
+		var name sql.NullString
+		var score float64
+		var data []byte
+		var ok bool
+		if err := rows.Scan(&id, &name, &score, &data, &ok); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %q %v %g %v %v", id, name.String, name.Valid, score, data, ok))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if want := `[1 "n0" true 1 [0] true 2 "n1" true 0.5 [1] false 3 "n2" true 2 [2] true 4 "" false 1.5 [3] false]`; fmt.Sprint(got) != want {
+		t.Fatalf("rows %v, want %s", got, want)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM t WHERE name IS NULL").Scan(&count); err != nil || count != 1 {
+		t.Fatalf("count %d: %v", count, err)
+	}
+
+	// the writes of a transaction are seen by its statements, kept by
+	// Commit only
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Stmt(ins).Exec("rolled back", 0, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM t").Scan(&count); err != nil || count != 11 {
+		t.Fatalf("count %d in the transaction: %v", count, err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = db.Begin()
+	tx.Exec("DELETE FROM t WHERE id > 5")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, sql.ErrTxDone) {
+		t.Fatalf("commit twice: %v", err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM t").Scan(&count); err != nil || count != 5 {
+		t.Fatalf("count %d after the commit", count)
+	}
+	ro, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ro.Exec("DELETE FROM t"); !errors.Is(err, storage.ErrTxNotWritable) {
+		t.Fatalf("delete in a read-only transaction: %v", err)
+	}
+	ro.Rollback()
+	if _, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted}); err == nil {
+		t.Fatal("transaction read committed")
+	}
+
+	for _, c := range []struct {
+		query string
+		args  []any
+	}{
+		{"SELECT FROM t", nil},
+		{"SELECT * FROM t WHERE id = ?", []any{sql.Named("id", 1)}},
+		{"SELECT * FROM t WHERE id = ?", []any{1, 2}},
+		{"SELECT * FROM missing", nil},
+	} {
+		if _, err := db.Query(c.query, c.args...); err == nil {
+			t.Errorf("query %s %v", c.query, c.args)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.ExecContext(ctx, "DELETE FROM t"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("delete canceled: %v", err)
+	}
+
+	// the DB is closed with the last connection
+	if len(d.dbs) != 1 {
+		t.Fatalf("%d DBs open", len(d.dbs))
+	}
+	ins.Close()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.dbs) != 0 {
+		t.Fatalf("%d DBs open after Close", len(d.dbs))
+	}
+	sdb, err := storage.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+	if res, err := sdb.Exec("SELECT COUNT(*) FROM t"); err != nil || res.Rows[0][0] != int64(5) {
+		t.Fatalf("rows %v: %v", res, err)
+	}
+}
+
+func TestOpenDB(t *testing.T) {
+	sdb, err := storage.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+	db := OpenDB(sdb)
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE t (id INT PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	plans, err := db.Query("EXPLAIN SELECT * FROM t WHERE id = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, _ := plans.Columns()
+	if !plans.Next() || len(cols) == 0 {
+		t.Fatal("no plan")
+	}
+	values := make([]any, len(cols))
+	for i := range values {
+		values[i] = new(any)
+	}
+	if err := plans.Scan(values...); err != nil {
+		t.Fatal(err)
+	}
+	plans.Close()
+	if plan := fmt.Sprint(*values[1].(*any)); plan != "key lookup" {
+		t.Fatalf("plan %v", plan)
+	}
+	// the DB is left open
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sdb.Exec("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	// a column of several types scans to any
+	r := &rows{res: &storage.Result{Columns: []string{"a", "b"}, Rows: [][]any{{int64(1), nil}, {"x", nil}}}}
+	if r.ColumnTypeScanType(0) != anyType || r.ColumnTypeScanType(1) != anyType {
+		t.Fatalf("scan types %v %v", r.ColumnTypeScanType(0), r.ColumnTypeScanType(1))
+	}
+	if reflect.TypeOf(int64(0)) != (&rows{res: &storage.Result{Rows: [][]any{{nil}, {int64(2)}}}}).ColumnTypeScanType(0) {
+		t.Fatal("scan type of int64 and NULL")
+	}
+}
@@ -0,0 +1,764 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SQLite export: Tx.ExportSQLite writes the keys of a snapshot into a
+// SQLite database file, for the SQLite shell and the tools built on it.
+// Each bucket is a table of two columns, key and value, named by its path,
+// the keys outside buckets are the table "keys"; with an index of the keys
+// if asked. The tables of records.go are tables of their typed columns,
+// their primary key and indexes SQLite indexes. The buckets of the engine,
+// at the top and starting with 0x00 as TABLES_BUCKET, aren't exported as
+// tables of keys.
+//
+// The file is written as SQLite would have it, without SQLite: the trees
+// are built from their leaves up as the keys come in order, the rows of a
+// table numbered from 1, then their roots are listed in the schema table,
+// whose root is the first page, after the header. Integers are big-endian,
+// varints those of SQLite: 7 bits a byte, the high bit set but on the
+// last, the 9th byte has 8 bits.
+//
+// header layout, at the start of the first page, the fields not listed are 0
+// | magic | page size | versions | reserved | payload fractions | change counter | pages |
+// | 16B   | 2B        | 2B       | 1B       | 3B                | 4B             | 4B    |
+// | ... | schema cookie | schema format | ... | text encoding | ... | valid for | SQLite version |
+// | 8B  | 4B            | 4B            | 12B | 4B            | 32B | 4B        | 4B             |
+// page layout, the cells from the end of the page, right is on the
+// interior pages only
+// | type | free block | cells | content start | fragmented | right | pointers... | ... | cells... |
+// | 1B   | 2B         | 2B    | 2B            | 1B         | 4B    | 2B each     |     |          |
+// cell layout, the payload on the leaves of the tables is a row, on the
+// index pages a key and the number of its row; the end of a payload too
+// large for the page is in a list of overflow pages
+// | left child | payload size | row    | payload | overflow |
+// | 4B         | varint       | varint | ...     | 4B       |
+// record layout, the payload, the types of the columns then their values
+// | header size | types...  | values... |
+// | varint      | varint    |           |
+
+const (
+	SQLITE_MAGIC     = "SQLite format 3\x00"
+	SQLITE_PAGE_SIZE = 4096
+	SQLITE_HEADER    = 100
+	SQLITE_VERSION   = 3040000 // of the SQLite the files are written as
+	SQLITE_KEYS      = "keys"  // table of the keys outside buckets
+
+	sqliteInteriorIndex = 0x02
+	sqliteInteriorTable = 0x05
+	sqliteLeafIndex     = 0x0a
+	sqliteLeafTable     = 0x0d
+)
+
+var ErrSQLiteTable = errors.New("bucket or table can't be a SQLite table")
+
+// SQLiteOptions are the options of Tx.ExportSQLite.
+type SQLiteOptions struct {
+	Strings bool // the columns are TEXT, BLOB otherwise
+	Index   bool // a unique index of the keys of each table, for the DBs ordered by bytes.Compare
+}
+
+// ExportSQLite writes the keys of the Tx into a new SQLite database file
+// at path: a table for the keys outside buckets and one for each bucket,
+// nested ones included, their names the paths separated by a slash, then
+// one for each table of records.go. The rows are in key order. The expiry
+// of the keys isn't kept. The entries of the indexes of the tables are
+// sorted in memory, a table at a time. The file is removed if the export
+// fails; ErrSQLiteTable if two tables or indexes would have the same name,
+// or one a name reserved by SQLite.
+func (tx *Tx) ExportSQLite(path string, opts SQLiteOptions) (err error) {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if opts.Index && tx.db.opts.cmp != nil {
+		return fmt.Errorf("an index of the keys needs them in byte order, not of comparator %q", tx.db.opts.comparator)
+	}
+	paths, err := tx.bucketPaths()
+	if err != nil {
+		return err
+	}
+	var tables []*Table
+	names := map[string]bool{}
+	addName := func(name string) error {
+		if names[name] || strings.HasPrefix(strings.ToLower(name), "sqlite_") {
+			return fmt.Errorf("%w: %q", ErrSQLiteTable, name)
+		}
+		names[name] = true
+		return nil
+	}
+	for _, p := range paths {
+		name := SQLITE_KEYS
+		if p != nil {
+			name = string(bytes.Join(p, []byte("/")))
+		}
+		if err := addName(name); err != nil {
+			return err
+		}
+		if opts.Index {
+			if err := addName(name + "_key"); err != nil {
+				return err
+			}
+		}
+	}
+	tableNames, err := tx.Tables()
+	if err != nil {
+		return err
+	}
+	for _, name := range tableNames {
+		t, err := tx.Table(name)
+		if err != nil {
+			return err
+		}
+		if err := addName(name); err != nil {
+			return err
+		}
+		if err := addName(name + "_pkey"); err != nil {
+			return err
+		}
+		for _, ix := range t.indexes {
+			if err := addName(name + "_" + ix.Name); err != nil {
+				return err
+			}
+		}
+		tables = append(tables, t)
+	}
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	defer catchTreeError(&err)
+	w := &sqliteWriter{fp: fp, w: bufio.NewWriter(fp), pages: 1}
+	// the first page is written last
+	if _, err := w.w.Write(make([]byte, SQLITE_PAGE_SIZE)); err != nil {
+		return err
+	}
+	keyType, valueType := "BLOB", "BLOB"
+	if opts.Strings {
+		keyType, valueType = "TEXT", "TEXT"
+	}
+	schema := w.newTree(false, SQLITE_HEADER)
+	var schemaRow int64
+	addSchema := func(kind, name, table string, root uint32, sql string) error {
+		schemaRow++
+		return schema.addRow(schemaRow, sqliteRecord(sqliteText(kind), sqliteText(name), sqliteText(table), int64(root), sqliteText(sql)))
+	}
+	for _, p := range paths {
+		c, err := tx.pathCursor(p)
+		if err != nil {
+			return err
+		}
+		table, index := w.newTree(false, 0), w.newTree(true, 0)
+		var row int64
+		for key, value := c.First(); key != nil; key, value = c.Next() {
+			row++
+			k, v := any(key), any(value)
+			if opts.Strings {
+				k, v = sqliteText(key), sqliteText(value)
+			}
+			if err := table.addRow(row, sqliteRecord(k, v)); err != nil {
+				return err
+			}
+			if opts.Index {
+				if err := index.addEntry(sqliteRecord(k, row)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := c.Err(); err != nil {
+			return err
+		}
+		name := SQLITE_KEYS
+		if p != nil {
+			name = string(bytes.Join(p, []byte("/")))
+		}
+		root, err := table.finish(false)
+		if err != nil {
+			return err
+		}
+		if err := addSchema("table", name, name, root, fmt.Sprintf("CREATE TABLE %s(key %s, value %s)", sqliteQuote(name), keyType, valueType)); err != nil {
+			return err
+		}
+		if opts.Index {
+			if root, err = index.finish(false); err != nil {
+				return err
+			}
+			if err := addSchema("index", name+"_key", name, root, fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s(key)", sqliteQuote(name+"_key"), sqliteQuote(name))); err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range tables {
+		if err := w.exportTable(t, addSchema); err != nil {
+			return err
+		}
+	}
+	if _, err := schema.finish(true); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.writeFirst(schema.root)
+}
+
+// write a table of records.go as a table of its columns, then its primary
+// key and indexes as indexes of the columns and the row: their entries are
+// sorted by the keys of AppendKey, in the order of SQLite since the
+// columns each have a type, NULL first
+func (w *sqliteWriter) exportTable(t *Table, addSchema func(kind, name, table string, root uint32, sql string) error) error {
+	name := t.schema.Name
+	indexes := []sqliteIndex{{name: name + "_pkey", cols: t.key, unique: true}}
+	for _, ix := range t.indexes {
+		indexes = append(indexes, sqliteIndex{name: name + "_" + ix.Name, cols: ix.cols, unique: ix.Unique})
+	}
+	rows := w.newTree(false, 0)
+	var row int64
+	err := t.Scan(nil, nil, func(r Row) error {
+		row++
+		values := make([]any, len(r))
+		for i, v := range r {
+			values[i] = sqliteValue(v)
+		}
+		if err := rows.addRow(row, sqliteRecord(values...)); err != nil {
+			return err
+		}
+		for i := range indexes {
+			ix := &indexes[i]
+			entry := append(columnsOf(ix.cols, values), row)
+			order := columnsOf(ix.cols, r)
+			for j := range order {
+				if values[ix.cols[j]] == nil {
+					order[j] = nil // NaN
+				}
+			}
+			key, err := AppendKey(nil, append(order, row)...)
+			if err != nil {
+				return err
+			}
+			ix.entries = append(ix.entries, sqliteEntry{key: key, record: sqliteRecord(entry...)})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	root, err := rows.finish(false)
+	if err != nil {
+		return err
+	}
+	var cols []string
+	for _, c := range t.schema.Columns {
+		col := sqliteQuote(c.Name) + " " + sqliteTypes[c.Type]
+		// a NaN is a NULL to SQLite
+		if !c.Nullable && c.Type != ColumnFloat64 {
+			col += " NOT NULL"
+		}
+		cols = append(cols, col)
+	}
+	if err := addSchema("table", name, name, root, fmt.Sprintf("CREATE TABLE %s(%s)", sqliteQuote(name), strings.Join(cols, ", "))); err != nil {
+		return err
+	}
+	for _, ix := range indexes {
+		sort.Slice(ix.entries, func(i, j int) bool { return bytes.Compare(ix.entries[i].key, ix.entries[j].key) < 0 })
+		tree := w.newTree(true, 0)
+		for _, e := range ix.entries {
+			if err := tree.addEntry(e.record); err != nil {
+				return err
+			}
+		}
+		root, err := tree.finish(false)
+		if err != nil {
+			return err
+		}
+		cols = cols[:0]
+		for _, col := range ix.cols {
+			cols = append(cols, sqliteQuote(t.schema.Columns[col].Name))
+		}
+		create := "CREATE INDEX"
+		if ix.unique {
+			create = "CREATE UNIQUE INDEX"
+		}
+		if err := addSchema("index", ix.name, name, root, fmt.Sprintf("%s %s ON %s(%s)", create, sqliteQuote(ix.name), sqliteQuote(name), strings.Join(cols, ", "))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// an index of a table being exported
+type sqliteIndex struct {
+	name    string
+	cols    []int
+	unique  bool
+	entries []sqliteEntry
+}
+
+type sqliteEntry struct {
+	key    []byte // to sort the entries
+	record []byte
+}
+
+// the declared types of the columns, the bools are 0 or 1
+var sqliteTypes = map[ColumnType]string{
+	ColumnInt64:   "INTEGER",
+	ColumnFloat64: "REAL",
+	ColumnString:  "TEXT",
+	ColumnBytes:   "BLOB",
+	ColumnBool:    "BOOLEAN",
+}
+
+// the value of sqliteRecord of a value of a row, NaN is NULL in SQLite
+func sqliteValue(v any) any {
+	switch v := v.(type) {
+	case float64:
+		if math.IsNaN(v) {
+			return nil
+		}
+	case string:
+		return sqliteText(v)
+	case bool:
+		return int64(boolByte(v))
+	}
+	return v
+}
+
+// the paths of the buckets in order, each before those inside it, after
+// nil for the keys outside buckets; not the buckets of the engine
+func (tx *Tx) bucketPaths() ([][][]byte, error) {
+	paths := [][][]byte{nil}
+	var walk func(path [][]byte, b *Bucket) error
+	walk = func(path [][]byte, b *Bucket) error {
+		var names [][]byte
+		collect := func(name []byte) error {
+			names = append(names, bytes.Clone(name))
+			return nil
+		}
+		var err error
+		if b == nil {
+			err = tx.ForEachBucket(collect)
+		} else {
+			err = b.ForEachBucket(collect)
+		}
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if b == nil && name[0] == 0 {
+				continue
+			}
+			var inner *Bucket
+			if b == nil {
+				inner, err = tx.Bucket(name)
+			} else {
+				inner, err = b.Bucket(name)
+			}
+			if err != nil {
+				return err
+			}
+			p := append(path[:len(path):len(path)], name)
+			paths = append(paths, p)
+			if err := walk(p, inner); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk(nil, nil)
+	return paths, err
+}
+
+type sqliteWriter struct {
+	fp    *os.File
+	w     *bufio.Writer
+	pages uint32 // written, with the first one
+}
+
+// write the next page
+func (w *sqliteWriter) write(page []byte) (uint32, error) {
+	if _, err := w.w.Write(page); err != nil {
+		return 0, err
+	}
+	w.pages++
+	return w.pages, nil
+}
+
+// write the first page, the header and the root of the schema table
+func (w *sqliteWriter) writeFirst(root []byte) error {
+	h := root[:SQLITE_HEADER]
+	copy(h, SQLITE_MAGIC)
+	binary.BigEndian.PutUint16(h[16:], SQLITE_PAGE_SIZE)
+	h[18], h[19] = 1, 1 // legacy journal
+	h[21], h[22], h[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(h[24:], 1) // change counter
+	binary.BigEndian.PutUint32(h[28:], w.pages)
+	binary.BigEndian.PutUint32(h[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(h[44:], 4) // schema format
+	binary.BigEndian.PutUint32(h[56:], 1) // UTF-8
+	binary.BigEndian.PutUint32(h[92:], 1)
+	binary.BigEndian.PutUint32(h[96:], SQLITE_VERSION)
+	_, err := w.fp.WriteAt(root, 0)
+	return err
+}
+
+// a tree built from its leaves up
+type sqliteTree struct {
+	w       *sqliteWriter
+	index   bool
+	reserve int // bytes at the start of the root page, for the header
+	levels  []*sqliteLevel
+	root    []byte // the root page when the root is the first page
+}
+
+// the page being filled at a depth, the leaves first
+type sqliteLevel struct {
+	cells [][]byte
+	size  int
+	last  int64 // row of the last cell of a leaf of a table
+}
+
+// a cell pointing to a child, with the end of its row or key
+type sqliteChild struct {
+	page    uint32
+	row     int64
+	divider []byte // record of an index between this child and the next
+}
+
+func (w *sqliteWriter) newTree(index bool, reserve int) *sqliteTree {
+	return &sqliteTree{w: w, index: index, reserve: reserve, levels: []*sqliteLevel{{}}}
+}
+
+// the free bytes of a page at the depth
+func (t *sqliteTree) space(depth int) int {
+	header := 8
+	if depth > 0 {
+		header = 12
+	}
+	return SQLITE_PAGE_SIZE - header - t.reserve
+}
+
+func (t *sqliteTree) addRow(row int64, record []byte) error {
+	prefix := sqlitePutVarint(nil, uint64(len(record)))
+	cell, err := t.w.payload(sqlitePutVarint(prefix, uint64(row)), record, false)
+	if err != nil {
+		return err
+	}
+	leaf := t.levels[0]
+	if leaf.size+len(cell)+2 > t.space(0) {
+		if len(leaf.cells) == 0 {
+			return fmt.Errorf("%w: row of %d bytes too large for a page", ErrSQLiteTable, len(cell))
+		}
+		page, err := t.writePage(0, 0)
+		if err != nil {
+			return err
+		}
+		if err := t.addChild(1, sqliteChild{page: page, row: leaf.last}); err != nil {
+			return err
+		}
+	}
+	leaf.cells = append(leaf.cells, cell)
+	leaf.size += len(cell) + 2
+	leaf.last = row
+	return nil
+}
+
+func (t *sqliteTree) addEntry(record []byte) error {
+	cell, err := t.w.payload(sqlitePutVarint(nil, uint64(len(record))), record, true)
+	if err != nil {
+		return err
+	}
+	leaf := t.levels[0]
+	leaf.size += len(cell) + 2
+	leaf.cells = append(leaf.cells, cell)
+	if leaf.size <= t.space(0) {
+		return nil
+	}
+	// the last entry that fits goes up between the leaf and the next one
+	n := len(leaf.cells) - 2
+	if n < 1 {
+		return fmt.Errorf("%w: key of %d bytes too large for a page", ErrSQLiteTable, len(cell))
+	}
+	divider, next := leaf.cells[n], leaf.cells[n+1]
+	leaf.cells = leaf.cells[:n]
+	page, err := t.writePage(0, 0)
+	if err != nil {
+		return err
+	}
+	leaf.cells, leaf.size = append(leaf.cells, next), len(next)+2
+	return t.addChild(1, sqliteChild{page: page, divider: divider})
+}
+
+// add a child to the interior page at the depth; a full page is written
+// with its last child as the right one, and goes up itself
+func (t *sqliteTree) addChild(depth int, c sqliteChild) error {
+	if depth == len(t.levels) {
+		t.levels = append(t.levels, &sqliteLevel{})
+	}
+	l := t.levels[depth]
+	cell := binary.BigEndian.AppendUint32(nil, c.page)
+	if t.index {
+		cell = append(cell, c.divider...)
+	} else {
+		cell = sqlitePutVarint(cell, uint64(c.row))
+	}
+	if l.size+len(cell)+2 > t.space(depth) && len(l.cells) > 1 {
+		up, err := t.flushInterior(depth)
+		if err != nil {
+			return err
+		}
+		if err := t.addChild(depth+1, up); err != nil {
+			return err
+		}
+	}
+	l.cells = append(l.cells, cell)
+	l.size += len(cell) + 2
+	return nil
+}
+
+// write the interior page at the depth, its last cell the right child,
+// and return it as a child of the page above
+func (t *sqliteTree) flushInterior(depth int) (sqliteChild, error) {
+	l := t.levels[depth]
+	last := l.cells[len(l.cells)-1]
+	l.cells = l.cells[:len(l.cells)-1]
+	right := binary.BigEndian.Uint32(last)
+	up := sqliteChild{}
+	if t.index {
+		up.divider = last[4:]
+	} else {
+		row, _ := sqliteVarint(last[4:])
+		up.row = int64(row)
+	}
+	page, err := t.writePage(depth, right)
+	if err != nil {
+		return up, err
+	}
+	up.page = page
+	return up, nil
+}
+
+// write the page being filled at the depth and empty it
+func (t *sqliteTree) writePage(depth int, right uint32) (uint32, error) {
+	page := t.page(depth, right, 0)
+	l := t.levels[depth]
+	l.cells, l.size = l.cells[:0], 0
+	return t.w.write(page)
+}
+
+// the page at the depth, the header at offset
+func (t *sqliteTree) page(depth int, right uint32, offset int) []byte {
+	l := t.levels[depth]
+	page := make([]byte, SQLITE_PAGE_SIZE)
+	h := page[offset:]
+	switch {
+	case depth == 0 && t.index:
+		h[0] = sqliteLeafIndex
+	case depth == 0:
+		h[0] = sqliteLeafTable
+	case t.index:
+		h[0] = sqliteInteriorIndex
+	default:
+		h[0] = sqliteInteriorTable
+	}
+	pointers := offset + 8
+	if depth > 0 {
+		binary.BigEndian.PutUint32(h[8:], right)
+		pointers += 4
+	}
+	binary.BigEndian.PutUint16(h[3:], uint16(len(l.cells)))
+	end := SQLITE_PAGE_SIZE
+	for i, cell := range l.cells {
+		end -= len(cell)
+		copy(page[end:], cell)
+		binary.BigEndian.PutUint16(page[pointers+2*i:], uint16(end))
+	}
+	binary.BigEndian.PutUint16(h[5:], uint16(end)) // 0 for 65536
+	return page
+}
+
+// write the pages left and return the root: written as the next page, or
+// kept in root for the first page
+func (t *sqliteTree) finish(first bool) (uint32, error) {
+	top := 0
+	for depth := 0; depth < len(t.levels)-1; depth++ {
+		if depth == 0 {
+			page, err := t.writePage(0, 0)
+			if err != nil {
+				return 0, err
+			}
+			last := t.levels[0].last
+			if err := t.addChild(1, sqliteChild{page: page, row: last}); err != nil {
+				return 0, err
+			}
+		} else {
+			up, err := t.flushInterior(depth)
+			if err != nil {
+				return 0, err
+			}
+			if err := t.addChild(depth+1, up); err != nil {
+				return 0, err
+			}
+		}
+		top = depth + 1
+	}
+	var right uint32
+	if top > 0 {
+		l := t.levels[top]
+		right = binary.BigEndian.Uint32(l.cells[len(l.cells)-1])
+		l.cells = l.cells[:len(l.cells)-1]
+	}
+	if first {
+		t.root = t.page(top, right, SQLITE_HEADER)
+		return 1, nil
+	}
+	return t.w.write(t.page(top, right, 0))
+}
+
+// the payload of a cell after prefix: the part of the record kept in the
+// page, then its overflow pages if it's too large, written
+func (w *sqliteWriter) payload(prefix, record []byte, index bool) ([]byte, error) {
+	const usable = SQLITE_PAGE_SIZE
+	maxLocal := usable - 35
+	if index {
+		maxLocal = (usable-12)*64/255 - 23
+	}
+	minLocal := (usable-12)*32/255 - 23
+	local := len(record)
+	if local > maxLocal {
+		local = minLocal + (len(record)-minLocal)%(usable-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	cell := append(prefix, record[:local]...)
+	if local == len(record) {
+		return cell, nil
+	}
+	// the overflow pages from the last, each points to the next
+	rest := record[local:]
+	chunk := usable - 4
+	n := (len(rest) + chunk - 1) / chunk
+	first := w.pages + 1
+	for i := 0; i < n; i++ {
+		page := make([]byte, SQLITE_PAGE_SIZE)
+		if i < n-1 {
+			binary.BigEndian.PutUint32(page, first+uint32(i)+1)
+		}
+		copy(page[4:], rest[i*chunk:min(len(rest), (i+1)*chunk)])
+		if _, err := w.write(page); err != nil {
+			return nil, err
+		}
+	}
+	return binary.BigEndian.AppendUint32(cell, first), nil
+}
+
+type sqliteText []byte
+
+// a record of the values: []byte a BLOB, sqliteText a TEXT, int64 an
+// INTEGER, float64 a REAL and nil a NULL
+func sqliteRecord(values ...any) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = append(types, 0)
+		case float64:
+			types = append(types, 7)
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(v))
+		case []byte:
+			types = sqlitePutVarint(types, uint64(len(v))*2+12)
+			body = append(body, v...)
+		case sqliteText:
+			types = sqlitePutVarint(types, uint64(len(v))*2+13)
+			body = append(body, v...)
+		case int64:
+			switch {
+			case v == 0:
+				types = append(types, 8)
+			case v == 1:
+				types = append(types, 9)
+			case v >= -1<<7 && v < 1<<7:
+				types = append(types, 1)
+				body = append(body, byte(v))
+			case v >= -1<<15 && v < 1<<15:
+				types = append(types, 2)
+				body = binary.BigEndian.AppendUint16(body, uint16(v))
+			case v >= -1<<31 && v < 1<<31:
+				types = append(types, 4)
+				body = binary.BigEndian.AppendUint32(body, uint32(v))
+			default:
+				types = append(types, 6)
+				body = binary.BigEndian.AppendUint64(body, uint64(v))
+			}
+		}
+	}
+	// the size of the header counts its own varint
+	size := len(types) + 1
+	for len(sqlitePutVarint(nil, uint64(size)))+len(types) != size {
+		size++
+	}
+	record := sqlitePutVarint(nil, uint64(size))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+func sqlitePutVarint(b []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		for shift := 57; shift >= 8; shift -= 7 {
+			b = append(b, byte(v>>shift&0x7f)|0x80)
+		}
+		return append(b, byte(v))
+	}
+	var tmp [8]byte
+	n := 0
+	for {
+		tmp[n] = byte(v & 0x7f)
+		n++
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		c := tmp[i]
+		if i > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v, len(b)
+}
+
+func sqliteQuote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,459 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a reader of the SQLite files of ExportSQLite
+type sqliteFileTest struct {
+	t    *testing.T
+	file []byte
+}
+
+func readSQLiteTest(t *testing.T, path string) *sqliteFileTest {
+	t.Helper()
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file) < SQLITE_PAGE_SIZE || string(file[:16]) != SQLITE_MAGIC {
+		t.Fatal("not a SQLite file")
+	}
+	if size := binary.BigEndian.Uint16(file[16:]); size != SQLITE_PAGE_SIZE {
+		t.Fatalf("pages of %d bytes", size)
+	}
+	if pages := binary.BigEndian.Uint32(file[28:]); int(pages)*SQLITE_PAGE_SIZE != len(file) {
+		t.Fatalf("%d pages in a file of %d bytes", pages, len(file))
+	}
+	return &sqliteFileTest{t: t, file: file}
+}
+
+func (f *sqliteFileTest) page(n uint32) []byte {
+	if n < 1 || int(n)*SQLITE_PAGE_SIZE > len(f.file) {
+		f.t.Fatalf("page %d out of the file", n)
+	}
+	return f.file[int(n-1)*SQLITE_PAGE_SIZE : int(n)*SQLITE_PAGE_SIZE]
+}
+
+// the payload of a cell at the start of b, its overflow pages followed
+func (f *sqliteFileTest) payload(b []byte, index bool) []byte {
+	size, n := sqliteVarint(b)
+	b = b[n:]
+	const usable = SQLITE_PAGE_SIZE
+	maxLocal, minLocal := usable-35, (usable-12)*32/255-23
+	if index {
+		maxLocal = (usable-12)*64/255 - 23
+	}
+	if size <= uint64(maxLocal) {
+		return b[:size]
+	}
+	local := minLocal + int(size-uint64(minLocal))%(usable-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	payload := append([]byte(nil), b[:local]...)
+	for next := binary.BigEndian.Uint32(b[local:]); uint64(len(payload)) < size; {
+		page := f.page(next)
+		payload = append(payload, page[4:min(usable, 4+int(size)-len(payload))]...)
+		next = binary.BigEndian.Uint32(page)
+	}
+	return payload
+}
+
+// call fn with the rows, 0 for the entries of an index, and the records
+// of the tree at root in order
+func (f *sqliteFileTest) walk(root uint32, fn func(row int64, record []byte)) {
+	page := f.page(root)
+	h := page
+	if root == 1 {
+		h = page[SQLITE_HEADER:]
+	}
+	cells := int(binary.BigEndian.Uint16(h[3:]))
+	pointers := h[8:]
+	if h[0] == sqliteInteriorIndex || h[0] == sqliteInteriorTable {
+		pointers = h[12:]
+	}
+	for i := 0; i < cells; i++ {
+		cell := page[binary.BigEndian.Uint16(pointers[2*i:]):]
+		switch h[0] {
+		case sqliteLeafTable:
+			_, n := sqliteVarint(cell)
+			row, m := sqliteVarint(cell[n:])
+			// the row number is between the size and the payload
+			fn(int64(row), f.payload(append(cell[:n:n], cell[n+m:]...), false))
+		case sqliteLeafIndex:
+			fn(0, f.payload(cell, true))
+		case sqliteInteriorTable:
+			f.walk(binary.BigEndian.Uint32(cell), fn)
+		case sqliteInteriorIndex:
+			f.walk(binary.BigEndian.Uint32(cell), fn)
+			fn(0, f.payload(cell[4:], true))
+		default:
+			f.t.Fatalf("page %d of type %#x", root, h[0])
+		}
+	}
+	if h[0] == sqliteInteriorIndex || h[0] == sqliteInteriorTable {
+		f.walk(binary.BigEndian.Uint32(h[8:]), fn)
+	}
+}
+
+// the values of a record: nil, int64, float64, string for TEXT, []byte for
+// BLOB
+func decodeSQLiteRecord(t *testing.T, record []byte) []any {
+	t.Helper()
+	size, n := sqliteVarint(record)
+	header, body := record[n:size], record[size:]
+	var values []any
+	for len(header) > 0 {
+		typ, n := sqliteVarint(header)
+		header = header[n:]
+		intSize := map[uint64]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 6, 6: 8}
+		switch {
+		case typ == 0:
+			values = append(values, nil)
+		case intSize[typ] > 0:
+			var v int64
+			for i := 0; i < intSize[typ]; i++ {
+				v = v<<8 | int64(body[i])
+			}
+			shift := 64 - 8*intSize[typ]
+			values = append(values, v<<shift>>shift)
+			body = body[intSize[typ]:]
+		case typ == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(body)))
+			body = body[8:]
+		case typ == 8, typ == 9:
+			values = append(values, int64(typ-8))
+		case typ >= 12 && typ%2 == 0:
+			values = append(values, body[:(typ-12)/2])
+			body = body[(typ-12)/2:]
+		case typ >= 13:
+			values = append(values, string(body[:(typ-13)/2]))
+			body = body[(typ-13)/2:]
+		default:
+			t.Fatalf("type %d in a record", typ)
+		}
+	}
+	if len(body) != 0 {
+		t.Fatalf("%d bytes after the values of a record", len(body))
+	}
+	return values
+}
+
+// the order of SQLite: NULL, the numbers, TEXT then BLOB
+func compareSQLite(a, b []any) int {
+	class := func(v any) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, float64:
+			return 1
+		case string:
+			return 2
+		}
+		return 3
+	}
+	number := func(v any) float64 {
+		if i, ok := v.(int64); ok {
+			return float64(i)
+		}
+		return v.(float64)
+	}
+	for i := range a {
+		ca, cb := class(a[i]), class(b[i])
+		c := ca - cb
+		switch {
+		case c != 0:
+		case ca == 1:
+			if x, y := number(a[i]), number(b[i]); x < y {
+				c = -1
+			} else if x > y {
+				c = 1
+			}
+		case ca == 2:
+			c = strings.Compare(a[i].(string), b[i].(string))
+		case ca == 3:
+			c = bytes.Compare(a[i].([]byte), b[i].([]byte))
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+type sqliteSchemaTest struct {
+	kind, name, table string
+	root              uint32
+	sql               string
+}
+
+func (f *sqliteFileTest) schema() map[string]sqliteSchemaTest {
+	schema := map[string]sqliteSchemaTest{}
+	f.walk(1, func(row int64, record []byte) {
+		v := decodeSQLiteRecord(f.t, record)
+		s := sqliteSchemaTest{kind: v[0].(string), name: v[1].(string), table: v[2].(string), root: uint32(v[3].(int64)), sql: v[4].(string)}
+		schema[s.name] = s
+	})
+	return schema
+}
+
+// the rows of a table, and check its indexes hold them in order
+func (f *sqliteFileTest) rows(schema map[string]sqliteSchemaTest, table string) map[int64][]any {
+	f.t.Helper()
+	rows := map[int64][]any{}
+	last := int64(0)
+	f.walk(schema[table].root, func(row int64, record []byte) {
+		if row <= last {
+			f.t.Fatalf("row %d after %d in %s", row, last, table)
+		}
+		rows[row], last = decodeSQLiteRecord(f.t, record), row
+	})
+	for _, s := range schema {
+		if s.kind != "index" || s.table != table {
+			continue
+		}
+		var prev []any
+		n := 0
+		f.walk(s.root, func(_ int64, record []byte) {
+			entry := decodeSQLiteRecord(f.t, record)
+			if prev != nil && compareSQLite(prev, entry) >= 0 {
+				f.t.Fatalf("entry %v after %v in %s", entry, prev, s.name)
+			}
+			if rows[entry[len(entry)-1].(int64)] == nil {
+				f.t.Fatalf("entry %v of %s of no row", entry, s.name)
+			}
+			prev = entry
+			n++
+		})
+		if n != len(rows) {
+			f.t.Fatalf("%d entries in %s of %d rows", n, s.name, len(rows))
+		}
+	}
+	return rows
+}
+
+func TestExportSQLite(t *testing.T) {
+	const keys = 50000
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < keys; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%06d", i)), []byte(fmt.Sprintf("value %d", i*i)))
+	}
+	b, _ := tx.CreateBucket([]byte("b"))
+	for i := 0; i < 3000; i++ {
+		b.Set(bytes.Repeat([]byte{byte(i % 250), byte(i / 250)}, 1+i%450), bytes.Repeat([]byte("v"), i))
+	}
+	n, _ := b.CreateBucket([]byte(`nested "q"`))
+	n.Set([]byte("x"), []byte("y"))
+	tx.CreateBucket([]byte("empty"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, opts := range []SQLiteOptions{{Index: true}, {Strings: true}} {
+		path := filepath.Join(dir, fmt.Sprintf("%v.sqlite", opts.Strings))
+		if err := db.View(func(tx *Tx) error { return tx.ExportSQLite(path, opts) }); err != nil {
+			t.Fatal(err)
+		}
+		f := readSQLiteTest(t, path)
+		schema := f.schema()
+		keyType := "BLOB"
+		if opts.Strings {
+			keyType = "TEXT"
+		}
+		for _, name := range []string{SQLITE_KEYS, "b", `b/nested "q"`, "empty"} {
+			s := schema[name]
+			want := fmt.Sprintf("CREATE TABLE %s(key %s, value %s)", sqliteQuote(name), keyType, keyType)
+			if s.kind != "table" || s.table != name || s.sql != want {
+				t.Fatalf("schema of %s %+v", name, s)
+			}
+			if _, ok := schema[name+"_key"]; ok != opts.Index {
+				t.Fatalf("index of %s %v", name, ok)
+			}
+		}
+		if len(schema) != 4 && !opts.Index || len(schema) != 8 && opts.Index {
+			t.Fatalf("schema %v", schema)
+		}
+		rows := f.rows(schema, SQLITE_KEYS)
+		if len(rows) != keys {
+			t.Fatalf("%d rows", len(rows))
+		}
+		for i := 0; i < keys; i += 997 {
+			key, value := any([]byte(fmt.Sprintf("k%06d", i))), any([]byte(fmt.Sprintf("value %d", i*i)))
+			if opts.Strings {
+				key, value = string(key.([]byte)), string(value.([]byte))
+			}
+			if got := fmt.Sprint(rows[int64(i+1)]); got != fmt.Sprint([]any{key, value}) {
+				t.Fatalf("row %d is %s", i+1, got)
+			}
+		}
+		// the values past a page are in overflow pages
+		total := 0
+		for _, v := range f.rows(schema, "b") {
+			value := fmt.Sprintf("%s", v[1])
+			if strings.Trim(value, "v") != "" {
+				t.Fatalf("value %q", value)
+			}
+			total += len(value)
+		}
+		if total != 3000*2999/2 {
+			t.Fatalf("values of %d bytes in b", total)
+		}
+	}
+
+	// a file there isn't overwritten, ErrTxClosed after the Tx
+	tx, _ = db.Begin(false)
+	if err := tx.ExportSQLite(filepath.Join(dir, "true.sqlite"), SQLiteOptions{}); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("export over a file: %v", err)
+	}
+	tx.Rollback()
+	if err := tx.ExportSQLite(filepath.Join(dir, "closed.sqlite"), SQLiteOptions{}); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("export of a closed Tx: %v", err)
+	}
+	for _, name := range []string{"sqlite_master", "keys"} {
+		tx, _ := db.Begin(true)
+		tx.CreateBucket([]byte(name))
+		path := filepath.Join(dir, name+".sqlite")
+		if err := tx.ExportSQLite(path, SQLiteOptions{}); !errors.Is(err, ErrSQLiteTable) {
+			t.Fatalf("export of the bucket %s: %v", name, err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("file of a failed export: %v", err)
+		}
+		tx.Rollback()
+	}
+}
+
+// the tables of records.go are tables of their columns, with their keys
+// and indexes, not a table of the bucket of the tables
+func TestExportSQLiteTables(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	users, err := tx.CreateTable(Schema{
+		Name: "users",
+		Columns: []Column{
+			{Name: "id", Type: ColumnInt64},
+			{Name: "name", Type: ColumnString, Nullable: true},
+			{Name: "score", Type: ColumnFloat64},
+			{Name: "active", Type: ColumnBool},
+			{Name: "data", Type: ColumnBytes, Nullable: true},
+		},
+		PrimaryKey: []string{"id"},
+		Indexes:    []Index{{Name: "by_name", Columns: []string{"name"}}, {Name: "by_score", Columns: []string{"score", "active"}, Unique: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const rows = 5000
+	for i := int64(0); i < rows; i++ {
+		var name, data any
+		if i%7 != 0 {
+			name = fmt.Sprintf("user %d", i%100)
+		}
+		if i%3 == 0 {
+			data = bytes.Repeat([]byte{byte(i)}, int(i%2900))
+		}
+		score := float64(rows/2-i) / 4
+		if i == 42 {
+			score = math.NaN()
+		}
+		if _, err := users.Insert(Row{i*3 - rows, name, score, i%2 == 0, data}); err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+	}
+	events, err := tx.CreateTable(Schema{
+		Name:       "events",
+		Columns:    []Column{{Name: "user", Type: ColumnString}, {Name: "at", Type: ColumnInt64}, {Name: "what", Type: ColumnString}},
+		PrimaryKey: []string{"user", "at"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"b", "a\x00", "a"} {
+		for _, at := range []int64{3, -1, 2} {
+			events.Insert(Row{user, at, user + fmt.Sprint(at)})
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "tables.sqlite")
+	if err := db.View(func(tx *Tx) error { return tx.ExportSQLite(path, SQLiteOptions{Index: true}) }); err != nil {
+		t.Fatal(err)
+	}
+	f := readSQLiteTest(t, path)
+	schema := f.schema()
+	for name, sql := range map[string]string{
+		"users":          `CREATE TABLE "users"("id" INTEGER NOT NULL, "name" TEXT, "score" REAL, "active" BOOLEAN NOT NULL, "data" BLOB)`,
+		"users_pkey":     `CREATE UNIQUE INDEX "users_pkey" ON "users"("id")`,
+		"users_by_name":  `CREATE INDEX "users_by_name" ON "users"("name")`,
+		"users_by_score": `CREATE UNIQUE INDEX "users_by_score" ON "users"("score", "active")`,
+		"events":         `CREATE TABLE "events"("user" TEXT NOT NULL, "at" INTEGER NOT NULL, "what" TEXT NOT NULL)`,
+		"events_pkey":    `CREATE UNIQUE INDEX "events_pkey" ON "events"("user", "at")`,
+	} {
+		if s := schema[name]; s.sql != sql {
+			t.Errorf("schema of %s: %s, want %s", name, s.sql, sql)
+		}
+	}
+	// the keys outside buckets and their index, no table of TABLES_BUCKET
+	if len(schema) != 8 || schema[SQLITE_KEYS].kind != "table" || schema[SQLITE_KEYS+"_key"].kind != "index" {
+		t.Fatalf("schema %v", schema)
+	}
+
+	got := f.rows(schema, "users")
+	if len(got) != rows {
+		t.Fatalf("%d rows", len(got))
+	}
+	// the rows in the order of their keys, NaN a NULL
+	for i := int64(0); i < rows; i++ {
+		r := got[i+1]
+		if r[0] != i*3-rows || r[3] != int64(boolByte(i%2 == 0)) {
+			t.Fatalf("row %d is %v", i+1, r)
+		}
+		if i == 42 && r[2] != nil || i != 42 && r[2] != float64(rows/2-i)/4 {
+			t.Fatalf("score of row %d is %v", i+1, r[2])
+		}
+		if (i%7 == 0) != (r[1] == nil) || (i%3 == 0) != (r[4] != nil) {
+			t.Fatalf("NULLs of row %d: %v", i+1, r[:2])
+		}
+		if data, ok := r[4].([]byte); ok && len(data) != int(i%2900) {
+			t.Fatalf("data of row %d of %d bytes", i+1, len(data))
+		}
+	}
+	var order []string
+	for row := int64(1); row <= 9; row++ {
+		order = append(order, f.rows(schema, "events")[row][2].(string))
+	}
+	if fmt.Sprintf("%q", order) != `["a-1" "a2" "a3" "a\x00-1" "a\x002" "a\x003" "b-1" "b2" "b3"]` {
+		t.Fatalf("events in the order %q", order)
+	}
+
+	// a bucket can't have the name of a table or of its indexes
+	for _, name := range []string{"users", "users_by_name"} {
+		tx, _ := db.Begin(true)
+		tx.CreateBucket([]byte(name))
+		if err := tx.ExportSQLite(filepath.Join(t.TempDir(), "x.sqlite"), SQLiteOptions{}); !errors.Is(err, ErrSQLiteTable) {
+			t.Fatalf("export of the bucket %s: %v", name, err)
+		}
+		tx.Rollback()
+	}
+}
+
+func TestSQLiteVarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 16383, 16384, 1<<56 - 1, 1 << 56, math.MaxUint64} {
+		b := sqlitePutVarint(nil, v)
+		if got, n := sqliteVarint(b); got != v || n != len(b) || n > 9 {
+			t.Errorf("%d encoded in %d bytes, read %d of %d bytes", v, len(b), got, n)
+		}
+	}
+}
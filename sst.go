@@ -0,0 +1,515 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SST export: Tx.ExportSST writes the keys of a snapshot in order into
+// immutable sorted files, of the layout of the LevelDB tables, for other
+// systems to ingest without reading the database file. OpenSST reads them.
+//
+// A file is data blocks of the keys in order, then the Bloom filter of its
+// keys and the index block, with the last key of each data block and its
+// handle, then the footer. Integers are big-endian, varints unsigned.
+//
+// file layout
+// | data blocks... | filter | index block | footer |
+// block layout, the data compressed with DEFLATE or not, as told by its
+// type, the checksum is the CRC-32 of the data and the type
+// | data | type | crc32 |
+// |      | 1B   | 4B    |
+// data of a block, the key of an entry shares a prefix with the one
+// before, but at the restarts: the offsets of the entries stored whole,
+// every SST_RESTART_INTERVAL entries
+// | entries... | restarts... | nrestarts |
+// |            | 4B each     | 4B        |
+// entry layout
+// | shared | unshared | vlen   | key suffix | value |
+// | varint | varint   | varint | ...        | ...   |
+// handle layout, of a block without its type and checksum
+// | offset | size   |
+// | varint | varint |
+// filter layout, the probes of a key are the bits h, h+d, h+2d... modulo
+// the size of the bits, where h is the 32 bits FNV-1a of the key and d
+// is h rotated right by 17 bits
+// | bits... | nprobes |
+// |         | 1B      |
+// footer layout
+// | index offset | index size | filter offset | filter size | keys | version | magic |
+// | 8B           | 8B         | 8B            | 8B          | 8B   | 8B      | 8B    |
+
+const (
+	SST_MAGIC            = "SESST-01"
+	SST_FOOTER           = 7 * 8
+	SST_BLOCK_TRAILER    = 1 + 4
+	SST_RESTART_INTERVAL = 16
+	SST_BLOCK_SIZE       = 4 << 10  // bytes of the data of a block before it's cut
+	SST_FILE_SIZE        = 64 << 20 // bytes of a file before the next one
+	SST_BLOOM_BITS       = 10       // bits of the filter per key, 1% of false positives
+
+	SST_BLOCK_RAW     = 0
+	SST_BLOCK_DEFLATE = 1
+)
+
+var ErrBadSST = errors.New("bad SST file")
+
+// SSTOptions are the options of Tx.ExportSST, the zero values are the
+// defaults.
+type SSTOptions struct {
+	Bucket    [][]byte // path of the bucket exported, the names from the top, nil for the keys outside buckets
+	BlockSize int      // SST_BLOCK_SIZE if 0
+	FileSize  int64    // SST_FILE_SIZE if 0
+	BloomBits int      // SST_BLOOM_BITS if 0, no filter if negative
+}
+
+// ExportSST writes the keys of a bucket of the Tx into SST files in dir,
+// created if missing, and returns their paths: <version>-<n>.sst, the
+// version of the Tx in hex, the files in key order. Each file is cut once
+// it passes the file size, after a block. The keys are in the order of
+// the comparator of the DB, their expiry isn't kept. There's no file
+// without keys, and the files are removed if the export fails.
+func (tx *Tx) ExportSST(dir string, opts SSTOptions) (files []string, err error) {
+	if tx.done {
+		return nil, ErrTxClosed
+	}
+	var w *sstWriter
+	defer func() {
+		if w != nil {
+			w.fp.Close()
+		}
+		if err != nil {
+			for _, f := range files {
+				os.Remove(f)
+			}
+			files = nil
+		}
+	}()
+	defer catchTreeError(&err)
+	if opts.BlockSize == 0 {
+		opts.BlockSize = SST_BLOCK_SIZE
+	}
+	if opts.FileSize == 0 {
+		opts.FileSize = SST_FILE_SIZE
+	}
+	if opts.BloomBits == 0 {
+		opts.BloomBits = SST_BLOOM_BITS
+	}
+	c, err := tx.pathCursor(opts.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	for key, value := c.First(); key != nil; key, value = c.Next() {
+		if w == nil {
+			name := filepath.Join(dir, fmt.Sprintf("%016x-%04d.sst", tx.version, len(files)))
+			if w, err = newSSTWriter(name, opts); err != nil {
+				return files, err
+			}
+			files = append(files, name)
+		}
+		if err := w.add(key, value); err != nil {
+			return files, err
+		}
+		if w.offset >= opts.FileSize {
+			err, w = w.close(tx.version), nil
+			if err != nil {
+				return files, err
+			}
+		}
+	}
+	if err := c.Err(); err != nil {
+		return files, err
+	}
+	if w != nil {
+		err, w = w.close(tx.version), nil
+	}
+	return files, err
+}
+
+// a block being built
+type sstBlock struct {
+	buf      []byte
+	restarts []uint32
+	n        int // entries since the last restart
+	last     []byte
+}
+
+func (b *sstBlock) add(key, value []byte) {
+	if len(b.restarts) == 0 || b.n == SST_RESTART_INTERVAL {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.n = 0
+	}
+	shared := 0
+	if b.n > 0 {
+		for shared < len(key) && shared < len(b.last) && key[shared] == b.last[shared] {
+			shared++
+		}
+	}
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+	b.last = append(b.last[:0], key...)
+	b.n++
+}
+
+func (b *sstBlock) finish() []byte {
+	for _, r := range b.restarts {
+		b.buf = binary.BigEndian.AppendUint32(b.buf, r)
+	}
+	return binary.BigEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+}
+
+func (b *sstBlock) reset() {
+	b.buf, b.restarts, b.n = b.buf[:0], b.restarts[:0], 0
+}
+
+type sstWriter struct {
+	fp     *os.File
+	w      *bufio.Writer
+	opts   SSTOptions
+	offset int64
+	data   sstBlock
+	index  sstBlock
+	hashes []uint32 // of the keys, for the filter
+	keys   uint64
+	flate  *flate.Writer
+	packed bytes.Buffer
+}
+
+func newSSTWriter(path string, opts SSTOptions) (*sstWriter, error) {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &sstWriter{fp: fp, w: bufio.NewWriter(fp), opts: opts}
+	w.flate, _ = flate.NewWriter(&w.packed, flate.DefaultCompression)
+	return w, nil
+}
+
+func (w *sstWriter) add(key, value []byte) error {
+	w.data.add(key, value)
+	w.keys++
+	if w.opts.BloomBits > 0 {
+		w.hashes = append(w.hashes, sstHash(key))
+	}
+	if len(w.data.buf) >= w.opts.BlockSize {
+		return w.flushData()
+	}
+	return nil
+}
+
+// write the data block and its entry in the index
+func (w *sstWriter) flushData() error {
+	if len(w.data.buf) == 0 {
+		return nil
+	}
+	offset, size, err := w.writeBlock(w.data.finish(), true)
+	if err != nil {
+		return err
+	}
+	handle := binary.AppendUvarint(nil, uint64(offset))
+	w.index.add(w.data.last, binary.AppendUvarint(handle, uint64(size)))
+	w.data.reset()
+	return nil
+}
+
+// write a block, compressed if it saves an eighth of it at least
+func (w *sstWriter) writeBlock(data []byte, compress bool) (offset int64, size int, err error) {
+	kind := byte(SST_BLOCK_RAW)
+	if compress {
+		w.packed.Reset()
+		w.flate.Reset(&w.packed)
+		w.flate.Write(data)
+		if err := w.flate.Close(); err != nil {
+			return 0, 0, err
+		}
+		if w.packed.Len() < len(data)-len(data)/8 {
+			data, kind = w.packed.Bytes(), SST_BLOCK_DEFLATE
+		}
+	}
+	var trailer [SST_BLOCK_TRAILER]byte
+	trailer[0] = kind
+	crc := crc32.Update(crc32.ChecksumIEEE(data), crc32.IEEETable, trailer[:1])
+	binary.BigEndian.PutUint32(trailer[1:], crc)
+	offset = w.offset
+	if _, err := w.w.Write(data); err != nil {
+		return 0, 0, err
+	}
+	if _, err := w.w.Write(trailer[:]); err != nil {
+		return 0, 0, err
+	}
+	w.offset += int64(len(data) + SST_BLOCK_TRAILER)
+	return offset, len(data), nil
+}
+
+// write the filter, the index and the footer, and fsync the file
+func (w *sstWriter) close(version uint64) error {
+	defer w.fp.Close()
+	if err := w.flushData(); err != nil {
+		return err
+	}
+	footer := make([]byte, 0, SST_FOOTER)
+	var filterOffset int64
+	var filter []byte
+	if w.opts.BloomBits > 0 {
+		filter = sstFilter(w.hashes, w.opts.BloomBits)
+		var err error
+		if filterOffset, _, err = w.writeBlock(filter, false); err != nil {
+			return err
+		}
+	}
+	indexOffset, indexSize, err := w.writeBlock(w.index.finish(), true)
+	if err != nil {
+		return err
+	}
+	for _, v := range []uint64{uint64(indexOffset), uint64(indexSize), uint64(filterOffset), uint64(len(filter)), w.keys, version} {
+		footer = binary.BigEndian.AppendUint64(footer, v)
+	}
+	footer = append(footer, SST_MAGIC...)
+	if _, err := w.w.Write(footer); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.fp.Sync()
+}
+
+func sstHash(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+// the Bloom filter of the hashes of the keys
+func sstFilter(hashes []uint32, bitsPerKey int) []byte {
+	probes := int(float64(bitsPerKey) * math.Ln2)
+	probes = max(1, min(probes, 30))
+	nbits := max(64, len(hashes)*bitsPerKey)
+	filter := make([]byte, (nbits+7)/8+1)
+	nbits = (len(filter) - 1) * 8
+	for _, h := range hashes {
+		d := h>>17 | h<<15
+		for i := 0; i < probes; i++ {
+			bit := h % uint32(nbits)
+			filter[bit/8] |= 1 << (bit % 8)
+			h += d
+		}
+	}
+	filter[len(filter)-1] = byte(probes)
+	return filter
+}
+
+// SSTReader reads an SST file of Tx.ExportSST. Get only finds the keys of
+// a DB with the default comparator, ForEach reads any.
+type SSTReader struct {
+	fp      *os.File
+	Keys    uint64 // in the file
+	Version uint64 // the commit exported
+	index   []sstIndexEntry
+	filter  []byte
+}
+
+type sstIndexEntry struct {
+	last   []byte // key of the block
+	offset int64
+	size   int
+}
+
+// OpenSST opens an SST file and reads its index and filter.
+func OpenSST(path string) (*SSTReader, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &SSTReader{fp: fp}
+	if err := r.open(); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *SSTReader) open() error {
+	fi, err := r.fp.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < SST_FOOTER {
+		return fmt.Errorf("%w: %d bytes", ErrBadSST, fi.Size())
+	}
+	footer := make([]byte, SST_FOOTER)
+	if _, err := r.fp.ReadAt(footer, fi.Size()-SST_FOOTER); err != nil {
+		return err
+	}
+	if string(footer[48:]) != SST_MAGIC {
+		return fmt.Errorf("%w: bad magic", ErrBadSST)
+	}
+	field := func(i int) uint64 { return binary.BigEndian.Uint64(footer[i*8:]) }
+	r.Keys, r.Version = field(4), field(5)
+	if field(3) > 0 {
+		if r.filter, err = r.block(int64(field(2)), int(field(3))); err != nil {
+			return err
+		}
+	}
+	index, err := r.block(int64(field(0)), int(field(1)))
+	if err != nil {
+		return err
+	}
+	return sstEntries(index, func(key, value []byte) error {
+		offset, n := binary.Uvarint(value)
+		size, m := binary.Uvarint(value[max(n, 0):])
+		if n <= 0 || m <= 0 {
+			return fmt.Errorf("%w: bad block handle", ErrBadSST)
+		}
+		r.index = append(r.index, sstIndexEntry{last: bytes.Clone(key), offset: int64(offset), size: int(size)})
+		return nil
+	})
+}
+
+// Close closes the file.
+func (r *SSTReader) Close() error {
+	return r.fp.Close()
+}
+
+// the data of a block, checked and decompressed
+func (r *SSTReader) block(offset int64, size int) ([]byte, error) {
+	if size < 0 || size > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: block of %d bytes", ErrBadSST, size)
+	}
+	buf := make([]byte, size+SST_BLOCK_TRAILER)
+	if _, err := r.fp.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("%w: block at %d: %v", ErrBadSST, offset, err)
+	}
+	data, kind := buf[:size], buf[size]
+	if crc32.ChecksumIEEE(buf[:size+1]) != binary.BigEndian.Uint32(buf[size+1:]) {
+		return nil, fmt.Errorf("%w: bad checksum of the block at %d", ErrBadSST, offset)
+	}
+	switch kind {
+	case SST_BLOCK_RAW:
+		return data, nil
+	case SST_BLOCK_DEFLATE:
+		data, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: block at %d: %v", ErrBadSST, offset, err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("%w: block of type %d", ErrBadSST, kind)
+	}
+}
+
+// call fn for the entries of a block in order
+func sstEntries(data []byte, fn func(key, value []byte) error) error {
+	if len(data) < 4 {
+		return fmt.Errorf("%w: block of %d bytes", ErrBadSST, len(data))
+	}
+	nrestarts := int(binary.BigEndian.Uint32(data[len(data)-4:]))
+	end := len(data) - 4 - 4*nrestarts
+	if nrestarts < 1 || end < 0 {
+		return fmt.Errorf("%w: block with %d restarts", ErrBadSST, nrestarts)
+	}
+	var key []byte
+	for pos := 0; pos < end; {
+		var fields [3]uint64
+		for i := range fields {
+			v, n := binary.Uvarint(data[pos:end])
+			if n <= 0 {
+				return fmt.Errorf("%w: bad entry", ErrBadSST)
+			}
+			fields[i], pos = v, pos+n
+		}
+		shared, unshared, vlen := fields[0], fields[1], fields[2]
+		if shared > uint64(len(key)) || unshared+vlen > uint64(end-pos) {
+			return fmt.Errorf("%w: bad entry", ErrBadSST)
+		}
+		key = append(key[:shared], data[pos:pos+int(unshared)]...)
+		pos += int(unshared)
+		value := data[pos : pos+int(vlen)]
+		pos += int(vlen)
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MayContain tells if the key may be in the file from the filter, true
+// without one.
+func (r *SSTReader) MayContain(key []byte) bool {
+	if len(r.filter) < 2 {
+		return true
+	}
+	nbits := uint32(len(r.filter)-1) * 8
+	probes := int(r.filter[len(r.filter)-1])
+	h := sstHash(key)
+	d := h>>17 | h<<15
+	for i := 0; i < probes; i++ {
+		bit := h % nbits
+		if r.filter[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h += d
+	}
+	return true
+}
+
+var errSSTFound = errors.New("found")
+
+// Get returns the value of a key, the keys in bytes.Compare order.
+func (r *SSTReader) Get(key []byte) ([]byte, bool, error) {
+	if !r.MayContain(key) {
+		return nil, false, nil
+	}
+	i := sort.Search(len(r.index), func(i int) bool { return bytes.Compare(r.index[i].last, key) >= 0 })
+	if i == len(r.index) {
+		return nil, false, nil
+	}
+	data, err := r.block(r.index[i].offset, r.index[i].size)
+	if err != nil {
+		return nil, false, err
+	}
+	var value []byte
+	err = sstEntries(data, func(k, v []byte) error {
+		if bytes.Equal(k, key) {
+			value = bytes.Clone(v)
+			return errSSTFound
+		}
+		return nil
+	})
+	if err == errSSTFound {
+		return value, true, nil
+	}
+	return nil, false, err
+}
+
+// ForEach calls fn for the keys in order, the slices are valid until it
+// returns. An error of fn is returned.
+func (r *SSTReader) ForEach(fn func(key, value []byte) error) error {
+	for _, e := range r.index {
+		data, err := r.block(e.offset, e.size)
+		if err != nil {
+			return err
+		}
+		if err := sstEntries(data, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sstValueTest(i int) []byte {
+	return bytes.Repeat([]byte{byte(i)}, i%200)
+}
+
+func TestExportSST(t *testing.T) {
+	const keys = 50000
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < keys; i++ {
+		tx.Set([]byte(fmt.Sprintf("key%07d", i)), sstValueTest(i))
+	}
+	b, _ := tx.CreateBucket([]byte("b"))
+	b.Set([]byte("outside"), []byte("b"))
+	n, _ := b.CreateBucket([]byte("n"))
+	n.Set([]byte("x"), []byte("y"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the export reads the snapshot of the Tx
+	tx, _ = db.Begin(false)
+	defer tx.Rollback()
+	mustSet(t, db, "key9999999", "after the snapshot")
+	dir := t.TempDir()
+	files, err := tx.ExportSST(dir, SSTOptions{FileSize: 100 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 {
+		t.Fatalf("%d files of 100KB", len(files))
+	}
+	// the files are in key order, the keys outside buckets only
+	var prev []byte
+	total := 0
+	for i, f := range files {
+		if want := filepath.Join(dir, fmt.Sprintf("%016x-%04d.sst", tx.version, i)); f != want {
+			t.Fatalf("file %s, want %s", f, want)
+		}
+		r, err := OpenSST(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inFile := 0
+		err = r.ForEach(func(k, v []byte) error {
+			if bytes.Compare(prev, k) >= 0 {
+				return fmt.Errorf("%q after %q", k, prev)
+			}
+			prev = append(prev[:0], k...)
+			var i int
+			if _, err := fmt.Sscanf(string(k), "key%07d", &i); err != nil || !bytes.Equal(v, sstValueTest(i)) {
+				return fmt.Errorf("%q = %q", k, v)
+			}
+			inFile++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Keys != uint64(inFile) || r.Version != tx.version {
+			t.Fatalf("footer of %d keys at %d, %d read at %d", r.Keys, r.Version, inFile, tx.version)
+		}
+		total += inFile
+		r.Close()
+	}
+	if total != keys {
+		t.Fatalf("%d keys exported", total)
+	}
+
+	// Get finds the keys of a file, the filter skips most of the others
+	r, err := OpenSST(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	found, falsePositives := 0, 0
+	for i := 0; i < keys; i++ {
+		k := []byte(fmt.Sprintf("key%07d", i))
+		v, ok, err := r.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case ok:
+			if !bytes.Equal(v, sstValueTest(i)) {
+				t.Fatalf("%s = %q", k, v)
+			}
+			found++
+		case r.MayContain(k):
+			falsePositives++
+		}
+	}
+	if uint64(found) != r.Keys {
+		t.Fatalf("found %d of the %d keys of the file", found, r.Keys)
+	}
+	if rate := float64(falsePositives) / float64(keys-found); rate > 0.03 {
+		t.Fatalf("%d false positives, %.3f", falsePositives, rate)
+	}
+	if _, ok, err := r.Get([]byte("zzz")); ok || err != nil {
+		t.Fatalf("key after the file: %v %v", ok, err)
+	}
+
+	// a nested bucket without a filter
+	files, err = tx.ExportSST(filepath.Join(dir, "nested"), SSTOptions{Bucket: [][]byte{[]byte("b"), []byte("n")}, BloomBits: -1})
+	if err != nil || len(files) != 1 {
+		t.Fatalf("%v: %v", files, err)
+	}
+	nr, err := OpenSST(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nr.Close()
+	if v, ok, err := nr.Get([]byte("x")); string(v) != "y" || !ok || err != nil {
+		t.Fatalf("x = %q %v %v", v, ok, err)
+	}
+	if nr.filter != nil || !nr.MayContain([]byte("absent")) {
+		t.Fatal("filter of an export without one")
+	}
+
+	if _, err := tx.ExportSST(filepath.Join(dir, "missing"), SSTOptions{Bucket: [][]byte{[]byte("nope")}}); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("export of a missing bucket: %v", err)
+	}
+	// a missing nested bucket
+	if files, err := tx.ExportSST(filepath.Join(dir, "empty"), SSTOptions{Bucket: [][]byte{[]byte("b"), []byte("n"), []byte("none")}}); err == nil || files != nil {
+		t.Fatalf("export of a missing nested bucket: %v %v", files, err)
+	}
+	tx.Rollback()
+	if _, err := tx.ExportSST(dir, SSTOptions{}); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("export of a closed Tx: %v", err)
+	}
+}
+
+func TestExportSSTEmpty(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	tx.CreateBucket([]byte("empty"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *Tx) error {
+		files, err := tx.ExportSST(t.TempDir(), SSTOptions{Bucket: [][]byte{[]byte("empty")}})
+		if err != nil || len(files) != 0 {
+			t.Fatalf("files %v of an empty bucket: %v", files, err)
+		}
+		return nil
+	})
+}
+
+func TestOpenSSTBad(t *testing.T) {
+	db := openTest(t)
+	for i := 0; i < 1000; i++ {
+		mustSet(t, db, fmt.Sprintf("k%04d", i), strings.Repeat("v", 100))
+	}
+	var files []string
+	dir := t.TempDir()
+	db.View(func(tx *Tx) (err error) {
+		files, err = tx.ExportSST(dir, SSTOptions{})
+		return err
+	})
+	good, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, corrupt := range map[string]func([]byte) []byte{
+		"short":  func(b []byte) []byte { return b[:SST_FOOTER-1] },
+		"magic":  func(b []byte) []byte { b[len(b)-1] ^= 1; return b },
+		"index":  func(b []byte) []byte { b[len(b)-SST_FOOTER-1] ^= 1; return b },
+		"offset": func(b []byte) []byte { b[len(b)-SST_FOOTER] = 0x7f; return b },
+	} {
+		path := filepath.Join(dir, name+".sst")
+		if err := os.WriteFile(path, corrupt(bytes.Clone(good)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if r, err := OpenSST(path); !errors.Is(err, ErrBadSST) {
+			if r != nil {
+				r.Close()
+			}
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	// a data block corrupt is found by the reads
+	bad := bytes.Clone(good)
+	bad[10] ^= 1
+	path := filepath.Join(dir, "data.sst")
+	os.WriteFile(path, bad, 0644)
+	r, err := OpenSST(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, _, err := r.Get([]byte("k0000")); !errors.Is(err, ErrBadSST) {
+		t.Fatalf("get from a corrupt block: %v", err)
+	}
+	if err := r.ForEach(func(k, v []byte) error { return nil }); !errors.Is(err, ErrBadSST) {
+		t.Fatalf("scan of a corrupt block: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Prepared statements: PrepareSQL parses a statement once, run then with
+// the values of its parameters ?, never parsed as SQL. The access paths
+// chosen for the scans of a run are kept for the next ones with values of
+// the same types, NULL and NaN their own, while the schemas of the tables
+// are the same: the bounds of the WHERE, and so the paths, are the same.
+
+const PREPARED_PLANS = 16 // access paths kept per statement, by the types of the values
+
+// PreparedStmt is a statement of PrepareSQL, safe for concurrent use.
+type PreparedStmt struct {
+	db     *DB
+	stmt   Statement
+	params int
+	mu     sync.Mutex
+	plans  map[string][]cachedChoice // by the types of the values
+}
+
+// the access path of a scan, for the schema of its table
+type cachedChoice struct {
+	schema Schema
+	planChoice
+}
+
+// the access paths of a run of a PreparedStmt, those of a run before
+// replayed while they're of the same tables
+type planRecorder struct {
+	cached []cachedChoice
+	used   []cachedChoice
+	fresh  bool // a path was chosen again
+}
+
+// PrepareSQL parses a statement of ParseSQL for Exec and ExecTx.
+func (db *DB) PrepareSQL(query string) (*PreparedStmt, error) {
+	stmt, params, err := parseSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	return &PreparedStmt{db: db, stmt: stmt, params: params}, nil
+}
+
+// Statement returns the statement parsed.
+func (s *PreparedStmt) Statement() Statement {
+	return s.stmt
+}
+
+// NumParams returns the number of the parameters of the statement.
+func (s *PreparedStmt) NumParams() int {
+	return s.params
+}
+
+// Exec runs the statement in a Tx of its own like DB.Exec, with a value
+// for each parameter.
+func (s *PreparedStmt) Exec(args ...any) (*Result, error) {
+	args, plans, err := s.bind(args)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.db.execStatement(s.stmt, args, plans)
+	if err == nil {
+		s.keep(args, plans)
+	}
+	return res, err
+}
+
+// ExecTx runs the statement in a Tx like Tx.ExecStatement, with a value
+// for each parameter.
+func (s *PreparedStmt) ExecTx(tx *Tx, args ...any) (*Result, error) {
+	args, plans, err := s.bind(args)
+	if err != nil {
+		return nil, err
+	}
+	outer := tx.sqlPlans
+	tx.sqlPlans = plans
+	res, err := tx.ExecStatement(s.stmt, args...)
+	tx.sqlPlans = outer
+	if err == nil {
+		s.keep(args, plans)
+	}
+	return res, err
+}
+
+// the values of the parameters and the access paths of their types
+func (s *PreparedStmt) bind(args []any) ([]any, *planRecorder, error) {
+	if len(args) != s.params {
+		return nil, nil, fmt.Errorf("%w: %d values for %d parameters", ErrSQL, len(args), s.params)
+	}
+	args, err := bindArgs(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return args, &planRecorder{cached: s.plans[argTypes(args)]}, nil
+}
+
+// keep the access paths of a run if chosen again
+func (s *PreparedStmt) keep(args []any, plans *planRecorder) {
+	if !plans.fresh {
+		return
+	}
+	key := argTypes(args)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.plans[key]; !ok && len(s.plans) >= PREPARED_PLANS {
+		return
+	}
+	if s.plans == nil {
+		s.plans = map[string][]cachedChoice{}
+	}
+	s.plans[key] = plans.used
+}
+
+// the types of the values, the key of their access paths
+func argTypes(args []any) string {
+	var b strings.Builder
+	for _, v := range args {
+		if f, ok := v.(float64); ok && math.IsNaN(f) {
+			b.WriteString("NaN,")
+			continue
+		}
+		fmt.Fprintf(&b, "%T,", v)
+	}
+	return b.String()
+}
+
+// the path of the next scan of the run before, false if there's none or
+// its table changed
+func (r *planRecorder) replay(t *Table) (planChoice, bool) {
+	if r == nil {
+		return planChoice{}, false
+	}
+	n := len(r.used)
+	if !r.fresh && n < len(r.cached) && reflect.DeepEqual(r.cached[n].schema, t.schema) {
+		return r.cached[n].planChoice, true
+	}
+	r.fresh = true
+	return planChoice{}, false
+}
+
+func (r *planRecorder) record(t *Table, c planChoice) {
+	if r != nil {
+		r.used = append(r.used, cachedChoice{schema: t.schema, planChoice: c})
+	}
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPreparedStmt(t *testing.T) {
+	db := itemsTest(t)
+	ins, err := db.PrepareSQL("INSERT INTO items VALUES (?, ?, ?, ?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ins.Statement().(*InsertStmt); !ok || ins.NumParams() != 4 {
+		t.Fatalf("statement %T of %d parameters", ins.Statement(), ins.NumParams())
+	}
+	// the Go integers and float32 are bound as int64 and float64
+	for i, args := range [][]any{
+		{uint8(100), "m", float32(0.5), int16(3)},
+		{int32(101), "m", 1.5, uint(4)},
+		{uint64(102), "m", nil, nil},
+	} {
+		if res, err := ins.Exec(args...); err != nil || res.RowsAffected != 1 {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	if got := selectTest(t, db, "SELECT * FROM items WHERE name = 'm'"); got != "[[100 m 0.5 3] [101 m 1.5 4] [102 m <nil> <nil>]]" {
+		t.Fatalf("rows %s", got)
+	}
+	for _, args := range [][]any{
+		{1},
+		{200, "m", 1.0, 1, 5},
+		{200, struct{}{}, 1.0, 1},
+		{uint64(math.MaxUint64), "m", 1.0, 1},
+	} {
+		if _, err := ins.Exec(args...); !errors.Is(err, ErrSQL) {
+			t.Errorf("insert of %v: %v", args, err)
+		}
+	}
+	if _, err := db.PrepareSQL("SELECT FROM"); !errors.Is(err, ErrSQLSyntax) {
+		t.Fatalf("prepare of bad SQL: %v", err)
+	}
+
+	// the access path of a run is kept for the values of the same types
+	sel, _ := db.PrepareSQL("SELECT id FROM items WHERE name = ? AND qty < ? ORDER BY id DESC LIMIT 2")
+	for _, c := range []struct {
+		name string
+		rows string
+	}{{"n1", "[[19] [18]]"}, {"n2", "[[27] [25]]"}, {"n9", "[[99] [97]]"}} {
+		res, err := sel.Exec(c.name, 2)
+		if err != nil || fmt.Sprint(res.Rows) != c.rows {
+			t.Fatalf("select of %s: %v %v", c.name, res, err)
+		}
+	}
+	if len(sel.plans) != 1 || len(sel.plans["string,int64,"]) != 1 {
+		t.Fatalf("paths kept %v", sel.plans)
+	}
+	if p := sel.plans["string,int64,"][0]; len(p.schema.Indexes) != 1 {
+		t.Fatalf("path kept for the schema %+v", p.schema)
+	}
+	if res, err := sel.Exec(nil, 2); err != nil || len(res.Rows) != 0 {
+		t.Fatalf("select of NULL: %v %v", res, err)
+	}
+	if res, err := sel.Exec("n1", math.NaN()); err != nil || len(res.Rows) != 0 || len(sel.plans) != 3 {
+		t.Fatalf("select of NaN: %v %v, %d paths kept", res, err, len(sel.plans))
+	}
+
+	// chosen again when the schema of the table changed
+	tx, _ := db.Begin(true)
+	items, _ := tx.Table("items")
+	if err := items.DropIndex("by_name"); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	res, err := sel.ExecTx(tx, "n1", 2)
+	if err != nil || fmt.Sprint(res.Rows) != "[[19] [18]]" {
+		tx.Rollback()
+		t.Fatalf("select after dropping the index: %v %v", res, err)
+	}
+	if tx.sqlPlans != nil {
+		tx.Rollback()
+		t.Fatal("paths of the statement left in the Tx")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if p := sel.plans["string,int64,"][0]; len(p.schema.Indexes) != 0 {
+		t.Fatalf("path kept for the schema %+v", p.schema)
+	}
+	explain, _ := db.PrepareSQL("EXPLAIN SELECT id, price FROM items WHERE name = ?")
+	plan := func() string {
+		t.Helper()
+		res, err := explain.Exec("n1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(res.Rows)
+	}
+	if p := plan(); !strings.Contains(p, "full scan") {
+		t.Fatalf("plan %s without the index", p)
+	}
+	execTest(t, db, "CREATE INDEX by_name ON items (name)")
+	if p := plan(); !strings.Contains(p, "index scan by_name") {
+		t.Fatalf("plan %s with the index", p)
+	}
+
+	// no more than PREPARED_PLANS types of values
+	any2, _ := db.PrepareSQL("SELECT id FROM items WHERE id = 1 AND (? IS NULL OR ? IS NULL)")
+	values := []any{1, 1.5, "x", []byte("x"), true, nil, math.NaN()}
+	for _, a := range values {
+		for _, b := range values {
+			if _, err := any2.Exec(a, b); err != nil {
+				t.Fatalf("select of %v, %v: %v", a, b, err)
+			}
+		}
+	}
+	if len(any2.plans) != PREPARED_PLANS {
+		t.Fatalf("%d paths kept", len(any2.plans))
+	}
+}
+
+func TestPreparedStmtConcurrent(t *testing.T) {
+	db := itemsTest(t)
+	sel, _ := db.PrepareSQL("SELECT COUNT(*) FROM items WHERE name = ?")
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				res, err := sel.Exec(fmt.Sprint("n", (g+i)%10))
+				if err == nil && fmt.Sprint(res.Rows) != "[[10]]" {
+					err = fmt.Errorf("count %v", res.Rows)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,77 @@
+package storage
+
+import "time"
+
+const DEFAULT_SYNC_INTERVAL = 100 * time.Millisecond
+
+// SyncPolicy is when commits are made durable, trading durability for
+// throughput. Whatever the policy, a crash never corrupts the database:
+// the commits lost are the latest ones, the others are recovered in order.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs the WAL before Commit returns, concurrent commits
+	// share an fsync. No commit returned is lost.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs the WAL every WithSyncInterval in the background,
+	// Commit returns before. The commits of the last interval can be lost.
+	SyncInterval
+	// SyncNever only fsyncs the WAL on Checkpoint and Close, every commit
+	// since the last checkpoint can be lost. Prepare still fsyncs.
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	default:
+		return "unknown"
+	}
+}
+
+// start the background fsync of SyncInterval on the first commit
+func (db *DB) startSyncer() {
+	db.syncer.once.Do(func() {
+		if db.opts.syncPolicy != SyncInterval {
+			return
+		}
+		interval := db.opts.syncInterval
+		if interval <= 0 {
+			interval = DEFAULT_SYNC_INTERVAL
+		}
+		db.syncer.stop = make(chan struct{})
+		db.syncer.done = make(chan struct{})
+		go db.runSyncer(interval)
+	})
+}
+
+func (db *DB) runSyncer(interval time.Duration) {
+	defer close(db.syncer.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.syncer.stop:
+			return
+		case <-ticker.C:
+			db.sync.mu.Lock()
+			appended := db.sync.appended
+			db.sync.mu.Unlock()
+			// an error poisons the database, the next commit reports it
+			db.waitDurable(appended)
+		}
+	}
+}
+
+func (db *DB) stopSyncer() {
+	db.syncer.once.Do(func() {})
+	if db.syncer.stop != nil {
+		close(db.syncer.stop)
+		<-db.syncer.done
+	}
+}
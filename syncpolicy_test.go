@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSyncPolicy(t *testing.T) {
+	const commits = 100
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		t.Run(policy.String(), func(t *testing.T) {
+			const interval = 10 * time.Millisecond
+			db := openTest(t, WithSyncPolicy(policy), WithSyncInterval(interval))
+			for i := 0; i < commits; i++ {
+				mustSet(t, db, fmt.Sprint(i), "v")
+			}
+			// visible right away whatever the policy
+			wantValue(t, db, fmt.Sprint(commits-1), []byte("v"))
+			s := db.Stats()
+			if s.SyncPolicy != policy {
+				t.Fatalf("stats policy %v", s.SyncPolicy)
+			}
+			switch policy {
+			case SyncAlways:
+				if s.WALSyncs != commits || s.Unsynced != 0 {
+					t.Fatalf("%d fsyncs, %d commits unsynced", s.WALSyncs, s.Unsynced)
+				}
+			case SyncInterval:
+				time.Sleep(5 * interval)
+				if s = db.Stats(); s.WALSyncs == 0 || s.WALSyncs >= commits || s.Unsynced != 0 {
+					t.Fatalf("%d fsyncs, %d commits unsynced after the interval", s.WALSyncs, s.Unsynced)
+				}
+			case SyncNever:
+				time.Sleep(20 * time.Millisecond)
+				if s = db.Stats(); s.WALSyncs != 0 || s.Unsynced != commits {
+					t.Fatalf("%d fsyncs, %d commits unsynced", s.WALSyncs, s.Unsynced)
+				}
+				if err := db.Checkpoint(); err != nil {
+					t.Fatal(err)
+				}
+				if s = db.Stats(); s.Unsynced != 0 {
+					t.Fatalf("%d commits unsynced after the checkpoint", s.Unsynced)
+				}
+			}
+			// the commits lost by a crash are the latest, none here since
+			// the OS kept the writes
+			crashTest(db)
+			db = openTestPath(t, db.Path)
+			for i := 0; i < commits; i++ {
+				wantValue(t, db, fmt.Sprint(i), []byte("v"))
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// TLS: the servers of the DB take a listener, they're served over TLS on
+// that of tls.NewListener with the ServerConfig of a TLSCertificate, a
+// gRPC server of RegisterKV with credentials.NewTLS of it. The followers
+// connect over TLS with WithReplicationTLS. The certificate is reloaded
+// without a restart, the connections open keep the one they began with.
+
+// TLSCertificate is a certificate and its key loaded from PEM files, and
+// the CAs of the client certificates if they're required, until Reload.
+type TLSCertificate struct {
+	certFile, keyFile, clientCAFile string
+	cert                            atomic.Pointer[tls.Certificate]
+	clientCAs                       atomic.Pointer[x509.CertPool] // nil if not required
+}
+
+// LoadTLSCertificate loads the certificate and key of PEM files. With a
+// clientCAFile, the servers require the clients to present a certificate
+// signed by one of its CAs.
+func LoadTLSCertificate(certFile, keyFile, clientCAFile string) (*TLSCertificate, error) {
+	c := &TLSCertificate{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the files again, the certificate and CAs stay those loaded
+// before if they can't be read.
+func (c *TLSCertificate) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if c.clientCAFile != "" {
+		if pool, err = loadCAs(c.clientCAFile); err != nil {
+			return err
+		}
+	}
+	c.cert.Store(&cert)
+	c.clientCAs.Store(pool)
+	return nil
+}
+
+// ServerConfig is the configuration of the servers, each handshake with
+// the certificate last loaded.
+func (c *TLSCertificate) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*c.cert.Load()}}
+			if pool := c.clientCAs.Load(); pool != nil {
+				cfg.ClientCAs, cfg.ClientAuth = pool, tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// TLSClientConfig is the configuration of the clients of a server whose
+// certificate is signed by a CA of the PEM file caFile, or of the system
+// if empty, presenting cert if not nil.
+func TLSClientConfig(caFile string, cert *TLSCertificate) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCAs(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if cert != nil {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.cert.Load(), nil
+		}
+	}
+	return cfg, nil
+}
+
+func loadCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("tls CAs: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("tls CAs: no certificate in %s", path)
+	}
+	return pool, nil
+}
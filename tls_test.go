@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a certificate for the loopback signed by ca, or a CA if nil, written to
+// dir/name.pem and its key to dir/name.key
+type certTest struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCertTest(t *testing.T, dir, name string, ca *certTest) *certTest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  ca == nil,
+		BasicConstraintsValid: true,
+	}
+	parent, signer := tmpl, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return &certTest{cert, key}
+}
+
+// accept TLS connections on the loopback, writing "ok" to each, until
+// the test is over
+func serveTLSTest(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	l = tls.NewListener(l, cfg)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write([]byte("ok"))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// the serial of the certificate of the server at addr
+func dialTLSTest(addr string, cfg *tls.Config) (*big.Int, error) {
+	c, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	// a TLS 1.3 server refuses a certificate after the handshake, on the
+	// first read
+	var buf [2]byte
+	if _, err := c.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	return c.ConnectionState().PeerCertificates[0].SerialNumber, nil
+}
+
+func TestTLSCertificate(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+	ca := newCertTest(t, dir, "ca", nil)
+	server := newCertTest(t, dir, "server", ca)
+	newCertTest(t, dir, "client", ca)
+	newCertTest(t, dir, "other", newCertTest(t, dir, "other-ca", nil))
+
+	cert, err := LoadTLSCertificate(file("server.pem"), file("server.key"), file("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLSTest(t, cert.ServerConfig())
+	client, err := LoadTLSCertificate(file("client.pem"), file("client.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := TLSClientConfig(file("ca.pem"), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial, err := dialTLSTest(addr, cfg); err != nil || serial.Cmp(server.cert.SerialNumber) != 0 {
+		t.Fatalf("server certificate %v: %v", serial, err)
+	}
+	// the client certificates are required, signed by the CAs
+	noCert, _ := TLSClientConfig(file("ca.pem"), nil)
+	other, _ := LoadTLSCertificate(file("other.pem"), file("other.key"), "")
+	otherCert, _ := TLSClientConfig(file("ca.pem"), other)
+	for name, cfg := range map[string]*tls.Config{"no certificate": noCert, "another CA": otherCert} {
+		if _, err := dialTLSTest(addr, cfg); err == nil {
+			t.Errorf("connection with %s", name)
+		}
+	}
+	// the server is checked by the CAs of the client
+	otherCAs, _ := TLSClientConfig(file("other-ca.pem"), client)
+	if _, err := dialTLSTest(addr, otherCAs); err == nil {
+		t.Error("server of another CA accepted")
+	}
+
+	// a reload serves the new certificate to the connections to come, a
+	// failed one keeps the certificate before
+	renewed := newCertTest(t, dir, "server", ca)
+	if err := cert.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if serial, err := dialTLSTest(addr, cfg); err != nil || serial.Cmp(renewed.cert.SerialNumber) != 0 {
+		t.Fatalf("server certificate %v after the reload: %v", serial, err)
+	}
+	os.WriteFile(file("server.pem"), []byte("not a certificate"), 0o600)
+	if err := cert.Reload(); err == nil {
+		t.Fatal("reload of a bad certificate")
+	}
+	if serial, err := dialTLSTest(addr, cfg); err != nil || serial.Cmp(renewed.cert.SerialNumber) != 0 {
+		t.Fatalf("server certificate %v after a failed reload: %v", serial, err)
+	}
+
+	// without client CAs, any client connects
+	open, err := LoadTLSCertificate(file("other.pem"), file("other.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	anyCA, _ := TLSClientConfig(file("other-ca.pem"), nil)
+	if _, err := dialTLSTest(serveTLSTest(t, open.ServerConfig()), anyCA); err != nil {
+		t.Fatalf("connection without a client certificate: %v", err)
+	}
+}
+
+func TestTLSFilesBad(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+	newCertTest(t, dir, "server", nil)
+	os.WriteFile(file("empty.pem"), nil, 0o600)
+	load := func(cert, clientCAs string) error {
+		_, err := LoadTLSCertificate(file(cert), file("server.key"), clientCAs)
+		return err
+	}
+	_, clientErr := TLSClientConfig(file("empty.pem"), nil)
+	for name, err := range map[string]error{
+		"missing certificate": load("missing.pem", ""),
+		"missing client CAs":  load("server.pem", file("missing.pem")),
+		"empty client CAs":    load("server.pem", file("empty.pem")),
+		"empty CAs":           clientErr,
+	} {
+		if err == nil || !strings.Contains(err.Error(), "tls") {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+// the followers of WithReplicationTLS, with a certificate of the CAs only
+func TestReplicationTLS(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+	ca := newCertTest(t, dir, "ca", nil)
+	newCertTest(t, dir, "server", ca)
+	newCertTest(t, dir, "client", ca)
+	cert, err := LoadTLSCertificate(file("server.pem"), file("server.key"), file("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := openTest(t, WithWALArchiveSize(1<<20))
+	for i := 0; i < 100; i++ {
+		writeReplicated(t, primary, i)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		primary.ServeReplication(tls.NewListener(l, cert.ServerConfig()))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	addr := l.Addr().String()
+
+	client, _ := LoadTLSCertificate(file("client.pem"), file("client.key"), "")
+	cfg, err := TLSClientConfig(file("ca.pem"), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower := openTest(t, WithReplicationTLS(cfg))
+	startFollow(t, follower, addr)
+	writeReplicated(t, primary, 100)
+	waitFollower(t, primary, follower)
+	wantSameDB(t, primary, follower)
+
+	noCert, _ := TLSClientConfig(file("ca.pem"), nil)
+	for name, opts := range map[string][]Option{"plaintext": nil, "no certificate": {WithReplicationTLS(noCert)}} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if _, err := openTest(t, opts...).BackupFrom(ctx, addr); err == nil {
+			t.Errorf("backup over a %s connection", name)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// PageSource is where a page read by a traced operation came from.
+type PageSource int
+
+const (
+	PageFromTx    PageSource = iota // written by the Tx itself
+	PageFromCache                   // a cache hit
+	PageFromFile                    // a cache miss, read from the file
+)
+
+func (s PageSource) String() string {
+	switch s {
+	case PageFromTx:
+		return "tx"
+	case PageFromCache:
+		return "cache"
+	case PageFromFile:
+		return "file"
+	default:
+		return "unknown"
+	}
+}
+
+// PageAccess is a page read or written by a traced operation. The pages
+// written are the new pages of the Tx, on the file at the next checkpoint.
+type PageAccess struct {
+	Page   uint64
+	Write  bool
+	Source PageSource // of a read
+}
+
+// TraceOp is an operation of a Tx and the pages it went through, in order.
+// A scan is a single op from the Seek, First or Last of a cursor to its
+// next repositioning.
+type TraceOp struct {
+	Op    string // get, set, del, merge, increment or scan
+	Key   []byte // the key, or where the scan started
+	Pages []PageAccess
+}
+
+// OpTrace records the operations of the transactions begun with a context
+// from WithOpTrace. It may be shared by transactions on several goroutines,
+// their ops interleave then.
+type OpTrace struct {
+	mu  sync.Mutex
+	ops []TraceOp
+}
+
+type opTraceKey struct{}
+
+// WithOpTrace returns a context tracing the transactions begun with it in t,
+// see BeginContext. Transactions without one pay a single check per page.
+func WithOpTrace(ctx context.Context, t *OpTrace) context.Context {
+	return context.WithValue(ctx, opTraceKey{}, t)
+}
+
+func opTraceFrom(ctx context.Context) *OpTrace {
+	t, _ := ctx.Value(opTraceKey{}).(*OpTrace)
+	return t
+}
+
+// Ops returns the operations traced so far.
+func (t *OpTrace) Ops() []TraceOp {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ops := make([]TraceOp, len(t.ops))
+	for i, op := range t.ops {
+		op.Pages = append([]PageAccess(nil), op.Pages...)
+		ops[i] = op
+	}
+	return ops
+}
+
+// Reset forgets the operations traced.
+func (t *OpTrace) Reset() {
+	t.mu.Lock()
+	t.ops = nil
+	t.mu.Unlock()
+}
+
+func (t *OpTrace) begin(op string, key []byte) {
+	t.mu.Lock()
+	t.ops = append(t.ops, TraceOp{Op: op, Key: append([]byte(nil), key...)})
+	t.mu.Unlock()
+}
+
+// record a page access in the last op
+func (t *OpTrace) page(access PageAccess) {
+	t.mu.Lock()
+	if n := len(t.ops); n > 0 {
+		t.ops[n-1].Pages = append(t.ops[n-1].Pages, access)
+	}
+	t.mu.Unlock()
+}
+
+// start an op of the Tx if it's traced
+func (tx *Tx) traceOp(op string, key []byte) {
+	if tx.trace != nil {
+		tx.trace.begin(op, key)
+	}
+}
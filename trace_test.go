@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestOpTrace(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	for i := 0; i < 3000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 50))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	stats, _ := db.TreeStats()
+	db = reopenTest(t, db)
+
+	var trace OpTrace
+	ctx := WithOpTrace(context.Background(), &trace)
+	tx, _ = db.BeginContext(ctx, false)
+	tx.Get([]byte("k01000"))
+	tx.Get([]byte("k01000"))
+	c := tx.Cursor()
+	n := 0
+	for k, _ := c.Seek([]byte("k00100")); k != nil && n < 500; k, _ = c.Next() {
+		n++
+	}
+	tx.Rollback()
+	ops := trace.Ops()
+	if len(ops) != 3 || ops[0].Op != "get" || string(ops[0].Key) != "k01000" || ops[2].Op != "scan" || string(ops[2].Key) != "k00100" {
+		t.Fatalf("ops %+v", ops)
+	}
+	for i, source := range []PageSource{PageFromFile, PageFromCache} {
+		if len(ops[i].Pages) < stats.Height {
+			t.Fatalf("get %d went through %d pages, the tree has %d levels", i, len(ops[i].Pages), stats.Height)
+		}
+		// the pages of the tree, then those of the expiry times
+		for _, p := range ops[i].Pages[:stats.Height] {
+			if p.Source != source || p.Write {
+				t.Fatalf("get %d read %+v, want from %v", i, p, source)
+			}
+		}
+	}
+	if len(ops[2].Pages) < 500*60/BTREE_PAGE_SIZE {
+		t.Fatalf("scan of 500 keys went through %d pages", len(ops[2].Pages))
+	}
+
+	trace.Reset()
+	tx, _ = db.BeginContext(ctx, true)
+	tx.Set([]byte("k01000"), []byte("v"))
+	tx.Get([]byte("k01000"))
+	tx.Rollback()
+	if ops = trace.Ops(); len(ops) != 2 || ops[0].Op != "set" {
+		t.Fatalf("ops %+v", ops)
+	}
+	writes := 0
+	for _, p := range ops[0].Pages {
+		if p.Write {
+			writes++
+		}
+	}
+	if writes < stats.Height {
+		t.Fatalf("set wrote %d pages, the tree has %d levels", writes, stats.Height)
+	}
+	for _, p := range ops[1].Pages {
+		if p.Source != PageFromTx {
+			t.Fatalf("get after the set read %+v", p)
+		}
+	}
+
+	// the Txs without a trace aren't traced
+	trace.Reset()
+	db.Get([]byte("k01000"))
+	if ops = trace.Ops(); len(ops) != 0 {
+		t.Fatalf("ops %+v", ops)
+	}
+}
@@ -0,0 +1,100 @@
+package storage
+
+import "bytes"
+
+// TreeStats describes the trees of a Tx, from a walk of all their pages.
+type TreeStats struct {
+	Height      int // levels of the keys of the Tx, 0 if empty
+	BranchPages int
+	LeafPages   int
+	Keys        int     // keys of the Tx, outside buckets
+	KeyBytes    int64   // bytes of their keys and values
+	FillFactor  float64 // average share of the leaf pages in use
+	Buckets     int
+	BucketKeys  int
+	BucketPages int // pages of the buckets, the catalog and the internal trees
+}
+
+// the pages and keys of a tree
+type treeShape struct {
+	height   int
+	branches int
+	leaves   int
+	keys     int   // the sentinel excluded
+	bytes    int64 // of the keys and values
+	used     int64 // bytes of the leaves in use
+}
+
+func (s treeShape) pages() int {
+	return s.branches + s.leaves
+}
+
+func (tx *Tx) walkTree(ptr uint64, depth int, shape *treeShape) {
+	node := tx.tree.get(ptr)
+	shape.height = max(shape.height, depth)
+	if node.getNodeType() == BNODE_NODE {
+		shape.branches++
+		for i := uint16(0); i < node.getNumberOfKeys(); i++ {
+			tx.walkTree(node.getPointer(i), depth+1, shape)
+		}
+		return
+	}
+	shape.leaves++
+	shape.used += int64(node.nbytes())
+	for i := uint16(0); i < node.getNumberOfKeys(); i++ {
+		if key := node.getKey(i); len(key) > 0 {
+			shape.keys++
+			shape.bytes += int64(len(key) + len(node.getValue(i)))
+		}
+	}
+}
+
+// TreeStats walks the trees of the Tx, see DB.Stats for the counters kept
+// without reading pages.
+func (tx *Tx) TreeStats() (stats TreeStats, err error) {
+	if tx.done {
+		return stats, ErrTxClosed
+	}
+	defer catchTreeError(&err)
+	var keys treeShape
+	if tx.tree.root != 0 {
+		tx.walkTree(tx.tree.root, 1, &keys)
+	}
+	stats.Height, stats.BranchPages, stats.LeafPages = keys.height, keys.branches, keys.leaves
+	stats.Keys, stats.KeyBytes = keys.keys, keys.bytes
+	if keys.leaves > 0 {
+		stats.FillFactor = float64(keys.used) / float64(keys.leaves*tx.tree.pageSize())
+	}
+	if tx.catalog.root == 0 {
+		return stats, nil
+	}
+	var catalog treeShape
+	tx.walkTree(tx.catalog.root, 1, &catalog)
+	stats.BucketPages = catalog.pages()
+	paths, roots, err := tx.catalogScan(nil)
+	if err != nil {
+		return stats, err
+	}
+	for i, path := range paths {
+		var bucket treeShape
+		if roots[i] != 0 {
+			tx.walkTree(roots[i], 1, &bucket)
+		}
+		stats.BucketPages += bucket.pages()
+		if !bytes.HasPrefix(path, []byte{0, 2}) {
+			stats.Buckets++
+			stats.BucketKeys += bucket.keys
+		}
+	}
+	return stats, nil
+}
+
+// TreeStats runs Tx.TreeStats on the last commit visible to readers.
+func (db *DB) TreeStats() (TreeStats, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return TreeStats{}, err
+	}
+	defer tx.Rollback()
+	return tx.TreeStats()
+}
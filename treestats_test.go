@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTreeStats(t *testing.T) {
+	db := openTest(t)
+	if s, err := db.TreeStats(); err != nil || s.Keys != 0 || s.Height != 0 {
+		t.Fatalf("empty %+v %v", s, err)
+	}
+	tx, _ := db.Begin(true)
+	for i := 0; i < 5000; i++ {
+		tx.Set([]byte(fmt.Sprintf("k%06d", i)), []byte("valuevalue"))
+	}
+	b, _ := tx.CreateBucket([]byte("b"))
+	b.Set([]byte("x"), []byte("y"))
+	tx.SetWithExpiry([]byte("t"), []byte("y"), time.Now().Add(time.Hour))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.TreeStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Keys != 5001 || s.KeyBytes != 5000*17+2 || s.Buckets != 1 || s.BucketKeys != 1 {
+		t.Fatalf("keys %+v", s)
+	}
+	if s.Height < 2 || s.BranchPages == 0 || s.LeafPages < 5000*17/BTREE_PAGE_SIZE || s.BucketPages == 0 {
+		t.Fatalf("pages %+v", s)
+	}
+	if s.FillFactor <= 0.3 || s.FillFactor > 1 {
+		t.Fatalf("fill factor %v", s.FillFactor)
+	}
+}
+
+func TestStats(t *testing.T) {
+	db := openTest(t)
+	for i := 0; i < 200; i++ {
+		mustSet(t, db, fmt.Sprint("k", i), "v")
+	}
+	s := db.Stats()
+	if s.Commits != 200 || s.WALSyncs == 0 || s.WALSize < 200*2 || s.PageSize != BTREE_PAGE_SIZE {
+		t.Fatalf("%d commits, %d fsyncs, WAL of %d bytes", s.Commits, s.WALSyncs, s.WALSize)
+	}
+	walSize := s.WALSize
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	s = db.Stats()
+	if s.WALSize >= walSize/10 || s.FilePages == 0 || s.PageWrites == 0 || s.CachedPages == 0 {
+		t.Fatalf("after the checkpoint WAL of %d bytes, %d pages in the file, %d written, %d cached",
+			s.WALSize, s.FilePages, s.PageWrites, s.CachedPages)
+	}
+	if rate := (Stats{}).CacheHitRate(); rate != 0 {
+		t.Fatalf("hit rate %v without reads", rate)
+	}
+	if rate := (Stats{CacheHits: 3, CacheMisses: 1}).CacheHitRate(); rate != 0.75 {
+		t.Fatalf("hit rate %v", rate)
+	}
+}
@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	DEFAULT_SWEEP_INTERVAL = time.Second
+	SWEEP_BATCH            = 256 // expired keys deleted per Tx by the sweeper
+
+	// internal trees in the catalog, no bucket path starts with 0x00 0x02
+	EXPIRY_PATH   = "\x00\x02expiry"   // key to deadline
+	EXPIRING_PATH = "\x00\x02expiring" // deadline then key, for the sweeper
+)
+
+// Keys set with SetWithExpiry are absent once their deadline is past, and
+// deleted later by the sweeper. A Tx reads the clock once, a key expiring
+// meanwhile stays visible until the Tx ends.
+//
+// The deadlines are in two trees of the catalog, by key and by deadline,
+// in bytes.Compare order. They're not logged as pages: a WAL_OP_EXPIRE op
+// sets the deadline of a key, or removes it if empty, and replay updates
+// both trees. Only the keys outside buckets can expire.
+
+// SetWithExpiry sets the key until the given deadline, a zero time sets it
+// without one like Set. Keys can be 8 bytes shorter than for Set.
+func (tx *Tx) SetWithExpiry(key []byte, value []byte, at time.Time) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if max := maxKeySize(tx.tree.pageSize()) - 8; len(key) > max {
+		return fmt.Errorf("%w: %d bytes, at most %d with an expiry", ErrKeyTooLarge, len(key), max)
+	}
+	if err := tx.set(key, value); err != nil {
+		return err
+	}
+	var deadline int64
+	if !at.IsZero() {
+		deadline = max(at.UnixNano(), 1)
+	}
+	return tx.expire(key, deadline)
+}
+
+// Expiry returns the deadline of the key, the zero time if it has none.
+// An expired or absent key has none either.
+func (tx *Tx) Expiry(key []byte) (time.Time, error) {
+	if tx.done {
+		return time.Time{}, ErrTxClosed
+	}
+	var deadline int64
+	if w, ok := tx.writes[string(key)]; ok && w.expires != 0 {
+		deadline = max(w.expires, 0) // -1 if removed by the Tx
+	} else {
+		var err error
+		if deadline, err = tx.deadline(key); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if deadline == 0 || deadline <= tx.clock() {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, deadline), nil
+}
+
+// SetWithTTL runs Tx.SetWithExpiry in its own Tx, the key expires after ttl.
+func (db *DB) SetWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.SetWithExpiry(key, value, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// the time keys expire against, read once per Tx
+func (tx *Tx) clock() int64 {
+	if tx.now == 0 {
+		tx.now = time.Now().UnixNano()
+	}
+	return tx.now
+}
+
+// an internal tree, empty if not created yet: it's added to the catalog
+// by the first update
+func (tx *Tx) internalTree(path string) (*BTree, error) {
+	if tree, ok := tx.buckets[path]; ok {
+		return tree, nil
+	}
+	tree := tx.tree
+	tree.root, tree.cmp = 0, nil
+	tree.usage, tree.new, tree.del = nil, tx.pageNew, tx.pageDel
+	value, ok, err := tx.catalog.Get([]byte(path))
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if len(value) != 8 {
+			return nil, fmt.Errorf("%w: bad catalog entry %q", ErrCorrupt, path)
+		}
+		tree.root = binary.LittleEndian.Uint64(value)
+	}
+	if tx.buckets == nil {
+		tx.buckets = map[string]*BTree{}
+	}
+	tx.buckets[path] = &tree
+	return &tree, nil
+}
+
+func encodeDeadline(deadline int64) []byte {
+	if deadline == 0 {
+		return nil
+	}
+	return binary.BigEndian.AppendUint64(nil, uint64(deadline))
+}
+
+func decodeDeadline(data []byte) (int64, error) {
+	switch len(data) {
+	case 0:
+		return 0, nil
+	case 8:
+		return int64(binary.BigEndian.Uint64(data)), nil
+	default:
+		return 0, fmt.Errorf("%w: deadline of %d bytes", ErrCorrupt, len(data))
+	}
+}
+
+// the key of the sweeper tree, deadlines in order
+func expiringKey(deadline int64, key []byte) []byte {
+	return append(encodeDeadline(deadline), key...)
+}
+
+// the deadline of a key in the tree of the Tx, 0 if none
+func (tx *Tx) deadline(key []byte) (int64, error) {
+	byKey, err := tx.internalTree(EXPIRY_PATH)
+	if err != nil || byKey.root == 0 {
+		return 0, err
+	}
+	value, ok, err := byKey.Get(key)
+	if !ok {
+		return 0, err
+	}
+	return decodeDeadline(value)
+}
+
+func (tx *Tx) expired(key []byte) (bool, error) {
+	deadline, err := tx.deadline(key)
+	return deadline != 0 && deadline <= tx.clock(), err
+}
+
+// set the deadline of a key, 0 removes it, and log it
+func (tx *Tx) expire(key []byte, deadline int64) error {
+	op := walOp{kind: WAL_OP_EXPIRE, key: append([]byte(nil), key...), value: encodeDeadline(deadline)}
+	if tx.optimistic {
+		tx.bufferWrite(op)
+		return nil
+	}
+	old, err := tx.deadline(key)
+	if err != nil || old == deadline {
+		return err
+	}
+	byKey, err := tx.internalTree(EXPIRY_PATH)
+	if err != nil {
+		return err
+	}
+	byTime, err := tx.internalTree(EXPIRING_PATH)
+	if err != nil {
+		return err
+	}
+	if old != 0 {
+		_, err = byTime.Delete(expiringKey(old, key))
+	}
+	if err == nil && deadline != 0 {
+		err = byKey.Insert(key, op.value)
+		if err == nil {
+			err = byTime.Insert(expiringKey(deadline, key), nil)
+		}
+	} else if err == nil {
+		_, err = byKey.Delete(key)
+	}
+	if err == nil {
+		err = tx.setBucketRoot([]byte(EXPIRY_PATH), byKey.root)
+	}
+	if err == nil {
+		err = tx.setBucketRoot([]byte(EXPIRING_PATH), byTime.root)
+	}
+	if err != nil {
+		tx.err = err
+		return err
+	}
+	tx.logOp(nil, op)
+	tx.gen++
+	return nil
+}
+
+// remove the deadline of a key updated by Set or Del, whether it had
+// expired already
+func (tx *Tx) unexpire(key []byte) (bool, error) {
+	if tx.optimistic {
+		// the latest commit may have a deadline the snapshot doesn't
+		return false, tx.expire(key, 0)
+	}
+	deadline, err := tx.deadline(key)
+	if err != nil || deadline == 0 {
+		return false, err
+	}
+	return deadline <= tx.clock(), tx.expire(key, 0)
+}
+
+// delete the key if it expired, before updating it from its old value
+func (tx *Tx) dropExpired(key []byte) error {
+	expired, err := tx.expired(key)
+	if err != nil || !expired {
+		return err
+	}
+	if _, err := tx.del(key); err != nil {
+		return err
+	}
+	return tx.expire(key, 0)
+}
+
+// Sweep deletes the expired keys, SWEEP_BATCH keys per Tx, and returns
+// how many it deleted. The sweeper calls it every WithSweepInterval.
+func (db *DB) Sweep() (int, error) {
+	return db.sweep(context.Background())
+}
+
+func (db *DB) sweep(ctx context.Context) (int, error) {
+	// look first without blocking writers, most sweeps find nothing
+	var keys [][]byte
+	err := db.View(func(tx *Tx) (err error) {
+		keys, err = tx.expiredKeys(1)
+		return err
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	total := 0
+	for {
+		n, err := db.sweepBatch(ctx)
+		total += n
+		if err != nil || n < SWEEP_BATCH {
+			return total, err
+		}
+	}
+}
+
+func (db *DB) sweepBatch(ctx context.Context) (int, error) {
+	tx, err := db.BeginContext(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	keys, err := tx.expiredKeys(SWEEP_BATCH)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if _, err := tx.del(key); err != nil {
+			return 0, err
+		}
+		if err := tx.expire(key, 0); err != nil {
+			return 0, err
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	return len(keys), tx.Commit()
+}
+
+// the first keys past their deadline
+func (tx *Tx) expiredKeys(limit int) (keys [][]byte, err error) {
+	byTime, err := tx.internalTree(EXPIRING_PATH)
+	if err != nil || byTime.root == 0 {
+		return nil, err
+	}
+	defer catchTreeError(&err)
+	now := encodeDeadline(tx.clock())
+	for iter := byTime.SeekLE(nil); !iter.atEnd() && len(keys) < limit; iter.Next() {
+		if !iter.Valid() {
+			continue // the sentinel
+		}
+		key, _ := iter.Deref()
+		if bytes.Compare(key[:8], now) > 0 {
+			break
+		}
+		keys = append(keys, append([]byte(nil), key[8:]...))
+	}
+	return keys, nil
+}
+
+// start the sweeper on the first commit, after the DB is configured
+func (db *DB) startSweeper() {
+	db.sweeper.once.Do(func() {
+		interval := db.opts.sweepInterval
+		if interval <= 0 || db.opts.replicaOf != "" {
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		db.sweeper.cancel = cancel
+		db.sweeper.done = make(chan struct{})
+		go db.runSweeper(ctx, interval)
+	})
+}
+
+func (db *DB) runSweeper(ctx context.Context, interval time.Duration) {
+	defer close(db.sweeper.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// the keys are absent anyway, a failed sweep is retried
+			if _, err := db.sweep(ctx); err != nil && ctx.Err() == nil {
+				db.log.Warn("sweep of expired keys failed", "err", err)
+			}
+		}
+	}
+}
+
+// stop the sweeper, it may be waiting for the writer lock held by Close
+func (db *DB) stopSweeper() {
+	db.sweeper.once.Do(func() {})
+	if db.sweeper.cancel != nil {
+		db.sweeper.cancel()
+		<-db.sweeper.done
+	}
+}
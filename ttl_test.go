@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// count the keys of a scan, the same both ways
+func countKeys(t *testing.T, tx *Tx) int {
+	t.Helper()
+	forward, backward := 0, 0
+	c := tx.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		forward++
+	}
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		backward++
+	}
+	if forward != backward {
+		t.Fatalf("%d keys forward, %d backward", forward, backward)
+	}
+	return forward
+}
+
+func TestTTL(t *testing.T) {
+	db := openTest(t, WithSweepInterval(0))
+	mustSet(t, db, "a", "1")
+	if err := db.SetWithTTL([]byte("b"), []byte("2"), 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ := db.Begin(true)
+	for i := 0; i < 600; i++ {
+		tx.SetWithExpiry([]byte(fmt.Sprintf("e%04d", i)), []byte("x"), time.Now().Add(300*time.Millisecond))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.SetWithTTL([]byte("c"), []byte("3"), time.Hour)
+	wantValue(t, db, "b", []byte("2"))
+	tx, _ = db.Begin(false)
+	if n := countKeys(t, tx); n != 603 {
+		t.Fatalf("%d keys before the expiry", n)
+	}
+	if at, _ := tx.Expiry([]byte("c")); at.IsZero() {
+		t.Fatal("no expiry")
+	}
+	if at, _ := tx.Expiry([]byte("a")); !at.IsZero() {
+		t.Fatalf("expiry %v of a key without", at)
+	}
+	tx.Rollback()
+
+	time.Sleep(350 * time.Millisecond)
+	wantValue(t, db, "b", nil)
+	tx, _ = db.Begin(false)
+	if n := countKeys(t, tx); n != 2 {
+		t.Fatalf("%d keys after the expiry", n)
+	}
+	tx.Rollback()
+	tx, _ = db.Begin(true)
+	if ok, _ := tx.Del([]byte("b")); ok {
+		t.Fatal("deleted an expired key")
+	}
+	tx.Rollback()
+
+	// an expired counter starts over
+	db.SetWithTTL([]byte("n"), []byte("12345678"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if n, err := db.Increment([]byte("n"), 2); n != 2 || err != nil {
+		t.Fatalf("counter %d %v", n, err)
+	}
+	if n, err := db.Sweep(); err != nil || n != 601 {
+		t.Fatalf("swept %d: %v", n, err)
+	}
+	if n, _ := db.Sweep(); n != 0 {
+		t.Fatalf("swept %d twice", n)
+	}
+
+	db = reopenTest(t, db)
+	tx, _ = db.Begin(false)
+	defer tx.Rollback()
+	if n := countKeys(t, tx); n != 3 {
+		t.Fatalf("%d keys after reopening", n)
+	}
+	if at, _ := tx.Expiry([]byte("c")); at.IsZero() {
+		t.Fatal("no expiry after reopening")
+	}
+	if names := listBuckets(tx, nil); len(names) != 0 {
+		t.Fatalf("internal trees listed as buckets %q", names)
+	}
+}
+
+func TestTTLOptimistic(t *testing.T) {
+	db := openTest(t, WithSweepInterval(0))
+	mustSet(t, db, "a", "1")
+	db.SetWithTTL([]byte("b"), []byte("2"), time.Millisecond)
+	db.SetWithTTL([]byte("c"), []byte("3"), time.Hour)
+	time.Sleep(5 * time.Millisecond)
+	tx, _ := db.BeginTx(TxOptions{Writable: true})
+	if _, ok, _ := tx.Get([]byte("b")); ok {
+		t.Fatal("expired key visible")
+	}
+	if n := countKeys(t, tx); n != 2 {
+		t.Fatalf("%d keys", n)
+	}
+	tx.SetWithExpiry([]byte("d"), []byte("4"), time.Now().Add(-time.Second))
+	tx.SetWithExpiry([]byte("f"), []byte("5"), time.Now().Add(time.Hour))
+	tx.Set([]byte("c"), []byte("33"))
+	if n := countKeys(t, tx); n != 3 {
+		t.Fatalf("%d keys with the writes of the Tx", n)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = db.Begin(false)
+	defer tx.Rollback()
+	if at, _ := tx.Expiry([]byte("c")); !at.IsZero() {
+		t.Fatal("a set kept the expiry")
+	}
+	if at, _ := tx.Expiry([]byte("f")); at.IsZero() {
+		t.Fatal("no expiry")
+	}
+	if _, ok, _ := tx.Get([]byte("d")); ok {
+		t.Fatal("key set expired visible")
+	}
+}
+
+func TestTTLRecover(t *testing.T) {
+	db := openTest(t, WithSweepInterval(0), WithCheckpointSize(1<<40))
+	db.SetWithTTL([]byte("a"), []byte("1"), time.Hour)
+	db.SetWithTTL([]byte("b"), []byte("1"), time.Hour)
+	mustSet(t, db, "b", "2")
+	crashTest(db)
+	db = openTestPath(t, db.Path)
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	if at, _ := tx.Expiry([]byte("a")); at.IsZero() {
+		t.Fatal("expiry lost")
+	}
+	if at, _ := tx.Expiry([]byte("b")); !at.IsZero() {
+		t.Fatal("a set kept the expiry")
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	db := openTest(t, WithSweepInterval(10*time.Millisecond))
+	db.SetWithTTL([]byte("g"), []byte("x"), time.Millisecond)
+	time.Sleep(80 * time.Millisecond)
+	if n, _ := db.Sweep(); n != 0 {
+		t.Fatalf("%d keys left to sweep", n)
+	}
+}
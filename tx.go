@@ -0,0 +1,575 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrTxClosed      = errors.New("transaction is closed")
+	ErrTxNotWritable = errors.New("transaction is read-only")
+)
+
+// Tx is a transaction on the database.
+// A writable Tx buffers its new pages in memory and logs its updates,
+// nothing is visible to others until Commit makes the log record durable
+// and publishes the new root.
+// A read-only Tx sees the database as of Begin, later commits don't affect it.
+// A Tx must not be used by several goroutines at once, begin one per goroutine.
+type Tx struct {
+	db       *DB
+	ctx      context.Context
+	writable bool
+	done     bool
+	version  uint64  // version of the snapshot, the number of commits before Begin
+	ops      []walOp // updates to log on commit
+	// optimistic Tx from BeginTx, they buffer updates instead of pages
+	optimistic bool
+	isolation  Isolation
+	writes     map[string]pendingWrite
+	reads      map[string]struct{} // keys read, for Serializable only
+	scans      []keyRange          // ranges walked by cursors, for Serializable only
+	touched    bool                // the Tx read or updated a key
+	gen        uint64              // number of updates, cursors follow them
+	locked     bool                // the Tx holds key locks
+	snap       *snapshot           // pinned by a read-only Tx
+	tree       BTree
+	page       struct {
+		flushed  uint64            // database size in number of pages when the Tx began
+		nappend  uint64            // pages appended at the end of the file
+		reused   int               // pages taken from the free list
+		updates  map[uint64][]byte // pages written by this Tx
+		recycled []uint64          // pages written then freed by this Tx, reusable right away
+		retired  []uint64          // pages written then freed, but kept for a savepoint
+		sealed   map[uint64]bool   // pages reachable from a savepoint
+		freed    []uint64          // committed pages freed by this Tx
+	}
+	savepoints  []savepoint
+	err         error                 // a tree error stopped an update, the Tx can only roll back
+	prefetching sync.WaitGroup        // pages read ahead of cursors
+	prefetched  map[uint64]bool       // pages being read ahead
+	catalog     BTree                 // bucket names to roots, see Bucket
+	buckets     map[string]*BTree     // the buckets opened by the Tx
+	opBucket    []byte                // bucket of the last op logged, nil for the keys of the Tx
+	now         int64                 // the clock for expired keys, see clock
+	trace       *OpTrace              // from the context, see WithOpTrace
+	span        span                  // nil once ended, or for replay
+	usage       map[string]*treeUsage // updates of the trees, by usage key
+	sqlPlans    *planRecorder         // of the PreparedStmt run, nil if none
+	schemaGen   uint64                // bumped by each schema written or rolled back, see Table.children
+}
+
+// Begin starts a transaction. Only one writable transaction runs at a time,
+// Begin(true) blocks until the previous one is committed or rolled back.
+// It fails with ErrInDoubt while a prepared Tx recovered by Open isn't
+// resolved, see Prepared. See BeginTx for writable transactions that run
+// concurrently.
+func (db *DB) Begin(writable bool) (*Tx, error) {
+	return db.BeginContext(context.Background(), writable)
+}
+
+// BeginContext is Begin with a context: Begin(true) stops waiting for the
+// previous writable Tx when ctx is done. The context is checked by the
+// cursors of the Tx between leaves and by Commit, the Tx is rolled back
+// once it's done.
+func (db *DB) BeginContext(ctx context.Context, writable bool) (*Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var tx *Tx
+	var err error
+	if !writable {
+		if tx, err = db.beginRead(); err == nil {
+			tx.ctx, tx.trace = ctx, opTraceFrom(ctx)
+		}
+	} else if db.readOnly(ctx) {
+		return nil, ErrReadOnly
+	} else {
+		tx, err = db.beginWrite(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tx.ctx, tx.span = db.startSpan(tx.ctx, "storage_engine.tx")
+	tx.span.set("tx.writable", writable)
+	tx.span.set("tx.version", tx.version)
+	return tx, nil
+}
+
+// writable Txs fail on a read-only DB, and on a replica unless they're
+// those of the replication
+func (db *DB) readOnly(ctx context.Context) bool {
+	return db.opts.readOnly || db.opts.replicaOf != "" && ctx.Value(replicationKey{}) == nil
+}
+
+// recover replays the WAL even when the DB is read-only
+func (db *DB) beginWrite(ctx context.Context) (*Tx, error) {
+	if err := db.checkInDoubt(); err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&db.writersActive, 1)
+	if err := lockContext(ctx, &db.writer); err != nil {
+		atomic.AddInt32(&db.writersActive, -1)
+		return nil, err
+	}
+	db.mu.Lock()
+	if db.closed.Load() {
+		db.mu.Unlock()
+		db.writer.Unlock()
+		atomic.AddInt32(&db.writersActive, -1)
+		return nil, ErrDBClosed
+	}
+	// start from the last commit, durable or not
+	tx := &Tx{db: db, ctx: ctx, trace: opTraceFrom(ctx), writable: true, version: db.version}
+	tx.tree.root = db.root
+	tx.catalog.root = db.catalog
+	tx.page.flushed = db.page.flushed
+	tx.page.updates = map[uint64][]byte{}
+	tx.tree.arena = &arena{}
+	// pages freed before the oldest snapshot are unreachable now,
+	// including the snapshots that readers can still begin on
+	var zero []byte
+	for _, ptr := range db.free.release(db.oldestReader(), db.checkpointed, db.opts.secureDelete) {
+		if !db.opts.secureDelete {
+			db.cache.drop(ptr)
+			continue
+		}
+		if zero == nil {
+			zero = make([]byte, db.nodeSize())
+		}
+		db.cache.wipe(ptr, zero)
+	}
+	db.mu.Unlock()
+	tx.setCallbacks()
+	tx.track(&tx.tree, USAGE_KEYS)
+	return tx, nil
+}
+
+// a read-only Tx takes no lock, see snapshot
+func (db *DB) beginRead() (*Tx, error) {
+	db.nreaders.Add(1)
+	if db.closed.Load() {
+		db.readerDone()
+		return nil, ErrDBClosed
+	}
+	// pin the snapshot until the Tx ends
+	tx := &Tx{db: db, ctx: context.Background(), snap: db.pinSnapshot()}
+	tx.version = tx.snap.version
+	tx.tree.root = tx.snap.root
+	tx.catalog.root = tx.snap.catalog
+	tx.setCallbacks()
+	return tx, nil
+}
+
+func (tx *Tx) setCallbacks() {
+	tx.tree.get = tx.pageGet
+	tx.tree.new = tx.pageNew
+	tx.tree.del = tx.pageDel
+	tx.tree.size = tx.db.nodeSize()
+	tx.tree.cmp = tx.db.opts.cmp
+	// the catalog is in bytes.Compare order whatever the comparator
+	root := tx.catalog.root
+	tx.catalog = tx.tree
+	tx.catalog.root, tx.catalog.cmp = root, nil
+}
+
+func (tx *Tx) Writable() bool {
+	return tx.writable
+}
+
+// Version is the number of commits visible to the Tx.
+func (tx *Tx) Version() uint64 {
+	return tx.version
+}
+
+// Get returns the value of the key without copying it: the slice points into
+// a page or into the updates of the Tx. It's valid until the Tx ends and must
+// not be modified, see GetCopy to keep it longer.
+func (tx *Tx) Get(key []byte) ([]byte, bool, error) {
+	if tx.done {
+		return nil, false, ErrTxClosed
+	}
+	tx.traceOp("get", key)
+	if tx.db.opts.latency {
+		defer tx.db.stats.getLatency.since(time.Now())
+	}
+	if tx.optimistic {
+		return tx.optimisticGet(key)
+	}
+	return tx.treeGet(key)
+}
+
+// read the tree of the Tx, expired keys are absent
+func (tx *Tx) treeGet(key []byte) ([]byte, bool, error) {
+	value, ok, err := tx.tree.Get(key)
+	if !ok {
+		return nil, false, err
+	}
+	if expired, err := tx.expired(key); expired || err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// GetCopy returns a copy of the value of the key, owned by the caller.
+func (tx *Tx) GetCopy(key []byte) ([]byte, bool, error) {
+	value, ok, err := tx.Get(key)
+	if !ok {
+		return nil, false, err
+	}
+	return append([]byte{}, value...), true, nil
+}
+
+// Set updates the key, an expiration set by SetWithExpiry is removed.
+func (tx *Tx) Set(key []byte, value []byte) error {
+	tx.traceOp("set", key)
+	if tx.db.opts.latency {
+		defer tx.db.stats.setLatency.since(time.Now())
+	}
+	if err := tx.set(key, value); err != nil {
+		return err
+	}
+	_, err := tx.unexpire(key)
+	return err
+}
+
+// Del removes the key, false if it's absent or expired.
+func (tx *Tx) Del(key []byte) (bool, error) {
+	tx.traceOp("del", key)
+	deleted, err := tx.del(key)
+	if err != nil || !deleted {
+		return false, err
+	}
+	expired, err := tx.unexpire(key)
+	return !expired && err == nil, err
+}
+
+// Set and Del without the expiration, which the WAL records on its own
+func (tx *Tx) set(key []byte, value []byte) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	op := walOp{
+		kind:  WAL_OP_SET,
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	}
+	if err := tx.tree.checkKeyValue(key, value); err != nil {
+		return err
+	}
+	if tx.optimistic {
+		tx.bufferWrite(op)
+		return nil
+	}
+	if err := tx.tree.Insert(key, value); err != nil {
+		tx.err = err
+		return err
+	}
+	tx.logOp(nil, op)
+	tx.gen++
+	return nil
+}
+
+func (tx *Tx) del(key []byte) (bool, error) {
+	if err := tx.checkWritable(); err != nil {
+		return false, err
+	}
+	op := walOp{kind: WAL_OP_DEL, key: append([]byte(nil), key...)}
+	if err := tx.tree.checkKeyValue(key, nil); err != nil {
+		return false, err
+	}
+	if tx.optimistic {
+		if _, ok, err := tx.optimisticGet(key); !ok {
+			return false, err
+		}
+		tx.bufferWrite(op)
+		return true, nil
+	}
+	if deleted, err := tx.tree.Delete(key); err != nil {
+		tx.err = err
+		return false, err
+	} else if !deleted {
+		return false, nil
+	}
+	tx.logOp(nil, op)
+	tx.gen++
+	return true, nil
+}
+
+func (tx *Tx) checkWritable() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	return tx.err
+}
+
+// add an op to the WAL record, preceded by the bucket it updates
+func (tx *Tx) logOp(bucket []byte, op walOp) {
+	if !bytes.Equal(bucket, tx.opBucket) {
+		tx.ops = append(tx.ops, walOp{kind: WAL_OP_BUCKET, key: bucket})
+		tx.opBucket = bucket
+	}
+	tx.ops = append(tx.ops, op)
+}
+
+// Commit appends the updates of a writable Tx to the WAL and returns once
+// they're durable, or right away depending on WithSyncPolicy. The new pages
+// stay in memory until the next checkpoint. On error nothing is published.
+func (tx *Tx) Commit() error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if err := tx.ctx.Err(); err != nil {
+		tx.endSpan(err)
+		tx.close()
+		return err
+	}
+	if tx.optimistic {
+		return tx.commitOptimistic()
+	}
+	if len(tx.ops) == 0 {
+		return tx.Rollback()
+	}
+	if err := tx.audit(); err != nil {
+		tx.endSpan(err)
+		tx.close()
+		return err
+	}
+	return tx.commit(tx.ops)
+}
+
+// log the given ops as the record of the Tx and publish it
+func (tx *Tx) commit(logged []walOp) (err error) {
+	db := tx.db
+	start := time.Now()
+	version := tx.version + 1
+	// the Tx is closed before the commit is durable
+	span := tx.span
+	tx.span = nil
+	if span != nil {
+		defer func() { endSpan(span, err) }()
+	}
+	if err := db.failed(); err != nil {
+		tx.close()
+		return err
+	}
+	if err := tx.flushUsage(); err != nil {
+		tx.close()
+		return err
+	}
+	events, err := tx.watchEvents(version)
+	if err != nil {
+		tx.close()
+		return err
+	}
+	walSize := db.wal.size.Load()
+	if err := db.wal.append(walRecord{version: version, ops: append(logged[:len(logged):len(logged)], commitTime(start))}); err != nil {
+		tx.close()
+		return err
+	}
+	logBytes, pages := db.wal.size.Load()-walSize, len(tx.page.updates)
+	if span != nil {
+		span.set("tx.commit", version)
+		span.set("tx.ops", len(logged))
+		span.set("tx.pages_written", pages)
+		span.set("wal.bytes", logBytes) // fsynced by the commit with SyncAlways
+	}
+	db.watch.add(events)
+	tx.publish(version)
+	db.startFlusher()
+	db.startSweeper()
+	db.startScrubber()
+	checkpoint := db.wal.size.Load() > db.opts.checkpointSize
+	tx.close()
+
+	if db.opts.syncPolicy == SyncAlways {
+		if err := db.waitDurable(version); err != nil {
+			return err
+		}
+	} else {
+		// visible right away, durable later
+		db.publish(version)
+		db.startSyncer()
+	}
+	elapsed := time.Since(start)
+	db.stats.commitLatency.observe(elapsed)
+	if db.slow(elapsed) {
+		db.log.Warn("slow commit", "version", version, "duration", elapsed, "ops", len(logged), "pages", pages, "wal_bytes", logBytes)
+	}
+	if checkpoint {
+		// the commit is durable anyway, a failed checkpoint is retried later
+		db.Checkpoint()
+	}
+	return nil
+}
+
+// make the Tx the latest commit, readers see it once it's durable
+func (tx *Tx) publish(version uint64) {
+	db := tx.db
+	// the savepoints are gone, so are the pages they kept
+	tx.page.recycled = append(tx.page.recycled, tx.page.retired...)
+	garbage := make(map[uint64]bool, len(tx.page.recycled))
+	for _, ptr := range tx.page.recycled {
+		garbage[ptr] = true
+	}
+	freed := pendingFree{version: version}
+	for _, ptr := range tx.page.freed {
+		if db.quarantined(ptr) {
+			continue // never reused
+		}
+		if db.cache.isDirty(ptr) {
+			freed.young = append(freed.young, ptr)
+		} else {
+			freed.pages = append(freed.pages, ptr)
+		}
+	}
+	for ptr, page := range tx.page.updates {
+		if !garbage[ptr] {
+			db.cache.putDirty(ptr, page)
+		}
+	}
+
+	db.mu.Lock()
+	remaining := db.free.free[:len(db.free.free)-tx.page.reused]
+	db.free.free = append(remaining, tx.page.recycled...)
+	db.free.pending = append(db.free.pending, freed)
+	db.root = tx.tree.root
+	db.catalog = tx.catalog.root
+	db.version = version
+	db.page.flushed = tx.page.flushed + tx.page.nappend
+	db.commits = append(db.commits, commit{version: version, root: db.root, catalog: db.catalog})
+	db.recordWrites(version, tx.ops, db.oldestReader())
+	db.mu.Unlock()
+
+	db.sync.mu.Lock()
+	db.sync.appended = version
+	db.sync.mu.Unlock()
+}
+
+// Rollback discards a Tx. Calling it after Commit only returns ErrTxClosed,
+// so it can be deferred right after Begin.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	tx.close()
+	return nil
+}
+
+func (tx *Tx) close() {
+	tx.endSpan(nil)
+	tx.done = true
+	tx.prefetching.Wait()
+	tx.page.updates = nil
+	tx.tree.arena = nil
+	tx.catalog.arena = nil
+	tx.buckets = nil
+	tx.savepoints = nil
+	tx.ops = nil
+	if tx.locked {
+		tx.db.locks.release(tx)
+	}
+	if tx.writable && !tx.optimistic {
+		tx.db.writer.Unlock()
+		atomic.AddInt32(&tx.db.writersActive, -1)
+		return
+	}
+	tx.db.unpinSnapshot(tx.snap)
+	tx.db.readerDone()
+}
+
+// one read-only Tx less, Close waits for them
+func (db *DB) readerDone() {
+	if db.nreaders.Add(-1) == 0 && db.closed.Load() {
+		db.mu.Lock()
+		db.closing.Broadcast()
+		db.mu.Unlock()
+	}
+}
+
+// callback for BTree, dereference a pointer
+func (tx *Tx) pageGet(ptr uint64) BNode {
+	if page, ok := tx.page.updates[ptr]; ok {
+		if tx.trace != nil {
+			tx.trace.page(PageAccess{Page: ptr, Source: PageFromTx})
+		}
+		return BNode{page}
+	}
+	db := tx.db
+	if tx.prefetched[ptr] {
+		// being read ahead, don't read it twice
+		tx.prefetching.Wait()
+		clear(tx.prefetched)
+	}
+	if page := db.cache.get(ptr); page != nil {
+		if tx.trace != nil {
+			tx.trace.page(PageAccess{Page: ptr, Source: PageFromCache})
+		}
+		return BNode{page}
+	}
+	if tx.trace != nil {
+		tx.trace.page(PageAccess{Page: ptr, Source: PageFromFile})
+	}
+	node, err := db.readPage(ptr)
+	if err == nil {
+		err = checkNode(node)
+	}
+	if err != nil {
+		db.log.Error("bad page", "page", ptr, "err", err)
+		treeFail(fmt.Errorf("read page %d: %w", ptr, err))
+	}
+	return BNode{db.cache.addClean(ptr, node.data)}
+}
+
+// callback for BTree, allocate a new page
+func (tx *Tx) pageNew(node BNode) uint64 {
+	size := tx.tree.pageSize()
+	if node.nbytes() > uint16(size) {
+		corrupt("pageNew called with a node of %d bytes", node.nbytes())
+	}
+	ptr := tx.pageAlloc()
+	tx.page.updates[ptr] = node.data[:size]
+	if tx.trace != nil {
+		tx.trace.page(PageAccess{Page: ptr, Write: true})
+	}
+	return ptr
+}
+
+// callback for BTree, deallocate a page
+func (tx *Tx) pageDel(ptr uint64) {
+	if _, ok := tx.page.updates[ptr]; ok {
+		// never committed, no snapshot can see it
+		if tx.page.sealed[ptr] {
+			tx.page.retired = append(tx.page.retired, ptr)
+		} else {
+			tx.page.recycled = append(tx.page.recycled, ptr)
+		}
+		return
+	}
+	tx.page.freed = append(tx.page.freed, ptr)
+}
+
+// pick a page number, reusing free pages before growing the file
+func (tx *Tx) pageAlloc() uint64 {
+	if n := len(tx.page.recycled); n > 0 {
+		ptr := tx.page.recycled[n-1]
+		tx.page.recycled = tx.page.recycled[:n-1]
+		return ptr
+	}
+	free := tx.db.free.free
+	if tx.page.reused < len(free) {
+		tx.page.reused++
+		return free[len(free)-tx.page.reused]
+	}
+	ptr := tx.page.flushed + tx.page.nappend
+	tx.page.nappend++
+	return ptr
+}
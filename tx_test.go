@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestTxCommit(t *testing.T) {
+	db := openTest(t)
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		if err := tx.Set([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint("v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := tx.Del([]byte("k7")); err != nil || !ok {
+		t.Fatalf("del %v %v", ok, err)
+	}
+	if v, ok, err := tx.Get([]byte("k8")); err != nil || !ok || string(v) != "v8" {
+		t.Fatalf("own write %q %v %v", v, ok, err)
+	}
+	wantValue(t, db, "k8", nil) // not committed yet
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wantValue(t, db, "k8", []byte("v8"))
+	wantValue(t, db, "k7", nil)
+
+	db = reopenTest(t, db)
+	wantValue(t, db, "k299", []byte("v299"))
+	wantValue(t, db, "k7", nil)
+}
+
+func TestTxRollback(t *testing.T) {
+	db := openTest(t)
+	mustSet(t, db, "a", "1")
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Set([]byte("a"), []byte("2"))
+	tx.Set([]byte("b"), []byte("2"))
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	wantValue(t, db, "a", []byte("1"))
+	wantValue(t, db, "b", nil)
+
+	db = reopenTest(t, db)
+	wantValue(t, db, "a", []byte("1"))
+	wantValue(t, db, "b", nil)
+}
+
+func TestTxClosed(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(true)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("a"), []byte("1")); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("set after commit: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("commit twice: %v", err)
+	}
+	if err := tx.Rollback(); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("rollback after commit: %v", err)
+	}
+}
+
+func TestTxReadOnly(t *testing.T) {
+	db := openTest(t)
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	if tx.Writable() {
+		t.Fatal("writable")
+	}
+	if err := tx.Set([]byte("a"), []byte("1")); !errors.Is(err, ErrTxNotWritable) {
+		t.Fatalf("set: %v", err)
+	}
+	if _, err := tx.Del([]byte("a")); !errors.Is(err, ErrTxNotWritable) {
+		t.Fatalf("del: %v", err)
+	}
+}
+
+func TestUpdateError(t *testing.T) {
+	db := openTest(t)
+	failed := errors.New("failed")
+	err := db.Update(func(tx *Tx) error {
+		tx.Set([]byte("a"), []byte("1"))
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("update: %v", err)
+	}
+	wantValue(t, db, "a", nil)
+}
+
+func TestDBClosed(t *testing.T) {
+	db := openTest(t)
+	db.Close()
+	if _, err := db.Begin(false); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("begin: %v", err)
+	}
+	if err := db.Set([]byte("a"), []byte("1")); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("set: %v", err)
+	}
+}
+
+// the copies outlive the Tx, the eviction of the page and the reuse of its
+// buffer by later commits
+func TestGetCopy(t *testing.T) {
+	db := openTest(t, WithCacheSize(16))
+	value := func(i int) []byte { return []byte(fmt.Sprintf("%0100d", i)) }
+	for i := 0; i < 1000; i++ {
+		mustSet(t, db, fmt.Sprintf("k%04d", i), string(value(i)))
+	}
+	db.Checkpoint()
+
+	r, _ := db.Begin(false)
+	copied, ok, err := r.GetCopy([]byte("k0500"))
+	if err != nil || !ok {
+		t.Fatalf("get copy %v %v", ok, err)
+	}
+	r.Rollback()
+	w, _ := db.Begin(true)
+	w.Set([]byte("new"), value(-1))
+	fresh, _, _ := w.GetCopy([]byte("new"))
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// rewrite every page, freed and reused, then evict them
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 1000; i++ {
+			mustSet(t, db, fmt.Sprintf("k%04d", i), fmt.Sprintf("%0100d", i+round*1000))
+		}
+		mustSet(t, db, "new", "x")
+		db.Checkpoint()
+	}
+	for i := 0; i < 1000; i += 3 {
+		db.Get([]byte(fmt.Sprintf("k%04d", i)))
+	}
+	if string(copied) != string(value(500)) {
+		t.Fatalf("copy from a read-only Tx changed to %q", copied)
+	}
+	if string(fresh) != string(value(-1)) {
+		t.Fatalf("copy from a writable Tx changed to %q", fresh)
+	}
+
+	// the copy is owned by the caller
+	copied[0] = 'x'
+	r, _ = db.Begin(false)
+	defer r.Rollback()
+	if v, _, _ := r.Get([]byte("k0500")); v[0] == 'x' {
+		t.Fatal("modifying the copy modified the page")
+	}
+	if _, ok, err := r.GetCopy([]byte("missing")); ok || err != nil {
+		t.Fatalf("get copy of a missing key: %v %v", ok, err)
+	}
+}
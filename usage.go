@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// The keys, bytes and pages of each tree are counted while a writable Tx
+// updates it and added to an internal tree at commit, by tree path: the
+// catalog path of a bucket or USAGE_KEYS for the keys of the Tx. Like the
+// deadlines, the counts aren't logged: replay updates the trees again and
+// counts the same.
+//
+// A file created before the counts has no usage tree, its first commit
+// walks every tree once to create it. Until then Usage walks them too.
+// Expired keys are counted until the sweeper deletes them.
+
+const (
+	USAGE_PATH = "\x00\x02usage"
+	USAGE_KEYS = "\x00" // no bucket path is a single 0x00
+	USAGE_SIZE = 24
+)
+
+// TreeUsage is the space taken by the keys of a tree.
+type TreeUsage struct {
+	Keys  int64
+	Bytes int64 // of the keys and values
+	Pages int64
+}
+
+// BucketUsage is the space taken by the keys of a bucket, not those of the
+// buckets inside.
+type BucketUsage struct {
+	Path [][]byte // the names from the top
+	TreeUsage
+}
+
+// Usage is the space taken by the trees of a Tx, from the counts kept by
+// the commits, and the space of the file left.
+type Usage struct {
+	PageSize  int
+	FilePages uint64 // of the last commit, checkpointed or not
+	FreePages int    // reusable now or once no reader needs them
+	Keys      TreeUsage
+	Buckets   []BucketUsage // nested ones included, in catalog order
+	// the meta page, the catalog, the free list and the expiry trees
+	OtherPages int64
+	// bytes of the pages of the trees not holding keys and values: page
+	// headers and the space left unused by splits and deletes
+	Fragmented int64
+}
+
+// FreeBytes is the space of the free pages.
+func (u Usage) FreeBytes() int64 {
+	return int64(u.FreePages) * int64(u.PageSize)
+}
+
+// the updates of a tree by a Tx
+type treeUsage struct {
+	TreeUsage
+	reset bool // the tree was deleted, the counts don't add to the old ones
+}
+
+func (u *treeUsage) add(d TreeUsage) {
+	u.Keys += d.Keys
+	u.Bytes += d.Bytes
+	u.Pages += d.Pages
+}
+
+// a key set, with its old value if found
+func (u *treeUsage) set(key []byte, value []byte, old []byte, found bool) {
+	if found {
+		u.Bytes += int64(len(value) - len(old))
+		return
+	}
+	u.Keys++
+	u.Bytes += int64(len(key) + len(value))
+}
+
+func (u *treeUsage) remove(key []byte, value []byte) {
+	u.Keys--
+	u.Bytes -= int64(len(key) + len(value))
+}
+
+func encodeUsage(u TreeUsage) []byte {
+	data := make([]byte, USAGE_SIZE)
+	binary.LittleEndian.PutUint64(data[0:], uint64(u.Keys))
+	binary.LittleEndian.PutUint64(data[8:], uint64(u.Bytes))
+	binary.LittleEndian.PutUint64(data[16:], uint64(u.Pages))
+	return data
+}
+
+func decodeUsage(data []byte) (TreeUsage, error) {
+	if len(data) != USAGE_SIZE {
+		return TreeUsage{}, fmt.Errorf("%w: usage of %d bytes", ErrCorrupt, len(data))
+	}
+	return TreeUsage{
+		Keys:  int64(binary.LittleEndian.Uint64(data[0:])),
+		Bytes: int64(binary.LittleEndian.Uint64(data[8:])),
+		Pages: int64(binary.LittleEndian.Uint64(data[16:])),
+	}, nil
+}
+
+// count the updates of a tree of a writable Tx, path is its usage key
+func (tx *Tx) track(tree *BTree, path string) {
+	if tx.usage == nil {
+		tx.usage = map[string]*treeUsage{}
+	}
+	u := tx.usage[path]
+	if u == nil {
+		u = &treeUsage{}
+		tx.usage[path] = u
+	}
+	tree.usage = u
+	tree.new = func(node BNode) uint64 {
+		u.Pages++
+		return tx.pageNew(node)
+	}
+	tree.del = func(ptr uint64) {
+		u.Pages--
+		tx.pageDel(ptr)
+	}
+}
+
+// the bucket is deleted, a bucket created again with its path starts empty
+func (tx *Tx) dropUsage(path []byte) {
+	if tx.usage == nil {
+		tx.usage = map[string]*treeUsage{}
+	}
+	if u := tx.usage[string(path)]; u != nil {
+		*u = treeUsage{reset: true}
+	} else {
+		tx.usage[string(path)] = &treeUsage{reset: true}
+	}
+}
+
+func (tx *Tx) hasUsage() (bool, error) {
+	_, ok, err := tx.catalog.Get([]byte(USAGE_PATH))
+	return ok, err
+}
+
+// add the counts of the Tx to the usage tree, before the commit is logged
+func (tx *Tx) flushUsage() (err error) {
+	ok, err := tx.hasUsage()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return tx.initUsage()
+	}
+	if len(tx.usage) == 0 {
+		return nil
+	}
+	tree, err := tx.internalTree(USAGE_PATH)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.err = err
+		}
+	}()
+	// in order, replay builds the same tree
+	paths := make([]string, 0, len(tx.usage))
+	for path := range tx.usage {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	for _, path := range paths {
+		u := tx.usage[path]
+		if !u.reset && u.TreeUsage == (TreeUsage{}) {
+			continue
+		}
+		sum := treeUsage{TreeUsage: u.TreeUsage}
+		if !u.reset {
+			value, ok, err := tree.Get([]byte(path))
+			if err != nil {
+				return err
+			}
+			if ok {
+				old, err := decodeUsage(value)
+				if err != nil {
+					return err
+				}
+				sum.add(old)
+			}
+		}
+		if sum.TreeUsage == (TreeUsage{}) {
+			_, err = tree.Delete([]byte(path))
+		} else {
+			err = tree.Insert([]byte(path), encodeUsage(sum.TreeUsage))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.setBucketRoot([]byte(USAGE_PATH), tree.root)
+}
+
+// create the usage tree from a walk of the trees of the Tx
+func (tx *Tx) initUsage() (err error) {
+	walked, err := tx.walkUsage()
+	if err != nil {
+		return err
+	}
+	tree, err := tx.internalTree(USAGE_PATH)
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(walked))
+	for path := range walked {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	for _, path := range paths {
+		if walked[path] == (TreeUsage{}) {
+			continue
+		}
+		if err := tree.Insert([]byte(path), encodeUsage(walked[path])); err != nil {
+			tx.err = err
+			return err
+		}
+	}
+	return tx.setBucketRoot([]byte(USAGE_PATH), tree.root)
+}
+
+// the usage of every tree counted from their pages, by usage key
+func (tx *Tx) walkUsage() (trees map[string]TreeUsage, err error) {
+	defer catchTreeError(&err)
+	walk := func(root uint64) TreeUsage {
+		var shape treeShape
+		if root != 0 {
+			tx.walkTree(root, 1, &shape)
+		}
+		return TreeUsage{Keys: int64(shape.keys), Bytes: shape.bytes, Pages: int64(shape.pages())}
+	}
+	trees = map[string]TreeUsage{USAGE_KEYS: walk(tx.tree.root)}
+	paths, roots, err := tx.catalogScan(nil)
+	if err != nil {
+		return nil, err
+	}
+	for i, path := range paths {
+		if !bytes.HasPrefix(path, []byte{0, 2}) {
+			trees[string(path)] = walk(roots[i])
+		}
+	}
+	return trees, nil
+}
+
+// Usage returns the space taken by the keys of the Tx and of each bucket,
+// its own updates included, without walking the trees. The file and free
+// pages are those of the last commit.
+func (tx *Tx) Usage() (Usage, error) {
+	if tx.done {
+		return Usage{}, ErrTxClosed
+	}
+	db := tx.db
+	usage := Usage{PageSize: db.opts.pageSize}
+	db.mu.Lock()
+	usage.FilePages, usage.FreePages = db.page.flushed, db.free.total()
+	db.mu.Unlock()
+
+	ok, err := tx.hasUsage()
+	if err != nil {
+		return Usage{}, err
+	}
+	var walked map[string]TreeUsage
+	if !ok {
+		if walked, err = tx.walkUsage(); err != nil {
+			return Usage{}, err
+		}
+	}
+	tree, err := tx.internalTree(USAGE_PATH)
+	if err != nil {
+		return Usage{}, err
+	}
+	get := func(path string) (TreeUsage, error) {
+		if walked != nil {
+			return walked[path], nil
+		}
+		var u treeUsage
+		if d := tx.usage[path]; d == nil || !d.reset {
+			value, ok, err := tree.Get([]byte(path))
+			if err != nil {
+				return TreeUsage{}, err
+			}
+			if ok {
+				if u.TreeUsage, err = decodeUsage(value); err != nil {
+					return TreeUsage{}, err
+				}
+			}
+		}
+		if d := tx.usage[path]; d != nil {
+			u.add(d.TreeUsage)
+		}
+		return u.TreeUsage, nil
+	}
+	if usage.Keys, err = get(USAGE_KEYS); err != nil {
+		return Usage{}, err
+	}
+	paths, _, err := tx.catalogScan(nil)
+	if err != nil {
+		return Usage{}, err
+	}
+	trees := []TreeUsage{usage.Keys}
+	for _, path := range paths {
+		if bytes.HasPrefix(path, []byte{0, 2}) {
+			continue
+		}
+		u, err := get(string(path))
+		if err != nil {
+			return Usage{}, err
+		}
+		usage.Buckets = append(usage.Buckets, BucketUsage{Path: splitPath(path), TreeUsage: u})
+		trees = append(trees, u)
+	}
+	usage.OtherPages = int64(usage.FilePages) - int64(usage.FreePages)
+	for _, u := range trees {
+		usage.OtherPages -= u.Pages
+		usage.Fragmented += u.Pages*int64(usage.PageSize) - u.Bytes
+	}
+	usage.OtherPages = max(usage.OtherPages, 0)
+	return usage, nil
+}
+
+// Usage runs Tx.Usage on the last commit visible to readers.
+func (db *DB) Usage() (Usage, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return Usage{}, err
+	}
+	defer tx.Rollback()
+	return tx.Usage()
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// the counts kept by the commits match a walk of the trees
+func checkUsage(t *testing.T, db *DB) Usage {
+	t.Helper()
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+	usage, err := tx.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	walked, err := tx.walkUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Keys != walked[USAGE_KEYS] {
+		t.Fatalf("keys counted %+v, walked %+v", usage.Keys, walked[USAGE_KEYS])
+	}
+	for _, b := range usage.Buckets {
+		path := bucketPath(nil, b.Path[0])
+		for _, name := range b.Path[1:] {
+			path = bucketPath(path, name)
+		}
+		if b.TreeUsage != walked[string(path)] {
+			t.Fatalf("bucket %q counted %+v, walked %+v", b.Path, b.TreeUsage, walked[string(path)])
+		}
+	}
+	return usage
+}
+
+func TestUsage(t *testing.T) {
+	db := openTest(t, WithCheckpointSize(1<<40))
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 60; i++ {
+		tx, _ := db.Begin(true)
+		b, err := tx.Bucket([]byte("b"))
+		if err != nil {
+			b, _ = tx.CreateBucket([]byte("b"))
+		}
+		nested, err := b.Bucket([]byte("n"))
+		if err != nil {
+			nested, _ = b.CreateBucket([]byte("n"))
+		}
+		for j := 0; j < 50; j++ {
+			k := []byte(fmt.Sprint("k", r.Intn(500)))
+			v := make([]byte, r.Intn(200))
+			switch r.Intn(6) {
+			case 0:
+				tx.Del(k)
+			case 1:
+				b.Del(k)
+			case 2:
+				tx.Set(k, v)
+			case 3:
+				b.Set(k, v)
+			default:
+				nested.Set(k, v)
+			}
+		}
+		if i%10 == 0 {
+			// counts of the Tx itself
+			if _, err := tx.Usage(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage := checkUsage(t, db)
+	if len(usage.Buckets) != 2 || usage.Keys.Keys == 0 || usage.Buckets[1].Keys == 0 {
+		t.Fatalf("usage %+v", usage)
+	}
+	if usage.PageSize != BTREE_PAGE_SIZE || usage.FilePages == 0 || usage.FreeBytes() != int64(usage.FreePages)*BTREE_PAGE_SIZE {
+		t.Fatalf("file %+v", usage)
+	}
+	stats, _ := db.TreeStats()
+	if usage.Keys.Keys != int64(stats.Keys) || usage.Keys.Bytes != stats.KeyBytes {
+		t.Fatalf("usage %+v, tree stats %+v", usage.Keys, stats)
+	}
+
+	// replay counts the same
+	crashTest(db)
+	db = openTestPath(t, db.Path)
+	if replayed := checkUsage(t, db); replayed.Keys != usage.Keys || fmt.Sprint(replayed.Buckets) != fmt.Sprint(usage.Buckets) {
+		t.Fatalf("replayed %+v, was %+v", replayed, usage)
+	}
+
+	tx, _ := db.Begin(true)
+	tx.DeleteBucket([]byte("b"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if usage = checkUsage(t, db); len(usage.Buckets) != 0 {
+		t.Fatalf("buckets deleted %+v", usage.Buckets)
+	}
+}
@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	WAL_SIG        = "SEWAL-01"
+	WAL_SIG_SEALED = "SEWAL-E1" // of an encrypted file, see sealRecord
+
+	// WAL file layout
+	// | sig | database id | records... |
+	// | 8B  | 16B         |            |
+	// record layout, the checksum covers everything after it
+	// | crc32 | size | version | nops | ops... |
+	// | 4B    | 4B   | 8B      | 4B   |        |
+	// record layout sealed, the nops and ops encrypted
+	// | crc32 | size | version | epoch | nops and ops... | tag |
+	// | 4B    | 4B   | 8B      | 8B    |                 | 16B |
+	// op layout
+	// | type | klen | vlen | key | value |
+	// | 1B   | 2B   | 4B   | ... | ...   |
+	WAL_HEADER        = 8 + 16
+	WAL_RECORD_HEADER = 4 + 4 + 8
+	WAL_SHRED_CHUNK   = 1 << 16 // bytes of zeros written at once, see wal.shred
+
+	WAL_OP_SET = 1
+	WAL_OP_DEL = 2
+	// two-phase commit, the first op of a record, the key is the id.
+	// A prepare record holds the updates, the commit record of the same
+	// version publishes them, the rollback record discards them.
+	WAL_OP_PREPARE           = 3
+	WAL_OP_COMMIT_PREPARED   = 4
+	WAL_OP_ROLLBACK_PREPARED = 5
+	// buckets, the key is the path of the bucket. The SET and DEL ops
+	// following a BUCKET op update that bucket, an empty path for the keys
+	// outside buckets.
+	WAL_OP_BUCKET        = 6
+	WAL_OP_CREATE_BUCKET = 7
+	WAL_OP_DELETE_BUCKET = 8
+	// an operand of Merge buffered by an optimistic Tx, never in the WAL:
+	// it's logged as the SET of the merged value
+	WAL_OP_MERGE = 9
+	// the deadline of a key, see SetWithExpiry: 8 bytes of unix nanoseconds,
+	// big-endian, or empty when the key no longer expires
+	WAL_OP_EXPIRE = 10
+	// the position of a follower, see Follow: the id of the primary and
+	// the version of its last commit applied, 16 and 8 bytes big-endian,
+	// or empty when it's reset for a resync
+	WAL_OP_REPLICATED = 11
+	// the time of the commit, the last op of each record but those of
+	// 2PC prepares and rollbacks: 8 bytes of unix nanoseconds, big-endian
+	WAL_OP_TIME = 12
+	// a part of an entry of the audit log, see WithAuditLog: the key and
+	// the value of the entry
+	WAL_OP_AUDIT = 13
+)
+
+var ErrBadWAL = errors.New("bad WAL file")
+
+type walOp struct {
+	kind  byte
+	key   []byte
+	value []byte
+}
+
+// a committed Tx as recorded in the WAL
+type walRecord struct {
+	version uint64
+	ops     []walOp
+}
+
+// wal is the redo log of the commits since the last checkpoint.
+type wal struct {
+	fp     *os.File
+	size   atomic.Int64 // bytes written, including the header, read by Stats
+	cipher *pageCipher  // seals the records, nil if the file isn't encrypted
+}
+
+func walPath(path string) string {
+	return path + "-wal"
+}
+
+// open the WAL of the database, creating it if needed unless read-only:
+// a missing read-only WAL has no record. Its records are sealed with the
+// cipher of an encrypted file.
+func openWAL(path string, id DBID, readOnly bool, c *pageCipher) (*wal, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(walPath(path), flag, 0644)
+	if readOnly && errors.Is(err, os.ErrNotExist) {
+		return &wal{cipher: c}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open WAL: %w", err)
+	}
+	w := &wal{fp: fp, cipher: c}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("stat WAL: %w", err)
+	}
+	if fi.Size() == 0 && readOnly {
+		return w, nil
+	}
+	if fi.Size() == 0 {
+		if err := w.reset(id); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+	header := make([]byte, WAL_HEADER)
+	if _, err := fp.ReadAt(header, 0); err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("%w: read header: %v", ErrBadWAL, err)
+	}
+	switch sig := string(header[:8]); {
+	case sig != WAL_SIG && sig != WAL_SIG_SEALED:
+		fp.Close()
+		return nil, fmt.Errorf("%w: bad signature", ErrBadWAL)
+	case sig != w.sig():
+		fp.Close()
+		return nil, fmt.Errorf("%w: WAL sealed %v, the file encrypted %v", ErrEncryptionKey, sig == WAL_SIG_SEALED, c != nil)
+	}
+	if DBID(header[8:24]) != id {
+		fp.Close()
+		return nil, fmt.Errorf("%w: WAL belongs to database %s", ErrBadWAL, DBID(header[8:24]))
+	}
+	w.size.Store(fi.Size())
+	return w, nil
+}
+
+// the signature of the WAL, sealed if the file is encrypted
+func (w *wal) sig() string {
+	if w.cipher != nil {
+		return WAL_SIG_SEALED
+	}
+	return WAL_SIG
+}
+
+func (w *wal) close() error {
+	if w.fp == nil {
+		return nil
+	}
+	return w.fp.Close()
+}
+
+// overwrite the records with zeros, for WithSecureDelete: the blocks that
+// Truncate frees would keep them. A crash meanwhile leaves a WAL whose
+// records end at the first zeros, checkpointed already.
+func (w *wal) shred() error {
+	size := w.size.Load()
+	if size <= WAL_HEADER {
+		return nil
+	}
+	zeros := make([]byte, min(size-WAL_HEADER, WAL_SHRED_CHUNK))
+	for pos := int64(WAL_HEADER); pos < size; pos += int64(len(zeros)) {
+		if _, err := w.fp.WriteAt(zeros[:min(int64(len(zeros)), size-pos)], pos); err != nil {
+			return fmt.Errorf("shred WAL: %w", err)
+		}
+	}
+	if err := w.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync WAL: %w", err)
+	}
+	return nil
+}
+
+// empty the WAL, the records must be checkpointed already
+func (w *wal) reset(id DBID) error {
+	header := make([]byte, WAL_HEADER)
+	copy(header[:8], w.sig())
+	copy(header[8:], id[:])
+	if err := w.fp.Truncate(0); err != nil {
+		return fmt.Errorf("truncate WAL: %w", err)
+	}
+	if _, err := w.fp.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("write WAL: %w", err)
+	}
+	if err := w.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync WAL: %w", err)
+	}
+	w.size.Store(WAL_HEADER)
+	return nil
+}
+
+func encodeWALRecord(rec walRecord) []byte {
+	size := WAL_RECORD_HEADER + 4
+	for _, op := range rec.ops {
+		size += 1 + 2 + 4 + len(op.key) + len(op.value)
+	}
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint32(data[4:], uint32(size))
+	binary.LittleEndian.PutUint64(data[8:], rec.version)
+	binary.LittleEndian.PutUint32(data[16:], uint32(len(rec.ops)))
+	pos := WAL_RECORD_HEADER + 4
+	for _, op := range rec.ops {
+		data[pos] = op.kind
+		binary.LittleEndian.PutUint16(data[pos+1:], uint16(len(op.key)))
+		binary.LittleEndian.PutUint32(data[pos+3:], uint32(len(op.value)))
+		pos += 7
+		pos += copy(data[pos:], op.key)
+		pos += copy(data[pos:], op.value)
+	}
+	binary.LittleEndian.PutUint32(data[0:], crc32.ChecksumIEEE(data[4:]))
+	return data
+}
+
+func decodeWALRecord(data []byte) (walRecord, error) {
+	rec := walRecord{version: binary.LittleEndian.Uint64(data[8:])}
+	nops := binary.LittleEndian.Uint32(data[16:])
+	data = data[WAL_RECORD_HEADER+4:]
+	for i := uint32(0); i < nops; i++ {
+		if len(data) < 7 {
+			return rec, fmt.Errorf("%w: truncated op", ErrBadWAL)
+		}
+		op := walOp{kind: data[0]}
+		klen := int(binary.LittleEndian.Uint16(data[1:]))
+		vlen := int(binary.LittleEndian.Uint32(data[3:]))
+		data = data[7:]
+		if len(data) < klen+vlen {
+			return rec, fmt.Errorf("%w: truncated op", ErrBadWAL)
+		}
+		op.key, op.value = data[:klen], data[klen:klen+vlen]
+		data = data[klen+vlen:]
+		rec.ops = append(rec.ops, op)
+	}
+	return rec, nil
+}
+
+// append a record without waiting for it to be durable
+func (w *wal) append(rec walRecord) error {
+	data := encodeWALRecord(rec)
+	if w.cipher != nil {
+		data = w.cipher.sealRecord(data)
+	}
+	if _, err := w.fp.WriteAt(data, w.size.Load()); err != nil {
+		return fmt.Errorf("write WAL: %w", err)
+	}
+	w.size.Add(int64(len(data)))
+	return nil
+}
+
+// read the records in order, a torn record at the end is ignored
+func (w *wal) replay(fn func(rec walRecord) error) error {
+	end := w.size.Load()
+	if end < WAL_HEADER {
+		return nil // no WAL, or an empty one opened read-only
+	}
+	pos, err := readWALRecords(w.fp, WAL_HEADER, end, w.cipher, func(rec walRecord, _ int64) error {
+		return fn(rec)
+	})
+	if err != nil {
+		return err
+	}
+	// drop the torn tail so that new records follow the valid ones
+	w.size.Store(pos)
+	return nil
+}
+
+// read the records of a WAL file from pos, a record start, up to end and
+// return where the valid ones end; fn gets the position after the record.
+// The records are opened with the cipher if sealed, c nil otherwise.
+func readWALRecords(r io.ReaderAt, pos, end int64, c *pageCipher, fn func(rec walRecord, next int64) error) (int64, error) {
+	br := bufio.NewReader(io.NewSectionReader(r, pos, end-pos))
+	header := make([]byte, WAL_RECORD_HEADER)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return pos, nil // end of the log
+		}
+		size := int64(binary.LittleEndian.Uint32(header[4:]))
+		if size < WAL_RECORD_HEADER+4 || pos+size > end {
+			return pos, nil
+		}
+		data := make([]byte, size)
+		copy(data, header)
+		if _, err := io.ReadFull(br, data[WAL_RECORD_HEADER:]); err != nil {
+			return pos, nil
+		}
+		if crc32.ChecksumIEEE(data[4:]) != binary.LittleEndian.Uint32(data) {
+			return pos, nil
+		}
+		if c != nil {
+			var err error
+			if data, err = c.openRecord(data); err != nil {
+				return pos, err
+			}
+		}
+		rec, err := decodeWALRecord(data)
+		if err != nil {
+			return pos, err
+		}
+		if err := fn(rec, pos+size); err != nil {
+			return pos, err
+		}
+		pos += size
+	}
+}
+
+// Group commit: the first committer waiting for its record to be durable
+// becomes the leader and fsyncs the WAL for every record appended so far,
+// the others wait for it. When other writers are active, the leader waits up
+// to WithMaxBatchDelay so that their records join the same fsync.
+
+// wait until the record of the given version is durable
+func (db *DB) waitDurable(version uint64) error {
+	s := &db.sync
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.durable < version && s.err == nil {
+		if s.syncing {
+			s.done.Wait()
+			continue
+		}
+		s.syncing = true
+		s.mu.Unlock()
+		if db.opts.maxBatchDelay > 0 && atomic.LoadInt32(&db.writersActive) > 0 {
+			time.Sleep(db.opts.maxBatchDelay)
+		}
+		s.mu.Lock()
+		target := s.appended
+		s.mu.Unlock()
+		err := db.fsync(db.wal.fp)
+		s.mu.Lock()
+		s.syncing = false
+		if err != nil {
+			// the records may or may not be on disk, nothing can be trusted
+			s.err = fmt.Errorf("fsync WAL: %w", err)
+			db.log.Error("database failed, writes are refused until it's reopened", "err", s.err)
+		} else {
+			db.stats.walSyncs.Add(1)
+			db.stats.lastBatch.Store(target - s.durable)
+			if batch := target - s.durable; batch > db.stats.largestBatch.Load() {
+				db.stats.largestBatch.Store(batch)
+			}
+			db.stats.commits.Add(target - s.durable)
+			s.durable = target
+			db.publish(target)
+		}
+		s.done.Broadcast()
+	}
+	return s.err
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// leave the DB as a crash would: the background tasks stop and the files
+// are closed, with no checkpoint
+func crashTest(db *DB) {
+	db.stopReplica()
+	db.stopScrubber()
+	db.stopRekey()
+	db.stopFlusher()
+	db.stopSyncer()
+	db.stopSweeper()
+	db.closed.Store(true)
+	db.wal.close()
+	db.pager.close()
+	db.fp.Close()
+}
+
+func TestRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	ref := map[string]string{}
+	r := rand.New(rand.NewSource(5))
+	for round := 0; round < 6; round++ {
+		db, err := Open(path, WithCheckpointSize(int64(r.Intn(200000))))
+		if err != nil {
+			t.Fatal(round, err)
+		}
+		for k, v := range ref {
+			wantValue(t, db, k, []byte(v))
+		}
+		for i := 0; i < 300; i++ {
+			tx, _ := db.Begin(true)
+			for j := 0; j < 4; j++ {
+				k := fmt.Sprint("k", r.Intn(1000))
+				if r.Intn(4) == 0 {
+					tx.Del([]byte(k))
+					delete(ref, k)
+					continue
+				}
+				v := fmt.Sprint(r.Int63(), string(make([]byte, r.Intn(300))))
+				tx.Set([]byte(k), []byte(v))
+				ref[k] = v
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if round%2 == 0 {
+			crashTest(db)
+		} else if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	db := openTest(t, WithMaxBatchDelay(time.Millisecond))
+	const writers, commits = 16, 50
+	// the writers queue up behind this Tx, so that the first fsync waits
+	held, _ := db.Begin(true)
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < commits; i++ {
+				if err := db.Set([]byte(fmt.Sprint(g, "-", i)), []byte("v")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	for atomic.LoadInt32(&db.writersActive) <= writers {
+		time.Sleep(time.Millisecond)
+	}
+	held.Set([]byte("held"), []byte("v"))
+	if err := held.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	s := db.Stats()
+	if s.Commits != writers*commits+1 {
+		t.Fatalf("%d commits, want %d", s.Commits, writers*commits+1)
+	}
+	if s.WALSyncs >= s.Commits || s.LargestBatch < 2 {
+		t.Fatalf("%d fsyncs for %d commits, largest batch %d", s.WALSyncs, s.Commits, s.LargestBatch)
+	}
+	db = reopenTest(t, db)
+	for g := 0; g < writers; g++ {
+		for i := 0; i < commits; i++ {
+			wantValue(t, db, fmt.Sprint(g, "-", i), []byte("v"))
+		}
+	}
+}
+
+// the records shredded read as the end of the log, sealed or not
+func TestWALShred(t *testing.T) {
+	c, _ := newPageCipher(keyTest(1))
+	for _, c := range []*pageCipher{nil, c} {
+		path := filepath.Join(t.TempDir(), "test.db")
+		w, err := openWAL(path, DBID{1}, false, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.close()
+		if err := w.reset(DBID{1}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			w.append(walRecord{version: uint64(i + 1), ops: []walOp{{kind: WAL_OP_SET, key: []byte("k"), value: []byte("secret value")}}})
+		}
+		size := w.size.Load()
+		if err := w.shred(); err != nil {
+			t.Fatal(err)
+		}
+		data := readFileTest(t, walPath(path))
+		if int64(len(data)) != size || string(data[:8]) != w.sig() || bytes.ContainsFunc(data[WAL_HEADER:], func(r rune) bool { return r != 0 }) {
+			t.Fatalf("WAL of %d bytes after the shred, %d before", len(data), size)
+		}
+		n := 0
+		if err := w.replay(func(walRecord) error { n++; return nil }); err != nil || n != 0 || w.size.Load() != WAL_HEADER {
+			t.Fatalf("%d records replayed, %d bytes: %v", n, w.size.Load(), err)
+		}
+	}
+}
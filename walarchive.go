@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// WAL archive: with WithWALArchiveSize, each checkpoint copies the WAL to a
+// segment next to it before emptying it, path-wal.<version> with the
+// version of its last commit in hex. The oldest segments are removed once
+// they take more than that size, the last one stays. The segments then the
+// WAL hold the commits in order, as read by a walReader.
+
+const WAL_READ_SIZE = 1 << 20 // bytes of records returned by walReader.next at most
+
+// ErrWALGone is a walReader behind the commits kept by the WAL archive.
+var ErrWALGone = errors.New("WAL records no longer kept")
+
+func walSegmentPath(path string, version uint64) string {
+	return fmt.Sprintf("%s.%016x", walPath(path), version)
+}
+
+// the versions of the segments of the archive, in order
+func walSegments(path string) ([]uint64, error) {
+	names, err := filepath.Glob(walPath(path) + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var versions []uint64
+	for _, name := range names {
+		suffix := name[len(walPath(path))+1:]
+		if len(suffix) != 16 {
+			continue // a copy not renamed yet
+		}
+		if v, err := strconv.ParseUint(suffix, 16, 64); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+// empty the WAL once checkpointed, archived first with WithWALArchiveSize:
+// an archive that fails is logged, the followers behind resync
+func (db *DB) resetWAL() error {
+	db.archive.mu.Lock()
+	defer db.archive.mu.Unlock()
+	if db.opts.walArchiveSize > 0 {
+		if err := db.archiveWAL(); err != nil {
+			db.log.Warn("WAL archive failed", "err", err)
+		}
+	}
+	db.archive.gen++
+	if db.opts.secureDelete {
+		if err := db.wal.shred(); err != nil {
+			return err
+		}
+	}
+	return db.wal.reset(db.info.ID)
+}
+
+// copy the WAL to a segment and prune the archive
+func (db *DB) archiveWAL() error {
+	size := db.wal.size.Load()
+	if size <= WAL_HEADER {
+		return nil
+	}
+	name := walSegmentPath(db.Path, db.version)
+	fp, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fp, io.NewSectionReader(db.wal.fp, 0, size))
+	if err == nil {
+		err = db.fsync(fp)
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return db.pruneWALArchive()
+}
+
+// remove the oldest segments past the size of WithWALArchiveSize
+func (db *DB) pruneWALArchive() error {
+	versions, err := walSegments(db.Path)
+	if err != nil {
+		return err
+	}
+	var kept int64
+	for i := len(versions) - 1; i >= 0; i-- {
+		name := walSegmentPath(db.Path, versions[i])
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if kept += fi.Size(); kept > db.opts.walArchiveSize && i < len(versions)-1 {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walReader reads the commits after a version, from the archive then the
+// WAL, up to the last one visible: for the followers of ServeReplication.
+// A prepared Tx is read at its commit, the records of a rollback are
+// skipped, and those copied twice by a checkpoint that failed read once.
+type walReader struct {
+	db       *DB
+	version  uint64 // of the last commit read
+	segment  uint64 // the segment being read, 0 if none
+	live     bool   // reading the WAL of generation gen
+	gen      uint64
+	pos      int64 // of the next record in the segment or the WAL
+	prepared *walRecord
+}
+
+func (db *DB) newWALReader(version uint64) *walReader {
+	return &walReader{db: db, version: version}
+}
+
+var errWALStop = errors.New("stop")
+
+// the next commits, none if the reader is at the last visible one
+func (r *walReader) next() ([]walRecord, error) {
+	db := r.db
+	db.archive.mu.RLock()
+	defer db.archive.mu.RUnlock()
+	if db.closed.Load() {
+		return nil, ErrDBClosed
+	}
+	visible := db.visible.Load().version
+	var recs []walRecord
+	size := 0
+	for r.version < visible {
+		if r.live && r.gen != db.archive.gen {
+			r.live = false // archived meanwhile, found again by version
+		}
+		if r.segment == 0 && !r.live {
+			if err := r.locate(); err != nil {
+				return nil, err
+			}
+		}
+		src, end, err := r.open()
+		if err != nil {
+			return nil, err
+		}
+		pos, err := readWALRecords(src, r.pos, end, r.db.wal.cipher, func(rec walRecord, next int64) error {
+			rec, ok, err := r.resolve(rec, visible)
+			if err != nil || !ok {
+				if err == nil {
+					r.pos = next
+				}
+				return err
+			}
+			size += int(next - r.pos)
+			r.version, r.pos = rec.version, next
+			recs = append(recs, rec)
+			if size >= WAL_READ_SIZE {
+				return errWALStop
+			}
+			return nil
+		})
+		if !r.live {
+			src.(*os.File).Close()
+		}
+		if err == errWALStop {
+			break
+		}
+		if errors.Is(err, ErrEncryptionKey) && !r.live {
+			// sealed before a rotation, its key is gone
+			return nil, fmt.Errorf("%w: segment %016x: %v", ErrWALGone, r.segment, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.pos = pos
+		if r.live {
+			if r.version < visible {
+				return nil, fmt.Errorf("%w: WAL ends at version %d", ErrWALGone, r.version)
+			}
+			break
+		}
+		r.segment = 0
+	}
+	return recs, nil
+}
+
+// the segment being read and its size, or the WAL and its end
+func (r *walReader) open() (io.ReaderAt, int64, error) {
+	if r.live {
+		return r.db.wal.fp, r.db.wal.size.Load(), nil
+	}
+	fp, err := os.Open(walSegmentPath(r.db.Path, r.segment))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, fmt.Errorf("%w: segment %016x removed", ErrWALGone, r.segment)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, 0, err
+	}
+	return fp, fi.Size(), nil
+}
+
+// the first segment with commits after the version of the reader, or the WAL
+func (r *walReader) locate() error {
+	versions, err := walSegments(r.db.Path)
+	if err != nil {
+		return err
+	}
+	r.pos = WAL_HEADER
+	for _, v := range versions {
+		if v > r.version {
+			r.segment = v
+			return nil
+		}
+	}
+	r.live, r.gen = true, r.db.archive.gen
+	return nil
+}
+
+// the commit of a record, false if there's none: a prepare, a rollback, or
+// an older commit. errWALStop past the visible version.
+func (r *walReader) resolve(rec walRecord, visible uint64) (walRecord, bool, error) {
+	if len(rec.ops) > 0 {
+		switch rec.ops[0].kind {
+		case WAL_OP_PREPARE:
+			r.prepared = &rec
+			return rec, false, nil
+		case WAL_OP_ROLLBACK_PREPARED:
+			r.prepared = nil
+			return rec, false, nil
+		case WAL_OP_COMMIT_PREPARED:
+			if rec.version > visible {
+				return rec, false, errWALStop
+			}
+			if rec.version <= r.version {
+				r.prepared = nil
+				return rec, false, nil
+			}
+			if r.prepared == nil {
+				return rec, false, fmt.Errorf("%w: commit of unknown prepared transaction %q", ErrBadWAL, rec.ops[0].key)
+			}
+			ops := r.prepared.ops
+			rec.ops, r.prepared = append(ops[1:len(ops):len(ops)], rec.ops[1:]...), nil
+		}
+	}
+	switch {
+	case rec.version <= r.version:
+		return rec, false, nil
+	case rec.version > visible:
+		return rec, false, errWALStop
+	case rec.version != r.version+1:
+		return rec, false, fmt.Errorf("%w: version %d follows %d in the archive", ErrWALGone, rec.version, r.version)
+	}
+	return rec, true, nil
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// read the commits after version with r until the last visible one
+func readWALTest(t *testing.T, r *walReader) []walRecord {
+	t.Helper()
+	var all []walRecord
+	for {
+		recs, err := r.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) == 0 {
+			return all
+		}
+		all = append(all, recs...)
+	}
+}
+
+func TestWALArchive(t *testing.T) {
+	db := openTest(t, WithWALArchiveSize(1<<30), WithCheckpointSize(1<<40))
+	r := db.newWALReader(0)
+	for i := 1; i <= 300; i++ {
+		mustSet(t, db, fmt.Sprint("k", i), fmt.Sprintf("%0500d", i))
+		if i%50 == 0 {
+			if err := db.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// read from the WAL, then from the segment it's archived to
+		if i%40 == 0 {
+			readWALTest(t, r)
+		}
+	}
+	segments, err := walSegments(db.Path)
+	if err != nil || len(segments) != 6 || segments[0] != 50 || segments[5] != 300 {
+		t.Fatalf("segments %v: %v", segments, err)
+	}
+	mustSet(t, db, "last", "x")
+	recs := append(readWALTest(t, db.newWALReader(0)), readWALTest(t, db.newWALReader(299))...)
+	if len(recs) != 303 {
+		t.Fatalf("%d commits read", len(recs))
+	}
+	for i, rec := range recs[:301] {
+		if rec.version != uint64(i+1) {
+			t.Fatalf("commit %d of version %d", i, rec.version)
+		}
+	}
+	if readWALTest(t, r); r.version != 301 {
+		t.Fatalf("reader at version %d", r.version)
+	}
+
+	// the oldest segments are removed past the size, the last one stays;
+	// Close archived 301
+	fi, _ := os.Stat(walSegmentPath(db.Path, 300))
+	db = reopenTest(t, db, WithWALArchiveSize(fi.Size()))
+	mustSet(t, db, "more", "x")
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if segments, _ := walSegments(db.Path); fmt.Sprint(segments) != "[301 302]" {
+		t.Fatalf("segments %v after pruning", segments)
+	}
+	if _, err := db.newWALReader(0).next(); err == nil {
+		t.Fatal("read of pruned commits")
+	}
+	db = reopenTest(t, db, WithWALArchiveSize(1))
+	mustSet(t, db, "again", "x")
+	db.Checkpoint()
+	if segments, _ := walSegments(db.Path); fmt.Sprint(segments) != "[303]" {
+		t.Fatalf("segments %v past the size", segments)
+	}
+
+	// copies not renamed yet aren't segments
+	os.WriteFile(walSegmentPath(db.Path, 400)+".tmp", nil, 0o644)
+	if segments, _ := walSegments(db.Path); fmt.Sprint(segments) != "[303]" {
+		t.Fatalf("segments %v with a temporary copy", segments)
+	}
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Watchers get the changes to the keys outside buckets once the commits
+// making them are visible to readers, in commit order. The events of a
+// commit are built while it's logged, before the writer lock is released:
+// the old values are read from the tree of the previous commit.
+//
+// Each watcher queues the events of the commits its goroutine hasn't sent
+// yet, a commit never waits for a slow watcher, the queue grows instead.
+
+type EventOp int
+
+const (
+	EventSet EventOp = iota + 1
+	EventDelete
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is the change of a key by a commit. Old is nil if the key was
+// absent, New if it's deleted. Several updates of the key by the same Tx
+// are a single event with the value before and after the Tx. The slices
+// are shared by the watchers and must not be modified.
+type Event struct {
+	Op      EventOp
+	Key     []byte
+	Old     []byte
+	New     []byte
+	Version uint64 // the commit
+}
+
+type watcher struct {
+	prefix []byte
+	ch     chan Event
+	mu     sync.Mutex
+	ready  *sync.Cond // signaled when queue grows or the watcher stops
+	queue  []Event
+	done   bool
+}
+
+// the watchers of a DB and the events of the commits not visible yet
+type watchers struct {
+	mu      sync.Mutex
+	active  map[*watcher]struct{}
+	n       atomic.Int32 // len(active), read by commits without the lock
+	pending []Event      // in version order
+}
+
+// Watch returns the events of the commits changing keys that start with
+// the prefix, a nil prefix watches every key. The channel is closed once
+// ctx is done or the DB is closed, events not received by then are lost.
+// Expired keys are deleted by the sweeper, not when their deadline passes.
+func (db *DB) Watch(ctx context.Context, prefix []byte) <-chan Event {
+	w := &watcher{prefix: append([]byte(nil), prefix...), ch: make(chan Event)}
+	w.ready = sync.NewCond(&w.mu)
+	ws := &db.watch
+	ws.mu.Lock()
+	if db.closed.Load() {
+		ws.mu.Unlock()
+		close(w.ch)
+		return w.ch
+	}
+	if ws.active == nil {
+		ws.active = map[*watcher]struct{}{}
+	}
+	ws.active[w] = struct{}{}
+	ws.n.Store(int32(len(ws.active)))
+	ws.mu.Unlock()
+	stop := context.AfterFunc(ctx, func() { ws.remove(w) })
+	go func() {
+		defer stop()
+		w.run(ctx)
+	}()
+	return w.ch
+}
+
+// send the queued events until the watcher stops
+func (w *watcher) run(ctx context.Context) {
+	defer close(w.ch)
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.done {
+			w.ready.Wait()
+		}
+		if w.done {
+			w.mu.Unlock()
+			return
+		}
+		ev := w.queue[0]
+		w.queue[0] = Event{}
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+		select {
+		case w.ch <- ev:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *watcher) stop() {
+	w.mu.Lock()
+	w.done = true
+	w.queue = nil
+	w.ready.Signal()
+	w.mu.Unlock()
+}
+
+func (ws *watchers) remove(w *watcher) {
+	ws.mu.Lock()
+	delete(ws.active, w)
+	ws.n.Store(int32(len(ws.active)))
+	ws.mu.Unlock()
+	w.stop()
+}
+
+// stop every watcher, the DB is closed
+func (ws *watchers) close() {
+	ws.mu.Lock()
+	active := ws.active
+	ws.active = nil
+	ws.n.Store(0)
+	ws.pending = nil
+	ws.mu.Unlock()
+	for w := range active {
+		w.stop()
+	}
+}
+
+// whether a watcher is interested in the key
+func (ws *watchers) watching(key []byte) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.active {
+		if bytes.HasPrefix(key, w.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// queue the events of a commit until it's visible, commits come in order
+// under the writer lock
+func (ws *watchers) add(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	ws.mu.Lock()
+	if ws.active != nil {
+		ws.pending = append(ws.pending, events...)
+	}
+	ws.mu.Unlock()
+}
+
+// hand the events of the commits up to version to the watchers
+func (ws *watchers) deliver(version uint64) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	n := 0
+	for ; n < len(ws.pending) && ws.pending[n].Version <= version; n++ {
+	}
+	if n == 0 {
+		return
+	}
+	for w := range ws.active {
+		w.mu.Lock()
+		for _, ev := range ws.pending[:n] {
+			if bytes.HasPrefix(ev.Key, w.prefix) {
+				w.queue = append(w.queue, ev)
+			}
+		}
+		w.ready.Signal()
+		w.mu.Unlock()
+	}
+	ws.pending = append(ws.pending[:0], ws.pending[n:]...)
+}
+
+// the events of the updates of a writable Tx, the caller holds the writer
+// lock so that the last commit is the one the Tx updates
+func (tx *Tx) watchEvents(version uint64) (events []Event, err error) {
+	db := tx.db
+	ws := &db.watch
+	if ws.n.Load() == 0 {
+		return nil, nil
+	}
+	old := tx.tree
+	db.mu.Lock()
+	old.root = db.root
+	db.mu.Unlock()
+	seen := map[string]bool{}
+	inBucket := false
+	for _, op := range tx.ops {
+		switch op.kind {
+		case WAL_OP_BUCKET:
+			inBucket = len(op.key) > 0
+			continue
+		case WAL_OP_SET, WAL_OP_DEL:
+		default:
+			continue
+		}
+		if inBucket || seen[string(op.key)] {
+			continue
+		}
+		seen[string(op.key)] = true
+		if !ws.watching(op.key) {
+			continue
+		}
+		before, existed, err := old.Get(op.key)
+		if err != nil {
+			return nil, err
+		}
+		after, exists, err := tx.tree.Get(op.key)
+		if err != nil {
+			return nil, err
+		}
+		if !existed && !exists {
+			continue
+		}
+		ev := Event{Op: EventSet, Key: op.key, Version: version}
+		if existed {
+			ev.Old = append([]byte{}, before...)
+		}
+		if exists {
+			ev.New = append([]byte{}, after...)
+		} else {
+			ev.Op = EventDelete
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncNever} {
+		t.Run(policy.String(), func(t *testing.T) {
+			db := openTest(t, WithSyncPolicy(policy))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			prefixed := db.Watch(ctx, []byte("a"))
+			all := db.Watch(context.Background(), nil)
+			mustSet(t, db, "a1", "x")
+			mustSet(t, db, "b1", "x")
+			mustSet(t, db, "a1", "y")
+			db.Del([]byte("a1"))
+			tx, _ := db.Begin(true)
+			tx.Set([]byte("a2"), []byte("1"))
+			tx.Set([]byte("a2"), []byte("2"))
+			b, _ := tx.CreateBucket([]byte("a"))
+			b.Set([]byte("a3"), []byte("z"))
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []string{"set a1  x", "set a1 x y", "delete a1 y ", "set a2  2"} {
+				select {
+				case ev := <-prefixed:
+					if got := fmt.Sprintf("%v %s %s %s", ev.Op, ev.Key, ev.Old, ev.New); got != want {
+						t.Fatalf("event %q, want %q", got, want)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("no event %q", want)
+				}
+			}
+
+			go func() {
+				for i := 0; i < 100; i++ {
+					db.Set([]byte(fmt.Sprint("c", i)), nil)
+				}
+			}()
+			var last uint64
+			for n := 0; n < 105; n++ {
+				ev := <-all
+				if ev.Version <= last {
+					t.Fatalf("event of version %d after %d", ev.Version, last)
+				}
+				last = ev.Version
+			}
+
+			cancel()
+			for ev := range prefixed {
+				t.Fatalf("event %v after the cancel", ev)
+			}
+			db.Close()
+			if _, ok := <-all; ok {
+				t.Fatal("channel left open by Close")
+			}
+		})
+	}
+}